@@ -1,57 +1,223 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/certfix/certfix-agent/pkg/breaker"
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/cloudmeta"
+	"github.com/certfix/certfix-agent/pkg/containers"
+	"github.com/certfix/certfix-agent/pkg/cron"
+	"github.com/certfix/certfix-agent/pkg/dnscheck"
+	"github.com/certfix/certfix-agent/pkg/fips"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/kubernetes"
+	"github.com/certfix/certfix-agent/pkg/metrics"
+	"github.com/certfix/certfix-agent/pkg/limits"
+	"github.com/certfix/certfix-agent/pkg/lockfile"
 	"github.com/certfix/certfix-agent/pkg/machineidentifier"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/netinfo"
+	"github.com/certfix/certfix-agent/pkg/platform"
+	"github.com/certfix/certfix-agent/pkg/pqc"
+	"github.com/certfix/certfix-agent/pkg/redact"
+	"github.com/certfix/certfix-agent/pkg/sandbox"
+	"github.com/certfix/certfix-agent/pkg/scanner"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+	"github.com/certfix/certfix-agent/pkg/spiffe"
+	"github.com/certfix/certfix-agent/pkg/webserver"
 )
 
 const (
-	CONFIG_FILE       = "/etc/certfix-agent/config.json"
 	DEFAULT_VERSION   = "0.0.0"
 	HEARTBEAT_INTERVAL = 5 * time.Minute
+	INVENTORY_INTERVAL = 1 * time.Hour
 	REGISTER_RETRY_DELAY = 30 * time.Second
+	API_FAILURE_THRESHOLD = 3
+	API_COOLDOWN = 1 * time.Minute
 )
 
+// Locations differ per OS; see pkg/platform
+var (
+	CONFIG_FILE = platform.ConfigFile()
+	STATE_DIR   = platform.StateDir()
+)
+
+// Superseded by the state database; imported once on upgrade
+var SCAN_CACHE_FILE = filepath.Join(STATE_DIR, "scan-cache.json")
+
+// Shared by every periodic API call so an outage backs all of them off at once
+var apiBreaker = breaker.New(API_FAILURE_THRESHOLD, API_COOLDOWN)
+
 type Config struct {
-	Token          string `json:"token"`
-	Endpoint       string `json:"endpoint"`
-	CurrentVersion string `json:"current_version,omitempty"`
-	Architecture   string `json:"architecture,omitempty"`
+	Token                string                     `json:"token"`
+	Endpoint             string                     `json:"endpoint"`
+	CurrentVersion       string                     `json:"current_version,omitempty"`
+	Architecture         string                     `json:"architecture,omitempty"`
+	CertPaths            []string                   `json:"cert_paths,omitempty"`
+	Sandbox              bool                       `json:"sandbox,omitempty"`
+	KnownAddresses       []string                   `json:"known_addresses,omitempty"`
+	ExcludeInterfaces    []string                   `json:"exclude_interfaces,omitempty"`
+	DisableCloudMetadata bool                       `json:"disable_cloud_metadata,omitempty"`
+	DisableAIAFetch      bool                       `json:"disable_aia_fetch,omitempty"`
+	ServiceAllowlist     []string                   `json:"service_allowlist,omitempty"`
+	ServiceValidators    map[string][]string        `json:"service_validators,omitempty"`
+	ScriptPublicKeys     []string                   `json:"script_public_keys,omitempty"`
+	ScriptUser           string                     `json:"script_user,omitempty"`
+	Scan                 ScanConfig                 `json:"scan,omitempty"`
+	Schedule             *ScheduleConfig            `json:"schedule,omitempty"`
+	Watch                *WatchConfig               `json:"watch,omitempty"`
+	DNSCacheTTL          int                        `json:"dns_cache_ttl,omitempty"`
+	HTTPVersion          string                     `json:"http_version,omitempty"`
+	TLS                  TLSConfig                  `json:"tls,omitempty"`
+	Bandwidth            *BandwidthConfig           `json:"bandwidth,omitempty"`
+	DNS                  *DNSConfig                 `json:"dns,omitempty"`
+	Network              *NetworkConfig             `json:"network,omitempty"`
+	Resources            *ResourcesConfig           `json:"resources,omitempty"`
+	Metered              *MeteredConfig             `json:"metered,omitempty"`
+	SPIFFE               *SPIFFEConfig              `json:"spiffe,omitempty"`
+	FIPS                 bool                       `json:"fips,omitempty"`
+	Kubernetes           *KubernetesConfig          `json:"kubernetes,omitempty"`
+	SDS                  *SDSConfig                 `json:"sds,omitempty"`
+	DNSProviders         map[string]json.RawMessage `json:"dns_providers,omitempty"`
+	Secrets              map[string]json.RawMessage `json:"secrets,omitempty"`
+	Notifications        *NotificationsConfig       `json:"notifications,omitempty"`
+	PluginDir            string                     `json:"plugin_dir,omitempty"`
+	HooksDir             string                     `json:"hooks_dir,omitempty"`
+	ProxyHosts           []ProxyHostConfig          `json:"proxy_hosts,omitempty"`
+	Drift                *DriftConfig               `json:"drift,omitempty"`
+	TLSObserver          *TLSObserverConfig         `json:"tls_observer,omitempty"`
+	ACME                 *ACMEConfig                `json:"acme,omitempty"`
+	Dashboard            *DashboardConfig           `json:"dashboard,omitempty"`
+	TrustStore           *TrustStoreConfig          `json:"trust_store,omitempty"`
+	Stapling             *StaplingConfig            `json:"ocsp_stapling,omitempty"`
+	Metrics              *MetricsConfig             `json:"metrics,omitempty"`
+	Backup               *BackupConfig              `json:"backup,omitempty"`
+	Verify               *VerifyConfig              `json:"verify,omitempty"`
+	Tenants              []TenantConfig             `json:"tenants,omitempty"`
+
+	// Set on the configuration derived for each tenant
+	tenant string
+}
+
+// Envoy Secret Discovery Service: Listen is the "unix:/path" socket for
+// gRPC SDS (REST-JSON with APIType "rest"), Dir receives files for
+// path-based SDS. AllowedUIDs and AllowedGIDs name the users, besides
+// root, that may connect to the socket.
+type SDSConfig struct {
+	Listen      string      `json:"listen,omitempty"`
+	APIType     string      `json:"api_type,omitempty"`
+	AllowedUIDs []int       `json:"allowed_uids,omitempty"`
+	AllowedGIDs []int       `json:"allowed_gids,omitempty"`
+	Dir         string      `json:"dir,omitempty"`
+	Secrets     []SDSSecret `json:"secrets"`
+}
+
+type SDSSecret struct {
+	Name     string `json:"name"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// DaemonSet mode: each node registers as its own instance
+type KubernetesConfig struct {
+	HostRoot string `json:"host_root,omitempty"`
+}
+
+type TLSConfig struct {
+	MinVersion         string   `json:"min_version,omitempty"`
+	CipherSuites       []string `json:"cipher_suites,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+	Pins               []string `json:"pins,omitempty"`
+}
+
+// Caps on the agent's traffic in kilobits per second, for branch sites on
+// thin WAN links; zero or unset leaves a direction unlimited
+type BandwidthConfig struct {
+	UploadKbps   int64 `json:"upload_kbps,omitempty"`
+	DownloadKbps int64 `json:"download_kbps,omitempty"`
+}
+
+// DNS over HTTPS or TLS for the agent's own lookups: DNS-01 propagation
+// checks, CAA records and endpoint scans. API calls keep the system's DNS.
+type DNSConfig struct {
+	// https://host/dns-query for DNS over HTTPS, tls://host[:port] for DNS
+	// over TLS
+	Resolver string `json:"resolver"`
+	// Addresses of the resolver's host, so reaching it doesn't depend on
+	// the local DNS
+	Bootstrap []string `json:"bootstrap,omitempty"`
+}
+
+// Outbound connections race the addresses of dual-stack hosts (Happy
+// Eyeballs), starting with the preferred family
+type NetworkConfig struct {
+	// "ipv4", "ipv6", or "auto" (default) for the system's address order;
+	// the preferred family's address is also the one reported
+	Prefer string `json:"prefer,omitempty"`
+	// Wait before racing the next address; 250 by default
+	AttemptDelayMs int `json:"attempt_delay_ms,omitempty"`
+}
+
+// Caps on what the agent itself uses, so scans and deployments never
+// compete with the workload on the host; the limits of the agent's cgroup
+// (container, or systemd CPUQuota=/MemoryMax=) apply too
+type ResourcesConfig struct {
+	// CPUs the agent may keep busy, e.g. 0.5 for half a core
+	MaxCPUs float64 `json:"max_cpus,omitempty"`
+	// Memory the agent aims to stay under, in MiB
+	MaxMemoryMB int64 `json:"max_memory_mb,omitempty"`
 }
 
-type InstanceData struct {
-	MachineID    string                 `json:"machine_id"`
-	Hostname     string                 `json:"hostname"`
-	OSType       string                 `json:"os_type"`
-	OSVersion    string                 `json:"os_version"`
-	Architecture string                 `json:"architecture"`
-	IPAddress    string                 `json:"ip_address,omitempty"`
-	MACAddress   string                 `json:"mac_address,omitempty"`
-	AgentVersion string                 `json:"agent_version"`
-	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+// SVID files written by a SPIRE agent; Dir supplies the spiffe-helper
+// default file names for anything not set explicitly
+type SPIFFEConfig struct {
+	Dir        string `json:"dir,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	BundleFile string `json:"bundle_file,omitempty"`
+	// ServerID is the API server's SPIFFE ID; any ID in the agent's trust
+	// domain is accepted when empty
+	ServerID string `json:"server_id,omitempty"`
 }
 
-type RegisterResponse struct {
-	InstanceID  string `json:"instance_id"`
-	KeyID       string `json:"key_id"`
-	ServiceHash string `json:"service_hash"`
-	ServiceName string `json:"service_name"`
-	Status      string `json:"status"`
-	Message     string `json:"message"`
+type ScanConfig struct {
+	Paths          []string `json:"paths,omitempty"`
+	Endpoints      []string `json:"endpoints,omitempty"`
+	Exclude        []string `json:"exclude,omitempty"`
+	Workers        int      `json:"workers,omitempty"`
+	FilesPerSecond int      `json:"files_per_second,omitempty"`
+}
+
+// Clock skew measured from API response Date headers
+var clockTracker = &clockcheck.Tracker{}
+
+// Build an API client for the configured endpoint; clients are cheap and
+// share the skew tracker and the pooled transport
+func apiClient(config *Config) *client.Client {
+	tokenMu.RLock()
+	token := config.Token
+	tokenMu.RUnlock()
+	return client.New(client.Options{
+		Endpoint:      config.Endpoint,
+		Token:         token,
+		Clock:         clockTracker,
+		OnDeprecation: onAPIDeprecation,
+		Observe:       observeAPI,
+	})
 }
 
 // Load configuration from file
@@ -66,14 +232,24 @@ func loadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	if config.Token == "" {
+	// An SVID authenticates the agent in place of the token
+	if config.Token == "" && config.SPIFFE == nil {
 		return nil, fmt.Errorf("token is required in config file")
 	}
+	redact.AddSecret(config.Token)
 
 	if config.Endpoint == "" {
 		return nil, fmt.Errorf("endpoint is required in config file")
 	}
 
+	redactTenantTokens(&config)
+	if err := validateTenants(&config); err != nil {
+		return nil, err
+	}
+	if _, _, err := config.Schedule.parse(); err != nil {
+		return nil, err
+	}
+
 	// Set default version if not specified
 	if config.CurrentVersion == "" {
 		config.CurrentVersion = DEFAULT_VERSION
@@ -121,172 +297,403 @@ func getHostname() string {
 
 // Get OS version
 func getOSVersion() string {
-	switch runtime.GOOS {
-	case "linux":
-		// Try to read /etc/os-release
-		data, err := os.ReadFile("/etc/os-release")
-		if err == nil {
-			lines := strings.Split(string(data), "\n")
-			for _, line := range lines {
-				if strings.HasPrefix(line, "PRETTY_NAME=") {
-					return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), "\"")
-				}
-			}
-		}
-		
-		// Fallback to uname
-		cmd := exec.Command("uname", "-r")
-		output, err := cmd.Output()
-		if err == nil {
-			return strings.TrimSpace(string(output))
-		}
-	case "darwin":
-		cmd := exec.Command("sw_vers", "-productVersion")
-		output, err := cmd.Output()
-		if err == nil {
-			return "macOS " + strings.TrimSpace(string(output))
-		}
-	}
-	return "unknown"
+	return platform.OSVersion()
 }
 
-// Get primary IP address
-func getIPAddress() string {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return ""
+// Collect instance data
+func collectInstanceData(config *Config) (*client.InstanceData, error) {
+	// In a DaemonSet the node is the instance, not the pod
+	if config.Kubernetes != nil {
+		return collectNodeInstanceData(config)
 	}
 
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
-		}
+	// Generate machine ID
+	machineID, err := machineidentifier.GenerateMachineID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate machine ID: %w", err)
 	}
-	return ""
-}
 
-// Get MAC address of primary interface
-func getMACAddress() string {
-	interfaces, err := net.Interfaces()
+	// Network report; a failure here shouldn't block registration
+	network, err := netinfo.Collect(config.ExcludeInterfaces)
 	if err != nil {
-		return ""
+		log.Printf("[WARNING] Failed to collect network interfaces: %v", err)
+		network = &netinfo.Report{}
 	}
 
-	for _, iface := range interfaces {
-		// Skip loopback and down interfaces
-		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
-			continue
-		}
+	metadata := map[string]interface{}{
+		"num_cpu":     runtime.NumCPU(),
+		"go_version":  runtime.Version(),
+		"fingerprint": machineidentifier.GetMachineFingerprint(),
+		"web_servers": webserver.Detect(),
+	}
 
-		// Return first valid MAC address
-		if iface.HardwareAddr.String() != "" {
-			return iface.HardwareAddr.String()
+	// Cloud tags let the console reuse existing fleet tagging
+	if !config.DisableCloudMetadata {
+		if cloud := cloudmeta.Detect(context.Background()); cloud != nil {
+			metadata["cloud"] = cloud
 		}
 	}
-	return ""
+
+	return &client.InstanceData{
+		MachineID:    machineID,
+		Hostname:     getHostname(),
+		OSType:       runtime.GOOS,
+		OSVersion:    getOSVersion(),
+		Architecture: runtime.GOARCH,
+		IPAddress:    network.PrimaryIP(netdial.Preference() == netdial.PREFER_IPV6),
+		IPv6Address:  network.PrimaryIPv6,
+		MACAddress:   network.PrimaryMAC,
+		Interfaces:   network.Interfaces,
+		AgentVersion: config.CurrentVersion,
+		Metadata:     metadata,
+	}, nil
 }
 
-// Collect instance data
-func collectInstanceData(version string) (*InstanceData, error) {
-	// Generate machine ID
-	machineID, err := machineidentifier.GenerateMachineID()
+// Describe the Kubernetes node this DaemonSet pod runs on
+func collectNodeInstanceData(config *Config) (*client.InstanceData, error) {
+	node, err := kubernetes.GetNode(context.Background(), kubernetes.NodeName())
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate machine ID: %w", err)
+		return nil, fmt.Errorf("failed to read node: %w", err)
 	}
 
-	return &InstanceData{
-		MachineID:    machineID,
-		Hostname:     getHostname(),
+	// Pods normally run with host networking, so this is the node's address
+	network, err := netinfo.Collect(config.ExcludeInterfaces)
+	if err != nil {
+		log.Printf("[WARNING] Failed to collect network interfaces: %v", err)
+		network = &netinfo.Report{}
+	}
+
+	return &client.InstanceData{
+		MachineID:    node.InstanceID(),
+		Hostname:     node.Name,
 		OSType:       runtime.GOOS,
-		OSVersion:    getOSVersion(),
+		OSVersion:    node.OSImage,
 		Architecture: runtime.GOARCH,
-		IPAddress:    getIPAddress(),
-		MACAddress:   getMACAddress(),
-		AgentVersion: version,
+		IPAddress:    network.PrimaryIP(netdial.Preference() == netdial.PREFER_IPV6),
+		IPv6Address:  network.PrimaryIPv6,
+		MACAddress:   network.PrimaryMAC,
+		Interfaces:   network.Interfaces,
+		AgentVersion: config.CurrentVersion,
 		Metadata: map[string]interface{}{
-			"num_cpu":      runtime.NumCPU(),
-			"go_version":   runtime.Version(),
-			"fingerprint":  machineidentifier.GetMachineFingerprint(),
+			"num_cpu":    runtime.NumCPU(),
+			"go_version": runtime.Version(),
+			"kubernetes": node,
 		},
 	}, nil
 }
 
-// Register instance with the API
-func registerInstance(config *Config, instanceData *InstanceData) (*RegisterResponse, error) {
-	// Prepare request body
-	reqBody, err := json.Marshal(instanceData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal instance data: %w", err)
+// Collect clock health and maintenance state to attach to the heartbeat
+func collectHeartbeatData() *client.HeartbeatData {
+	data := &client.HeartbeatData{
+		NTP:         clockcheck.CheckNTP(),
+		Maintenance: currentMaintenance(),
 	}
+	clockTracker.ObserveNTP(data.NTP)
 
-	// Create HTTP request
-	url := strings.TrimRight(config.Endpoint, "/") + "/instances/register"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	if skew, ok := clockTracker.Skew(); ok {
+		seconds := skew.Seconds()
+		data.ClockSkewSeconds = &seconds
+		if clockcheck.IsSignificant(skew) {
+			log.Printf("[WARNING] System clock is %s; certificate validity checks may be wrong", clockcheck.Describe(skew))
+		}
+	}
+	if data.NTP != nil && !data.NTP.Synchronized {
+		log.Printf("[WARNING] Time synchronization (%s) is not healthy: %s", data.NTP.Source, data.NTP.Detail)
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", config.Token)
+	return data
+}
 
-	// Send request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+// Collect certificate inventory and check the names it serves
+func collectInventory(config *Config) *inventory.Report {
+	report := discoverCertificates(config)
+	report.DNSChecks = checkServedNames(config, report)
+	report.PQReadiness = assessPQReadiness(report)
+	if config.tenant == "" {
+		report.TrustStores = trustStoreInventory(config)
 	}
-	defer resp.Body.Close()
+	return report
+}
 
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+// Find certificates in web server configurations, containers, plugins and
+// the filesystem and endpoint scan
+func discoverCertificates(config *Config) *inventory.Report {
+	// A tenant's inventory is only what is under its own paths
+	var usages []webserver.CertUsage
+	if config.tenant == "" {
+		usages = webserver.FindCertUsages(webserver.Detect())
+	}
+	report := inventory.Build(usages)
+	if config.tenant == "" {
+		if containers.Available() {
+			report.Add(containers.Discover(context.Background()))
+		}
+		report.Add(pluginCertificates(context.Background()))
+		if tlsObserver != nil {
+			report.Observe(tlsObserver.Report())
+		}
+	}
+	report.Add(stagingCertificates(config), nil)
+	report.TLSA = managedTLSA(config)
+
+	// Filesystem and endpoint scan; defaults to the managed cert paths
+	opts := scanOptions(config)
+	if len(opts.Roots) > 0 || len(opts.Endpoints) > 0 {
+		// Between scheduled scans reports reuse the last one's results
+		result := reusableScan(config)
+		if result == nil {
+			// Only files changed since the previous scan are re-parsed; commands
+			// run beside the agent can't open its state and parse everything
+			if stateDB != nil {
+				opts.Cache = scanner.LoadCache(stateDB.Blob(STATE_SCAN_CACHE + tenantSuffix(config)))
+			}
+			started := time.Now()
+			result = scanner.Scan(context.Background(), opts)
+			metrics.Observe(metrics.OP_SCAN, scanTarget(config), result.Stats.Duration, nil)
+			log.Printf("[INFO] Scan: %d files seen, %d parsed, %d cached, %d certificates in %v",
+				result.Stats.FilesSeen, result.Stats.FilesParsed, result.Stats.CacheHits, result.Stats.Certificates, result.Stats.Duration.Round(time.Millisecond))
+			if opts.Cache != nil {
+				if err := opts.Cache.Save(); err != nil {
+					log.Printf("[WARNING] Failed to save scan cache: %v", err)
+				}
+			}
+			rememberScan(config, started, result)
+		}
+		report.Merge(result.Certificates, result.Errors)
+	}
+	if config.tenant == "" {
+		withoutTenantFiles(config, report)
 	}
+	tagManaged(config, report)
 
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, string(body))
+	return report
+}
+
+// Scans are timed per tenant; the host's own is "host"
+func scanTarget(config *Config) string {
+	if config.tenant != "" {
+		return "tenant:" + config.tenant
 	}
+	return "host"
+}
 
-	// Parse response
-	var registerResp RegisterResponse
-	if err := json.Unmarshal(body, &registerResp); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+// Build scanner options from configuration
+func scanOptions(config *Config) scanner.Options {
+	roots := config.Scan.Paths
+	if len(roots) == 0 {
+		roots = config.CertPaths
 	}
 
-	return &registerResp, nil
+	// Node certificates (kubelet, control plane, etcd) through the hostPath mount
+	if config.Kubernetes != nil {
+		hostRoot := config.Kubernetes.HostRoot
+		if hostRoot == "" {
+			hostRoot = kubernetes.DEFAULT_HOST_ROOT
+		}
+		roots = append(append([]string{}, roots...), kubernetes.ScanRoots(hostRoot)...)
+	}
+
+	return scanner.Options{
+		Roots:          roots,
+		Endpoints:      config.Scan.Endpoints,
+		Exclude:        append(append([]string{}, config.Scan.Exclude...), tenantPaths(config)...),
+		Workers:        config.Scan.Workers,
+		FilesPerSecond: config.Scan.FilesPerSecond,
+	}
 }
 
-// Send heartbeat to update last_seen_at
-func sendHeartbeat(config *Config, instanceID string) error {
-	url := strings.TrimRight(config.Endpoint, "/") + "/instances/" + instanceID + "/heartbeat"
-	
-	req, err := http.NewRequest("PUT", url, nil)
+// Verify that names served by this host still resolve to it
+func checkServedNames(config *Config, report *inventory.Report) []dnscheck.Result {
+	checker, err := dnscheck.NewChecker(config.KnownAddresses)
 	if err != nil {
-		return fmt.Errorf("failed to create heartbeat request: %w", err)
+		report.Errors = append(report.Errors, fmt.Sprintf("dns check: %v", err))
+		return nil
 	}
 
-	req.Header.Set("X-API-Key", config.Token)
+	results := checker.Check(context.Background(), report.ServedNames())
+	for _, mismatch := range dnscheck.Mismatches(results) {
+		if mismatch.Error != "" {
+			log.Printf("[WARNING] DNS check: %s does not resolve: %s", mismatch.Name, mismatch.Error)
+		} else {
+			log.Printf("[WARNING] DNS check: %s resolves to %s, not to this host", mismatch.Name, strings.Join(mismatch.Resolved, ", "))
+		}
+	}
+	return results
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+// Classify the algorithms in use and probe scanned endpoints for hybrid
+// post-quantum key exchange
+func assessPQReadiness(report *inventory.Report) *pqc.Report {
+	readiness := pqc.NewReport(report.Readiness(), pqc.ProbeEndpoints(context.Background(), report.Endpoints()))
+	summary := readiness.Summary
+	log.Printf("[INFO] PQ readiness: %d of %d certificates quantum-vulnerable, %d of %d endpoints negotiate hybrid key exchange",
+		summary.QuantumVulnerable, summary.Certificates, summary.HybridEndpoints, summary.Endpoints)
+	return readiness
+}
+
+// applyResourceLimits keeps the agent within its configured and cgroup
+// limits, before any scan or deployment starts
+func applyResourceLimits(config *Config) {
+	var opts limits.Options
+	if rc := config.Resources; rc != nil {
+		opts = limits.Options{CPUs: rc.MaxCPUs, MemoryBytes: rc.MaxMemoryMB << 20}
+	}
+	applied, err := limits.Apply(opts)
 	if err != nil {
-		return fmt.Errorf("failed to send heartbeat: %w", err)
+		log.Fatalf("[FATAL] Invalid resource limits: %v", err)
+	}
+	if applied.CPUs > 0 {
+		log.Printf("[INFO] CPU limited to %g (%s)", applied.CPUs, applied.CPUSource)
+	}
+	if applied.MemoryBytes > 0 {
+		log.Printf("[INFO] Memory limited to %d MiB (%s)", applied.MemoryBytes>>20, applied.MemorySource)
+	}
+}
+
+// Apply connection settings to the shared HTTP transport
+func configureHTTP(config *Config) error {
+	// Cache API host lookups when configured (seconds)
+	if config.DNSCacheTTL > 0 {
+		httpclient.SetDNSCache(time.Duration(config.DNSCacheTTL) * time.Second)
+	}
+
+	// Every API call, ACME order and notification shares the caps
+	if bw := config.Bandwidth; bw != nil && (bw.UploadKbps > 0 || bw.DownloadKbps > 0) {
+		httpclient.SetBandwidth(bw.UploadKbps*1000/8, bw.DownloadKbps*1000/8)
+		log.Printf("[INFO] Bandwidth limited to %s up, %s down", describeKbps(bw.UploadKbps), describeKbps(bw.DownloadKbps))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("heartbeat failed with status %d: %s", resp.StatusCode, string(body))
+	if nc := config.Network; nc != nil {
+		if err := netdial.SetPreference(nc.Prefer, time.Duration(nc.AttemptDelayMs)*time.Millisecond); err != nil {
+			return err
+		}
 	}
 
+	if config.DNS != nil {
+		resolver, err := securedns.New(securedns.Options{Server: config.DNS.Resolver, Bootstrap: config.DNS.Bootstrap})
+		if err != nil {
+			return err
+		}
+		securedns.Use(resolver)
+		log.Printf("[INFO] DNS lookups for challenges, CAA and endpoints go through %s", config.DNS.Resolver)
+	}
+
+	// Pins and client authentication apply to the API host only
+	var apiHost string
+	if endpoint, err := url.Parse(config.Endpoint); err == nil {
+		apiHost = endpoint.Hostname()
+	}
+
+	policy := httpclient.TLSPolicy{
+		MinVersion:         config.TLS.MinVersion,
+		CipherSuites:       config.TLS.CipherSuites,
+		InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		Pins:               config.TLS.Pins,
+		PinnedHost:         apiHost,
+	}
+
+	// The SVID and its bundle apply to the API host only; ACME, backups,
+	// DNS providers and webhooks keep the system roots
+	if config.SPIFFE != nil {
+		source, err := spiffeSource(config.SPIFFE)
+		if err != nil {
+			return err
+		}
+		id, _ := source.ID()
+		log.Printf("[INFO] Authenticating with SPIFFE ID %s", id)
+		auth := &httpclient.ClientAuth{Host: apiHost, GetClientCertificate: source.GetClientCertificate}
+		if source.BundleFile != "" {
+			if _, err := source.Bundle(); err != nil {
+				return err
+			}
+			auth.VerifyPeerCertificate = source.VerifyServer(config.SPIFFE.ServerID)
+		}
+		policy.ClientAuth = auth
+	}
+
+	if err := httpclient.ApplyTLSPolicy(policy); err != nil {
+		return err
+	}
+	// After the TLS policy, which the HTTP/3 transport copies
+	if err := httpclient.SetProtocol(config.HTTPVersion); err != nil {
+		return err
+	}
+	if config.HTTPVersion != "" {
+		log.Printf("[INFO] API traffic uses HTTP/%s", config.HTTPVersion)
+	}
 	return nil
 }
 
+func describeKbps(kbps int64) string {
+	if kbps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d kbit/s", kbps)
+}
+
+// Open the SVID source described by the spiffe config section
+func spiffeSource(cfg *SPIFFEConfig) (*spiffe.Source, error) {
+	certFile, keyFile, bundleFile := cfg.CertFile, cfg.KeyFile, cfg.BundleFile
+	if cfg.Dir != "" {
+		if certFile == "" {
+			certFile = filepath.Join(cfg.Dir, spiffe.DEFAULT_CERT_FILE)
+		}
+		if keyFile == "" {
+			keyFile = filepath.Join(cfg.Dir, spiffe.DEFAULT_KEY_FILE)
+		}
+		if bundleFile == "" {
+			bundleFile = filepath.Join(cfg.Dir, spiffe.DEFAULT_BUNDLE_FILE)
+		}
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("spiffe requires dir or cert_file and key_file")
+	}
+	return spiffe.NewSource(certFile, keyFile, bundleFile)
+}
+
+// Run an API call through the circuit breaker
+func callAPI(call func() error) error {
+	if err := apiBreaker.Allow(); err != nil {
+		return err
+	}
+	err := call()
+	apiBreaker.Record(err)
+	apiActivity.record(err)
+	handleAPIError(err)
+	return err
+}
+
+// Collect and upload inventory, logging the outcome
+func reportInventory(config *Config, instanceID string) (*inventory.Report, error) {
+	// A metered host reports its inventory with a check-in
+	if metered(config) {
+		report, _, err := checkIn(config, instanceID)
+		if err != nil {
+			log.Printf("[ERROR] Check-in failed: %v", err)
+		}
+		return report, err
+	}
+
+	report := collectInventory(config)
+	for _, msg := range report.Errors {
+		log.Printf("[WARNING] Inventory: %s", msg)
+	}
+	notifyExpiring(config, report)
+
+	if err := callAPI(func() error { return apiClient(config).UploadInventory(context.Background(), instanceID, report) }); err != nil {
+		log.Printf("[ERROR] Inventory upload failed: %v", err)
+		recordInventory(instanceID, report, false)
+		return report, err
+	}
+	recordInventory(instanceID, report, true)
+	log.Printf("[INFO] Inventory uploaded (%d certificates)", len(report.Certificates))
+	return report, nil
+}
+
 func main() {
+	// Nothing the agent logs may carry the token or key material
+	log.SetOutput(redact.NewWriter(os.Stderr))
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -300,11 +707,39 @@ func main() {
 	case "config":
 		handleShowConfig()
 	case "start":
-		handleStart()
+		parseStartFlags()
+		// Under the Windows SCM the service dispatcher drives handleStart
+		if ran, err := platform.RunService(SERVICE_NAME, handleStart); err != nil {
+			log.Fatalf("[FATAL] Failed to run as a service: %v", err)
+		} else if !ran {
+			handleStart(nil)
+		}
 	case "version":
 		handleVersion()
 	case "machine-id":
 		handleMachineID()
+	case "service":
+		handleService()
+	case "doctor":
+		handleDoctor()
+	case "status":
+		handleStatus()
+	case "list-certs":
+		handleListCerts()
+	case "top":
+		handleTop()
+	case "export":
+		handleExport()
+	case "receipts":
+		handleReceipts()
+	case "scan":
+		handleScan()
+	case "backup":
+		handleBackup()
+	case "restore":
+		handleRestore()
+	case "benchmark":
+		handleBenchmark()
 	case "help", "--help", "-h":
 		printUsage()
 	default:
@@ -319,9 +754,21 @@ func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  certfix-agent configure --token <api-key> --endpoint <url>")
 	fmt.Println("  certfix-agent config")
-	fmt.Println("  certfix-agent start")
+	fmt.Println("  certfix-agent start [--staging] [--simulate [--pebble <directory-url>]]")
 	fmt.Println("  certfix-agent machine-id")
-	fmt.Println("  certfix-agent version")
+	fmt.Println("  certfix-agent doctor")
+	fmt.Println("  certfix-agent status [--tenant <name>]")
+	fmt.Println("  certfix-agent list-certs [--label <selector>] [--group-by <key>]")
+	fmt.Println("  certfix-agent top [--interval <duration>] [--once]")
+	fmt.Println("  certfix-agent export [--format csv|json] [--out <file>]")
+	fmt.Println("  certfix-agent scan --now")
+	fmt.Println("  certfix-agent benchmark [--path <dir>[,<dir>...]] [--workers <n>[,<n>...]]")
+	fmt.Println("  certfix-agent backup --out <file> [--recipient <age1...>] [--key <key>]")
+	fmt.Println("  certfix-agent restore --out <dir> [--name <cert>] [--host <name>] [--identity <file>] [--list]")
+	fmt.Println("  certfix-agent restore --archive <file> [--identity <file>] [--key <key>] [--force]")
+	fmt.Println("  certfix-agent receipts [--tenant <name>] [--file <log>] [--key <base64>] [--last <n>]")
+	fmt.Println("  certfix-agent service install|print|print-socket")
+	fmt.Println("  certfix-agent version [--fips]")
 	fmt.Println("  certfix-agent help")
 	fmt.Println()
 	fmt.Println("Commands:")
@@ -329,12 +776,32 @@ func printUsage() {
 	fmt.Println("  config     Show current configuration")
 	fmt.Println("  start      Start the agent service")
 	fmt.Println("  machine-id Show unique machine identifier")
-	fmt.Println("  version    Show version information")
+	fmt.Println("  doctor     Run health checks (connectivity, clock)")
+	fmt.Println("  status     Show managed certificates and remaining CA rate limits")
+	fmt.Println("  list-certs List the certificates found on this host")
+	fmt.Println("  top        Live view of the running agent: expiries, renewal queue, events")
+	fmt.Println("  export     Write the certificate inventory to a CSV or JSON file")
+	fmt.Println("  scan       Have the running agent scan and report right away (--now)")
+	fmt.Println("  benchmark  Measure scan throughput on this host and suggest settings")
+	fmt.Println("  backup     Write the agent's identity and state to an encrypted archive")
+	fmt.Println("  restore    Restore certificates from the backup bucket, or the state from an archive")
+	fmt.Println("  receipts   List signed deployment receipts and verify their chain")
+	fmt.Println("  service    Install or print the hardened systemd unit")
+	fmt.Println("  version    Show version information (--fips: FIPS status only)")
 	fmt.Println("  help       Show this help message")
 	fmt.Println()
 	fmt.Println("Configure Options:")
 	fmt.Println("  --token     API token for authentication (required)")
 	fmt.Println("  --endpoint  API endpoint URL (required)")
+	fmt.Println()
+	fmt.Println("Start Options:")
+	fmt.Println("  --simulate  Run against an embedded fake API in a scratch directory")
+	fmt.Println("  --pebble    Issue simulated certificates from this ACME directory")
+	fmt.Println("  --staging   Renew ACME certificates from staging directories, without deploying")
+	fmt.Println()
+	fmt.Println("List-certs Options:")
+	fmt.Println("  --label     Only certificates whose labels match, e.g. app=checkout,tier!=edge")
+	fmt.Println("  --group-by  Group certificates by the value of a label, e.g. app")
 }
 
 func getVersionString() string {
@@ -346,10 +813,20 @@ func getVersionString() string {
 }
 
 func handleVersion() {
+	// --fips prints only the FIPS status; exit code 1 when it is disabled
+	if len(os.Args) > 2 && (os.Args[2] == "--fips" || os.Args[2] == "-fips") {
+		fmt.Printf("FIPS: %s\n", fips.Current())
+		if !fips.Enabled() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Printf("CertFix Agent v%s\n", getVersionString())
 	fmt.Printf("OS: %s\n", runtime.GOOS)
 	fmt.Printf("Architecture: %s\n", runtime.GOARCH)
 	fmt.Printf("Go Version: %s\n", runtime.Version())
+	fmt.Printf("FIPS: %s\n", fips.Current())
 }
 
 func handleMachineID() {
@@ -462,19 +939,90 @@ func maskToken(token string) string {
 	return token[:4] + "..." + token[len(token)-4:]
 }
 
-func handleStart() {
+// handleStart runs the agent until stop is closed; a nil stop runs it until
+// the process is killed
+func handleStart(stop <-chan struct{}) {
 	// Load configuration
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("[FATAL] Failed to load configuration: %v", err)
 	}
+	// The dashboard shows the log from startup on
+	if config.Dashboard != nil {
+		keepDashboardLogs(config.Dashboard)
+	}
+
+	// Refuse to start with non-validated crypto when FIPS is required
+	if config.FIPS {
+		if err := fips.Assert(); err != nil {
+			log.Fatalf("[FATAL] FIPS mode required by configuration: %v", err)
+		}
+		log.Printf("[INFO] FIPS mode: %s", fips.Current())
+	}
+
+	// Refuse to run alongside another agent: two daemons would double-register
+	// and race on the config and certificate files
+	lock, err := lockfile.Acquire(lockfile.LOCK_FILE)
+	if err != nil {
+		var lockedErr *lockfile.LockedError
+		if errors.As(err, &lockedErr) {
+			log.Printf("[FATAL] Another certfix-agent is already running: %v", lockedErr)
+			log.Println("[INFO] Stop it first (e.g. 'sudo systemctl stop certfix-agent') before starting a new one")
+			os.Exit(1)
+		}
+		log.Fatalf("[FATAL] Failed to acquire instance lock: %v", err)
+	}
+	defer lock.Release()
+
+	// Opened before the sandbox, which would otherwise have to allow it
+	openState()
+	defer stateDB.Close()
+
+	if err := configureHTTP(config); err != nil {
+		log.Fatalf("[FATAL] Invalid connection settings: %v", err)
+	}
+	configureNotifications(config)
+	// The roots decide which cached intermediates are kept, so they come first
+	if err := setupVerification(config); err != nil {
+		log.Fatalf("[FATAL] Invalid verify settings: %v", err)
+	}
+	setupIntermediates(config)
+	startMetrics(config)
+	startBackup(config)
+	startMetered(config)
+	// Read before the sandbox, which would hide the cgroup files
+	applyResourceLimits(config)
+
+	// The capture filter is attached before the sandbox, like the state
+	if config.TLSObserver != nil {
+		startTLSObserver(config.TLSObserver)
+	}
+
+	// Confine the process to its own files before talking to the network
+	if config.Sandbox {
+		policy := sandboxPolicy(config)
+		if err := sandbox.Apply(policy); err != nil {
+			if errors.Is(err, sandbox.ErrUnsupported) {
+				log.Printf("[WARNING] Sandbox requested but not available, continuing without it: %v", err)
+			} else {
+				log.Fatalf("[FATAL] Failed to apply sandbox: %v", err)
+			}
+		} else {
+			log.Printf("[INFO] Sandbox enabled (%s)", sandbox.Describe(policy))
+		}
+	}
 
 	log.Println("[certfix-agent] Starting agent version", config.CurrentVersion)
 	log.Printf("[INFO] Configuration loaded from %s", CONFIG_FILE)
 	log.Printf("[INFO] Endpoint: %s", config.Endpoint)
 
+	// Local sidecars get certificates even while the API is unreachable
+	if config.SDS != nil {
+		startSDS(config)
+	}
+
 	// Collect instance data
-	instanceData, err := collectInstanceData(config.CurrentVersion)
+	instanceData, err := collectInstanceData(config)
 	if err != nil {
 		log.Fatalf("[FATAL] Failed to collect instance data: %v", err)
 	}
@@ -486,9 +1034,36 @@ func handleStart() {
 		instanceData.OSVersion,
 	)
 	log.Printf("[INFO] Machine ID: %s", instanceData.Metadata["fingerprint"])
+	openReceipts(instanceData)
+
+	// Commands run beside the agent ('top') read its live state here
+	startControl(config, instanceData)
+	watchRescanSignals()
+
+	// Standalone hosts watch the agent here instead of the console
+	if config.Dashboard != nil {
+		startDashboard(config, instanceData)
+	}
+
+	// Advertise which task types the server may send us
+	loadPlugins(config)
+	verifyTask := newTaskVerifier(config)
+	taskRegistry := newTaskRegistry(config, verifyTask)
+	instanceData.Metadata["task_types"] = taskRegistry.Types()
+	if len(loadedPlugins) > 0 {
+		instanceData.Metadata["plugins"] = pluginSummary()
+	}
+
+	// Before renewals, which deploy tenants' certificates through their own deployers
+	setupTenants(config, verifyTask)
+
+	// Managed certificates renew on their own schedule, API or not
+	startRenewals(config)
+	startStapling(config)
+	tenantRenewals()
 
 	// Register with retry logic
-	var registerResp *RegisterResponse
+	var registerResp *client.RegisterResponse
 	for {
 		log.Println("[INFO] Registering instance with API...")
 		registerResp, err = registerInstance(config, instanceData)
@@ -505,21 +1080,164 @@ func handleStart() {
 	log.Printf("[INFO] Instance ID: %s", registerResp.InstanceID)
 	log.Printf("[INFO] Service: %s (%s)", registerResp.ServiceName, registerResp.ServiceHash)
 	log.Printf("[INFO] Key ID: %s", registerResp.KeyID)
+	instanceID := registerResp.InstanceID
+
+	if skew, ok := clockTracker.Skew(); ok && clockcheck.IsSignificant(skew) {
+		log.Printf("[WARNING] System clock is %s; check NTP configuration", clockcheck.Describe(skew))
+	}
+
+	// Initial inventory report
+	reportInventory(config, instanceID)
+
+	// Hosts managed over SSH register as sub-instances of this one
+	if len(config.ProxyHosts) > 0 {
+		setupProxyHosts(config, verifyTask)
+		registerProxyHosts(config, instanceData, instanceID)
+		proxyInventories(config)
+	}
+
+	// Each tenant registers as its own instance, with its own token
+	if len(tenantInstances) > 0 {
+		registerTenants(instanceData)
+		tenantInventories()
+	}
+
+	heartbeatInterval, inventoryInterval, taskInterval := HEARTBEAT_INTERVAL, INVENTORY_INTERVAL, TASK_POLL_INTERVAL
+	if simulation != nil {
+		heartbeatInterval, inventoryInterval, taskInterval = SIMULATE_HEARTBEAT_INTERVAL, SIMULATE_INVENTORY_INTERVAL, SIMULATE_POLL_INTERVAL
+	}
+
+	// A metered host checks in instead, seldom, and runs tasks and drift
+	// checks after each check-in
+	heartbeatName := "Heartbeat"
+	if metered(config) {
+		heartbeatName = "Check-in"
+		heartbeatInterval, inventoryInterval, taskInterval = config.Metered.interval(), 0, 0
+	}
 
 	// Start heartbeat ticker
-	heartbeatTicker := time.NewTicker(HEARTBEAT_INTERVAL)
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
 	defer heartbeatTicker.Stop()
 
+	// Cron schedules apply outside simulation, which runs on its own
+	// intervals; a metered host only reports when it checks in, scanning
+	// then if the scan schedule has come round
+	var inventoryCron, scanCron *cron.Schedule
+	if simulation == nil && !metered(config) {
+		inventoryCron, scanCron = inventorySchedule(config), scanSchedule(config)
+	}
+	if inventoryCron != nil {
+		log.Printf("[INFO] Inventory reports scheduled at %q (%s)", inventoryCron, inventoryCron.Location())
+	}
+	if scanCron != nil {
+		log.Printf("[INFO] Scans scheduled at %q (%s)", scanCron, scanCron.Location())
+	}
+	inventoryTimer := newRunTimer(inventoryCron, inventoryInterval)
+	defer inventoryTimer.Stop()
+	scanTimer := newRunTimer(scanCron, 0)
+	defer scanTimer.Stop()
+
+	var taskC <-chan time.Time
+	if taskInterval > 0 {
+		taskTicker := time.NewTicker(taskInterval)
+		defer taskTicker.Stop()
+		taskC = taskTicker.C
+	}
+
+	// Drift checks stay off the select when disabled
+	var driftC <-chan time.Time
+	if driftEnabled(config) && !metered(config) {
+		interval := driftInterval(config)
+		if simulation != nil {
+			interval = SIMULATE_DRIFT_INTERVAL
+		}
+		driftTicker := time.NewTicker(interval)
+		defer driftTicker.Stop()
+		driftC = driftTicker.C
+	}
+
+	// Changes under the certificate directories, as they happen
+	watchC := startWatch(config)
+
+	// Heartbeats count as down from startup until the first succeeds
+	lastHeartbeat := time.Now()
+
 	// Main loop
 	for {
 		select {
 		case <-heartbeatTicker.C:
-			log.Println("[INFO] Sending heartbeat...")
-			if err := sendHeartbeat(config, registerResp.InstanceID); err != nil {
-				log.Printf("[ERROR] Heartbeat failed: %v", err)
+			// A check-in is the metered host's heartbeat
+			var err error
+			var checkInResp *client.CheckInResponse
+			if metered(config) {
+				log.Println("[INFO] Checking in...")
+				_, checkInResp, err = checkIn(config, instanceID)
+			} else {
+				log.Println("[INFO] Sending heartbeat...")
+				err = callAPI(func() error {
+					return apiClient(config).Heartbeat(context.Background(), instanceID, collectHeartbeatData())
+				})
+			}
+			if err != nil {
+				if errors.Is(err, breaker.ErrOpen) {
+					log.Printf("[WARNING] %s skipped: %v", heartbeatName, err)
+				} else {
+					log.Printf("[ERROR] %s failed: %v", heartbeatName, err)
+				}
+				// An instance deleted on the server, or a long outage, sends
+				// the agent back through registration; an expired token is
+				// exchanged for a new one
+				down := time.Since(lastHeartbeat)
+				if client.Action(err) == client.ACTION_ROTATE_TOKEN {
+					if rotateToken(config, instanceID) {
+						lastHeartbeat = time.Now()
+					}
+				} else if instanceGone(err) || down >= REREGISTER_AFTER {
+					if id, ok := reregister(config, instanceData, instanceID, down, err); ok {
+						instanceID = id
+						lastHeartbeat = time.Now()
+					}
+				}
 			} else {
-				log.Println("[INFO] Heartbeat sent successfully")
+				if !metered(config) {
+					log.Println("[INFO] Heartbeat sent successfully")
+				}
+				lastHeartbeat = time.Now()
+			}
+			proxyHeartbeats(config, instanceData, instanceID)
+			tenantHeartbeats(instanceData)
+			if metered(config) && err == nil {
+				afterCheckIn(config, instanceID, taskRegistry, checkInResp)
+			}
+		case <-inventoryTimer.C():
+			if !inventoryTimer.Due() {
+				continue
+			}
+			reportInventory(config, instanceID)
+			proxyInventories(config)
+			tenantInventories()
+		case <-scanTimer.C():
+			if !scanTimer.Due() {
+				continue
 			}
+			log.Println("[INFO] Running scheduled scan...")
+			reportInventory(config, instanceID)
+			tenantInventories()
+		case <-taskC:
+			processTasks(config, instanceID, taskRegistry)
+			flushReceipts(config, instanceID)
+			proxyTasks(config)
+			tenantTasks()
+		case <-driftC:
+			checkDrift(config, instanceID)
+		case paths := <-watchC:
+			handleWatch(config, instanceID, paths)
+		case req := <-rescanRequests:
+			rescan(config, instanceID, req)
+		case <-stop:
+			// The deferred cleanup closes the state database and the lock
+			log.Println("[INFO] Stopping agent")
+			return
 		}
 	}
 }
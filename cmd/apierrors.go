@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/dashboard"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	// Pause when the server asks the agent to back off without saying for
+	// how long
+	DEFAULT_API_BACKOFF = 5 * time.Minute
+	MAX_API_BACKOFF     = 1 * time.Hour
+)
+
+// Guards config.Token, which a rotation replaces while other goroutines
+// build clients
+var tokenMu sync.RWMutex
+
+// What the API told the agent that an operator should know about
+var apiNotices = &apiNoticeState{deprecations: make(map[string]*client.Deprecation)}
+
+type apiNoticeState struct {
+	mu sync.Mutex
+	// The error that needs someone to step in, until a call succeeds
+	operator *client.APIError
+	// Deprecated endpoints the agent calls, by method and path
+	deprecations map[string]*client.Deprecation
+}
+
+// handleAPIError acts on what a failed call's error code asks for that
+// doesn't need the instance: backing off and alerting the operator.
+// Re-registration and token rotation are left to the heartbeat.
+func handleAPIError(err error) {
+	if err == nil {
+		apiNotices.mu.Lock()
+		apiNotices.operator = nil
+		apiNotices.mu.Unlock()
+		return
+	}
+
+	var statusErr *client.StatusError
+	if !errors.As(err, &statusErr) {
+		return
+	}
+	switch client.Action(err) {
+	case client.ACTION_BACK_OFF:
+		pause := statusErr.RetryAfter
+		if pause <= 0 {
+			pause = DEFAULT_API_BACKOFF
+		}
+		pause = min(pause, MAX_API_BACKOFF)
+		apiBreaker.Hold(pause)
+		log.Printf("[WARNING] The API asked the agent to back off; pausing calls for %v", pause)
+	case client.ACTION_OPERATOR:
+		apiErr := statusErr.API
+		apiNotices.mu.Lock()
+		known := apiNotices.operator != nil && apiNotices.operator.Code == apiErr.Code
+		apiNotices.operator = apiErr
+		apiNotices.mu.Unlock()
+		if known {
+			return
+		}
+		log.Printf("[ERROR] The API refused the agent and needs an operator: %s", describeAPIError(apiErr))
+		details := map[string]string{"code": apiErr.Code, "operation": statusErr.Op}
+		if apiErr.RemediationURL != "" {
+			details["remediation_url"] = apiErr.RemediationURL
+		}
+		events.Publish(events.Event{
+			Type:     events.EVENT_API_ACTION_REQUIRED,
+			Severity: events.SEVERITY_CRITICAL,
+			Summary:  "The CertFix API needs an operator: " + apiErr.Message,
+			Details:  details,
+		})
+	}
+}
+
+func describeAPIError(apiErr *client.APIError) string {
+	description := fmt.Sprintf("%s (%s)", apiErr.Message, apiErr.Code)
+	if apiErr.RemediationURL != "" {
+		description += "; see " + apiErr.RemediationURL
+	}
+	return description
+}
+
+// onAPIDeprecation warns once for each deprecated endpoint the agent calls
+func onAPIDeprecation(d *client.Deprecation) {
+	key := d.Method + " " + d.Path
+	apiNotices.mu.Lock()
+	_, known := apiNotices.deprecations[key]
+	apiNotices.deprecations[key] = d
+	apiNotices.mu.Unlock()
+	if known {
+		return
+	}
+
+	log.Printf("[WARNING] The API deprecated %s (%s); update the agent", key, describeDeprecation(d))
+	details := map[string]string{"method": d.Method, "path": d.Path}
+	if !d.Sunset.IsZero() {
+		details["sunset"] = d.Sunset.Format(time.RFC3339)
+	}
+	if d.Link != "" {
+		details["link"] = d.Link
+	}
+	events.Publish(events.Event{
+		Type:     events.EVENT_API_DEPRECATED,
+		Severity: events.SEVERITY_WARNING,
+		Summary:  "The agent calls a deprecated API endpoint: " + key,
+		Details:  details,
+	})
+}
+
+func describeDeprecation(d *client.Deprecation) string {
+	description := "no removal date"
+	if !d.Sunset.IsZero() {
+		description = "removed after " + d.Sunset.Local().Format(time.RFC3339)
+	}
+	if d.Link != "" {
+		description += "; see " + d.Link
+	}
+	return description
+}
+
+// apiNoticesHealth sums up the notices for the dashboard; false when there
+// are none
+func apiNoticesHealth() (dashboard.Check, bool) {
+	apiNotices.mu.Lock()
+	defer apiNotices.mu.Unlock()
+	check := dashboard.Check{Name: "API notices"}
+	if apiNotices.operator != nil {
+		check.Status, check.Detail = dashboard.CHECK_FAIL, describeAPIError(apiNotices.operator)
+		return check, true
+	}
+	if len(apiNotices.deprecations) == 0 {
+		return check, false
+	}
+	keys := make([]string, 0, len(apiNotices.deprecations))
+	for key := range apiNotices.deprecations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	check.Status = dashboard.CHECK_WARN
+	check.Detail = "deprecated endpoints in use: " + strings.Join(keys, ", ")
+	return check, true
+}
+
+// rotateToken exchanges the host's expired token for a new one and writes
+// it to the config file. Tenants' tokens are theirs to rotate.
+func rotateToken(config *Config, instanceID string) bool {
+	if config.Token == "" {
+		return false
+	}
+	log.Printf("[WARNING] The API no longer accepts the instance token; rotating it")
+	var token string
+	err := callAPI(func() error {
+		var err error
+		token, err = apiClient(config).RotateToken(context.Background(), instanceID)
+		return err
+	})
+	if err != nil {
+		log.Printf("[ERROR] Token rotation failed: %v", err)
+		return false
+	}
+
+	redact.AddSecret(token)
+	tokenMu.Lock()
+	config.Token = token
+	tokenMu.Unlock()
+	if err := persistToken(token); err != nil {
+		log.Printf("[ERROR] The token was rotated but not saved; update %s by hand before restarting: %v", CONFIG_FILE, err)
+		return true
+	}
+	log.Printf("[SUCCESS] Instance token rotated")
+	return true
+}
+
+// persistToken replaces the token in the config file, leaving the rest of
+// it as written rather than as the agent resolved it
+func persistToken(token string) error {
+	info, err := os.Stat(CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	data, err := os.ReadFile(CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	fields["token"], _ = json.Marshal(token)
+	data, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(CONFIG_FILE), ".config-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set config file permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), CONFIG_FILE); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
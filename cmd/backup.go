@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/backup"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	BACKUP_QUEUE        = "backups"
+	MAX_PENDING_BACKUPS = 1000
+	// Failed uploads are retried this often
+	BACKUP_RETRY_INTERVAL = 5 * time.Minute
+	BACKUP_SETUP_TIMEOUT  = 30 * time.Second
+)
+
+// Encrypted copies of issued and deployed certificates in an S3-compatible
+// bucket, for 'certfix-agent restore' after losing the host
+type BackupConfig struct {
+	S3 backup.S3Options `json:"s3"`
+	// age public keys (age1...) to encrypt to; the host can't read its
+	// own backups, which only the matching identities restore
+	AgeRecipients []string `json:"age_recipients,omitempty"`
+	// Or a 32-byte AES-256-GCM key, base64 or hex, usually a secret
+	// reference (env:CERTFIX_BACKUP_KEY); the same key restores
+	Key string `json:"key,omitempty"`
+	// Folder of this host in the bucket; the hostname by default. Keep it
+	// when the host is rebuilt so restores find its certificates.
+	Host string `json:"host,omitempty"`
+}
+
+// A sealed entry waiting to be uploaded; encrypted before it is queued,
+// so the spool never holds a key in the clear
+type pendingBackup struct {
+	Name    string   `json:"name"`
+	Objects []string `json:"objects"`
+	Data    []byte   `json:"data"`
+}
+
+type backupService struct {
+	host   string
+	cipher backup.Cipher
+	bucket *backup.Bucket
+	queue  *store.Queue
+	wake   chan struct{}
+
+	mu sync.Mutex
+	// Fingerprints already queued, so every destination of one renewal
+	// doesn't upload it again
+	queued map[string]bool
+}
+
+// Nil unless backups are configured
+var certBackup *backupService
+
+// startBackup uploads what is queued and every certificate issued or
+// deployed from now on
+func startBackup(config *Config) {
+	if config.Backup == nil {
+		return
+	}
+	svc, err := newBackupService(config, config.Backup)
+	if err != nil {
+		log.Printf("[ERROR] Certificate backups disabled: %v", err)
+		return
+	}
+	svc.queue = stateDB.Queue(store.BUCKET_SPOOL, BACKUP_QUEUE, MAX_PENDING_BACKUPS)
+	certBackup = svc
+	log.Printf("[INFO] Backing up certificates to %s, encrypted with %s", svc.bucket, backupCipherName(svc.cipher))
+	go svc.run()
+}
+
+// newBackupService resolves the bucket credentials and the key; with age
+// only the recipients are needed here
+func newBackupService(config *Config, bc *BackupConfig) (*backupService, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKUP_SETUP_TIMEOUT)
+	defer cancel()
+
+	var cipher backup.Cipher
+	var err error
+	switch {
+	case len(bc.AgeRecipients) > 0 && bc.Key != "":
+		return nil, fmt.Errorf("set either age_recipients or key, not both")
+	case len(bc.AgeRecipients) > 0:
+		cipher, err = backup.NewAge(bc.AgeRecipients, nil)
+	case bc.Key != "":
+		cipher, err = backupKeyCipher(ctx, config, bc.Key)
+	default:
+		err = fmt.Errorf("no age_recipients or key to encrypt with")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBackupBucket(ctx, config, bc, cipher)
+}
+
+func newBackupBucket(ctx context.Context, config *Config, bc *BackupConfig, cipher backup.Cipher) (*backupService, error) {
+	opts := bc.S3
+	if opts.SecretAccessKey != "" {
+		secret, err := secretResolver(config).Resolve(ctx, opts.SecretAccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret_access_key: %w", err)
+		}
+		opts.SecretAccessKey = secret
+	}
+	bucket, err := backup.NewBucket(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	host := bc.Host
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("no host set and hostname unavailable: %w", err)
+		}
+	}
+	return &backupService{
+		host:   host,
+		cipher: cipher,
+		bucket: bucket,
+		wake:   make(chan struct{}, 1),
+		queued: map[string]bool{},
+	}, nil
+}
+
+func backupKeyCipher(ctx context.Context, config *Config, ref string) (backup.Cipher, error) {
+	value, err := secretResolver(config).Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve backup key: %w", err)
+	}
+	key, err := backup.ParseKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return backup.NewAES(key)
+}
+
+func backupCipherName(c backup.Cipher) string {
+	if c.Extension() == backup.EXTENSION_AGE {
+		return "age"
+	}
+	return "AES-256-GCM"
+}
+
+// backupCertificate queues an encrypted copy of a certificate and its key;
+// a no-op without backups configured
+func backupCertificate(tenant, name, source string, certificate, chain, key []byte) {
+	if certBackup == nil {
+		return
+	}
+	if err := certBackup.add(tenant, name, source, certificate, chain, key); err != nil {
+		log.Printf("[ERROR] Failed to back up certificate %s: %v", name, err)
+	}
+}
+
+func (s *backupService) add(tenant, name, source string, certificate, chain, key []byte) error {
+	entry, err := backup.NewEntry(s.host, tenant, name, source, certificate, chain, key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := entry.Dir() + entry.Fingerprint
+	if s.queued[id] {
+		return nil
+	}
+	sealed, err := backup.Seal(s.cipher, entry)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	dropped, err := s.queue.Push(pendingBackup{Name: name, Objects: entry.Objects(s.cipher.Extension()), Data: sealed})
+	if err != nil {
+		return fmt.Errorf("failed to queue: %w", err)
+	}
+	if dropped > 0 {
+		log.Printf("[WARNING] Backup queue full, dropped %d oldest backups", dropped)
+	}
+	s.queued[id] = true
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run uploads queued backups in order, waiting after a failure so an
+// unreachable bucket is retried rather than hammered
+func (s *backupService) run() {
+	retry := time.NewTicker(BACKUP_RETRY_INTERVAL)
+	defer retry.Stop()
+	for {
+		s.flush()
+		select {
+		case <-s.wake:
+		case <-retry.C:
+		}
+	}
+}
+
+func (s *backupService) flush() {
+	for {
+		var pending pendingBackup
+		found, err := s.queue.Peek(&pending)
+		if err != nil {
+			log.Printf("[ERROR] Discarding unreadable queued backup: %v", err)
+			if err := s.queue.Pop(); err != nil {
+				return
+			}
+			continue
+		}
+		if !found {
+			return
+		}
+		for _, object := range pending.Objects {
+			ctx, cancel := context.WithTimeout(context.Background(), backup.S3_TIMEOUT)
+			err = s.bucket.Put(ctx, object, pending.Data)
+			cancel()
+			if err != nil {
+				log.Printf("[WARNING] Backup of %s failed, %d pending: %v", pending.Name, s.queue.Len(), err)
+				return
+			}
+		}
+		if err := s.queue.Pop(); err != nil {
+			log.Printf("[ERROR] Failed to remove uploaded backup: %v", err)
+			return
+		}
+		log.Printf("[SUCCESS] Backed up certificate %s to %s", pending.Name, s.bucket)
+	}
+}
+
+// backupRecorder backs up every bundle the agent deploys, including those
+// the server pushes
+type backupRecorder struct {
+	tenant string
+}
+
+func (backupRecorder) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	return nil
+}
+
+func (r backupRecorder) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	backupCertificate(r.tenant, bundle.Name, backup.SOURCE_DEPLOY, bundle.Certificate, bundle.Chain, bundle.PrivateKey)
+	return nil
+}
+
+// Bring certificates back from the backup bucket onto a rebuilt host.
+// Without --name every certificate of the host is restored; --list only
+// shows what the bucket holds. With --archive the whole agent state is
+// restored instead.
+func handleRestore() {
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	name := restoreCmd.String("name", "", "Restore only this certificate")
+	host := restoreCmd.String("host", "", "Restore the certificates of this host (default: backup.host or the hostname)")
+	tenant := restoreCmd.String("tenant", "", "Restore the certificates of this tenant")
+	fingerprint := restoreCmd.String("fingerprint", "", "Restore this earlier certificate instead of the latest")
+	identity := restoreCmd.String("identity", "", "age identity file, for backups encrypted to age recipients")
+	out := restoreCmd.String("out", "", "Directory to write <name>.crt, <name>.chain.crt and <name>.key to (required unless --list)")
+	list := restoreCmd.Bool("list", false, "List the backed-up certificates without restoring")
+	archive := restoreCmd.String("archive", "", "Restore the agent's state from an archive written by 'backup' instead")
+	key := restoreCmd.String("key", "", "AES-256 key the archive was encrypted with, base64 or hex, or a secret reference")
+	force := restoreCmd.Bool("force", false, "With --archive, replace the configuration and state this host already has")
+	restoreCmd.Parse(os.Args[2:])
+
+	// A rebuilt host has no configuration yet
+	if *archive != "" {
+		restoreState(*archive, *identity, *key, *force)
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	if config.Backup == nil {
+		fmt.Println("[ERROR] No backup bucket configured; add \"backup\" to the configuration")
+		os.Exit(1)
+	}
+	if *tenant != "" && !tenantNamePattern.MatchString(*tenant) {
+		fmt.Printf("[ERROR] Invalid tenant name %q\n", *tenant)
+		os.Exit(1)
+	}
+	if !*list && *out == "" {
+		fmt.Println("[ERROR] --out is required")
+		os.Exit(1)
+	}
+
+	bc := *config.Backup
+	if *host != "" {
+		bc.Host = *host
+	}
+	svc, err := newRestoreService(config, &bc, *identity)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	dir := (&backup.Entry{Host: svc.host, Tenant: *tenant}).Dir()
+	keys, err := svc.bucket.List(ctx, dir)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to list %s: %v\n", svc.bucket, err)
+		os.Exit(1)
+	}
+
+	// Certificate names, and each one's backed-up fingerprints
+	names := map[string][]string{}
+	ext := svc.cipher.Extension()
+	for _, key := range keys {
+		rel, ok := strings.CutSuffix(strings.TrimPrefix(key, dir), ext)
+		parts := strings.Split(rel, "/")
+		if !ok || len(parts) != 2 {
+			continue
+		}
+		if parts[1] != backup.LATEST {
+			names[parts[0]] = append(names[parts[0]], parts[1])
+		}
+	}
+	if *name != "" {
+		if _, ok := names[*name]; !ok {
+			fmt.Printf("[ERROR] No backup of %s in %s%s\n", *name, svc.bucket, dir)
+			os.Exit(1)
+		}
+		names = map[string][]string{*name: names[*name]}
+	}
+	if len(names) == 0 {
+		fmt.Printf("No backups in %s%s\n", svc.bucket, dir)
+		return
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	if *list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSIONS\tLATEST")
+		for _, n := range sorted {
+			latest := "-"
+			if entry, err := svc.fetch(ctx, dir+n+"/"+backup.LATEST+ext); err == nil {
+				latest = fmt.Sprintf("%s (expires %s)", entry.Fingerprint[:16], entry.NotAfter.Format("2006-01-02"))
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\n", n, len(names[n]), latest)
+		}
+		w.Flush()
+		return
+	}
+
+	if err := os.MkdirAll(*out, 0700); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for _, n := range sorted {
+		object := backup.LATEST
+		if *fingerprint != "" {
+			object = *fingerprint
+		}
+		entry, err := svc.fetch(ctx, dir+n+"/"+object+ext)
+		if err == nil {
+			err = writeRestored(*out, entry)
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] %s: %v\n", n, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[SUCCESS] Restored %s (%s, expires %s)\n", n, entry.Fingerprint[:16], entry.NotAfter.Format(time.RFC3339))
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// newRestoreService builds the decrypting side: an age identity file, or
+// the configured AES key
+func newRestoreService(config *Config, bc *BackupConfig, identityFile string) (*backupService, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKUP_SETUP_TIMEOUT)
+	defer cancel()
+
+	var cipher backup.Cipher
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		identities, err := backup.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", identityFile, err)
+		}
+		if cipher, err = backup.NewAge(nil, identities); err != nil {
+			return nil, err
+		}
+	} else if bc.Key != "" {
+		var err error
+		if cipher, err = backupKeyCipher(ctx, config, bc.Key); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("backups are encrypted to age recipients; pass --identity with the matching identity file")
+	}
+	return newBackupBucket(ctx, config, bc, cipher)
+}
+
+func (s *backupService) fetch(ctx context.Context, key string) (*backup.Entry, error) {
+	sealed, err := s.bucket.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := backup.Unseal(s.cipher, sealed)
+	if errors.Is(err, backup.ErrWrongKey) {
+		return nil, fmt.Errorf("%w; restore with the key or identity the host was configured with", err)
+	}
+	return entry, err
+}
+
+// writeRestored writes the entry's PEM files once the key is shown to
+// match the certificate; existing files are left alone
+func writeRestored(dir string, entry *backup.Entry) error {
+	bundle := &deploy.Bundle{Name: entry.Name, Certificate: entry.Certificate, Chain: entry.Chain, PrivateKey: entry.PrivateKey}
+	if err := bundle.Validate(); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{entry.Name + ".crt", entry.Certificate, 0644},
+		{entry.Name + ".chain.crt", entry.Chain, 0644},
+		{entry.Name + ".key", entry.PrivateKey, 0600},
+	}
+	for _, f := range files {
+		if len(f.data) == 0 {
+			continue
+		}
+		path := filepath.Join(dir, f.name)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.mode)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(f.data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/limits"
+	"github.com/certfix/certfix-agent/pkg/scanner"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	// How often the heap is sampled for the high-water mark
+	MEMORY_SAMPLE_INTERVAL = 50 * time.Millisecond
+	// Fewer workers are recommended when they come this close to the best
+	BENCHMARK_TOLERANCE = 0.9
+	// Scans shorter than this make the numbers noise
+	MIN_BENCHMARK_DURATION = 200 * time.Millisecond
+)
+
+// One timed scan
+type benchmarkRun struct {
+	label   string
+	workers int
+	stats   scanner.Stats
+	// Highest heap in use while the scan ran
+	peakHeap uint64
+}
+
+func (r *benchmarkRun) filesPerSecond() float64 {
+	return perSecond(r.stats.FilesSeen, r.stats.Duration)
+}
+
+func (r *benchmarkRun) certsPerSecond() float64 {
+	return perSecond(r.stats.Certificates, r.stats.Duration)
+}
+
+// Measure how fast this host scans, before turning on full-disk scans. The
+// first pass reads from disk; the passes that follow are served by the OS
+// page cache and compare worker counts, and the last shows what the scan
+// cache saves on repeat scans.
+func handleBenchmark() {
+	benchCmd := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	paths := benchCmd.String("path", "", "Directories to scan, comma-separated (default: the configured scan paths)")
+	workerList := benchCmd.String("workers", "", "Worker counts to compare, comma-separated (default: 1, half the CPUs, the CPUs, twice the CPUs)")
+	benchCmd.Parse(os.Args[2:])
+
+	opts := scanner.Options{}
+	if config, err := loadConfig(); err == nil {
+		opts = scanOptions(config)
+		// Only the file walk is measured
+		opts.Endpoints = nil
+		opts.FilesPerSecond = 0
+	}
+	if *paths != "" {
+		opts.Roots = splitList(*paths)
+	}
+	if len(opts.Roots) == 0 {
+		fmt.Println("[ERROR] Nothing to scan; pass --path or configure scan.paths")
+		os.Exit(1)
+	}
+	for _, root := range opts.Roots {
+		if _, err := os.Stat(root); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	counts, err := benchmarkWorkers(*workerList)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Benchmarking scans of %s on %d CPUs\n\n", strings.Join(opts.Roots, ", "), runtime.GOMAXPROCS(0))
+
+	var runs []*benchmarkRun
+	cold := timeScan("cold", opts, runtime.GOMAXPROCS(0), nil)
+	runs = append(runs, cold)
+	var warm []*benchmarkRun
+	for _, n := range counts {
+		run := timeScan("warm", opts, n, nil)
+		warm = append(warm, run)
+		runs = append(runs, run)
+	}
+
+	// One pass fills the cache, the next is answered from it
+	cache := scanner.LoadCache(&memoryBlob{})
+	timeScan("", opts, runtime.GOMAXPROCS(0), cache)
+	cached := timeScan("cached", opts, runtime.GOMAXPROCS(0), cache)
+	runs = append(runs, cached)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PASS\tWORKERS\tFILES\tCERTS\tTIME\tFILES/S\tCERTS/S\tPEAK HEAP")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\t%.0f\t%.0f\t%s\n", run.label, run.workers,
+			run.stats.FilesSeen, run.stats.Certificates, run.stats.Duration.Round(time.Millisecond),
+			run.filesPerSecond(), run.certsPerSecond(), formatMiB(run.peakHeap))
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("Suggestions:")
+	for _, line := range benchmarkSuggestions(cold, warm, cached) {
+		fmt.Printf("  - %s\n", line)
+	}
+}
+
+// timeScan runs one scan while sampling the heap
+func timeScan(label string, opts scanner.Options, workers int, cache *scanner.Cache) *benchmarkRun {
+	opts.Workers = workers
+	opts.Cache = cache
+
+	runtime.GC()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var peak uint64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(MEMORY_SAMPLE_INTERVAL)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	result := scanner.Scan(context.Background(), opts)
+	close(stop)
+	wg.Wait()
+	return &benchmarkRun{label: label, workers: workers, stats: result.Stats, peakHeap: peak}
+}
+
+func benchmarkSuggestions(cold *benchmarkRun, warm []*benchmarkRun, cached *benchmarkRun) []string {
+	var lines []string
+	if cold.stats.FilesSeen == 0 {
+		return []string{"No files were found; check the paths and the scan.exclude patterns"}
+	}
+	if cold.stats.Duration < MIN_BENCHMARK_DURATION {
+		lines = append(lines, "The scan finished too quickly for reliable numbers; benchmark a larger directory tree")
+	}
+
+	// The fewest workers that come close to the best throughput
+	best := warm[0]
+	for _, run := range warm {
+		if run.filesPerSecond() > best.filesPerSecond() {
+			best = run
+		}
+	}
+	recommended := best
+	for _, run := range warm {
+		if run.filesPerSecond() >= best.filesPerSecond()*BENCHMARK_TOLERANCE && run.workers < recommended.workers {
+			recommended = run
+		}
+	}
+	if recommended.workers == runtime.GOMAXPROCS(0) {
+		lines = append(lines, fmt.Sprintf("The default of one worker per CPU (%d) is right for this host", recommended.workers))
+	} else {
+		lines = append(lines, fmt.Sprintf("Set \"scan\": {\"workers\": %d}; it reaches %.0f files/s, within %.0f%% of the best",
+			recommended.workers, recommended.filesPerSecond(), (1-BENCHMARK_TOLERANCE)*100))
+	}
+
+	// Reading from disk dominates when the cold pass is much slower
+	if ratio := cold.stats.Duration.Seconds() / max(best.stats.Duration.Seconds(), 1e-9); ratio > 2 {
+		lines = append(lines, fmt.Sprintf("The first pass was %.1fx slower than the ones from the page cache: scans are disk-bound, and more workers won't help a cold scan", ratio))
+	}
+
+	// The agent keeps the scan cache in its state; it pays off when parsing,
+	// not walking, is the cost
+	if cached.stats.Duration > 0 {
+		if speedup := best.stats.Duration.Seconds() / cached.stats.Duration.Seconds(); speedup >= 1.2 {
+			lines = append(lines, fmt.Sprintf("The scan cache makes repeat scans %.1fx faster (%v); unchanged files are not parsed again",
+				speedup, cached.stats.Duration.Round(time.Millisecond)))
+		} else {
+			lines = append(lines, "The scan cache gains little here: walking the tree costs more than parsing its certificates, so narrow scan.paths or add scan.exclude patterns instead")
+		}
+	}
+
+	// Throttled, a scan of this size takes four times as long but leaves
+	// most of the disk to the host's own work
+	throttled := int(cold.filesPerSecond() / 4)
+	if throttled > 0 && cold.stats.Duration >= MIN_BENCHMARK_DURATION {
+		eta := time.Duration(float64(cold.stats.FilesSeen) / float64(throttled) * float64(time.Second))
+		lines = append(lines, fmt.Sprintf("To keep scans gentle on busy disks, set \"files_per_second\": %d; this tree would then take about %v", throttled, eta.Round(time.Second)))
+	}
+
+	peak := uint64(0)
+	for _, run := range warm {
+		peak = max(peak, run.peakHeap)
+	}
+	if limit := limits.Current().MemoryBytes; limit > 0 && peak > uint64(limit)/4 {
+		lines = append(lines, fmt.Sprintf("Scans peaked at %s of heap, over a quarter of the %s memory limit; exclude large directories or lower the workers",
+			formatMiB(peak), formatMiB(uint64(limit))))
+	}
+	return lines
+}
+
+// benchmarkWorkers parses --workers, defaulting to a spread around the
+// number of CPUs
+func benchmarkWorkers(list string) ([]int, error) {
+	var counts []int
+	if list == "" {
+		cpus := runtime.GOMAXPROCS(0)
+		counts = []int{1, max(1, cpus/2), cpus, cpus * 2}
+	} else {
+		for _, field := range splitList(list) {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid worker count %q", field)
+			}
+			counts = append(counts, n)
+		}
+	}
+	sort.Ints(counts)
+	unique := counts[:0]
+	for i, n := range counts {
+		if i == 0 || n != counts[i-1] {
+			unique = append(unique, n)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("no worker counts given")
+	}
+	return unique, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func perSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// memoryBlob keeps a scan cache for the benchmark without touching the
+// agent's state
+type memoryBlob struct {
+	data []byte
+}
+
+func (b *memoryBlob) Load() ([]byte, error) {
+	if b.data == nil {
+		return nil, store.ErrNotFound
+	}
+	return b.data, nil
+}
+
+func (b *memoryBlob) Save(data []byte) error {
+	b.data = data
+	return nil
+}
+
+func formatMiB(bytes uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
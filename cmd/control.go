@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/events"
+)
+
+var CONTROL_SOCKET = filepath.Join(STATE_DIR, control.SOCKET_NAME)
+
+// Open the control socket in the background: /status is the dashboard's
+// snapshot, /events streams the agent's events, /events/stats counts what
+// each notification channel delivered and dropped, /state copies the state
+// database for 'backup', and a POST to /scan runs a scan and report cycle. Without it the agent runs as before.
+func startControl(config *Config, instance *client.InstanceData) {
+	// Under socket activation the unit owns the socket and its permissions
+	listener, err := control.Activated()
+	if err == nil && listener == nil {
+		listener, err = control.Listen(CONTROL_SOCKET)
+	} else if err == nil && listener.Addr().String() != CONTROL_SOCKET {
+		log.Printf("[WARNING] Socket unit listens on %s; commands look for the agent at %s", listener.Addr(), CONTROL_SOCKET)
+	}
+	if err != nil {
+		log.Printf("[WARNING] Control socket disabled: %v", err)
+		return
+	}
+	server := control.NewServer()
+	events.Default.AddNotifier(server.Events(), nil)
+	server.HandleJSON("/status", func() interface{} { return dashboardSnapshot(config, instance) })
+	server.HandleJSON("/events/stats", func() interface{} { return events.Default.Stats() })
+	server.Handle("/state", http.HandlerFunc(serveState))
+	server.HandleAction("/scan", requestRescan)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("[ERROR] Control socket stopped: %v", err)
+		}
+	}()
+}
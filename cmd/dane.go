@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/acme"
+	"github.com/certfix/certfix-agent/pkg/dane"
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const TLSA_PUBLISH_TIMEOUT = 5 * time.Minute
+
+// TLSAConfig publishes DANE TLSA records for a managed certificate
+type TLSAConfig struct {
+	// Ports default to 25 (SMTP)
+	Ports    []int  `json:"ports,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Records as "usage selector matching"; defaults to "3 1 1"
+	Records []string `json:"records,omitempty"`
+	// DNSProvider from dns_providers; without it records are only reported
+	DNSProvider string `json:"dns_provider,omitempty"`
+}
+
+// The TLSA records of a managed certificate and of the one before it,
+// which stay published until the next renewal so servers still presenting
+// the old certificate keep validating during the rollover
+type tlsaStatus struct {
+	Fingerprint string        `json:"fingerprint_sha256"`
+	Records     []dane.Record `json:"records"`
+	Previous    []dane.Record `json:"previous,omitempty"`
+	PublishedAt time.Time     `json:"published_at,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// updateTLSA computes the records of the current certificate and publishes
+// them before it is deployed. A failure holds the deployment back, since a
+// certificate that doesn't match the published records breaks delivery.
+func updateTLSA(config *Config, managed *ManagedCertificate, key string, record *renewalRecord) error {
+	if managed.TLSA == nil {
+		record.TLSA = nil
+		return nil
+	}
+	status := record.TLSA
+	if status == nil {
+		status = &tlsaStatus{}
+		record.TLSA = status
+	}
+
+	records, err := tlsaRecords(managed, key)
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	// A new certificate moves the records to Previous; changed settings
+	// just replace them
+	if status.Fingerprint != record.Fingerprint {
+		status.Previous = status.Records
+	}
+	if status.Fingerprint != record.Fingerprint || !slices.Equal(status.Records, records) {
+		status.Records = records
+		status.Fingerprint = record.Fingerprint
+		status.PublishedAt = time.Time{}
+	}
+	if managed.TLSA.DNSProvider == "" || !status.PublishedAt.IsZero() {
+		return nil
+	}
+
+	if err := publishTLSA(config, managed.TLSA.DNSProvider, status); err != nil {
+		status.Error = err.Error()
+		return fmt.Errorf("failed to publish TLSA records: %w", err)
+	}
+	status.PublishedAt = time.Now().UTC()
+	status.Error = ""
+	log.Printf("[SUCCESS] Published %d TLSA records for %s", len(status.Records), managed.Name)
+	return nil
+}
+
+func tlsaRecords(managed *ManagedCertificate, key string) ([]dane.Record, error) {
+	var cert acme.Certificate
+	if err := stateDB.Get(store.BUCKET_CERTIFICATES, key, &cert); err != nil {
+		return nil, fmt.Errorf("failed to load issued certificate: %w", err)
+	}
+	chain, err := parseChain(slices.Concat(cert.Certificate, cert.Chain))
+	if err != nil {
+		return nil, err
+	}
+	params, err := managed.TLSA.params()
+	if err != nil {
+		return nil, err
+	}
+
+	proto := managed.TLSA.Protocol
+	if proto == "" {
+		proto = dane.DEFAULT_PROTO
+	}
+	ports := managed.TLSA.Ports
+	if len(ports) == 0 {
+		ports = []int{dane.DEFAULT_PORT}
+	}
+	var records []dane.Record
+	for _, port := range ports {
+		portRecords, err := dane.Records(managed.Domains, port, proto, params, chain)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, portRecords...)
+	}
+	return records, nil
+}
+
+func (c *TLSAConfig) params() ([]dane.Params, error) {
+	values := c.Records
+	if len(values) == 0 {
+		values = []string{dane.DEFAULT_PARAMS}
+	}
+	params := make([]dane.Params, len(values))
+	for i, value := range values {
+		p, err := dane.ParseParams(value)
+		if err != nil {
+			return nil, err
+		}
+		params[i] = p
+	}
+	return params, nil
+}
+
+// Every name gets its current and previous values as one record set
+func publishTLSA(config *Config, providerName string, status *tlsaStatus) error {
+	options, ok := config.DNSProviders[providerName]
+	if !ok {
+		return fmt.Errorf("DNS provider %q is not configured", providerName)
+	}
+	provider, err := dns01.New(providerName, options)
+	if err != nil {
+		return err
+	}
+	setter, ok := provider.(dns01.RecordSetter)
+	if !ok {
+		return fmt.Errorf("DNS provider %q cannot publish TLSA records", providerName)
+	}
+
+	grouped := dane.ByName(slices.Concat(status.Records, status.Previous))
+	names := make([]string, 0, len(grouped))
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), TLSA_PUBLISH_TIMEOUT)
+	defer cancel()
+	for _, name := range names {
+		values := grouped[name]
+		slices.Sort(values)
+		values = slices.Compact(values)
+		if err := setter.SetRecords(ctx, name, "TLSA", values, dane.RECORD_TTL); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func parseChain(data []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return chain, nil
+}
+
+// TLSA records of every managed certificate, for the inventory
+func managedTLSA(config *Config) []dane.Record {
+	if config.ACME == nil || stateDB == nil {
+		return nil
+	}
+	var records []dane.Record
+	for _, managed := range config.ACME.Certificates {
+		if managed.TLSA == nil {
+			continue
+		}
+		var record renewalRecord
+		if err := stateDB.Get(store.BUCKET_RENEWALS, renewalKey(managed.Name), &record); err != nil || record.TLSA == nil {
+			continue
+		}
+		records = append(records, record.TLSA.Records...)
+	}
+	return records
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/breaker"
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/dashboard"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/fips"
+	"github.com/certfix/certfix-agent/pkg/redact"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	// Deployments and tasks listed on the dashboard
+	DASHBOARD_RECENT = 20
+	// Renewal failures shown as a warning until this many in a row
+	DASHBOARD_FAILURES_CRITICAL = 3
+)
+
+// Served on a loopback address only; Listen defaults to 127.0.0.1:9180
+type DashboardConfig struct {
+	Listen   string `json:"listen,omitempty"`
+	LogLines int    `json:"log_lines,omitempty"`
+}
+
+var (
+	dashboardLogs    *dashboard.LogBuffer
+	dashboardStarted = time.Now()
+)
+
+// The outcome of the latest API calls, for the dashboard's health summary
+var apiActivity = &apiCalls{}
+
+type apiCalls struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+func (a *apiCalls) record(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.lastFailure, a.lastError = time.Now(), err.Error()
+	} else {
+		a.lastSuccess = time.Now()
+	}
+}
+
+// keepDashboardLogs copies the agent's log, redacted like the rest, into
+// the buffer the dashboard shows
+func keepDashboardLogs(config *DashboardConfig) {
+	dashboardLogs = dashboard.NewLogBuffer(config.LogLines)
+	log.SetOutput(redact.NewWriter(io.MultiWriter(os.Stderr, dashboardLogs)))
+}
+
+// Serve the dashboard in the background; a failure to listen only
+// disables it
+func startDashboard(config *Config, instance *client.InstanceData) {
+	listener, err := dashboard.Listen(config.Dashboard.Listen)
+	if err != nil {
+		log.Printf("[ERROR] Dashboard disabled: %v", err)
+		return
+	}
+	snapshot := func() *dashboard.Snapshot { return dashboardSnapshot(config, instance) }
+	go func() {
+		if err := dashboard.Serve(listener, snapshot, dashboardLogs); err != nil {
+			log.Printf("[ERROR] Dashboard stopped: %v", err)
+		}
+	}()
+}
+
+func dashboardSnapshot(config *Config, instance *client.InstanceData) *dashboard.Snapshot {
+	var identity storedIdentity
+	stateDB.Get(store.BUCKET_IDENTITY, instance.MachineID, &identity)
+
+	snapshot := &dashboard.Snapshot{
+		GeneratedAt: time.Now(),
+		Agent: dashboard.Agent{
+			Version:    config.CurrentVersion,
+			Hostname:   instance.Hostname,
+			InstanceID: identity.InstanceID,
+			Endpoint:   config.Endpoint,
+			StartedAt:  dashboardStarted,
+			FIPS:       fmt.Sprint(fips.Current()),
+			Sandbox:    config.Sandbox,
+		},
+		Certificates: []dashboard.Certificate{},
+		Deployments:  []dashboard.Deployment{},
+		Tasks:        []dashboard.Task{},
+	}
+	apiActivity.mu.Lock()
+	snapshot.Agent.LastAPIContact = apiActivity.lastSuccess
+	apiActivity.mu.Unlock()
+	snapshot.Health = append(snapshot.Health, apiHealth(), inventoryHealth(identity.InstanceID), clockHealth(), notificationsHealth())
+	if check, ok := apiNoticesHealth(); ok {
+		snapshot.Health = append(snapshot.Health, check)
+	}
+	if config.Stapling != nil {
+		snapshot.Health = append(snapshot.Health, staplingHealth())
+	}
+	if m := currentMaintenance(); m != nil {
+		snapshot.Health = append(snapshot.Health, dashboard.Check{Name: "Maintenance", Status: dashboard.CHECK_WARN, Detail: "renewals and deployments paused: " + describeMaintenance(m)})
+	}
+	if config.ACME != nil {
+		managedSnapshot(config, snapshot)
+	}
+	snapshot.Tasks = recentTasks()
+	return snapshot
+}
+
+func apiHealth() dashboard.Check {
+	check := dashboard.Check{Name: "API"}
+	apiActivity.mu.Lock()
+	defer apiActivity.mu.Unlock()
+	switch {
+	case apiBreaker.State() == breaker.STATE_OPEN:
+		check.Status, check.Detail = dashboard.CHECK_FAIL, "unreachable, calls paused: "+apiActivity.lastError
+	case apiActivity.lastSuccess.IsZero() && apiActivity.lastFailure.IsZero():
+		check.Status, check.Detail = dashboard.CHECK_WARN, "not contacted yet"
+	case apiActivity.lastFailure.After(apiActivity.lastSuccess):
+		check.Status, check.Detail = dashboard.CHECK_WARN, "last call failed: "+apiActivity.lastError
+	default:
+		check.Status, check.Detail = dashboard.CHECK_OK, "last call succeeded at "+apiActivity.lastSuccess.Format(time.RFC3339)
+	}
+	return check
+}
+
+func inventoryHealth(instanceID string) dashboard.Check {
+	check := dashboard.Check{Name: "Inventory", Status: dashboard.CHECK_WARN, Detail: "not collected yet"}
+	var stored storedInventory
+	if instanceID == "" || stateDB.Get(store.BUCKET_INVENTORY, instanceID, &stored) != nil || stored.Report == nil {
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d certificates at %s", len(stored.Report.Certificates), stored.GeneratedAt.Local().Format(time.RFC3339))
+	if !stored.Uploaded {
+		check.Detail += ", not uploaded"
+		return check
+	}
+	check.Status = dashboard.CHECK_OK
+	if len(stored.Report.Errors) > 0 {
+		check.Status = dashboard.CHECK_WARN
+		check.Detail += fmt.Sprintf(", %d errors: %s", len(stored.Report.Errors), strings.Join(stored.Report.Errors, "; "))
+	}
+	return check
+}
+
+func clockHealth() dashboard.Check {
+	check := dashboard.Check{Name: "Clock", Status: dashboard.CHECK_OK, Detail: "not measured yet"}
+	if skew, ok := clockTracker.Skew(); ok {
+		check.Detail = clockcheck.Describe(skew)
+		if clockcheck.IsSignificant(skew) {
+			check.Status = dashboard.CHECK_WARN
+		}
+	}
+	return check
+}
+
+// notificationsHealth warns when channels lose events to full queues
+func notificationsHealth() dashboard.Check {
+	check := dashboard.Check{Name: "Notifications", Status: dashboard.CHECK_OK, Detail: "no channels"}
+	stats := events.Default.Stats()
+	var dropped []string
+	failed := int64(0)
+	for _, s := range stats {
+		if s.Dropped > 0 {
+			dropped = append(dropped, fmt.Sprintf("%s: %d", s.Notifier, s.Dropped))
+		}
+		failed += s.Failed
+	}
+	switch {
+	case len(dropped) > 0:
+		check.Status, check.Detail = dashboard.CHECK_WARN, "events dropped on full queues ("+strings.Join(dropped, ", ")+")"
+	case failed > 0:
+		check.Status, check.Detail = dashboard.CHECK_WARN, fmt.Sprintf("%d events failed to deliver", failed)
+	case len(stats) > 0:
+		check.Detail = "nothing dropped"
+	}
+	return check
+}
+
+// managedSnapshot adds the managed certificates, their deployments and a
+// health line summing up renewals
+func managedSnapshot(config *Config, snapshot *dashboard.Snapshot) {
+	records := managedRecords(config)
+	failing := 0
+	for i := range config.ACME.Certificates {
+		managed := &config.ACME.Certificates[i]
+		record := records[managed.Name]
+		policy := renewalPolicy(config, managed)
+		cert := dashboard.Certificate{
+			Name:           managed.Name,
+			Domains:        managed.Domains,
+			Labels:         managed.Labels,
+			NotBefore:      record.NotBefore,
+			NotAfter:       record.NotAfter,
+			NextAttempt:    record.NextAttempt,
+			AwaitingWindow: record.AwaitingWindow,
+			Status:         dashboard.CHECK_OK,
+		}
+		if record.NotAfter.IsZero() {
+			cert.Status, cert.Detail = dashboard.CHECK_WARN, "not issued yet"
+		} else {
+			cert.RenewAt = renewalTime(managed, &policy, &record)
+		}
+		switch {
+		case record.LastError != "":
+			failing++
+			cert.Status = dashboard.CHECK_WARN
+			if record.Failures >= DASHBOARD_FAILURES_CRITICAL || clockTracker.CorrectedNow().After(record.NotAfter) {
+				cert.Status = dashboard.CHECK_FAIL
+			}
+			cert.Detail = fmt.Sprintf("%d failed attempts, next at %s: %s", record.Failures, record.NextAttempt.Local().Format(time.RFC3339), record.LastError)
+		case record.AwaitingWindow:
+			cert.Detail = "deploys in the maintenance window at " + record.NextAttempt.Local().Format(time.RFC3339)
+		}
+		snapshot.Certificates = append(snapshot.Certificates, cert)
+
+		for id, destination := range record.Destinations {
+			snapshot.Deployments = append(snapshot.Deployments, dashboard.Deployment{
+				Certificate: managed.Name,
+				Destination: id,
+				At:          destination.DeployedAt,
+				Error:       destination.Error,
+			})
+		}
+	}
+
+	// Newest first; failed deployments that never succeeded go last
+	sort.Slice(snapshot.Deployments, func(i, j int) bool {
+		return snapshot.Deployments[i].At.After(snapshot.Deployments[j].At)
+	})
+	if len(snapshot.Deployments) > DASHBOARD_RECENT {
+		snapshot.Deployments = snapshot.Deployments[:DASHBOARD_RECENT]
+	}
+
+	check := dashboard.Check{Name: "Renewals", Status: dashboard.CHECK_OK, Detail: fmt.Sprintf("%d certificates managed", len(snapshot.Certificates))}
+	if failing > 0 {
+		check.Status, check.Detail = dashboard.CHECK_WARN, fmt.Sprintf("%d of %d certificates failing to renew", failing, len(snapshot.Certificates))
+	}
+	snapshot.Health = append(snapshot.Health, check)
+}
+
+// recentTasks lists the latest finished tasks, newest first
+func recentTasks() []dashboard.Task {
+	tasks := []dashboard.Task{}
+	err := stateDB.Queue(store.BUCKET_TASKS, TASK_HISTORY_QUEUE, MAX_TASK_HISTORY).List(func(data []byte) error {
+		var record taskRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil
+		}
+		tasks = append(tasks, dashboard.Task{ID: record.TaskID, Type: record.Type, Status: record.Status, Error: record.Error, FinishedAt: record.FinishedAt})
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARNING] Dashboard: failed to read task history: %v", err)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].FinishedAt.After(tasks[j].FinishedAt) })
+	if len(tasks) > DASHBOARD_RECENT {
+		tasks = tasks[:DASHBOARD_RECENT]
+	}
+	return tasks
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/dnscheck"
+	"github.com/certfix/certfix-agent/pkg/firewall"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+	"github.com/certfix/certfix-agent/pkg/webserver"
+)
+
+const (
+	CHECK_OK   = "OK"
+	CHECK_WARN = "WARN"
+	CHECK_FAIL = "FAIL"
+	CHECK_SKIP = "SKIP"
+)
+
+// doctorCheck is a single diagnostic run by the doctor command
+type doctorCheck struct {
+	name string
+	run  func(config *Config) (status string, detail string)
+}
+
+var doctorChecks = []doctorCheck{
+	{name: "API connectivity", run: checkAPIConnectivity},
+	{name: "TLS negotiation", run: checkTLS},
+	{name: "Clock skew", run: checkClockSkew},
+	{name: "Time synchronization", run: checkNTP},
+	{name: "DNS resolver", run: checkResolver},
+	{name: "DNS for served names", run: checkDNS},
+	{name: "Challenge ports", run: checkChallengePorts},
+}
+
+func handleDoctor() {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[FAIL] Configuration: %v\n", err)
+		fmt.Println("[INFO] Run 'certfix-agent configure' to set up the agent")
+		os.Exit(1)
+	}
+
+	fmt.Println("CertFix Agent Doctor")
+	fmt.Println("─────────────────────────────────────────────────")
+	if err := configureHTTP(config); err != nil {
+		fmt.Printf("[%s] Configuration: %v\n", CHECK_FAIL, err)
+		os.Exit(1)
+	}
+	fmt.Printf("[%s] Configuration: %s\n", CHECK_OK, CONFIG_FILE)
+
+	failed := false
+	for _, check := range doctorChecks {
+		status, detail := check.run(config)
+		fmt.Printf("[%s] %s: %s\n", status, check.name, detail)
+		if status == CHECK_FAIL {
+			failed = true
+		}
+	}
+	fmt.Println("─────────────────────────────────────────────────")
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Probe the API endpoint; any HTTP response proves connectivity
+func probeEndpoint(config *Config) (*http.Response, time.Time, time.Time, error) {
+	req, err := http.NewRequest("HEAD", strings.TrimRight(config.Endpoint, "/"), nil)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	client := httpclient.New(10 * time.Second)
+	sent := time.Now()
+	resp, err := client.Do(req)
+	received := time.Now()
+	if err != nil {
+		return nil, sent, received, err
+	}
+	resp.Body.Close()
+	return resp, sent, received, nil
+}
+
+func checkAPIConnectivity(config *Config) (string, string) {
+	resp, sent, received, err := probeEndpoint(config)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	return CHECK_OK, fmt.Sprintf("%s responded %d in %v", config.Endpoint, resp.StatusCode, received.Sub(sent).Round(time.Millisecond))
+}
+
+func checkTLS(config *Config) (string, string) {
+	resp, _, _, err := probeEndpoint(config)
+	if err != nil {
+		return CHECK_SKIP, "API unreachable"
+	}
+
+	detail := httpclient.DescribeConnection(resp.TLS)
+	if resp.TLS == nil {
+		return CHECK_WARN, detail
+	}
+	if config.TLS.InsecureSkipVerify {
+		return CHECK_WARN, detail + " (certificate verification disabled)"
+	}
+	return CHECK_OK, detail
+}
+
+func checkClockSkew(config *Config) (string, string) {
+	resp, sent, received, err := probeEndpoint(config)
+	if err != nil {
+		return CHECK_SKIP, "API unreachable"
+	}
+
+	skew, err := clockcheck.SkewFromResponse(resp, sent, received)
+	if err != nil {
+		return CHECK_SKIP, err.Error()
+	}
+	if clockcheck.IsSignificant(skew) {
+		return CHECK_FAIL, "local clock is " + clockcheck.Describe(skew)
+	}
+	return CHECK_OK, "local clock is " + clockcheck.Describe(skew)
+}
+
+func checkNTP(config *Config) (string, string) {
+	status := clockcheck.CheckNTP()
+	if status == nil {
+		return CHECK_WARN, "no chrony, ntpd or systemd-timesyncd found"
+	}
+	if !status.Synchronized {
+		return CHECK_WARN, fmt.Sprintf("%s: %s", status.Source, status.Detail)
+	}
+	return CHECK_OK, fmt.Sprintf("%s synchronized (offset %v)", status.Source, status.Offset)
+}
+
+// checkResolver asks the configured DNS over HTTPS or TLS resolver for the
+// root name servers
+func checkResolver(config *Config) (string, string) {
+	if config.DNS == nil {
+		return CHECK_SKIP, "system resolver in use"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), securedns.QUERY_TIMEOUT)
+	defer cancel()
+	servers, err := securedns.Resolver().LookupNS(ctx, ".")
+	if err != nil {
+		return CHECK_FAIL, fmt.Sprintf("%s: %v", config.DNS.Resolver, err)
+	}
+	return CHECK_OK, fmt.Sprintf("%s answers (%d root name servers)", config.DNS.Resolver, len(servers))
+}
+
+func checkDNS(config *Config) (string, string) {
+	report := inventory.Build(webserver.FindCertUsages(webserver.Detect()))
+	names := report.ServedNames()
+	if len(names) == 0 {
+		return CHECK_SKIP, "no served certificate names found"
+	}
+
+	checker, err := dnscheck.NewChecker(config.KnownAddresses)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+
+	results := checker.Check(context.Background(), names)
+	mismatches := dnscheck.Mismatches(results)
+	if len(mismatches) == 0 {
+		return CHECK_OK, fmt.Sprintf("%d names resolve to this host", len(results))
+	}
+
+	var details []string
+	for _, mismatch := range mismatches {
+		if mismatch.Error != "" {
+			details = append(details, mismatch.Name+" (unresolvable)")
+		} else {
+			details = append(details, fmt.Sprintf("%s -> %s", mismatch.Name, strings.Join(mismatch.Resolved, ",")))
+		}
+	}
+	return CHECK_WARN, fmt.Sprintf("%d of %d names point elsewhere: %s", len(mismatches), len(results), strings.Join(details, "; "))
+}
+
+func checkChallengePorts(config *Config) (string, string) {
+	var details []string
+	status := CHECK_OK
+
+	for _, challenge := range []string{firewall.CHALLENGE_HTTP_01, firewall.CHALLENGE_TLS_ALPN_01} {
+		port := firewall.ChallengePort(challenge)
+		result := firewall.CheckPort(port)
+		if result.Allowed {
+			details = append(details, fmt.Sprintf("%s port %d open (%s)", challenge, port, result.Backend))
+			continue
+		}
+		status = CHECK_WARN
+		details = append(details, (&firewall.BlockedError{Status: result}).Error())
+	}
+
+	return status, strings.Join(details, "; ")
+}
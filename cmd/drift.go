@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/drift"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	DEFAULT_DRIFT_INTERVAL = 15 * time.Minute
+	DRIFT_CHECK_TIMEOUT    = 2 * time.Minute
+)
+
+// Compare deployed certificates with the desired state on a schedule
+type DriftConfig struct {
+	Disabled        bool `json:"disabled,omitempty"`
+	IntervalMinutes int  `json:"interval_minutes,omitempty"`
+	// Ask the server to redeploy certificates that drifted
+	AutoRemediate bool `json:"auto_remediate,omitempty"`
+}
+
+// Findings already announced, so an unresolved drift alerts once
+var driftNotified = map[string]bool{}
+
+func driftEnabled(config *Config) bool {
+	return config.Drift == nil || !config.Drift.Disabled
+}
+
+func driftInterval(config *Config) time.Duration {
+	if config.Drift != nil && config.Drift.IntervalMinutes > 0 {
+		return time.Duration(config.Drift.IntervalMinutes) * time.Minute
+	}
+	return DEFAULT_DRIFT_INTERVAL
+}
+
+// deploymentRecorder remembers every successful deployment as the local
+// desired state; a tenant's are kept apart from the host's
+type deploymentRecorder struct {
+	tenant string
+}
+
+func (deploymentRecorder) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	return nil
+}
+
+func (r deploymentRecorder) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	expected := drift.Record(req, bundle, result)
+	if len(expected.Files) == 0 {
+		return nil
+	}
+	key := expected.Key()
+	if r.tenant != "" {
+		key = TENANT_DEPLOYMENT_PREFIX + r.tenant + ":" + key
+	}
+	if err := stateDB.Put(store.BUCKET_DEPLOYMENTS, key, expected); err != nil {
+		log.Printf("[WARNING] Failed to record deployment of %s: %v", req.Name, err)
+	}
+	return nil
+}
+
+// The server's desired state wins where it has one; local records fill in
+// the file details it doesn't know, and are all there is when it can't be
+// reached
+func desiredDeployments(config *Config, instanceID string) []*drift.Expected {
+	local := map[string]*drift.Expected{}
+	err := stateDB.ForEach(store.BUCKET_DEPLOYMENTS, func(key string, data []byte) error {
+		if strings.HasPrefix(key, TENANT_DEPLOYMENT_PREFIX) {
+			return nil
+		}
+		var exp drift.Expected
+		if err := json.Unmarshal(data, &exp); err != nil {
+			log.Printf("[WARNING] Ignoring unreadable deployment record %s: %v", key, err)
+			return nil
+		}
+		local[key] = &exp
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed to read deployment records: %v", err)
+	}
+
+	var remote []*drift.Expected
+	supported := true
+	err = callAPI(func() error {
+		var err error
+		remote, err = apiClient(config).DesiredDeployments(context.Background(), instanceID)
+		// Older servers don't publish a desired state; that is no outage
+		var statusErr *client.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			supported = false
+			return nil
+		}
+		return err
+	})
+
+	if err != nil || !supported {
+		if err != nil {
+			log.Printf("[WARNING] Desired state unavailable, checking local deployment records: %v", err)
+		}
+		expected := make([]*drift.Expected, 0, len(local))
+		for _, exp := range local {
+			expected = append(expected, exp)
+		}
+		return expected
+	}
+
+	listed := map[string]bool{}
+	for i, exp := range remote {
+		listed[exp.Key()] = true
+		if rec, ok := local[exp.Key()]; ok && rec.Fingerprint == exp.Fingerprint {
+			rec.Endpoints = exp.Endpoints
+			remote[i] = rec
+		}
+	}
+	// The server doesn't know what the agent's own ACME certificates should
+	// look like; their records are the desired state
+	if config.ACME != nil {
+		for _, managed := range config.ACME.Certificates {
+			for key, rec := range local {
+				if rec.Name == managed.Name && !listed[key] {
+					remote = append(remote, rec)
+				}
+			}
+		}
+	}
+	return remote
+}
+
+// Check for drift and report it
+func checkDrift(config *Config, instanceID string) {
+	checkDriftOf(config, instanceID, nil, config.Drift != nil && config.Drift.AutoRemediate)
+}
+
+// checkDriftOf checks the deployments that wrote one of paths, or all of
+// them when paths is nil, and reports what it found
+func checkDriftOf(config *Config, instanceID string, paths map[string]bool, remediate bool) *drift.Report {
+	expected := desiredDeployments(config, instanceID)
+	if paths != nil {
+		expected = slices.DeleteFunc(expected, func(exp *drift.Expected) bool {
+			return !slices.ContainsFunc(exp.Files, func(f drift.File) bool { return paths[f.Path] })
+		})
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DRIFT_CHECK_TIMEOUT)
+	report := drift.Check(ctx, expected)
+	cancel()
+	// Redeployments would only be refused during maintenance
+	report.Remediate = remediate && currentMaintenance() == nil
+
+	for _, msg := range report.Errors {
+		log.Printf("[WARNING] Drift check: %s", msg)
+	}
+	current := map[string]bool{}
+	for _, finding := range report.Findings {
+		id := finding.ID()
+		current[id] = true
+		log.Printf("[WARNING] Drift: %s", describeDrift(&finding))
+		if !driftNotified[id] {
+			events.Publish(events.Event{
+				Type:     events.EVENT_DRIFT_DETECTED,
+				Severity: events.SEVERITY_WARNING,
+				Summary:  describeDrift(&finding),
+				Details: map[string]string{
+					"certificate": finding.Name,
+					"target":      finding.Target,
+					"kind":        finding.Kind,
+				},
+			})
+		}
+	}
+	// Resolved findings may alert again if they come back; a check of some
+	// deployments can't tell which of the others were resolved
+	if paths == nil {
+		driftNotified = current
+	} else {
+		for id := range current {
+			driftNotified[id] = true
+		}
+	}
+
+	var resp *client.DriftResponse
+	err := callAPI(func() error {
+		var err error
+		resp, err = apiClient(config).ReportDrift(context.Background(), instanceID, report)
+		var statusErr *client.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("[ERROR] Drift report failed: %v", err)
+		return report
+	}
+	if len(report.Findings) == 0 {
+		log.Printf("[INFO] Drift check: %d deployments match", report.Checked)
+	} else if resp != nil && resp.Queued > 0 {
+		log.Printf("[INFO] Server queued %d redeployments to remediate drift", resp.Queued)
+	}
+	return report
+}
+
+func describeDrift(f *drift.Finding) string {
+	location := f.Path
+	if location == "" {
+		location = f.Endpoint
+	}
+	switch f.Kind {
+	case drift.KIND_MISSING:
+		return fmt.Sprintf("%s (%s): %s was deleted", f.Name, f.Target, location)
+	case drift.KIND_REPLACED:
+		return fmt.Sprintf("%s (%s): %s holds a different certificate", f.Name, f.Target, location)
+	case drift.KIND_CHAIN_MODIFIED:
+		return fmt.Sprintf("%s (%s): chain in %s was modified", f.Name, f.Target, location)
+	case drift.KIND_KEY_MISMATCH:
+		return fmt.Sprintf("%s (%s): %s holds a different private key", f.Name, f.Target, location)
+	case drift.KIND_NOT_SERVED:
+		return fmt.Sprintf("%s (%s): %s serves a different certificate", f.Name, f.Target, location)
+	}
+	return fmt.Sprintf("%s (%s): %s was modified", f.Name, f.Target, location)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+const (
+	EXPORT_CSV  = "csv"
+	EXPORT_JSON = "json"
+)
+
+var exportColumns = []string{
+	"location", "path", "endpoint", "common_name", "dns_names", "ip_addresses",
+	"subject", "issuer", "serial_number", "not_before", "not_after", "days_left",
+	"key_algorithm", "key_size", "signature_algorithm", "fingerprint_sha256",
+	"is_ca", "chain_length", "staging", "managed", "labels", "deployed_to",
+}
+
+// Write the local inventory to a file for audits and spreadsheets, without
+// contacting the API
+func handleExport() {
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	format := exportCmd.String("format", "", "csv or json; taken from the --out extension by default, else json")
+	out := exportCmd.String("out", "-", "File to write, or - for standard output")
+	exportCmd.Parse(os.Args[2:])
+
+	if *format == "" {
+		*format = EXPORT_JSON
+		if strings.EqualFold(filepath.Ext(*out), "."+EXPORT_CSV) {
+			*format = EXPORT_CSV
+		}
+	}
+	if *format != EXPORT_CSV && *format != EXPORT_JSON {
+		fmt.Printf("[ERROR] Unknown export format %q (want %s or %s)\n", *format, EXPORT_CSV, EXPORT_JSON)
+		os.Exit(1)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	report := discoverCertificates(config)
+
+	var data []byte
+	if *format == EXPORT_CSV {
+		data, err = exportCSV(report)
+	} else {
+		data, err = json.MarshalIndent(report, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to encode the inventory: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *out == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := filetransfer.WriteFileAtomic(*out, data, filetransfer.PUBLIC_FILE_MODE); err != nil {
+		fmt.Printf("[ERROR] Failed to write %s: %v\n", *out, err)
+		os.Exit(1)
+	}
+	fmt.Printf("[SUCCESS] Exported %d certificates to %s\n", len(report.Certificates), *out)
+	for _, msg := range report.Errors {
+		fmt.Printf("[WARNING] %s\n", msg)
+	}
+}
+
+// exportCSV writes one row per certificate found; lists are joined with
+// "; " so every certificate stays on one row
+func exportCSV(report *inventory.Report) ([]byte, error) {
+	destinations := map[string][]string{}
+	for _, managed := range report.Managed {
+		destinations[managed.Name] = managed.Destinations
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(exportColumns)
+	for _, cert := range report.Certificates {
+		location := cert.Path
+		if cert.Endpoint != "" {
+			location = cert.Endpoint
+		}
+		keySize := ""
+		if cert.KeySize > 0 {
+			keySize = strconv.Itoa(cert.KeySize)
+		}
+		row := []string{
+			location, cert.Path, cert.Endpoint, cert.CommonName,
+			strings.Join(cert.DNSNames, "; "), strings.Join(cert.IPAddresses, "; "),
+			cert.Subject, cert.Issuer, cert.SerialNumber,
+			cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339),
+			strconv.Itoa(int(time.Until(cert.NotAfter).Hours() / 24)),
+			cert.KeyAlgorithm, keySize, cert.SignatureAlgorithm, cert.FingerprintSHA256,
+			strconv.FormatBool(cert.IsCA), strconv.Itoa(cert.ChainLength), strconv.FormatBool(cert.Staging),
+			cert.Managed, formatLabels(cert.Labels),
+			strings.Join(deployedTo(&cert, destinations[cert.Managed]), "; "),
+		}
+		for i := range row {
+			row[i] = spreadsheetSafe(row[i])
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// deployedTo lists where a certificate is in use: the web server vhosts
+// referencing its file, the container it was found in and, for a managed
+// certificate, the deploy destinations it was installed to
+func deployedTo(cert *inventory.Certificate, destinations []string) []string {
+	var locations []string
+	for _, usage := range cert.Usages {
+		location := fmt.Sprintf("%s %s:%d", usage.Server, usage.ConfigFile, usage.Line)
+		if names := strings.Join(usage.ServerNames, ","); names != "" {
+			location += " (" + names + ")"
+		}
+		locations = append(locations, location)
+	}
+	if c := cert.Container; c != nil {
+		locations = append(locations, fmt.Sprintf("container %s (%s)", c.Name, c.Image))
+	}
+	for _, id := range destinations {
+		locations = append(locations, "deploy "+id)
+	}
+	return locations
+}
+
+// spreadsheetSafe keeps a cell from being read as a formula; subjects and
+// names come from the certificates, which anyone could have issued
+func spreadsheetSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
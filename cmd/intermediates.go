@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"log"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/intermediates"
+)
+
+const (
+	STATE_INTERMEDIATES = "intermediates"
+	AIA_FETCH_TIMEOUT   = 15 * time.Second
+)
+
+// setupIntermediates persists the shared intermediate cache and lets it
+// fetch missing issuers over AIA unless the configuration forbids it
+func setupIntermediates(config *Config) {
+	if err := intermediates.Default.Load(stateDB.Blob(STATE_INTERMEDIATES)); err != nil {
+		log.Printf("[WARNING] Starting with an empty intermediate cache: %v", err)
+	}
+	if !config.DisableAIAFetch {
+		intermediates.Default.SetClient(httpclient.New(AIA_FETCH_TIMEOUT))
+	}
+}
+
+// chainCompleter adds the intermediates a bundle lacks, from the cache or
+// AIA, so servers never send an incomplete chain. A chain that cannot be
+// completed is deployed as given.
+type chainCompleter struct{}
+
+func (chainCompleter) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	given := intermediates.ParsePEM(bundle.Chain)
+	chain, err := intermediates.Default.Complete(ctx, bundle.Leaf(), given)
+	if err != nil {
+		log.Printf("[WARNING] Chain of %s may be incomplete: %v", bundle.Name, err)
+	}
+	if len(chain) <= len(given) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	bundle.Chain = buf.Bytes()
+	log.Printf("[INFO] Completed chain of %s with %d intermediates", bundle.Name, len(chain)-len(given))
+	return nil
+}
+
+func (chainCompleter) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const MAX_LABEL_VALUE = 63
+
+// Label keys are lower case, optionally prefixed like team/owner
+var labelKeyPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._/-]{0,61}[a-z0-9])?$`)
+
+// Label values stay clear of the selector syntax
+var labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._/@:+-]*$`)
+
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key %q: want lower case letters, digits and . _ / -", key)
+		}
+		if len(value) > MAX_LABEL_VALUE || !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("invalid value for label %s: at most %d letters, digits and . _ / @ : + -", key, MAX_LABEL_VALUE)
+		}
+	}
+	return nil
+}
+
+// formatLabels prints labels sorted by key, as a selector would match them
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// tagManaged lists the managed certificates in the inventory, with their
+// labels and where they are deployed, and gives the files found of each
+// its name and labels, so the server can group them
+func tagManaged(config *Config, report *inventory.Report) {
+	if config.ACME == nil {
+		return
+	}
+	records := managedRecords(config)
+	for _, managed := range config.ACME.Certificates {
+		labels := managed.Labels
+		if err := validateLabels(labels); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("labels of %s: %v", managed.Name, err))
+			labels = nil
+		}
+		record := records[managed.Name]
+		fingerprints := []string{record.Fingerprint}
+		if record.Rotation != nil && record.Rotation.CompletedAt.IsZero() {
+			fingerprints = append(fingerprints, record.Rotation.Previous)
+		}
+		var destinations []string
+		for id, destination := range record.Destinations {
+			if destination.Fingerprint == record.Fingerprint && destination.Error == "" {
+				destinations = append(destinations, id)
+			}
+		}
+		sort.Strings(destinations)
+		report.Tag(inventory.ManagedCertificate{
+			Name:         managed.Name,
+			Domains:      managed.Domains,
+			Fingerprint:  record.Fingerprint,
+			NotAfter:     record.NotAfter,
+			Labels:       labels,
+			Destinations: destinations,
+		}, fingerprints...)
+	}
+}
+
+// managedRecords reads the renewal state of the managed certificates, from
+// the status file when another process holds the state database
+func managedRecords(config *Config) map[string]renewalRecord {
+	records := map[string]renewalRecord{}
+	if stateDB != nil {
+		for _, managed := range config.ACME.Certificates {
+			var record renewalRecord
+			if err := stateDB.Get(store.BUCKET_RENEWALS, renewalKey(managed.Name), &record); err != nil {
+				if !errors.Is(err, store.ErrNotFound) {
+					log.Printf("[WARNING] Failed to read renewal state of %s: %v", managed.Name, err)
+				}
+				continue
+			}
+			records[managed.Name] = record
+		}
+		return records
+	}
+
+	data, err := os.ReadFile(renewalStatusFile(config))
+	if err != nil {
+		return records
+	}
+	var status renewalStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		log.Printf("[WARNING] Failed to read %s: %v", renewalStatusFile(config), err)
+		return records
+	}
+	for _, cert := range status.Certificates {
+		records[cert.Name] = cert.renewalRecord
+	}
+	return records
+}
+
+// labelSelector filters by labels like 'list-certs --label': comma
+// separated key=value, key!=value, key (has the label) and !key
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	value  string
+	negate bool
+	exists bool
+}
+
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var requirements labelSelector
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req labelRequirement
+		if key, value, found := strings.Cut(term, "!="); found {
+			req = labelRequirement{key: key, value: value, negate: true}
+		} else if key, value, found := strings.Cut(term, "="); found {
+			req = labelRequirement{key: key, value: value}
+		} else if key, found := strings.CutPrefix(term, "!"); found {
+			req = labelRequirement{key: key, exists: true, negate: true}
+		} else {
+			req = labelRequirement{key: term, exists: true}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !labelKeyPattern.MatchString(req.key) {
+			return nil, fmt.Errorf("invalid label key %q in selector", req.key)
+		}
+		requirements = append(requirements, req)
+	}
+	return requirements, nil
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		match := ok
+		if !req.exists {
+			match = ok && value == req.value
+		}
+		if match == req.negate {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+// Print what the inventory would report, without contacting the API
+func handleListCerts() {
+	listCmd := flag.NewFlagSet("list-certs", flag.ExitOnError)
+	selector := listCmd.String("label", "", "Only certificates whose labels match (app=checkout,tier!=edge)")
+	groupBy := listCmd.String("group-by", "", "Group certificates by the value of this label")
+	listCmd.Parse(os.Args[2:])
+
+	filter, err := parseLabelSelector(*selector)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Nothing is measured against the API here, so correct validity by the
+	// NTP daemon's offset
+	clockTracker.ObserveNTP(clockcheck.CheckNTP())
+
+	report := discoverCertificates(config)
+	var certs []inventory.Certificate
+	for _, cert := range report.Certificates {
+		if filter.matches(cert.Labels) {
+			certs = append(certs, cert)
+		}
+	}
+
+	fmt.Printf("Certificates (%d)\n", len(certs))
+	fmt.Println("─────────────────────────────────────────────────")
+	if *groupBy == "" {
+		for _, cert := range certs {
+			printCertificate(&cert)
+		}
+	} else {
+		groups := map[string][]inventory.Certificate{}
+		for _, cert := range certs {
+			groups[cert.Labels[*groupBy]] = append(groups[cert.Labels[*groupBy]], cert)
+		}
+		values := make([]string, 0, len(groups))
+		for value := range groups {
+			values = append(values, value)
+		}
+		// Unlabeled certificates come last
+		sort.Slice(values, func(i, j int) bool {
+			if (values[i] == "") != (values[j] == "") {
+				return values[j] == ""
+			}
+			return values[i] < values[j]
+		})
+		for _, value := range values {
+			title := *groupBy + "=" + value
+			if value == "" {
+				title = "no " + *groupBy + " label"
+			}
+			fmt.Printf("[%s] (%d)\n", title, len(groups[value]))
+			for _, cert := range groups[value] {
+				printCertificate(&cert)
+			}
+		}
+	}
+	for _, msg := range report.Errors {
+		fmt.Printf("[WARNING] %s\n", msg)
+	}
+	fmt.Println("─────────────────────────────────────────────────")
+}
+
+func printCertificate(cert *inventory.Certificate) {
+	location := cert.Path
+	if cert.Endpoint != "" {
+		location = cert.Endpoint
+	}
+	if cert.Staging {
+		location += " [staging]"
+	}
+	fmt.Println(location)
+	if cert.Managed != "" {
+		fmt.Printf("  Managed: %s\n", cert.Managed)
+	}
+	if len(cert.Labels) > 0 {
+		fmt.Printf("  Labels:  %s\n", formatLabels(cert.Labels))
+	}
+
+	// International names are shown in both forms
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	for _, name := range cert.DNSNames {
+		names = append(names, idn.Display(name))
+	}
+	names = append(names, cert.IPAddresses...)
+	if len(names) == 0 && cert.CommonName != "" {
+		names = append(names, idn.Display(cert.CommonName))
+	}
+	fmt.Printf("  Names:   %s\n", strings.Join(names, ", "))
+	fmt.Printf("  Issuer:  %s\n", cert.Issuer)
+
+	days := int(cert.NotAfter.Sub(clockTracker.CorrectedNow()).Hours() / 24)
+	expiry := fmt.Sprintf("in %d days", days)
+	if days < 0 {
+		expiry = fmt.Sprintf("expired %d days ago", -days)
+	}
+	fmt.Printf("  Expires: %s (%s)\n", cert.NotAfter.Local().Format(time.RFC3339), expiry)
+	if assessment := clockTracker.Evaluate(cert.NotBefore, cert.NotAfter); assessment.Flips() {
+		fmt.Printf("  Clock:   %s by the local clock, %s after correction; %s\n",
+			describeValidity(assessment.Local), describeValidity(assessment.Corrected), describeClockDrift(assessment))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/store"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	// Puts the host in maintenance or releases it, from the console
+	TASK_MAINTENANCE = "agent.maintenance"
+
+	STATE_MAINTENANCE = "maintenance"
+)
+
+// Payload of an agent.maintenance task
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// Released on its own at this time, when set
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Serializes entering, leaving and expiring maintenance
+var maintenanceMu sync.Mutex
+
+// currentMaintenance returns the maintenance the host is in, or nil. One
+// whose end time has passed is released here.
+func currentMaintenance() *client.Maintenance {
+	if stateDB == nil {
+		return nil
+	}
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	var m client.Maintenance
+	if err := stateDB.Get(store.BUCKET_STATE, STATE_MAINTENANCE, &m); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[WARNING] Failed to read maintenance state: %v", err)
+		}
+		return nil
+	}
+	if m.Until != nil && !time.Now().Before(*m.Until) {
+		endMaintenance(&m, "its end time passed")
+		return nil
+	}
+	return &m
+}
+
+// endMaintenance clears the stored maintenance; the caller holds
+// maintenanceMu
+func endMaintenance(m *client.Maintenance, why string) {
+	if err := stateDB.Delete(store.BUCKET_STATE, STATE_MAINTENANCE); err != nil {
+		log.Printf("[WARNING] Failed to clear maintenance state: %v", err)
+	}
+	log.Printf("[INFO] Maintenance ended (%s); renewals and deployments resume", why)
+	events.Publish(events.Event{
+		Type:     events.EVENT_MAINTENANCE_ENDED,
+		Severity: events.SEVERITY_INFO,
+		Summary:  "Maintenance ended: " + why,
+		Details:  map[string]string{"reason": m.Reason, "since": m.Since.Format(time.RFC3339)},
+	})
+}
+
+// handleMaintenance runs agent.maintenance tasks. Entering maintenance
+// again updates the reason and end time but keeps when it started.
+func handleMaintenance(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req maintenanceRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	if req.Enabled && req.Until != nil && !req.Until.After(time.Now()) {
+		return nil, tasks.Rejectf("maintenance end time %s has already passed", req.Until.Format(time.RFC3339))
+	}
+
+	current := currentMaintenance()
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	if !req.Enabled {
+		if current != nil {
+			endMaintenance(current, "released from the console")
+		}
+		return map[string]bool{"maintenance": false}, nil
+	}
+
+	m := &client.Maintenance{Reason: req.Reason, Since: time.Now().UTC(), Until: req.Until, TaskID: task.ID}
+	if current != nil {
+		m.Since = current.Since
+	}
+	if err := stateDB.Put(store.BUCKET_STATE, STATE_MAINTENANCE, m); err != nil {
+		return nil, err
+	}
+	if current == nil {
+		log.Printf("[WARNING] Maintenance started: renewals and deployments paused (%s)", describeMaintenance(m))
+		events.Publish(events.Event{
+			Type:     events.EVENT_MAINTENANCE_STARTED,
+			Severity: events.SEVERITY_WARNING,
+			Summary:  "Maintenance started: renewals and deployments paused",
+			Details:  map[string]string{"reason": m.Reason, "task": task.ID},
+		})
+	} else {
+		log.Printf("[INFO] Maintenance updated (%s)", describeMaintenance(m))
+	}
+	return m, nil
+}
+
+func describeMaintenance(m *client.Maintenance) string {
+	description := "no reason given"
+	if m.Reason != "" {
+		description = m.Reason
+	}
+	if m.Until != nil {
+		description += ", until " + m.Until.Local().Format(time.RFC3339)
+	}
+	return description
+}
+
+// maintenanceHold refuses deployments while the host is in maintenance,
+// whichever task or renewal asks for them
+type maintenanceHold struct{}
+
+func (maintenanceHold) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	if m := currentMaintenance(); m != nil {
+		return tasks.Rejectf("host is in maintenance (%s)", describeMaintenance(m))
+	}
+	return nil
+}
+
+func (maintenanceHold) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	return nil
+}
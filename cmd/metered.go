@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/store"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	DEFAULT_CHECKIN_INTERVAL = 1 * time.Hour
+	MIN_CHECKIN_INTERVAL     = 5 * time.Minute
+	// Events kept for the next check-in; the oldest go first
+	MAX_CHECKIN_EVENTS = 200
+	// The inventory the server last acknowledged, under this prefix and
+	// the instance ID
+	CHECKIN_BASELINE_PREFIX = "checkin-baseline/"
+)
+
+// Low-bandwidth mode for hosts on satellite or LTE links: the heartbeat,
+// the events raised since the last check-in and what changed in the
+// inventory go to the API together, compressed, in one request per
+// interval. Tasks and drift checks follow each check-in instead of running
+// on their own timers.
+type MeteredConfig struct {
+	// Minutes between check-ins; 60 by default
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+}
+
+func (m *MeteredConfig) interval() time.Duration {
+	if m.IntervalMinutes <= 0 {
+		return DEFAULT_CHECKIN_INTERVAL
+	}
+	return max(time.Duration(m.IntervalMinutes)*time.Minute, MIN_CHECKIN_INTERVAL)
+}
+
+// metered reports whether config's instance checks in; tenants keep the
+// usual calls
+func metered(config *Config) bool {
+	return config.Metered != nil && config.tenant == ""
+}
+
+// Events raised between check-ins
+var checkInEvents = &eventBuffer{}
+
+type eventBuffer struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (b *eventBuffer) Name() string {
+	return "check-in"
+}
+
+func (b *eventBuffer) Notify(ctx context.Context, event events.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, event)
+	if len(b.events) > MAX_CHECKIN_EVENTS {
+		b.events = b.events[len(b.events)-MAX_CHECKIN_EVENTS:]
+	}
+	return nil
+}
+
+// take empties the buffer for a check-in
+func (b *eventBuffer) take() []events.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	taken := b.events
+	b.events = nil
+	return taken
+}
+
+// restore puts back the events of a failed check-in, ahead of newer ones
+func (b *eventBuffer) restore(taken []events.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(taken, b.events...)
+	if len(b.events) > MAX_CHECKIN_EVENTS {
+		b.events = b.events[len(b.events)-MAX_CHECKIN_EVENTS:]
+	}
+}
+
+// startMetered collects events for the check-ins
+func startMetered(config *Config) {
+	if config.Metered == nil {
+		return
+	}
+	events.Default.AddNotifier(checkInEvents, nil)
+	log.Printf("[INFO] Metered mode: checking in every %v", config.Metered.interval())
+}
+
+// checkIn sends the heartbeat, the buffered events and the inventory, or
+// what changed in it since the server last acknowledged one, in a single
+// compressed request
+func checkIn(config *Config, instanceID string) (*inventory.Report, *client.CheckInResponse, error) {
+	report := collectInventory(config)
+	for _, msg := range report.Errors {
+		log.Printf("[WARNING] Inventory: %s", msg)
+	}
+	notifyExpiring(config, report)
+
+	req := &client.CheckIn{Heartbeat: collectHeartbeatData(), Events: checkInEvents.take()}
+	var base inventory.Report
+	if err := stateDB.Get(store.BUCKET_INVENTORY, CHECKIN_BASELINE_PREFIX+instanceID, &base); err == nil {
+		req.InventoryDelta = report.Diff(&base)
+	} else {
+		req.Inventory = report
+	}
+
+	var resp *client.CheckInResponse
+	err := callAPI(func() error {
+		var err error
+		resp, err = apiClient(config).CheckIn(context.Background(), instanceID, req)
+		return err
+	})
+	if err != nil {
+		checkInEvents.restore(req.Events)
+		recordInventory(instanceID, report, false)
+		return report, nil, err
+	}
+	recordInventory(instanceID, report, true)
+
+	if resp.ResyncInventory {
+		log.Printf("[WARNING] The server has no inventory to apply changes to; sending it whole at the next check-in")
+		stateDB.Delete(store.BUCKET_INVENTORY, CHECKIN_BASELINE_PREFIX+instanceID)
+	} else if err := stateDB.Put(store.BUCKET_INVENTORY, CHECKIN_BASELINE_PREFIX+instanceID, report); err != nil {
+		log.Printf("[WARNING] Failed to store inventory baseline: %v", err)
+	}
+
+	if delta := req.InventoryDelta; delta != nil {
+		log.Printf("[INFO] Checked in (%d events; inventory: %d changed, %d removed)", len(req.Events), len(delta.Changed), len(delta.Removed))
+	} else {
+		log.Printf("[INFO] Checked in (%d events; full inventory of %d certificates)", len(req.Events), len(report.Certificates))
+	}
+	return report, resp, nil
+}
+
+// afterCheckIn does the work that has its own timer outside metered mode:
+// proxied and tenant inventories, tasks and drift checks
+func afterCheckIn(config *Config, instanceID string, registry *tasks.Registry, resp *client.CheckInResponse) {
+	proxyInventories(config)
+	tenantInventories()
+
+	// The poll is skipped when the server said nothing is waiting, unless
+	// results from earlier tasks are
+	if resp == nil || resp.TasksPending == nil || *resp.TasksPending > 0 || resultSpool(instanceID).Len() > 0 {
+		processTasks(config, instanceID, registry)
+	}
+	flushReceipts(config, instanceID)
+	proxyTasks(config)
+	tenantTasks()
+
+	if driftEnabled(config) {
+		checkDrift(config, instanceID)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/metrics"
+)
+
+// Duration histograms of issuance, deployment, deploy hooks, reloads, scans
+// and API calls, for Prometheus and StatsD
+type MetricsConfig struct {
+	// Address to serve /metrics on, e.g. 127.0.0.1:9464; the histograms
+	// carry no secrets, but keep it off public interfaces
+	Listen string `json:"listen,omitempty"`
+	// StatsD server (host:port) that receives each duration as a timer
+	StatsD       string `json:"statsd,omitempty"`
+	StatsDPrefix string `json:"statsd_prefix,omitempty"`
+}
+
+// startMetrics exposes the histograms; durations are recorded whether or
+// not anything reads them
+func startMetrics(config *Config) {
+	mc := config.Metrics
+	if mc == nil {
+		return
+	}
+	if mc.StatsD != "" {
+		statsd, err := metrics.NewStatsD(mc.StatsD, mc.StatsDPrefix)
+		if err != nil {
+			log.Printf("[ERROR] StatsD disabled: %v", err)
+		} else {
+			metrics.Default.AddSink(statsd)
+			log.Printf("[INFO] Sending operation timings to StatsD at %s", mc.StatsD)
+		}
+	}
+	if mc.Listen != "" {
+		listener, err := net.Listen("tcp", mc.Listen)
+		if err != nil {
+			log.Printf("[ERROR] Metrics endpoint disabled: %v", err)
+			return
+		}
+		go func() {
+			if err := metrics.Default.Serve(listener); err != nil {
+				log.Printf("[ERROR] Metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+}
+
+// observeAPI records an API call's duration, for client.Options.Observe
+func observeAPI(op string, duration time.Duration, err error) {
+	metrics.Observe(metrics.OP_API, op, duration, err)
+}
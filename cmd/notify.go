@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+const (
+	DEFAULT_EXPIRY_WARNING_DAYS = 14
+	// A certificate is announced at most once per interval
+	EXPIRY_NOTIFY_INTERVAL = 24 * time.Hour
+)
+
+// Local alert channels, used even when the API is unreachable
+type NotificationsConfig struct {
+	ExpiryWarningDays int                    `json:"expiry_warning_days,omitempty"`
+	Webhooks          []events.WebhookConfig `json:"webhooks,omitempty"`
+	SMTP              *events.SMTPConfig     `json:"smtp,omitempty"`
+	// Events each channel may fall behind by; 100 by default
+	QueueSize int `json:"queue_size,omitempty"`
+	// What a full queue does with new events: "drop_oldest" (default) or
+	// "sample", which lets one in ten in and keeps every critical one
+	Overflow string `json:"overflow,omitempty"`
+}
+
+var (
+	expiryMu       sync.Mutex
+	expiryNotified = map[string]time.Time{}
+	// Certificates whose validity depends on the clock drift, already logged
+	driftWarned = map[string]string{}
+)
+
+// Subscribe the configured channels to local events
+func configureNotifications(config *Config) {
+	if config.Notifications == nil {
+		return
+	}
+	if err := events.Default.SetQueue(config.Notifications.QueueSize, config.Notifications.Overflow); err != nil {
+		log.Printf("[WARNING] Using the default event queue: %v", err)
+	}
+	for _, hook := range config.Notifications.Webhooks {
+		webhook, err := events.NewWebhook(hook)
+		if err != nil {
+			log.Printf("[WARNING] Webhook disabled: %v", err)
+			continue
+		}
+		events.Default.AddNotifier(webhook, hook.Events)
+		log.Printf("[INFO] Notifications enabled: %s", webhook.Name())
+	}
+	if smtp := config.Notifications.SMTP; smtp != nil {
+		mailer, err := events.NewSMTP(*smtp)
+		if err != nil {
+			log.Printf("[WARNING] Email alerts disabled: %v", err)
+			return
+		}
+		events.Default.AddNotifier(mailer, smtp.Events)
+		log.Printf("[INFO] Notifications enabled: %s", mailer.Name())
+	}
+}
+
+// Raise cert.expiring for certificates inside the warning window
+func notifyExpiring(config *Config, report *inventory.Report) {
+	days := DEFAULT_EXPIRY_WARNING_DAYS
+	if config.Notifications != nil && config.Notifications.ExpiryWarningDays > 0 {
+		days = config.Notifications.ExpiryWarningDays
+	}
+	window := time.Duration(days) * 24 * time.Hour
+	now := time.Now()
+	// Judge expiry on the corrected clock so a skewed host does not raise
+	// false alerts
+	corrected := clockTracker.CorrectedNow()
+
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+
+	for _, cert := range report.Certificates {
+		warnValidityDrift(&cert)
+		remaining := cert.NotAfter.Sub(corrected)
+		if cert.IsCA || remaining > window {
+			continue
+		}
+		if last, ok := expiryNotified[cert.FingerprintSHA256]; ok && now.Sub(last) < EXPIRY_NOTIFY_INTERVAL {
+			continue
+		}
+		expiryNotified[cert.FingerprintSHA256] = now
+
+		severity, summary := events.SEVERITY_WARNING, fmt.Sprintf("%s expires in %d days", cert.Subject, int(remaining.Hours()/24))
+		if remaining <= 0 {
+			severity, summary = events.SEVERITY_CRITICAL, fmt.Sprintf("%s expired on %s", cert.Subject, cert.NotAfter.Format("2006-01-02"))
+		}
+
+		location := cert.Path
+		if location == "" {
+			location = cert.Endpoint
+		}
+		events.Publish(events.Event{
+			Type:     events.EVENT_CERT_EXPIRING,
+			Severity: severity,
+			Summary:  summary,
+			Details: map[string]string{
+				"location":    location,
+				"not_after":   cert.NotAfter.UTC().Format(time.RFC3339),
+				"fingerprint": cert.FingerprintSHA256,
+			},
+		})
+	}
+}
+
+// Log once when the measured drift flips a certificate's validity, i.e. the
+// local clock alone would call it expired or not yet valid, or valid when
+// it is not. Called with expiryMu held.
+func warnValidityDrift(cert *inventory.Certificate) {
+	assessment := clockTracker.Evaluate(cert.NotBefore, cert.NotAfter)
+	if !assessment.Flips() {
+		delete(driftWarned, cert.FingerprintSHA256)
+		return
+	}
+	if driftWarned[cert.FingerprintSHA256] == assessment.Corrected {
+		return
+	}
+	driftWarned[cert.FingerprintSHA256] = assessment.Corrected
+
+	location := cert.Path
+	if location == "" {
+		location = cert.Endpoint
+	}
+	log.Printf("[WARNING] %s (%s) is %s by the local clock but %s after correcting for drift: %s",
+		cert.Subject, location, describeValidity(assessment.Local), describeValidity(assessment.Corrected), describeClockDrift(assessment))
+}
+
+func describeValidity(validity string) string {
+	return strings.ReplaceAll(validity, "_", " ")
+}
+
+// Render the drift behind an assessment, e.g. "clock is 45s ahead (chrony)"
+func describeClockDrift(assessment clockcheck.Assessment) string {
+	switch {
+	case assessment.Drift > 0:
+		return fmt.Sprintf("clock is %v ahead (%s)", assessment.Drift, assessment.Source)
+	case assessment.Drift < 0:
+		return fmt.Sprintf("clock is %v behind (%s)", -assessment.Drift, assessment.Source)
+	default:
+		return "no drift measured"
+	}
+}
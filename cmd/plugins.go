@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/hooks"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/platform"
+	"github.com/certfix/certfix-agent/pkg/plugins"
+)
+
+// Plugins found at startup; the directory is not rescanned while running
+var loadedPlugins []*plugins.Plugin
+
+// Load external plugins from the configured directory
+func loadPlugins(config *Config) {
+	dir := config.PluginDir
+	if dir == "" {
+		dir = platform.PluginDir()
+	}
+
+	found, errs := plugins.Discover(context.Background(), dir)
+	for _, err := range errs {
+		log.Printf("[WARNING] Plugin skipped: %v", err)
+	}
+	for _, plugin := range found {
+		log.Printf("[INFO] Loaded plugin %s: %v", plugin, plugin.Manifest.Capabilities)
+	}
+	loadedPlugins = found
+}
+
+// Offer deploy-capable plugins as targets; built-in targets keep their names
+func registerPluginTargets(deployer *deploy.Service) {
+	builtin := make(map[string]bool)
+	for _, name := range deployer.Targets() {
+		builtin[name] = true
+	}
+	for _, plugin := range loadedPlugins {
+		if !plugin.Manifest.Has(plugins.CAPABILITY_DEPLOY) {
+			continue
+		}
+		if builtin[plugin.Manifest.Name] {
+			log.Printf("[WARNING] Plugin %s not registered: deploy target name is built in", plugin)
+			continue
+		}
+		deployer.RegisterTarget(plugin.Manifest.Name, plugin.DeployFactory())
+	}
+}
+
+// Ask source plugins for the certificates they manage
+func pluginCertificates(ctx context.Context) ([]inventory.Certificate, []string) {
+	var certs []inventory.Certificate
+	var errs []string
+	for _, plugin := range loadedPlugins {
+		if !plugin.Manifest.Has(plugins.CAPABILITY_SOURCE) {
+			continue
+		}
+		found, failed := plugin.Certificates(ctx)
+		certs = append(certs, found...)
+		errs = append(errs, failed...)
+	}
+	return certs, errs
+}
+
+// Plugin names and versions reported in the instance metadata
+func pluginSummary() map[string]string {
+	summary := make(map[string]string)
+	for _, plugin := range loadedPlugins {
+		summary[plugin.Manifest.Name] = plugin.Manifest.Version
+	}
+	return summary
+}
+
+// Attach the Starlark hooks; a broken script disables all of them rather
+// than letting deployments skip a policy check
+func addDeployHooks(deployer *deploy.Service, config *Config) {
+	dir := config.HooksDir
+	if dir == "" {
+		dir = filepath.Join(platform.ConfigDir(), "hooks")
+	}
+
+	loaded, err := hooks.Load(dir)
+	if err != nil {
+		log.Printf("[ERROR] Deploy hooks not loaded, deployments refused: %v", err)
+		deployer.AddHook(hooks.Broken(err))
+		return
+	}
+	if scripts := loaded.Scripts(); len(scripts) > 0 {
+		log.Printf("[INFO] Loaded deploy hooks: %s", strings.Join(scripts, ", "))
+		deployer.AddHook(loaded)
+	}
+}
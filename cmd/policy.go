@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/acme"
+	"github.com/certfix/certfix-agent/pkg/metrics"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	DEPLOY_HOOK_TIMEOUT = 5 * time.Minute
+	// Hook output kept in errors
+	MAX_HOOK_OUTPUT = 4096
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// RenewalPolicy is when a managed certificate renews, with which key, and
+// when and how it is deployed. acme.renewal_policies sets one per ACME
+// profile; a certificate's own fields override its profile's one by one.
+type RenewalPolicy struct {
+	// RenewBeforeDays, or RenewBeforePercent of the lifetime for
+	// short-lived certificates; a third of the lifetime by default
+	RenewBeforeDays    int `json:"renew_before_days,omitempty"`
+	RenewBeforePercent int `json:"renew_before_percent,omitempty"`
+	// KeyType replaces the profile's key_type
+	KeyType string `json:"key_type,omitempty"`
+	// Commands run before and after every deployment; a failing pre_deploy
+	// holds the deployment back. An empty list turns the profile's off.
+	PreDeploy  []string `json:"pre_deploy,omitempty"`
+	PostDeploy []string `json:"post_deploy,omitempty"`
+	// Renewed certificates are only deployed inside one of these
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows,omitempty"`
+}
+
+// MaintenanceWindow opens at Start and closes at End ("HH:MM") on Days,
+// every day without them. A window ending before it starts closes the
+// next day.
+type MaintenanceWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	// Timezone is an IANA name; the host's by default
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// renewalPolicy layers the certificate's settings over its profile's
+func renewalPolicy(config *Config, managed *ManagedCertificate) RenewalPolicy {
+	profile := managed.Profile
+	if profile == "" {
+		profile = DEFAULT_ACME_PROFILE
+	}
+	policy := config.ACME.RenewalPolicies[profile]
+	own := managed.RenewalPolicy
+	// The threshold is one setting, whichever unit it is in
+	if own.RenewBeforeDays > 0 || own.RenewBeforePercent > 0 {
+		policy.RenewBeforeDays, policy.RenewBeforePercent = own.RenewBeforeDays, own.RenewBeforePercent
+	}
+	if own.KeyType != "" {
+		policy.KeyType = own.KeyType
+	}
+	if own.PreDeploy != nil {
+		policy.PreDeploy = own.PreDeploy
+	}
+	if own.PostDeploy != nil {
+		policy.PostDeploy = own.PostDeploy
+	}
+	if own.MaintenanceWindows != nil {
+		policy.MaintenanceWindows = own.MaintenanceWindows
+	}
+	return policy
+}
+
+func (p *RenewalPolicy) Validate() error {
+	if p.RenewBeforePercent < 0 || p.RenewBeforePercent >= 100 {
+		return fmt.Errorf("renew_before_percent must be between 1 and 99")
+	}
+	if p.RenewBeforeDays > 0 && p.RenewBeforePercent > 0 {
+		return fmt.Errorf("renew_before_days and renew_before_percent are mutually exclusive")
+	}
+	if err := acme.CheckKeyType(p.KeyType); err != nil {
+		return err
+	}
+	for _, window := range p.MaintenanceWindows {
+		if _, _, _, err := window.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewBefore is how long before expiry a certificate valid for lifetime
+// renews
+func (p *RenewalPolicy) renewBefore(lifetime time.Duration) time.Duration {
+	switch {
+	case p.RenewBeforeDays > 0:
+		return time.Duration(p.RenewBeforeDays) * 24 * time.Hour
+	case p.RenewBeforePercent > 0:
+		return lifetime * time.Duration(p.RenewBeforePercent) / 100
+	}
+	return lifetime / 3
+}
+
+// nextWindow returns when a deployment may start: now inside a window, or
+// when the next one opens. Without windows it is always now.
+func (p *RenewalPolicy) nextWindow(now time.Time) time.Time {
+	if len(p.MaintenanceWindows) == 0 {
+		return now
+	}
+	var next time.Time
+	for _, window := range p.MaintenanceWindows {
+		opens, err := window.next(now)
+		if err != nil {
+			continue
+		}
+		if next.IsZero() || opens.Before(next) {
+			next = opens
+		}
+	}
+	if next.IsZero() {
+		return now
+	}
+	return next
+}
+
+// windowWait holds a renewed certificate back until a window opens
+type windowWait struct {
+	opens time.Time
+}
+
+func (w *windowWait) Error() string {
+	return "waiting for the maintenance window at " + w.opens.Format(time.RFC3339)
+}
+
+// nextRenewalCheck is RENEWAL_CHECK_INTERVAL, or less when a deployment
+// waits for a window that opens sooner, since windows can be short
+func nextRenewalCheck(config *Config) time.Duration {
+	wait := RENEWAL_CHECK_INTERVAL
+	for _, managed := range config.ACME.Certificates {
+		var record renewalRecord
+		if err := stateDB.Get(store.BUCKET_RENEWALS, renewalKey(managed.Name), &record); err != nil || !record.AwaitingWindow {
+			continue
+		}
+		wait = min(wait, max(time.Until(record.NextAttempt), time.Second))
+	}
+	return wait
+}
+
+// parse returns the opening time of day, how long the window stays open
+// and its time zone
+func (w *MaintenanceWindow) parse() (time.Time, time.Duration, *time.Location, error) {
+	loc := time.Local
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return time.Time{}, 0, nil, fmt.Errorf("invalid maintenance window timezone: %w", err)
+		}
+	}
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, strings.ToLower(day)) {
+			return time.Time{}, 0, nil, fmt.Errorf("invalid maintenance window day %q (want %s)", day, strings.Join(weekdays, ", "))
+		}
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return time.Time{}, 0, nil, fmt.Errorf("invalid maintenance window start %q: want HH:MM", w.Start)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return time.Time{}, 0, nil, fmt.Errorf("invalid maintenance window end %q: want HH:MM", w.End)
+	}
+	length := end.Sub(start)
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	return start, length, loc, nil
+}
+
+// next returns now if the window is open, else when it next opens. The
+// window may have opened the day before, when it spans midnight.
+func (w *MaintenanceWindow) next(now time.Time) (time.Time, error) {
+	start, length, loc, err := w.parse()
+	if err != nil {
+		return time.Time{}, err
+	}
+	local := now.In(loc)
+	for offset := -1; offset <= 7; offset++ {
+		day := local.AddDate(0, 0, offset)
+		if len(w.Days) > 0 && !slices.ContainsFunc(w.Days, func(d string) bool {
+			return strings.EqualFold(d, weekdays[day.Weekday()])
+		}) {
+			continue
+		}
+		opens := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+		if now.Before(opens) {
+			return opens, nil
+		}
+		if now.Before(opens.Add(length)) {
+			return now, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("maintenance window never opens")
+}
+
+// runDeployHook runs a pre_deploy or post_deploy command, named by stage,
+// with the certificate described in its environment
+func runDeployHook(stage string, command []string, managed *ManagedCertificate, record *renewalRecord) (err error) {
+	if len(command) == 0 {
+		return nil
+	}
+	defer func(started time.Time) { metrics.Since(metrics.OP_DEPLOY_HOOK, stage, started, err) }(time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), DEPLOY_HOOK_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"CERTFIX_CERT_NAME="+managed.Name,
+		"CERTFIX_DOMAINS="+strings.Join(managed.Domains, ","),
+		"CERTFIX_FINGERPRINT="+record.Fingerprint,
+		"CERTFIX_NOT_AFTER="+record.NotAfter.Format(time.RFC3339),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if len(output) > MAX_HOOK_OUTPUT {
+			output = output[:MAX_HOOK_OUTPUT] + "..."
+		}
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(command, " "), err, output)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/platform"
+	"github.com/certfix/certfix-agent/pkg/sshproxy"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+// A host managed over SSH where the agent itself can't be installed.
+// Deployments are confined to CertPaths (default ScanPaths) and may only
+// reload services in ServiceAllowlist.
+type ProxyHostConfig struct {
+	Name             string   `json:"name"`
+	Address          string   `json:"address"`
+	User             string   `json:"user"`
+	KeyFile          string   `json:"key_file"`
+	KnownHostsFile   string   `json:"known_hosts_file,omitempty"`
+	ScanPaths        []string `json:"scan_paths"`
+	CertPaths        []string `json:"cert_paths,omitempty"`
+	ServiceAllowlist []string `json:"service_allowlist,omitempty"`
+	ReloadCommand    string   `json:"reload_command,omitempty"`
+}
+
+// A proxied host and the sub-instance it is registered as
+type proxyInstance struct {
+	host       *sshproxy.Host
+	registry   *tasks.Registry
+	instanceID string
+}
+
+var proxyInstances []*proxyInstance
+
+// Set up the configured proxy hosts; broken entries are skipped
+func setupProxyHosts(config *Config, verifyTask tasks.Verifier) {
+	auditLog := audit.NewLogger(AUDIT_LOG)
+	for _, hc := range config.ProxyHosts {
+		knownHosts := hc.KnownHostsFile
+		if knownHosts == "" {
+			knownHosts = filepath.Join(platform.ConfigDir(), "known_hosts")
+		}
+		host, err := sshproxy.New(sshproxy.Options{
+			Name:             hc.Name,
+			Address:          hc.Address,
+			User:             hc.User,
+			KeyFile:          hc.KeyFile,
+			KnownHostsFile:   knownHosts,
+			ScanPaths:        hc.ScanPaths,
+			CertPaths:        hc.CertPaths,
+			ServiceAllowlist: hc.ServiceAllowlist,
+			ReloadCommand:    hc.ReloadCommand,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Proxy host skipped: %v", err)
+			continue
+		}
+
+		registry := tasks.NewRegistry()
+		if verifyTask != nil {
+			registry.SetVerifier(verifyTask)
+		}
+		sshproxy.NewService(host, auditLog).Register(registry)
+		proxyInstances = append(proxyInstances, &proxyInstance{host: host, registry: registry})
+	}
+}
+
+// Register proxied hosts that aren't yet; unreachable ones are retried on
+// the next heartbeat
+func registerProxyHosts(config *Config, parent *client.InstanceData, parentID string) {
+	for _, p := range proxyInstances {
+		if p.instanceID != "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		osType, release, arch := p.host.System(ctx)
+		cancel()
+		if osType == "unknown" {
+			if err := p.host.Ping(); err != nil {
+				log.Printf("[WARNING] Proxy host %s unreachable: %v", p.host.Name(), err)
+				continue
+			}
+		}
+
+		// Stable per parent and address, so re-registration finds the same instance
+		sum := sha256.Sum256([]byte("ssh-proxy\n" + parent.MachineID + "\n" + p.host.Name() + "\n" + p.host.Address()))
+		ip, _, _ := net.SplitHostPort(p.host.Address())
+		data := &client.InstanceData{
+			MachineID:    hex.EncodeToString(sum[:]),
+			Hostname:     p.host.Name(),
+			OSType:       osType,
+			OSVersion:    release,
+			Architecture: arch,
+			IPAddress:    ip,
+			AgentVersion: parent.AgentVersion,
+			Metadata: map[string]interface{}{
+				"proxy":      "ssh",
+				"proxied_by": parentID,
+				"task_types": p.registry.Types(),
+			},
+		}
+
+		var resp *client.RegisterResponse
+		err := callAPI(func() error {
+			var err error
+			resp, err = register(config, data)
+			return err
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to register proxy host %s: %v", p.host.Name(), err)
+			continue
+		}
+		p.instanceID = resp.InstanceID
+		log.Printf("[SUCCESS] Proxy host %s registered as instance %s", p.host.Name(), resp.InstanceID)
+		recordIdentity(config, resp.InstanceID, data.MachineID)
+	}
+}
+
+// Heartbeats only vouch for hosts that answer, so the server sees
+// unreachable ones go stale
+func proxyHeartbeats(config *Config, parent *client.InstanceData, parentID string) {
+	registerProxyHosts(config, parent, parentID)
+	for _, p := range proxyInstances {
+		if p.instanceID == "" {
+			continue
+		}
+		if err := p.host.Ping(); err != nil {
+			log.Printf("[WARNING] Proxy host %s unreachable, heartbeat skipped: %v", p.host.Name(), err)
+			continue
+		}
+		if err := callAPI(func() error {
+			return apiClient(config).Heartbeat(context.Background(), p.instanceID, &client.HeartbeatData{})
+		}); instanceGone(err) {
+			// Registered again at the next heartbeat
+			log.Printf("[WARNING] The server no longer knows proxy host %s as instance %s", p.host.Name(), p.instanceID)
+			p.instanceID = ""
+		} else if err != nil {
+			log.Printf("[ERROR] Heartbeat for proxy host %s failed: %v", p.host.Name(), err)
+		}
+	}
+}
+
+// Scan each proxied host over SFTP and upload its inventory
+func proxyInventories(config *Config) {
+	for _, p := range proxyInstances {
+		if p.instanceID == "" {
+			continue
+		}
+		certs, errs := p.host.Scan(context.Background())
+		report := &inventory.Report{
+			GeneratedAt:  time.Now().UTC(),
+			Certificates: []inventory.Certificate{},
+			Errors:       errs,
+		}
+		report.Add(certs, nil)
+		for _, msg := range errs {
+			log.Printf("[WARNING] Proxy host %s inventory: %s", p.host.Name(), msg)
+		}
+
+		if err := callAPI(func() error {
+			return apiClient(config).UploadInventory(context.Background(), p.instanceID, report)
+		}); err != nil {
+			log.Printf("[ERROR] Inventory upload for proxy host %s failed: %v", p.host.Name(), err)
+			recordInventory(p.instanceID, report, false)
+			continue
+		}
+		recordInventory(p.instanceID, report, true)
+		log.Printf("[INFO] Proxy host %s inventory uploaded (%d certificates)", p.host.Name(), len(report.Certificates))
+	}
+}
+
+// Run pending tasks for each proxied host
+func proxyTasks(config *Config) {
+	for _, p := range proxyInstances {
+		if p.instanceID != "" {
+			processTasks(config, p.instanceID, p.registry)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/acme"
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/receipt"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	STATE_RECEIPT_KEY = "receipt_key"
+	RECEIPT_QUEUE     = "receipts"
+	// Receipts awaiting upload; the local log keeps them all regardless
+	MAX_PENDING_RECEIPTS = 5000
+)
+
+var RECEIPT_LOG = filepath.Join(STATE_DIR, "receipts.jsonl")
+
+// Set by openReceipts when the agent runs; deployments made without it get
+// no receipt
+var receiptKey ed25519.PrivateKey
+
+// The host and each tenant keep a chain of their own, opened on first use
+var (
+	receiptMu   sync.Mutex
+	receiptLogs = map[string]*receipt.Log{}
+)
+
+// openReceipts loads the agent's receipt key and adds it to what the
+// instance registers with
+func openReceipts(instance *client.InstanceData) {
+	key, err := receipt.LoadKey(stateDB.Blob(STATE_RECEIPT_KEY))
+	if err != nil {
+		log.Printf("[WARNING] Deployment receipts disabled: %v", err)
+		return
+	}
+	receiptKey = key
+	instance.ReceiptKey = receipt.PublicKey(key)
+	log.Printf("[INFO] Deployment receipts are signed with key %s", receipt.KeyID(key.Public().(ed25519.PublicKey)))
+}
+
+func receiptLogFile(config *Config) string {
+	return strings.TrimSuffix(RECEIPT_LOG, ".jsonl") + tenantSuffix(config) + ".jsonl"
+}
+
+func receiptLogFor(config *Config) (*receipt.Log, error) {
+	receiptMu.Lock()
+	defer receiptMu.Unlock()
+	if l, ok := receiptLogs[config.tenant]; ok {
+		return l, nil
+	}
+	l, err := receipt.Open(receiptLogFile(config), receiptKey)
+	if err != nil {
+		return nil, err
+	}
+	receiptLogs[config.tenant] = l
+	return l, nil
+}
+
+// receiptIssuer signs a receipt for each successful deployment made for
+// config and queues it for upload
+func receiptIssuer(config *Config) deploy.DeployedFunc {
+	return func(id string, req *deploy.DeployRequest, result *deploy.Result) {
+		if receiptKey == nil {
+			return
+		}
+		issueReceipt(config, id, req, result)
+	}
+}
+
+func issueReceipt(config *Config, id string, req *deploy.DeployRequest, result *deploy.Result) {
+	receipts, err := receiptLogFor(config)
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue receipt for deployment %s: %v", id, err)
+		return
+	}
+	r := &receipt.Receipt{
+		Host:         getHostname(),
+		DeploymentID: id,
+		OrderID:      receiptOrderID(id),
+		Certificate:  req.Name,
+		Fingerprint:  result.Fingerprint,
+		Target:       result.Target,
+		Files:        receipt.HashFiles(result.Files),
+		Reloaded:     result.Reloaded,
+		DeployedAt:   time.Now().UTC(),
+	}
+	if block, _ := pem.Decode([]byte(req.Certificate)); block != nil {
+		if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+			r.SerialNumber = leaf.SerialNumber.Text(16)
+			r.NotAfter = leaf.NotAfter.UTC()
+		}
+	}
+
+	signed, err := receipts.Issue(r)
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue receipt for deployment %s: %v", id, err)
+		return
+	}
+	dropped, err := receiptSpool(config).Push(signed)
+	if err != nil {
+		log.Printf("[ERROR] Failed to queue receipt %d for upload: %v", r.Sequence, err)
+		return
+	}
+	if dropped > 0 {
+		log.Printf("[WARNING] Receipt backlog full, dropped %d oldest receipts from the upload queue", dropped)
+	}
+}
+
+// The order a deployment delivered: the ACME order the agent's own renewals
+// were issued for, otherwise the task that carried the certificate
+func receiptOrderID(id string) string {
+	deployment, _, _ := strings.Cut(id, "/")
+	name, ok := strings.CutPrefix(deployment, "acme:")
+	if !ok {
+		return deployment
+	}
+	var cert acme.Certificate
+	if err := stateDB.Get(store.BUCKET_CERTIFICATES, renewalKey(name), &cert); err != nil {
+		return ""
+	}
+	return cert.OrderURL
+}
+
+func receiptSpool(config *Config) *store.Queue {
+	return stateDB.Queue(store.BUCKET_SPOOL, RECEIPT_QUEUE+tenantSuffix(config), MAX_PENDING_RECEIPTS)
+}
+
+// Upload queued receipts in chain order; they stay queued while the API is
+// unreachable or doesn't accept receipts yet
+func flushReceipts(config *Config, instanceID string) {
+	spool := receiptSpool(config)
+	for {
+		var signed receipt.Signed
+		found, err := spool.Peek(&signed)
+		if err != nil {
+			log.Printf("[ERROR] Discarding unreadable queued receipt: %v", err)
+			if err := spool.Pop(); err != nil {
+				return
+			}
+			continue
+		}
+		if !found {
+			return
+		}
+		err = callAPI(func() error { return apiClient(config).UploadReceipt(context.Background(), instanceID, &signed) })
+		var statusErr *client.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return
+		}
+		if err != nil {
+			log.Printf("[WARNING] %d deployment receipts still pending: %v", spool.Len(), err)
+			return
+		}
+		if err := spool.Pop(); err != nil {
+			log.Printf("[ERROR] Failed to remove uploaded receipt: %v", err)
+			return
+		}
+	}
+}
+
+// List the local deployment receipts and check their signatures and chain,
+// for auditors; works on a copy of the log with --file
+func handleReceipts() {
+	receiptsCmd := flag.NewFlagSet("receipts", flag.ExitOnError)
+	file := receiptsCmd.String("file", "", "Receipt log to read, e.g. a copy handed to an auditor")
+	tenant := receiptsCmd.String("tenant", "", "Read the receipts of this tenant instead of the host's")
+	trusted := receiptsCmd.String("key", "", "Base64 public key the receipts must be signed with, as registered with the API")
+	last := receiptsCmd.Int("last", 20, "Receipts to list, most recent last; 0 lists them all")
+	receiptsCmd.Parse(os.Args[2:])
+	if *tenant != "" && !tenantNamePattern.MatchString(*tenant) {
+		fmt.Printf("[ERROR] Invalid tenant name %q\n", *tenant)
+		os.Exit(1)
+	}
+	if *file == "" {
+		*file = receiptLogFile(&Config{tenant: *tenant})
+	}
+
+	var key ed25519.PublicKey
+	if *trusted != "" {
+		data, err := base64.StdEncoding.DecodeString(*trusted)
+		if err != nil || len(data) != ed25519.PublicKeySize {
+			fmt.Printf("[ERROR] --key is not a base64 Ed25519 public key\n")
+			os.Exit(1)
+		}
+		key = data
+	}
+
+	receipts, err := receipt.Read(*file)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No deployment receipts in %s\n", *file)
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to read %s: %v\n", *file, err)
+		os.Exit(1)
+	}
+
+	shown := receipts
+	if *last > 0 && len(shown) > *last {
+		shown = shown[len(shown)-*last:]
+	}
+	for _, signed := range shown {
+		r, err := signed.Receipt()
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			continue
+		}
+		fmt.Printf("#%d  %s  %s -> %s\n", r.Sequence, r.DeployedAt.Local().Format(time.DateTime), r.Certificate, r.Target)
+		fmt.Printf("  Deployment: %s\n", r.DeploymentID)
+		if r.OrderID != "" {
+			fmt.Printf("  Order: %s\n", r.OrderID)
+		}
+		fmt.Printf("  Fingerprint: %s\n", r.Fingerprint)
+		for _, f := range r.Files {
+			if f.Error != "" {
+				fmt.Printf("  File: %s (not hashed: %s)\n", f.Path, f.Error)
+			} else {
+				fmt.Printf("  File: %s sha256:%s\n", f.Path, f.SHA256)
+			}
+		}
+	}
+
+	problems := receipt.VerifyChain(receipts, key)
+	for _, p := range problems {
+		fmt.Printf("[ERROR] Receipt %d: %s\n", p.Sequence, p.Reason)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	if len(receipts) > 0 {
+		first, _ := receipts[0].Receipt()
+		fmt.Printf("[SUCCESS] %d receipts (%d to %d) verified, signed by key %s\n",
+			len(receipts), first.Sequence, first.Sequence+uint64(len(receipts))-1, receipts[0].KeyID)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/events"
+)
+
+// Going this long without a successful heartbeat makes the agent register
+// again. Measured in time rather than failed attempts, since heartbeats the
+// open circuit breaker skips never get to fail.
+const REREGISTER_AFTER = 1 * time.Hour
+
+// Idempotency keys of registrations the server has not answered yet, by
+// machine ID. Every retry of a registration carries the same key, so one
+// that reached the server but timed out on the way back does not create a
+// second instance; a later registration gets a fresh key.
+var registrationKeys = struct {
+	sync.Mutex
+	keys map[string]string
+}{keys: map[string]string{}}
+
+// registerInstance registers the host once and records its identity
+func registerInstance(config *Config, instanceData *client.InstanceData) (*client.RegisterResponse, error) {
+	resp, err := register(config, instanceData)
+	if err != nil {
+		return nil, err
+	}
+	recordIdentity(config, resp.InstanceID, instanceData.MachineID)
+	return resp, nil
+}
+
+// register sends a registration under its machine's pending key
+func register(config *Config, data *client.InstanceData) (*client.RegisterResponse, error) {
+	registrationKeys.Lock()
+	key, ok := registrationKeys.keys[data.MachineID]
+	if !ok {
+		key = client.NewIdempotencyKey()
+		registrationKeys.keys[data.MachineID] = key
+	}
+	registrationKeys.Unlock()
+
+	resp, err := apiClient(config).Register(client.WithIdempotencyKey(context.Background(), key), data)
+	if client.Settled(err) {
+		registrationKeys.Lock()
+		delete(registrationKeys.keys, data.MachineID)
+		registrationKeys.Unlock()
+	}
+	return resp, err
+}
+
+// instanceGone reports whether the server answered that it no longer knows
+// the instance, as after it was deleted there
+func instanceGone(err error) bool {
+	return client.Action(err) == client.ACTION_REREGISTER
+}
+
+// reregister registers the host again with its stored machine ID, so the
+// server finds the instance it had or creates a new one. It returns the
+// instance ID to use from now on; failing, the agent keeps the one it has
+// and tries again after the next failed heartbeat.
+func reregister(config *Config, instanceData *client.InstanceData, instanceID string, down time.Duration, cause error) (string, bool) {
+	if instanceGone(cause) {
+		log.Printf("[WARNING] The server no longer knows instance %s; registering again", instanceID)
+	} else {
+		log.Printf("[WARNING] No heartbeat succeeded for %s; registering again", down.Round(time.Minute))
+	}
+	resp, err := registerInstance(config, instanceData)
+	if err != nil {
+		log.Printf("[ERROR] Re-registration failed: %v", err)
+		return instanceID, false
+	}
+	log.Printf("[SUCCESS] Instance registered again as %s", resp.InstanceID)
+	events.Publish(events.Event{
+		Type:     events.EVENT_REREGISTERED,
+		Severity: events.SEVERITY_WARNING,
+		Summary:  "Agent registered again as instance " + resp.InstanceID,
+		Details:  map[string]string{"previous_instance": instanceID, "instance": resp.InstanceID},
+	})
+	if resp.InstanceID == instanceID {
+		return instanceID, true
+	}
+
+	// A new instance knows nothing yet, and proxied hosts name their parent
+	for _, p := range proxyInstances {
+		p.instanceID = ""
+	}
+	reportInventory(config, resp.InstanceID)
+	return resp.InstanceID, true
+}
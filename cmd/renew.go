@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/acme"
+	"github.com/certfix/certfix-agent/pkg/backup"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/metrics"
+	"github.com/certfix/certfix-agent/pkg/store"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	RENEWAL_CHECK_INTERVAL = 1 * time.Hour
+	// Failed renewals back off exponentially from RENEWAL_RETRY_DELAY
+	RENEWAL_RETRY_DELAY = 5 * time.Minute
+	MAX_RENEWAL_BACKOFF = 24 * time.Hour
+	DEPLOY_TIMEOUT      = 5 * time.Minute
+
+	// reuse_key never keeps a key longer than this unless configured
+	DEFAULT_MAX_KEY_AGE_DAYS = 365
+
+	DEFAULT_ACME_PROFILE = "default"
+	STAGING_SUFFIX       = ":staging"
+)
+
+// Certificates the agent issues itself from an ACME CA, without the API
+type ACMEConfig struct {
+	// Profiles by name; "default" may be omitted for Let's Encrypt over
+	// standalone http-01
+	Profiles     map[string]acme.Profile `json:"profiles,omitempty"`
+	Certificates []ManagedCertificate    `json:"certificates,omitempty"`
+	// RenewalPolicies by profile name apply to the certificates issued
+	// under that profile
+	RenewalPolicies map[string]RenewalPolicy `json:"renewal_policies,omitempty"`
+}
+
+type ManagedCertificate struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	Profile string   `json:"profile,omitempty"`
+	// FallbackProfiles are tried in order when the profile's CA fails
+	FallbackProfiles []string `json:"fallback_profiles,omitempty"`
+	// Labels group certificates by application (app=checkout, tier=edge)
+	// in list-certs and the console
+	Labels map[string]string `json:"labels,omitempty"`
+	// Overrides of the profile's renewal policy
+	RenewalPolicy
+	// ReuseKey submits the current key again at renewal, for public key
+	// pinning; the key is still rotated after MaxKeyAgeDays
+	ReuseKey      bool `json:"reuse_key,omitempty"`
+	MaxKeyAgeDays int  `json:"max_key_age_days,omitempty"`
+	// Every renewal fans out to all of these cert.deploy targets at once
+	Deploy []deploy.Destination `json:"deploy,omitempty"`
+	// TLSA records to publish for DANE before each deployment
+	TLSA *TLSAConfig `json:"tlsa,omitempty"`
+	// Rotation keeps the previous certificate valid and watched for a
+	// while after each renewal
+	Rotation *RotationConfig `json:"rotation,omitempty"`
+}
+
+// Set by 'start --staging': order from each profile's staging directory and
+// never deploy the result
+var acmeStaging bool
+
+// Renewals deploy through the same targets and hooks as cert.deploy tasks
+var localDeployer *deploy.Service
+
+// Spent rate limits of every directory, shared by all managed certificates
+var acmeBudget *acme.Budget
+
+// Renewal records change in the renewal loop and when the file watcher
+// asks for a redeployment
+var renewalMu sync.Mutex
+
+// Renewal state of one managed certificate; staging runs keep their own
+type renewalRecord struct {
+	Name        string    `json:"name"`
+	Domains     []string  `json:"domains"`
+	Fingerprint string    `json:"fingerprint_sha256,omitempty"`
+	NotBefore   time.Time `json:"not_before,omitempty"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	Directory   string    `json:"directory,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	Staging     bool      `json:"staging,omitempty"`
+	Deployed    bool      `json:"deployed,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	Failures    int       `json:"failures,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	// KeyCreatedAt stays put across renewals while reuse_key keeps the key
+	KeyCreatedAt time.Time `json:"key_created_at,omitempty"`
+	// AwaitingWindow holds the deployment until NextAttempt, when a
+	// maintenance window opens
+	AwaitingWindow bool `json:"awaiting_window,omitempty"`
+	// Per destination, so a retry only redeploys where it failed
+	Destinations map[string]*destinationStatus `json:"destinations,omitempty"`
+	TLSA         *tlsaStatus                   `json:"tlsa,omitempty"`
+	Rotation     *rotationStatus               `json:"rotation,omitempty"`
+}
+
+type destinationStatus struct {
+	Target      string    `json:"target"`
+	Fingerprint string    `json:"fingerprint_sha256,omitempty"`
+	DeployedAt  time.Time `json:"deployed_at,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func renewalKey(name string) string {
+	if acmeStaging {
+		return name + STAGING_SUFFIX
+	}
+	return name
+}
+
+// A CA a managed certificate may come from
+type issuingCA struct {
+	Name      string
+	Profile   acme.Profile
+	Directory string
+}
+
+func lookupProfile(config *Config, name string) (acme.Profile, error) {
+	if name == "" {
+		name = DEFAULT_ACME_PROFILE
+	}
+	profile, ok := config.ACME.Profiles[name]
+	if !ok && name != DEFAULT_ACME_PROFILE {
+		return profile, fmt.Errorf("unknown ACME profile %q", name)
+	}
+	return profile, nil
+}
+
+// managedCAs returns the certificate's CA followed by its fallbacks, in
+// the current mode. A fallback without a directory for the mode (no
+// staging_directory) is left out rather than failing the certificate.
+func managedCAs(config *Config, managed *ManagedCertificate) ([]issuingCA, error) {
+	var cas []issuingCA
+	for n, name := range append([]string{managed.Profile}, managed.FallbackProfiles...) {
+		profile, err := lookupProfile(config, name)
+		if err != nil {
+			return nil, err
+		}
+		directory, err := profile.DirectoryURL(acmeStaging)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("[WARNING] Certificate %s: skipping fallback profile %s: %v", managed.Name, name, err)
+			continue
+		}
+		if name == "" {
+			name = DEFAULT_ACME_PROFILE
+		}
+		cas = append(cas, issuingCA{Name: name, Profile: profile, Directory: directory})
+	}
+	return cas, nil
+}
+
+func caDirectories(cas []issuingCA) []string {
+	directories := make([]string, len(cas))
+	for i, ca := range cas {
+		directories[i] = ca.Directory
+	}
+	return directories
+}
+
+// Check managed certificates now and then every RENEWAL_CHECK_INTERVAL
+func startRenewals(config *Config) {
+	if config.ACME == nil || len(config.ACME.Certificates) == 0 {
+		if acmeStaging {
+			log.Printf("[WARNING] --staging has no effect: no ACME certificates are configured")
+		}
+		return
+	}
+	mode := "production"
+	if acmeStaging {
+		mode = "staging, nothing is deployed"
+	}
+	if config.tenant != "" {
+		mode += ", tenant " + config.tenant
+	}
+	log.Printf("[INFO] Managing %d ACME certificates (%s)", len(config.ACME.Certificates), mode)
+	if acmeBudget == nil {
+		acmeBudget = acme.NewBudget(stateDB.Blob(STATE_RATE_LIMITS), nil)
+	}
+
+	go func() {
+		for {
+			for i := range config.ACME.Certificates {
+				renewCertificate(config, &config.ACME.Certificates[i])
+				watchRotation(&config.ACME.Certificates[i])
+			}
+			writeRenewalStatus(config)
+			time.Sleep(nextRenewalCheck(config))
+		}
+	}()
+}
+
+// Issue the certificate when it is due and deploy it until that succeeds
+func renewCertificate(config *Config, managed *ManagedCertificate) {
+	// Picked up again at the first check after maintenance ends
+	if currentMaintenance() != nil {
+		return
+	}
+	renewalMu.Lock()
+	defer renewalMu.Unlock()
+	key := renewalKey(managed.Name)
+	var record renewalRecord
+	if err := stateDB.Get(store.BUCKET_RENEWALS, key, &record); err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("[WARNING] Failed to read renewal state of %s: %v", managed.Name, err)
+	}
+
+	cas, err := managedCAs(config, managed)
+	if err != nil {
+		log.Printf("[ERROR] Certificate %s: %v", managed.Name, err)
+		return
+	}
+	directory := cas[0].Directory
+	policy := renewalPolicy(config, managed)
+	if err := policy.Validate(); err != nil {
+		log.Printf("[ERROR] Certificate %s: invalid renewal policy: %v", managed.Name, err)
+		return
+	}
+
+	now := time.Now()
+	due := renewalDue(managed, &policy, &record, caDirectories(cas), now)
+	if !due && (record.Deployed || acmeStaging) {
+		return
+	}
+	// A held deployment checks its windows again, which may have changed
+	if now.Before(record.NextAttempt) && !record.AwaitingWindow {
+		return
+	}
+	record.Name = managed.Name
+	record.LastAttempt = now.UTC()
+
+	// How long each phase took, for the events of a slow or failed renewal
+	var issuance, deployment time.Duration
+	err = func() error {
+		if due {
+			started := time.Now()
+			err := issueManaged(config, managed, cas, &record)
+			issuance = time.Since(started)
+			if err != nil {
+				return err
+			}
+		}
+		if acmeStaging {
+			log.Printf("[INFO] Staging certificate for %s issued by %s; not deployed", managed.Name, record.Directory)
+			return nil
+		}
+		if err := updateTLSA(config, managed, key, &record); err != nil {
+			return err
+		}
+		if opens := policy.nextWindow(now); opens.After(now) {
+			return &windowWait{opens: opens}
+		}
+		started := time.Now()
+		err := deployManaged(deployerFor(config), managed, &policy, key, &record)
+		deployment = time.Since(started)
+		return err
+	}()
+
+	// A deployment still held for the same window is logged once
+	held := record.AwaitingWindow
+	record.AwaitingWindow = false
+	var limitErr *acme.RateLimitError
+	var wait *windowWait
+	if errors.As(err, &wait) {
+		held = held && record.NextAttempt.Equal(wait.opens.UTC())
+		record.AwaitingWindow = true
+		record.NextAttempt = wait.opens.UTC()
+		if !held {
+			log.Printf("[INFO] Deployment of %s held until the maintenance window at %s", managed.Name, wait.opens.Format(time.RFC3339))
+		}
+	} else if errors.As(err, &limitErr) {
+		// Not a failure: retrying sooner would only extend the lockout
+		record.LastError = err.Error()
+		record.NextAttempt = limitErr.RetryAt.UTC()
+		log.Printf("[WARNING] Renewal of %s deferred: %v", managed.Name, err)
+		events.Publish(events.Event{
+			Type:     events.EVENT_RENEWAL_FAILED,
+			Severity: events.SEVERITY_WARNING,
+			Summary:  fmt.Sprintf("Renewal of %s deferred: %v", managed.Name, err),
+			Details:  renewalDetails(managed.Name, directory, issuance, deployment, "limit", limitErr.Limit),
+		})
+	} else if err != nil {
+		record.Failures++
+		record.LastError = err.Error()
+		record.NextAttempt = now.Add(renewalBackoff(record.Failures)).UTC()
+		log.Printf("[ERROR] Renewal of %s failed (attempt %d, next at %s): %v", managed.Name, record.Failures, record.NextAttempt.Format(time.RFC3339), err)
+		events.Publish(events.Event{
+			Type:     events.EVENT_RENEWAL_FAILED,
+			Severity: events.SEVERITY_CRITICAL,
+			Summary:  fmt.Sprintf("Renewal of %s failed: %v", managed.Name, err),
+			Details:  renewalDetails(managed.Name, directory, issuance, deployment),
+		})
+	} else {
+		record.Deployed = !acmeStaging
+		startRotation(managed, &record)
+		record.Failures = 0
+		record.LastError = ""
+		record.NextAttempt = time.Time{}
+	}
+
+	if err := stateDB.Put(store.BUCKET_RENEWALS, key, record); err != nil {
+		log.Printf("[WARNING] Failed to store renewal state of %s: %v", managed.Name, err)
+	}
+}
+
+// renewalDetails describes a renewal for its events, with the time spent
+// issuing and deploying so a slow CA can be told from a slow host
+func renewalDetails(name, directory string, issuance, deployment time.Duration, extra ...string) map[string]string {
+	details := map[string]string{"certificate": name, "directory": directory}
+	if issuance > 0 {
+		details["issuance_duration"] = metrics.Format(issuance)
+	}
+	if deployment > 0 {
+		details["deploy_duration"] = metrics.Format(deployment)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		details[extra[i]] = extra[i+1]
+	}
+	return details
+}
+
+func directoryHost(directory string) string {
+	if u, err := url.Parse(directory); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return directory
+}
+
+// A certificate is due when there is none, it no longer matches the
+// configuration (names, or a CA that is no longer among its profiles) or
+// it is inside its renewal window
+func renewalDue(managed *ManagedCertificate, policy *RenewalPolicy, record *renewalRecord, directories []string, now time.Time) bool {
+	if record.Fingerprint == "" || !slices.Contains(directories, record.Directory) {
+		return true
+	}
+	if !slices.Equal(sortedNames(managed.Domains), sortedNames(record.Domains)) {
+		return true
+	}
+	// A reused key past its age renews early, so rotation isn't put off
+	// until the certificate itself is due
+	if managed.ReuseKey && !record.KeyCreatedAt.IsZero() && now.Sub(record.KeyCreatedAt) >= maxKeyAge(managed) {
+		return true
+	}
+	return now.After(renewalTime(managed, policy, record))
+}
+
+// renewalTime is when the issued certificate enters its renewal window
+func renewalTime(managed *ManagedCertificate, policy *RenewalPolicy, record *renewalRecord) time.Time {
+	renewBefore := policy.renewBefore(record.NotAfter.Sub(record.NotBefore))
+	// Twice the overlap, so failed attempts still leave all of it
+	if managed.Rotation != nil {
+		renewBefore = max(renewBefore, 2*managed.Rotation.overlap())
+	}
+	return record.NotAfter.Add(-renewBefore)
+}
+
+func renewalBackoff(failures int) time.Duration {
+	delay := RENEWAL_RETRY_DELAY
+	for i := 1; i < failures && delay < MAX_RENEWAL_BACKOFF; i++ {
+		delay *= 2
+	}
+	return min(delay, MAX_RENEWAL_BACKOFF)
+}
+
+// Names compare in A-label form, however they were configured
+func sortedNames(names []string) []string {
+	sorted := make([]string, len(names))
+	for i, name := range names {
+		sorted[i] = strings.ToLower(name)
+		if ascii, err := idn.ToASCII(name); err == nil {
+			sorted[i] = ascii
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Order a new certificate and keep it, with its key, in the state database
+// issueManaged tries each CA in turn until one issues. Only when every CA
+// is rate limited is the result a *acme.RateLimitError, for the earliest
+// retry; any other failure keeps the renewal backing off.
+func issueManaged(config *Config, managed *ManagedCertificate, cas []issuingCA, record *renewalRecord) error {
+	var failures []string
+	var limited *acme.RateLimitError
+	for n, ca := range cas {
+		if n > 0 {
+			log.Printf("[WARNING] Falling back to profile %s (%s) for %s", ca.Name, ca.Directory, managed.Name)
+		}
+		err := issueFrom(config, managed, ca, record)
+		if err == nil {
+			if n > 0 {
+				events.Publish(events.Event{
+					Type:     events.EVENT_RENEWAL_FALLBACK,
+					Severity: events.SEVERITY_WARNING,
+					Summary:  fmt.Sprintf("%s was issued by fallback profile %s after: %s", managed.Name, ca.Name, strings.Join(failures, "; ")),
+					Details:  map[string]string{"certificate": managed.Name, "profile": ca.Name, "directory": ca.Directory},
+				})
+			}
+			return nil
+		}
+		if len(cas) == 1 {
+			return err
+		}
+		log.Printf("[WARNING] Issuing %s from profile %s failed: %v", managed.Name, ca.Name, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", ca.Name, err))
+
+		var limitErr *acme.RateLimitError
+		if !errors.As(err, &limitErr) {
+			limited = nil
+		} else if n == 0 || limited != nil && limitErr.RetryAt.Before(limited.RetryAt) {
+			limited = limitErr
+		}
+	}
+	if limited != nil {
+		return limited
+	}
+	return fmt.Errorf("every CA failed: %s", strings.Join(failures, "; "))
+}
+
+func issueFrom(config *Config, managed *ManagedCertificate, ca issuingCA, record *renewalRecord) error {
+	profile := ca.Profile
+	if policy := renewalPolicy(config, managed); policy.KeyType != "" {
+		profile.KeyType = policy.KeyType
+	}
+	var provider dns01.Provider
+	if profile.Challenge == acme.CHALLENGE_DNS01 {
+		options, ok := config.DNSProviders[profile.DNSProvider]
+		if !ok {
+			return fmt.Errorf("DNS provider %q is not configured", profile.DNSProvider)
+		}
+		var err error
+		if provider, err = dns01.New(profile.DNSProvider, options); err != nil {
+			return err
+		}
+	}
+
+	directory := ca.Directory
+	// One account per directory (and external account binding), shared by
+	// every profile that uses it; tenants have accounts of their own
+	account := STATE_ACME_ACCOUNT + profile.AccountName(directory, acmeStaging)
+	if config.tenant != "" {
+		account = STATE_ACME_ACCOUNT + "tenant:" + config.tenant + ":" + profile.AccountName(directory, acmeStaging)
+	}
+	issuer, err := acme.NewIssuer(profile, acmeStaging, stateDB.Blob(account), provider)
+	if err != nil {
+		return err
+	}
+	issuer.SetBudget(acmeBudget)
+
+	log.Printf("[INFO] Requesting certificate %s for %s from %s", managed.Name, strings.Join(managed.Domains, ", "), issuer.Directory())
+	started := time.Now()
+	cert, err := issuer.Reissue(context.Background(), managed.Domains, reusableCertificate(managed, profile))
+	metrics.Since(metrics.OP_ISSUANCE, directoryHost(issuer.Directory()), started, err)
+	if err != nil {
+		return err
+	}
+	if err := stateDB.Put(store.BUCKET_CERTIFICATES, renewalKey(managed.Name), cert); err != nil {
+		return fmt.Errorf("failed to store issued certificate: %w", err)
+	}
+	if !cert.Staging {
+		backupCertificate(config.tenant, managed.Name, backup.SOURCE_ACME, cert.Certificate, cert.Chain, cert.PrivateKey)
+	}
+
+	described, err := inventory.ParseCertificate(bytes.NewReader(cert.Certificate), managed.Name)
+	if err != nil {
+		return err
+	}
+	prepareRotation(managed, record)
+	record.Domains = managed.Domains
+	record.Fingerprint = described.FingerprintSHA256
+	record.NotBefore = cert.NotBefore
+	record.NotAfter = cert.NotAfter
+	record.Directory = cert.Directory
+	record.Profile = ca.Name
+	record.Staging = cert.Staging
+	record.KeyCreatedAt = cert.KeyCreatedAt
+	record.Deployed = false
+	log.Printf("[SUCCESS] Issued certificate %s (valid until %s)", managed.Name, cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// reusableCertificate returns the stored certificate whose key reuse_key
+// should submit again, or nil for a fresh key
+func reusableCertificate(managed *ManagedCertificate, profile acme.Profile) *acme.Certificate {
+	if !managed.ReuseKey {
+		return nil
+	}
+	var previous acme.Certificate
+	if err := stateDB.Get(store.BUCKET_CERTIFICATES, renewalKey(managed.Name), &previous); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[WARNING] Failed to load the key of %s, generating a new one: %v", managed.Name, err)
+		}
+		return nil
+	}
+	if reason := acme.KeyRotationReason(&previous, profile.KeyType, maxKeyAge(managed), time.Now()); reason != "" {
+		log.Printf("[INFO] Rotating the key of %s: %s", managed.Name, reason)
+		return nil
+	}
+	log.Printf("[INFO] Reusing the key of %s from %s", managed.Name, previous.KeyCreatedAt.Format(time.RFC3339))
+	return &previous
+}
+
+func maxKeyAge(managed *ManagedCertificate) time.Duration {
+	days := managed.MaxKeyAgeDays
+	if days <= 0 {
+		days = DEFAULT_MAX_KEY_AGE_DAYS
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Install the stored certificate to every destination that doesn't have
+// it yet, all at once
+func deployManaged(deployer *deploy.Service, managed *ManagedCertificate, policy *RenewalPolicy, key string, record *renewalRecord) error {
+	var cert acme.Certificate
+	if err := stateDB.Get(store.BUCKET_CERTIFICATES, key, &cert); err != nil {
+		return fmt.Errorf("failed to load issued certificate: %w", err)
+	}
+	// A staging certificate must never reach a server, whatever the mode
+	if cert.Staging {
+		return fmt.Errorf("refusing to deploy a staging certificate")
+	}
+	if deployer == nil {
+		return fmt.Errorf("no deployer available")
+	}
+
+	destinations := deploy.NamedDestinations(managed.Deploy)
+	statuses := map[string]*destinationStatus{}
+	var pending []deploy.Destination
+	for _, d := range destinations {
+		status := record.Destinations[d.ID]
+		if status == nil || status.Target != d.Target {
+			status = &destinationStatus{Target: d.Target}
+		}
+		statuses[d.ID] = status
+		if status.Fingerprint != record.Fingerprint {
+			pending = append(pending, d)
+		}
+	}
+	// Destinations removed from the configuration are forgotten
+	record.Destinations = statuses
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := runDeployHook("pre_deploy", policy.PreDeploy, managed, record); err != nil {
+		return fmt.Errorf("pre_deploy: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DEPLOY_TIMEOUT)
+	defer cancel()
+	result, err := deployer.FanOut(ctx, "acme:"+managed.Name, &deploy.FanOutRequest{
+		Name:         managed.Name,
+		Certificate:  string(cert.Certificate),
+		Chain:        string(cert.Chain),
+		PrivateKey:   string(cert.PrivateKey),
+		Destinations: pending,
+	})
+	if result == nil {
+		return err
+	}
+	for _, d := range result.Destinations {
+		status := statuses[d.ID]
+		status.Error = d.Error
+		if d.Status == tasks.STATUS_SUCCEEDED {
+			status.Fingerprint = result.Fingerprint
+			status.DeployedAt = time.Now().UTC()
+			log.Printf("[SUCCESS] Deployed %s to %s", managed.Name, d.ID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Deployed %s to %d destinations", managed.Name, result.Succeeded)
+	// Every destination has it now, so a failure here isn't retried
+	if err := runDeployHook("post_deploy", policy.PostDeploy, managed, record); err != nil {
+		log.Printf("[ERROR] post_deploy of %s: %v", managed.Name, err)
+	}
+	return nil
+}
+
+// Staging certificates are never deployed, so the scan can't find them;
+// list them in the inventory, marked, so they are visible to the server
+func stagingCertificates(config *Config) []inventory.Certificate {
+	if !acmeStaging || config.ACME == nil {
+		return nil
+	}
+	var certs []inventory.Certificate
+	for _, managed := range config.ACME.Certificates {
+		var cert acme.Certificate
+		if err := stateDB.Get(store.BUCKET_CERTIFICATES, renewalKey(managed.Name), &cert); err != nil {
+			continue
+		}
+		described, err := inventory.ParseCertificate(bytes.NewReader(slices.Concat(cert.Certificate, cert.Chain)), "acme:"+managed.Name)
+		if err != nil {
+			continue
+		}
+		described.Managed = managed.Name
+		described.Staging = true
+		certs = append(certs, *described)
+	}
+	return certs
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/platform"
+)
+
+// 'scan --now' waits this long for the agent to finish; a large scan with
+// a files_per_second limit is slow
+const RESCAN_TIMEOUT = 30 * time.Minute
+
+// An immediate scan asked for by signal or through the control socket;
+// done is nil for a signal, which nobody waits on
+type rescanRequest struct {
+	done chan *rescanResult
+}
+
+// What 'scan --now' prints
+type rescanResult struct {
+	Certificates int           `json:"certificates"`
+	Errors       []string      `json:"errors,omitempty"`
+	UploadError  string        `json:"upload_error,omitempty"`
+	Duration     time.Duration `json:"duration"`
+}
+
+// Served by the main loop between its other work; one pending request
+// covers any signals that arrive meanwhile
+var rescanRequests = make(chan *rescanRequest, 1)
+
+// watchRescanSignals turns SIGUSR1 into a scan request; installed before
+// the agent registers, since the signal would otherwise end the process
+func watchRescanSignals() {
+	signals := platform.RescanSignals()
+	if len(signals) == 0 {
+		return
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go func() {
+		for sig := range received {
+			log.Printf("[INFO] Received %v, scanning now", sig)
+			select {
+			case rescanRequests <- &rescanRequest{}:
+			default:
+			}
+		}
+	}()
+}
+
+// requestRescan queues a scan for the main loop and waits for its result
+func requestRescan(ctx context.Context) (interface{}, error) {
+	req := &rescanRequest{done: make(chan *rescanResult, 1)}
+	select {
+	case rescanRequests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case result := <-req.done:
+		return result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// rescan runs an inventory cycle now, scanning afresh even between
+// scheduled scans
+func rescan(config *Config, instanceID string, req *rescanRequest) {
+	started := time.Now()
+	forgetScan(config)
+	report, err := reportInventory(config, instanceID)
+	proxyInventories(config)
+	for _, t := range tenantInstances {
+		forgetScan(t.config)
+	}
+	tenantInventories()
+
+	if req.done == nil {
+		return
+	}
+	result := &rescanResult{
+		Certificates: len(report.Certificates),
+		Errors:       report.Errors,
+		Duration:     time.Since(started),
+	}
+	if err != nil {
+		result.UploadError = err.Error()
+	}
+	req.done <- result
+}
+
+// Ask the running agent for an immediate scan and report, e.g. right after
+// a certificate was changed by hand
+func handleScan() {
+	scanCmd := flag.NewFlagSet("scan", flag.ExitOnError)
+	now := scanCmd.Bool("now", false, "Scan and report the inventory right away instead of at the next scheduled time")
+	scanCmd.Parse(os.Args[2:])
+	if !*now {
+		fmt.Println("[ERROR] The agent scans on its own schedule; use --now to scan right away")
+		scanCmd.Usage()
+		os.Exit(1)
+	}
+
+	fmt.Println("Scanning...")
+	ctx, cancel := context.WithTimeout(context.Background(), RESCAN_TIMEOUT)
+	defer cancel()
+	var result rescanResult
+	if err := control.NewClient(CONTROL_SOCKET).Post(ctx, "/scan", &result); err != nil {
+		if errors.Is(err, control.ErrNotRunning) {
+			fmt.Printf("[ERROR] Cannot reach the agent at %s: %v\n", CONTROL_SOCKET, err)
+		} else {
+			fmt.Printf("[ERROR] Scan failed: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	for _, msg := range result.Errors {
+		fmt.Printf("[WARNING] %s\n", msg)
+	}
+	if result.UploadError != "" {
+		fmt.Printf("[ERROR] Found %d certificates in %v, but the inventory upload failed: %s\n",
+			result.Certificates, result.Duration.Round(time.Millisecond), result.UploadError)
+		os.Exit(1)
+	}
+	fmt.Printf("[SUCCESS] Found %d certificates in %v; inventory uploaded\n", result.Certificates, result.Duration.Round(time.Millisecond))
+}
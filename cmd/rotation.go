@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/probe"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	DEFAULT_OVERLAP_HOURS    = 72
+	DEFAULT_ROTATION_SAMPLES = 5
+	ROTATION_PROBE_TIMEOUT   = 2 * time.Minute
+)
+
+// RotationConfig rotates blue/green: after each renewal the previous
+// certificate stays valid for an overlap window while the endpoints are
+// sampled to see which certificate clients get, for services with long
+// reused connections or pinned clients
+type RotationConfig struct {
+	// OverlapHours the previous certificate must remain valid once the new
+	// one is deployed; renewal starts early enough to leave it
+	OverlapHours int `json:"overlap_hours,omitempty"`
+	// Endpoints as host:port; without any only the overlap is kept
+	Endpoints  []string `json:"endpoints,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
+	// Samples are fresh connections per endpoint and check, to reach more
+	// of the instances behind a load balancer
+	Samples int `json:"samples,omitempty"`
+}
+
+// A rotation in progress: the certificate replaced, until when it must
+// stay valid, and what the latest sampling saw
+type rotationStatus struct {
+	Previous         string                     `json:"previous_fingerprint_sha256"`
+	PreviousNotAfter time.Time                  `json:"previous_not_after"`
+	Current          string                     `json:"current_fingerprint_sha256"`
+	StartedAt        time.Time                  `json:"started_at"`
+	OverlapUntil     time.Time                  `json:"overlap_until"`
+	CheckedAt        time.Time                  `json:"checked_at,omitempty"`
+	CompletedAt      time.Time                  `json:"completed_at,omitempty"`
+	Overdue          bool                       `json:"overdue,omitempty"`
+	Endpoints        map[string]*endpointSample `json:"endpoints,omitempty"`
+}
+
+// How many of the latest samples of an endpoint saw which certificate
+type endpointSample struct {
+	Previous int    `json:"previous"`
+	Current  int    `json:"current"`
+	Other    int    `json:"other,omitempty"`
+	Failed   int    `json:"failed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (c *RotationConfig) overlap() time.Duration {
+	hours := c.OverlapHours
+	if hours <= 0 {
+		hours = DEFAULT_OVERLAP_HOURS
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func (c *RotationConfig) samples() int {
+	if c.Samples <= 0 {
+		return DEFAULT_ROTATION_SAMPLES
+	}
+	return c.Samples
+}
+
+// prepareRotation remembers the deployed certificate a renewal is about to
+// replace. While a renewal waits to be deployed, the one servers have is
+// still the previous one, so it is kept.
+func prepareRotation(managed *ManagedCertificate, record *renewalRecord) {
+	if managed.Rotation == nil || acmeStaging {
+		record.Rotation = nil
+		return
+	}
+	if record.Deployed && record.Fingerprint != "" {
+		record.Rotation = &rotationStatus{Previous: record.Fingerprint, PreviousNotAfter: record.NotAfter}
+	}
+}
+
+// startRotation opens the overlap window once the renewal is deployed. The
+// window never outlasts the previous certificate.
+func startRotation(managed *ManagedCertificate, record *renewalRecord) {
+	status := record.Rotation
+	if managed.Rotation == nil || status == nil || !status.StartedAt.IsZero() {
+		return
+	}
+	now := time.Now().UTC()
+	until := now.Add(managed.Rotation.overlap())
+	if status.PreviousNotAfter.Before(until) {
+		log.Printf("[WARNING] Previous certificate of %s expires at %s, before the overlap window ends", managed.Name, status.PreviousNotAfter.Format(time.RFC3339))
+		until = status.PreviousNotAfter
+	}
+	status.Current = record.Fingerprint
+	status.StartedAt = now
+	status.OverlapUntil = until
+	log.Printf("[INFO] Rotating %s: the previous certificate stays valid until %s", managed.Name, until.Format(time.RFC3339))
+}
+
+// watchRotation samples the endpoints of a rotation in progress. It ends
+// when every sample gets the new certificate, or when the previous one
+// expires; an overlap window running out first raises an event.
+func watchRotation(managed *ManagedCertificate) {
+	if managed.Rotation == nil || acmeStaging {
+		return
+	}
+	key := renewalKey(managed.Name)
+	var record renewalRecord
+	if err := stateDB.Get(store.BUCKET_RENEWALS, key, &record); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[WARNING] Failed to read renewal state of %s: %v", managed.Name, err)
+		}
+		return
+	}
+	status := record.Rotation
+	now := time.Now().UTC()
+	if status == nil || !status.CompletedAt.IsZero() || status.Current != record.Fingerprint || now.After(status.PreviousNotAfter) {
+		return
+	}
+
+	if len(managed.Rotation.Endpoints) > 0 {
+		sampleRotation(managed.Rotation, status)
+		status.CheckedAt = now
+	}
+	previousSeen, sampled, failed := status.seen()
+	switch {
+	case len(managed.Rotation.Endpoints) == 0 && now.After(status.OverlapUntil):
+		status.CompletedAt = now
+		log.Printf("[INFO] Overlap window of %s ended", managed.Name)
+	// An endpoint that can't be reached may still serve the previous one
+	case sampled > 0 && previousSeen == 0 && failed == 0:
+		status.CompletedAt = now
+		log.Printf("[SUCCESS] Rotation of %s complete: every sample got the new certificate", managed.Name)
+	case now.After(status.OverlapUntil) && !status.Overdue:
+		status.Overdue = true
+		summary := fmt.Sprintf("Previous certificate of %s still served after the overlap window: %d of %d samples", managed.Name, previousSeen, sampled)
+		log.Printf("[WARNING] %s", summary)
+		events.Publish(events.Event{
+			Type:     events.EVENT_ROTATION_INCOMPLETE,
+			Severity: events.SEVERITY_WARNING,
+			Summary:  summary,
+			Details:  map[string]string{"certificate": managed.Name, "previous": status.Previous, "current": status.Current},
+		})
+	}
+
+	if err := stateDB.Put(store.BUCKET_RENEWALS, key, record); err != nil {
+		log.Printf("[WARNING] Failed to store renewal state of %s: %v", managed.Name, err)
+	}
+}
+
+// sampleRotation opens fresh connections to every endpoint and counts
+// which certificate each one got
+func sampleRotation(config *RotationConfig, status *rotationStatus) {
+	ctx, cancel := context.WithTimeout(context.Background(), ROTATION_PROBE_TIMEOUT)
+	defer cancel()
+
+	status.Endpoints = map[string]*endpointSample{}
+	for _, endpoint := range config.Endpoints {
+		sample := &endpointSample{}
+		status.Endpoints[endpoint] = sample
+		host, portText, err := net.SplitHostPort(endpoint)
+		port, portErr := strconv.Atoi(portText)
+		if err != nil || portErr != nil {
+			sample.Error = fmt.Sprintf("invalid endpoint %q: want host:port", endpoint)
+			continue
+		}
+		for range config.samples() {
+			result := probe.Probe(ctx, probe.Target{Host: host, Port: port, TLS: true, ServerName: config.ServerName})
+			if !result.Reachable || len(result.TLS.Certificates) == 0 {
+				sample.Failed++
+				sample.Error = result.Error
+				continue
+			}
+			switch result.TLS.Certificates[0].Fingerprint {
+			case status.Previous:
+				sample.Previous++
+			case status.Current:
+				sample.Current++
+			default:
+				sample.Other++
+			}
+		}
+	}
+}
+
+// seen counts the latest samples that got the previous certificate, all
+// that completed a handshake, and those that failed
+func (s *rotationStatus) seen() (int, int, int) {
+	previous, sampled, failed := 0, 0, 0
+	for _, sample := range s.Endpoints {
+		previous += sample.Previous
+		sampled += sample.Previous + sample.Current + sample.Other
+		failed += sample.Failed
+	}
+	return previous, sampled, failed
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/cron"
+	"github.com/certfix/certfix-agent/pkg/scanner"
+)
+
+// The agent re-reads the clock this often while waiting for a scheduled
+// run, so a suspended host or a corrected clock doesn't delay it
+const SCHEDULE_RECHECK = 5 * time.Minute
+
+// Cron expressions for when inventories are reported and when the
+// filesystem and endpoint scan behind them runs. Reports between scans
+// reuse the last scan's results, so a heavy scan can be pinned to off-peak
+// hours while the inventory is still reported often.
+type ScheduleConfig struct {
+	// Reported every INVENTORY_INTERVAL by default
+	Inventory string `json:"inventory,omitempty"`
+	// Scanned for every report by default
+	Scan string `json:"scan,omitempty"`
+	// Timezone is an IANA name; the host's by default. An expression can
+	// name its own with a CRON_TZ= prefix.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// The last scan of the host and of each tenant
+var (
+	scanMu    sync.Mutex
+	lastScans = map[string]*lastScan{}
+)
+
+type lastScan struct {
+	at     time.Time
+	result *scanner.Result
+}
+
+// parse returns the inventory and scan schedules; nil for those not set
+func (s *ScheduleConfig) parse() (inventory, scan *cron.Schedule, err error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid schedule timezone: %w", err)
+		}
+	}
+	if s.Inventory != "" {
+		if inventory, err = cron.Parse(s.Inventory, loc); err != nil {
+			return nil, nil, fmt.Errorf("invalid inventory schedule: %w", err)
+		}
+	}
+	if s.Scan != "" {
+		if scan, err = cron.Parse(s.Scan, loc); err != nil {
+			return nil, nil, fmt.Errorf("invalid scan schedule: %w", err)
+		}
+	}
+	return inventory, scan, nil
+}
+
+// Schedules are checked when the configuration loads, so later callers
+// can ignore the error
+func scanSchedule(config *Config) *cron.Schedule {
+	_, scan, _ := config.Schedule.parse()
+	return scan
+}
+
+func inventorySchedule(config *Config) *cron.Schedule {
+	inventory, _, _ := config.Schedule.parse()
+	return inventory
+}
+
+// reusableScan returns the previous scan's results while the scan schedule
+// hasn't come round since; nil means scan now. The first report after the
+// agent starts always scans.
+func reusableScan(config *Config) *scanner.Result {
+	schedule := scanSchedule(config)
+	if schedule == nil {
+		return nil
+	}
+	scanMu.Lock()
+	last := lastScans[config.tenant]
+	scanMu.Unlock()
+	if last == nil {
+		return nil
+	}
+	next := schedule.Next(last.at)
+	if !time.Now().Before(next) {
+		return nil
+	}
+	log.Printf("[INFO] Scan: reusing results from %s; next scan at %s",
+		last.at.Format(time.DateTime), next.Format(time.DateTime+" MST"))
+	return last.result
+}
+
+func rememberScan(config *Config, at time.Time, result *scanner.Result) {
+	if scanSchedule(config) == nil {
+		return
+	}
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	lastScans[config.tenant] = &lastScan{at: at, result: result}
+}
+
+// forgetScan makes the next report scan again, for changes seen as they
+// happened
+func forgetScan(config *Config) {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	delete(lastScans, config.tenant)
+}
+
+// runTimer fires on a cron schedule, or every interval without one; with
+// neither, its channel is nil and never fires
+type runTimer struct {
+	schedule *cron.Schedule
+	interval time.Duration
+	next     time.Time
+	timer    *time.Timer
+}
+
+func newRunTimer(schedule *cron.Schedule, interval time.Duration) *runTimer {
+	t := &runTimer{schedule: schedule, interval: interval}
+	if schedule != nil || interval > 0 {
+		t.arm(time.Now())
+	}
+	return t
+}
+
+func (t *runTimer) arm(now time.Time) {
+	if t.schedule != nil {
+		t.next = t.schedule.Next(now)
+	} else {
+		t.next = now.Add(t.interval)
+	}
+	wait := time.Until(t.next)
+	if t.schedule != nil {
+		wait = min(wait, SCHEDULE_RECHECK)
+	}
+	if t.timer == nil {
+		t.timer = time.NewTimer(wait)
+	} else {
+		t.timer.Reset(wait)
+	}
+}
+
+func (t *runTimer) C() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Due is called when the channel fires: it reports whether the run is due
+// and arms the timer again
+func (t *runTimer) Due() bool {
+	now := time.Now()
+	if t.schedule != nil && now.Before(t.next) {
+		t.timer.Reset(min(time.Until(t.next), SCHEDULE_RECHECK))
+		return false
+	}
+	t.arm(now)
+	return true
+}
+
+func (t *runTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
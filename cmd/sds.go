@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/sds"
+)
+
+const (
+	// How often certificate files behind SDS secrets are re-read
+	SDS_REFRESH_INTERVAL = 30 * time.Second
+
+	// Envoy's api_type for the SDS config source
+	SDS_API_GRPC = "grpc"
+	SDS_API_REST = "rest"
+)
+
+// Start serving managed certificates to Envoy; runs in the background
+func startSDS(config *Config) {
+	var sources []sds.Source
+	for _, secret := range config.SDS.Secrets {
+		sources = append(sources, sds.Source{Name: secret.Name, CertFile: secret.CertFile, KeyFile: secret.KeyFile})
+	}
+
+	store := sds.NewStore()
+	refresh := func() {
+		changed, errs := store.Load(sources)
+		for _, err := range errs {
+			log.Printf("[WARNING] SDS: %v", err)
+		}
+		if !changed {
+			return
+		}
+		log.Printf("[INFO] SDS secrets updated (version %s)", store.Version())
+		if config.SDS.Dir != "" {
+			if err := store.WriteFiles(config.SDS.Dir); err != nil {
+				log.Printf("[ERROR] SDS: %v", err)
+			}
+		}
+	}
+	refresh()
+
+	if config.SDS.Listen != "" {
+		if err := serveSDS(config.SDS, store); err != nil {
+			log.Printf("[ERROR] SDS server disabled: %v", err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(SDS_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			refresh()
+		}
+	}()
+}
+
+// Open the SDS socket and serve it in the background
+func serveSDS(config *SDSConfig, store *sds.Store) error {
+	rest := strings.EqualFold(config.APIType, SDS_API_REST)
+	if !rest && config.APIType != "" && !strings.EqualFold(config.APIType, SDS_API_GRPC) {
+		return fmt.Errorf("unknown api_type %q (use grpc or rest)", config.APIType)
+	}
+	listener, err := sds.Listen(config.Listen, sds.Access{UIDs: config.AllowedUIDs, GIDs: config.AllowedGIDs})
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := sds.Serve(listener, store, rest); err != nil {
+			log.Printf("[ERROR] SDS server stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"log"
+
+	"github.com/certfix/certfix-agent/pkg/secrets"
+)
+
+// Resolver for secret references in deploy options, with the providers
+// configured under "secrets"
+func secretResolver(config *Config) *secrets.Resolver {
+	resolver, err := secrets.NewResolver(config.Secrets)
+	if err != nil {
+		log.Printf("[WARNING] Secrets providers misconfigured, using their defaults: %v", err)
+		return nil
+	}
+	return resolver
+}
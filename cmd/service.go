@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/lockfile"
+	"github.com/certfix/certfix-agent/pkg/platform"
+	"github.com/certfix/certfix-agent/pkg/sandbox"
+	"github.com/certfix/certfix-agent/pkg/truststore"
+)
+
+const (
+	SERVICE_NAME        = "certfix-agent"
+	SYSTEMD_UNIT_FILE   = "/etc/systemd/system/certfix-agent.service"
+	SYSTEMD_SOCKET_FILE = "/etc/systemd/system/certfix-agent.socket"
+)
+
+// Build the sandbox policy for this agent from its configuration
+func sandboxPolicy(config *Config) sandbox.Policy {
+	agentDirs := []string{
+		filepath.Dir(CONFIG_FILE),
+		STATE_DIR,
+		filepath.Dir(lockfile.LOCK_FILE),
+	}
+
+	// SDS output and its unix socket live outside the agent's own dirs
+	if config.SDS != nil {
+		if config.SDS.Dir != "" {
+			agentDirs = append(agentDirs, config.SDS.Dir)
+		}
+		if path, ok := strings.CutPrefix(config.SDS.Listen, "unix:"); ok {
+			agentDirs = append(agentDirs, filepath.Dir(path))
+		}
+	}
+	// HTTP-01 tokens are written below each profile's webroot
+	if config.ACME != nil {
+		for _, profile := range config.ACME.Profiles {
+			if profile.Webroot != "" {
+				agentDirs = append(agentDirs, profile.Webroot)
+			}
+		}
+	}
+	// Deploy targets arrive as tasks, so open what the mail target writes
+	// for whichever mail servers are installed
+	agentDirs = append(agentDirs, deploy.MailConfigPaths()...)
+	if config.TrustStore != nil && config.TrustStore.Manage {
+		if backend := truststore.Detect(); backend != nil {
+			agentDirs = append(agentDirs, truststore.Paths(backend)...)
+		}
+	}
+	policy := sandbox.DefaultPolicy(agentDirs, config.CertPaths)
+	policy.PacketCapture = config.TLSObserver != nil
+	return policy
+}
+
+// Render the systemd unit, including, with sandbox enabled, the hardening
+// directives that mirror the in-process sandbox policy
+func renderSystemdUnit(binPath string, config *Config) string {
+	var b strings.Builder
+
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=CertFix Agent Service\n")
+	b.WriteString("After=network-online.target certfix-agent.socket\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("Requires=certfix-agent.socket\n")
+	b.WriteString("\n")
+	b.WriteString("[Service]\n")
+	fmt.Fprintf(&b, "ExecStart=%s start\n", binPath)
+	b.WriteString("Restart=always\n")
+	b.WriteString("RestartSec=5\n")
+	b.WriteString("User=root\n")
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", filepath.Dir(CONFIG_FILE))
+	fmt.Fprintf(&b, "StateDirectory=%s\n", filepath.Base(STATE_DIR))
+	// Deploy targets write all over the system (mail and trust store
+	// configuration, validation logs), so the read-only root is only
+	// imposed along with the sandbox that makes the same trade
+	if config.Sandbox {
+		b.WriteString("\n")
+		b.WriteString("# Hardening: keep in sync with the agent's Landlock policy\n")
+		for _, directive := range sandbox.SystemdDirectives(sandboxPolicy(config)) {
+			b.WriteString(directive + "\n")
+		}
+	}
+	b.WriteString("\n")
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	b.WriteString("Also=certfix-agent.socket\n")
+
+	return b.String()
+}
+
+// Render the socket unit for the control socket: systemd creates it with
+// these permissions and starts the agent on the first connection if it
+// isn't running. Group access is granted with a drop-in setting
+// SocketGroup.
+func renderSystemdSocket() string {
+	var b strings.Builder
+
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=CertFix Agent Control Socket\n")
+	b.WriteString("\n")
+	b.WriteString("[Socket]\n")
+	fmt.Fprintf(&b, "ListenStream=%s\n", CONTROL_SOCKET)
+	fmt.Fprintf(&b, "FileDescriptorName=%s\n", control.SOCKET_FD_NAME)
+	b.WriteString("SocketMode=0660\n")
+	b.WriteString("SocketUser=root\n")
+	b.WriteString("SocketGroup=root\n")
+	b.WriteString("RemoveOnStop=yes\n")
+	b.WriteString("\n")
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=sockets.target\n")
+
+	return b.String()
+}
+
+func handleService() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: certfix-agent service install|print|print-socket")
+		os.Exit(1)
+	}
+
+	// The unit only depends on the sandbox settings; a missing config yields
+	// the baseline unit
+	config, err := loadConfig()
+	if err != nil {
+		config = &Config{}
+	}
+
+	binPath, err := os.Executable()
+	if err != nil {
+		binPath = platform.DefaultBinaryPath()
+	}
+
+	if runtime.GOOS == "windows" {
+		handleWindowsService(binPath)
+		return
+	}
+
+	unit := renderSystemdUnit(binPath, config)
+	socket := renderSystemdSocket()
+
+	switch os.Args[2] {
+	case "print":
+		fmt.Print(unit)
+	case "print-socket":
+		fmt.Print(socket)
+	case "install":
+		for path, content := range map[string]string{SYSTEMD_UNIT_FILE: unit, SYSTEMD_SOCKET_FILE: socket} {
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				fmt.Printf("[ERROR] Failed to write %s: %v\n", path, err)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("[SUCCESS] Systemd units written to %s and %s\n", SYSTEMD_UNIT_FILE, SYSTEMD_SOCKET_FILE)
+
+		// Enabling the service enables its socket too (Also=)
+		for _, args := range [][]string{{"daemon-reload"}, {"enable", SERVICE_NAME}} {
+			if output, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+				fmt.Printf("[ERROR] systemctl %s failed: %v\n%s", strings.Join(args, " "), err, output)
+				os.Exit(1)
+			}
+		}
+		fmt.Println("[INFO] Service enabled. Start it with: sudo systemctl start certfix-agent")
+	default:
+		fmt.Printf("Unknown service command: %s\n", os.Args[2])
+		os.Exit(1)
+	}
+}
+
+// sc.exe invocations that register the agent with the Windows Service
+// Control Manager and restart it when it exits unexpectedly
+func windowsServiceCommands(binPath string) [][]string {
+	return [][]string{
+		{"create", SERVICE_NAME, "binPath=", fmt.Sprintf("\"%s\" start", binPath), "start=", "delayed-auto", "DisplayName=", "CertFix Agent"},
+		{"description", SERVICE_NAME, "CertFix certificate management agent"},
+		{"failure", SERVICE_NAME, "reset=", "86400", "actions=", "restart/5000/restart/5000/restart/30000"},
+	}
+}
+
+func handleWindowsService(binPath string) {
+	commands := windowsServiceCommands(binPath)
+
+	switch os.Args[2] {
+	case "print":
+		for _, args := range commands {
+			fmt.Printf("sc.exe %s\n", strings.Join(args, " "))
+		}
+	case "install":
+		for _, args := range commands {
+			if output, err := exec.Command("sc.exe", args...).CombinedOutput(); err != nil {
+				fmt.Printf("[ERROR] sc.exe %s failed: %v\n%s", args[0], err, output)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("[SUCCESS] Service %s registered\n", SERVICE_NAME)
+		fmt.Printf("[INFO] Start it with: sc.exe start %s\n", SERVICE_NAME)
+	default:
+		fmt.Printf("Unknown service command: %s\n", os.Args[2])
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/lockfile"
+	"github.com/certfix/certfix-agent/pkg/machineidentifier"
+	"github.com/certfix/certfix-agent/pkg/replay"
+	"github.com/certfix/certfix-agent/pkg/simulator"
+)
+
+const (
+	// A simulation plays out in minutes rather than hours
+	SIMULATE_POLL_INTERVAL      = 10 * time.Second
+	SIMULATE_HEARTBEAT_INTERVAL = 1 * time.Minute
+	SIMULATE_INVENTORY_INTERVAL = 1 * time.Minute
+	SIMULATE_DRIFT_INTERVAL     = 1 * time.Minute
+)
+
+// Set by 'start --simulate'; nil against a real API
+var simulation *simulator.Server
+
+// Parse the start command's flags; --simulate swaps the configured API for
+// an embedded one before anything else reads the configuration
+func parseStartFlags() {
+	startCmd := flag.NewFlagSet("start", flag.ExitOnError)
+	simulate := startCmd.Bool("simulate", false, "Run against an embedded fake API")
+	pebble := startCmd.String("pebble", "", "ACME directory URL to issue simulated certificates from (e.g. a local Pebble)")
+	startCmd.BoolVar(&acmeStaging, "staging", false, "Renew ACME certificates from staging directories and never deploy them")
+	startCmd.Parse(os.Args[2:])
+
+	if *pebble != "" && !*simulate {
+		log.Fatalf("[FATAL] --pebble requires --simulate")
+	}
+	if *simulate {
+		startSimulation(*pebble)
+	}
+}
+
+// Start the fake API and point every path the agent writes into a scratch
+// directory, so a simulation never touches the real installation
+func startSimulation(acmeDirectory string) {
+	dir, err := os.MkdirTemp("", "certfix-simulate-")
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to create simulation directory: %v", err)
+	}
+	certDir := filepath.Join(dir, "certs")
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		log.Fatalf("[FATAL] Failed to create simulation directory: %v", err)
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append([]string{hostname}, names...)
+	}
+
+	token := replay.NewNonce()
+	server, err := simulator.Start(simulator.Options{
+		Token:         token,
+		CertDir:       certDir,
+		Names:         names,
+		ACMEDirectory: acmeDirectory,
+	})
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to start simulator: %v", err)
+	}
+	simulation = server
+
+	// Hooks, plugins and drift settings are worth exercising too; nothing
+	// else carries over
+	config := &Config{
+		Token:          token,
+		Endpoint:       server.URL,
+		CurrentVersion: DEFAULT_VERSION,
+		Architecture:   runtime.GOARCH,
+		CertPaths:      []string{certDir},
+	}
+	if real, err := loadConfig(); err == nil {
+		config.CurrentVersion = real.CurrentVersion
+		config.HooksDir = real.HooksDir
+		config.PluginDir = real.PluginDir
+		config.Drift = real.Drift
+		config.ACME = real.ACME
+	}
+
+	STATE_DIR = filepath.Join(dir, "state")
+	CONFIG_FILE = filepath.Join(dir, "config.json")
+	SCAN_CACHE_FILE = filepath.Join(STATE_DIR, "scan-cache.json")
+	AUDIT_LOG = filepath.Join(STATE_DIR, "audit.log")
+	KEY_MANIFEST_FILE = filepath.Join(STATE_DIR, "signing-keys.json")
+	TASK_NONCE_FILE = filepath.Join(STATE_DIR, "task-nonces.json")
+	STATE_DB = filepath.Join(STATE_DIR, "state.db")
+	RENEWAL_STATUS_FILE = filepath.Join(STATE_DIR, "renewals.json")
+	CONTROL_SOCKET = filepath.Join(STATE_DIR, control.SOCKET_NAME)
+	RECEIPT_LOG = filepath.Join(STATE_DIR, "receipts.jsonl")
+	lockfile.LOCK_FILE = filepath.Join(dir, "certfix-agent.lock")
+	machineidentifier.MACHINE_ID_FILE = filepath.Join(dir, "machine-id")
+
+	if err := os.MkdirAll(STATE_DIR, 0700); err != nil {
+		log.Fatalf("[FATAL] Failed to create simulation directory: %v", err)
+	}
+	if err := saveConfig(config); err != nil {
+		log.Fatalf("[FATAL] Failed to write simulation config: %v", err)
+	}
+
+	log.Printf("[INFO] Simulation mode: nothing is sent to a real CertFix API")
+	log.Printf("[INFO] Simulation files: %s (certificates in %s)", dir, certDir)
+}
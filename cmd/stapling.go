@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/dashboard"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/drift"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/service"
+	"github.com/certfix/certfix-agent/pkg/stapling"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	DEFAULT_STAPLING_INTERVAL = 1 * time.Hour
+	MIN_STAPLING_INTERVAL     = 5 * time.Minute
+	STAPLING_TIMEOUT          = 10 * time.Minute
+)
+
+// OCSP responses kept next to deployed certificates, as <file>.ocsp, for
+// web servers that cannot reach the responder to staple on their own
+type StaplingConfig struct {
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+	// Certificate files besides those the agent deployed
+	Files []string `json:"files,omitempty"`
+	// HAProxy admin socket; new responses are pushed to the running process
+	HAProxySocket string `json:"haproxy_socket,omitempty"`
+	// Services reloaded when a response changes, e.g. nginx, which only
+	// reads ssl_stapling_file at startup
+	Reload []string `json:"reload,omitempty"`
+}
+
+var (
+	staplingMu sync.Mutex
+	// Last result per certificate file, for the dashboard
+	staplingResults = map[string]*stapling.Result{}
+	// A deployment asks for a refresh so its new certificate is stapled
+	// right away rather than at the next interval
+	staplingKick = make(chan struct{}, 1)
+)
+
+// startStapling refreshes the responses in the background
+func startStapling(config *Config) {
+	if config.Stapling == nil {
+		return
+	}
+	interval := DEFAULT_STAPLING_INTERVAL
+	if config.Stapling.IntervalMinutes > 0 {
+		interval = max(time.Duration(config.Stapling.IntervalMinutes)*time.Minute, MIN_STAPLING_INTERVAL)
+	}
+	log.Printf("[INFO] OCSP stapling responses refreshed every %v", interval)
+
+	go func() {
+		for {
+			refreshStapling(config)
+			select {
+			case <-time.After(interval):
+			case <-staplingKick:
+			}
+		}
+	}()
+}
+
+// staplingRefresher requests a refresh after every deployment
+type staplingRefresher struct{}
+
+func (staplingRefresher) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	return nil
+}
+
+func (staplingRefresher) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	select {
+	case staplingKick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// staplingHealth sums up the last refresh for the dashboard
+func staplingHealth() dashboard.Check {
+	check := dashboard.Check{Name: "OCSP stapling", Status: dashboard.CHECK_OK}
+	staplingMu.Lock()
+	defer staplingMu.Unlock()
+	stapled, failed := 0, []string{}
+	for file, result := range staplingResults {
+		switch result.Status {
+		case stapling.STATUS_FRESH, stapling.STATUS_UPDATED:
+			stapled++
+		case stapling.STATUS_REVOKED:
+			check.Status = dashboard.CHECK_FAIL
+			failed = append(failed, file+": "+result.Error)
+		case stapling.STATUS_FAILED:
+			if result.Error != stapling.ErrNoResponder.Error() {
+				if check.Status == dashboard.CHECK_OK {
+					check.Status = dashboard.CHECK_WARN
+				}
+				failed = append(failed, file+": "+result.Error)
+			}
+		}
+	}
+	sort.Strings(failed)
+	check.Detail = fmt.Sprintf("%d certificates stapled", stapled)
+	if len(failed) > 0 {
+		check.Detail += "; " + strings.Join(failed, "; ")
+	}
+	return check
+}
+
+func refreshStapling(config *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), STAPLING_TIMEOUT)
+	defer cancel()
+	client := httpclient.New(stapling.FETCH_TIMEOUT)
+
+	updated := 0
+	for _, file := range staplingFiles(config) {
+		result := stapling.Refresh(ctx, client, file)
+		staplingMu.Lock()
+		previous := staplingResults[file]
+		staplingResults[file] = result
+		staplingMu.Unlock()
+
+		switch result.Status {
+		case stapling.STATUS_UPDATED:
+			updated++
+			log.Printf("[INFO] OCSP response for %s updated (next update %s)", file, result.NextUpdate.Local().Format(time.RFC3339))
+			if socket := config.Stapling.HAProxySocket; socket != "" {
+				if err := stapling.UpdateHAProxy(socket, result.Response); err != nil {
+					log.Printf("[WARNING] %v", err)
+				}
+			}
+		case stapling.STATUS_REVOKED:
+			if previous == nil || previous.Status != stapling.STATUS_REVOKED {
+				log.Printf("[ERROR] Certificate in %s is %s", file, result.Error)
+				events.Publish(events.Event{
+					Type:     events.EVENT_CERT_REVOKED,
+					Severity: events.SEVERITY_CRITICAL,
+					Summary:  "Deployed certificate in " + file + " is " + result.Error,
+					Details:  map[string]string{"location": file},
+				})
+			}
+		case stapling.STATUS_FAILED:
+			// Certificates from CAs without OCSP are simply not stapled
+			if result.Error != stapling.ErrNoResponder.Error() {
+				log.Printf("[WARNING] OCSP response for %s not refreshed: %s", file, result.Error)
+			}
+		}
+	}
+
+	if updated == 0 {
+		return
+	}
+	manager := service.Detect()
+	for _, name := range config.Stapling.Reload {
+		if err := service.Apply(ctx, manager, service.ACTION_RELOAD, name); err != nil {
+			log.Printf("[WARNING] Failed to reload %s after OCSP update: %v", name, err)
+		}
+	}
+}
+
+// staplingFiles lists the configured files and the certificate files of
+// every recorded deployment, once each
+func staplingFiles(config *Config) []string {
+	seen := map[string]bool{}
+	var files []string
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, path := range config.Stapling.Files {
+		add(path)
+	}
+	err := stateDB.ForEach(store.BUCKET_DEPLOYMENTS, func(key string, data []byte) error {
+		var exp drift.Expected
+		if err := json.Unmarshal(data, &exp); err != nil {
+			return nil
+		}
+		// Files that start with the deployed leaf; chain-only files and
+		// keys need no response
+		for _, file := range exp.Files {
+			if len(file.Certificates) > 0 && file.Certificates[0] == exp.Fingerprint {
+				add(file.Path)
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("[WARNING] Failed to read deployment records: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
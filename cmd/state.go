@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/store"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	// Finished tasks kept locally for troubleshooting
+	MAX_TASK_HISTORY = 500
+
+	STATE_SCAN_CACHE   = "scan_cache"
+	STATE_KEY_MANIFEST = "signing_keys"
+	STATE_TASK_NONCES  = "task_nonces"
+	STATE_RATE_LIMITS  = "acme_rate_limits"
+	// One ACME account per directory: acme_account:<directory URL>
+	STATE_ACME_ACCOUNT = "acme_account:"
+	TASK_HISTORY_QUEUE = "history"
+)
+
+var STATE_DB = filepath.Join(STATE_DIR, "state.db")
+
+// Open for the lifetime of 'start'; the instance lock keeps other commands out
+var stateDB *store.Store
+
+// What this host was last registered as
+type storedIdentity struct {
+	InstanceID   string    `json:"instance_id"`
+	MachineID    string    `json:"machine_id"`
+	Endpoint     string    `json:"endpoint"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// The last inventory built for an instance, whether or not it was delivered
+type storedInventory struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Uploaded    bool              `json:"uploaded"`
+	Report      *inventory.Report `json:"report"`
+}
+
+type taskRecord struct {
+	InstanceID string    `json:"instance_id"`
+	TaskID     string    `json:"task_id"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Open the state database, moving state written by older versions into it
+func openState() {
+	db, err := store.Open(STATE_DB)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	stateDB = db
+
+	legacy := []struct{ key, path string }{
+		{STATE_SCAN_CACHE, SCAN_CACHE_FILE},
+		{STATE_KEY_MANIFEST, KEY_MANIFEST_FILE},
+		{STATE_TASK_NONCES, TASK_NONCE_FILE},
+	}
+	for _, l := range legacy {
+		imported, err := db.ImportFile(l.key, l.path)
+		if err != nil {
+			log.Printf("[WARNING] State migration: %v", err)
+		}
+		if imported {
+			log.Printf("[INFO] Moved %s into %s", l.path, STATE_DB)
+		}
+	}
+}
+
+// Remember the registration, noting when the server handed out a new ID
+func recordIdentity(config *Config, instanceID, machineID string) {
+	var previous storedIdentity
+	err := stateDB.Get(store.BUCKET_IDENTITY, machineID, &previous)
+	if err == nil && previous.InstanceID != instanceID {
+		log.Printf("[INFO] Instance ID changed from %s (registered %s)", previous.InstanceID, previous.RegisteredAt.Format(time.RFC3339))
+	} else if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("[WARNING] Failed to read stored identity: %v", err)
+	}
+
+	identity := storedIdentity{
+		InstanceID:   instanceID,
+		MachineID:    machineID,
+		Endpoint:     config.Endpoint,
+		RegisteredAt: time.Now().UTC(),
+	}
+	if err := stateDB.Put(store.BUCKET_IDENTITY, machineID, identity); err != nil {
+		log.Printf("[WARNING] Failed to store identity: %v", err)
+	}
+}
+
+// Keep the last inventory so it survives a restart during an outage
+func recordInventory(instanceID string, report *inventory.Report, uploaded bool) {
+	entry := storedInventory{GeneratedAt: report.GeneratedAt, Uploaded: uploaded, Report: report}
+	if err := stateDB.Put(store.BUCKET_INVENTORY, instanceID, entry); err != nil {
+		log.Printf("[WARNING] Failed to store inventory: %v", err)
+	}
+}
+
+func recordTask(instanceID string, result *tasks.Result) {
+	entry := taskRecord{
+		InstanceID: instanceID,
+		TaskID:     result.TaskID,
+		Type:       result.Type,
+		Status:     result.Status,
+		Error:      result.Error,
+		StartedAt:  result.StartedAt,
+		FinishedAt: result.FinishedAt,
+	}
+	if _, err := stateDB.Queue(store.BUCKET_TASKS, TASK_HISTORY_QUEUE, MAX_TASK_HISTORY).Push(entry); err != nil {
+		log.Printf("[WARNING] Failed to record task %s: %v", result.TaskID, err)
+	}
+}
+
+// Undelivered task results of one instance
+func resultSpool(instanceID string) *store.Queue {
+	return stateDB.Queue(store.BUCKET_SPOOL, instanceID, MAX_PENDING_RESULTS)
+}
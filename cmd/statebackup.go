@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/backup"
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/lockfile"
+	"github.com/certfix/certfix-agent/pkg/machineidentifier"
+	"github.com/certfix/certfix-agent/pkg/secrets"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+// Names of the files in a state archive
+const (
+	ARCHIVE_CONFIG     = "config.json"
+	ARCHIVE_MACHINE_ID = "machine-id"
+	ARCHIVE_STATE_DB   = "state.db"
+	// Other files of the state directory: state/<name>
+	ARCHIVE_STATE_DIR = "state/"
+
+	// Files replaced by a restore are kept beside it with this suffix
+	RESTORE_BACKUP_SUFFIX = ".before-restore"
+)
+
+// Files of the state directory that travel with the database: the
+// receipt chains and the renewal status 'status' reads
+var archivedStateFiles = []string{"receipts*.jsonl", "renewals*.json"}
+
+// Snapshot the agent's identity and state into an encrypted archive:
+// configuration, machine ID, the state database (instance identities,
+// managed certificates and their keys, ACME accounts, queues) and receipt
+// chains. Restored with 'restore --archive' onto a rebuilt host, the agent
+// carries on as the same instance. Works while the agent runs.
+func handleBackup() {
+	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := backupCmd.String("out", "", "File to write the encrypted archive to (required)")
+	recipients := backupCmd.String("recipient", "", "age recipients to encrypt to, comma-separated (default: backup.age_recipients)")
+	key := backupCmd.String("key", "", "AES-256 key, base64 or hex, or a secret reference (default: backup.key)")
+	backupCmd.Parse(os.Args[2:])
+
+	if *out == "" {
+		fmt.Println("[ERROR] --out is required")
+		os.Exit(1)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	cipher, err := archiveCipher(config, splitList(*recipients), *key)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+
+	manifest, err := snapshotAgent(config)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	sealed, err := backup.WriteArchive(cipher, manifest)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to write archive: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*out, sealed, 0600); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("[SUCCESS] Wrote %s (%d bytes, encrypted with %s)\n", *out, len(sealed), backupCipherName(cipher))
+	for _, f := range manifest.Files {
+		fmt.Printf("  %-24s %d bytes\n", f.Name, f.Size)
+	}
+	fmt.Println("Keep the archive off this host; it holds the agent's token and private keys.")
+}
+
+// archiveCipher encrypts to the given recipients or key, falling back to
+// what the backup section configures
+func archiveCipher(config *Config, recipients []string, key string) (backup.Cipher, error) {
+	if len(recipients) == 0 && key == "" && config.Backup != nil {
+		recipients, key = config.Backup.AgeRecipients, config.Backup.Key
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), BACKUP_SETUP_TIMEOUT)
+	defer cancel()
+	switch {
+	case len(recipients) > 0 && key != "":
+		return nil, fmt.Errorf("use either age recipients or a key, not both")
+	case len(recipients) > 0:
+		return backup.NewAge(recipients, nil)
+	case key != "":
+		return backupKeyCipher(ctx, config, key)
+	}
+	return nil, fmt.Errorf("nothing to encrypt with: pass --recipient or --key, or configure backup.age_recipients or backup.key")
+}
+
+// snapshotAgent reads the files of the archive. The database is copied
+// from the running agent through its socket, since it holds the lock.
+func snapshotAgent(config *Config) (*backup.Manifest, error) {
+	hostname, _ := os.Hostname()
+	manifest := &backup.Manifest{
+		CreatedAt:    time.Now().UTC(),
+		Host:         hostname,
+		AgentVersion: config.CurrentVersion,
+	}
+
+	data, err := os.ReadFile(CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	manifest.Files = append(manifest.Files, &backup.ArchiveFile{Name: ARCHIVE_CONFIG, Mode: 0600, Data: data})
+
+	if data, err := os.ReadFile(machineidentifier.MACHINE_ID_FILE); err == nil {
+		manifest.MachineID = strings.TrimSpace(string(data))
+		manifest.Files = append(manifest.Files, &backup.ArchiveFile{Name: ARCHIVE_MACHINE_ID, Mode: 0644, Data: data})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read machine ID: %w", err)
+	}
+
+	state, err := snapshotState()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		manifest.Files = append(manifest.Files, &backup.ArchiveFile{Name: ARCHIVE_STATE_DB, Mode: 0600, Data: state})
+	}
+
+	for _, pattern := range archivedStateFiles {
+		matches, _ := filepath.Glob(filepath.Join(STATE_DIR, pattern))
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Files = append(manifest.Files, &backup.ArchiveFile{Name: ARCHIVE_STATE_DIR + filepath.Base(path), Mode: 0600, Data: data})
+		}
+	}
+	return manifest, nil
+}
+
+// snapshotState copies the state database; nil when there is none yet
+func snapshotState() ([]byte, error) {
+	var buf bytes.Buffer
+	lock, err := lockfile.Acquire(lockfile.LOCK_FILE)
+	var lockedErr *lockfile.LockedError
+	if errors.As(err, &lockedErr) {
+		err := control.NewClient(CONTROL_SOCKET).Download(context.Background(), "/state", &buf)
+		if err != nil {
+			return nil, fmt.Errorf("the agent is running and its state could not be copied through %s: %w", CONTROL_SOCKET, err)
+		}
+		return buf.Bytes(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire instance lock: %w", err)
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(STATE_DB); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	db, err := store.Open(STATE_DB)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("failed to copy state database: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// serveState streams a consistent copy of the state database to 'backup'
+func serveState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := stateDB.WriteTo(w); err != nil {
+		log.Printf("[ERROR] Failed to copy state for backup: %v", err)
+	}
+}
+
+// restoreState puts an archive from 'backup' in place on this host. The
+// agent must be stopped; files it replaces are kept with a suffix.
+func restoreState(archive, identityFile, key string, force bool) {
+	lock, err := lockfile.Acquire(lockfile.LOCK_FILE)
+	if err != nil {
+		var lockedErr *lockfile.LockedError
+		if errors.As(err, &lockedErr) {
+			fmt.Printf("[ERROR] The agent is running (%v); stop it before restoring\n", lockedErr)
+		} else {
+			fmt.Printf("[ERROR] Failed to acquire instance lock: %v\n", err)
+		}
+		os.Exit(1)
+	}
+	defer lock.Release()
+
+	cipher, err := restoreCipher(identityFile, key)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	sealed, err := os.ReadFile(archive)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		os.Exit(1)
+	}
+	manifest, err := backup.ReadArchive(cipher, sealed)
+	if errors.Is(err, backup.ErrWrongKey) {
+		err = fmt.Errorf("%w; pass the key or identity the archive was made for", err)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to read %s: %v\n", archive, err)
+		os.Exit(1)
+	}
+
+	type placement struct {
+		file *backup.ArchiveFile
+		path string
+	}
+	var placements []placement
+	var existing []string
+	for _, f := range manifest.Files {
+		path := archiveDestination(f.Name)
+		if path == "" {
+			fmt.Printf("[WARNING] Skipping %s, unknown to this version\n", f.Name)
+			continue
+		}
+		placements = append(placements, placement{f, path})
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) > 0 && !force {
+		fmt.Printf("[ERROR] This host already has %s; pass --force to replace them (they are kept with the %s suffix)\n",
+			strings.Join(existing, ", "), RESTORE_BACKUP_SUFFIX)
+		os.Exit(1)
+	}
+
+	for _, p := range placements {
+		if err := placeRestored(p.path, p.file); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("  %-24s -> %s\n", p.file.Name, p.path)
+	}
+
+	fmt.Printf("[SUCCESS] Restored the state of %s from %s\n", manifest.Host, manifest.CreatedAt.Format(time.RFC3339))
+	if manifest.MachineID != "" {
+		fmt.Printf("Machine ID: %s\n", manifest.MachineID)
+	}
+	if manifest.File(ARCHIVE_STATE_DB) != nil {
+		printRestoredIdentities()
+	}
+	fmt.Println("Start the agent to resume as the same instance; renewals pick up where they left off.")
+}
+
+func restoreCipher(identityFile, key string) (backup.Cipher, error) {
+	switch {
+	case identityFile != "" && key != "":
+		return nil, fmt.Errorf("use either --identity or --key, not both")
+	case identityFile != "":
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		identities, err := backup.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", identityFile, err)
+		}
+		return backup.NewAge(nil, identities)
+	case key != "":
+		// No configuration to take provider options from yet
+		var resolver *secrets.Resolver
+		value, err := resolver.Resolve(context.Background(), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve key: %w", err)
+		}
+		parsed, err := backup.ParseKey(value)
+		if err != nil {
+			return nil, err
+		}
+		return backup.NewAES(parsed)
+	}
+	return nil, fmt.Errorf("pass --identity with the age identity file, or --key with the AES key the archive was made with")
+}
+
+// archiveDestination is where a file of the archive goes on this host,
+// empty for names it doesn't know
+func archiveDestination(name string) string {
+	switch name {
+	case ARCHIVE_CONFIG:
+		return CONFIG_FILE
+	case ARCHIVE_MACHINE_ID:
+		return machineidentifier.MACHINE_ID_FILE
+	case ARCHIVE_STATE_DB:
+		return STATE_DB
+	}
+	if base, ok := strings.CutPrefix(name, ARCHIVE_STATE_DIR); ok && base == filepath.Base(base) {
+		for _, pattern := range archivedStateFiles {
+			if matched, _ := filepath.Match(pattern, base); matched {
+				return filepath.Join(STATE_DIR, base)
+			}
+		}
+	}
+	return ""
+}
+
+// placeRestored writes a file beside its destination and renames it into
+// place, keeping what was there
+func placeRestored(path string, f *backup.ArchiveFile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, f.Data, f.Mode.Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+RESTORE_BACKUP_SUFFIX); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to keep the current %s: %w", path, err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	return nil
+}
+
+// printRestoredIdentities opens the restored database, which also proves
+// it intact, and lists the instances it was registered as
+func printRestoredIdentities() {
+	db, err := store.Open(STATE_DB)
+	if err != nil {
+		fmt.Printf("[WARNING] The restored state database does not open: %v\n", err)
+		return
+	}
+	defer db.Close()
+	db.ForEach(store.BUCKET_IDENTITY, func(key string, data []byte) error {
+		var identity storedIdentity
+		if json.Unmarshal(data, &identity) == nil {
+			fmt.Printf("Instance: %s (registered %s with %s)\n", identity.InstanceID, identity.RegisteredAt.Format(time.RFC3339), identity.Endpoint)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/acme"
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+// Written after every renewal pass for 'certfix-agent status', since the
+// state database stays locked while the agent runs
+var RENEWAL_STATUS_FILE = filepath.Join(STATE_DIR, "renewals.json")
+
+type renewalStatus struct {
+	UpdatedAt    time.Time           `json:"updated_at"`
+	Staging      bool                `json:"staging,omitempty"`
+	Certificates []certificateStatus `json:"certificates"`
+}
+
+type certificateStatus struct {
+	renewalRecord
+	// What is left of each rate limit the next order would count against
+	Budget []acme.Usage      `json:"budget,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func writeRenewalStatus(config *Config) {
+	status := renewalStatus{UpdatedAt: time.Now().UTC(), Staging: acmeStaging, Certificates: []certificateStatus{}}
+	for i := range config.ACME.Certificates {
+		managed := &config.ACME.Certificates[i]
+		var entry certificateStatus
+		if err := stateDB.Get(store.BUCKET_RENEWALS, renewalKey(managed.Name), &entry.renewalRecord); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[WARNING] Failed to read renewal state of %s: %v", managed.Name, err)
+		}
+		entry.Name, entry.Domains, entry.Labels = managed.Name, managed.Domains, managed.Labels
+		if cas, err := managedCAs(config, managed); err == nil {
+			for _, ca := range cas {
+				entry.Budget = append(entry.Budget, acmeBudget.Status(ca.Directory, ca.Profile.Limits(ca.Directory), managed.Domains)...)
+			}
+		}
+		status.Certificates = append(status.Certificates, entry)
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		log.Printf("[WARNING] Failed to encode renewal status: %v", err)
+		return
+	}
+	if err := filetransfer.WriteFileAtomic(renewalStatusFile(config), data, filetransfer.PUBLIC_FILE_MODE); err != nil {
+		log.Printf("[WARNING] Failed to write renewal status: %v", err)
+	}
+}
+
+// Each tenant's renewals are written to a file of their own
+func renewalStatusFile(config *Config) string {
+	return strings.TrimSuffix(RENEWAL_STATUS_FILE, ".json") + tenantSuffix(config) + ".json"
+}
+
+func handleStatus() {
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	tenant := statusCmd.String("tenant", "", "Show the renewals of this tenant instead of the host's")
+	statusCmd.Parse(os.Args[2:])
+	if *tenant != "" && !tenantNamePattern.MatchString(*tenant) {
+		fmt.Printf("[ERROR] Invalid tenant name %q\n", *tenant)
+		os.Exit(1)
+	}
+
+	statusFile := renewalStatusFile(&Config{tenant: *tenant})
+	data, err := os.ReadFile(statusFile)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("[INFO] No renewal status yet: the agent writes it once it manages ACME certificates")
+		os.Exit(1)
+	}
+	var status renewalStatus
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to read %s: %v\n", statusFile, err)
+		os.Exit(1)
+	}
+
+	mode := ""
+	if status.Staging {
+		mode = " [staging]"
+	}
+	fmt.Printf("Managed Certificates%s (as of %s)\n", mode, status.UpdatedAt.Local().Format(time.RFC3339))
+	fmt.Println("─────────────────────────────────────────────────")
+	for _, cert := range status.Certificates {
+		fmt.Printf("%s: %s\n", cert.Name, strings.Join(cert.Domains, ", "))
+		if len(cert.Labels) > 0 {
+			fmt.Printf("  Labels:       %s\n", formatLabels(cert.Labels))
+		}
+		if cert.NotAfter.IsZero() {
+			fmt.Println("  Expires:      not issued yet")
+		} else {
+			fmt.Printf("  Expires:      %s (%s)\n", cert.NotAfter.Local().Format(time.RFC3339), describeIssuer(&cert.renewalRecord))
+		}
+		if !cert.KeyCreatedAt.IsZero() {
+			fmt.Printf("  Key created:  %s\n", cert.KeyCreatedAt.Local().Format(time.RFC3339))
+		}
+		if cert.AwaitingWindow {
+			fmt.Printf("  Deploys at:   %s (maintenance window)\n", cert.NextAttempt.Local().Format(time.RFC3339))
+		} else if !cert.NextAttempt.IsZero() {
+			fmt.Printf("  Next attempt: %s\n", cert.NextAttempt.Local().Format(time.RFC3339))
+		}
+		if cert.LastError != "" {
+			fmt.Printf("  Last error:   %s\n", cert.LastError)
+		}
+		ids := make([]string, 0, len(cert.Destinations))
+		for id := range cert.Destinations {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Printf("  Deploy:       %s\n", describeDestination(id, cert.Destinations[id], cert.Fingerprint))
+		}
+		if cert.Rotation != nil {
+			fmt.Printf("  Rotation:     %s\n", describeRotation(cert.Rotation))
+		}
+		if cert.TLSA != nil {
+			fmt.Printf("  TLSA:         %s\n", describeTLSA(cert.TLSA))
+		}
+		for _, usage := range cert.Budget {
+			fmt.Printf("  Rate limit:   %s\n", describeUsage(&usage))
+		}
+	}
+	fmt.Println("─────────────────────────────────────────────────")
+}
+
+func describeIssuer(record *renewalRecord) string {
+	if record.Profile == "" {
+		return record.Directory
+	}
+	return fmt.Sprintf("profile %s, %s", record.Profile, record.Directory)
+}
+
+func describeTLSA(status *tlsaStatus) string {
+	switch {
+	case status.Error != "":
+		return fmt.Sprintf("%d records, failed: %s", len(status.Records), status.Error)
+	case status.PublishedAt.IsZero():
+		return fmt.Sprintf("%d records, not published", len(status.Records))
+	}
+	return fmt.Sprintf("%d records published at %s", len(status.Records), status.PublishedAt.Local().Format(time.RFC3339))
+}
+
+func describeRotation(status *rotationStatus) string {
+	switch {
+	case status.StartedAt.IsZero():
+		return "waiting for the new certificate to be deployed"
+	case !status.CompletedAt.IsZero():
+		return fmt.Sprintf("complete at %s", status.CompletedAt.Local().Format(time.RFC3339))
+	}
+	line := fmt.Sprintf("previous certificate kept until %s", status.OverlapUntil.Local().Format(time.RFC3339))
+	previous, sampled, failed := status.seen()
+	if sampled > 0 {
+		line += fmt.Sprintf(", %d of %d samples still get it", previous, sampled)
+	}
+	if failed > 0 {
+		line += fmt.Sprintf(", %d samples failed", failed)
+	}
+	if status.Overdue {
+		line += " (overdue)"
+	}
+	return line
+}
+
+func describeDestination(id string, d *destinationStatus, fingerprint string) string {
+	switch {
+	case d.Error != "":
+		return fmt.Sprintf("%s failed: %s", id, d.Error)
+	case d.Fingerprint == fingerprint:
+		return fmt.Sprintf("%s current (since %s)", id, d.DeployedAt.Local().Format(time.RFC3339))
+	case d.Fingerprint != "":
+		return fmt.Sprintf("%s has the previous certificate", id)
+	}
+	return fmt.Sprintf("%s pending", id)
+}
+
+func describeUsage(u *acme.Usage) string {
+	if u.Limit == acme.LIMIT_SERVER {
+		return fmt.Sprintf("CA asked to wait for %s until %s", u.Key, u.ResetsAt.Local().Format(time.RFC3339))
+	}
+	if u.Max == 0 {
+		return fmt.Sprintf("%s %s: %d used", u.Limit, u.Key, u.Used)
+	}
+	line := fmt.Sprintf("%s %s: %d of %d left", u.Limit, u.Key, u.Remaining(), u.Max)
+	if !u.ResetsAt.IsZero() {
+		line += fmt.Sprintf(" (one more from %s)", u.ResetsAt.Local().Format(time.RFC3339))
+	}
+	return line
+}
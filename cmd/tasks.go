@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/breaker"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/probe"
+	"github.com/certfix/certfix-agent/pkg/replay"
+	"github.com/certfix/certfix-agent/pkg/scripts"
+	"github.com/certfix/certfix-agent/pkg/service"
+	"github.com/certfix/certfix-agent/pkg/signing"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+	"github.com/certfix/certfix-agent/pkg/verify"
+)
+
+const (
+	TASK_POLL_INTERVAL  = 1 * time.Minute
+	DEFAULT_SCRIPT_USER = "nobody"
+	// Results that could not be delivered are kept up to this many
+	MAX_PENDING_RESULTS = 100
+)
+
+var (
+	AUDIT_LOG = filepath.Join(STATE_DIR, "audit.log")
+	// Superseded by the state database; imported once on upgrade
+	KEY_MANIFEST_FILE = filepath.Join(STATE_DIR, "signing-keys.json")
+	TASK_NONCE_FILE   = filepath.Join(STATE_DIR, "task-nonces.json")
+)
+
+// Build the registry of task types this agent accepts from the server.
+// Commands must be signed by a key the compiled-in root vouches for;
+// verifyTask is nil when no root key is built in.
+func newTaskRegistry(config *Config, verifyTask tasks.Verifier) *tasks.Registry {
+	registry, deployer := buildTaskRegistry(config, verifyTask)
+	localDeployer = deployer
+	// Maintenance freezes the whole host, so only its own server sets it
+	registry.Register(TASK_MAINTENANCE, handleMaintenance)
+	// Likewise the trust store, which every tenant's software shares
+	registerTrustStore(config, registry)
+	return registry
+}
+
+// buildTaskRegistry sets up the task handlers for one configuration and
+// returns its deployer, which ACME renewals share
+func buildTaskRegistry(config *Config, verifyTask tasks.Verifier) (*tasks.Registry, *deploy.Service) {
+	registry := tasks.NewRegistry()
+	auditLog := audit.NewLogger(AUDIT_LOG)
+
+	if verifyTask != nil {
+		registry.SetVerifier(verifyTask)
+	}
+
+	manager := service.Detect()
+	filetransfer.NewService(config.CertPaths, auditLog).Register(registry)
+	service.NewTaskHandler(manager, config.ServiceAllowlist, auditLog).Register(registry)
+	deployer := deploy.NewService(deploy.Env{
+		Roots:      config.CertPaths,
+		Manager:    manager,
+		Allowlist:  config.ServiceAllowlist,
+		Validators: config.ServiceValidators,
+		Secrets:    secretResolver(config),
+	}, auditLog)
+	registerPluginTargets(deployer)
+	deployer.AddHook(maintenanceHold{})
+	deployer.AddHook(chainCompleter{})
+	// Recorded before policy hooks run, since the files are written by then
+	deployer.AddHook(deploymentRecorder{tenant: config.tenant})
+	if certBackup != nil {
+		deployer.AddHook(backupRecorder{tenant: config.tenant})
+	}
+	if config.Stapling != nil {
+		deployer.AddHook(staplingRefresher{})
+	}
+	deployer.OnDeployed(receiptIssuer(config))
+	addDeployHooks(deployer, config)
+	checker := verify.NewTaskHandler(externalTLSCheck(config))
+	// Last, so only deployments every policy hook accepted are checked
+	if config.Verify != nil && len(config.Verify.Targets) > 0 {
+		deployer.AddHook(deployVerifier{config: config.Verify, checker: checker})
+	}
+	deployer.Register(registry)
+	dns01.NewService(config.DNSProviders, auditLog).Register(registry)
+	checker.Register(registry)
+	probe.Register(registry)
+
+	// Remote scripts are only accepted when signing keys are configured
+	if len(config.ScriptPublicKeys) > 0 {
+		runAs := config.ScriptUser
+		if runAs == "" {
+			runAs = DEFAULT_SCRIPT_USER
+		}
+		runner, err := scripts.NewRunner(config.ScriptPublicKeys, runAs, filepath.Join(STATE_DIR, "scripts"), auditLog)
+		if err != nil {
+			log.Printf("[WARNING] Remote scripts disabled: %v", err)
+		} else {
+			runner.Register(registry)
+		}
+	}
+
+	return registry, deployer
+}
+
+// Build the task check: stale or replayed tasks are always refused, and
+// signatures are enforced when the build carries a root key
+func newTaskVerifier(config *Config) tasks.Verifier {
+	// Task timestamps are server time, so compare against the corrected clock
+	guard := replay.NewGuard(stateDB.Blob(STATE_TASK_NONCES), replay.DEFAULT_WINDOW, clockTracker.ServerNow)
+
+	root, err := signing.RootKey()
+	// The simulator signs with its own throwaway root
+	if simulation != nil {
+		root, err = simulation.RootKey(), nil
+	}
+	if err != nil {
+		log.Printf("[WARNING] Task signatures are not enforced: %v", err)
+		return func(task *tasks.Task) error {
+			return guard.Check(task.Nonce, task.CreatedAt)
+		}
+	}
+
+	verifier := signing.NewVerifier(root, stateDB.Blob(STATE_KEY_MANIFEST))
+	refresh := func() {
+		data, err := apiClient(config).KeyManifest(context.Background())
+		if err != nil {
+			log.Printf("[WARNING] Failed to fetch signing key manifest: %v", err)
+			return
+		}
+		if err := verifier.ApplyManifest(data); err != nil {
+			log.Printf("[ERROR] Rejected signing key manifest: %v", err)
+		}
+	}
+	refresh()
+
+	return func(task *tasks.Task) error {
+		if task.Signature == "" || task.KeyID == "" {
+			return errors.New("task is not signed")
+		}
+		// The key may have been rotated in since the last fetch
+		if !verifier.HasKey(task.KeyID) {
+			refresh()
+		}
+		if err := verifier.Verify(task.KeyID, tasks.SignedMessage(task), task.Signature); err != nil {
+			return err
+		}
+		// Only a verified task may consume its nonce
+		return guard.Check(task.Nonce, task.CreatedAt)
+	}
+}
+
+// Ask the API's external checker which certificate a target serves
+func externalTLSCheck(config *Config) verify.ExternalChecker {
+	return apiClient(config).CheckTLS
+}
+
+// Fetch, execute and report all pending tasks
+func processTasks(config *Config, instanceID string, registry *tasks.Registry) {
+	if !flushPendingResults(config, instanceID) {
+		return
+	}
+
+	var pending []tasks.Task
+	err := callAPI(func() error {
+		var err error
+		pending, err = apiClient(config).FetchTasks(context.Background(), instanceID)
+		return err
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		log.Printf("[WARNING] Task poll skipped: %v", err)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch tasks: %v", err)
+		return
+	}
+
+	for i := range pending {
+		task := &pending[i]
+		log.Printf("[INFO] Running task %s (%s)", task.ID, task.Type)
+
+		result := registry.Execute(context.Background(), task)
+		if result.Error != "" {
+			log.Printf("[WARNING] Task %s %s: %s", task.ID, result.Status, result.Error)
+		} else {
+			log.Printf("[INFO] Task %s %s", task.ID, result.Status)
+		}
+		recordTask(instanceID, result)
+
+		if err := callAPI(func() error { return apiClient(config).ReportTaskResult(context.Background(), instanceID, result) }); err != nil {
+			log.Printf("[ERROR] Failed to report result of task %s, will retry: %v", task.ID, err)
+			queueResult(instanceID, result)
+		}
+	}
+}
+
+// Keep an undelivered result, dropping the oldest once the backlog is full.
+// The spool is on disk, so results outlive a restart during an outage.
+func queueResult(instanceID string, result *tasks.Result) {
+	dropped, err := resultSpool(instanceID).Push(result)
+	if err != nil {
+		log.Printf("[ERROR] Failed to spool result of task %s: %v", result.TaskID, err)
+		return
+	}
+	if dropped > 0 {
+		log.Printf("[WARNING] Result backlog full, dropped %d oldest results", dropped)
+	}
+}
+
+// Deliver queued results in order; reports whether the backlog is empty
+func flushPendingResults(config *Config, instanceID string) bool {
+	spool := resultSpool(instanceID)
+	for {
+		var result tasks.Result
+		found, err := spool.Peek(&result)
+		if err != nil {
+			// An unreadable entry would block the spool forever
+			log.Printf("[ERROR] Discarding unreadable spooled result: %v", err)
+			if err := spool.Pop(); err != nil {
+				return false
+			}
+			continue
+		}
+		if !found {
+			return true
+		}
+		if err := callAPI(func() error { return apiClient(config).ReportTaskResult(context.Background(), instanceID, &result) }); err != nil {
+			log.Printf("[WARNING] %d task results still pending: %v", spool.Len(), err)
+			return false
+		}
+		if err := spool.Pop(); err != nil {
+			log.Printf("[ERROR] Failed to remove delivered result of task %s: %v", result.TaskID, err)
+			return false
+		}
+		log.Printf("[INFO] Delivered queued result of task %s", result.TaskID)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/client"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/redact"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+// An organization this host serves besides its own, as for an MSP hosting
+// several customers. Each tenant registers as its own instance with its
+// own token and only sees what is under its CertPaths: its inventory is
+// scanned there, its tasks deploy only there, and its ACME certificates
+// are issued with its own profiles and accounts.
+type TenantConfig struct {
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// Kept out of the host's own inventory and every other tenant's
+	CertPaths        []string                   `json:"cert_paths"`
+	ServiceAllowlist []string                   `json:"service_allowlist,omitempty"`
+	DNSProviders     map[string]json.RawMessage `json:"dns_providers,omitempty"`
+	Secrets          map[string]json.RawMessage `json:"secrets,omitempty"`
+	ACME             *ACMEConfig                `json:"acme,omitempty"`
+}
+
+// Deployment records of tenants, which the host's drift checks leave alone
+const TENANT_DEPLOYMENT_PREFIX = "tenant:"
+
+// Tenant names appear in state keys and file names
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// A tenant and the instance it is registered as
+type tenantInstance struct {
+	config     *Config
+	registry   *tasks.Registry
+	instanceID string
+}
+
+var tenantInstances []*tenantInstance
+
+// Each tenant's ACME certificates renew through its own confined deployer
+var tenantDeployers = map[string]*deploy.Service{}
+
+// validateTenants keeps tenants apart: distinct names, paths that overlap
+// neither each other nor the host's own (whose tasks could otherwise write
+// into a tenant's files), and managed certificate names unique across the
+// host, since renewal state is kept by certificate name
+func validateTenants(config *Config) error {
+	names := map[string]bool{}
+	managed := map[string]string{}
+	claim := func(owner string, acme *ACMEConfig) error {
+		if acme == nil {
+			return nil
+		}
+		for _, cert := range acme.Certificates {
+			if other, ok := managed[cert.Name]; ok && other != owner {
+				return fmt.Errorf("ACME certificate %q is configured for both %s and %s", cert.Name, other, owner)
+			}
+			managed[cert.Name] = owner
+		}
+		return nil
+	}
+	if err := claim("this host", config.ACME); err != nil {
+		return err
+	}
+
+	type claimedPath struct{ path, owner string }
+	var paths []claimedPath
+	for _, path := range cleanPaths(config.CertPaths) {
+		paths = append(paths, claimedPath{path, "this host"})
+	}
+	for _, tenant := range config.Tenants {
+		if !tenantNamePattern.MatchString(tenant.Name) {
+			return fmt.Errorf("invalid tenant name %q: want lower case letters, digits and -", tenant.Name)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenant %s is configured twice", tenant.Name)
+		}
+		names[tenant.Name] = true
+		if tenant.Token == "" {
+			return fmt.Errorf("tenant %s has no token", tenant.Name)
+		}
+		if len(tenant.CertPaths) == 0 {
+			return fmt.Errorf("tenant %s has no cert_paths", tenant.Name)
+		}
+		for _, path := range tenant.CertPaths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("cert path %q of tenant %s is not absolute", path, tenant.Name)
+			}
+			path = filepath.Clean(path)
+			for _, other := range paths {
+				if withinPath(path, other.path) || withinPath(other.path, path) {
+					return fmt.Errorf("cert path %s of tenant %s overlaps %s of %s", path, tenant.Name, other.path, other.owner)
+				}
+			}
+		}
+		for _, path := range cleanPaths(tenant.CertPaths) {
+			paths = append(paths, claimedPath{path, "tenant " + tenant.Name})
+		}
+		if err := claim("tenant "+tenant.Name, tenant.ACME); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanPaths(paths []string) []string {
+	cleaned := make([]string, len(paths))
+	for i, path := range paths {
+		cleaned[i] = filepath.Clean(path)
+	}
+	return cleaned
+}
+
+// withinPath reports whether path is dir or below it
+func withinPath(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// tenantConfig derives the configuration a tenant runs with: its token and
+// paths, and none of the host's scripts, proxied hosts, secrets or DNS
+// credentials
+func tenantConfig(config *Config, tenant *TenantConfig) *Config {
+	c := *config
+	c.tenant = tenant.Name
+	c.Token = tenant.Token
+	if tenant.Endpoint != "" {
+		c.Endpoint = tenant.Endpoint
+	}
+	c.CertPaths = cleanPaths(tenant.CertPaths)
+	c.Scan = ScanConfig{Exclude: config.Scan.Exclude, Workers: config.Scan.Workers, FilesPerSecond: config.Scan.FilesPerSecond}
+	if len(tenant.ServiceAllowlist) > 0 {
+		c.ServiceAllowlist = tenant.ServiceAllowlist
+	}
+	c.DNSProviders = tenant.DNSProviders
+	c.Secrets = tenant.Secrets
+	c.ACME = tenant.ACME
+	c.ScriptPublicKeys = nil
+	c.ProxyHosts = nil
+	c.Kubernetes = nil
+	c.SDS = nil
+	c.Drift = nil
+	c.Tenants = nil
+	return &c
+}
+
+// Set up a task registry and deployer for each tenant
+func setupTenants(config *Config, verifyTask tasks.Verifier) {
+	for i := range config.Tenants {
+		tc := tenantConfig(config, &config.Tenants[i])
+		registry, deployer := buildTaskRegistry(tc, verifyTask)
+		tenantDeployers[tc.tenant] = deployer
+		tenantInstances = append(tenantInstances, &tenantInstance{config: tc, registry: registry})
+		log.Printf("[INFO] Serving tenant %s (%s)", tc.tenant, strings.Join(tc.CertPaths, ", "))
+	}
+}
+
+// Register tenants that aren't yet, each with its own token; the ones the
+// API refuses are retried on the next heartbeat
+func registerTenants(host *client.InstanceData) {
+	for _, t := range tenantInstances {
+		if t.instanceID != "" {
+			continue
+		}
+		// Stable per host and tenant, so re-registration finds the same instance
+		sum := sha256.Sum256([]byte("tenant\n" + host.MachineID + "\n" + t.config.tenant))
+		data := *host
+		data.MachineID = hex.EncodeToString(sum[:])
+		data.Metadata = map[string]interface{}{}
+		for key, value := range host.Metadata {
+			data.Metadata[key] = value
+		}
+		data.Metadata["tenant"] = t.config.tenant
+		data.Metadata["task_types"] = t.registry.Types()
+
+		var resp *client.RegisterResponse
+		err := callAPI(func() error {
+			var err error
+			resp, err = register(t.config, &data)
+			return err
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to register tenant %s: %v", t.config.tenant, err)
+			continue
+		}
+		t.instanceID = resp.InstanceID
+		log.Printf("[SUCCESS] Tenant %s registered as instance %s", t.config.tenant, resp.InstanceID)
+		recordIdentity(t.config, resp.InstanceID, data.MachineID)
+	}
+}
+
+func tenantHeartbeats(host *client.InstanceData) {
+	registerTenants(host)
+	for _, t := range tenantInstances {
+		if t.instanceID == "" {
+			continue
+		}
+		if err := callAPI(func() error {
+			return apiClient(t.config).Heartbeat(context.Background(), t.instanceID, collectHeartbeatData())
+		}); instanceGone(err) {
+			// Registered again at the next heartbeat
+			log.Printf("[WARNING] The server no longer knows tenant %s as instance %s", t.config.tenant, t.instanceID)
+			t.instanceID = ""
+		} else if err != nil {
+			log.Printf("[ERROR] Heartbeat for tenant %s failed: %v", t.config.tenant, err)
+		}
+	}
+}
+
+func tenantInventories() {
+	for _, t := range tenantInstances {
+		if t.instanceID != "" {
+			reportInventory(t.config, t.instanceID)
+		}
+	}
+}
+
+func tenantTasks() {
+	for _, t := range tenantInstances {
+		if t.instanceID != "" {
+			processTasks(t.config, t.instanceID, t.registry)
+			flushReceipts(t.config, t.instanceID)
+		}
+	}
+}
+
+func tenantRenewals() {
+	for _, t := range tenantInstances {
+		startRenewals(t.config)
+	}
+}
+
+// deployerFor is the deployer a configuration's ACME certificates use
+func deployerFor(config *Config) *deploy.Service {
+	if config.tenant != "" {
+		return tenantDeployers[config.tenant]
+	}
+	return localDeployer
+}
+
+// tenantPaths lists every tenant's cert paths
+func tenantPaths(config *Config) []string {
+	var paths []string
+	for _, tenant := range config.Tenants {
+		paths = append(paths, cleanPaths(tenant.CertPaths)...)
+	}
+	return paths
+}
+
+// withoutTenantFiles drops certificates found under a tenant's paths from
+// the host's own inventory, including ones its web servers point at
+func withoutTenantFiles(config *Config, report *inventory.Report) {
+	paths := tenantPaths(config)
+	if len(paths) == 0 {
+		return
+	}
+	report.Certificates = slices.DeleteFunc(report.Certificates, func(cert inventory.Certificate) bool {
+		if cert.Path == "" {
+			return false
+		}
+		for _, dir := range paths {
+			if withinPath(filepath.Clean(cert.Path), dir) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// redactTenantTokens keeps every tenant's token out of the logs
+func redactTenantTokens(config *Config) {
+	for _, tenant := range config.Tenants {
+		redact.AddSecret(tenant.Token)
+	}
+}
+
+// tenantSuffix tells a tenant's files and queues apart from the host's
+func tenantSuffix(config *Config) string {
+	if config.tenant == "" {
+		return ""
+	}
+	return "-" + config.tenant
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/certfix/certfix-agent/pkg/tlsobserve"
+)
+
+// TLSObserverConfig counts the certificates the host's servers present in
+// handshakes, with an eBPF socket filter (Linux, CAP_BPF and CAP_NET_RAW)
+type TLSObserverConfig struct {
+	// Ports to watch; implicit TLS ports by default
+	Ports []int `json:"ports,omitempty"`
+}
+
+// Running observer, reported with every inventory; nil when off
+var tlsObserver *tlsobserve.Observer
+
+func startTLSObserver(config *TLSObserverConfig) {
+	observer := tlsobserve.New(config.Ports)
+	if err := observer.Start(context.Background()); err != nil {
+		if errors.Is(err, tlsobserve.ErrUnsupported) {
+			log.Printf("[WARNING] TLS observer requested but not supported by this kernel, continuing without it")
+		} else {
+			log.Printf("[ERROR] Failed to start TLS observer: %v", err)
+		}
+		return
+	}
+	tlsObserver = observer
+	log.Printf("[INFO] TLS observer watching handshakes on ports %v", observer.Report().Ports)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"github.com/certfix/certfix-agent/pkg/control"
+	"github.com/certfix/certfix-agent/pkg/dashboard"
+	"github.com/certfix/certfix-agent/pkg/events"
+)
+
+const (
+	TOP_INTERVAL = 2 * time.Second
+	// Events kept for the screen, newest first
+	TOP_EVENTS = 200
+	// Used when the terminal size is unknown
+	TOP_WIDTH = 100
+
+	ANSI_RESET  = "\x1b[0m"
+	ANSI_BOLD   = "\x1b[1m"
+	ANSI_RED    = "\x1b[31m"
+	ANSI_YELLOW = "\x1b[33m"
+	ANSI_GREEN  = "\x1b[32m"
+	ANSI_DIM    = "\x1b[2m"
+)
+
+// One screen line, colored as a whole so it can be cut to the width
+type topLine struct {
+	text  string
+	color string
+}
+
+// Live view of a running agent through its control socket
+func handleTop() {
+	topCmd := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := topCmd.Duration("interval", TOP_INTERVAL, "How often the status is refreshed")
+	once := topCmd.Bool("once", false, "Print the status once and exit")
+	topCmd.Parse(os.Args[2:])
+
+	agent := control.NewClient(CONTROL_SOCKET)
+	var snapshot dashboard.Snapshot
+	if err := agent.Get(context.Background(), "/status", &snapshot); err != nil {
+		if errors.Is(err, control.ErrNotRunning) {
+			fmt.Printf("[ERROR] Cannot reach the agent at %s: %v\n", CONTROL_SOCKET, err)
+		} else {
+			fmt.Printf("[ERROR] Failed to read the agent status: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	out := int(os.Stdout.Fd())
+	if *once || !term.IsTerminal(out) {
+		var recent []events.Event
+		if err := agent.Get(context.Background(), "/events/recent", &recent); err != nil {
+			fmt.Printf("[WARNING] Failed to read recent events: %v\n", err)
+		}
+		slices.Reverse(recent)
+		for _, line := range renderTop(&snapshot, recent, "", 0) {
+			fmt.Println(line.text)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Raw input lets 'q' quit without Enter; Ctrl-C then arrives as a key
+	in := int(os.Stdin.Fd())
+	if term.IsTerminal(in) {
+		if state, err := term.MakeRaw(in); err == nil {
+			defer term.Restore(in, state)
+			go func() {
+				key := make([]byte, 1)
+				for {
+					if n, err := os.Stdin.Read(key); err != nil || (n == 1 && (key[0] == 'q' || key[0] == 'Q' || key[0] == 3)) {
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+	}
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var (
+		mu       sync.Mutex
+		received []events.Event
+		problem  string
+	)
+	go func() {
+		for ctx.Err() == nil {
+			err := agent.StreamEvents(ctx, func(event events.Event) {
+				mu.Lock()
+				received = append([]events.Event{event}, received...)
+				if len(received) > TOP_EVENTS {
+					received = received[:TOP_EVENTS]
+				}
+				mu.Unlock()
+			})
+			if err != nil && ctx.Err() == nil {
+				time.Sleep(*interval)
+			}
+			// Reconnecting replays the recent events
+			mu.Lock()
+			received = nil
+			mu.Unlock()
+		}
+	}()
+
+	// The alternate screen leaves the shell's scrollback as it was
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		width, height, err := term.GetSize(out)
+		if err != nil || width <= 0 {
+			width, height = TOP_WIDTH, 0
+		}
+		mu.Lock()
+		lines := renderTop(&snapshot, received, problem, height)
+		mu.Unlock()
+		drawTop(lines, width)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var next dashboard.Snapshot
+		if err := agent.Get(ctx, "/status", &next); err != nil {
+			problem = fmt.Sprintf("agent unreachable: %v (showing the status as of %s)", err, snapshot.GeneratedAt.Local().Format(time.TimeOnly))
+		} else {
+			snapshot, problem = next, ""
+		}
+	}
+}
+
+func drawTop(lines []topLine, width int) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	for i, line := range lines {
+		if i > 0 {
+			// Raw mode doesn't return the carriage by itself
+			b.WriteString("\r\n")
+		}
+		text := line.text
+		if utf8.RuneCountInString(text) > width {
+			text = string([]rune(text)[:width])
+		}
+		if line.color != "" {
+			text = line.color + text + ANSI_RESET
+		}
+		b.WriteString(text)
+	}
+	os.Stdout.WriteString(b.String())
+}
+
+// renderTop lays out the screen; height limits the events listed, zero
+// lists them all
+func renderTop(snapshot *dashboard.Snapshot, received []events.Event, problem string, height int) []topLine {
+	now := time.Now()
+	var lines []topLine
+	add := func(color, format string, args ...interface{}) {
+		lines = append(lines, topLine{text: fmt.Sprintf(format, args...), color: color})
+	}
+
+	agent := snapshot.Agent
+	add(ANSI_BOLD, "certfix-agent top — %s — v%s — up %s — %s   (q to quit)",
+		agent.Hostname, agent.Version, now.Sub(agent.StartedAt).Round(time.Second), now.Format(time.TimeOnly))
+	if problem != "" {
+		add(ANSI_RED, "%s", problem)
+	}
+	contact := "never"
+	if !agent.LastAPIContact.IsZero() {
+		contact = fmt.Sprintf("%s ago (%s)", now.Sub(agent.LastAPIContact).Round(time.Second), agent.LastAPIContact.Local().Format(time.TimeOnly))
+	}
+	add("", "Last API contact: %s   Endpoint: %s", contact, agent.Endpoint)
+	health := make([]string, 0, len(snapshot.Health))
+	worst := ""
+	for _, check := range snapshot.Health {
+		health = append(health, check.Name+" "+check.Status)
+		worst = worseStatus(worst, check.Status)
+	}
+	add(statusColor(worst), "Health: %s", strings.Join(health, " · "))
+
+	certs := append([]dashboard.Certificate{}, snapshot.Certificates...)
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter) })
+	add("", "")
+	add(ANSI_BOLD, "%-24s %-17s %-10s %s", fmt.Sprintf("CERTIFICATES (%d)", len(certs)), "EXPIRES", "LEFT", "STATUS")
+	for _, cert := range certs {
+		expires, left := "—", "not issued"
+		if !cert.NotAfter.IsZero() {
+			expires = cert.NotAfter.Local().Format("2006-01-02 15:04")
+			left = describeLeft(cert.NotAfter.Sub(now))
+		}
+		status := cert.Status
+		if cert.Detail != "" {
+			status += ": " + cert.Detail
+		}
+		add(statusColor(cert.Status), "%-24s %-17s %-10s %s", cert.Name, expires, left, status)
+	}
+
+	add("", "")
+	add(ANSI_BOLD, "%-17s %-10s %-24s %s", "RENEWAL QUEUE", "IN", "CERTIFICATE", "ACTION")
+	for _, item := range renewalQueue(certs) {
+		add(item.color, "%-17s %-10s %-24s %s", item.at.Local().Format("2006-01-02 15:04"), describeLeft(item.at.Sub(now)), item.name, item.action)
+	}
+
+	add("", "")
+	add(ANSI_BOLD, "EVENTS")
+	if len(received) == 0 {
+		add(ANSI_DIM, "no events since the agent started")
+	}
+	for _, event := range received {
+		if height > 0 && len(lines) >= height {
+			break
+		}
+		add(severityColor(event.Severity), "%s %-8s %-20s %s", event.Time.Local().Format(time.DateTime), event.Severity, event.Type, event.Summary)
+	}
+	return lines
+}
+
+type queueItem struct {
+	at     time.Time
+	name   string
+	action string
+	color  string
+}
+
+// renewalQueue orders what the agent will do next for each certificate
+func renewalQueue(certs []dashboard.Certificate) []queueItem {
+	var queue []queueItem
+	for _, cert := range certs {
+		switch {
+		case cert.AwaitingWindow:
+			queue = append(queue, queueItem{cert.NextAttempt, cert.Name, "deploy in maintenance window", ANSI_YELLOW})
+		case !cert.NextAttempt.IsZero():
+			queue = append(queue, queueItem{cert.NextAttempt, cert.Name, "retry after failure", statusColor(cert.Status)})
+		case cert.NotAfter.IsZero():
+			queue = append(queue, queueItem{time.Now(), cert.Name, "issue", ""})
+		default:
+			queue = append(queue, queueItem{cert.RenewAt, cert.Name, "renew", ""})
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].at.Before(queue[j].at) })
+	return queue
+}
+
+func describeLeft(d time.Duration) string {
+	switch {
+	case d < 0:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+func worseStatus(a, b string) string {
+	rank := map[string]int{dashboard.CHECK_OK: 1, dashboard.CHECK_WARN: 2, dashboard.CHECK_FAIL: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func statusColor(status string) string {
+	switch status {
+	case dashboard.CHECK_FAIL:
+		return ANSI_RED
+	case dashboard.CHECK_WARN:
+		return ANSI_YELLOW
+	case dashboard.CHECK_OK:
+		return ANSI_GREEN
+	}
+	return ""
+}
+
+func severityColor(severity string) string {
+	switch severity {
+	case events.SEVERITY_CRITICAL:
+		return ANSI_RED
+	case events.SEVERITY_WARNING:
+		return ANSI_YELLOW
+	}
+	return ""
+}
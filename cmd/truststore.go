@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+	"github.com/certfix/certfix-agent/pkg/truststore"
+)
+
+const (
+	STATE_TRUSTSTORE = "truststore"
+)
+
+// The OS trust store is shared by everything on the host, so the server
+// may only change it when the operator opts in
+type TrustStoreConfig struct {
+	// Accept truststore.apply tasks installing and removing organization CAs
+	Manage bool `json:"manage,omitempty"`
+	// Report the CAs the OS trusts with the inventory, and optionally those
+	// of Java keystores and NSS databases found on the host
+	Inventory bool `json:"inventory,omitempty"`
+	Java      bool `json:"java,omitempty"`
+	NSS       bool `json:"nss,omitempty"`
+}
+
+// Set when trust store management is enabled
+var trustManager *truststore.Manager
+
+// registerTrustStore accepts trust store policy from the server when
+// enabled. Only the CAs the agent installed can be replaced or removed.
+func registerTrustStore(config *Config, registry *tasks.Registry) {
+	if config.TrustStore == nil || !config.TrustStore.Manage {
+		return
+	}
+	backend := truststore.Detect()
+	if backend == nil {
+		log.Printf("[WARNING] Trust store management disabled: no supported trust store found")
+		return
+	}
+	manager, err := truststore.NewManager(backend, stateDB.Blob(STATE_TRUSTSTORE))
+	if err != nil {
+		log.Printf("[WARNING] Trust store management disabled: %v", err)
+		return
+	}
+	trustManager = manager
+	truststore.NewTaskHandler(manager, audit.NewLogger(AUDIT_LOG)).Register(registry)
+	log.Printf("[INFO] Trust store management enabled (%s, %d CAs installed by the agent)", backend.Name(), len(manager.Installed()))
+}
+
+// trustStoreInventory enumerates the trusted CAs for the inventory report
+func trustStoreInventory(config *Config) []truststore.Store {
+	if config.TrustStore == nil || !config.TrustStore.Inventory {
+		return nil
+	}
+	opts := truststore.InventoryOptions{Java: config.TrustStore.Java, NSS: config.TrustStore.NSS}
+	if trustManager != nil {
+		opts.Managed = map[string]bool{}
+		for _, entry := range trustManager.Installed() {
+			opts.Managed[entry.SHA256] = true
+		}
+	}
+	stores := truststore.Enumerate(context.Background(), opts)
+	for _, store := range stores {
+		if store.Error != "" {
+			log.Printf("[WARNING] Trust store %s (%s): %s", store.Location, store.Kind, store.Error)
+		}
+	}
+	return stores
+}
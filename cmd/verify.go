@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/intermediates"
+	"github.com/certfix/certfix-agent/pkg/verify"
+)
+
+// Check after each deployment that the public endpoints serve the new
+// certificate
+type VerifyConfig struct {
+	// Endpoints to check, by certificate name
+	Targets map[string][]verify.Target `json:"targets,omitempty"`
+	// Repeat each check from the internet through the API's external checker
+	External bool `json:"external,omitempty"`
+	// CAs trusted besides the system roots, for certificates from an
+	// internal CA; also used by deploy.verify tasks and drift checks
+	RootCAFiles []string `json:"root_ca_files,omitempty"`
+}
+
+// setupVerification loads the extra roots served chains are checked
+// against, which also vouch for the intermediates worth caching
+func setupVerification(config *Config) error {
+	if config.Verify == nil || len(config.Verify.RootCAFiles) == 0 {
+		return nil
+	}
+	pool, err := verify.LoadRootCAs(config.Verify.RootCAFiles)
+	if err != nil {
+		return err
+	}
+	verify.SetRoots(pool)
+	intermediates.Default.SetRoots(pool)
+	return nil
+}
+
+// deployVerifier checks the configured endpoints of a certificate once it
+// is deployed and reports the outcome with the deployment. A failed check
+// doesn't fail the deployment, whose files are already in place.
+type deployVerifier struct {
+	config  *VerifyConfig
+	checker *verify.TaskHandler
+}
+
+func (deployVerifier) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	return nil
+}
+
+func (v deployVerifier) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	targets := v.config.Targets[bundle.Name]
+	if len(targets) == 0 {
+		return nil
+	}
+
+	report := v.checker.VerifyAll(ctx, bundle.Name, targets, bundle.Fingerprint(), v.config.External)
+	if result.Details == nil {
+		result.Details = map[string]string{}
+	}
+	result.Details["verification"] = report.Status
+
+	var failures []string
+	for _, check := range report.Results {
+		if check.Status != verify.STATUS_VERIFIED {
+			failures = append(failures, fmt.Sprintf("%s (%s): %s", check.Target.Address(), check.Checker, check.Error))
+		}
+	}
+	if len(failures) > 0 {
+		result.Details["verification_error"] = strings.Join(failures, "; ")
+		log.Printf("[WARNING] Deployment of %s not verified: %s", bundle.Name, result.Details["verification_error"])
+		return nil
+	}
+	log.Printf("[INFO] Deployment of %s verified on %d endpoints", bundle.Name, len(targets))
+	return nil
+}
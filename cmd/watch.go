@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/drift"
+	"github.com/certfix/certfix-agent/pkg/fswatch"
+	"github.com/certfix/certfix-agent/pkg/scanner"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+// Watch certificate directories and react to changes as they happen
+// instead of at the next scan
+type WatchConfig struct {
+	// Directories to watch; the scan paths by default
+	Paths           []string `json:"paths,omitempty"`
+	DebounceSeconds int      `json:"debounce_seconds,omitempty"`
+	// Put back deployed certificates that were replaced or deleted: the
+	// agent's own ACME certificates from its stored copy, the rest by
+	// asking the server
+	Redeploy bool `json:"redeploy,omitempty"`
+}
+
+// Private keys and keystores, which the scan doesn't inventory but
+// deployments write
+var keyExtensions = map[string]bool{
+	".key":      true,
+	".p12":      true,
+	".pfx":      true,
+	".jks":      true,
+	".keystore": true,
+}
+
+// startWatch watches the scan paths, every tenant's, and the directories
+// deployments wrote to; the channel is nil when watching is off
+func startWatch(config *Config) <-chan []string {
+	if config.Watch == nil {
+		return nil
+	}
+	roots := config.Watch.Paths
+	if len(roots) == 0 {
+		roots = scanOptions(config).Roots
+	}
+	roots = append(append([]string{}, roots...), tenantPaths(config)...)
+	var dirs []string
+	for path := range deployedFiles() {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+
+	exclude := config.Scan.Exclude
+	watcher, err := fswatch.New(fswatch.Options{
+		Roots:    roots,
+		Dirs:     dirs,
+		Skip:     func(path string) bool { return scanner.Excluded(path, exclude) },
+		Debounce: time.Duration(config.Watch.DebounceSeconds) * time.Second,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Watch mode disabled: %v", err)
+		return nil
+	}
+	log.Printf("[INFO] Watching %s for certificate changes", strings.Join(roots, ", "))
+	return watcher.Changes()
+}
+
+// deployedFiles lists the files the host's recorded deployments wrote
+func deployedFiles() map[string]bool {
+	files := map[string]bool{}
+	err := stateDB.ForEach(store.BUCKET_DEPLOYMENTS, func(key string, data []byte) error {
+		if strings.HasPrefix(key, TENANT_DEPLOYMENT_PREFIX) {
+			return nil
+		}
+		var exp drift.Expected
+		if json.Unmarshal(data, &exp) == nil {
+			for _, f := range exp.Files {
+				files[f.Path] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed to read deployment records: %v", err)
+	}
+	return files
+}
+
+// handleWatch re-inventories whoever owns the changed files and checks the
+// deployments that wrote any of them for drift
+func handleWatch(config *Config, instanceID string, paths []string) {
+	deployed := deployedFiles()
+	var changed []string
+	for _, path := range paths {
+		ext := strings.ToLower(filepath.Ext(path))
+		if deployed[path] || ext == "" || scanner.HasCertExtension(path) || keyExtensions[ext] {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	log.Printf("[INFO] Watch: %d certificate files changed (%s)", len(changed), describePaths(changed))
+
+	host := false
+	tenants := map[*tenantInstance]bool{}
+	for _, path := range changed {
+		owned := false
+		for _, t := range tenantInstances {
+			if pathsContain(t.config.CertPaths, path) {
+				owned = true
+				tenants[t] = true
+			}
+		}
+		host = host || !owned
+	}
+	if host {
+		forgetScan(config)
+		reportInventory(config, instanceID)
+	}
+	for _, t := range tenantInstances {
+		if tenants[t] && t.instanceID != "" {
+			forgetScan(t.config)
+			reportInventory(t.config, t.instanceID)
+		}
+	}
+
+	touched := map[string]bool{}
+	for _, path := range changed {
+		if deployed[path] {
+			touched[path] = true
+		}
+	}
+	if len(touched) == 0 || !driftEnabled(config) {
+		return
+	}
+	// The agent's own deployments write these files too; once one is done
+	// its record matches them again
+	if deployer := deployerFor(config); deployer != nil && deployer.Busy() {
+		return
+	}
+	remediate := config.Watch.Redeploy || (config.Drift != nil && config.Drift.AutoRemediate)
+	report := checkDriftOf(config, instanceID, touched, remediate)
+	if report != nil && config.Watch.Redeploy {
+		redeployDrifted(config, report.Findings)
+	}
+}
+
+// redeployDrifted deploys the stored copy of managed ACME certificates to
+// the targets where they drifted; the renewal policy's maintenance windows
+// still apply
+func redeployDrifted(config *Config, findings []drift.Finding) {
+	if config.ACME == nil || acmeStaging {
+		return
+	}
+	targets := map[string]map[string]bool{}
+	for _, f := range findings {
+		if targets[f.Name] == nil {
+			targets[f.Name] = map[string]bool{}
+		}
+		targets[f.Name][f.Target] = true
+	}
+	for i := range config.ACME.Certificates {
+		managed := &config.ACME.Certificates[i]
+		if targets[managed.Name] == nil {
+			continue
+		}
+		if !markForRedeploy(managed, targets[managed.Name]) {
+			continue
+		}
+		log.Printf("[INFO] Redeploying %s after it changed on disk", managed.Name)
+		renewCertificate(config, managed)
+	}
+}
+
+// markForRedeploy sets the certificate's destinations of the given target
+// types as not yet deployed
+func markForRedeploy(managed *ManagedCertificate, targets map[string]bool) bool {
+	renewalMu.Lock()
+	defer renewalMu.Unlock()
+	key := renewalKey(managed.Name)
+	var record renewalRecord
+	if err := stateDB.Get(store.BUCKET_RENEWALS, key, &record); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[WARNING] Failed to read renewal state of %s: %v", managed.Name, err)
+		}
+		return false
+	}
+	marked := false
+	for _, status := range record.Destinations {
+		if targets[status.Target] {
+			status.Fingerprint = ""
+			marked = true
+		}
+	}
+	if !marked {
+		return false
+	}
+	record.Deployed = false
+	if err := stateDB.Put(store.BUCKET_RENEWALS, key, record); err != nil {
+		log.Printf("[WARNING] Failed to store renewal state of %s: %v", managed.Name, err)
+		return false
+	}
+	return true
+}
+
+func pathsContain(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if withinPath(filepath.Clean(path), dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// describePaths names the first few paths of a batch
+func describePaths(paths []string) string {
+	const shown = 3
+	if len(paths) <= shown {
+		return strings.Join(paths, ", ")
+	}
+	return strings.Join(paths[:shown], ", ") + ", ..."
+}
@@ -0,0 +1,500 @@
+// Package acme issues certificates straight from an ACME CA (RFC 8555) for
+// the certificates this host manages itself. A Profile names the CA and how
+// to prove control of the names: HTTP-01 through a webroot or a standalone
+// listener, or DNS-01 through the dns01 providers.
+//
+// Every profile also has a staging directory, so renewals can be rehearsed
+// without spending the production CA's rate limits.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	LETSENCRYPT_DIRECTORY         = "https://acme-v02.api.letsencrypt.org/directory"
+	LETSENCRYPT_STAGING_DIRECTORY = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	CHALLENGE_HTTP01 = "http-01"
+	CHALLENGE_DNS01  = "dns-01"
+
+	// Whole orders, including validation, must finish within this
+	ORDER_TIMEOUT   = 10 * time.Minute
+	REQUEST_TIMEOUT = 30 * time.Second
+
+	PROPAGATION_TIMEOUT = 5 * time.Minute
+
+	USER_AGENT = "certfix-agent"
+)
+
+// Profile describes a CA and how to validate with it
+type Profile struct {
+	// Directory defaults to Let's Encrypt
+	Directory string `json:"directory,omitempty"`
+	// StagingDirectory is used in staging mode; staging is implied for Let's
+	// Encrypt and Google Trust Services
+	StagingDirectory string `json:"staging_directory,omitempty"`
+	// RootCAFile trusts a private CA's directory over TLS (test CAs)
+	RootCAFile string `json:"root_ca_file,omitempty"`
+	Email      string `json:"email,omitempty"`
+	// Challenge is http-01 (default) or dns-01
+	Challenge string `json:"challenge,omitempty"`
+	// HTTP-01: write tokens below Webroot, or serve them on HTTPListen
+	Webroot    string `json:"webroot,omitempty"`
+	HTTPListen string `json:"http_listen,omitempty"`
+	// DNS-01: a provider name from dns_providers
+	DNSProvider string `json:"dns_provider,omitempty"`
+	KeyType     string `json:"key_type,omitempty"`
+	// RateLimits overrides the limits budgeted locally
+	RateLimits *Limits `json:"rate_limits,omitempty"`
+	// CSR adds extensions beyond the names to every request
+	CSR *CSROptions `json:"csr,omitempty"`
+	// EAB is required by some CAs (ZeroSSL, Sectigo, Google Trust Services);
+	// StagingEAB is for staging directories with their own credentials
+	EAB        *ExternalAccountBinding `json:"external_account_binding,omitempty"`
+	StagingEAB *ExternalAccountBinding `json:"staging_external_account_binding,omitempty"`
+	// CAAIdentities are the issuer domains checked against CAA records
+	// before ordering; SkipCAACheck turns the check off
+	CAAIdentities []string `json:"caa_identities,omitempty"`
+	SkipCAACheck  bool     `json:"skip_caa_check,omitempty"`
+}
+
+// Validate checks the profile is usable
+func (p *Profile) Validate() error {
+	switch p.Challenge {
+	case "", CHALLENGE_HTTP01:
+		if p.Webroot != "" && p.HTTPListen != "" {
+			return fmt.Errorf("webroot and http_listen are mutually exclusive")
+		}
+	case CHALLENGE_DNS01:
+		if p.DNSProvider == "" {
+			return fmt.Errorf("dns-01 requires dns_provider")
+		}
+	default:
+		return fmt.Errorf("unknown challenge %q (available: %s, %s)", p.Challenge, CHALLENGE_HTTP01, CHALLENGE_DNS01)
+	}
+	if p.CSR != nil {
+		if err := p.CSR.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, eab := range []*ExternalAccountBinding{p.EAB, p.StagingEAB} {
+		if eab == nil {
+			continue
+		}
+		if err := eab.Validate(); err != nil {
+			return err
+		}
+	}
+	return CheckKeyType(p.KeyType)
+}
+
+// DirectoryURL returns the directory to order from. Staging never falls
+// back to production: a profile for another CA must name its staging
+// directory.
+func (p *Profile) DirectoryURL(staging bool) (string, error) {
+	directory := p.Directory
+	if directory == "" {
+		directory = LETSENCRYPT_DIRECTORY
+	}
+	if !staging {
+		return directory, nil
+	}
+	if p.StagingDirectory != "" {
+		return p.StagingDirectory, nil
+	}
+	switch directory {
+	case LETSENCRYPT_DIRECTORY:
+		return LETSENCRYPT_STAGING_DIRECTORY, nil
+	case GOOGLE_DIRECTORY:
+		return GOOGLE_STAGING_DIRECTORY, nil
+	}
+	return "", fmt.Errorf("no staging_directory configured for %s", directory)
+}
+
+// Certificate is an issued certificate with its chain and key, all PEM
+type Certificate struct {
+	Certificate []byte    `json:"certificate"`
+	Chain       []byte    `json:"chain,omitempty"`
+	PrivateKey  []byte    `json:"private_key"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	// Directory that issued it, and whether that was a staging directory
+	Directory string `json:"directory"`
+	Staging   bool   `json:"staging,omitempty"`
+	// When the key was generated; older than the certificate if reused
+	KeyCreatedAt time.Time `json:"key_created_at,omitempty"`
+	// The order it was issued for, which deployment receipts refer to
+	OrderURL string `json:"order_url,omitempty"`
+}
+
+// Issuer orders certificates from one directory with one account
+type Issuer struct {
+	profile   Profile
+	directory string
+	staging   bool
+	client    *acme.Client
+	dns       dns01.Provider
+	budget    *Budget
+}
+
+// NewIssuer prepares an issuer for profile. The account key is loaded from
+// account, or generated and saved there on first use; dns is required for
+// dns-01 profiles.
+func NewIssuer(profile Profile, staging bool, account store.Blob, dns dns01.Provider) (*Issuer, error) {
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	directory, err := profile.DirectoryURL(staging)
+	if err != nil {
+		return nil, err
+	}
+	if err := profile.checkEAB(directory, staging); err != nil {
+		return nil, err
+	}
+	if profile.Challenge == CHALLENGE_DNS01 && dns == nil {
+		return nil, fmt.Errorf("dns-01 requires a DNS provider")
+	}
+
+	key, err := accountKey(account)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := newHTTPClient(profile.RootCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		profile:   profile,
+		directory: directory,
+		staging:   staging,
+		dns:       dns,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: directory,
+			HTTPClient:   httpClient,
+			UserAgent:    USER_AGENT,
+		},
+	}, nil
+}
+
+// Directory returns the directory URL orders go to
+func (i *Issuer) Directory() string {
+	return i.directory
+}
+
+// SetBudget makes the issuer respect and record rate limits
+func (i *Issuer) SetBudget(budget *Budget) {
+	i.budget = budget
+}
+
+// Issue registers the account if needed, validates every name and returns
+// the certificate with a freshly generated key. With a budget, orders that
+// would exceed a rate limit fail with a *RateLimitError without reaching
+// the CA; names whose CAA records forbid the CA fail with a
+// *caa.ForbiddenError before an order is created.
+func (i *Issuer) Issue(ctx context.Context, domains []string) (*Certificate, error) {
+	return i.Reissue(ctx, domains, nil)
+}
+
+// Reissue is Issue submitting the key of previous again, for setups that
+// pin the public key; a nil previous generates a fresh key. Whether the
+// key may be kept is for KeyRotationReason to decide.
+func (i *Issuer) Reissue(ctx context.Context, domains []string, previous *Certificate) (*Certificate, error) {
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no domains to issue for")
+	}
+	// CAs only take A-labels; names may be configured in either form
+	ascii := make([]string, len(domains))
+	for n, domain := range domains {
+		name, err := idn.ToASCII(domain)
+		if err != nil {
+			return nil, err
+		}
+		ascii[n] = name
+	}
+	domains = ascii
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") && i.profile.Challenge != CHALLENGE_DNS01 {
+			return nil, fmt.Errorf("wildcard %s requires the dns-01 challenge", domain)
+		}
+		if net.ParseIP(domain) != nil && i.profile.Challenge == CHALLENGE_DNS01 {
+			return nil, fmt.Errorf("IP address %s cannot be validated with dns-01", domain)
+		}
+	}
+	key, keyCreatedAt, err := i.certificateKey(previous)
+	if err != nil {
+		return nil, err
+	}
+	if i.budget == nil {
+		return i.issue(ctx, domains, key, keyCreatedAt)
+	}
+
+	if err := i.budget.Check(i.directory, i.profile.Limits(i.directory), domains); err != nil {
+		return nil, err
+	}
+	cert, err := i.issue(ctx, domains, key, keyCreatedAt)
+	if wait, limited := rateLimitWait(err); limited {
+		if err := i.budget.RateLimited(i.directory, domains, wait); err != nil {
+			log.Printf("[WARNING] %v", err)
+		}
+		return nil, &RateLimitError{Limit: LIMIT_SERVER, Key: strings.Join(registeredDomains(domains), ","), RetryAt: time.Now().Add(wait)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := i.budget.Issued(i.directory, domains); err != nil {
+		log.Printf("[WARNING] %v", err)
+	}
+	return cert, nil
+}
+
+// certificateKey returns the key to submit and when it was generated
+func (i *Issuer) certificateKey(previous *Certificate) (crypto.Signer, time.Time, error) {
+	if previous != nil {
+		key, err := parseKey(previous.PrivateKey)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return key, previous.KeyCreatedAt, nil
+	}
+	key, err := newKey(i.profile.KeyType)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return key, time.Now().UTC(), nil
+}
+
+func (i *Issuer) issue(ctx context.Context, domains []string, key crypto.Signer, keyCreatedAt time.Time) (*Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, ORDER_TIMEOUT)
+	defer cancel()
+
+	if err := i.register(ctx); err != nil {
+		return nil, err
+	}
+	if err := i.checkCAA(ctx, domains); err != nil {
+		return nil, err
+	}
+
+	order, err := i.client.AuthorizeOrder(ctx, identifiers(domains))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	solver, err := i.newSolver()
+	if err != nil {
+		return nil, err
+	}
+	defer solver.Close()
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, solver, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	// Only the creation response carries the order URL in Location
+	orderURL := order.URI
+	if order, err = i.client.WaitOrder(ctx, orderURL); err != nil {
+		return nil, fmt.Errorf("order failed: %w", err)
+	}
+
+	csr, err := createCSR(domains, i.profile.CSR, key)
+	if err != nil {
+		return nil, err
+	}
+	ders, err := i.finalize(ctx, orderURL, order.FinalizeURL, csr)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := i.bundle(ders, key)
+	if err != nil {
+		return nil, err
+	}
+	cert.KeyCreatedAt = keyCreatedAt
+	cert.OrderURL = orderURL
+	return cert, nil
+}
+
+// finalize submits the CSR and downloads the certificate. CAs that finish
+// asynchronously without a Location header on the finalize response (Pebble
+// does) leave the client polling nothing, so poll the order URL from before.
+func (i *Issuer) finalize(ctx context.Context, orderURL, finalizeURL string, csr []byte) ([][]byte, error) {
+	ders, _, err := i.client.CreateOrderCert(ctx, finalizeURL, csr, true)
+	if err == nil {
+		return ders, nil
+	}
+	finalized, waitErr := i.client.WaitOrder(ctx, orderURL)
+	if waitErr != nil || finalized.Status != acme.StatusValid {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	if ders, err = i.client.FetchCert(ctx, finalized.CertURL, true); err != nil {
+		return nil, fmt.Errorf("failed to download certificate: %w", err)
+	}
+	return ders, nil
+}
+
+// register creates the account, or finds the existing one for the key
+func (i *Issuer) register(ctx context.Context) error {
+	account := &acme.Account{}
+	if i.profile.Email != "" {
+		account.Contact = []string{"mailto:" + i.profile.Email}
+	}
+	if eab := i.profile.ExternalAccount(i.staging); eab != nil {
+		binding, err := eab.binding()
+		if err != nil {
+			return err
+		}
+		account.ExternalAccountBinding = binding
+	}
+	_, err := i.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account at %s: %w", i.directory, err)
+	}
+	return nil
+}
+
+func (i *Issuer) authorize(ctx context.Context, solver solver, authzURL string) error {
+	authz, err := i.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == solver.Type() {
+			challenge = c
+			break
+		}
+	}
+	name := authz.Identifier.Value
+	if authz.Wildcard {
+		name = "*." + name
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA offers no %s challenge for %s", solver.Type(), name)
+	}
+
+	cleanup, err := solver.Present(ctx, i.client, authz.Identifier.Value, challenge)
+	if err != nil {
+		return fmt.Errorf("failed to prepare %s challenge for %s: %w", solver.Type(), name, err)
+	}
+	defer cleanup()
+
+	if _, err := i.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s: %w", name, err)
+	}
+	if _, err := i.client.WaitAuthorization(ctx, authzURL); err != nil {
+		var authzErr *acme.AuthorizationError
+		if i.budget != nil && errors.As(err, &authzErr) {
+			if err := i.budget.FailedValidation(i.directory, name); err != nil {
+				log.Printf("[WARNING] %v", err)
+			}
+		}
+		return fmt.Errorf("validation of %s failed: %w", name, err)
+	}
+	return nil
+}
+
+func (i *Issuer) bundle(ders [][]byte, key crypto.Signer) (*Certificate, error) {
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(ders[0])
+	if err != nil {
+		return nil, fmt.Errorf("CA returned an invalid certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	cert := &Certificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ders[0]}),
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		NotBefore:   leaf.NotBefore.UTC(),
+		NotAfter:    leaf.NotAfter.UTC(),
+		Directory:   i.directory,
+		Staging:     i.staging,
+	}
+	for _, der := range ders[1:] {
+		cert.Chain = append(cert.Chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return cert, nil
+}
+
+// accountKey loads the account key, creating one on first use
+func accountKey(account store.Blob) (crypto.Signer, error) {
+	if data, err := account.Load(); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("stored ACME account key is not PEM")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored ACME account key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("stored ACME account key cannot sign")
+		}
+		return signer, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode ACME account key: %w", err)
+	}
+	if err := account.Save(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to store ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// newHTTPClient uses the agent's shared transport, or a copy of it trusting
+// rootCAFile for CAs with private roots
+func newHTTPClient(rootCAFile string) (*http.Client, error) {
+	if rootCAFile == "" {
+		return httpclient.New(REQUEST_TIMEOUT), nil
+	}
+	data, err := os.ReadFile(rootCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root_ca_file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", rootCAFile)
+	}
+	transport := httpclient.Transport().Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport, Timeout: REQUEST_TIMEOUT}, nil
+}
@@ -0,0 +1,68 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/caa"
+)
+
+// CAA issuer domains of public CAs, for directories that don't announce
+// theirs in the directory metadata
+var caaIdentities = map[string][]string{
+	LETSENCRYPT_DIRECTORY:         {"letsencrypt.org"},
+	LETSENCRYPT_STAGING_DIRECTORY: {"letsencrypt.org"},
+	ZEROSSL_DIRECTORY:             {"sectigo.com", "zerossl.com"},
+	SECTIGO_DIRECTORY:             {"sectigo.com"},
+	GOOGLE_DIRECTORY:              {"pki.goog"},
+	GOOGLE_STAGING_DIRECTORY:      {"pki.goog"},
+}
+
+// CAAIdentities returns the issuer domains the CA accepts in CAA records:
+// the profile's own, the directory's caaIdentities, or the known ones.
+// Without any the check is skipped, as is usual for private CAs.
+func (i *Issuer) CAAIdentities(ctx context.Context) []string {
+	identities := i.profile.CAAIdentities
+	if len(identities) == 0 {
+		if dir, err := i.client.Discover(ctx); err == nil {
+			identities = dir.CAA
+		}
+	}
+	if len(identities) == 0 {
+		identities = caaIdentities[i.directory]
+	}
+	normalized := make([]string, len(identities))
+	for n, identity := range identities {
+		normalized[n] = strings.ToLower(strings.TrimSpace(identity))
+	}
+	return normalized
+}
+
+// checkCAA fails before the order is created when the names' CAA records
+// don't allow this CA. Lookup failures only warn: the CA checks again
+// anyway, and split-horizon DNS may hide what the CA sees.
+func (i *Issuer) checkCAA(ctx context.Context, domains []string) error {
+	if i.profile.SkipCAACheck {
+		return nil
+	}
+	identities := i.CAAIdentities(ctx)
+	if len(identities) == 0 {
+		return nil
+	}
+	method := i.profile.Challenge
+	if method == "" {
+		method = CHALLENGE_HTTP01
+	}
+
+	err := caa.Check(ctx, domains, caa.CA{Identities: identities, AccountURI: string(i.client.KID), Method: method})
+	var forbidden *caa.ForbiddenError
+	if errors.As(err, &forbidden) {
+		return err
+	}
+	if err != nil {
+		log.Printf("[WARNING] CAA pre-check skipped: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	EKU_SERVER_AUTH      = "server_auth"
+	EKU_CLIENT_AUTH      = "client_auth"
+	EKU_CODE_SIGNING     = "code_signing"
+	EKU_EMAIL_PROTECTION = "email_protection"
+	EKU_TIME_STAMPING    = "time_stamping"
+	EKU_OCSP_SIGNING     = "ocsp_signing"
+
+	// RFC 7633 status_request, the only TLS feature CAs set
+	TLS_FEATURE_STATUS_REQUEST = 5
+)
+
+var (
+	OID_TLS_FEATURE        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+	OID_EXTENDED_KEY_USAGE = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+	extKeyUsages = map[string]asn1.ObjectIdentifier{
+		EKU_SERVER_AUTH:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+		EKU_CLIENT_AUTH:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+		EKU_CODE_SIGNING:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+		EKU_EMAIL_PROTECTION: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+		EKU_TIME_STAMPING:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+		EKU_OCSP_SIGNING:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	}
+)
+
+// CSROptions request more of the certificate than names, for PKIs with
+// stricter requirements. Public CAs ignore or refuse most of them; Let's
+// Encrypt, for one, no longer issues must-staple certificates.
+type CSROptions struct {
+	// MustStaple sets the TLS Feature extension, so clients require a
+	// stapled OCSP response
+	MustStaple bool `json:"must_staple,omitempty"`
+	// Email SANs, for CAs whose policy allows them
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	// Extended key usages by name (server_auth, client_auth, ...) or as
+	// dotted OIDs
+	ExtKeyUsages []string `json:"ext_key_usages,omitempty"`
+}
+
+// Validate checks every option can be encoded
+func (o *CSROptions) Validate() error {
+	for _, address := range o.EmailAddresses {
+		if _, err := mail.ParseAddress(address); err != nil || strings.ContainsAny(address, "<> ") {
+			return fmt.Errorf("invalid email address %q", address)
+		}
+	}
+	_, err := o.extKeyUsageOIDs()
+	return err
+}
+
+func (o *CSROptions) extKeyUsageOIDs() ([]asn1.ObjectIdentifier, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(o.ExtKeyUsages))
+	for _, usage := range o.ExtKeyUsages {
+		if oid, ok := extKeyUsages[usage]; ok {
+			oids = append(oids, oid)
+			continue
+		}
+		oid, err := parseOID(usage)
+		if err != nil {
+			return nil, fmt.Errorf("unknown extended key usage %q (use a name like %s or a dotted OID)", usage, EKU_CLIENT_AUTH)
+		}
+		oids = append(oids, oid)
+	}
+	return oids, nil
+}
+
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("not an OID")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("not an OID")
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// identifiers orders IP addresses as ip identifiers (RFC 8738) and
+// everything else as DNS names
+func identifiers(names []string) []acme.AuthzID {
+	ids := make([]acme.AuthzID, len(names))
+	for i, name := range names {
+		if net.ParseIP(name) != nil {
+			ids[i] = acme.AuthzID{Type: "ip", Value: name}
+		} else {
+			ids[i] = acme.AuthzID{Type: "dns", Value: name}
+		}
+	}
+	return ids
+}
+
+// createCSR builds the CSR for names, with the profile's extensions
+func createCSR(names []string, options *CSROptions, key crypto.Signer) ([]byte, error) {
+	request := &x509.CertificateRequest{}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			request.IPAddresses = append(request.IPAddresses, ip)
+		} else {
+			request.DNSNames = append(request.DNSNames, name)
+		}
+	}
+
+	if options != nil {
+		request.EmailAddresses = options.EmailAddresses
+		if options.MustStaple {
+			value, err := asn1.Marshal([]int{TLS_FEATURE_STATUS_REQUEST})
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode TLS feature: %w", err)
+			}
+			request.ExtraExtensions = append(request.ExtraExtensions, pkix.Extension{Id: OID_TLS_FEATURE, Value: value})
+		}
+		oids, err := options.extKeyUsageOIDs()
+		if err != nil {
+			return nil, err
+		}
+		if len(oids) > 0 {
+			value, err := asn1.Marshal(oids)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode extended key usage: %w", err)
+			}
+			request.ExtraExtensions = append(request.ExtraExtensions, pkix.Extension{Id: OID_EXTENDED_KEY_USAGE, Value: value})
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, request, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return csr, nil
+}
@@ -0,0 +1,95 @@
+package acme
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	ZEROSSL_DIRECTORY        = "https://acme.zerossl.com/v2/DV90"
+	SECTIGO_DIRECTORY        = "https://acme.sectigo.com/v2/DV"
+	GOOGLE_DIRECTORY         = "https://dv.acme-v02.api.pki.goog/directory"
+	GOOGLE_STAGING_DIRECTORY = "https://dv.acme-v02.test-api.pki.goog/directory"
+)
+
+// Public CAs that refuse to create accounts without a binding
+var eabRequired = map[string]string{
+	ZEROSSL_DIRECTORY:        "ZeroSSL",
+	SECTIGO_DIRECTORY:        "Sectigo",
+	GOOGLE_DIRECTORY:         "Google Trust Services",
+	GOOGLE_STAGING_DIRECTORY: "Google Trust Services",
+}
+
+// ExternalAccountBinding ties the ACME account to an account the CA knows
+// from elsewhere (RFC 8555 section 7.3.4), with credentials from the CA's
+// dashboard
+type ExternalAccountBinding struct {
+	KeyID string `json:"key_id"`
+	// HMACKey is base64url, as CAs hand it out
+	HMACKey string `json:"hmac_key"`
+}
+
+// Validate checks both credentials are present and the key decodes
+func (e *ExternalAccountBinding) Validate() error {
+	if e.KeyID == "" || e.HMACKey == "" {
+		return fmt.Errorf("external_account_binding requires key_id and hmac_key")
+	}
+	_, err := e.key()
+	return err
+}
+
+func (e *ExternalAccountBinding) key() ([]byte, error) {
+	// Padded or not, URL or standard alphabet: CAs differ
+	encoded := strings.TrimRight(strings.TrimSpace(e.HMACKey), "=")
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("external_account_binding hmac_key is not base64: %w", err)
+	}
+	return key, nil
+}
+
+func (e *ExternalAccountBinding) binding() (*acme.ExternalAccountBinding, error) {
+	key, err := e.key()
+	if err != nil {
+		return nil, err
+	}
+	redact.AddSecret(e.HMACKey)
+	return &acme.ExternalAccountBinding{KID: e.KeyID, Key: key}, nil
+}
+
+// ExternalAccount returns the binding for production or staging; staging
+// falls back to the production one, which some CAs accept for both
+func (p *Profile) ExternalAccount(staging bool) *ExternalAccountBinding {
+	if staging && p.StagingEAB != nil {
+		return p.StagingEAB
+	}
+	return p.EAB
+}
+
+// checkEAB refuses a directory known to require a binding when none is
+// configured, rather than failing at registration
+func (p *Profile) checkEAB(directory string, staging bool) error {
+	if ca, required := eabRequired[directory]; required && p.ExternalAccount(staging) == nil {
+		return fmt.Errorf("%s requires external_account_binding (key_id and hmac_key from the CA)", ca)
+	}
+	return nil
+}
+
+// AccountName identifies the ACME account a profile uses at directory.
+// Accounts are shared per directory, except that each external account
+// binding gets its own, since an account stays bound to the first one.
+func (p *Profile) AccountName(directory string, staging bool) string {
+	eab := p.ExternalAccount(staging)
+	if eab == nil {
+		return directory
+	}
+	return directory + "#" + eab.KeyID
+}
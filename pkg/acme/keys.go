@@ -0,0 +1,117 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+const (
+	KEY_ECDSA_P256 = "ecdsa-p256"
+	KEY_ECDSA_P384 = "ecdsa-p384"
+	KEY_RSA_2048   = "rsa-2048"
+	KEY_RSA_3072   = "rsa-3072"
+	KEY_RSA_4096   = "rsa-4096"
+
+	DEFAULT_KEY_TYPE = KEY_ECDSA_P256
+)
+
+// newKey generates a certificate key of the given type
+func newKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", KEY_ECDSA_P256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KEY_ECDSA_P384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KEY_RSA_2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KEY_RSA_3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KEY_RSA_4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, CheckKeyType(keyType)
+}
+
+// CheckKeyType validates a key type without generating a key
+func CheckKeyType(keyType string) error {
+	switch keyType {
+	case "", KEY_ECDSA_P256, KEY_ECDSA_P384, KEY_RSA_2048, KEY_RSA_3072, KEY_RSA_4096:
+		return nil
+	}
+	return fmt.Errorf("unknown key type %q (available: %s, %s, %s, %s, %s)",
+		keyType, KEY_ECDSA_P256, KEY_ECDSA_P384, KEY_RSA_2048, KEY_RSA_3072, KEY_RSA_4096)
+}
+
+// KeyType names the type of a certificate key, or "" for keys no profile
+// would generate (e.g. RSA below 2048 bits)
+func KeyType(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KEY_ECDSA_P256
+		case elliptic.P384():
+			return KEY_ECDSA_P384
+		}
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KEY_RSA_2048
+		case 3072:
+			return KEY_RSA_3072
+		case 4096:
+			return KEY_RSA_4096
+		}
+	}
+	return ""
+}
+
+// parseKey decodes a PKCS#8 PEM certificate key
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("certificate key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("certificate key cannot sign")
+	}
+	return signer, nil
+}
+
+// KeyRotationReason says why the key of previous must not be submitted
+// again under keyType, or "" when it may. A key is never kept past maxAge
+// or once the profile asks for another key type.
+func KeyRotationReason(previous *Certificate, keyType string, maxAge time.Duration, now time.Time) string {
+	if keyType == "" {
+		keyType = DEFAULT_KEY_TYPE
+	}
+	key, err := parseKey(previous.PrivateKey)
+	if err != nil {
+		return err.Error()
+	}
+	if current := KeyType(key.Public()); current != keyType {
+		if current == "" {
+			return "the key is of an unsupported type"
+		}
+		return fmt.Sprintf("the key is %s but the profile asks for %s", current, keyType)
+	}
+	if previous.KeyCreatedAt.IsZero() {
+		return "the key's age is unknown"
+	}
+	if age := now.Sub(previous.KeyCreatedAt); maxAge > 0 && age >= maxAge {
+		return fmt.Sprintf("the key is %d days old (max %d)", int(age.Hours()/24), int(maxAge.Hours()/24))
+	}
+	return ""
+}
@@ -0,0 +1,334 @@
+package acme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	LIMIT_CERTIFICATES_PER_DOMAIN = "certificates_per_domain"
+	LIMIT_DUPLICATE_CERTIFICATE   = "duplicate_certificate"
+	LIMIT_FAILED_VALIDATIONS      = "failed_validations"
+	// The CA itself answered rateLimited
+	LIMIT_SERVER = "server"
+
+	// Let's Encrypt's published production limits
+	LETSENCRYPT_CERTIFICATES_PER_DOMAIN = 50
+	LETSENCRYPT_DUPLICATE_CERTIFICATES  = 5
+	LETSENCRYPT_FAILED_VALIDATIONS      = 5
+
+	CERTIFICATE_WINDOW        = 7 * 24 * time.Hour
+	FAILED_VALIDATION_WINDOW  = 1 * time.Hour
+	DEFAULT_SERVER_RETRY_WAIT = 1 * time.Hour
+
+	PROBLEM_RATE_LIMITED = "urn:ietf:params:acme:error:rateLimited"
+)
+
+// Limits caps what the agent asks of one directory; zero means unlimited
+type Limits struct {
+	// Certificates per registered domain (example.com for www.example.com)
+	// per week
+	CertificatesPerDomain int `json:"certificates_per_domain,omitempty"`
+	// Certificates for exactly the same set of names per week
+	DuplicateCertificates int `json:"duplicate_certificates,omitempty"`
+	// Failed validations per hostname per hour
+	FailedValidations int `json:"failed_validations,omitempty"`
+	// Disabled turns off local budgeting; rateLimited answers still apply
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// Limits returns the profile's limits for directory. Let's Encrypt
+// production gets its published limits unless the profile overrides them;
+// other CAs, staging included, are only limited by what they answer.
+func (p *Profile) Limits(directory string) Limits {
+	if p.RateLimits != nil {
+		if p.RateLimits.Disabled {
+			return Limits{}
+		}
+		return *p.RateLimits
+	}
+	if directory == LETSENCRYPT_DIRECTORY {
+		return Limits{
+			CertificatesPerDomain: LETSENCRYPT_CERTIFICATES_PER_DOMAIN,
+			DuplicateCertificates: LETSENCRYPT_DUPLICATE_CERTIFICATES,
+			FailedValidations:     LETSENCRYPT_FAILED_VALIDATIONS,
+		}
+	}
+	return Limits{}
+}
+
+// RateLimitError means an order was not placed because it would exceed a
+// limit, or the CA asked to wait
+type RateLimitError struct {
+	Limit   string
+	Key     string
+	Used    int
+	Max     int
+	RetryAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Limit == LIMIT_SERVER {
+		return fmt.Sprintf("CA rate limit for %s, retry after %s", e.Key, e.RetryAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s limit for %s reached (%d/%d), retry after %s", e.Limit, e.Key, e.Used, e.Max, e.RetryAt.Format(time.RFC3339))
+}
+
+// Usage is how much of one limit has been spent
+type Usage struct {
+	Directory string    `json:"directory"`
+	Limit     string    `json:"limit"`
+	Key       string    `json:"key"`
+	Used      int       `json:"used"`
+	Max       int       `json:"max,omitempty"`
+	ResetsAt  time.Time `json:"resets_at,omitempty"`
+}
+
+// Remaining is how many more requests the limit allows
+func (u *Usage) Remaining() int {
+	return max(u.Max-u.Used, 0)
+}
+
+// One issuance, failed validation or CA rate limit answer
+type spend struct {
+	Directory string    `json:"directory"`
+	Limit     string    `json:"limit"`
+	Key       string    `json:"key"`
+	At        time.Time `json:"at"`
+	// Until is when a CA rate limit answer expires
+	Until time.Time `json:"until,omitempty"`
+}
+
+// Budget records what was spent against each directory's limits, so
+// renewals wait instead of retrying into a lockout
+type Budget struct {
+	mu     sync.Mutex
+	state  store.Blob
+	spends []spend
+	now    func() time.Time
+}
+
+// NewBudget loads the ledger from state; nil keeps it in memory only
+func NewBudget(state store.Blob, now func() time.Time) *Budget {
+	if now == nil {
+		now = time.Now
+	}
+	b := &Budget{state: state, now: now}
+	if state != nil {
+		if data, err := state.Load(); err == nil {
+			_ = json.Unmarshal(data, &b.spends)
+		}
+	}
+	return b
+}
+
+// Check refuses an order for domains that would exceed a limit
+func (b *Budget) Check(directory string, limits Limits, domains []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.prune(now)
+	for _, domain := range registeredDomains(domains) {
+		for _, s := range b.spends {
+			if s.Directory == directory && s.Limit == LIMIT_SERVER && s.Key == domain {
+				return &RateLimitError{Limit: LIMIT_SERVER, Key: domain, RetryAt: s.Until}
+			}
+		}
+	}
+	for _, domain := range domains {
+		if err := b.check(now, directory, LIMIT_FAILED_VALIDATIONS, hostname(domain), limits.FailedValidations, FAILED_VALIDATION_WINDOW); err != nil {
+			return err
+		}
+	}
+	if err := b.check(now, directory, LIMIT_DUPLICATE_CERTIFICATE, nameSet(domains), limits.DuplicateCertificates, CERTIFICATE_WINDOW); err != nil {
+		return err
+	}
+	for _, domain := range registeredDomains(domains) {
+		if err := b.check(now, directory, LIMIT_CERTIFICATES_PER_DOMAIN, domain, limits.CertificatesPerDomain, CERTIFICATE_WINDOW); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Budget) check(now time.Time, directory, limit, key string, maximum int, window time.Duration) error {
+	if maximum <= 0 {
+		return nil
+	}
+	times := b.times(now, directory, limit, key, window)
+	if len(times) < maximum {
+		return nil
+	}
+	// Wait until enough of the counted requests leave the window
+	return &RateLimitError{Limit: limit, Key: key, Used: len(times), Max: maximum, RetryAt: times[len(times)-maximum].Add(window)}
+}
+
+// times returns when the counted requests were made, oldest first
+func (b *Budget) times(now time.Time, directory, limit, key string, window time.Duration) []time.Time {
+	var times []time.Time
+	for _, s := range b.spends {
+		if s.Directory == directory && s.Limit == limit && s.Key == key && now.Sub(s.At) < window {
+			times = append(times, s.At)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// Issued counts a certificate against the duplicate and per-domain limits
+func (b *Budget) Issued(directory string, domains []string) error {
+	now := b.now()
+	spends := []spend{{Directory: directory, Limit: LIMIT_DUPLICATE_CERTIFICATE, Key: nameSet(domains), At: now}}
+	for _, domain := range registeredDomains(domains) {
+		spends = append(spends, spend{Directory: directory, Limit: LIMIT_CERTIFICATES_PER_DOMAIN, Key: domain, At: now})
+	}
+	return b.add(spends...)
+}
+
+// FailedValidation counts a failed challenge for name
+func (b *Budget) FailedValidation(directory, name string) error {
+	return b.add(spend{Directory: directory, Limit: LIMIT_FAILED_VALIDATIONS, Key: hostname(name), At: b.now()})
+}
+
+// RateLimited blocks the order's domains until the CA's Retry-After
+func (b *Budget) RateLimited(directory string, domains []string, retryAfter time.Duration) error {
+	now := b.now()
+	var spends []spend
+	for _, domain := range registeredDomains(domains) {
+		spends = append(spends, spend{Directory: directory, Limit: LIMIT_SERVER, Key: domain, At: now, Until: now.Add(retryAfter)})
+	}
+	return b.add(spends...)
+}
+
+func (b *Budget) add(spends ...spend) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(b.now())
+	b.spends = append(b.spends, spends...)
+	return b.save()
+}
+
+// Status reports the limits that apply to an order for domains
+func (b *Budget) Status(directory string, limits Limits, domains []string) []Usage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	var usages []Usage
+	usage := func(limit, key string, maximum int, window time.Duration) {
+		times := b.times(now, directory, limit, key, window)
+		if maximum <= 0 && len(times) == 0 {
+			return
+		}
+		u := Usage{Directory: directory, Limit: limit, Key: key, Used: len(times), Max: maximum}
+		if len(times) > 0 {
+			u.ResetsAt = times[0].Add(window)
+		}
+		usages = append(usages, u)
+	}
+
+	for _, domain := range registeredDomains(domains) {
+		for _, s := range b.spends {
+			if s.Directory == directory && s.Limit == LIMIT_SERVER && s.Key == domain && now.Before(s.Until) {
+				usages = append(usages, Usage{Directory: directory, Limit: LIMIT_SERVER, Key: domain, ResetsAt: s.Until})
+			}
+		}
+		usage(LIMIT_CERTIFICATES_PER_DOMAIN, domain, limits.CertificatesPerDomain, CERTIFICATE_WINDOW)
+	}
+	usage(LIMIT_DUPLICATE_CERTIFICATE, nameSet(domains), limits.DuplicateCertificates, CERTIFICATE_WINDOW)
+	for _, domain := range domains {
+		if times := b.times(now, directory, LIMIT_FAILED_VALIDATIONS, hostname(domain), FAILED_VALIDATION_WINDOW); len(times) > 0 {
+			usage(LIMIT_FAILED_VALIDATIONS, hostname(domain), limits.FailedValidations, FAILED_VALIDATION_WINDOW)
+		}
+	}
+	return usages
+}
+
+// Nothing outlives the longest window or its CA block
+func (b *Budget) prune(now time.Time) {
+	kept := b.spends[:0]
+	for _, s := range b.spends {
+		if s.Limit == LIMIT_SERVER && now.Before(s.Until) || s.Limit != LIMIT_SERVER && now.Sub(s.At) < CERTIFICATE_WINDOW {
+			kept = append(kept, s)
+		}
+	}
+	b.spends = kept
+}
+
+func (b *Budget) save() error {
+	if b.state == nil {
+		return nil
+	}
+	data, err := json.Marshal(b.spends)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rate limit ledger: %w", err)
+	}
+	if err := b.state.Save(data); err != nil {
+		return fmt.Errorf("failed to store rate limit ledger: %w", err)
+	}
+	return nil
+}
+
+// rateLimitWait reports whether err is the CA's rateLimited problem and
+// how long it asked to wait
+func rateLimitWait(err error) (time.Duration, bool) {
+	var problem *acme.Error
+	if !errors.As(err, &problem) || problem.ProblemType != PROBLEM_RATE_LIMITED {
+		return 0, false
+	}
+	if problem.Header != nil {
+		value := problem.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+			return time.Until(at), true
+		}
+	}
+	return DEFAULT_SERVER_RETRY_WAIT, true
+}
+
+// nameSet identifies a certificate's exact set of names
+func nameSet(domains []string) string {
+	names := make([]string, len(domains))
+	for i, domain := range domains {
+		names[i] = strings.ToLower(domain)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Validations are per hostname; a wildcard validates at its base
+func hostname(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(domain, "*."))
+}
+
+// registeredDomains maps names to their registered domains (eTLD+1), once each
+func registeredDomains(domains []string) []string {
+	seen := map[string]bool{}
+	var registered []string
+	for _, domain := range domains {
+		name := hostname(domain)
+		if etld1, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+			name = etld1
+		}
+		if !seen[name] {
+			seen[name] = true
+			registered = append(registered, name)
+		}
+	}
+	return registered
+}
@@ -0,0 +1,181 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/firewall"
+)
+
+const (
+	DEFAULT_HTTP_LISTEN = ":80"
+	HTTP_CHALLENGE_PATH = "/.well-known/acme-challenge/"
+)
+
+// solver answers one challenge type for the duration of an order
+type solver interface {
+	Type() string
+	// Present makes the challenge answerable and returns its cleanup
+	Present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error)
+	Close()
+}
+
+func (i *Issuer) newSolver() (solver, error) {
+	switch {
+	case i.profile.Challenge == CHALLENGE_DNS01:
+		return &dnsSolver{provider: i.dns}, nil
+	case i.profile.Webroot != "":
+		if err := preflightHTTP01(false); err != nil {
+			return nil, err
+		}
+		return &webrootSolver{root: i.profile.Webroot}, nil
+	}
+	listen := i.profile.HTTPListen
+	if listen == "" {
+		listen = DEFAULT_HTTP_LISTEN
+	}
+	// Port 80 must also be free when the agent binds it itself; another
+	// listen address is reached through a redirect the firewall check
+	// still covers
+	if err := preflightHTTP01(listen == DEFAULT_HTTP_LISTEN); err != nil {
+		return nil, err
+	}
+	return newStandaloneSolver(listen)
+}
+
+// preflightHTTP01 explains up front what would otherwise surface as an
+// opaque validation failure from the CA. Reading the firewall rules is a
+// heuristic, so a port that looks blocked only warns; a port another
+// process holds fails the order.
+func preflightHTTP01(standalone bool) error {
+	err := firewall.Preflight(firewall.CHALLENGE_HTTP_01, standalone)
+	var blocked *firewall.BlockedError
+	if errors.As(err, &blocked) {
+		log.Printf("[WARNING] HTTP-01 validation may fail: %v", err)
+		return nil
+	}
+	return err
+}
+
+// webrootSolver writes tokens where the running web server serves them
+type webrootSolver struct {
+	root string
+}
+
+func (s *webrootSolver) Type() string { return CHALLENGE_HTTP01 }
+
+func (s *webrootSolver) Present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.root, filepath.FromSlash(client.HTTP01ChallengePath(challenge.Token)))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// The web server usually runs as another user and must read the token
+	if err := os.WriteFile(path, []byte(response), 0644); err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+func (s *webrootSolver) Close() {}
+
+// standaloneSolver serves tokens itself, for hosts with nothing on port 80
+type standaloneSolver struct {
+	server *http.Server
+
+	mu        sync.Mutex
+	responses map[string]string
+}
+
+func newStandaloneSolver(listen string) (*standaloneSolver, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s for http-01: %w", listen, err)
+	}
+	s := &standaloneSolver{responses: make(map[string]string)}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serve), ReadHeaderTimeout: 10 * time.Second}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+func (s *standaloneSolver) Type() string { return CHALLENGE_HTTP01 }
+
+func (s *standaloneSolver) serve(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, HTTP_CHALLENGE_PATH)
+	s.mu.Lock()
+	response, found := s.responses[token]
+	s.mu.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+func (s *standaloneSolver) Present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.responses[challenge.Token] = response
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.responses, challenge.Token)
+		s.mu.Unlock()
+	}, nil
+}
+
+func (s *standaloneSolver) Close() {
+	s.server.Close()
+}
+
+// dnsSolver publishes TXT records through a DNS provider and waits until
+// every authoritative server has them
+type dnsSolver struct {
+	provider dns01.Provider
+}
+
+func (s *dnsSolver) Type() string { return CHALLENGE_DNS01 }
+
+func (s *dnsSolver) Present(ctx context.Context, client *acme.Client, domain string, challenge *acme.Challenge) (func(), error) {
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	fqdn := dns01.ChallengeName(domain)
+	if err := s.provider.Present(ctx, fqdn, value); err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := s.provider.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("[WARNING] Failed to remove %s challenge record: %v", fqdn, err)
+		}
+	}
+	if err := dns01.WaitForPropagation(ctx, fqdn, value, PROPAGATION_TIMEOUT); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+func (s *dnsSolver) Close() {}
@@ -0,0 +1,65 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+// Entry is one audit record, written as a JSON line
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	TaskID  string            `json:"task_id,omitempty"`
+	Action  string            `json:"action"`
+	Target  string            `json:"target,omitempty"`
+	Outcome string            `json:"outcome"`
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Logger appends audit entries to a file that only root can read
+type Logger struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLogger creates a logger writing to path
+func NewLogger(path string) *Logger {
+	return &Logger{path: path}
+}
+
+// Record appends an entry and syncs it to disk
+func (l *Logger) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Error = redact.String(entry.Error)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit directory: %w", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return file.Sync()
+}
@@ -0,0 +1,225 @@
+// Package awsauth signs AWS API requests and finds the credentials to sign
+// them with, for the integrations that talk to AWS without its SDK
+package awsauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Instance profile credentials come from IMDSv2
+	IMDS_ENDPOINT = "http://169.254.169.254/latest"
+
+	// Temporary credentials are replaced this long before they expire
+	REFRESH_BEFORE = 5 * time.Minute
+)
+
+// Credentials are an access key pair, temporary when Token is set
+type Credentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// FromEnvironment returns the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY pair,
+// or nil when it isn't set
+func FromEnvironment() *Credentials {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		return nil
+	}
+	return &Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Source hands out static credentials, or without them the instance
+// profile's, refreshed shortly before they expire
+type Source struct {
+	mu    sync.Mutex
+	creds *Credentials
+}
+
+func NewSource(static *Credentials) *Source {
+	return &Source{creds: static}
+}
+
+func (s *Source) Get(ctx context.Context) (*Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creds != nil && (s.creds.Expiration.IsZero() || time.Until(s.creds.Expiration) > REFRESH_BEFORE) {
+		return s.creds, nil
+	}
+	creds, err := InstanceProfileCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials configured and instance profile unavailable: %w", err)
+	}
+	s.creds = creds
+	return creds, nil
+}
+
+// InstanceProfileCredentials fetches the role credentials of the EC2
+// instance profile through IMDSv2
+func InstanceProfileCredentials(ctx context.Context) (*Credentials, error) {
+	// Metadata must be reached directly, never through a proxy
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{Proxy: nil}}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", IMDS_ENDPOINT+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := imdsFetch(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", IMDS_ENDPOINT+"/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return imdsFetch(client, req)
+	}
+
+	role, err := get("")
+	if err != nil {
+		return nil, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	if role == "" {
+		return nil, fmt.Errorf("instance has no IAM role")
+	}
+
+	body, err := get(role)
+	if err != nil {
+		return nil, err
+	}
+	var creds Credentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse instance profile credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+func imdsFetch(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return string(body), err
+}
+
+// SignV4 adds an AWS Signature Version 4 Authorization header
+func SignV4(req *http.Request, body []byte, creds *Credentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.EscapedPath()),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// canonicalQuery sorts parameters and encodes them the way AWS expects:
+// RFC 3986 unreserved characters only, spaces as %20
+func canonicalQuery(query map[string][]string) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_VERSION  = 1
+	ARCHIVE_MANIFEST = "manifest.json"
+	// Archives hold the state database, which stays well below this
+	MAX_ARCHIVE_SIZE = 512 << 20
+)
+
+// Manifest describes a state archive: where it was taken and the files it
+// holds, with their checksums
+type Manifest struct {
+	Version      int            `json:"version"`
+	CreatedAt    time.Time      `json:"created_at"`
+	Host         string         `json:"host"`
+	AgentVersion string         `json:"agent_version,omitempty"`
+	MachineID    string         `json:"machine_id,omitempty"`
+	Files        []*ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is one file of a state archive. Name is relative and
+// portable; the restoring host decides where it goes.
+type ArchiveFile struct {
+	Name   string      `json:"name"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+	Data   []byte      `json:"-"`
+}
+
+// File looks up a file of the archive by name
+func (m *Manifest) File(name string) *ArchiveFile {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// WriteArchive packs the manifest's files into a gzipped tar and encrypts
+// it; the manifest's sizes and checksums are filled in
+func WriteArchive(c Cipher, m *Manifest) ([]byte, error) {
+	m.Version = ARCHIVE_VERSION
+	for _, f := range m.Files {
+		if !validArchiveName(f.Name) {
+			return nil, fmt.Errorf("invalid archive file name %q", f.Name)
+		}
+		sum := sha256.Sum256(f.Data)
+		f.Size = int64(len(f.Data))
+		f.SHA256 = hex.EncodeToString(sum[:])
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, mode os.FileMode, data []byte) error {
+		header := &tar.Header{Name: name, Mode: int64(mode.Perm()), Size: int64(len(data)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(ARCHIVE_MANIFEST, 0600, manifest); err != nil {
+		return nil, err
+	}
+	for _, f := range m.Files {
+		if err := add(f.Name, f.Mode, f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return c.Encrypt(buf.Bytes())
+}
+
+// ReadArchive decrypts an archive and checks every file against the
+// manifest
+func ReadArchive(c Cipher, sealed []byte) (*Manifest, error) {
+	data, err := c.Decrypt(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	contents := map[string][]byte{}
+	var total int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		if total += header.Size; total > MAX_ARCHIVE_SIZE {
+			return nil, fmt.Errorf("archive is larger than %d MiB", MAX_ARCHIVE_SIZE>>20)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		contents[header.Name] = content
+	}
+
+	var m Manifest
+	manifest, ok := contents[ARCHIVE_MANIFEST]
+	if !ok {
+		return nil, fmt.Errorf("archive has no %s", ARCHIVE_MANIFEST)
+	}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("invalid archive manifest: %w", err)
+	}
+	if m.Version != ARCHIVE_VERSION {
+		return nil, fmt.Errorf("archive version %d is not supported", m.Version)
+	}
+	for _, f := range m.Files {
+		content, ok := contents[f.Name]
+		if !ok || !validArchiveName(f.Name) {
+			return nil, fmt.Errorf("archive is missing %s", f.Name)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("%s does not match its checksum", f.Name)
+		}
+		f.Data = content
+	}
+	return &m, nil
+}
+
+func validArchiveName(name string) bool {
+	return name != "" && name != ARCHIVE_MANIFEST && !path.IsAbs(name) && path.Clean(name) == name && !strings.HasPrefix(name, "..")
+}
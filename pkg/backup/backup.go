@@ -0,0 +1,263 @@
+// Package backup keeps encrypted copies of the agent's certificates and
+// keys in an S3-compatible bucket, so a host that is lost can be rebuilt
+// with the certificates it served. Everything is encrypted on the host,
+// with age recipients or a shared AES-256-GCM key, before it is uploaded.
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	// Where the entry came from
+	SOURCE_ACME   = "acme"
+	SOURCE_DEPLOY = "deploy"
+
+	// Object holding the most recent backup of a certificate, beside the
+	// ones named by fingerprint
+	LATEST = "latest"
+
+	EXTENSION_AGE = ".age"
+	EXTENSION_AES = ".enc"
+
+	AES_KEY_SIZE = 32
+)
+
+// Header of AES-GCM objects: magic, then a key ID so a restore with the
+// wrong key says so instead of failing to authenticate
+var aesMagic = []byte("CFBK1")
+
+var ErrWrongKey = errors.New("backup was encrypted with a different key")
+
+// Entry is one certificate as backed up, with its chain and private key
+type Entry struct {
+	Name        string    `json:"name"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Host        string    `json:"host"`
+	Source      string    `json:"source"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate []byte    `json:"certificate"`
+	Chain       []byte    `json:"chain,omitempty"`
+	PrivateKey  []byte    `json:"private_key"`
+	BackedUpAt  time.Time `json:"backed_up_at"`
+}
+
+// NewEntry describes a PEM certificate, chain and key for backup
+func NewEntry(host, tenant, name, source string, certificate, chain, key []byte) (*Entry, error) {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return nil, fmt.Errorf("certificate %s is not PEM", name)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate %s: %w", name, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("certificate %s has no private key", name)
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	return &Entry{
+		Name:        name,
+		Tenant:      tenant,
+		Host:        host,
+		Source:      source,
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotAfter:    leaf.NotAfter.UTC(),
+		Certificate: certificate,
+		Chain:       chain,
+		PrivateKey:  key,
+		BackedUpAt:  time.Now().UTC(),
+	}, nil
+}
+
+// Dir is the entry's folder under the bucket prefix:
+// <host>/[<tenant>/]<name>/
+func (e *Entry) Dir() string {
+	parts := []string{e.Host}
+	if e.Tenant != "" {
+		parts = append(parts, e.Tenant)
+	}
+	return path.Join(append(parts, e.Name)...) + "/"
+}
+
+// Objects returns the keys the entry is written to, relative to the
+// prefix: one named by fingerprint that is never overwritten, and latest
+func (e *Entry) Objects(ext string) []string {
+	return []string{e.Dir() + e.Fingerprint + ext, e.Dir() + LATEST + ext}
+}
+
+// Cipher encrypts backups on the host and decrypts them on restore
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(sealed []byte) ([]byte, error)
+	// Extension of the objects it writes
+	Extension() string
+}
+
+// Seal encodes and encrypts an entry
+func Seal(c Cipher, e *Entry) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return c.Encrypt(data)
+}
+
+// Unseal decrypts and decodes an entry
+func Unseal(c Cipher, sealed []byte) (*Entry, error) {
+	data, err := c.Decrypt(sealed)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	return &e, nil
+}
+
+// ParseKey reads a 32-byte AES key written as base64 or hex
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == AES_KEY_SIZE {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == AES_KEY_SIZE {
+		return key, nil
+	}
+	return nil, fmt.Errorf("backup key must be %d bytes, base64 or hex (e.g. from 'openssl rand -base64 32')", AES_KEY_SIZE)
+}
+
+type aesCipher struct {
+	aead cipher.AEAD
+	id   []byte
+}
+
+// NewAES encrypts with AES-256-GCM; the same key restores
+func NewAES(key []byte) (Cipher, error) {
+	if len(key) != AES_KEY_SIZE {
+		return nil, fmt.Errorf("backup key must be %d bytes", AES_KEY_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &aesCipher{aead: aead, id: sum[:8]}, nil
+}
+
+func (c *aesCipher) Extension() string {
+	return EXTENSION_AES
+}
+
+// Encrypt writes magic, key ID, nonce and ciphertext; the header is
+// authenticated with the data
+func (c *aesCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	header := append(append([]byte{}, aesMagic...), c.id...)
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return c.aead.Seal(out, nonce, plaintext, header), nil
+}
+
+func (c *aesCipher) Decrypt(sealed []byte) ([]byte, error) {
+	headerSize := len(aesMagic) + len(c.id)
+	if len(sealed) < headerSize+c.aead.NonceSize() || !bytes.HasPrefix(sealed, aesMagic) {
+		return nil, fmt.Errorf("not an AES-GCM backup")
+	}
+	header := sealed[:headerSize]
+	if !bytes.Equal(header[len(aesMagic):], c.id) {
+		return nil, ErrWrongKey
+	}
+	nonce := sealed[headerSize : headerSize+c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, sealed[headerSize+len(nonce):], header)
+	if err != nil {
+		return nil, fmt.Errorf("backup is corrupt or was tampered with")
+	}
+	return plaintext, nil
+}
+
+type ageCipher struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewAge encrypts to age recipients (age1...), so the host holds no key
+// that could read its backups; restores need a matching identity
+func NewAge(recipients []string, identities []age.Identity) (Cipher, error) {
+	c := &ageCipher{identities: identities}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", r, err)
+		}
+		c.recipients = append(c.recipients, recipient)
+	}
+	return c, nil
+}
+
+// ParseIdentities reads an age identity file (AGE-SECRET-KEY-1...)
+func ParseIdentities(r io.Reader) ([]age.Identity, error) {
+	return age.ParseIdentities(r)
+}
+
+func (c *ageCipher) Extension() string {
+	return EXTENSION_AGE
+}
+
+func (c *ageCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	if len(c.recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients")
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, c.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *ageCipher) Decrypt(sealed []byte) ([]byte, error) {
+	if len(c.identities) == 0 {
+		return nil, fmt.Errorf("no age identity to decrypt with")
+	}
+	r, err := age.Decrypt(bytes.NewReader(sealed), c.identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, ErrWrongKey
+		}
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
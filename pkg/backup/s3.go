@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/awsauth"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	S3_TIMEOUT = 60 * time.Second
+	// Backups are a few kilobytes; anything larger isn't one
+	MAX_OBJECT_SIZE = 1 << 20
+)
+
+var ErrNotExist = errors.New("backup not found")
+
+// S3Options configure the bucket. Without static keys the agent uses
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY and then the EC2 instance
+// profile, which needs s3:PutObject, and s3:GetObject and s3:ListBucket to
+// restore.
+type S3Options struct {
+	Bucket string `json:"bucket"`
+	// Region defaults to AWS_REGION; S3-compatible services mostly accept
+	// any, us-east-1 when none is set
+	Region string `json:"region,omitempty"`
+	// Base URL of an S3-compatible service (MinIO, Ceph, R2, ...); AWS
+	// when empty
+	Endpoint string `json:"endpoint,omitempty"`
+	// Address the bucket as <endpoint>/<bucket> rather than
+	// <bucket>.<endpoint>, as most S3-compatible services expect
+	PathStyle bool `json:"path_style,omitempty"`
+	// Prepended to every object key, e.g. "certfix/"
+	Prefix          string `json:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// Bucket reads and writes backup objects
+type Bucket struct {
+	opts   S3Options
+	base   *url.URL
+	client *http.Client
+	creds  *awsauth.Source
+}
+
+// NewBucket checks the options; the secret access key must already be
+// resolved
+func NewBucket(opts S3Options) (*Bucket, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("no bucket configured")
+	}
+	if opts.Region == "" {
+		opts.Region = os.Getenv("AWS_REGION")
+	}
+	if opts.Region == "" {
+		opts.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + opts.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || base.Host == "" || (base.Scheme != "https" && base.Scheme != "http") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if opts.PathStyle {
+		base.Path += "/" + opts.Bucket
+	} else {
+		base.Host = opts.Bucket + "." + base.Host
+	}
+
+	creds := awsauth.FromEnvironment()
+	if opts.AccessKeyID != "" {
+		creds = &awsauth.Credentials{AccessKeyID: opts.AccessKeyID, SecretAccessKey: opts.SecretAccessKey, Token: opts.SessionToken}
+	}
+	if creds != nil && creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("backup bucket requires secret_access_key with access_key_id")
+	}
+	if creds != nil {
+		redact.AddSecret(creds.SecretAccessKey)
+	}
+	return &Bucket{opts: opts, base: base, client: httpclient.New(S3_TIMEOUT), creds: awsauth.NewSource(creds)}, nil
+}
+
+// String names the bucket for logs
+func (b *Bucket) String() string {
+	return "s3://" + b.opts.Bucket + "/" + b.opts.Prefix
+}
+
+// Put writes an object under the prefix
+func (b *Bucket) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := b.do(ctx, "PUT", b.objectURL(key), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PutObject", resp)
+	}
+	return nil
+}
+
+// Get reads an object under the prefix; ErrNotExist when there is none
+func (b *Bucket) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := b.do(ctx, "GET", b.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("GetObject", resp)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_OBJECT_SIZE))
+}
+
+// List returns the keys under the prefix that start with dir, relative to
+// the prefix
+func (b *Bucket) List(ctx context.Context, dir string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {b.opts.Prefix + dir}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := *b.base
+		u.Path += "/"
+		u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+		resp, err := b.do(ctx, "GET", &u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("ListObjectsV2", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bucket listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, b.opts.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *Bucket) objectURL(key string) *url.URL {
+	u := *b.base
+	var escaped []string
+	for _, segment := range strings.Split(b.opts.Prefix+key, "/") {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	u.Path += "/" + b.opts.Prefix + key
+	u.RawPath = b.base.EscapedPath() + "/" + strings.Join(escaped, "/")
+	return &u
+}
+
+func (b *Bucket) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	creds, err := b.creds.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	awsauth.SignV4(req, body, creds, b.opts.Region, "s3", time.Now())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("backup bucket unreachable: %w", err)
+	}
+	return resp, nil
+}
+
+// s3Error reads the code and message of an S3 error response
+func s3Error(op string, resp *http.Response) error {
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return fmt.Errorf("%s failed: %s: %s", op, apiErr.Code, apiErr.Message)
+	}
+	return fmt.Errorf("%s failed with status %d", op, resp.StatusCode)
+}
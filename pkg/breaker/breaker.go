@@ -0,0 +1,140 @@
+// Package breaker implements a circuit breaker for calls to the API, so an
+// outage turns into a few spaced-out probes instead of a request per tick.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_CLOSED    = "closed"
+	STATE_OPEN      = "open"
+	STATE_HALF_OPEN = "half-open"
+
+	// Consecutive trips double the cooldown up to this ceiling
+	MAX_COOLDOWN = 30 * time.Minute
+)
+
+// ErrOpen is returned by Allow while the breaker is cooling down
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError tells the caller how long until the next probe is allowed
+type OpenError struct {
+	RetryIn time.Duration
+}
+
+func (e *OpenError) Error() string {
+	if e.RetryIn <= 0 {
+		return fmt.Sprintf("%v (probe in progress)", ErrOpen)
+	}
+	return fmt.Sprintf("%v (retry in %v)", ErrOpen, e.RetryIn.Round(time.Second))
+}
+
+func (e *OpenError) Unwrap() error {
+	return ErrOpen
+}
+
+// Breaker trips after threshold consecutive failures. While open every call
+// is rejected; after the cooldown a single probe is let through, and its
+// outcome either closes the breaker or re-opens it with a longer cooldown.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	trips     int
+	openUntil time.Time
+	probing   bool
+}
+
+// New returns a closed breaker
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: STATE_CLOSED}
+}
+
+// Allow reports whether a call may proceed; every allowed call must be
+// followed by Record
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case STATE_OPEN:
+		now := time.Now()
+		if now.Before(b.openUntil) {
+			return &OpenError{RetryIn: b.openUntil.Sub(now)}
+		}
+		b.state = STATE_HALF_OPEN
+		b.probing = true
+		return nil
+	case STATE_HALF_OPEN:
+		if b.probing {
+			return &OpenError{}
+		}
+		b.probing = true
+		return nil
+	}
+	return nil
+}
+
+// Record feeds the outcome of an allowed call back into the breaker
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.state = STATE_CLOSED
+		b.failures = 0
+		b.trips = 0
+		return
+	}
+
+	b.failures++
+	if b.state == STATE_HALF_OPEN || b.failures >= b.threshold {
+		b.trip()
+	}
+}
+
+func (b *Breaker) trip() {
+	cooldown := b.cooldown
+	for i := 0; i < b.trips && cooldown < MAX_COOLDOWN; i++ {
+		cooldown *= 2
+	}
+	if cooldown > MAX_COOLDOWN {
+		cooldown = MAX_COOLDOWN
+	}
+
+	b.trips++
+	b.state = STATE_OPEN
+	b.openUntil = time.Now().Add(cooldown)
+}
+
+// Hold opens the breaker for d, as when the server asks callers to back
+// off, without lengthening later cooldowns. A longer hold in place is kept.
+func (b *Breaker) Hold(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if b.state == STATE_OPEN && b.openUntil.After(until) {
+		return
+	}
+	b.state = STATE_OPEN
+	b.openUntil = until
+	b.probing = false
+}
+
+// State returns the current state name
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,344 @@
+// Package caa checks Certification Authority Authorization records
+// (RFC 8659) before a certificate is ordered, so names whose owner doesn't
+// allow the CA fail locally with a clear reason instead of spending an
+// ACME order, and the CA's rate limits, on a validation that can't pass.
+package caa
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/certfix/certfix-agent/pkg/dns01"
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+)
+
+const (
+	TYPE_CAA dnsmessage.Type = 257
+
+	TAG_ISSUE     = "issue"
+	TAG_ISSUEWILD = "issuewild"
+
+	// Issuer critical flag: a CA must refuse records it doesn't understand
+	// when it is set
+	FLAG_CRITICAL = 0x80
+
+	// RFC 8657 parameters
+	PARAM_ACCOUNT_URI        = "accounturi"
+	PARAM_VALIDATION_METHODS = "validationmethods"
+
+	QUERY_TIMEOUT = 5 * time.Second
+	MAX_CNAMES    = 8
+	UDP_SIZE      = 4096
+)
+
+// Property tags CAs know; other tags marked critical forbid issuance
+var knownTags = []string{TAG_ISSUE, TAG_ISSUEWILD, "iodef", "contactemail", "contactphone", "issuemail", "issuevmc"}
+
+// Record is one CAA property
+type Record struct {
+	Flags uint8  `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%d %s %q", r.Flags, r.Tag, r.Value)
+}
+
+// CA is what the records are checked against
+type CA struct {
+	// Identities are the issuer domain names the CA recognizes as its own
+	Identities []string
+	// AccountURI and Method are matched against RFC 8657 parameters when
+	// known
+	AccountURI string
+	Method     string
+}
+
+// ForbiddenError is a name whose CAA records don't allow the CA
+type ForbiddenError struct {
+	Name   string
+	Issuer string
+	// At is where the relevant record set was found, Name or a parent
+	At      string
+	Records []Record
+	Reason  string
+}
+
+func (e *ForbiddenError) Error() string {
+	msg := fmt.Sprintf("CAA forbids issuer %s for %s", e.Issuer, e.Name)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	values := make([]string, len(e.Records))
+	for i, r := range e.Records {
+		values[i] = r.String()
+	}
+	return fmt.Sprintf("%s (records at %s: %s)", msg, e.At, strings.Join(values, ", "))
+}
+
+// Check finds the relevant record set of every name and returns a
+// *ForbiddenError for the first one that doesn't permit ca. Names whose
+// lookup fails are still checked after them; the first lookup error is
+// returned only if nothing was forbidden. IP addresses have no CAA.
+func Check(ctx context.Context, names []string, ca CA) error {
+	var lookupErr error
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			continue
+		}
+		at, records, err := Lookup(ctx, name)
+		if err != nil {
+			if lookupErr == nil {
+				lookupErr = err
+			}
+			continue
+		}
+		if ok, reason := Permits(records, strings.HasPrefix(name, "*."), ca); !ok {
+			return &ForbiddenError{Name: name, Issuer: strings.Join(ca.Identities, "/"), At: at, Records: records, Reason: reason}
+		}
+	}
+	return lookupErr
+}
+
+// Permits decides whether a relevant record set lets ca issue for a name.
+// An empty set, or one without issue properties, permits any CA.
+func Permits(records []Record, wildcard bool, ca CA) (bool, string) {
+	tag := TAG_ISSUE
+	for _, r := range records {
+		if r.Flags&FLAG_CRITICAL != 0 && !slices.Contains(knownTags, r.Tag) {
+			return false, fmt.Sprintf("unknown critical property %q", r.Tag)
+		}
+		if wildcard && r.Tag == TAG_ISSUEWILD {
+			tag = TAG_ISSUEWILD
+		}
+	}
+
+	restricted, reason := false, ""
+	for _, r := range records {
+		if r.Tag != tag {
+			continue
+		}
+		restricted = true
+		domain, params := parseValue(r.Value)
+		if domain == "" || !slices.Contains(ca.Identities, domain) {
+			continue
+		}
+		if uri, ok := params[PARAM_ACCOUNT_URI]; ok && ca.AccountURI != "" && uri != ca.AccountURI {
+			reason = fmt.Sprintf("only account %s may issue", uri)
+			continue
+		}
+		if methods, ok := params[PARAM_VALIDATION_METHODS]; ok && ca.Method != "" && !slices.Contains(strings.Split(methods, ","), ca.Method) {
+			reason = fmt.Sprintf("only %s validation is allowed", methods)
+			continue
+		}
+		return true, ""
+	}
+	return !restricted, reason
+}
+
+// parseValue splits "issuer.example; key=value; ..." into the issuer domain
+// and its parameters. A bare ";" names no issuer at all.
+func parseValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	domain := strings.ToLower(strings.TrimSpace(parts[0]))
+	params := map[string]string{}
+	for _, part := range parts[1:] {
+		key, val, found := strings.Cut(strings.TrimSpace(part), "=")
+		if found {
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(val)
+		}
+	}
+	return domain, params
+}
+
+// Lookup climbs from name towards the top-level domain and returns the
+// first non-empty record set and where it was found. No records anywhere
+// returns an empty set. Wildcards are looked up at their base name.
+func Lookup(ctx context.Context, name string) (string, []Record, error) {
+	name = strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(name), "."), "*.")
+	if ascii, err := idn.ToASCII(name); err == nil {
+		name = ascii
+	}
+	for strings.Contains(name, ".") {
+		records, err := lookupAt(ctx, name, 0)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to look up CAA records of %s: %w", name, err)
+		}
+		if len(records) > 0 {
+			return name, records, nil
+		}
+		name = name[strings.Index(name, ".")+1:]
+	}
+	return "", nil, nil
+}
+
+// lookupAt asks the zone's authoritative servers, like the DNS-01
+// propagation check, so a caching resolver can't answer with stale records
+func lookupAt(ctx context.Context, name string, cnames int) ([]Record, error) {
+	_, servers, err := dns01.FindZone(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, server := range servers {
+		records, target, err := query(ctx, server, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if target == "" {
+			return records, nil
+		}
+		if cnames >= MAX_CNAMES {
+			return nil, fmt.Errorf("too many CNAMEs at %s", name)
+		}
+		return lookupAt(ctx, target, cnames+1)
+	}
+	return nil, lastErr
+}
+
+// query returns the CAA records at name, or the CNAME target to follow
+// when the server doesn't hold the records behind it
+func query(ctx context.Context, server, name string) ([]Record, string, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, "", err
+	}
+	request := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.N(1 << 16))},
+		Questions: []dnsmessage.Question{{Name: qname, Type: TYPE_CAA, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(UDP_SIZE, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, "", err
+	}
+	request.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode query: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	response, err := exchange(ctx, "udp", server, packed, request.ID)
+	if err == nil && response.Truncated {
+		response, err = exchange(ctx, "tcp", server, packed, request.ID)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("%s answered %s", server, response.RCode)
+	}
+
+	// Follow the CNAME chain within the answer to the records at its end
+	owners := map[string][]Record{}
+	cnames := map[string]string{}
+	for _, answer := range response.Answers {
+		owner := strings.ToLower(answer.Header.Name.String())
+		switch body := answer.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			cnames[owner] = strings.ToLower(body.CNAME.String())
+		case *dnsmessage.UnknownResource:
+			if body.Type != TYPE_CAA {
+				continue
+			}
+			record, err := parseRecord(body.Data)
+			if err != nil {
+				return nil, "", err
+			}
+			owners[owner] = append(owners[owner], record)
+		}
+	}
+	current := name + "."
+	for range MAX_CNAMES {
+		target, ok := cnames[current]
+		if !ok {
+			break
+		}
+		current = target
+	}
+	if records := owners[current]; len(records) > 0 || current == name+"." {
+		return records, "", nil
+	}
+	return nil, strings.TrimSuffix(current, "."), nil
+}
+
+func exchange(ctx context.Context, network, server string, request []byte, id uint16) (*dnsmessage.Message, error) {
+	dialer := netdial.Dialer{Timeout: QUERY_TIMEOUT, Resolver: securedns.Resolver()}
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		// DNS over TCP prefixes every message with its length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(request)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, UDP_SIZE)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", server, err)
+	}
+	if response.ID != id {
+		return nil, fmt.Errorf("mismatched response from %s", server)
+	}
+	return &response, nil
+}
+
+// parseRecord decodes CAA RDATA: flags, tag length, tag, value
+func parseRecord(data []byte) (Record, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return Record{}, fmt.Errorf("malformed CAA record")
+	}
+	tagEnd := 2 + int(data[1])
+	return Record{
+		Flags: data[0],
+		Tag:   strings.ToLower(string(data[2:tagEnd])),
+		Value: string(data[tagEnd:]),
+	}, nil
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+// CheckIn is everything a metered agent reports in one request: its
+// heartbeat, the events raised since the last check-in and its inventory,
+// as a delta when the server has the report it is based on
+type CheckIn struct {
+	Heartbeat      *HeartbeatData    `json:"heartbeat"`
+	Events         []events.Event    `json:"events,omitempty"`
+	Inventory      *inventory.Report `json:"inventory,omitempty"`
+	InventoryDelta *inventory.Delta  `json:"inventory_delta,omitempty"`
+}
+
+// CheckInResponse is what the server has for a metered agent
+type CheckInResponse struct {
+	// The server has no report the delta applies to; the next check-in
+	// sends the whole inventory
+	ResyncInventory bool `json:"resync_inventory,omitempty"`
+	// Tasks waiting for the agent; nil when the server doesn't say
+	TasksPending *int `json:"tasks_pending,omitempty"`
+}
+
+// CheckIn sends a check-in gzip-compressed; the signature covers the
+// compressed body
+func (c *Client) CheckIn(ctx context.Context, instanceID string, checkIn *CheckIn) (_ *CheckInResponse, err error) {
+	defer c.observe("check-in", time.Now(), &err)
+	var body bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&body, gzip.BestCompression)
+	if err := json.NewEncoder(zw).Encode(checkIn); err != nil {
+		return nil, fmt.Errorf("failed to marshal check-in request: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress check-in request: %w", err)
+	}
+
+	req, err := c.NewRequest(ctx, "POST", instancePath(instanceID, "checkin"), &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create check-in request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := c.Do(req, UPLOAD_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send check-in request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("check-in", resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	var out CheckInResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to parse check-in response: %w", err)
+	}
+	return &out, nil
+}
@@ -0,0 +1,202 @@
+// Package client talks to the CertFix API: registration, heartbeats,
+// inventory uploads and the task channel. Every request is authenticated
+// and signed the same way, so tools other than the agent can reuse it
+// without copying request code.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+)
+
+const (
+	DEFAULT_TIMEOUT = 10 * time.Second
+	UPLOAD_TIMEOUT  = 30 * time.Second
+	STREAM_TIMEOUT  = 60 * time.Second
+	CHECK_TIMEOUT   = 60 * time.Second
+
+	// Error bodies are only kept for the message
+	MAX_ERROR_BODY = 4096
+)
+
+// Options configure a Client
+type Options struct {
+	// Endpoint is the API base URL, e.g. https://api.certfix.io/v1
+	Endpoint string
+	// Token is the instance credential; empty when SPIFFE authenticates
+	// the connection instead
+	Token string
+	// Transport defaults to the agent's shared transport, which carries the
+	// configured TLS policy and pins
+	Transport http.RoundTripper
+	// Clock receives skew measurements from response Date headers and
+	// dates signed requests; a private tracker is used when nil
+	Clock *clockcheck.Tracker
+	// OnDeprecation is called for each response announcing that its
+	// endpoint is deprecated
+	OnDeprecation func(*Deprecation)
+	// Observe is called after each API call with its name (e.g.
+	// "heartbeat"), how long it took and its error
+	Observe func(op string, duration time.Duration, err error)
+}
+
+// Client is a CertFix API client. It is safe for concurrent use.
+type Client struct {
+	endpoint  string
+	token     string
+	transport http.RoundTripper
+	clock     *clockcheck.Tracker
+
+	onDeprecation func(*Deprecation)
+	onObserve     func(string, time.Duration, error)
+}
+
+// New creates a client
+func New(opts Options) *Client {
+	c := &Client{
+		endpoint:  strings.TrimRight(opts.Endpoint, "/"),
+		token:     opts.Token,
+		transport: opts.Transport,
+		clock:     opts.Clock,
+
+		onDeprecation: opts.OnDeprecation,
+		onObserve:     opts.Observe,
+	}
+	if c.transport == nil {
+		c.transport = httpclient.RoundTripper()
+	}
+	if c.clock == nil {
+		c.clock = &clockcheck.Tracker{}
+	}
+	return c
+}
+
+// StatusError is returned when the API answers with an unexpected status
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+	// The parsed body, when the API sent a structured error
+	API *APIError
+	// From the Retry-After header; zero when absent
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.API == nil {
+		return fmt.Sprintf("%s failed with status %d: %s", e.Op, e.StatusCode, e.Body)
+	}
+	msg := fmt.Sprintf("%s failed with status %d: %s (%s)", e.Op, e.StatusCode, e.API.Message, e.API.Code)
+	if e.API.RemediationURL != "" {
+		msg += "; see " + e.API.RemediationURL
+	}
+	return msg
+}
+
+// NewRequest builds an authenticated request for path, relative to the
+// endpoint. A non-nil body is sent as JSON, and a key set with
+// WithIdempotencyKey goes in the Idempotency-Key header.
+func (c *Client) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key := idempotencyKey(ctx); key != "" {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+	c.authenticate(req)
+	return req, nil
+}
+
+// Do sends a request with an overall timeout, recording clock skew from the
+// response. The caller closes the body.
+func (c *Client) Do(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	httpClient := &http.Client{Transport: c.transport, Timeout: timeout}
+	sent := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.clock.Observe(resp, sent, time.Now())
+	if c.onDeprecation != nil {
+		if d := parseDeprecation(resp); d != nil {
+			c.onDeprecation(d)
+		}
+	}
+	return resp, nil
+}
+
+// call sends in as JSON and decodes the response into out, when given.
+// Statuses not accepted by checkStatus become a StatusError.
+func (c *Client) call(ctx context.Context, op, method, path string, in, out interface{}, timeout time.Duration, ok ...int) (err error) {
+	defer c.observe(op, time.Now(), &err)
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s request: %w", op, err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := c.NewRequest(ctx, method, path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", op, err)
+	}
+	resp, err := c.Do(req, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to send %s request: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(op, resp, ok...); err != nil {
+		return err
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to parse %s response: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// observe reports a call to Options.Observe; it is deferred with a pointer
+// to the call's error
+func (c *Client) observe(op string, started time.Time, err *error) {
+	if c.onObserve != nil {
+		c.onObserve(op, time.Since(started), *err)
+	}
+}
+
+// checkStatus accepts the listed statuses, or any 2xx when none are listed
+func checkStatus(op string, resp *http.Response, ok ...int) error {
+	if len(ok) == 0 && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY))
+	return &StatusError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		API:        parseAPIError(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
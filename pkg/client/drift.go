@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/certfix/certfix-agent/pkg/drift"
+)
+
+// DriftResponse acknowledges a drift report
+type DriftResponse struct {
+	// Redeployments the server queued when remediation was requested
+	Queued int `json:"queued"`
+}
+
+type desiredState struct {
+	Deployments []*drift.Expected `json:"deployments"`
+}
+
+// DesiredDeployments returns what the server expects to be deployed on an
+// instance
+func (c *Client) DesiredDeployments(ctx context.Context, instanceID string) ([]*drift.Expected, error) {
+	var state desiredState
+	if err := c.call(ctx, "desired state", "GET", instancePath(instanceID, "deployments"), nil, &state, DEFAULT_TIMEOUT, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return state.Deployments, nil
+}
+
+// ReportDrift uploads the result of a drift check
+func (c *Client) ReportDrift(ctx context.Context, instanceID string, report *drift.Report) (*DriftResponse, error) {
+	var resp DriftResponse
+	if err := c.call(ctx, "drift report", "POST", instancePath(instanceID, "drift"), report, &resp, UPLOAD_TIMEOUT,
+		http.StatusOK, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codes the API puts in structured error bodies
+const (
+	CODE_INSTANCE_NOT_FOUND      = "instance_not_found"
+	CODE_INSTANCE_DELETED        = "instance_deleted"
+	CODE_TOKEN_EXPIRED           = "token_expired"
+	CODE_TOKEN_ROTATION_REQUIRED = "token_rotation_required"
+	CODE_TOKEN_REVOKED           = "token_revoked"
+	CODE_RATE_LIMITED            = "rate_limited"
+	CODE_SERVICE_UNAVAILABLE     = "service_unavailable"
+	CODE_AGENT_UNSUPPORTED       = "agent_version_unsupported"
+	CODE_ENDPOINT_REMOVED        = "endpoint_removed"
+	CODE_PLAN_LIMIT              = "plan_limit_exceeded"
+)
+
+// What the agent does about a failed call
+const (
+	// Retry as usual
+	ACTION_NONE = ""
+	// Register the instance again
+	ACTION_REREGISTER = "reregister"
+	// Exchange the token for a new one
+	ACTION_ROTATE_TOKEN = "rotate_token"
+	// Stop calling the API for a while
+	ACTION_BACK_OFF = "back_off"
+	// Nothing the agent can do; someone has to step in
+	ACTION_OPERATOR = "operator"
+)
+
+var codeActions = map[string]string{
+	CODE_INSTANCE_NOT_FOUND:      ACTION_REREGISTER,
+	CODE_INSTANCE_DELETED:        ACTION_REREGISTER,
+	CODE_TOKEN_EXPIRED:           ACTION_ROTATE_TOKEN,
+	CODE_TOKEN_ROTATION_REQUIRED: ACTION_ROTATE_TOKEN,
+	CODE_TOKEN_REVOKED:           ACTION_OPERATOR,
+	CODE_RATE_LIMITED:            ACTION_BACK_OFF,
+	CODE_SERVICE_UNAVAILABLE:     ACTION_BACK_OFF,
+	CODE_AGENT_UNSUPPORTED:       ACTION_OPERATOR,
+	CODE_ENDPOINT_REMOVED:        ACTION_OPERATOR,
+	CODE_PLAN_LIMIT:              ACTION_OPERATOR,
+}
+
+// APIError is the structured body of an API error response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Where an operator reads how to fix it
+	RemediationURL string `json:"remediation_url,omitempty"`
+}
+
+// parseAPIError reads an error body, either the error object itself or one
+// wrapped in "error"; nil when the body isn't one
+func parseAPIError(body []byte) *APIError {
+	var wrapped struct {
+		Error *APIError `json:"error"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && wrapped.Error != nil && wrapped.Error.Code != "" {
+		return wrapped.Error
+	}
+	var bare APIError
+	if json.Unmarshal(body, &bare) == nil && bare.Code != "" {
+		return &bare
+	}
+	return nil
+}
+
+// Action returns what the agent should do about err. Codes the agent
+// doesn't know fall back to the status: a vanished instance is registered
+// again and throttling or unavailability backs off.
+func Action(err error) string {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return ACTION_NONE
+	}
+	if statusErr.API != nil {
+		if action, ok := codeActions[statusErr.API.Code]; ok {
+			return action
+		}
+	}
+	switch statusErr.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return ACTION_REREGISTER
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return ACTION_BACK_OFF
+	}
+	return ACTION_NONE
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as a date;
+// zero when absent
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// Deprecation is the API announcing, in the Deprecation and Sunset
+// headers, that an endpoint the agent called is going away
+type Deprecation struct {
+	Method string
+	Path   string
+	// When the endpoint stops working; zero when not announced
+	Sunset time.Time
+	// Documentation linked from the response, if any
+	Link string
+}
+
+// parseDeprecation reads the deprecation headers of a response; nil when
+// the endpoint isn't deprecated
+func parseDeprecation(resp *http.Response) *Deprecation {
+	header := strings.TrimSpace(resp.Header.Get("Deprecation"))
+	if header == "" || header == "false" {
+		return nil
+	}
+	d := &Deprecation{Method: resp.Request.Method, Path: resp.Request.URL.Path}
+	if sunset, err := http.ParseTime(resp.Header.Get("Sunset")); err == nil {
+		d.Sunset = sunset
+	}
+	// Link: <https://...>; rel="deprecation"
+	for _, link := range resp.Header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			target, params, _ := strings.Cut(part, ";")
+			if strings.Contains(params, "deprecation") || strings.Contains(params, "sunset") {
+				d.Link = strings.Trim(strings.TrimSpace(target), "<>")
+				return d
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/replay"
+)
+
+// Header naming an operation the server performs at most once: a retry
+// carrying the same key gets the first attempt's response instead of
+// creating a second instance or record
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+type idempotencyKeyContext struct{}
+
+// NewIdempotencyKey returns a random key for an operation that may be
+// retried. Keep it until the server has answered; Settled tells when.
+func NewIdempotencyKey() string {
+	return replay.NewNonce()
+}
+
+// WithIdempotencyKey makes requests created with ctx carry key
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContext{}).(string)
+	return key
+}
+
+// withDerivedKey keys an operation by what identifies it, when the caller
+// gave no key, so retries after a restart still match the first attempt
+func withDerivedKey(ctx context.Context, parts ...string) context.Context {
+	if idempotencyKey(ctx) != "" {
+		return ctx
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return WithIdempotencyKey(ctx, hex.EncodeToString(sum[:16]))
+}
+
+// Settled reports whether the server gave a final answer to a call, so its
+// idempotency key can be dropped. After a network error, a timeout or a
+// 5xx the outcome is unknown and a retry must reuse the key.
+func Settled(err error) bool {
+	if err == nil {
+		return true
+	}
+	var status *StatusError
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch status.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		// 409 is how servers report the first attempt is still in progress
+		return false
+	}
+	return status.StatusCode < 500
+}
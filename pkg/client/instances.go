@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/clockcheck"
+	"github.com/certfix/certfix-agent/pkg/netinfo"
+)
+
+// InstanceData describes the host at registration
+type InstanceData struct {
+	MachineID    string                 `json:"machine_id"`
+	Hostname     string                 `json:"hostname"`
+	OSType       string                 `json:"os_type"`
+	OSVersion    string                 `json:"os_version"`
+	Architecture string                 `json:"architecture"`
+	IPAddress    string                 `json:"ip_address,omitempty"`
+	IPv6Address  string                 `json:"ipv6_address,omitempty"`
+	MACAddress   string                 `json:"mac_address,omitempty"`
+	Interfaces   []netinfo.Interface    `json:"interfaces,omitempty"`
+	AgentVersion string                 `json:"agent_version"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	// Public key that signs this instance's deployment receipts
+	ReceiptKey string `json:"receipt_public_key,omitempty"`
+}
+
+// HeartbeatData reports clock health with each heartbeat, and whether the
+// agent is in maintenance
+type HeartbeatData struct {
+	ClockSkewSeconds *float64              `json:"clock_skew_seconds,omitempty"`
+	NTP              *clockcheck.NTPStatus `json:"ntp,omitempty"`
+	Maintenance      *Maintenance          `json:"maintenance,omitempty"`
+}
+
+// Maintenance is a freeze the server put the agent in: no renewals or
+// deployments until it is released, or until Until when set
+type Maintenance struct {
+	Reason string     `json:"reason,omitempty"`
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+	// The task that started it
+	TaskID string `json:"task_id,omitempty"`
+}
+
+// RegisterResponse identifies the registered instance
+type RegisterResponse struct {
+	InstanceID  string `json:"instance_id"`
+	KeyID       string `json:"key_id"`
+	ServiceHash string `json:"service_hash"`
+	ServiceName string `json:"service_name"`
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+}
+
+// Register registers the host, or finds its existing instance by machine
+// ID. Retries should reuse an idempotency key set on ctx, so a registration
+// whose response was lost does not create a second instance.
+func (c *Client) Register(ctx context.Context, data *InstanceData) (*RegisterResponse, error) {
+	var resp RegisterResponse
+	if err := c.call(ctx, "registration", "POST", "/instances/register", data, &resp, DEFAULT_TIMEOUT, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Heartbeat updates the instance's last_seen_at
+func (c *Client) Heartbeat(ctx context.Context, instanceID string, data *HeartbeatData) error {
+	return c.call(ctx, "heartbeat", "PUT", instancePath(instanceID, "heartbeat"), data, nil, DEFAULT_TIMEOUT, http.StatusOK)
+}
+
+// RotateToken exchanges the instance's token, expired or due for rotation,
+// for a new one; requests made with the old token stop working
+func (c *Client) RotateToken(ctx context.Context, instanceID string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.call(ctx, "token rotation", "POST", instancePath(instanceID, "token"), nil, &resp, DEFAULT_TIMEOUT, http.StatusOK); err != nil {
+		return "", err
+	}
+	if resp.Token == "" {
+		return "", fmt.Errorf("token rotation returned no token")
+	}
+	return resp.Token, nil
+}
+
+func instancePath(instanceID string, parts ...string) string {
+	path := "/instances/" + url.PathEscape(instanceID)
+	for _, part := range parts {
+		path += "/" + part
+	}
+	return path
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/dnscheck"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+const (
+	// Inventories above this size are sent in chunks instead of one document
+	STREAM_THRESHOLD   = 1000
+	STREAM_CHUNK_SIZE  = 500
+	STREAM_CHUNK_TRIES = 3
+)
+
+// Header of a chunked inventory upload; certificates follow as NDJSON chunks
+type inventoryUploadStart struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Total       int               `json:"total"`
+	ChunkSize   int               `json:"chunk_size"`
+	DNSChecks   []dnscheck.Result `json:"dns_checks,omitempty"`
+	Errors      []string          `json:"errors,omitempty"`
+}
+
+type inventoryUploadSession struct {
+	UploadID string `json:"upload_id"`
+}
+
+type inventoryChunkAck struct {
+	Received int `json:"received"`
+}
+
+// UploadInventory uploads the certificate inventory for an instance
+func (c *Client) UploadInventory(ctx context.Context, instanceID string, report *inventory.Report) error {
+	// Very large inventories go in chunks, so no request body is built
+	// whole and a failure only resends one chunk
+	if len(report.Certificates) > STREAM_THRESHOLD {
+		return c.streamInventory(ctx, instanceID, report)
+	}
+	return c.call(ctx, "inventory upload", "POST", instancePath(instanceID, "inventory"), report, nil, UPLOAD_TIMEOUT,
+		http.StatusOK, http.StatusAccepted)
+}
+
+// Stream a large inventory as NDJSON chunks, each acknowledged by the API.
+// Only the encoding is bounded: the report itself is already complete in
+// memory, since drift detection, the PQ assessment and the stored last
+// inventory all work on the merged report.
+func (c *Client) streamInventory(ctx context.Context, instanceID string, report *inventory.Report) error {
+	base := instancePath(instanceID, "inventory", "uploads")
+
+	start := inventoryUploadStart{
+		GeneratedAt: report.GeneratedAt,
+		Total:       len(report.Certificates),
+		ChunkSize:   STREAM_CHUNK_SIZE,
+		DNSChecks:   report.DNSChecks,
+		Errors:      report.Errors,
+	}
+	var session inventoryUploadSession
+	if err := c.call(ctx, "inventory upload start", "POST", base, start, &session, STREAM_TIMEOUT); err != nil {
+		return fmt.Errorf("failed to start inventory upload: %w", err)
+	}
+	if session.UploadID == "" {
+		return fmt.Errorf("failed to start inventory upload: no upload id returned")
+	}
+
+	seq := 0
+	for offset := 0; offset < len(report.Certificates); offset += STREAM_CHUNK_SIZE {
+		end := offset + STREAM_CHUNK_SIZE
+		if end > len(report.Certificates) {
+			end = len(report.Certificates)
+		}
+		chunk := report.Certificates[offset:end]
+		path := fmt.Sprintf("%s/%s/chunks/%d", base, session.UploadID, seq)
+
+		var err error
+		for attempt := 1; attempt <= STREAM_CHUNK_TRIES; attempt++ {
+			if err = c.uploadChunk(ctx, path, chunk); err == nil {
+				break
+			}
+			log.Printf("[WARNING] Inventory chunk %d attempt %d failed: %v", seq, attempt, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upload inventory chunk %d: %w", seq, err)
+		}
+		seq++
+	}
+
+	if err := c.call(ctx, "inventory upload complete", "POST", base+"/"+session.UploadID+"/complete", map[string]int{"chunks": seq}, nil, STREAM_TIMEOUT); err != nil {
+		return fmt.Errorf("failed to complete inventory upload: %w", err)
+	}
+	return nil
+}
+
+// Send one chunk, encoding it straight into the request body
+func (c *Client) uploadChunk(ctx context.Context, path string, chunk []inventory.Certificate) (err error) {
+	defer c.observe("chunk upload", time.Now(), &err)
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		for i := range chunk {
+			if err := enc.Encode(&chunk[i]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	req, err := c.NewRequest(ctx, "PUT", path, pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("failed to create chunk request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.Do(req, STREAM_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("failed to send chunk: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("chunk upload", resp, http.StatusOK, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	var ack inventoryChunkAck
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return fmt.Errorf("failed to parse chunk acknowledgment: %w", err)
+	}
+	if ack.Received != len(chunk) {
+		return fmt.Errorf("server acknowledged %d of %d certificates", ack.Received, len(chunk))
+	}
+	return nil
+}
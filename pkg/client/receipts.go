@@ -0,0 +1,17 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/certfix/certfix-agent/pkg/receipt"
+)
+
+// UploadReceipt delivers one signed deployment receipt; receipts are sent
+// in chain order so the server can check each link as it arrives. The
+// signature keys the upload, so a resent receipt is not stored twice.
+func (c *Client) UploadReceipt(ctx context.Context, instanceID string, signed *receipt.Signed) error {
+	ctx = withDerivedKey(ctx, "receipt", instanceID, signed.Signature)
+	return c.call(ctx, "deployment receipt", "POST", instancePath(instanceID, "receipts"), signed, nil, UPLOAD_TIMEOUT,
+		http.StatusOK, http.StatusCreated, http.StatusAccepted)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+	"github.com/certfix/certfix-agent/pkg/verify"
+)
+
+const (
+	// The signing key manifest is small; anything bigger is not one
+	MAX_KEY_MANIFEST = 1 << 20
+)
+
+// FetchTasks returns the instance's pending tasks; none is not an error
+func (c *Client) FetchTasks(ctx context.Context, instanceID string) (_ []tasks.Task, err error) {
+	defer c.observe("task fetch", time.Now(), &err)
+
+	req, err := c.NewRequest(ctx, "GET", instancePath(instanceID, "tasks"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tasks request: %w", err)
+	}
+	resp, err := c.Do(req, DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tasks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if err := checkStatus("task fetch", resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var pending []tasks.Task
+	if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+		return nil, fmt.Errorf("failed to parse tasks: %w", err)
+	}
+	return pending, nil
+}
+
+// ReportTaskResult sends a task's outcome back to the API. Unless ctx
+// carries one, the idempotency key is derived from the task and the time it
+// finished, so a spooled result resent after a restart is not recorded twice.
+func (c *Client) ReportTaskResult(ctx context.Context, instanceID string, result *tasks.Result) error {
+	ctx = withDerivedKey(ctx, "task-result", instanceID, result.TaskID, result.FinishedAt.UTC().Format(time.RFC3339Nano))
+	return c.call(ctx, "task result", "POST", instancePath(instanceID, "tasks", result.TaskID, "result"), result, nil, UPLOAD_TIMEOUT,
+		http.StatusOK, http.StatusAccepted)
+}
+
+// KeyManifest fetches the signed manifest of command signing keys
+func (c *Client) KeyManifest(ctx context.Context) (_ []byte, err error) {
+	defer c.observe("key manifest fetch", time.Now(), &err)
+
+	req, err := c.NewRequest(ctx, "GET", "/signing/keys", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key manifest request: %w", err)
+	}
+	resp, err := c.Do(req, DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch key manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("key manifest fetch", resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_KEY_MANIFEST))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key manifest: %w", err)
+	}
+	return body, nil
+}
+
+// CheckTLS asks the API's external checker which certificate a target
+// serves, as seen from outside the host's network
+func (c *Client) CheckTLS(ctx context.Context, target verify.Target) (*verify.Result, error) {
+	var result verify.Result
+	if err := c.call(ctx, "external check", "POST", "/checks/tls", target, &result, CHECK_TIMEOUT, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
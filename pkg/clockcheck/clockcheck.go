@@ -0,0 +1,256 @@
+package clockcheck
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Skew beyond this breaks validity checks and token signatures
+	SKEW_WARNING_THRESHOLD = 30 * time.Second
+	COMMAND_TIMEOUT        = 5 * time.Second
+)
+
+// Validity states of a certificate at a given instant
+const (
+	VALIDITY_VALID         = "valid"
+	VALIDITY_NOT_YET_VALID = "not_yet_valid"
+	VALIDITY_EXPIRED       = "expired"
+)
+
+// NTPStatus describes the local time synchronization daemon
+type NTPStatus struct {
+	Source       string `json:"source"`
+	Synchronized bool   `json:"synchronized"`
+	// Positive when the local clock is ahead of the time source
+	Offset time.Duration `json:"offset,omitempty"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+// Tracker records the most recent skew measured against the API
+type Tracker struct {
+	mu         sync.RWMutex
+	skew       time.Duration
+	measured   bool
+	measuredAt time.Time
+	ntpOffset  time.Duration
+	ntpSource  string
+}
+
+// Assessment compares a certificate's validity on the local clock with its
+// validity once the measured drift is taken out
+type Assessment struct {
+	Local     string
+	Corrected string
+	Drift     time.Duration
+	// Where the drift was measured: "api", the NTP daemon's name, or empty
+	Source string
+}
+
+// Flips reports whether the drift changes the validity conclusion
+func (a Assessment) Flips() bool {
+	return a.Local != a.Corrected
+}
+
+// Observe estimates local clock skew from a response's Date header. The
+// server timestamp is compared against the midpoint of the request so
+// network latency doesn't count as skew. Positive skew means the local
+// clock is ahead of the server.
+func (t *Tracker) Observe(resp *http.Response, sent, received time.Time) {
+	skew, err := SkewFromResponse(resp, sent, received)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.skew = skew
+	t.measured = true
+	t.measuredAt = received
+	t.mu.Unlock()
+}
+
+// Skew returns the last measured skew and whether any measurement exists
+func (t *Tracker) Skew() (time.Duration, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.skew, t.measured
+}
+
+// ObserveNTP records the offset reported by the time synchronization
+// daemon, used when no skew has been measured against the API
+func (t *Tracker) ObserveNTP(status *NTPStatus) {
+	if status == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.ntpOffset = status.Offset
+	t.ntpSource = status.Source
+	t.mu.Unlock()
+}
+
+// Drift returns the clock error to compensate for and where it was
+// measured. Skew against the API wins over the NTP daemon's offset since
+// it is what validity is judged against on the server.
+func (t *Tracker) Drift() (time.Duration, string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	switch {
+	case t.measured:
+		return t.skew, "api"
+	case t.ntpSource != "":
+		return t.ntpOffset, t.ntpSource
+	default:
+		return 0, ""
+	}
+}
+
+// CorrectedNow returns the current time with the drift taken out
+func (t *Tracker) CorrectedNow() time.Time {
+	drift, _ := t.Drift()
+	return time.Now().Add(-drift)
+}
+
+// Evaluate judges a validity period at the local and the corrected time
+func (t *Tracker) Evaluate(notBefore, notAfter time.Time) Assessment {
+	drift, source := t.Drift()
+	now := time.Now()
+	return Assessment{
+		Local:     ValidityAt(notBefore, notAfter, now),
+		Corrected: ValidityAt(notBefore, notAfter, now.Add(-drift)),
+		Drift:     drift,
+		Source:    source,
+	}
+}
+
+// ValidityAt classifies a validity period at the given instant. A zero
+// bound is treated as open.
+func ValidityAt(notBefore, notAfter, at time.Time) string {
+	switch {
+	case !notBefore.IsZero() && at.Before(notBefore):
+		return VALIDITY_NOT_YET_VALID
+	case !notAfter.IsZero() && at.After(notAfter):
+		return VALIDITY_EXPIRED
+	default:
+		return VALIDITY_VALID
+	}
+}
+
+// ServerNow returns the current time corrected by the measured skew, i.e.
+// an estimate of the server's clock
+func (t *Tracker) ServerNow() time.Time {
+	skew, _ := t.Skew()
+	return time.Now().Add(-skew)
+}
+
+// SkewFromResponse computes skew from a single HTTP response
+func SkewFromResponse(resp *http.Response, sent, received time.Time) (time.Duration, error) {
+	header := resp.Header.Get("Date")
+	if header == "" {
+		return 0, fmt.Errorf("response has no Date header")
+	}
+
+	serverTime, err := http.ParseTime(header)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Date header %q: %w", header, err)
+	}
+
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	skew := midpoint.Sub(serverTime)
+
+	// The Date header has one second resolution; ignore sub-second noise
+	if skew > -time.Second && skew < time.Second {
+		return 0, nil
+	}
+	return skew.Round(time.Second), nil
+}
+
+// IsSignificant reports whether skew exceeds the warning threshold
+func IsSignificant(skew time.Duration) bool {
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew >= SKEW_WARNING_THRESHOLD
+}
+
+// Describe renders skew as "3s ahead"/"12s behind"
+func Describe(skew time.Duration) string {
+	switch {
+	case skew > 0:
+		return fmt.Sprintf("%v ahead of server", skew)
+	case skew < 0:
+		return fmt.Sprintf("%v behind server", -skew)
+	default:
+		return "in sync with server"
+	}
+}
+
+var chronyOffsetRe = regexp.MustCompile(`System time\s*:\s*([0-9.]+) seconds (fast|slow)`)
+
+// CheckNTP inspects chrony, ntpd or systemd-timesyncd, in that order, and
+// returns nil when no synchronization daemon could be queried
+func CheckNTP() *NTPStatus {
+	if output, err := run("chronyc", "tracking"); err == nil {
+		status := &NTPStatus{Source: "chrony"}
+		status.Synchronized = strings.Contains(output, "Leap status     : Normal")
+		if match := chronyOffsetRe.FindStringSubmatch(output); len(match) > 2 {
+			if seconds, err := strconv.ParseFloat(match[1], 64); err == nil {
+				status.Offset = time.Duration(seconds * float64(time.Second))
+				if match[2] == "slow" {
+					status.Offset = -status.Offset
+				}
+			}
+		}
+		if !status.Synchronized {
+			status.Detail = "chrony reports leap status not normal"
+		}
+		return status
+	}
+
+	if output, err := run("ntpq", "-pn"); err == nil {
+		// The selected peer is marked with '*' in the first column
+		status := &NTPStatus{Source: "ntpd"}
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, "*") {
+				status.Synchronized = true
+				fields := strings.Fields(line)
+				if len(fields) >= 9 {
+					// ntpq reports the peer's offset from the local clock
+					if ms, err := strconv.ParseFloat(fields[8], 64); err == nil {
+						status.Offset = -time.Duration(ms * float64(time.Millisecond))
+					}
+				}
+			}
+		}
+		if !status.Synchronized {
+			status.Detail = "ntpd has no selected peer"
+		}
+		return status
+	}
+
+	if output, err := run("timedatectl", "show", "-p", "NTPSynchronized", "--value"); err == nil {
+		status := &NTPStatus{Source: "systemd-timesyncd"}
+		status.Synchronized = strings.TrimSpace(output) == "yes"
+		if !status.Synchronized {
+			status.Detail = "timedatectl reports NTPSynchronized=no"
+		}
+		return status
+	}
+
+	return nil
+}
+
+func run(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMMAND_TIMEOUT)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	return string(output), err
+}
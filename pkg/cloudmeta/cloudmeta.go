@@ -0,0 +1,218 @@
+package cloudmeta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Metadata services answer in milliseconds; anything slower means "not this cloud"
+	PROBE_TIMEOUT = 2 * time.Second
+
+	EC2_ENDPOINT   = "http://169.254.169.254/latest"
+	GCE_ENDPOINT   = "http://metadata.google.internal/computeMetadata/v1"
+	AZURE_ENDPOINT = "http://169.254.169.254/metadata/instance?api-version=2021-02-01"
+
+	// GCE attributes are free-form and routinely hold secrets (ssh-keys,
+	// kube-env, startup scripts), so only those opted in with this prefix are
+	// reported, under their name without it
+	GCE_TAG_PREFIX = "certfix-"
+)
+
+// Info is the cloud identity and tagging of this instance
+type Info struct {
+	Provider   string            `json:"provider"`
+	InstanceID string            `json:"instance_id,omitempty"`
+	Region     string            `json:"region,omitempty"`
+	Zone       string            `json:"zone,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+type probe func(ctx context.Context, client *http.Client) (*Info, error)
+
+// Detect queries the EC2, GCE and Azure metadata services concurrently and
+// returns the first that answers, or nil when not running in a known cloud
+func Detect(ctx context.Context) *Info {
+	client := &http.Client{
+		Timeout: PROBE_TIMEOUT,
+		// Metadata services must be reached directly, never through a proxy
+		Transport: &http.Transport{Proxy: nil},
+	}
+
+	probes := []probe{probeEC2, probeGCE, probeAzure}
+	results := make(chan *Info, len(probes))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*PROBE_TIMEOUT)
+	defer cancel()
+
+	for _, p := range probes {
+		go func(p probe) {
+			info, err := p(ctx, client)
+			if err != nil {
+				info = nil
+			}
+			results <- info
+		}(p)
+	}
+
+	for range probes {
+		if info := <-results; info != nil {
+			return info
+		}
+	}
+	return nil
+}
+
+// probeEC2 uses IMDSv2 session tokens. Tags are only visible when
+// "instance metadata tags" is enabled on the instance.
+func probeEC2(ctx context.Context, client *http.Client) (*Info, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", EC2_ENDPOINT+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := fetch(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", EC2_ENDPOINT+"/meta-data/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return fetch(client, req)
+	}
+
+	instanceID, err := get("instance-id")
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Provider: "aws", InstanceID: instanceID, Tags: map[string]string{}}
+	info.Region, _ = get("placement/region")
+	info.Zone, _ = get("placement/availability-zone")
+
+	if keys, err := get("tags/instance"); err == nil {
+		for _, key := range strings.Split(keys, "\n") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			if value, err := get("tags/instance/" + key); err == nil {
+				info.Tags[key] = value
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// probeGCE reads custom instance metadata attributes; GCE labels are not
+// exposed by the metadata server, so attributes are the closest equivalent.
+// Only attributes named with GCE_TAG_PREFIX are taken as tags.
+func probeGCE(ctx context.Context, client *http.Client) (*Info, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", GCE_ENDPOINT+"/instance/?recursive=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := fetch(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var instance struct {
+		ID         json.Number       `json:"id"`
+		Zone       string            `json:"zone"`
+		Attributes map[string]string `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, fmt.Errorf("failed to parse GCE metadata: %w", err)
+	}
+
+	// Zone is "projects/<num>/zones/us-central1-a"
+	zone := instance.Zone[strings.LastIndex(instance.Zone, "/")+1:]
+	info := &Info{
+		Provider:   "gcp",
+		InstanceID: instance.ID.String(),
+		Zone:       zone,
+		Tags:       map[string]string{},
+	}
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		info.Region = zone[:i]
+	}
+	for key, value := range instance.Attributes {
+		if name, ok := strings.CutPrefix(key, GCE_TAG_PREFIX); ok && name != "" {
+			info.Tags[name] = value
+		}
+	}
+
+	return info, nil
+}
+
+func probeAzure(ctx context.Context, client *http.Client) (*Info, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", AZURE_ENDPOINT, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := fetch(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var instance struct {
+		Compute struct {
+			VMID     string `json:"vmId"`
+			Location string `json:"location"`
+			Zone     string `json:"zone"`
+			TagsList []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"tagsList"`
+		} `json:"compute"`
+	}
+	if err := json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, fmt.Errorf("failed to parse Azure metadata: %w", err)
+	}
+	if instance.Compute.VMID == "" {
+		return nil, fmt.Errorf("Azure metadata has no vmId")
+	}
+
+	info := &Info{
+		Provider:   "azure",
+		InstanceID: instance.Compute.VMID,
+		Region:     instance.Compute.Location,
+		Zone:       instance.Compute.Zone,
+		Tags:       map[string]string{},
+	}
+	for _, tag := range instance.Compute.TagsList {
+		info.Tags[tag.Name] = tag.Value
+	}
+
+	return info, nil
+}
+
+func fetch(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %s failed with status %d", req.URL.Path, resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
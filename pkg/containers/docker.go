@@ -0,0 +1,232 @@
+package containers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+const (
+	DOCKER_SOCKET    = "/var/run/docker.sock"
+	DOCKER_API       = "http://docker/v1.41"
+	PROBE_TIMEOUT    = 3 * time.Second
+	MAX_MOUNT_DEPTH  = 3
+	MAX_MOUNT_FILES  = 2000
+	MAX_CERT_FILE_KB = 1024
+)
+
+// certExtensions are the file names worth parsing inside mounted volumes
+var certExtensions = map[string]bool{
+	".pem":  true,
+	".crt":  true,
+	".cer":  true,
+	".cert": true,
+}
+
+type dockerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+type dockerMount struct {
+	Type        string `json:"Type"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+}
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []dockerPort      `json:"Ports"`
+	Mounts []dockerMount     `json:"Mounts"`
+}
+
+// Available reports whether a Docker socket exists on this host
+func Available() bool {
+	info, err := os.Stat(DOCKER_SOCKET)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// Discover enumerates running containers through the Docker socket and
+// returns the certificates they serve on published TCP ports or keep in
+// mounted volumes
+func Discover(ctx context.Context) ([]inventory.Certificate, []string) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", DOCKER_SOCKET)
+			},
+		},
+	}
+
+	containers, err := listContainers(ctx, client)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("docker: %v", err)}
+	}
+
+	var certs []inventory.Certificate
+	for _, c := range containers {
+		source := &inventory.ContainerSource{
+			ID:     shortID(c.ID),
+			Name:   strings.TrimPrefix(firstOr(c.Names, c.ID), "/"),
+			Image:  c.Image,
+			Labels: c.Labels,
+		}
+
+		for _, port := range c.Ports {
+			if port.Type != "tcp" || port.PublicPort == 0 {
+				continue
+			}
+			if cert, ok := probePort(ctx, port); ok {
+				src := *source
+				src.Port = port.PrivatePort
+				cert.Container = &src
+				certs = append(certs, cert)
+			}
+		}
+
+		for _, mount := range c.Mounts {
+			for _, cert := range scanMount(mount) {
+				src := *source
+				src.MountPath = mount.Destination
+				cert.Container = &src
+				certs = append(certs, cert)
+			}
+		}
+	}
+
+	return certs, nil
+}
+
+func listContainers(ctx context.Context, client *http.Client) ([]dockerContainer, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", DOCKER_API+"/containers/json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("container list failed with status %d", resp.StatusCode)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to parse container list: %w", err)
+	}
+	return containers, nil
+}
+
+// probePort attempts a TLS handshake on a published port and returns the
+// served leaf certificate. Non-TLS ports simply fail the handshake.
+func probePort(ctx context.Context, port dockerPort) (inventory.Certificate, bool) {
+	host := port.IP
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port.PublicPort))
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: PROBE_TIMEOUT},
+		// We only read the served certificate; trust is evaluated server-side
+		Config: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+	defer cancel()
+
+	conn, err := dialer.DialContext(probeCtx, "tcp", addr)
+	if err != nil {
+		return inventory.Certificate{}, false
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return inventory.Certificate{}, false
+	}
+
+	cert := inventory.Describe(state.PeerCertificates[0])
+	cert.Endpoint = addr
+	cert.ChainLength = len(state.PeerCertificates)
+	return cert, true
+}
+
+// scanMount parses certificate files inside a bind mount or volume
+func scanMount(mount dockerMount) []inventory.Certificate {
+	if mount.Source == "" || (mount.Type != "bind" && mount.Type != "volume") {
+		return nil
+	}
+
+	var certs []inventory.Certificate
+	files := 0
+	rootDepth := strings.Count(filepath.Clean(mount.Source), string(os.PathSeparator))
+
+	filepath.WalkDir(mount.Source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.Count(path, string(os.PathSeparator))-rootDepth >= MAX_MOUNT_DEPTH {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		files++
+		if files > MAX_MOUNT_FILES {
+			return filepath.SkipAll
+		}
+		if !certExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > MAX_CERT_FILE_KB*1024 {
+			return nil
+		}
+
+		cert, err := inventory.ParseCertificateFile(path)
+		if err != nil {
+			// Keys and other PEM material share these extensions; not an error
+			return nil
+		}
+		certs = append(certs, *cert)
+		return nil
+	})
+
+	return certs
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func firstOr(values []string, fallback string) string {
+	if len(values) > 0 {
+		return values[0]
+	}
+	return fallback
+}
@@ -0,0 +1,116 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/events"
+)
+
+// Requests go to this host name; the socket path decides where they land
+const CLIENT_HOST = "http://agent"
+
+// ErrNotRunning means nothing listens on the socket
+var ErrNotRunning = errors.New("the agent is not running")
+
+// Client talks to a running agent through its socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}
+}
+
+// Get decodes the JSON the agent answers path with into v
+func (c *Client) Get(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Post asks the agent to act on path and decodes its answer into v; ctx
+// bounds the wait, since actions can take as long as they take
+func (c *Client) Post(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodPost, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Download copies what the agent answers path with into w
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// StreamEvents calls fn with each event the agent publishes, starting
+// with the recent ones, until ctx ends or the agent goes away
+func (c *Client) StreamEvents(ctx context.Context, fn func(events.Event)) error {
+	resp, err := c.do(ctx, http.MethodGet, "/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			fn(event)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, CLIENT_HOST+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNotRunning
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("agent answered %s: %s", resp.Status, body)
+	}
+	return resp, nil
+}
@@ -0,0 +1,228 @@
+// Package control serves the agent's local socket, through which commands
+// run beside the agent read its live state ('top') or ask it to act ('scan
+// --now'): the state database stays locked while the agent runs. Requests are HTTP over a unix socket
+// only root (and the socket's group) can open. The socket is the agent's
+// own, or one systemd opened and passed on (socket activation).
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/events"
+)
+
+const (
+	SOCKET_NAME = "agent.sock"
+
+	// Name of the socket in the socket unit (FileDescriptorName=)
+	SOCKET_FD_NAME = "control"
+	// systemd passes sockets from this descriptor on
+	LISTEN_FDS_START = 3
+
+	// Events replayed to a new subscriber before live ones
+	RECENT_EVENTS = 50
+	// Events a slow subscriber may fall behind by before losing some
+	SUBSCRIBER_BUFFER = 64
+)
+
+// Server routes requests on the socket; handlers are added before Serve
+type Server struct {
+	mux    *http.ServeMux
+	events *Broadcaster
+}
+
+func NewServer() *Server {
+	s := &Server{mux: http.NewServeMux(), events: &Broadcaster{subscribers: map[chan events.Event]struct{}{}}}
+	s.mux.HandleFunc("/events", s.streamEvents)
+	s.HandleJSON("/events/recent", func() interface{} { return s.events.Recent() })
+	return s
+}
+
+// Events is the notifier to add to the event dispatcher, so its events
+// reach subscribers of /events
+func (s *Server) Events() *Broadcaster {
+	return s.events
+}
+
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleJSON answers GET requests for pattern with what get returns
+func (s *Server) HandleJSON(pattern string, get func() interface{}) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(get())
+	})
+}
+
+// HandleAction answers POST requests for pattern by calling run with the
+// request's context, which ends if the caller goes away
+func (s *Server) HandleAction(pattern string, run func(ctx context.Context) (interface{}, error)) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := run(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// Listen opens the socket at path, replacing one a previous run left
+// behind; the instance lock keeps two agents from sharing it
+func Listen(path string) (net.Listener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// Activated returns the socket systemd passed the agent when its socket
+// unit started it, or nil when there is none. With several sockets the one
+// named SOCKET_FD_NAME is used. The variables describing them are cleared
+// so the agent's children don't see them.
+func Activated() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || count < 1 {
+		return nil, nil
+	}
+
+	fd := -1
+	for i := 0; i < count && i < len(names); i++ {
+		if names[i] == SOCKET_FD_NAME {
+			fd = LISTEN_FDS_START + i
+		}
+	}
+	if fd < 0 && count == 1 {
+		fd = LISTEN_FDS_START
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("none of the %d sockets passed by systemd is named %q", count, SOCKET_FD_NAME)
+	}
+	file := os.NewFile(uintptr(fd), SOCKET_FD_NAME)
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the socket passed by systemd: %w", err)
+	}
+	return listener, nil
+}
+
+// Serve answers requests until the listener is closed
+func (s *Server) Serve(listener net.Listener) error {
+	server := &http.Server{Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("[INFO] Control socket listening on %s", listener.Addr())
+	return server.Serve(listener)
+}
+
+// streamEvents writes one JSON event per line: the recent ones, then each
+// as it is published, until the client goes away
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	live, recent, cancel := s.events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, event := range recent {
+		encoder.Encode(event)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-live:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Broadcaster is an events.Notifier that hands every event to the
+// subscribers of the socket and keeps the most recent ones
+type Broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan events.Event]struct{}
+	recent      []events.Event
+}
+
+func (b *Broadcaster) Name() string {
+	return "control socket"
+}
+
+// Notify never blocks: a subscriber that keeps its buffer full misses
+// events rather than holding up the other notifiers
+func (b *Broadcaster) Notify(ctx context.Context, event events.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recent = append(b.recent, event)
+	if len(b.recent) > RECENT_EVENTS {
+		b.recent = b.recent[len(b.recent)-RECENT_EVENTS:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+// Recent returns the kept events, oldest first
+func (b *Broadcaster) Recent() []events.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]events.Event{}, b.recent...)
+}
+
+// Subscribe returns live events, the recent ones and a function to stop
+func (b *Broadcaster) Subscribe() (<-chan events.Event, []events.Event, func()) {
+	ch := make(chan events.Event, SUBSCRIBER_BUFFER)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+	recent := append([]events.Event{}, b.recent...)
+	return ch, recent, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
@@ -0,0 +1,230 @@
+// Package cron parses the five-field cron expressions of crontab(5) and
+// works out when they next fire, so work can be pinned to times of day
+// rather than run at a fixed interval.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A day that matches comes around within a leap cycle and a half; Parse
+// rejects expressions that never fire, such as February 30th
+const MAX_SEARCH_DAYS = 8 * 366
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: monthNames},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, names: dayNames},
+}
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+	location                      *time.Location
+}
+
+// Parse reads "minute hour day-of-month month day-of-week", with lists,
+// ranges, steps and month and day names, or one of @hourly, @daily,
+// @weekly, @monthly and @yearly. Times are in loc unless the expression
+// starts with CRON_TZ=<zone>. As in cron, when both the day of month and
+// the day of week are restricted a day matching either one fires.
+func Parse(spec string, loc *time.Location) (*Schedule, error) {
+	s := &Schedule{spec: spec, location: loc}
+	expr := strings.TrimSpace(spec)
+	if zone, ok := strings.CutPrefix(expr, "CRON_TZ="); ok {
+		name, rest, _ := strings.Cut(zone, " ")
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone in %q: %w", spec, err)
+		}
+		s.location, expr = l, strings.TrimSpace(rest)
+	}
+	if s.location == nil {
+		s.location = time.Local
+	}
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields (minute hour day-of-month month day-of-week)", spec)
+	}
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+	s.minute, s.hour, s.dom, s.month, s.dow = sets[0], sets[1], sets[2], sets[3], sets[4]
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domRestricted = !strings.HasPrefix(parts[2], "*")
+	s.dowRestricted = !strings.HasPrefix(parts[4], "*")
+
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never fires", spec)
+	}
+	return s, nil
+}
+
+// parseField turns one field into a bit set of the values it allows
+func parseField(part string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(part, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepPart, f.name)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = parseValue(from, f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(to, f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %s is backwards in %s", rangePart, f.name)
+			}
+		default:
+			v, err := parseValue(rangePart, f)
+			if err != nil {
+				return 0, err
+			}
+			// 5/15 means from 5 to the end, every 15
+			lo, hi = v, v
+			if hasStep {
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q (want %d-%d)", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Location is the time zone the schedule's times are in
+func (s *Schedule) Location() *time.Location {
+	return s.location
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time the schedule fires after t, or the zero time
+// if it never does. A time skipped when the clocks go forward fires late by
+// as much as they went forward; a time repeated when they go back fires
+// once.
+func (s *Schedule) Next(t time.Time) time.Time {
+	local := t.In(s.location)
+	year, month, day := local.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < MAX_SEARCH_DAYS; i++ {
+		date := start.AddDate(0, 0, i)
+		if !s.matchesDay(date) {
+			continue
+		}
+		// Times moved by a daylight saving change can come out of order
+		var best time.Time
+		for hour := 0; hour < 24; hour++ {
+			if s.hour&(1<<hour) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if s.minute&(1<<minute) == 0 {
+					continue
+				}
+				next := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, s.location)
+				if next.Hour() != hour || next.Minute() != minute {
+					next = skipped(next)
+				}
+				if next.After(t) && (best.IsZero() || next.Before(best)) {
+					best = next
+				}
+			}
+		}
+		if !best.IsZero() {
+			return best
+		}
+	}
+	return time.Time{}
+}
+
+// skipped moves a time that didn't exist, which time.Date put on the old
+// side of the change, to the same distance past it
+func skipped(t time.Time) time.Time {
+	_, before := t.Zone()
+	_, after := t.Add(24 * time.Hour).Zone()
+	return t.Add(time.Duration(after-before) * time.Second)
+}
+
+func (s *Schedule) matchesDay(date time.Time) bool {
+	if s.month&(1<<int(date.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<date.Day()) != 0
+	dow := s.dow&(1<<int(date.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,151 @@
+// Package dane computes TLSA records (RFC 6698, RFC 7671) for certificates,
+// so mail operators relying on DANE can publish them with each renewal.
+package dane
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+)
+
+const (
+	USAGE_PKIX_TA = 0
+	USAGE_PKIX_EE = 1
+	USAGE_DANE_TA = 2
+	USAGE_DANE_EE = 3
+
+	SELECTOR_CERT = 0
+	SELECTOR_SPKI = 1
+
+	MATCHING_FULL   = 0
+	MATCHING_SHA256 = 1
+	MATCHING_SHA512 = 2
+
+	// DANE-EE, public key, SHA-256: what RFC 7672 recommends for SMTP
+	DEFAULT_PARAMS = "3 1 1"
+	DEFAULT_PORT   = 25
+	DEFAULT_PROTO  = "tcp"
+
+	RECORD_TTL = 3600
+)
+
+// Params are a TLSA record's usage, selector and matching type
+type Params struct {
+	Usage    int
+	Selector int
+	Matching int
+}
+
+// ParseParams reads "usage selector matching", e.g. "3 1 1"
+func ParseParams(value string) (Params, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return Params{}, fmt.Errorf("invalid TLSA parameters %q: want \"usage selector matching\"", value)
+	}
+	var numbers [3]int
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return Params{}, fmt.Errorf("invalid TLSA parameters %q: %w", value, err)
+		}
+		numbers[i] = n
+	}
+	p := Params{Usage: numbers[0], Selector: numbers[1], Matching: numbers[2]}
+	if p.Usage < USAGE_PKIX_TA || p.Usage > USAGE_DANE_EE {
+		return p, fmt.Errorf("invalid TLSA usage %d (0-3)", p.Usage)
+	}
+	if p.Selector != SELECTOR_CERT && p.Selector != SELECTOR_SPKI {
+		return p, fmt.Errorf("invalid TLSA selector %d (0-1)", p.Selector)
+	}
+	if p.Matching < MATCHING_FULL || p.Matching > MATCHING_SHA512 {
+		return p, fmt.Errorf("invalid TLSA matching type %d (0-2)", p.Matching)
+	}
+	return p, nil
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("%d %d %d", p.Usage, p.Selector, p.Matching)
+}
+
+// Record is one TLSA record
+type Record struct {
+	Name string `json:"name"`
+	// Value is the record data: "usage selector matching hex"
+	Value string `json:"value"`
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s. IN TLSA %s", r.Name, r.Value)
+}
+
+// Name is the TLSA owner name for a service: _port._proto.host
+func Name(host string, port int, proto string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idn.ToASCII(host); err == nil {
+		host = ascii
+	}
+	return fmt.Sprintf("_%d._%s.%s", port, proto, host)
+}
+
+// Data computes the association data of p for a chain. End-entity usages
+// match the leaf, trust anchor usages the certificate that issued it.
+func Data(p Params, chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		return "", fmt.Errorf("no certificate")
+	}
+	cert := chain[0]
+	if p.Usage == USAGE_PKIX_TA || p.Usage == USAGE_DANE_TA {
+		if len(chain) < 2 {
+			return "", fmt.Errorf("TLSA usage %d needs the issuing CA certificate, but the chain is empty", p.Usage)
+		}
+		cert = chain[1]
+	}
+
+	selected := cert.Raw
+	if p.Selector == SELECTOR_SPKI {
+		selected = cert.RawSubjectPublicKeyInfo
+	}
+	switch p.Matching {
+	case MATCHING_SHA256:
+		sum := sha256.Sum256(selected)
+		return hex.EncodeToString(sum[:]), nil
+	case MATCHING_SHA512:
+		sum := sha512.Sum512(selected)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return hex.EncodeToString(selected), nil
+}
+
+// Records computes a record for every name and set of parameters. Wildcard
+// names are skipped: TLSA records live at concrete service names.
+func Records(names []string, port int, proto string, params []Params, chain []*x509.Certificate) ([]Record, error) {
+	var records []Record
+	for _, p := range params {
+		data, err := Data(p, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "*.") {
+				continue
+			}
+			records = append(records, Record{Name: Name(name, port, proto), Value: p.String() + " " + data})
+		}
+	}
+	return records, nil
+}
+
+// ByName groups record values by owner name, keeping their order
+func ByName(records []Record) map[string][]string {
+	grouped := map[string][]string{}
+	for _, r := range records {
+		grouped[r.Name] = append(grouped[r.Name], r.Value)
+	}
+	return grouped
+}
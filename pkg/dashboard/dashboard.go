@@ -0,0 +1,186 @@
+// Package dashboard serves a read-only web UI of the agent on a loopback
+// address, for hosts that run the agent without the hosted console: the
+// managed certificates and their expiry, recent deployments and tasks, the
+// agent's health and its recent log lines.
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_LISTEN = "127.0.0.1:9180"
+
+	// The page reloads itself this often
+	REFRESH_SECONDS = 30
+	// Log lines shown on the page; /logs has all that are kept
+	PAGE_LOG_LINES = 100
+
+	CHECK_OK   = "ok"
+	CHECK_WARN = "warn"
+	CHECK_FAIL = "fail"
+)
+
+// Snapshot is everything the dashboard shows, built on every request
+type Snapshot struct {
+	GeneratedAt  time.Time     `json:"generated_at"`
+	Agent        Agent         `json:"agent"`
+	Health       []Check       `json:"health"`
+	Certificates []Certificate `json:"certificates"`
+	Deployments  []Deployment  `json:"deployments"`
+	Tasks        []Task        `json:"tasks"`
+}
+
+type Agent struct {
+	Version    string    `json:"version"`
+	Hostname   string    `json:"hostname"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Endpoint   string    `json:"endpoint"`
+	StartedAt  time.Time `json:"started_at"`
+	FIPS       string    `json:"fips"`
+	Sandbox    bool      `json:"sandbox"`
+	// LastAPIContact is the last successful call to the API
+	LastAPIContact time.Time `json:"last_api_contact,omitempty"`
+}
+
+// Check is one line of the health summary
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Certificate is a managed certificate with its renewal state
+type Certificate struct {
+	Name      string            `json:"name"`
+	Domains   []string          `json:"domains"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	NotBefore time.Time         `json:"not_before,omitempty"`
+	NotAfter  time.Time         `json:"not_after,omitempty"`
+	// RenewAt is when the certificate becomes due for renewal
+	RenewAt time.Time `json:"renew_at,omitempty"`
+	// NextAttempt is set while a failed renewal waits for its retry, or a
+	// deployment for its maintenance window
+	NextAttempt    time.Time `json:"next_attempt,omitempty"`
+	AwaitingWindow bool      `json:"awaiting_window,omitempty"`
+	Status         string    `json:"status"`
+	Detail         string    `json:"detail,omitempty"`
+}
+
+// Deployment is one certificate installed at one destination
+type Deployment struct {
+	Certificate string    `json:"certificate"`
+	Destination string    `json:"destination"`
+	At          time.Time `json:"at,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Task is a finished task the server sent
+type Task struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Handler serves the page at /, the snapshot as JSON at /api/status and
+// the kept log lines at /logs
+func Handler(snapshot func() *Snapshot, logs *LogBuffer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var lines []string
+		if logs != nil {
+			lines = logs.Lines()
+		}
+		if len(lines) > PAGE_LOG_LINES {
+			lines = lines[len(lines)-PAGE_LOG_LINES:]
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, pageData{Snapshot: snapshot(), Logs: lines, Refresh: REFRESH_SECONDS}); err != nil {
+			log.Printf("[WARNING] Dashboard: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot())
+	})
+	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if logs != nil {
+			for _, line := range logs.Lines() {
+				fmt.Fprintln(w, line)
+			}
+		}
+	})
+	return localOnly(mux)
+}
+
+// localOnly answers read-only requests whose Host is a loopback name, so a
+// web page can't reach the dashboard through DNS rebinding, and keeps the
+// pages out of frames and caches
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLoopbackHost(r.Host) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen opens the dashboard listener, which must be on a loopback address:
+// the dashboard has no authentication of its own
+func Listen(address string) (net.Listener, error) {
+	if address == "" {
+		address = DEFAULT_LISTEN
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dashboard address %q: %w", address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("dashboard address %q must be loopback", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Serve runs the dashboard until the listener is closed
+func Serve(listener net.Listener, snapshot func() *Snapshot, logs *LogBuffer) error {
+	server := &http.Server{
+		Handler:           Handler(snapshot, logs),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("[INFO] Dashboard listening on http://%s/", listener.Addr())
+	return server.Serve(listener)
+}
@@ -0,0 +1,56 @@
+package dashboard
+
+import (
+	"strings"
+	"sync"
+)
+
+// Log lines kept for the dashboard when no size is given
+const DEFAULT_LOG_LINES = 1000
+
+// LogBuffer keeps the most recent log lines in memory. It is an io.Writer
+// to add beside the agent's log output, behind its redaction.
+type LogBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial string
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = DEFAULT_LOG_LINES
+	}
+	return &LogBuffer{lines: make([]string, size)}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	text := b.partial + string(p)
+	for {
+		line, rest, found := strings.Cut(text, "\n")
+		if !found {
+			b.partial = text
+			break
+		}
+		b.lines[b.next] = line
+		b.next = (b.next + 1) % len(b.lines)
+		if b.next == 0 {
+			b.full = true
+		}
+		text = rest
+	}
+	return len(p), nil
+}
+
+// Lines returns the kept lines, oldest first
+func (b *LogBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]string{}, b.lines[:b.next]...)
+	}
+	return append(append([]string{}, b.lines[b.next:]...), b.lines[:b.next]...)
+}
@@ -0,0 +1,133 @@
+package dashboard
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+type pageData struct {
+	*Snapshot
+	Logs    []string
+	Refresh int
+}
+
+var page = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"when":    formatTime,
+	"remains": remains,
+	"percent": percent,
+	"labels":  formatLabels,
+	"join":    strings.Join,
+	"lineClass": func(line string) string {
+		for _, level := range []string{"ERROR", "FATAL", "WARNING", "SUCCESS"} {
+			if strings.Contains(line, "["+level+"]") {
+				return strings.ToLower(level)
+			}
+		}
+		return ""
+	},
+}).Parse(pageTemplate))
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// remains describes how long until t, in days or hours
+func remains(t time.Time) string {
+	if t.IsZero() {
+		return "not issued"
+	}
+	left := time.Until(t)
+	switch {
+	case left < 0:
+		return "expired"
+	case left < 48*time.Hour:
+		return fmt.Sprintf("%d hours", int(left.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(left.Hours()/24))
+}
+
+// percent places t on the lifetime of a certificate, 0 to 100
+func percent(cert Certificate, t time.Time) int {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= 0 || t.IsZero() {
+		return 0
+	}
+	p := int(100 * t.Sub(cert.NotBefore) / lifetime)
+	return max(0, min(100, p))
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+const pageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>CertFix Agent — {{.Agent.Hostname}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+h2 { font-size: 1.1em; margin-top: 2em; border-bottom: 1px solid #ddd; }
+.meta { color: #666; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .3em .6em; border-bottom: 1px solid #eee; vertical-align: top; }
+.ok { color: #1a7f37; } .warn, .warning { color: #9a6700; } .fail, .error, .fatal { color: #cf222e; } .success { color: #1a7f37; }
+.track { position: relative; width: 14em; height: .8em; background: #eee; border-radius: .4em; }
+.elapsed { position: absolute; left: 0; top: 0; bottom: 0; background: #8c959f; border-radius: .4em; }
+.renew { position: absolute; top: -.2em; bottom: -.2em; width: 2px; background: #9a6700; }
+pre { background: #f6f8fa; padding: 1em; overflow-x: auto; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>CertFix Agent on {{.Agent.Hostname}}</h1>
+<p class="meta">Version {{.Agent.Version}} · running since {{when .Agent.StartedAt}} · {{.Agent.Endpoint}}{{if .Agent.InstanceID}} · instance {{.Agent.InstanceID}}{{end}} · FIPS {{.Agent.FIPS}}{{if .Agent.Sandbox}} · sandboxed{{end}} · as of {{when .GeneratedAt}}</p>
+
+<h2>Health</h2>
+<table>
+{{range .Health}}<tr><td class="{{.Status}}">{{.Status}}</td><td>{{.Name}}</td><td>{{.Detail}}</td></tr>
+{{end}}</table>
+
+<h2>Managed certificates</h2>
+{{if .Certificates}}<table>
+<tr><th>Name</th><th>Domains</th><th>Expires</th><th>Lifetime (mark: renewal)</th><th>Status</th></tr>
+{{range .Certificates}}<tr>
+<td>{{.Name}}{{if .Labels}}<br><span class="meta">{{labels .Labels}}</span>{{end}}</td>
+<td>{{join .Domains ", "}}</td>
+<td>{{when .NotAfter}}<br><span class="meta">{{remains .NotAfter}}</span></td>
+<td>{{if not .NotAfter.IsZero}}<div class="track"><div class="elapsed" style="width: {{percent . $.GeneratedAt}}%"></div>{{if not .RenewAt.IsZero}}<div class="renew" style="left: {{percent . .RenewAt}}%"></div>{{end}}</div><span class="meta">renews {{when .RenewAt}}</span>{{end}}</td>
+<td class="{{.Status}}">{{.Status}}{{if .Detail}}<br><span class="meta">{{.Detail}}</span>{{end}}</td>
+</tr>
+{{end}}</table>{{else}}<p class="meta">No certificates are managed by this agent.</p>{{end}}
+
+<h2>Recent deployments</h2>
+{{if .Deployments}}<table>
+<tr><th>When</th><th>Certificate</th><th>Destination</th><th>Result</th></tr>
+{{range .Deployments}}<tr><td>{{when .At}}</td><td>{{.Certificate}}</td><td>{{.Destination}}</td><td>{{if .Error}}<span class="fail">{{.Error}}</span>{{else}}<span class="ok">deployed</span>{{end}}</td></tr>
+{{end}}</table>{{else}}<p class="meta">No deployments yet.</p>{{end}}
+
+<h2>Recent tasks</h2>
+{{if .Tasks}}<table>
+<tr><th>Finished</th><th>Task</th><th>Type</th><th>Status</th></tr>
+{{range .Tasks}}<tr><td>{{when .FinishedAt}}</td><td>{{.ID}}</td><td>{{.Type}}</td><td>{{.Status}}{{if .Error}}<br><span class="fail">{{.Error}}</span>{{end}}</td></tr>
+{{end}}</table>{{else}}<p class="meta">No tasks yet.</p>{{end}}
+
+<h2>Log</h2>
+<pre>{{range .Logs}}<span class="{{lineClass .}}">{{.}}</span>
+{{end}}</pre>
+<p class="meta"><a href="/logs">All kept log lines</a> · <a href="/api/status">JSON</a></p>
+</body>
+</html>
+`
@@ -0,0 +1,322 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/awsauth"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_AWS_SECRETS_MANAGER = "aws-secrets-manager"
+	TARGET_AWS_SSM             = "aws-ssm"
+
+	AWS_TIMEOUT = 30 * time.Second
+
+	// Defaults: certfix/<name> for secrets, /certfix/<name>/ for parameters
+	DEFAULT_AWS_SECRET_PREFIX    = "certfix/"
+	DEFAULT_AWS_PARAMETER_PREFIX = "/certfix/"
+
+	// Parameters over 4 KB (a full chain, an RSA-4096 key) need the
+	// advanced tier; intelligent tiering only pays for it then
+	SSM_TIER = "Intelligent-Tiering"
+)
+
+var (
+	awsSecretNamePattern    = regexp.MustCompile(`^[A-Za-z0-9/_+=.@-]{1,512}$`)
+	awsParameterPathPattern = regexp.MustCompile(`^/?[A-Za-z0-9_.\-/]{1,1000}$`)
+)
+
+func init() {
+	builtinTargets[TARGET_AWS_SECRETS_MANAGER] = newSecretsManagerTarget
+	builtinTargets[TARGET_AWS_SSM] = newSSMTarget
+}
+
+// AWSOptions configure the Secrets Manager and SSM Parameter Store
+// targets. Without static keys the target uses AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, then the EC2 instance profile.
+type AWSOptions struct {
+	// Region defaults to AWS_REGION
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+	// KMSKeyID encrypts the secret or the parameters with a customer
+	// managed key (ID, ARN or alias/...); the account's default key for
+	// the service otherwise
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// SecretName for aws-secrets-manager; certfix/<name> by default
+	SecretName string `json:"secret_name,omitempty"`
+	// ParameterPrefix for aws-ssm, under which certificate, chain,
+	// fullchain and private_key are written; /certfix/<name>/ by default
+	ParameterPrefix string `json:"parameter_prefix,omitempty"`
+}
+
+// bundleDocument is the JSON a secret or key holds when the whole bundle
+// goes in one value
+type bundleDocument struct {
+	Certificate string    `json:"certificate"`
+	Chain       string    `json:"chain,omitempty"`
+	FullChain   string    `json:"fullchain"`
+	PrivateKey  string    `json:"private_key"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+func marshalBundle(bundle *Bundle) ([]byte, error) {
+	return json.Marshal(bundleDocument{
+		Certificate: string(bundle.Certificate),
+		Chain:       string(bundle.Chain),
+		FullChain:   string(bundle.FullChain()),
+		PrivateKey:  string(bundle.PrivateKey),
+		Fingerprint: bundle.Fingerprint(),
+		NotAfter:    bundle.Leaf().NotAfter.UTC(),
+	})
+}
+
+// awsAPI calls AWS JSON APIs signed with the target's credentials
+type awsAPI struct {
+	region string
+	client *http.Client
+	creds  *awsauth.Source
+}
+
+// awsError is an API error with its exception type
+type awsError struct {
+	Type    string
+	Message string
+	Status  int
+}
+
+func (e *awsError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("status %d", e.Status)
+	}
+	return e.Type + ": " + e.Message
+}
+
+func newAWSAPI(ctx context.Context, env *Env, opts *AWSOptions) (*awsAPI, error) {
+	region := opts.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, tasks.Rejectf("no region: set region or AWS_REGION")
+	}
+
+	creds := awsauth.FromEnvironment()
+	if opts.AccessKeyID != "" {
+		// Resolving redacts the secret from logs, even a plaintext one
+		secret, err := env.Secrets.Resolve(ctx, opts.SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, tasks.Rejectf("secret_access_key is required with access_key_id")
+		}
+		creds = &awsauth.Credentials{AccessKeyID: opts.AccessKeyID, SecretAccessKey: secret, Token: opts.SessionToken}
+	}
+	return &awsAPI{region: region, client: httpclient.New(AWS_TIMEOUT), creds: awsauth.NewSource(creds)}, nil
+}
+
+// call invokes service's operation (X-Amz-Target prefix.operation)
+func (a *awsAPI) call(ctx context.Context, service, prefix, operation string, in, out interface{}) error {
+	creds, err := a.creds.Get(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+service+"."+a.region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", prefix+"."+operation)
+	awsauth.SignV4(req, body, creds, a.region, service, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s unreachable: %w", service, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &awsError{Status: resp.StatusCode}
+		var parsed struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &parsed) == nil {
+			// Types may carry a namespace: com.amazonaws...#ResourceNotFoundException
+			apiErr.Type = parsed.Type[strings.LastIndex(parsed.Type, "#")+1:]
+			apiErr.Message = parsed.Message
+		}
+		return fmt.Errorf("%s failed: %w", operation, apiErr)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to parse %s response: %w", operation, err)
+		}
+	}
+	return nil
+}
+
+func isAWSError(err error, errType string) bool {
+	var apiErr *awsError
+	return errors.As(err, &apiErr) && apiErr.Type == errType
+}
+
+// secretsManagerTarget stores the bundle as one JSON secret, creating it
+// on first deployment. Each deployment is a new version (AWSCURRENT), so
+// applications that cache the secret pick it up on their next refresh.
+type secretsManagerTarget struct {
+	env  *Env
+	opts AWSOptions
+}
+
+func newSecretsManagerTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts AWSOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.ParameterPrefix != "" {
+		return nil, tasks.Rejectf("parameter_prefix is for the %s target", TARGET_AWS_SSM)
+	}
+	if opts.SecretName != "" && !awsSecretNamePattern.MatchString(opts.SecretName) {
+		return nil, tasks.Rejectf("invalid secret_name %q", opts.SecretName)
+	}
+	return &secretsManagerTarget{env: env, opts: opts}, nil
+}
+
+func (t *secretsManagerTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	api, err := newAWSAPI(ctx, t.env, &t.opts)
+	if err != nil {
+		return nil, err
+	}
+	name := t.opts.SecretName
+	if name == "" {
+		name = DEFAULT_AWS_SECRET_PREFIX + bundle.Name
+	}
+	value, err := marshalBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	request := map[string]interface{}{
+		"SecretId":     name,
+		"SecretString": string(value),
+	}
+	if t.opts.KMSKeyID != "" {
+		request["KmsKeyId"] = t.opts.KMSKeyID
+	}
+	var response struct {
+		ARN       string `json:"ARN"`
+		VersionID string `json:"VersionId"`
+	}
+	action := "updated"
+	err = api.call(ctx, "secretsmanager", "secretsmanager", "UpdateSecret", request, &response)
+	if isAWSError(err, "ResourceNotFoundException") {
+		delete(request, "SecretId")
+		request["Name"] = name
+		request["Description"] = "TLS certificate " + bundle.Name + ", managed by certfix-agent"
+		request["Tags"] = []map[string]string{{"Key": "managed-by", "Value": "certfix-agent"}}
+		err = api.call(ctx, "secretsmanager", "secretsmanager", "CreateSecret", request, &response)
+		action = "created"
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Details: map[string]string{"secret": response.ARN, "version_id": response.VersionID, "action": action}}, nil
+}
+
+// ssmTarget writes the bundle as SecureString parameters under a prefix:
+// private_key first and certificate last, like files, so a reader polling
+// the certificate never finds it ahead of its key
+type ssmTarget struct {
+	env  *Env
+	opts AWSOptions
+}
+
+func newSSMTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts AWSOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.SecretName != "" {
+		return nil, tasks.Rejectf("secret_name is for the %s target", TARGET_AWS_SECRETS_MANAGER)
+	}
+	if opts.ParameterPrefix != "" && (!awsParameterPathPattern.MatchString(opts.ParameterPrefix) || strings.Contains(opts.ParameterPrefix, "//")) {
+		return nil, tasks.Rejectf("invalid parameter_prefix %q", opts.ParameterPrefix)
+	}
+	return &ssmTarget{env: env, opts: opts}, nil
+}
+
+func (t *ssmTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	api, err := newAWSAPI(ctx, t.env, &t.opts)
+	if err != nil {
+		return nil, err
+	}
+	prefix := t.opts.ParameterPrefix
+	if prefix == "" {
+		prefix = DEFAULT_AWS_PARAMETER_PREFIX + bundle.Name + "/"
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	parameters := []struct {
+		name  string
+		value []byte
+	}{
+		{"private_key", bundle.PrivateKey},
+		{"chain", bundle.Chain},
+		{"fullchain", bundle.FullChain()},
+		{"certificate", bundle.Certificate},
+	}
+	result := &Result{Details: map[string]string{}}
+	var written []string
+	for _, p := range parameters {
+		if len(bytes.TrimSpace(p.value)) == 0 {
+			continue
+		}
+		request := map[string]interface{}{
+			"Name":      prefix + p.name,
+			"Value":     string(p.value),
+			"Type":      "SecureString",
+			"Overwrite": true,
+			"Tier":      SSM_TIER,
+		}
+		if t.opts.KMSKeyID != "" {
+			request["KeyId"] = t.opts.KMSKeyID
+		}
+		var response struct {
+			Version int64 `json:"Version"`
+		}
+		if err := api.call(ctx, "ssm", "AmazonSSM", "PutParameter", request, &response); err != nil {
+			result.Details["parameters"] = strings.Join(written, ",")
+			return result, fmt.Errorf("failed to write %s: %w", prefix+p.name, err)
+		}
+		written = append(written, prefix+p.name)
+		result.Details["version"] = fmt.Sprint(response.Version)
+	}
+	result.Details["parameters"] = strings.Join(written, ",")
+	return result, nil
+}
@@ -0,0 +1,203 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_CADDY = "caddy"
+
+	DEFAULT_CADDY_ADMIN = "http://localhost:2019"
+	CADDY_CERTS_PATH    = "/config/apps/tls/certificates/load_pem"
+	CADDY_TAG_PREFIX    = "certfix:"
+	CADDY_TIMEOUT       = 30 * time.Second
+)
+
+func init() {
+	builtinTargets[TARGET_CADDY] = newCaddyTarget
+}
+
+// CaddyOptions configure the Caddy admin API target
+type CaddyOptions struct {
+	// Admin is the admin endpoint; it must be local since it receives the key
+	Admin string `json:"admin,omitempty"`
+}
+
+// caddyTarget loads certificates into Caddy's running config through the
+// admin API (tls.certificates.load_pem). Caddy applies config changes
+// gracefully, so there is nothing to reload.
+type caddyTarget struct {
+	admin  string
+	client *http.Client
+}
+
+type caddyPEM struct {
+	Certificate string   `json:"certificate"`
+	Key         string   `json:"key"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func newCaddyTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts CaddyOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Admin == "" {
+		opts.Admin = DEFAULT_CADDY_ADMIN
+	}
+
+	if err := checkLocalURL("caddy admin address", opts.Admin); err != nil {
+		return nil, err
+	}
+
+	return &caddyTarget{
+		admin:  strings.TrimRight(opts.Admin, "/"),
+		client: localClient(CADDY_TIMEOUT),
+	}, nil
+}
+
+// checkLocalURL rejects admin endpoints that aren't on this host; they
+// receive keys or credentials
+func checkLocalURL(what, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return tasks.Rejectf("invalid %s %q", what, raw)
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return tasks.Rejectf("%s %q must be local", what, raw)
+	}
+	return nil
+}
+
+// localClient never goes through a proxy
+func localClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{Proxy: nil}}
+}
+
+func (t *caddyTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	tag := CADDY_TAG_PREFIX + bundle.Name
+	entry := caddyPEM{
+		Certificate: string(bundle.FullChain()),
+		Key:         string(bundle.PrivateKey),
+		Tags:        []string{"certfix", tag},
+	}
+
+	existing, err := t.loaded(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		if err := t.create(ctx, entry); err != nil {
+			return nil, err
+		}
+		return &Result{Details: map[string]string{"caddy": "added"}}, nil
+	}
+
+	// Replace our previous entry for this name, keep everything else
+	replaced := false
+	for i := range existing {
+		if hasTag(existing[i].Tags, tag) {
+			existing[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		existing = append(existing, entry)
+	}
+	if err := t.request(ctx, "PATCH", CADDY_CERTS_PATH, existing, nil); err != nil {
+		return nil, err
+	}
+
+	action := "added"
+	if replaced {
+		action = "replaced"
+	}
+	return &Result{Details: map[string]string{"caddy": action}}, nil
+}
+
+// loaded returns the current load_pem list, nil when the path is unset
+func (t *caddyTarget) loaded(ctx context.Context) ([]caddyPEM, error) {
+	var existing []caddyPEM
+	if err := t.request(ctx, "GET", CADDY_CERTS_PATH, nil, &existing); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// create sets load_pem, creating parent objects that don't exist yet
+func (t *caddyTarget) create(ctx context.Context, entry caddyPEM) error {
+	attempts := []struct {
+		path  string
+		value interface{}
+	}{
+		{CADDY_CERTS_PATH, []caddyPEM{entry}},
+		{"/config/apps/tls/certificates", map[string]interface{}{"load_pem": []caddyPEM{entry}}},
+		{"/config/apps/tls", map[string]interface{}{"certificates": map[string]interface{}{"load_pem": []caddyPEM{entry}}}},
+	}
+
+	var err error
+	for _, attempt := range attempts {
+		if err = t.request(ctx, "PUT", attempt.path, attempt.value, nil); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (t *caddyTarget) request(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal caddy config: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, t.admin+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create caddy request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("caddy admin API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("caddy %s %s failed with status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to parse caddy response: %w", err)
+		}
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_POSTGRESQL = "postgresql"
+	TARGET_MYSQL      = "mysql"
+
+	DEFAULT_POSTGRES_USER = "postgres"
+	DEFAULT_MYSQL_USER    = "mysql"
+
+	// Debian's maintenance credentials, used when present
+	MYSQL_DEBIAN_DEFAULTS = "/etc/mysql/debian.cnf"
+)
+
+func init() {
+	builtinTargets[TARGET_POSTGRESQL] = newPostgresTarget
+	builtinTargets[TARGET_MYSQL] = newMySQLTarget
+}
+
+// DatabaseOptions configure the PostgreSQL and MySQL targets
+type DatabaseOptions struct {
+	// CertFile and KeyFile default to the server's current ssl settings
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// User owns the files; defaults to postgres or mysql
+	User string `json:"user,omitempty"`
+	// DefaultsFile holds MySQL client credentials; defaults to debian.cnf
+	DefaultsFile string `json:"defaults_file,omitempty"`
+}
+
+// postgresTarget installs ssl_cert_file/ssl_key_file owned by the service
+// user (the server refuses group- or world-readable keys), points the
+// server at them with ALTER SYSTEM when they moved, and reloads through
+// pg_reload_conf() so no connection is dropped
+type postgresTarget struct {
+	env  *Env
+	opts DatabaseOptions
+}
+
+func newPostgresTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts DatabaseOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.User == "" {
+		opts.User = DEFAULT_POSTGRES_USER
+	}
+	if !commandExists("psql") {
+		return nil, tasks.Rejectf("psql not found")
+	}
+	return &postgresTarget{env: env, opts: opts}, nil
+}
+
+func (t *postgresTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	dataDir, err := t.query(ctx, "SHOW data_directory")
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]string{}
+	for _, setting := range []string{"ssl_cert_file", "ssl_key_file"} {
+		value, err := t.query(ctx, "SHOW "+setting)
+		if err != nil {
+			return nil, err
+		}
+		// Relative settings are resolved against the data directory
+		if value != "" && !filepath.IsAbs(value) {
+			value = filepath.Join(dataDir, value)
+		}
+		current[setting] = value
+	}
+
+	certPath, keyPath := t.opts.CertFile, t.opts.KeyFile
+	if certPath == "" {
+		certPath = current["ssl_cert_file"]
+	}
+	if keyPath == "" {
+		keyPath = current["ssl_key_file"]
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, tasks.Rejectf("server has no ssl_cert_file/ssl_key_file configured; set cert_file and key_file")
+	}
+
+	files, err := installPair(t.env, certPath, keyPath, bundle)
+	if err != nil {
+		return &Result{Files: files}, err
+	}
+	if err := chownToUser(files, t.opts.User); err != nil {
+		return &Result{Files: files}, err
+	}
+	result := &Result{Files: files, Details: map[string]string{}}
+
+	for setting, path := range map[string]string{"ssl_cert_file": files[0], "ssl_key_file": files[1]} {
+		if current[setting] == path {
+			continue
+		}
+		if _, err := t.query(ctx, fmt.Sprintf("ALTER SYSTEM SET %s = %s", setting, sqlQuote(path))); err != nil {
+			return result, err
+		}
+		result.Details[setting] = path
+	}
+
+	if _, err := t.query(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return result, err
+	}
+	result.Reloaded = []string{"postgresql"}
+
+	// A reload with a bad certificate keeps the old one and only logs, so
+	// ask the server whether TLS is still on
+	if ssl, err := t.query(ctx, "SHOW ssl"); err == nil {
+		result.Details["ssl"] = ssl
+	}
+	return result, nil
+}
+
+// query runs one statement over the local socket as the service user,
+// relying on peer authentication
+func (t *postgresTarget) query(ctx context.Context, statement string) (string, error) {
+	args := []string{"-X", "-A", "-t", "-v", "ON_ERROR_STOP=1", "-c", statement}
+	name, args := asUser(t.opts.User, "psql", args)
+	out, err := output(ctx, name, args...)
+	if err != nil {
+		return "", fmt.Errorf("psql %q failed: %w", statement, err)
+	}
+	return out, nil
+}
+
+// mysqlTarget installs ssl_cert/ssl_key for MySQL or MariaDB and reloads
+// the TLS context: ALTER INSTANCE RELOAD TLS on MySQL 8, FLUSH SSL on
+// MariaDB 10.4+. MySQL can also persist moved paths with SET PERSIST;
+// MariaDB can't change them at runtime, so there they must not move.
+type mysqlTarget struct {
+	env  *Env
+	opts DatabaseOptions
+}
+
+func newMySQLTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts DatabaseOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.User == "" {
+		opts.User = DEFAULT_MYSQL_USER
+	}
+	if opts.DefaultsFile == "" {
+		if _, err := os.Stat(MYSQL_DEBIAN_DEFAULTS); err == nil {
+			opts.DefaultsFile = MYSQL_DEBIAN_DEFAULTS
+		}
+	}
+	if !commandExists("mysql") && !commandExists("mariadb") {
+		return nil, tasks.Rejectf("mysql client not found")
+	}
+	return &mysqlTarget{env: env, opts: opts}, nil
+}
+
+func (t *mysqlTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	version, err := t.query(ctx, "SELECT VERSION()")
+	if err != nil {
+		return nil, err
+	}
+	mariadb := strings.Contains(strings.ToLower(version), "mariadb")
+
+	current, err := t.query(ctx, "SELECT @@datadir, @@ssl_cert, @@ssl_key")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(current, "\t")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected ssl settings %q", current)
+	}
+	currentCert, currentKey := resolveMySQLPath(fields[0], fields[1]), resolveMySQLPath(fields[0], fields[2])
+
+	certPath, keyPath := t.opts.CertFile, t.opts.KeyFile
+	if certPath == "" {
+		certPath = currentCert
+	}
+	if keyPath == "" {
+		keyPath = currentKey
+	}
+	moved := certPath != currentCert || keyPath != currentKey
+	if moved && mariadb {
+		return nil, tasks.Rejectf("MariaDB can't change ssl_cert/ssl_key at runtime; configure %s and %s first", certPath, keyPath)
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, tasks.Rejectf("server has no ssl_cert/ssl_key configured; set cert_file and key_file")
+	}
+
+	files, err := installPair(t.env, certPath, keyPath, bundle)
+	if err != nil {
+		return &Result{Files: files}, err
+	}
+	if err := chownToUser(files, t.opts.User); err != nil {
+		return &Result{Files: files}, err
+	}
+	result := &Result{Files: files, Details: map[string]string{"server": version}}
+
+	if moved {
+		statement := fmt.Sprintf("SET PERSIST ssl_cert = %s; SET PERSIST ssl_key = %s", sqlQuote(files[0]), sqlQuote(files[1]))
+		if _, err := t.query(ctx, statement); err != nil {
+			return result, err
+		}
+		result.Details["persisted"] = "ssl_cert,ssl_key"
+	}
+
+	reload := "ALTER INSTANCE RELOAD TLS"
+	if mariadb {
+		reload = "FLUSH SSL"
+	}
+	if _, err := t.query(ctx, reload); err != nil {
+		return result, err
+	}
+	result.Reloaded = []string{"mysql"}
+	return result, nil
+}
+
+// resolveMySQLPath turns batch output into a path; unset variables print
+// as NULL and relative ones live in the data directory
+func resolveMySQLPath(dataDir, path string) string {
+	switch {
+	case path == "NULL" || path == "":
+		return ""
+	case filepath.IsAbs(path):
+		return path
+	default:
+		return filepath.Join(dataDir, path)
+	}
+}
+
+func (t *mysqlTarget) query(ctx context.Context, statement string) (string, error) {
+	client := "mysql"
+	if !commandExists(client) {
+		client = "mariadb"
+	}
+	var args []string
+	// --defaults-file must come first
+	if t.opts.DefaultsFile != "" {
+		args = append(args, "--defaults-file="+t.opts.DefaultsFile)
+	}
+	args = append(args, "--batch", "--skip-column-names", "-e", statement)
+
+	out, err := output(ctx, client, args...)
+	if err != nil {
+		return "", fmt.Errorf("%s %q failed: %w", client, statement, err)
+	}
+	return out, nil
+}
+
+// chownToUser hands files to the database's service user
+func chownToUser(files []string, name string) error {
+	account, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	for _, file := range files {
+		if err := os.Chown(file, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// asUser wraps a command so it runs as the named user when the agent is
+// someone else
+func asUser(name, command string, args []string) (string, []string) {
+	if current, err := user.Current(); err == nil && current.Username == name {
+		return command, args
+	}
+	return "runuser", append([]string{"-u", name, "--", command}, args...)
+}
+
+// sqlQuote renders a string literal; standard_conforming_strings is the
+// default in PostgreSQL and MySQL accepts doubled quotes as well
+func sqlQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,444 @@
+// Package deploy installs renewed certificates into the servers that use
+// them. Each kind of server is a Target; the cert.deploy task picks the
+// target by name and hands it a validated Bundle.
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/events"
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/limits"
+	"github.com/certfix/certfix-agent/pkg/metrics"
+	"github.com/certfix/certfix-agent/pkg/secrets"
+	"github.com/certfix/certfix-agent/pkg/service"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_DEPLOY = "cert.deploy"
+)
+
+// ErrRolledBack marks failures after which a target restored the previous
+// configuration
+var ErrRolledBack = errors.New("changes rolled back")
+
+// Bundle is a certificate with its chain and private key, all PEM
+type Bundle struct {
+	// Name identifies the certificate across deployments (file names, tags)
+	Name        string
+	Certificate []byte
+	Chain       []byte
+	PrivateKey  []byte
+
+	leaf *x509.Certificate
+}
+
+// Validate checks the key matches the certificate and parses the leaf
+func (b *Bundle) Validate() error {
+	if !validName(b.Name) {
+		return tasks.Rejectf("invalid certificate name %q", b.Name)
+	}
+	pair, err := tls.X509KeyPair(b.FullChain(), b.PrivateKey)
+	if err != nil {
+		return tasks.Rejectf("certificate and key do not form a valid pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return tasks.Rejectf("invalid certificate: %v", err)
+	}
+	b.leaf = leaf
+	return nil
+}
+
+// Leaf returns the parsed leaf certificate; Validate must have succeeded
+func (b *Bundle) Leaf() *x509.Certificate {
+	return b.leaf
+}
+
+// FullChain is the leaf followed by its intermediates
+func (b *Bundle) FullChain() []byte {
+	var buf bytes.Buffer
+	buf.Write(bytes.TrimSpace(b.Certificate))
+	buf.WriteByte('\n')
+	if chain := bytes.TrimSpace(b.Chain); len(chain) > 0 {
+		buf.Write(chain)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// ChainCertificates returns the DER certificates of the intermediates
+func (b *Bundle) ChainCertificates() [][]byte {
+	var ders [][]byte
+	rest := b.Chain
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return ders
+		}
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+}
+
+// Fingerprint is the SHA-256 of the leaf certificate
+func (b *Bundle) Fingerprint() string {
+	sum := sha256.Sum256(b.leaf.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Names are used in file names and tags; keep them boring
+func validName(name string) bool {
+	if name == "" || len(name) > 128 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Result describes what a target changed
+type Result struct {
+	Target      string            `json:"target"`
+	Fingerprint string            `json:"fingerprint_sha256"`
+	Files       []string          `json:"files,omitempty"`
+	Reloaded    []string          `json:"reloaded,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// Target installs a bundle into one kind of server
+type Target interface {
+	Deploy(ctx context.Context, bundle *Bundle) (*Result, error)
+}
+
+// Env is what targets may touch on this host
+type Env struct {
+	// Roots confine every file a target writes
+	Roots []string
+	// Manager and Allowlist govern service reloads
+	Manager   service.Manager
+	Allowlist []string
+	// Validators override DefaultValidators by service name
+	Validators map[string][]string
+	// Secrets resolves secret references in target options
+	Secrets *secrets.Resolver
+}
+
+// Confine resolves path inside the allowed roots
+func (e *Env) Confine(path string) (string, error) {
+	return filetransfer.Confine(e.Roots, path)
+}
+
+// Reload reloads an allowlisted service once its configuration check
+// passes; a failed check is a *ValidationError
+func (e *Env) Reload(ctx context.Context, name string) (err error) {
+	if !allowed(e.Allowlist, name) {
+		return tasks.Rejectf("service %q is not in the allowlist", name)
+	}
+	if e.Manager == nil {
+		return fmt.Errorf("no service manager available to reload %s", name)
+	}
+	defer func(started time.Time) { metrics.Since(metrics.OP_RELOAD, name, started, err) }(time.Now())
+	if err := e.Validate(ctx, name); err != nil {
+		return err
+	}
+	return service.Apply(ctx, e.Manager, service.ACTION_RELOAD, name)
+}
+
+// Restart restarts an allowlisted service, for servers that can't reload,
+// with the same configuration check as Reload
+func (e *Env) Restart(ctx context.Context, name string) (err error) {
+	if !allowed(e.Allowlist, name) {
+		return tasks.Rejectf("service %q is not in the allowlist", name)
+	}
+	if e.Manager == nil {
+		return fmt.Errorf("no service manager available to restart %s", name)
+	}
+	defer func(started time.Time) { metrics.Since(metrics.OP_RELOAD, name, started, err) }(time.Now())
+	if err := e.Validate(ctx, name); err != nil {
+		return err
+	}
+	return service.Apply(ctx, e.Manager, service.ACTION_RESTART, name)
+}
+
+func allowed(list []string, name string) bool {
+	for _, entry := range list {
+		if entry == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Factory builds a target from the task's options
+type Factory func(env *Env, options json.RawMessage) (Target, error)
+
+// DeployRequest is the payload of a cert.deploy task
+type DeployRequest struct {
+	Name        string          `json:"name"`
+	Target      string          `json:"target"`
+	Options     json.RawMessage `json:"options,omitempty"`
+	Certificate string          `json:"certificate"`
+	Chain       string          `json:"chain,omitempty"`
+	PrivateKey  string          `json:"private_key"`
+}
+
+// Hook lets local policy veto a deployment before it happens or act on it
+// afterwards. BeforeDeploy refuses by returning an error (tasks.Rejectf
+// for policy decisions); AfterDeploy only runs when the target succeeded.
+type Hook interface {
+	BeforeDeploy(ctx context.Context, req *DeployRequest, bundle *Bundle) error
+	AfterDeploy(ctx context.Context, req *DeployRequest, bundle *Bundle, result *Result, env *Env) error
+}
+
+// Service runs cert.deploy tasks against registered targets
+type Service struct {
+	env       Env
+	audit     *audit.Logger
+	mu        sync.RWMutex
+	factories map[string]Factory
+	hooks     []Hook
+	deployed  []DeployedFunc
+	active    atomic.Int32
+}
+
+// DeployedFunc is told of every deployment Run completes, with its id
+type DeployedFunc func(id string, req *DeployRequest, result *Result)
+
+// NewService creates a deploy service with the built-in targets
+func NewService(env Env, auditLog *audit.Logger) *Service {
+	env.Roots = filetransfer.ResolveRoots(env.Roots)
+	if len(env.Allowlist) == 0 {
+		env.Allowlist = service.DefaultAllowlist
+	}
+	s := &Service{env: env, audit: auditLog, factories: make(map[string]Factory)}
+	for name, factory := range builtinTargets {
+		s.RegisterTarget(name, factory)
+	}
+	return s
+}
+
+// Built-in targets, filled in by each target's file
+var builtinTargets = map[string]Factory{}
+
+// RegisterTarget adds or replaces a target type
+func (s *Service) RegisterTarget(name string, factory Factory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.factories[name] = factory
+}
+
+// AddHook runs hook around every deployment, in the order added
+func (s *Service) AddHook(hook Hook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// OnDeployed calls fn after each successful Run, once every hook passed
+func (s *Service) OnDeployed(fn DeployedFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deployed = append(s.deployed, fn)
+}
+
+// Busy reports whether a deployment is under way, so changes to the files
+// it writes can be told from changes made by others
+func (s *Service) Busy() bool {
+	return s.active.Load() > 0
+}
+
+// Targets lists the available target types
+func (s *Service) Targets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.factories))
+	for name := range s.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register installs the cert.deploy and cert.deploy_fanout task handlers
+func (s *Service) Register(registry *tasks.Registry) {
+	registry.Register(TASK_DEPLOY, s.handleDeploy)
+	registry.Register(TASK_DEPLOY_FANOUT, s.handleFanOut)
+}
+
+func (s *Service) handleDeploy(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req DeployRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	return s.Run(ctx, task.ID, &req)
+}
+
+// Run deploys like Deploy and also audits and notifies, for deployments the
+// agent starts itself; id names the deployment in the audit log
+func (s *Service) Run(ctx context.Context, id string, req *DeployRequest) (*Result, error) {
+	started := time.Now()
+	result, err := s.Deploy(ctx, req)
+	s.record(id, req, result, err)
+	if err != nil {
+		s.notify(req, err, time.Since(started))
+		return result, err
+	}
+	s.mu.RLock()
+	deployed := s.deployed
+	s.mu.RUnlock()
+	for _, fn := range deployed {
+		fn(id, req, result)
+	}
+	return result, nil
+}
+
+// notify raises a local event for operators watching this host
+func (s *Service) notify(req *DeployRequest, err error, took time.Duration) {
+	event := events.Event{
+		Type:     events.EVENT_DEPLOY_FAILED,
+		Severity: events.SEVERITY_CRITICAL,
+		Summary:  fmt.Sprintf("Deployment of %s to %s failed: %v", req.Name, req.Target, err),
+		Details:  map[string]string{"certificate": req.Name, "target": req.Target, "duration": metrics.Format(took)},
+	}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		event.Details["validation_command"] = strings.Join(validation.Command, " ")
+		event.Details["validation_output"] = validation.Output
+	}
+	if errors.Is(err, ErrRolledBack) {
+		event.Type = events.EVENT_DEPLOY_ROLLED_BACK
+		event.Severity = events.SEVERITY_WARNING
+		event.Summary = fmt.Sprintf("Deployment of %s to %s was rolled back: %v", req.Name, req.Target, err)
+	}
+	events.Publish(event)
+}
+
+// Deploy validates the bundle and hands it to the requested target
+func (s *Service) Deploy(ctx context.Context, req *DeployRequest) (*Result, error) {
+	s.mu.RLock()
+	factory, ok := s.factories[req.Target]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, tasks.Rejectf("unknown deploy target %q (available: %s)", req.Target, strings.Join(s.Targets(), ", "))
+	}
+
+	bundle := &Bundle{
+		Name:        req.Name,
+		Certificate: []byte(req.Certificate),
+		Chain:       []byte(req.Chain),
+		PrivateKey:  []byte(req.PrivateKey),
+	}
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	s.active.Add(1)
+	defer s.active.Add(-1)
+
+	s.mu.RLock()
+	hooks := s.hooks
+	s.mu.RUnlock()
+	for _, hook := range hooks {
+		if err := hook.BeforeDeploy(ctx, req, bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	target, err := factory(&s.env, req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	limits.Wait(ctx)
+	started := time.Now()
+	result, err := target.Deploy(ctx, bundle)
+	metrics.Since(metrics.OP_DEPLOY, req.Target, started, err)
+	result = attachValidation(result, err)
+	if result != nil {
+		result.Target = req.Target
+		result.Fingerprint = bundle.Fingerprint()
+	}
+	if err != nil {
+		return result, err
+	}
+
+	for _, hook := range hooks {
+		started := time.Now()
+		err := hook.AfterDeploy(ctx, req, bundle, result, &s.env)
+		metrics.Since(metrics.OP_DEPLOY_HOOK, hookName(hook), started, err)
+		if err != nil {
+			return attachValidation(result, err), fmt.Errorf("post-deploy hook failed: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// hookName names a hook in metrics by its type, without the package
+func hookName(hook Hook) string {
+	name := strings.TrimPrefix(fmt.Sprintf("%T", hook), "*")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+func (s *Service) record(id string, req *DeployRequest, result *Result, err error) {
+	entry := audit.Entry{
+		TaskID:  id,
+		Action:  TASK_DEPLOY,
+		Target:  req.Target + ":" + req.Name,
+		Outcome: tasks.STATUS_SUCCEEDED,
+	}
+	if result != nil {
+		entry.Details = map[string]string{"fingerprint": result.Fingerprint}
+		if len(result.Files) > 0 {
+			entry.Details["files"] = strings.Join(result.Files, ",")
+		}
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", id, err)
+	}
+}
+
+// decodeOptions unmarshals target options, rejecting unknown fields
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(options))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return tasks.Rejectf("invalid target options: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+)
+
+// Upper bound for validation and reload commands
+const COMMAND_TIMEOUT = 60 * time.Second
+
+func run(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runEnv is run with an explicit environment, used to hand secrets to
+// tools without exposing them in the process list
+func runEnv(ctx context.Context, env []string, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+// outputEnv is output with an explicit environment, like runEnv
+func outputEnv(ctx context.Context, env []string, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = env
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// snapshot remembers file contents so a failed deployment can be undone
+type snapshot struct {
+	files map[string]*savedFile
+	undo  []func() error
+}
+
+type savedFile struct {
+	data   []byte
+	mode   os.FileMode
+	exists bool
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{files: make(map[string]*savedFile)}
+}
+
+// save records path's current state the first time it is seen
+func (s *snapshot) save(path string) {
+	if _, ok := s.files[path]; ok {
+		return
+	}
+	saved := &savedFile{}
+	if info, err := os.Stat(path); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			saved.data, saved.mode, saved.exists = data, info.Mode().Perm(), true
+		}
+	}
+	s.files[path] = saved
+}
+
+// onRestore registers an extra undo step, e.g. re-setting a config value
+func (s *snapshot) onRestore(undo func() error) {
+	s.undo = append(s.undo, undo)
+}
+
+// restore puts every saved file back, in no particular order, and runs the
+// undo steps in reverse
+func (s *snapshot) restore() {
+	for path, saved := range s.files {
+		var err error
+		if saved.exists {
+			err = filetransfer.WriteFileAtomic(path, saved.data, saved.mode)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[ERROR] Failed to restore %s: %v", path, err)
+		}
+	}
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		if err := s.undo[i](); err != nil {
+			log.Printf("[ERROR] Failed to undo deployment step: %v", err)
+		}
+	}
+}
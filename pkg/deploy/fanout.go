@@ -0,0 +1,166 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_DEPLOY_FANOUT = "cert.deploy_fanout"
+
+	MAX_DESTINATIONS = 64
+)
+
+// Destination is one place a fanned-out certificate goes
+type Destination struct {
+	// ID tells destinations apart in results; defaults to the target, with
+	// a counter when a target appears more than once
+	ID      string          `json:"id,omitempty"`
+	Target  string          `json:"target"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// FanOutRequest deploys one certificate, typically a wildcard, to several
+// targets in one operation
+type FanOutRequest struct {
+	Name         string        `json:"name"`
+	Certificate  string        `json:"certificate"`
+	Chain        string        `json:"chain,omitempty"`
+	PrivateKey   string        `json:"private_key"`
+	Destinations []Destination `json:"destinations"`
+}
+
+// DestinationResult is the outcome at one destination
+type DestinationResult struct {
+	ID         string  `json:"id"`
+	Target     string  `json:"target"`
+	Status     string  `json:"status"`
+	Result     *Result `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	RolledBack bool    `json:"rolled_back,omitempty"`
+}
+
+// FanOutResult reports every destination, failed or not
+type FanOutResult struct {
+	Fingerprint  string              `json:"fingerprint_sha256"`
+	Succeeded    int                 `json:"succeeded"`
+	Failed       int                 `json:"failed"`
+	Destinations []DestinationResult `json:"destinations"`
+}
+
+// FanOut deploys to every destination at once. Destinations of the same
+// target type go one after another, since they usually share a server and
+// its reloads, and no more target types run together than the agent has
+// CPUs to use; one destination failing doesn't stop the others. id names
+// the operation in the audit log.
+func (s *Service) FanOut(ctx context.Context, id string, req *FanOutRequest) (*FanOutResult, error) {
+	if len(req.Destinations) == 0 {
+		return nil, tasks.Rejectf("no destinations")
+	}
+	if len(req.Destinations) > MAX_DESTINATIONS {
+		return nil, tasks.Rejectf("too many destinations (%d, max %d)", len(req.Destinations), MAX_DESTINATIONS)
+	}
+	// An unusable bundle is refused before any destination is touched
+	bundle := &Bundle{
+		Name:        req.Name,
+		Certificate: []byte(req.Certificate),
+		Chain:       []byte(req.Chain),
+		PrivateKey:  []byte(req.PrivateKey),
+	}
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+
+	destinations := NamedDestinations(req.Destinations)
+	result := &FanOutResult{
+		Fingerprint:  bundle.Fingerprint(),
+		Destinations: make([]DestinationResult, len(destinations)),
+	}
+	byTarget := map[string][]int{}
+	for i, d := range destinations {
+		byTarget[d.Target] = append(byTarget[d.Target], i)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, indexes := range byTarget {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			for _, i := range indexes {
+				result.Destinations[i] = s.deployDestination(ctx, id, req, &destinations[i])
+			}
+		}(indexes)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, d := range result.Destinations {
+		if d.Status == tasks.STATUS_SUCCEEDED {
+			result.Succeeded++
+		} else {
+			result.Failed++
+			failed = append(failed, fmt.Sprintf("%s: %s", d.ID, d.Error))
+		}
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d destinations failed: %s", result.Failed, len(destinations), strings.Join(failed, "; "))
+	}
+	return result, nil
+}
+
+func (s *Service) deployDestination(ctx context.Context, id string, req *FanOutRequest, d *Destination) DestinationResult {
+	deployed, err := s.Run(ctx, id+"/"+d.ID, &DeployRequest{
+		Name:        req.Name,
+		Target:      d.Target,
+		Options:     d.Options,
+		Certificate: req.Certificate,
+		Chain:       req.Chain,
+		PrivateKey:  req.PrivateKey,
+	})
+	outcome := DestinationResult{ID: d.ID, Target: d.Target, Status: tasks.STATUS_SUCCEEDED, Result: deployed}
+	if err != nil {
+		outcome.Status = tasks.STATUS_FAILED
+		if errors.Is(err, tasks.ErrRejected) {
+			outcome.Status = tasks.STATUS_REJECTED
+		}
+		outcome.Error = err.Error()
+		outcome.RolledBack = errors.Is(err, ErrRolledBack)
+	}
+	return outcome
+}
+
+// NamedDestinations fills in missing IDs: the target name, numbered from the
+// second use of a target on
+func NamedDestinations(destinations []Destination) []Destination {
+	named := make([]Destination, len(destinations))
+	used := map[string]int{}
+	for i, d := range destinations {
+		if d.ID == "" {
+			d.ID = d.Target
+			if n := used[d.Target]; n > 0 {
+				d.ID = fmt.Sprintf("%s#%d", d.Target, n+1)
+			}
+		}
+		used[d.Target]++
+		named[i] = d
+	}
+	return named
+}
+
+func (s *Service) handleFanOut(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req FanOutRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	return s.FanOut(ctx, task.ID, &req)
+}
@@ -0,0 +1,86 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+)
+
+// installFile writes data to a path confined to the env's roots
+func installFile(env *Env, path string, data []byte, private bool) (string, error) {
+	resolved, err := env.Confine(path)
+	if err != nil {
+		return "", err
+	}
+
+	mode := filetransfer.PUBLIC_FILE_MODE
+	if private {
+		mode = filetransfer.PRIVATE_FILE_MODE
+	}
+	if err := filetransfer.WriteFileAtomic(resolved, data, mode); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// installPair writes the full chain and the key; the key goes first so a
+// server reloading in between never pairs a new certificate with an old key
+func installPair(env *Env, certPath, keyPath string, bundle *Bundle) ([]string, error) {
+	key, err := installFile(env, keyPath, bundle.PrivateKey, true)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := installFile(env, certPath, bundle.FullChain(), false)
+	if err != nil {
+		return []string{key}, err
+	}
+	return []string{cert, key}, nil
+}
+
+// buildKeystore encodes the bundle as a PKCS12 or JKS keystore holding one
+// key entry. The standard library can't write PKCS12, so openssl (and
+// keytool for JKS) do the encoding; secrets reach them through the
+// environment, never the command line.
+func buildKeystore(ctx context.Context, bundle *Bundle, storeType, alias, password string) ([]byte, error) {
+	work, err := os.MkdirTemp("", "certfix-keystore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(work)
+
+	chainFile := filepath.Join(work, "chain.pem")
+	keyFile := filepath.Join(work, "key.pem")
+	if err := os.WriteFile(chainFile, bundle.FullChain(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write chain: %w", err)
+	}
+	if err := os.WriteFile(keyFile, bundle.PrivateKey, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key: %w", err)
+	}
+
+	env := append(os.Environ(), "CERTFIX_KEYSTORE_PASS="+password)
+	p12 := filepath.Join(work, "keystore.p12")
+	if err := runEnv(ctx, env, "openssl", "pkcs12", "-export",
+		"-in", chainFile, "-inkey", keyFile, "-name", alias,
+		"-passout", "env:CERTFIX_KEYSTORE_PASS", "-out", p12); err != nil {
+		return nil, err
+	}
+
+	output := p12
+	if storeType == "JKS" {
+		output = filepath.Join(work, "keystore.jks")
+		if err := runEnv(ctx, env, "keytool", "-importkeystore", "-noprompt",
+			"-srckeystore", p12, "-srcstoretype", "PKCS12", "-srcstorepass:env", "CERTFIX_KEYSTORE_PASS",
+			"-destkeystore", output, "-deststoretype", "JKS", "-deststorepass:env", "CERTFIX_KEYSTORE_PASS"); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generated keystore: %w", err)
+	}
+	return data, nil
+}
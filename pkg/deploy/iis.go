@@ -0,0 +1,391 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_IIS = "iis"
+
+	IIS_STORE_PERSONAL    = "My"
+	IIS_STORE_WEBHOSTING  = "WebHosting"
+	DEFAULT_IIS_PORT      = 443
+	IIS_FRIENDLY_PREFIX   = "certfix:"
+	IIS_SERVED_TIMEOUT    = 30 * time.Second
+	IIS_SSL_FLAG_SNI      = 1
+	IIS_ALL_UNASSIGNED_IP = "*"
+)
+
+func init() {
+	builtinTargets[TARGET_IIS] = newIISTarget
+}
+
+// IISBinding is an HTTPS binding of a site that should serve the
+// certificate; it is created when missing
+type IISBinding struct {
+	Site string `json:"site"`
+	// Hostname is the binding's host header; empty binds every name
+	Hostname string `json:"hostname,omitempty"`
+	// Port defaults to 443 and IP to all unassigned addresses ("*")
+	Port int    `json:"port,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	// Bindings with a hostname use SNI unless disabled, which makes them
+	// share the IP and port's certificate with every site on them
+	DisableSNI bool `json:"disable_sni,omitempty"`
+}
+
+// IISOptions configure the IIS target
+type IISOptions struct {
+	Bindings []IISBinding `json:"bindings"`
+	// Store is My (Personal, the default) or WebHosting, which IIS loads
+	// on demand and suits hosts with many certificates
+	Store string `json:"store,omitempty"`
+	// KeepPrevious leaves certificates this target deployed before in the
+	// store; by default they are deleted once no binding uses them
+	KeepPrevious bool `json:"keep_previous,omitempty"`
+}
+
+// iisTarget imports the certificate into the local machine store and
+// points the configured HTTPS bindings at its thumbprint. Bindings of
+// those sites still on a certificate the target deployed earlier for the
+// same name, and no longer configured, are superseded and removed. The
+// import and the binding changes run as one PowerShell script that undoes
+// its binding changes if any of them fails.
+type iisTarget struct {
+	opts IISOptions
+}
+
+// iisRequest is what the script is given, through the environment
+type iisRequest struct {
+	PFX           string            `json:"pfx"`
+	Store         string            `json:"store"`
+	Thumbprint    string            `json:"thumbprint"`
+	FriendlyName  string            `json:"friendly_name"`
+	Intermediates []string          `json:"intermediates"`
+	Bindings      []iisBindingState `json:"bindings"`
+	KeepPrevious  bool              `json:"keep_previous"`
+}
+
+type iisBindingState struct {
+	Site     string `json:"site"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Hostname string `json:"hostname"`
+	SSLFlags int    `json:"ssl_flags"`
+}
+
+// iisResponse is what the script reports back
+type iisResponse struct {
+	Imported     bool     `json:"imported"`
+	Created      []string `json:"created"`
+	Updated      []string `json:"updated"`
+	Removed      []string `json:"removed"`
+	Deleted      []string `json:"deleted"`
+	Error        string   `json:"error"`
+	CleanupError string   `json:"cleanup_error"`
+}
+
+func newIISTarget(env *Env, options json.RawMessage) (Target, error) {
+	if runtime.GOOS != "windows" {
+		return nil, tasks.Rejectf("the iis target is only available on Windows")
+	}
+	var opts IISOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Bindings) == 0 {
+		return nil, tasks.Rejectf("iis target requires at least one binding")
+	}
+	switch opts.Store {
+	case "":
+		opts.Store = IIS_STORE_PERSONAL
+	case IIS_STORE_PERSONAL, IIS_STORE_WEBHOSTING:
+	default:
+		return nil, tasks.Rejectf("invalid store %q: want %s or %s", opts.Store, IIS_STORE_PERSONAL, IIS_STORE_WEBHOSTING)
+	}
+	for i := range opts.Bindings {
+		b := &opts.Bindings[i]
+		// Site names end up in configuration paths quoted with '
+		if b.Site == "" || strings.ContainsAny(b.Site, `'"`) {
+			return nil, tasks.Rejectf("invalid site %q", b.Site)
+		}
+		if b.Port == 0 {
+			b.Port = DEFAULT_IIS_PORT
+		}
+		if b.Port < 1 || b.Port > 65535 {
+			return nil, tasks.Rejectf("invalid port %d", b.Port)
+		}
+		if b.IP == "" {
+			b.IP = IIS_ALL_UNASSIGNED_IP
+		}
+		if b.IP != IIS_ALL_UNASSIGNED_IP && net.ParseIP(b.IP) == nil {
+			return nil, tasks.Rejectf("invalid ip %q", b.IP)
+		}
+		if strings.ContainsAny(b.Hostname, `:'" `) {
+			return nil, tasks.Rejectf("invalid hostname %q", b.Hostname)
+		}
+	}
+	if !commandExists("powershell") {
+		return nil, tasks.Rejectf("powershell not found")
+	}
+	return &iisTarget{opts: opts}, nil
+}
+
+func (t *iisTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	leaf := bundle.Leaf()
+	req := iisRequest{
+		Store:        t.opts.Store,
+		Thumbprint:   sha1Hex(leaf.Raw),
+		FriendlyName: IIS_FRIENDLY_PREFIX + bundle.Name,
+		KeepPrevious: t.opts.KeepPrevious,
+	}
+	for _, b := range t.opts.Bindings {
+		if b.Hostname != "" && !certificateCovers(bundle, b.Hostname) {
+			return nil, tasks.Rejectf("certificate does not cover %s, the hostname of a binding of %s", b.Hostname, b.Site)
+		}
+		state := iisBindingState{Site: b.Site, IP: b.IP, Port: b.Port, Hostname: b.Hostname}
+		if b.Hostname != "" && !b.DisableSNI {
+			state.SSLFlags = IIS_SSL_FLAG_SNI
+		}
+		req.Bindings = append(req.Bindings, state)
+	}
+
+	// PowerShell imports from files only; keep them private and short-lived
+	dir, err := os.MkdirTemp("", "certfix-iis-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	password, pfx, err := iisPFX(bundle)
+	if err != nil {
+		return nil, err
+	}
+	req.PFX = filepath.Join(dir, "certificate.pfx")
+	if err := os.WriteFile(req.PFX, pfx, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	// Intermediates go to the machine's CA store, where HTTP.sys looks
+	// for the chain it sends
+	for i, der := range bundle.ChainCertificates() {
+		file := filepath.Join(dir, "intermediate-"+strconv.Itoa(i)+".cer")
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write intermediate: %w", err)
+		}
+		req.Intermediates = append(req.Intermediates, file)
+	}
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	env := append(os.Environ(), "CERTFIX_IIS_REQUEST="+string(encoded), "CERTFIX_PFX_PASSWORD="+password)
+	out, err := outputEnv(ctx, env, "powershell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass",
+		"-EncodedCommand", encodePowerShell(iisScript))
+	if err != nil {
+		return nil, fmt.Errorf("iis binding script failed: %w", err)
+	}
+	// Modules may print warnings ahead of the answer, which is the last line
+	lines := strings.Split(out, "\n")
+	var response iisResponse
+	if err := json.Unmarshal([]byte(strings.TrimSpace(lines[len(lines)-1])), &response); err != nil {
+		return nil, fmt.Errorf("unexpected output from iis binding script: %s", out)
+	}
+
+	result := &Result{Details: map[string]string{
+		"thumbprint": req.Thumbprint,
+		"store":      `Cert:\LocalMachine\` + req.Store,
+	}}
+	for name, values := range map[string][]string{
+		"created": response.Created,
+		"updated": response.Updated,
+		"removed": response.Removed,
+		"deleted": response.Deleted,
+	} {
+		if len(values) > 0 {
+			result.Details[name] = strings.Join(values, ",")
+		}
+	}
+	if response.Error != "" {
+		return result, fmt.Errorf("failed to update bindings: %s: %w", response.Error, ErrRolledBack)
+	}
+	if response.CleanupError != "" {
+		result.Details["cleanup_error"] = response.CleanupError
+	}
+
+	for _, b := range req.Bindings {
+		host := b.IP
+		if host == IIS_ALL_UNASSIGNED_IP {
+			host = "127.0.0.1"
+		}
+		serverName := ""
+		if b.SSLFlags&IIS_SSL_FLAG_SNI != 0 {
+			serverName = strings.Replace(b.Hostname, "*", "certfix-check", 1)
+		}
+		if err := waitServed(ctx, net.JoinHostPort(host, strconv.Itoa(b.Port)), serverName, bundle.Fingerprint(), IIS_SERVED_TIMEOUT); err != nil {
+			return result, fmt.Errorf("site %s: %w", b.Site, err)
+		}
+	}
+	return result, nil
+}
+
+// certificateCovers reports whether the certificate is valid for a binding
+// hostname, which may itself be a wildcard in IIS 10
+func certificateCovers(bundle *Bundle, hostname string) bool {
+	leaf := bundle.Leaf()
+	if strings.HasPrefix(hostname, "*.") {
+		for _, name := range leaf.DNSNames {
+			if strings.EqualFold(name, hostname) {
+				return true
+			}
+		}
+		return false
+	}
+	return leaf.VerifyHostname(hostname) == nil
+}
+
+// iisPFX packs the leaf and key under a one-time password. The legacy
+// 3DES encryption is the one Windows Server 2016 and older can import;
+// the file never outlives the deployment.
+func iisPFX(bundle *Bundle) (string, []byte, error) {
+	pair, err := tls.X509KeyPair(bundle.FullChain(), bundle.PrivateKey)
+	if err != nil {
+		return "", nil, err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	password := hex.EncodeToString(secret)
+	pfx, err := pkcs12.LegacyDES.Encode(pair.PrivateKey, bundle.Leaf(), nil, password)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode PFX: %w", err)
+	}
+	return password, pfx, nil
+}
+
+// encodePowerShell renders a script for -EncodedCommand (base64 of
+// UTF-16LE), which sidesteps Windows command line quoting
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], unit)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// iisScript imports the certificate and updates the bindings with the
+// WebAdministration module. Binding changes are undone in reverse if one
+// fails; removing superseded bindings and certificates comes after and
+// only reports its failures.
+const iisScript = `
+$ErrorActionPreference = 'Stop'
+$ProgressPreference = 'SilentlyContinue'
+Import-Module WebAdministration
+$req = $env:CERTFIX_IIS_REQUEST | ConvertFrom-Json
+$store = "Cert:\LocalMachine\$($req.store)"
+$result = [ordered]@{ imported = $false; created = @(); updated = @(); removed = @(); deleted = @(); error = ''; cleanup_error = '' }
+$undo = New-Object System.Collections.ArrayList
+
+function Find-Binding($site, $info) {
+	Get-WebBinding -Name $site -Protocol https | Where-Object { $_.bindingInformation -eq $info } | Select-Object -First 1
+}
+
+try {
+	foreach ($file in $req.intermediates) {
+		Import-Certificate -FilePath $file -CertStoreLocation Cert:\LocalMachine\CA | Out-Null
+	}
+	if (-not (Test-Path "$store\$($req.thumbprint)")) {
+		$password = ConvertTo-SecureString -String $env:CERTFIX_PFX_PASSWORD -AsPlainText -Force
+		$cert = Import-PfxCertificate -FilePath $req.pfx -CertStoreLocation $store -Password $password
+		$cert.FriendlyName = $req.friendly_name
+		$result.imported = $true
+	}
+
+	foreach ($b in $req.bindings) {
+		$site = $b.site
+		$info = '{0}:{1}:{2}' -f $b.ip, $b.port, $b.hostname
+		if (-not (Get-Website -Name $site)) { throw "site '$site' not found" }
+		$binding = Find-Binding $site $info
+		if (-not $binding) {
+			New-WebBinding -Name $site -Protocol https -IPAddress $b.ip -Port $b.port -HostHeader $b.hostname -SslFlags $b.ssl_flags
+			[void]$undo.Add({ Find-Binding $site $info | Remove-WebBinding }.GetNewClosure())
+			$binding = Find-Binding $site $info
+			$result.created += "$site $info"
+		} elseif ([int]$binding.sslFlags -ne $b.ssl_flags) {
+			$filter = "system.applicationHost/sites/site[@name='$site']/bindings/binding[@protocol='https' and @bindingInformation='$info']"
+			$flags = [int]$binding.sslFlags
+			Set-WebConfigurationProperty -PSPath 'IIS:\' -Filter $filter -Name sslFlags -Value $b.ssl_flags
+			[void]$undo.Add({ Set-WebConfigurationProperty -PSPath 'IIS:\' -Filter $filter -Name sslFlags -Value $flags }.GetNewClosure())
+			$binding = Find-Binding $site $info
+		}
+		if ($binding.certificateHash -ne $req.thumbprint) {
+			$hash = $binding.certificateHash
+			$hashStore = $binding.certificateStoreName
+			if ($hash) { $binding.RemoveSslCertificate() }
+			$binding.AddSslCertificate($req.thumbprint, $req.store)
+			[void]$undo.Add({
+				$current = Find-Binding $site $info
+				$current.RemoveSslCertificate()
+				if ($hash) { $current.AddSslCertificate($hash, $hashStore) }
+			}.GetNewClosure())
+			$result.updated += "$site $info"
+		}
+	}
+} catch {
+	$result.error = $_.Exception.Message
+	for ($i = $undo.Count - 1; $i -ge 0; $i--) {
+		try { & $undo[$i] } catch {}
+	}
+	$result | ConvertTo-Json -Compress
+	exit 0
+}
+
+try {
+	$previous = @(Get-ChildItem $store | Where-Object { $_.FriendlyName -eq $req.friendly_name -and $_.Thumbprint -ne $req.thumbprint } | ForEach-Object { $_.Thumbprint })
+	$wanted = @{}
+	foreach ($b in $req.bindings) { $wanted["$($b.site)|$($b.ip):$($b.port):$($b.hostname)"] = $true }
+	foreach ($site in @($req.bindings | ForEach-Object { $_.site } | Select-Object -Unique)) {
+		foreach ($binding in @(Get-WebBinding -Name $site -Protocol https)) {
+			if ($wanted.ContainsKey("$site|$($binding.bindingInformation)")) { continue }
+			if (-not $binding.certificateHash -or $previous -notcontains $binding.certificateHash) { continue }
+			# A binding without SNI shares its IP and port's certificate
+			if (([int]$binding.sslFlags -band 1) -ne 0) { $binding.RemoveSslCertificate() }
+			$binding | Remove-WebBinding
+			$result.removed += "$site $($binding.bindingInformation)"
+		}
+	}
+	if (-not $req.keep_previous) {
+		$bound = @(Get-ChildItem IIS:\SslBindings | ForEach-Object { $_.Thumbprint })
+		foreach ($thumbprint in $previous) {
+			if ($bound -contains $thumbprint) { continue }
+			Remove-Item "$store\$thumbprint" -DeleteKey
+			$result.deleted += $thumbprint
+		}
+	}
+} catch {
+	$result.cleanup_error = $_.Exception.Message
+}
+$result | ConvertTo-Json -Compress
+`
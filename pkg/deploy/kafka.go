@@ -0,0 +1,457 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_KAFKA = "kafka"
+
+	DEFAULT_KAFKA_USER    = "kafka"
+	DEFAULT_KAFKA_SERVICE = "kafka"
+	KAFKA_KEY_ALIAS       = "kafka"
+
+	// Dynamic reload alters the listener's keystore through the admin API;
+	// restart restarts the broker once the cluster can spare it
+	KAFKA_RELOAD_DYNAMIC = "dynamic"
+	KAFKA_RELOAD_RESTART = "restart"
+
+	// A restarted broker recovers its logs before listening, and then has
+	// to catch up with its partitions' leaders
+	KAFKA_SERVED_TIMEOUT = 5 * time.Minute
+	KAFKA_SETTLE_TIMEOUT = 15 * time.Minute
+	KAFKA_POLL_INTERVAL  = 10 * time.Second
+)
+
+// Searched in order when server_properties is not given
+var kafkaConfigPaths = []string{
+	"/etc/kafka/server.properties",
+	"/etc/kafka/kraft/server.properties",
+	"/opt/kafka/config/server.properties",
+	"/opt/kafka/config/kraft/server.properties",
+}
+
+func init() {
+	builtinTargets[TARGET_KAFKA] = newKafkaTarget
+}
+
+// KafkaOptions configure the Kafka target
+type KafkaOptions struct {
+	// ServerProperties defaults to a distro or tarball path
+	ServerProperties string `json:"server_properties,omitempty"`
+	// Listener names the TLS listener to rotate; the first SSL or SASL_SSL
+	// listener by default
+	Listener string `json:"listener,omitempty"`
+	// KeystorePassword replaces the ssl.keystore.password (or, for PEM,
+	// ssl.key.password) of server.properties, for brokers that read it from
+	// a config provider; it may be a secret reference
+	KeystorePassword string `json:"keystore_password,omitempty"`
+	// Reload is dynamic or restart; dynamic when bootstrap_server is set
+	Reload string `json:"reload,omitempty"`
+	// BootstrapServer is where the admin tools connect, for dynamic reloads
+	// and the replication checks around a restart. List more than this
+	// broker, so the checks work while it restarts.
+	BootstrapServer string `json:"bootstrap_server,omitempty"`
+	// CommandConfig holds the admin client's security settings
+	CommandConfig string `json:"command_config,omitempty"`
+	// Service is restarted; defaults to kafka
+	Service string `json:"service,omitempty"`
+	// User owns the keystore; defaults to kafka
+	User string `json:"user,omitempty"`
+}
+
+// kafkaTarget rewrites the keystore a TLS listener references (JKS,
+// PKCS12 or a PEM file) and gets the broker to use it. A dynamic reload
+// points the listener at the keystore again through kafka-configs, which
+// makes the broker load the modified file with no downtime; Kafka refuses
+// it when the certificate's names change, and the target falls back to a
+// restart. A restart is rolling: it waits until no partition is
+// under-replicated, so taking this broker down loses no redundancy, and
+// after it waits for the broker to catch up again, so the next broker's
+// agent won't restart before it has.
+type kafkaTarget struct {
+	env  *Env
+	opts KafkaOptions
+}
+
+// kafkaListener is an entry of the listeners property
+type kafkaListener struct {
+	name    string
+	address string
+}
+
+func newKafkaTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts KafkaOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.ServerProperties == "" {
+		for _, path := range kafkaConfigPaths {
+			if _, err := os.Stat(path); err == nil {
+				opts.ServerProperties = path
+				break
+			}
+		}
+		if opts.ServerProperties == "" {
+			return nil, tasks.Rejectf("no Kafka server.properties found; set server_properties")
+		}
+	}
+	if opts.Reload == "" {
+		opts.Reload = KAFKA_RELOAD_RESTART
+		if opts.BootstrapServer != "" {
+			opts.Reload = KAFKA_RELOAD_DYNAMIC
+		}
+	}
+	if opts.Reload != KAFKA_RELOAD_DYNAMIC && opts.Reload != KAFKA_RELOAD_RESTART {
+		return nil, tasks.Rejectf("invalid reload %q: want %s or %s", opts.Reload, KAFKA_RELOAD_DYNAMIC, KAFKA_RELOAD_RESTART)
+	}
+	if opts.Reload == KAFKA_RELOAD_DYNAMIC && opts.BootstrapServer == "" {
+		return nil, tasks.Rejectf("dynamic reload requires bootstrap_server")
+	}
+	if opts.Service == "" {
+		opts.Service = DEFAULT_KAFKA_SERVICE
+	}
+	if opts.User == "" {
+		opts.User = DEFAULT_KAFKA_USER
+	}
+	return &kafkaTarget{env: env, opts: opts}, nil
+}
+
+func (t *kafkaTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	props, err := readProperties(t.opts.ServerProperties)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := t.listener(props)
+	if err != nil {
+		return nil, err
+	}
+	// Listener settings override the broker-wide ones
+	prefix := "listener.name." + strings.ToLower(listener.name) + "."
+	setting := func(key string) string {
+		if value, ok := props[prefix+key]; ok {
+			return value
+		}
+		return props[key]
+	}
+
+	if setting("ssl.keystore.key") != "" || setting("ssl.keystore.certificate.chain") != "" {
+		return nil, tasks.Rejectf("listener %s has its PEM keystore inline in %s; use ssl.keystore.location", listener.name, t.opts.ServerProperties)
+	}
+	location := setting("ssl.keystore.location")
+	if location == "" {
+		return nil, tasks.Rejectf("listener %s has no ssl.keystore.location in %s", listener.name, t.opts.ServerProperties)
+	}
+	path, err := t.env.Confine(location)
+	if err != nil {
+		return nil, err
+	}
+	storeType := strings.ToUpper(setting("ssl.keystore.type"))
+	if storeType == "" {
+		storeType = "JKS"
+	}
+
+	var data []byte
+	switch storeType {
+	case "PEM":
+		password, err := t.password(ctx, setting("ssl.key.password"))
+		if err != nil {
+			return nil, err
+		}
+		data, err = kafkaPEMKeystore(ctx, bundle, password)
+		if err != nil {
+			return nil, err
+		}
+	case "JKS", "PKCS12":
+		password, err := t.password(ctx, setting("ssl.keystore.password"))
+		if err != nil {
+			return nil, err
+		}
+		// keytool gives the key the store's password
+		if keyPassword := setting("ssl.key.password"); keyPassword != "" && keyPassword != password && !strings.Contains(keyPassword, "${") {
+			return nil, tasks.Rejectf("ssl.key.password differs from ssl.keystore.password; the keystore is written with one password")
+		}
+		if data, err = buildKeystore(ctx, bundle, storeType, KAFKA_KEY_ALIAS, password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, tasks.Rejectf("unsupported keystore type %q", storeType)
+	}
+
+	snap := newSnapshot()
+	snap.save(path)
+	file, err := installFile(t.env, path, data, true)
+	if err == nil {
+		err = chownToUser([]string{file}, t.opts.User)
+	}
+	if err != nil {
+		snap.restore()
+		return nil, err
+	}
+	result := &Result{Files: []string{file}, Details: map[string]string{
+		"listener": listener.name,
+		"format":   storeType,
+	}}
+
+	reload := t.opts.Reload
+	if reload == KAFKA_RELOAD_DYNAMIC {
+		err := t.alterKeystore(ctx, props, prefix+"ssl.keystore.location", location)
+		switch {
+		case err == nil:
+			result.Details["reload"] = KAFKA_RELOAD_DYNAMIC
+		case strings.Contains(err.Error(), "do not match"):
+			// A certificate for other names can only be loaded at startup
+			result.Details["dynamic_reload"] = "refused: certificate names changed"
+			reload = KAFKA_RELOAD_RESTART
+		default:
+			// The broker keeps its old keystore; keep the file it matches
+			snap.restore()
+			return nil, fmt.Errorf("%w: %w", err, ErrRolledBack)
+		}
+	}
+	if reload == KAFKA_RELOAD_RESTART {
+		if err := t.waitReplicated(ctx, "restarting"); err != nil {
+			return result, err
+		}
+		if err := t.env.Restart(ctx, t.opts.Service); err != nil {
+			return result, fmt.Errorf("failed to restart %s: %w", t.opts.Service, err)
+		}
+		result.Reloaded = []string{t.opts.Service}
+		result.Details["reload"] = KAFKA_RELOAD_RESTART
+	}
+
+	result.Details["address"] = listener.address
+	if err := waitServed(ctx, listener.address, "", bundle.Fingerprint(), KAFKA_SERVED_TIMEOUT); err != nil {
+		return result, err
+	}
+	if reload == KAFKA_RELOAD_RESTART {
+		if err := t.waitReplicated(ctx, "the restart"); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// listener finds the TLS listener in the listeners property, by name or
+// by its security protocol
+func (t *kafkaTarget) listener(props map[string]string) (*kafkaListener, error) {
+	protocols := map[string]string{}
+	for _, entry := range strings.Split(props["listener.security.protocol.map"], ",") {
+		if name, protocol, ok := strings.Cut(strings.TrimSpace(entry), ":"); ok {
+			protocols[strings.ToUpper(name)] = strings.ToUpper(protocol)
+		}
+	}
+
+	for _, entry := range strings.Split(props["listeners"], ",") {
+		name, address, ok := strings.Cut(strings.TrimSpace(entry), "://")
+		if !ok {
+			continue
+		}
+		name = strings.ToUpper(name)
+		if t.opts.Listener != "" {
+			if name != strings.ToUpper(t.opts.Listener) {
+				continue
+			}
+		} else if protocol := protocols[name]; protocol != "SSL" && protocol != "SASL_SSL" && !(protocol == "" && (name == "SSL" || name == "SASL_SSL")) {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q in %s", entry, t.opts.ServerProperties)
+		}
+		// Brokers listening on every interface are checked on loopback
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		return &kafkaListener{name: name, address: net.JoinHostPort(host, port)}, nil
+	}
+	if t.opts.Listener != "" {
+		return nil, tasks.Rejectf("no listener %s in %s", t.opts.Listener, t.opts.ServerProperties)
+	}
+	return nil, tasks.Rejectf("no SSL or SASL_SSL listener in %s", t.opts.ServerProperties)
+}
+
+// password resolves the configured password, or takes the one in
+// server.properties unless a config provider supplies it
+func (t *kafkaTarget) password(ctx context.Context, configured string) (string, error) {
+	if t.opts.KeystorePassword != "" {
+		return t.env.Secrets.Resolve(ctx, t.opts.KeystorePassword)
+	}
+	if strings.Contains(configured, "${") {
+		return "", tasks.Rejectf("keystore password in %s comes from a config provider; set keystore_password", t.opts.ServerProperties)
+	}
+	return configured, nil
+}
+
+// alterKeystore sets the listener's keystore location as a dynamic broker
+// config. Setting the same path again makes the broker reload the file,
+// after checking the new certificate keeps the old one's names.
+func (t *kafkaTarget) alterKeystore(ctx context.Context, props map[string]string, key, location string) error {
+	broker := props["node.id"]
+	if broker == "" {
+		broker = props["broker.id"]
+	}
+	if broker == "" || broker == "-1" {
+		return tasks.Rejectf("%s sets no broker.id or node.id to reconfigure", t.opts.ServerProperties)
+	}
+	if strings.ContainsAny(location, ",[]") {
+		return tasks.Rejectf("keystore path %q can't be passed to kafka-configs", location)
+	}
+	_, err := t.admin(ctx, "kafka-configs", "--entity-type", "brokers", "--entity-name", broker,
+		"--alter", "--add-config", key+"="+location)
+	return err
+}
+
+// waitReplicated waits until no partition is under-replicated. Without a
+// bootstrap server there is no cluster view and nothing to wait for.
+func (t *kafkaTarget) waitReplicated(ctx context.Context, stage string) error {
+	if t.opts.BootstrapServer == "" {
+		return nil
+	}
+	deadline := time.Now().Add(KAFKA_SETTLE_TIMEOUT)
+	for {
+		out, err := t.admin(ctx, "kafka-topics", "--describe", "--under-replicated-partitions")
+		if err == nil && out == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("failed to check replication before %s: %w", stage, err)
+			}
+			return fmt.Errorf("partitions still under-replicated %s before %s: %d", KAFKA_SETTLE_TIMEOUT, stage, strings.Count(out, "\n")+1)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(KAFKA_POLL_INTERVAL):
+		}
+	}
+}
+
+// admin runs a Kafka admin tool against the bootstrap server
+func (t *kafkaTarget) admin(ctx context.Context, tool string, args ...string) (string, error) {
+	command := t.tool(tool)
+	if command == "" {
+		return "", tasks.Rejectf("%s not found", tool)
+	}
+	args = append([]string{"--bootstrap-server", t.opts.BootstrapServer}, args...)
+	if t.opts.CommandConfig != "" {
+		args = append(args, "--command-config", t.opts.CommandConfig)
+	}
+	out, err := output(ctx, command, args...)
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w", tool, err)
+	}
+	return out, nil
+}
+
+// tool finds a Kafka script: on the PATH, as packaged by Apache (.sh) or
+// Confluent (no extension), or in the bin directory of the installation
+// server.properties belongs to
+func (t *kafkaTarget) tool(name string) string {
+	for _, candidate := range []string{name + ".sh", name} {
+		if commandExists(candidate) {
+			return candidate
+		}
+	}
+	dir := filepath.Dir(t.opts.ServerProperties)
+	for i := 0; i < 3; i++ {
+		dir = filepath.Dir(dir)
+		path := filepath.Join(dir, "bin", name+".sh")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// kafkaPEMKeystore renders a PEM keystore file: the key as PKCS#8, which
+// Kafka requires, followed by the full chain. With a password the key is
+// encrypted, which takes openssl.
+func kafkaPEMKeystore(ctx context.Context, bundle *Bundle, password string) ([]byte, error) {
+	pair, err := tls.X509KeyPair(bundle.FullChain(), bundle.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pair.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if password != "" {
+		work, err := os.MkdirTemp("", "certfix-keystore-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create work directory: %w", err)
+		}
+		defer os.RemoveAll(work)
+		plain := filepath.Join(work, "key.pem")
+		encrypted := filepath.Join(work, "key.enc.pem")
+		if err := os.WriteFile(plain, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write key: %w", err)
+		}
+		env := append(os.Environ(), "CERTFIX_KEY_PASS="+password)
+		if err := runEnv(ctx, env, "openssl", "pkcs8", "-topk8", "-v2", "aes-256-cbc",
+			"-in", plain, "-passout", "env:CERTFIX_KEY_PASS", "-out", encrypted); err != nil {
+			return nil, err
+		}
+		if key, err = os.ReadFile(encrypted); err != nil {
+			return nil, fmt.Errorf("failed to read encrypted key: %w", err)
+		}
+	}
+	return append(key, bundle.FullChain()...), nil
+}
+
+// readProperties reads a Java properties file: key=value, key:value or
+// key value, with backslash continuations
+func readProperties(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	props := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	var pending string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if pending == "" && (line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!")) {
+			continue
+		}
+		if strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`) {
+			pending += strings.TrimSuffix(line, `\`)
+			continue
+		}
+		line, pending = pending+line, ""
+
+		end := strings.IndexAny(line, "=: \t")
+		if end < 0 {
+			props[line] = ""
+			continue
+		}
+		value := strings.TrimLeft(line[end:], " \t")
+		if value != "" && (value[0] == '=' || value[0] == ':') {
+			value = strings.TrimLeft(value[1:], " \t")
+		}
+		props[line[:end]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return props, nil
+}
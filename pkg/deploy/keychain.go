@@ -0,0 +1,230 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_KEYCHAIN = "keychain"
+
+	SYSTEM_KEYCHAIN = "/Library/Keychains/System.keychain"
+)
+
+func init() {
+	builtinTargets[TARGET_KEYCHAIN] = newKeychainTarget
+}
+
+// KeychainOptions configure the macOS keychain target
+type KeychainOptions struct {
+	// Keychain defaults to the System keychain
+	Keychain string `json:"keychain,omitempty"`
+	// Applications may use the private key without a prompt (security
+	// import -T); anything else needs user approval
+	Applications []string `json:"applications,omitempty"`
+	// TrustRoot marks a self-signed root at the end of the chain as
+	// trusted, for certificates from a private CA
+	TrustRoot bool `json:"trust_root,omitempty"`
+	// KeepPrevious leaves older identities with the same common name in
+	// the keychain; by default they are deleted once the new one is in
+	KeepPrevious bool `json:"keep_previous,omitempty"`
+	// Services are launchd labels reloaded after the import
+	Services []string `json:"services,omitempty"`
+}
+
+// keychainTarget imports the key and chain with security(1) so the leaf
+// and key pair up as an identity that TLS servers can select
+type keychainTarget struct {
+	env  *Env
+	opts KeychainOptions
+}
+
+func newKeychainTarget(env *Env, options json.RawMessage) (Target, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, tasks.Rejectf("the keychain target is only available on macOS")
+	}
+	var opts KeychainOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Keychain == "" {
+		opts.Keychain = SYSTEM_KEYCHAIN
+	}
+	if !filepath.IsAbs(opts.Keychain) {
+		return nil, tasks.Rejectf("keychain must be an absolute path")
+	}
+	for _, app := range opts.Applications {
+		if !filepath.IsAbs(app) {
+			return nil, tasks.Rejectf("application %q must be an absolute path", app)
+		}
+	}
+	if !commandExists("security") {
+		return nil, tasks.Rejectf("security not found")
+	}
+	return &keychainTarget{env: env, opts: opts}, nil
+}
+
+func (t *keychainTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	// security import only reads files; keep them private and short-lived
+	dir, err := os.MkdirTemp("", "certfix-keychain-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	chainFile := filepath.Join(dir, "chain.pem")
+	if err := os.WriteFile(keyFile, bundle.PrivateKey, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(chainFile, bundle.FullChain(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write chain: %w", err)
+	}
+
+	fingerprint := sha1Hex(bundle.Leaf().Raw)
+	previous := t.identities(ctx, bundle.Leaf())
+
+	// Importing something already present fails with "already exists",
+	// which is fine for redeploys of the same certificate
+	keyArgs := []string{"import", keyFile, "-k", t.opts.Keychain, "-t", "priv", "-f", "openssl"}
+	for _, app := range t.opts.Applications {
+		keyArgs = append(keyArgs, "-T", app)
+	}
+	if err := importItem(ctx, keyArgs...); err != nil {
+		return nil, fmt.Errorf("failed to import private key: %w", err)
+	}
+	if err := importItem(ctx, "import", chainFile, "-k", t.opts.Keychain, "-t", "cert", "-f", "pemseq"); err != nil {
+		return nil, fmt.Errorf("failed to import certificate chain: %w", err)
+	}
+
+	if !t.hasIdentity(ctx, fingerprint) {
+		// The key and certificate did not pair up; drop what was imported
+		run(ctx, "security", "delete-certificate", "-Z", fingerprint, t.opts.Keychain)
+		return nil, fmt.Errorf("imported certificate %s has no matching private key in %s: %w", fingerprint, t.opts.Keychain, ErrRolledBack)
+	}
+
+	result := &Result{Details: map[string]string{"keychain": t.opts.Keychain, "identity_sha1": fingerprint}}
+
+	if t.opts.TrustRoot {
+		if root := selfSignedRoot(bundle); root != nil {
+			rootFile := filepath.Join(dir, "root.pem")
+			if err := os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0600); err != nil {
+				return result, fmt.Errorf("failed to write root: %w", err)
+			}
+			if err := run(ctx, "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", t.opts.Keychain, rootFile); err != nil {
+				return result, fmt.Errorf("failed to trust root %s: %w", root.Subject.CommonName, err)
+			}
+			result.Details["trusted_root"] = root.Subject.CommonName
+		}
+	}
+
+	if !t.opts.KeepPrevious {
+		var removed []string
+		for _, old := range previous {
+			if old == fingerprint {
+				continue
+			}
+			// delete-identity takes the key too; a bare certificate has none
+			if err := run(ctx, "security", "delete-identity", "-Z", old, t.opts.Keychain); err != nil {
+				if err := run(ctx, "security", "delete-certificate", "-Z", old, t.opts.Keychain); err != nil {
+					log.Printf("[WARNING] Failed to remove previous certificate %s from %s: %v", old, t.opts.Keychain, err)
+					continue
+				}
+			}
+			removed = append(removed, old)
+		}
+		if len(removed) > 0 {
+			result.Details["removed"] = strings.Join(removed, ",")
+		}
+	}
+
+	for _, name := range t.opts.Services {
+		if err := t.env.Reload(ctx, name); err != nil {
+			return result, err
+		}
+		result.Reloaded = append(result.Reloaded, name)
+	}
+	return result, nil
+}
+
+// identities lists the SHA-1 of leaf certificates in the keychain with the
+// same common name as leaf; those are the ones a new import replaces
+func (t *keychainTarget) identities(ctx context.Context, leaf *x509.Certificate) []string {
+	name := leaf.Subject.CommonName
+	if name == "" {
+		return nil
+	}
+	out, err := output(ctx, "security", "find-certificate", "-a", "-c", name, "-p", t.opts.Keychain)
+	if err != nil {
+		return nil
+	}
+
+	var fingerprints []string
+	rest := []byte(out)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return fingerprints
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		// -c matches substrings; only replace exact, non-CA matches
+		if err != nil || cert.IsCA || cert.Subject.CommonName != name {
+			continue
+		}
+		fingerprints = append(fingerprints, sha1Hex(cert.Raw))
+	}
+}
+
+// hasIdentity reports whether the certificate is paired with its key
+func (t *keychainTarget) hasIdentity(ctx context.Context, fingerprint string) bool {
+	out, err := output(ctx, "security", "find-identity", t.opts.Keychain)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[1], fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+func importItem(ctx context.Context, args ...string) error {
+	err := run(ctx, "security", args...)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	return err
+}
+
+// selfSignedRoot returns the last chain certificate if it signs itself
+func selfSignedRoot(bundle *Bundle) *x509.Certificate {
+	ders := bundle.ChainCertificates()
+	if len(ders) == 0 {
+		return nil
+	}
+	root, err := x509.ParseCertificate(ders[len(ders)-1])
+	if err != nil || !root.IsCA || root.CheckSignatureFrom(root) != nil {
+		return nil
+	}
+	return root
+}
+
+func sha1Hex(der []byte) string {
+	sum := sha1.Sum(der)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
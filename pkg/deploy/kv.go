@@ -0,0 +1,503 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_CONSUL = "consul"
+	TARGET_ETCD   = "etcd"
+
+	DEFAULT_CONSUL_ADDRESS = "http://127.0.0.1:8500"
+	DEFAULT_ETCD_ADDRESS   = "http://127.0.0.1:2379"
+	// Keys default to certfix/<name>
+	DEFAULT_KV_PREFIX = "certfix/"
+
+	// One key with the bundle as JSON, or one key per part under it
+	KV_FORMAT_JSON  = "json"
+	KV_FORMAT_SPLIT = "split"
+	// TTL that makes the keys expire with the certificate
+	KV_TTL_EXPIRY = "expiry"
+
+	KV_TIMEOUT = 30 * time.Second
+	// A write that loses a compare-and-swap race is read and tried again,
+	// this many times in all
+	KV_CAS_ATTEMPTS = 3
+)
+
+func init() {
+	builtinTargets[TARGET_CONSUL] = newConsulTarget
+	builtinTargets[TARGET_ETCD] = newEtcdTarget
+}
+
+// KVOptions configure the Consul and etcd targets
+type KVOptions struct {
+	// Address of the HTTP API; plain http only to this host, since the
+	// private key goes over it
+	Address string `json:"address,omitempty"`
+	// Key, certfix/<name> by default; with the split format its parts go
+	// under <key>/certificate, chain, fullchain and private_key
+	Key    string `json:"key,omitempty"`
+	Format string `json:"format,omitempty"`
+	// TTL makes the keys expire unless renewed: a duration such as "2160h",
+	// or "expiry" for the certificate's own expiry. etcd only, as a lease;
+	// Consul keys can't expire.
+	TTL string `json:"ttl,omitempty"`
+
+	// Consul ACL token and datacenter; the token may be a secret reference
+	Token      string `json:"token,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+	// etcd user; the password may be a secret reference
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// RootCAFile verifies the server; CertFile and KeyFile authenticate the
+	// agent to clusters that require client certificates
+	RootCAFile string `json:"root_ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+}
+
+// kvVersion is what a key holds now; Revision is 0 when it doesn't exist
+type kvVersion struct {
+	Value    []byte
+	Revision int64
+	// etcd lease the key is attached to
+	Lease int64
+}
+
+// kvEntry is a key and the value a deployment puts there
+type kvEntry struct {
+	Key   string
+	Value []byte
+}
+
+// kvStore is one KV backend's API
+type kvStore interface {
+	// read returns the current version of each key
+	read(ctx context.Context, keys []string) (map[string]kvVersion, error)
+	// swap writes every entry in one transaction, only if none of the keys
+	// changed since read; false when one did
+	swap(ctx context.Context, entries []kvEntry, current map[string]kvVersion, ttl time.Duration) (bool, error)
+}
+
+// kvTarget publishes bundles into a KV store with compare-and-swap, so a
+// concurrent writer is never silently overwritten and every key of a
+// split bundle changes at once
+type kvTarget struct {
+	opts  KVOptions
+	store kvStore
+}
+
+func newConsulTarget(env *Env, options json.RawMessage) (Target, error) {
+	opts, client, err := kvSetup(options, DEFAULT_CONSUL_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TTL != "" {
+		return nil, tasks.Rejectf("consul keys can't expire; ttl is only supported by the %s target", TARGET_ETCD)
+	}
+	if opts.Username != "" || opts.Password != "" {
+		return nil, tasks.Rejectf("consul authenticates with token, not username and password")
+	}
+	return &kvTarget{opts: opts, store: &consulStore{env: env, opts: opts, client: client}}, nil
+}
+
+func newEtcdTarget(env *Env, options json.RawMessage) (Target, error) {
+	opts, client, err := kvSetup(options, DEFAULT_ETCD_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token != "" || opts.Datacenter != "" {
+		return nil, tasks.Rejectf("etcd authenticates with username and password; token and datacenter are for consul")
+	}
+	if opts.TTL != "" && opts.TTL != KV_TTL_EXPIRY {
+		if d, err := time.ParseDuration(opts.TTL); err != nil || d < time.Minute {
+			return nil, tasks.Rejectf("invalid ttl %q: want a duration of at least 1m, or %q", opts.TTL, KV_TTL_EXPIRY)
+		}
+	}
+	return &kvTarget{opts: opts, store: &etcdStore{env: env, opts: opts, client: client}}, nil
+}
+
+// kvSetup decodes the options shared by both targets and builds the
+// client for the API
+func kvSetup(options json.RawMessage, defaultAddress string) (KVOptions, *http.Client, error) {
+	var opts KVOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return opts, nil, err
+	}
+	if opts.Address == "" {
+		opts.Address = defaultAddress
+	}
+	opts.Address = strings.TrimRight(opts.Address, "/")
+	parsed, err := url.Parse(opts.Address)
+	if err != nil || parsed.Host == "" || parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return opts, nil, tasks.Rejectf("invalid address %q", opts.Address)
+	}
+	if parsed.Scheme == "http" {
+		if ip := net.ParseIP(parsed.Hostname()); parsed.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return opts, nil, tasks.Rejectf("address %q must use https: the private key is sent to it", opts.Address)
+		}
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = KV_FORMAT_JSON
+	case KV_FORMAT_JSON, KV_FORMAT_SPLIT:
+	default:
+		return opts, nil, tasks.Rejectf("invalid format %q: want %s or %s", opts.Format, KV_FORMAT_JSON, KV_FORMAT_SPLIT)
+	}
+	if opts.Key != "" && (strings.HasPrefix(opts.Key, "/") || strings.HasSuffix(opts.Key, "/")) {
+		return opts, nil, tasks.Rejectf("key %q must not start or end with /", opts.Key)
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return opts, nil, tasks.Rejectf("cert_file and key_file go together")
+	}
+
+	client := httpclient.New(KV_TIMEOUT)
+	if opts.RootCAFile != "" || opts.CertFile != "" {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.RootCAFile != "" {
+			data, err := os.ReadFile(opts.RootCAFile)
+			if err != nil {
+				return opts, nil, fmt.Errorf("failed to read root_ca_file: %w", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(data) {
+				return opts, nil, tasks.Rejectf("no certificates found in %s", opts.RootCAFile)
+			}
+		}
+		if opts.CertFile != "" {
+			pair, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			if err != nil {
+				return opts, nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		transport := httpclient.Transport().Clone()
+		transport.TLSClientConfig = config
+		client = &http.Client{Transport: transport, Timeout: KV_TIMEOUT}
+	}
+	return opts, client, nil
+}
+
+func (t *kvTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	key := t.opts.Key
+	if key == "" {
+		key = DEFAULT_KV_PREFIX + bundle.Name
+	}
+	var entries []kvEntry
+	if t.opts.Format == KV_FORMAT_SPLIT {
+		for _, part := range []kvEntry{
+			{"certificate", bundle.Certificate},
+			{"chain", bundle.Chain},
+			{"fullchain", bundle.FullChain()},
+			{"private_key", bundle.PrivateKey},
+		} {
+			entries = append(entries, kvEntry{key + "/" + part.Key, part.Value})
+		}
+	} else {
+		value, err := marshalBundle(bundle)
+		if err != nil {
+			return nil, err
+		}
+		entries = []kvEntry{{key, value}}
+	}
+
+	var ttl time.Duration
+	switch t.opts.TTL {
+	case "":
+	case KV_TTL_EXPIRY:
+		if ttl = time.Until(bundle.Leaf().NotAfter); ttl <= 0 {
+			return nil, tasks.Rejectf("certificate has expired; it would expire from the store at once")
+		}
+	default:
+		ttl, _ = time.ParseDuration(t.opts.TTL)
+	}
+
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	result := &Result{Details: map[string]string{"keys": strings.Join(keys, ",")}}
+	for attempt := 1; attempt <= KV_CAS_ATTEMPTS; attempt++ {
+		current, err := t.store.read(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		// Leases are granted anew, so a TTL always rewrites
+		if ttl == 0 && kvUnchanged(entries, current) {
+			result.Details["action"] = "unchanged"
+			return result, nil
+		}
+		swapped, err := t.store.swap(ctx, entries, current, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			result.Details["action"] = "written"
+			if ttl > 0 {
+				result.Details["ttl"] = ttl.Round(time.Second).String()
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("%s changed while being written, %d times in a row; another writer is updating it", keys[0], KV_CAS_ATTEMPTS)
+}
+
+func kvUnchanged(entries []kvEntry, current map[string]kvVersion) bool {
+	for _, e := range entries {
+		if v := current[e.Key]; v.Revision == 0 || !bytes.Equal(v.Value, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// kvRequest sends a JSON request and decodes a JSON answer; the status is
+// returned for the caller to judge
+func kvRequest(ctx context.Context, client *http.Client, method, u string, headers map[string]string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s unreachable: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s failed with status %d: %s", method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to parse response to %s: %w", req.URL.Path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// consulStore uses the KV and transaction endpoints; a "cas" operation
+// with index 0 only creates
+type consulStore struct {
+	env    *Env
+	opts   KVOptions
+	client *http.Client
+}
+
+func (c *consulStore) headers(ctx context.Context) (map[string]string, error) {
+	if c.opts.Token == "" {
+		return nil, nil
+	}
+	token, err := c.env.Secrets.Resolve(ctx, c.opts.Token)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"X-Consul-Token": token}, nil
+}
+
+func (c *consulStore) endpoint(path string) string {
+	u := c.opts.Address + path
+	if c.opts.Datacenter != "" {
+		u += "?dc=" + url.QueryEscape(c.opts.Datacenter)
+	}
+	return u
+}
+
+func (c *consulStore) read(ctx context.Context, keys []string) (map[string]kvVersion, error) {
+	headers, err := c.headers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]kvVersion{}
+	for _, key := range keys {
+		var escaped []string
+		for _, segment := range strings.Split(key, "/") {
+			escaped = append(escaped, url.PathEscape(segment))
+		}
+		var pairs []struct {
+			ModifyIndex int64  `json:"ModifyIndex"`
+			Value       []byte `json:"Value"`
+		}
+		status, err := kvRequest(ctx, c.client, "GET", c.endpoint("/v1/kv/"+strings.Join(escaped, "/")), headers, nil, &pairs)
+		if status == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(pairs) > 0 {
+			current[key] = kvVersion{Value: pairs[0].Value, Revision: pairs[0].ModifyIndex}
+		}
+	}
+	return current, nil
+}
+
+func (c *consulStore) swap(ctx context.Context, entries []kvEntry, current map[string]kvVersion, ttl time.Duration) (bool, error) {
+	headers, err := c.headers(ctx)
+	if err != nil {
+		return false, err
+	}
+	var ops []map[string]interface{}
+	for _, e := range entries {
+		ops = append(ops, map[string]interface{}{"KV": map[string]interface{}{
+			"Verb":  "cas",
+			"Key":   e.Key,
+			"Value": e.Value,
+			"Index": current[e.Key].Revision,
+		}})
+	}
+	// A failed check rolls the whole transaction back with 409
+	status, err := kvRequest(ctx, c.client, "PUT", c.endpoint("/v1/txn"), headers, ops, nil)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// etcdStore uses the v3 JSON gateway; a transaction compares every key's
+// revision before putting any
+type etcdStore struct {
+	env    *Env
+	opts   KVOptions
+	client *http.Client
+	token  string
+}
+
+// etcdInt reads int64 fields, which the gateway writes as strings
+type etcdInt int64
+
+func (n *etcdInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*n = etcdInt(v)
+	return err
+}
+
+func (e *etcdStore) call(ctx context.Context, path string, in, out interface{}) error {
+	if e.opts.Username != "" && e.token == "" {
+		password, err := e.env.Secrets.Resolve(ctx, e.opts.Password)
+		if err != nil {
+			return err
+		}
+		var auth struct {
+			Token string `json:"token"`
+		}
+		if _, err := kvRequest(ctx, e.client, "POST", e.opts.Address+"/v3/auth/authenticate", nil,
+			map[string]string{"name": e.opts.Username, "password": password}, &auth); err != nil {
+			return fmt.Errorf("etcd authentication failed: %w", err)
+		}
+		e.token = auth.Token
+	}
+	var headers map[string]string
+	if e.token != "" {
+		headers = map[string]string{"Authorization": e.token}
+	}
+	_, err := kvRequest(ctx, e.client, "POST", e.opts.Address+path, headers, in, out)
+	return err
+}
+
+func (e *etcdStore) read(ctx context.Context, keys []string) (map[string]kvVersion, error) {
+	current := map[string]kvVersion{}
+	for _, key := range keys {
+		var response struct {
+			KVs []struct {
+				Value       []byte  `json:"value"`
+				ModRevision etcdInt `json:"mod_revision"`
+				Lease       etcdInt `json:"lease"`
+			} `json:"kvs"`
+		}
+		if err := e.call(ctx, "/v3/kv/range", map[string]interface{}{"key": []byte(key)}, &response); err != nil {
+			return nil, err
+		}
+		if len(response.KVs) > 0 {
+			kv := response.KVs[0]
+			current[key] = kvVersion{Value: kv.Value, Revision: int64(kv.ModRevision), Lease: int64(kv.Lease)}
+		}
+	}
+	return current, nil
+}
+
+func (e *etcdStore) swap(ctx context.Context, entries []kvEntry, current map[string]kvVersion, ttl time.Duration) (bool, error) {
+	var lease int64
+	if ttl > 0 {
+		var grant struct {
+			ID etcdInt `json:"ID"`
+		}
+		if err := e.call(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": strconv.FormatInt(int64(ttl.Seconds()), 10)}, &grant); err != nil {
+			return false, err
+		}
+		lease = int64(grant.ID)
+	}
+
+	var compare, success []map[string]interface{}
+	for _, entry := range entries {
+		revision := current[entry.Key].Revision
+		if revision == 0 {
+			compare = append(compare, map[string]interface{}{"key": []byte(entry.Key), "target": "CREATE", "result": "EQUAL", "create_revision": "0"})
+		} else {
+			compare = append(compare, map[string]interface{}{"key": []byte(entry.Key), "target": "MOD", "result": "EQUAL", "mod_revision": strconv.FormatInt(revision, 10)})
+		}
+		put := map[string]interface{}{"key": []byte(entry.Key), "value": entry.Value}
+		if lease != 0 {
+			put["lease"] = strconv.FormatInt(lease, 10)
+		}
+		success = append(success, map[string]interface{}{"request_put": put})
+	}
+	var response struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := e.call(ctx, "/v3/kv/txn", map[string]interface{}{"compare": compare, "success": success}, &response); err != nil {
+		e.revoke(ctx, lease)
+		return false, err
+	}
+	if !response.Succeeded {
+		e.revoke(ctx, lease)
+		return false, nil
+	}
+
+	// Leases the keys were moved off of have nothing left to expire
+	for _, v := range current {
+		if v.Lease != 0 && v.Lease != lease {
+			e.revoke(ctx, v.Lease)
+		}
+	}
+	return true, nil
+}
+
+// revoke drops a lease; failures only leave it to expire on its own
+func (e *etcdStore) revoke(ctx context.Context, lease int64) {
+	if lease == 0 {
+		return
+	}
+	e.call(ctx, "/v3/lease/revoke", map[string]interface{}{"ID": strconv.FormatInt(lease, 10)}, nil)
+}
@@ -0,0 +1,308 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_MAIL = "mail"
+
+	MAIL_POSTFIX = "postfix"
+	MAIL_DOVECOT = "dovecot"
+	MAIL_EXIM    = "exim"
+
+	// Drop-ins owned by the agent; they override earlier settings. They are
+	// fixed system paths rather than caller-chosen ones, so they are written
+	// without Env.Confine; MailConfigPaths opens them to the sandbox.
+	DOVECOT_DROPIN      = "/etc/dovecot/conf.d/99-certfix.conf"
+	EXIM_LOCAL_MACROS   = "/etc/exim4/exim4.conf.localmacros"
+	POSTFIX_SUBMISSIONS = "submission/inet,submissions/inet,smtps/inet"
+)
+
+// Exim reads its key when a STARTTLS connection arrives, after dropping
+// to its own user, so the key must be readable by the Exim group
+var eximGroups = []string{"Debian-exim", "exim"}
+
+// MailConfigPaths lists the directories the mail target writes outside the
+// certificate paths, for the servers installed here: main.cf, the Dovecot
+// drop-in, the Exim macros and the configuration update-exim4.conf renders
+func MailConfigPaths() []string {
+	var paths []string
+	for _, dir := range []string{"/etc/postfix", "/etc/dovecot/conf.d", "/etc/exim4", "/var/lib/exim4"} {
+		if dirExists(dir) {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+func init() {
+	builtinTargets[TARGET_MAIL] = newMailTarget
+}
+
+// MailOptions configure the mail server target
+type MailOptions struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Servers to configure; defaults to every one installed
+	Servers []string `json:"servers,omitempty"`
+}
+
+// mailTarget installs the certificate, points Postfix (smtpd and the
+// submission services), Dovecot and Exim at it, validates each config
+// and reloads. Any validation failure rolls back every change.
+type mailTarget struct {
+	env  *Env
+	opts MailOptions
+}
+
+func newMailTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts MailOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, tasks.Rejectf("mail target requires cert_file and key_file")
+	}
+
+	if len(opts.Servers) == 0 {
+		opts.Servers = detectMailServers()
+		if len(opts.Servers) == 0 {
+			return nil, tasks.Rejectf("no Postfix, Dovecot or Exim installation found")
+		}
+	}
+	for _, server := range opts.Servers {
+		if server != MAIL_POSTFIX && server != MAIL_DOVECOT && server != MAIL_EXIM {
+			return nil, tasks.Rejectf("unknown mail server %q", server)
+		}
+	}
+	return &mailTarget{env: env, opts: opts}, nil
+}
+
+func detectMailServers() []string {
+	var servers []string
+	if commandExists("postconf") {
+		servers = append(servers, MAIL_POSTFIX)
+	}
+	if commandExists("doveconf") {
+		servers = append(servers, MAIL_DOVECOT)
+	}
+	if commandExists("exim4") || commandExists("exim") {
+		servers = append(servers, MAIL_EXIM)
+	}
+	return servers
+}
+
+func (t *mailTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	snap := newSnapshot()
+	certPath, err := t.env.Confine(t.opts.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err := t.env.Confine(t.opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	snap.save(certPath)
+	snap.save(keyPath)
+
+	files, err := installPair(t.env, certPath, keyPath, bundle)
+	if err != nil {
+		snap.restore()
+		return nil, err
+	}
+	result := &Result{Files: files, Details: map[string]string{}}
+	if slices.Contains(t.opts.Servers, MAIL_EXIM) {
+		if err := shareKeyWithGroup(keyPath, eximGroups); err != nil {
+			snap.restore()
+			return nil, fmt.Errorf("%s: %w: %w", MAIL_EXIM, err, ErrRolledBack)
+		}
+	}
+
+	for _, server := range t.opts.Servers {
+		var err error
+		switch server {
+		case MAIL_POSTFIX:
+			err = t.configurePostfix(ctx, snap, certPath, keyPath)
+		case MAIL_DOVECOT:
+			err = t.configureDovecot(ctx, snap, certPath, keyPath)
+		case MAIL_EXIM:
+			err = t.configureExim(ctx, snap, certPath, keyPath)
+		}
+		if err != nil {
+			snap.restore()
+			return nil, fmt.Errorf("%s: %w: %w", server, err, ErrRolledBack)
+		}
+		result.Details[server] = "configured"
+	}
+
+	// Only reload once every config validated
+	for _, server := range t.opts.Servers {
+		unit := mailServiceName(server)
+		err := t.env.Reload(ctx, unit)
+		var validation *ValidationError
+		// Before the first reload the old configuration can still come back
+		if errors.As(err, &validation) && len(result.Reloaded) == 0 {
+			snap.restore()
+			return result, fmt.Errorf("%w: %w", err, ErrRolledBack)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to reload %s: %w", unit, err)
+		}
+		result.Reloaded = append(result.Reloaded, unit)
+	}
+	return result, nil
+}
+
+func mailServiceName(server string) string {
+	if server == MAIL_EXIM && commandExists("exim4") {
+		return "exim4"
+	}
+	return server
+}
+
+// Postfix: main.cf smtpd settings, plus master.cf overrides for submission
+// services that set their own certificate
+func (t *mailTarget) configurePostfix(ctx context.Context, snap *snapshot, certPath, keyPath string) error {
+	settings := map[string]string{
+		"smtpd_tls_cert_file": certPath,
+		"smtpd_tls_key_file":  keyPath,
+	}
+	for key, value := range settings {
+		previous, _ := output(ctx, "postconf", "-h", key)
+		if err := run(ctx, "postconf", "-e", key+"="+value); err != nil {
+			return err
+		}
+		snap.onRestore(func() error { return run(ctx, "postconf", "-e", key+"="+previous) })
+	}
+
+	overrides, _ := output(ctx, "postconf", "-P")
+	for _, service := range strings.Split(POSTFIX_SUBMISSIONS, ",") {
+		for key, value := range settings {
+			param := service + "/" + key
+			previous, found := postfixOverride(overrides, param)
+			if !found {
+				continue
+			}
+			if err := run(ctx, "postconf", "-P", param+"="+value); err != nil {
+				return err
+			}
+			snap.onRestore(func() error { return run(ctx, "postconf", "-P", param+"="+previous) })
+		}
+	}
+
+	return run(ctx, "postfix", "check")
+}
+
+// postfixOverride finds "service/type/param = value" in postconf -P output
+func postfixOverride(overrides, param string) (string, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(overrides))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(name) == param {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// Dovecot: a drop-in loaded after the distribution's 10-ssl.conf. Dovecot
+// 2.4 renamed the settings and takes paths instead of "<" file includes.
+func (t *mailTarget) configureDovecot(ctx context.Context, snap *snapshot, certPath, keyPath string) error {
+	version, _ := output(ctx, "dovecot", "--version")
+
+	var conf string
+	if strings.HasPrefix(version, "2.4") || strings.HasPrefix(version, "3.") {
+		conf = fmt.Sprintf("ssl_server_cert_file = %s\nssl_server_key_file = %s\n", certPath, keyPath)
+	} else {
+		conf = fmt.Sprintf("ssl_cert = <%s\nssl_key = <%s\n", certPath, keyPath)
+	}
+
+	snap.save(DOVECOT_DROPIN)
+	if err := filetransfer.WriteFileAtomic(DOVECOT_DROPIN, []byte("# Managed by certfix-agent\n"+conf), filetransfer.PUBLIC_FILE_MODE); err != nil {
+		return err
+	}
+	// doveconf exits non-zero when the configuration doesn't parse
+	return run(ctx, "doveconf", "-n")
+}
+
+// Exim: the Debian split configuration reads TLS settings from macros in
+// exim4.conf.localmacros; other layouts must already reference the paths
+func (t *mailTarget) configureExim(ctx context.Context, snap *snapshot, certPath, keyPath string) error {
+	binary := "exim"
+	if commandExists("exim4") {
+		binary = "exim4"
+	}
+
+	if _, err := os.Stat("/etc/exim4"); err == nil {
+		snap.save(EXIM_LOCAL_MACROS)
+		existing, _ := os.ReadFile(EXIM_LOCAL_MACROS)
+		updated := setMacros(string(existing), map[string]string{
+			"MAIN_TLS_ENABLE":      "yes",
+			"MAIN_TLS_CERTIFICATE": certPath,
+			"MAIN_TLS_PRIVATEKEY":  keyPath,
+		})
+		if err := filetransfer.WriteFileAtomic(EXIM_LOCAL_MACROS, []byte(updated), filetransfer.PUBLIC_FILE_MODE); err != nil {
+			return err
+		}
+		if commandExists("update-exim4.conf") {
+			if err := run(ctx, "update-exim4.conf"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return run(ctx, binary, "-bV")
+}
+
+// shareKeyWithGroup makes the key readable by the first of groups that
+// exists, leaving it owned by root
+func shareKeyWithGroup(keyPath string, groups []string) error {
+	for _, name := range groups {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(keyPath, -1, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", keyPath, err)
+		}
+		return os.Chmod(keyPath, 0640)
+	}
+	return fmt.Errorf("none of the groups %s exists to give Exim read access to %s", strings.Join(groups, ", "), keyPath)
+}
+
+// setMacros replaces "NAME = value" lines, appending macros not present
+func setMacros(content string, macros map[string]string) string {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		name, _, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if value, managed := macros[name]; ok && managed {
+			line = name + " = " + value
+			seen[name] = true
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	for _, name := range []string{"MAIN_TLS_ENABLE", "MAIN_TLS_CERTIFICATE", "MAIN_TLS_PRIVATEKEY"} {
+		if value, ok := macros[name]; ok && !seen[name] {
+			lines = append(lines, name+" = "+value)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,225 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_RABBITMQ = "rabbitmq"
+
+	DEFAULT_RABBITMQ_CONFIG = "/etc/rabbitmq/rabbitmq.conf"
+	DEFAULT_RABBITMQ_USER   = "rabbitmq"
+	RABBITMQ_SERVED_TIMEOUT = 30 * time.Second
+)
+
+func init() {
+	builtinTargets[TARGET_RABBITMQ] = newRabbitMQTarget
+}
+
+// RabbitMQOptions configure the RabbitMQ target
+type RabbitMQOptions struct {
+	// ConfigFile is the new-style (sysctl format) config; the paths come
+	// from its ssl_options and management.ssl settings
+	ConfigFile string `json:"config_file,omitempty"`
+	// CertFile and KeyFile are for nodes configured in advanced.config,
+	// whose paths the target can't read; they must match when
+	// rabbitmq.conf sets them too
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// Node is passed to rabbitmqctl -n; the local node by default
+	Node string `json:"node,omitempty"`
+	// User owns the files; defaults to rabbitmq
+	User string `json:"user,omitempty"`
+}
+
+// rabbitmqTarget rotates the files of the AMQPS listener and, when it has
+// its own, the management listener. Erlang's TLS stack caches PEM files,
+// so the target clears the node's PEM cache: new connections then get the
+// new certificate while established ones carry on, and no restart is
+// needed. In a cluster, each node's agent rotates its own node.
+type rabbitmqTarget struct {
+	env  *Env
+	opts RabbitMQOptions
+}
+
+// rabbitmqListener is a certificate/key pair the config references and the
+// port that serves it
+type rabbitmqListener struct {
+	name     string
+	certFile string
+	keyFile  string
+	port     string
+}
+
+func newRabbitMQTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts RabbitMQOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = DEFAULT_RABBITMQ_CONFIG
+	}
+	if opts.User == "" {
+		opts.User = DEFAULT_RABBITMQ_USER
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, tasks.Rejectf("cert_file and key_file go together")
+	}
+	if !commandExists("rabbitmqctl") {
+		return nil, tasks.Rejectf("rabbitmqctl not found")
+	}
+	return &rabbitmqTarget{env: env, opts: opts}, nil
+}
+
+func (t *rabbitmqTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	listeners, err := t.listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := newSnapshot()
+	result := &Result{Details: map[string]string{}}
+	installed := map[string]bool{}
+	for _, listener := range listeners {
+		// The management listener often shares the AMQPS files
+		if installed[listener.certFile+"\x00"+listener.keyFile] {
+			continue
+		}
+		installed[listener.certFile+"\x00"+listener.keyFile] = true
+		certPath, err := t.env.Confine(listener.certFile)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		keyPath, err := t.env.Confine(listener.keyFile)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		snap.save(certPath)
+		snap.save(keyPath)
+		files, err := installPair(t.env, certPath, keyPath, bundle)
+		if err == nil {
+			err = chownToUser(files, t.opts.User)
+		}
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		result.Files = append(result.Files, files...)
+	}
+
+	// Erlang's TLS stack caches certificate files by name, so a replaced
+	// file isn't read again until the cache is cleared. A node that can't
+	// be reached will read the new files when it starts, so they stay.
+	args := []string{"eval", "ssl:clear_pem_cache()."}
+	if t.opts.Node != "" {
+		args = append([]string{"-n", t.opts.Node}, args...)
+	}
+	if out, err := output(ctx, "rabbitmqctl", args...); err != nil || strings.TrimSpace(out) != "ok" {
+		if err == nil {
+			err = fmt.Errorf("unexpected result %q", out)
+		}
+		return result, fmt.Errorf("failed to clear the PEM cache of the node: %w", err)
+	}
+	result.Reloaded = []string{"rabbitmq"}
+
+	for _, listener := range listeners {
+		if listener.port == "" {
+			continue
+		}
+		address := net.JoinHostPort("127.0.0.1", listener.port)
+		result.Details[listener.name] = address
+		if err := waitServed(ctx, address, "", bundle.Fingerprint(), RABBITMQ_SERVED_TIMEOUT); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// listeners reads the TLS listeners rabbitmq.conf configures. Without the
+// file, or without ssl_options there, cert_file and key_file stand in for
+// the AMQPS listener.
+func (t *rabbitmqTarget) listeners() ([]rabbitmqListener, error) {
+	conf, err := readRabbitMQConfig(t.opts.ConfigFile)
+	if err != nil && !(os.IsNotExist(err) && t.opts.CertFile != "") {
+		return nil, fmt.Errorf("failed to read %s: %w", t.opts.ConfigFile, err)
+	}
+
+	amqps := rabbitmqListener{
+		name:     "amqps",
+		certFile: conf["ssl_options.certfile"],
+		keyFile:  conf["ssl_options.keyfile"],
+		port:     conf["listeners.ssl.default"],
+	}
+	if t.opts.CertFile != "" {
+		if amqps.certFile != "" && (amqps.certFile != t.opts.CertFile || amqps.keyFile != t.opts.KeyFile) {
+			return nil, tasks.Rejectf("%s uses %s and %s; cert_file and key_file must match or be omitted", t.opts.ConfigFile, amqps.certFile, amqps.keyFile)
+		}
+		amqps.certFile, amqps.keyFile = t.opts.CertFile, t.opts.KeyFile
+	}
+	if amqps.certFile == "" || amqps.keyFile == "" {
+		return nil, tasks.Rejectf("%s sets no ssl_options.certfile/keyfile; set cert_file and key_file", t.opts.ConfigFile)
+	}
+	// A bare listeners.ssl.default = 5671 is a port; an address keeps it last
+	if i := strings.LastIndex(amqps.port, ":"); i >= 0 {
+		amqps.port = amqps.port[i+1:]
+	}
+	listeners := []rabbitmqListener{amqps}
+
+	if conf["management.ssl.port"] != "" {
+		management := rabbitmqListener{
+			name:     "management",
+			certFile: conf["management.ssl.certfile"],
+			keyFile:  conf["management.ssl.keyfile"],
+			port:     conf["management.ssl.port"],
+		}
+		if management.certFile == "" || management.keyFile == "" {
+			management.certFile, management.keyFile = amqps.certFile, amqps.keyFile
+		}
+		listeners = append(listeners, management)
+	}
+
+	for i := range listeners {
+		for _, path := range []*string{&listeners[i].certFile, &listeners[i].keyFile} {
+			if !filepath.IsAbs(*path) {
+				return nil, tasks.Rejectf("%s: %s is not an absolute path", t.opts.ConfigFile, *path)
+			}
+		}
+	}
+	return listeners, nil
+}
+
+// readRabbitMQConfig reads the key = value settings of rabbitmq.conf
+func readRabbitMQConfig(path string) (map[string]string, error) {
+	conf := map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return conf, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		conf[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return conf, scanner.Err()
+}
@@ -0,0 +1,266 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_REDIS = "redis"
+
+	DEFAULT_REDIS_USER = "redis"
+	// Redis applies a CONFIG SET before answering, so this only covers the
+	// listener picking up new connections
+	REDIS_SERVED_TIMEOUT = 30 * time.Second
+)
+
+// Searched in order when config_file is not given
+var redisConfigPaths = []string{
+	"/etc/redis/redis.conf",
+	"/etc/redis.conf",
+	"/usr/local/etc/redis/redis.conf",
+}
+
+func init() {
+	builtinTargets[TARGET_REDIS] = newRedisTarget
+}
+
+// RedisOptions configure the Redis target
+type RedisOptions struct {
+	// ConfigFile tells the target how to reach the server; defaults to a
+	// distro path
+	ConfigFile string `json:"config_file,omitempty"`
+	// CertFile and KeyFile default to the server's tls-cert-file and
+	// tls-key-file
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// User owns the files; defaults to redis
+	User string `json:"user,omitempty"`
+	// Username and Password authenticate redis-cli (ACL user or
+	// requirepass); the password may be a secret reference
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// ClientCertFile and ClientKeyFile authenticate redis-cli when the
+	// server is only reachable over TLS with tls-auth-clients on
+	ClientCertFile string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string `json:"client_key_file,omitempty"`
+}
+
+// redisTarget installs tls-cert-file/tls-key-file and has the running
+// server load them with CONFIG SET, which rebuilds its TLS context without
+// dropping connections. The server's TLS port is then dialed to confirm it
+// serves the new certificate.
+type redisTarget struct {
+	env  *Env
+	opts RedisOptions
+}
+
+func newRedisTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts RedisOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.User == "" {
+		opts.User = DEFAULT_REDIS_USER
+	}
+	if opts.ConfigFile == "" {
+		for _, path := range redisConfigPaths {
+			if _, err := os.Stat(path); err == nil {
+				opts.ConfigFile = path
+				break
+			}
+		}
+		if opts.ConfigFile == "" {
+			return nil, tasks.Rejectf("no redis.conf found; set config_file")
+		}
+	}
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, tasks.Rejectf("client_cert_file and client_key_file go together")
+	}
+	if !commandExists("redis-cli") {
+		return nil, tasks.Rejectf("redis-cli not found")
+	}
+	return &redisTarget{env: env, opts: opts}, nil
+}
+
+func (t *redisTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	conf, err := readRedisConfig(t.opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := t.connection(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The running server is authoritative; its paths may differ from the
+	// file's after an earlier CONFIG SET without REWRITE
+	current := map[string]string{}
+	for _, setting := range []string{"tls-cert-file", "tls-key-file"} {
+		out, err := t.command(ctx, cli, "CONFIG", "GET", setting)
+		if err != nil {
+			return nil, err
+		}
+		if lines := strings.Split(out, "\n"); len(lines) == 2 {
+			current[setting] = strings.TrimSpace(lines[1])
+		}
+	}
+	certPath, keyPath := t.opts.CertFile, t.opts.KeyFile
+	if certPath == "" {
+		certPath = current["tls-cert-file"]
+	}
+	if keyPath == "" {
+		keyPath = current["tls-key-file"]
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, tasks.Rejectf("server has no tls-cert-file/tls-key-file configured; set cert_file and key_file")
+	}
+	if certPath, err = t.env.Confine(certPath); err != nil {
+		return nil, err
+	}
+	if keyPath, err = t.env.Confine(keyPath); err != nil {
+		return nil, err
+	}
+
+	snap := newSnapshot()
+	snap.save(certPath)
+	snap.save(keyPath)
+	files, err := installPair(t.env, certPath, keyPath, bundle)
+	if err != nil {
+		snap.restore()
+		return nil, err
+	}
+	if err := chownToUser(files, t.opts.User); err != nil {
+		snap.restore()
+		return nil, err
+	}
+	result := &Result{Files: files, Details: map[string]string{}}
+
+	// Setting either path reloads both files. Moving both takes Redis 7's
+	// multi-parameter CONFIG SET, which applies them together.
+	moved := certPath != current["tls-cert-file"] || keyPath != current["tls-key-file"]
+	set := []string{"CONFIG", "SET", "tls-cert-file", certPath}
+	if moved {
+		set = append(set, "tls-key-file", keyPath)
+	}
+	if _, err := t.command(ctx, cli, set...); err != nil {
+		// Redis keeps its old TLS context, so keep the files it matches
+		snap.restore()
+		return nil, fmt.Errorf("%w: %w", err, ErrRolledBack)
+	}
+	result.Reloaded = []string{"redis"}
+	if moved {
+		if _, err := t.command(ctx, cli, "CONFIG", "REWRITE"); err != nil {
+			return result, fmt.Errorf("new paths are active but were not saved to %s: %w", t.opts.ConfigFile, err)
+		}
+		result.Details["persisted"] = "tls-cert-file,tls-key-file"
+	}
+
+	if port := conf["tls-port"]; port != "" && port != "0" {
+		address := net.JoinHostPort("127.0.0.1", port)
+		result.Details["listener"] = address
+		if err := waitServed(ctx, address, "", bundle.Fingerprint(), REDIS_SERVED_TIMEOUT); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// connection picks how redis-cli reaches the server: the unix socket, the
+// plain port, or the TLS port, in that order of preference
+func (t *redisTarget) connection(conf map[string]string) ([]string, error) {
+	var args []string
+	switch {
+	case conf["unixsocket"] != "":
+		args = []string{"-s", conf["unixsocket"]}
+	case conf["port"] != "0":
+		port := conf["port"]
+		if port == "" {
+			port = "6379"
+		}
+		args = []string{"-h", "127.0.0.1", "-p", port}
+	case conf["tls-port"] != "" && conf["tls-port"] != "0":
+		// The connection stays on loopback and the served certificate is
+		// checked separately, against the fingerprint
+		args = []string{"-h", "127.0.0.1", "-p", conf["tls-port"], "--tls", "--insecure"}
+		if t.opts.ClientCertFile != "" {
+			args = append(args, "--cert", t.opts.ClientCertFile, "--key", t.opts.ClientKeyFile)
+		} else if conf["tls-auth-clients"] != "no" && conf["tls-auth-clients"] != "optional" {
+			return nil, tasks.Rejectf("redis only listens on TLS and requires client certificates; set client_cert_file and client_key_file")
+		}
+	default:
+		return nil, tasks.Rejectf("%s configures no port or unixsocket to reach redis on", t.opts.ConfigFile)
+	}
+	if t.opts.Username != "" {
+		args = append(args, "--user", t.opts.Username)
+	}
+	return args, nil
+}
+
+// command runs one redis-cli command; the password reaches it through
+// REDISCLI_AUTH rather than the command line. Error replies don't always
+// set the exit status, so they are recognised by their prefix.
+func (t *redisTarget) command(ctx context.Context, cli []string, command ...string) (string, error) {
+	env := os.Environ()
+	if t.opts.Password != "" {
+		password, err := t.env.Secrets.Resolve(ctx, t.opts.Password)
+		if err != nil {
+			return "", err
+		}
+		env = append(env, "REDISCLI_AUTH="+password)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "redis-cli", append(append([]string{"--no-auth-warning"}, cli...), command...)...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	reply := strings.TrimSpace(string(out))
+	for _, prefix := range []string{"ERR", "WRONGPASS", "NOAUTH", "NOPERM", "Could not connect"} {
+		if strings.HasPrefix(reply, prefix) {
+			err = fmt.Errorf("%s", reply)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("redis-cli %s failed: %v: %s", strings.Join(command[:2], " "), err, reply)
+	}
+	return reply, nil
+}
+
+// readRedisConfig reads the directives of redis.conf; the last occurrence
+// wins, as in Redis. Included files aren't followed.
+func readRedisConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	conf := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		conf[strings.ToLower(name)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return conf, nil
+}
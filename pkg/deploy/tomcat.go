@@ -0,0 +1,361 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_TOMCAT = "tomcat"
+
+	DEFAULT_KEYSTORE_PASSWORD = "changeit"
+	DEFAULT_KEY_ALIAS         = "tomcat"
+	JMX_TIMEOUT               = 30 * time.Second
+)
+
+// Searched in order when server_xml is not given
+var tomcatServerXMLPaths = []string{
+	"/etc/tomcat10/server.xml",
+	"/etc/tomcat9/server.xml",
+	"/etc/tomcat/server.xml",
+	"/opt/tomcat/conf/server.xml",
+	"/usr/share/tomcat/conf/server.xml",
+}
+
+func init() {
+	builtinTargets[TARGET_TOMCAT] = newTomcatTarget
+}
+
+// TomcatOptions configure the Tomcat target
+type TomcatOptions struct {
+	// ServerXML defaults to $CATALINA_BASE/conf/server.xml or a distro path
+	ServerXML string `json:"server_xml,omitempty"`
+	// Port selects the connector; defaults to the first TLS connector
+	Port int `json:"port,omitempty"`
+	// Service is restarted when JMX isn't configured; derived from the
+	// server.xml location by default
+	Service string `json:"service,omitempty"`
+	// KeystorePassword replaces the one in server.xml, which Tomcat may
+	// read from a ${property}; like JMXPassword it can be a secret
+	// reference such as "vault:secret/data/tomcat#keystore"
+	KeystorePassword string `json:"keystore_password,omitempty"`
+	// JMXProxy is the manager app's JMX proxy servlet, e.g.
+	// http://localhost:8080/manager/jmxproxy; when set the connector's TLS
+	// config is reloaded in place instead of restarting Tomcat
+	JMXProxy    string `json:"jmx_proxy,omitempty"`
+	JMXUser     string `json:"jmx_user,omitempty"`
+	JMXPassword string `json:"jmx_password,omitempty"`
+}
+
+// tomcatTarget rotates whatever the connector in server.xml references:
+// PEM files (certificateFile/certificateKeyFile, Tomcat 8.5+) or a PKCS12
+// or JKS keystore. server.xml itself is never modified.
+type tomcatTarget struct {
+	env  *Env
+	opts TomcatOptions
+	base string
+}
+
+// Only the parts of server.xml that locate certificates
+type tomcatServer struct {
+	Services []struct {
+		Connectors []tomcatConnector `xml:"Connector"`
+	} `xml:"Service"`
+}
+
+type tomcatConnector struct {
+	Port       string `xml:"port,attr"`
+	SSLEnabled string `xml:"SSLEnabled,attr"`
+	// Pre-8.5 attributes directly on the connector
+	KeystoreFile string `xml:"keystoreFile,attr"`
+	KeystorePass string `xml:"keystorePass,attr"`
+	KeystoreType string `xml:"keystoreType,attr"`
+	KeyAlias     string `xml:"keyAlias,attr"`
+	HostConfigs  []struct {
+		HostName     string              `xml:"hostName,attr"`
+		Certificates []tomcatCertificate `xml:"Certificate"`
+	} `xml:"SSLHostConfig"`
+}
+
+type tomcatCertificate struct {
+	CertificateFile    string `xml:"certificateFile,attr"`
+	CertificateKeyFile string `xml:"certificateKeyFile,attr"`
+	KeystoreFile       string `xml:"certificateKeystoreFile,attr"`
+	KeystorePassword   string `xml:"certificateKeystorePassword,attr"`
+	KeystoreType       string `xml:"certificateKeystoreType,attr"`
+	KeyAlias           string `xml:"certificateKeyAlias,attr"`
+	Type               string `xml:"type,attr"`
+}
+
+func newTomcatTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts TomcatOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	if opts.ServerXML == "" {
+		opts.ServerXML = findServerXML()
+		if opts.ServerXML == "" {
+			return nil, tasks.Rejectf("no Tomcat server.xml found; set server_xml")
+		}
+	}
+	if opts.JMXProxy != "" {
+		if err := checkLocalURL("tomcat jmx_proxy", opts.JMXProxy); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Service == "" {
+		opts.Service = tomcatServiceName(opts.ServerXML)
+	}
+
+	return &tomcatTarget{env: env, opts: opts, base: catalinaBase(opts.ServerXML)}, nil
+}
+
+func findServerXML() string {
+	if base := os.Getenv("CATALINA_BASE"); base != "" {
+		path := filepath.Join(base, "conf", "server.xml")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	for _, path := range tomcatServerXMLPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// /etc/tomcat9/server.xml belongs to the tomcat9 unit on Debian
+func tomcatServiceName(serverXML string) string {
+	dir := filepath.Base(filepath.Dir(serverXML))
+	if strings.HasPrefix(dir, "tomcat") {
+		return dir
+	}
+	return "tomcat"
+}
+
+// catalinaBase resolves relative paths the way Tomcat does. Distro layouts
+// symlink /etc/tomcatN into the real base, so prefer /var/lib/tomcatN.
+func catalinaBase(serverXML string) string {
+	dir := filepath.Dir(serverXML)
+	if filepath.Base(dir) == "conf" {
+		return filepath.Dir(dir)
+	}
+	if lib := filepath.Join("/var/lib", filepath.Base(dir)); dirExists(lib) {
+		return lib
+	}
+	return dir
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func (t *tomcatTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	connector, err := t.connector()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Details: map[string]string{
+		"server_xml": t.opts.ServerXML,
+		"port":       connector.Port,
+	}}
+
+	cert := connector.certificate()
+	switch {
+	case cert.CertificateFile != "" && cert.CertificateKeyFile != "":
+		result.Files, err = installPair(t.env, t.resolve(cert.CertificateFile), t.resolve(cert.CertificateKeyFile), bundle)
+		result.Details["format"] = "pem"
+	case cert.KeystoreFile != "":
+		var path string
+		path, err = t.writeKeystore(ctx, cert, bundle)
+		if path != "" {
+			result.Files = []string{path}
+		}
+		result.Details["format"] = keystoreType(cert)
+	default:
+		return nil, tasks.Rejectf("connector on port %s references no certificate files", connector.Port)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if t.opts.JMXProxy != "" {
+		if err := t.reloadConnector(ctx, connector.Port); err != nil {
+			return result, err
+		}
+		result.Details["reload"] = "jmx"
+		return result, nil
+	}
+
+	if err := t.env.Restart(ctx, t.opts.Service); err != nil {
+		return result, fmt.Errorf("failed to restart %s: %w", t.opts.Service, err)
+	}
+	result.Reloaded = []string{t.opts.Service}
+	result.Details["reload"] = "restart"
+	return result, nil
+}
+
+// connector finds the TLS connector to update in server.xml
+func (t *tomcatTarget) connector() (*tomcatConnector, error) {
+	data, err := os.ReadFile(t.opts.ServerXML)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", t.opts.ServerXML, err)
+	}
+	var server tomcatServer
+	if err := xml.Unmarshal(data, &server); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", t.opts.ServerXML, err)
+	}
+
+	for _, svc := range server.Services {
+		for i := range svc.Connectors {
+			connector := &svc.Connectors[i]
+			if !connector.isTLS() {
+				continue
+			}
+			if t.opts.Port == 0 || connector.Port == strconv.Itoa(t.opts.Port) {
+				return connector, nil
+			}
+		}
+	}
+	if t.opts.Port != 0 {
+		return nil, tasks.Rejectf("no TLS connector on port %d in %s", t.opts.Port, t.opts.ServerXML)
+	}
+	return nil, tasks.Rejectf("no TLS connector in %s", t.opts.ServerXML)
+}
+
+func (c *tomcatConnector) isTLS() bool {
+	return strings.EqualFold(c.SSLEnabled, "true") || len(c.HostConfigs) > 0 || c.KeystoreFile != ""
+}
+
+// certificate returns the default host's RSA (or only) certificate,
+// falling back to the legacy connector attributes
+func (c *tomcatConnector) certificate() tomcatCertificate {
+	for _, host := range c.HostConfigs {
+		if host.HostName != "" && host.HostName != "_default_" {
+			continue
+		}
+		for _, cert := range host.Certificates {
+			if cert.Type == "" || strings.EqualFold(cert.Type, "RSA") || len(host.Certificates) == 1 {
+				return cert
+			}
+		}
+	}
+	return tomcatCertificate{
+		KeystoreFile:     c.KeystoreFile,
+		KeystorePassword: c.KeystorePass,
+		KeystoreType:     c.KeystoreType,
+		KeyAlias:         c.KeyAlias,
+	}
+}
+
+// resolve expands ${catalina.base} and makes relative paths absolute
+func (t *tomcatTarget) resolve(path string) string {
+	path = strings.ReplaceAll(path, "${catalina.base}", t.base)
+	path = strings.ReplaceAll(path, "${catalina.home}", t.base)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(t.base, path)
+	}
+	return path
+}
+
+func keystoreType(cert tomcatCertificate) string {
+	if cert.KeystoreType == "" {
+		if strings.HasSuffix(strings.ToLower(cert.KeystoreFile), ".jks") {
+			return "JKS"
+		}
+		return "PKCS12"
+	}
+	return strings.ToUpper(cert.KeystoreType)
+}
+
+// writeKeystore builds a new keystore with the password and alias the
+// connector expects, then swaps it in atomically
+func (t *tomcatTarget) writeKeystore(ctx context.Context, cert tomcatCertificate, bundle *Bundle) (string, error) {
+	path, err := t.env.Confine(t.resolve(cert.KeystoreFile))
+	if err != nil {
+		return "", err
+	}
+	storeType := keystoreType(cert)
+	if storeType != "PKCS12" && storeType != "JKS" {
+		return "", tasks.Rejectf("unsupported keystore type %q", cert.KeystoreType)
+	}
+
+	password, err := t.keystorePassword(ctx, cert)
+	if err != nil {
+		return "", err
+	}
+	alias := cert.KeyAlias
+	if alias == "" {
+		alias = DEFAULT_KEY_ALIAS
+	}
+
+	data, err := buildKeystore(ctx, bundle, storeType, alias, password)
+	if err != nil {
+		return "", err
+	}
+	return installFile(t.env, path, data, true)
+}
+
+// keystorePassword resolves the configured password, or takes the one in
+// server.xml unless it is a property only Tomcat can expand
+func (t *tomcatTarget) keystorePassword(ctx context.Context, cert tomcatCertificate) (string, error) {
+	if t.opts.KeystorePassword != "" {
+		return t.env.Secrets.Resolve(ctx, t.opts.KeystorePassword)
+	}
+	if strings.Contains(cert.KeystorePassword, "${") {
+		return "", tasks.Rejectf("keystore password in %s is a property placeholder; set keystore_password", t.opts.ServerXML)
+	}
+	if cert.KeystorePassword == "" {
+		return DEFAULT_KEYSTORE_PASSWORD, nil
+	}
+	return cert.KeystorePassword, nil
+}
+
+// reloadConnector calls reloadSslHostConfigs on the connector's protocol
+// handler through the manager's JMX proxy servlet
+func (t *tomcatTarget) reloadConnector(ctx context.Context, port string) error {
+	query := url.Values{}
+	query.Set("invoke", "Catalina:type=ProtocolHandler,port="+port)
+	query.Set("op", "reloadSslHostConfigs")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(t.opts.JMXProxy, "/")+"/?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create JMX request: %w", err)
+	}
+	if t.opts.JMXUser != "" {
+		password, err := t.env.Secrets.Resolve(ctx, t.opts.JMXPassword)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(t.opts.JMXUser, password)
+	}
+
+	resp, err := localClient(JMX_TIMEOUT).Do(req)
+	if err != nil {
+		return fmt.Errorf("tomcat JMX proxy unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	// The servlet answers 200 with "Error - ..." when the invocation fails
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "OK") {
+		return fmt.Errorf("JMX reloadSslHostConfigs failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
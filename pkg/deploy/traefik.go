@@ -0,0 +1,73 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const TARGET_TRAEFIK = "traefik"
+
+func init() {
+	builtinTargets[TARGET_TRAEFIK] = newTraefikTarget
+}
+
+// TraefikOptions configure the Traefik file provider target
+type TraefikOptions struct {
+	// CertDir receives <name>.crt and <name>.key
+	CertDir string `json:"cert_dir"`
+	// ConfigDir is the directory watched by the file provider; defaults to CertDir
+	ConfigDir string `json:"config_dir,omitempty"`
+}
+
+// traefikTarget publishes certificates through Traefik's file provider.
+// Traefik watches the dynamic configuration directory and picks up the
+// new certificate by itself; no reload is needed.
+type traefikTarget struct {
+	env  *Env
+	opts TraefikOptions
+}
+
+func newTraefikTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts TraefikOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.CertDir == "" {
+		return nil, tasks.Rejectf("traefik target requires cert_dir")
+	}
+	if opts.ConfigDir == "" {
+		opts.ConfigDir = opts.CertDir
+	}
+	return &traefikTarget{env: env, opts: opts}, nil
+}
+
+func (t *traefikTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	certPath := filepath.Join(t.opts.CertDir, bundle.Name+".crt")
+	keyPath := filepath.Join(t.opts.CertDir, bundle.Name+".key")
+
+	files, err := installPair(t.env, certPath, keyPath, bundle)
+	if err != nil {
+		return &Result{Files: files}, err
+	}
+
+	// Written last: Traefik must never see a config referencing missing files
+	configPath := filepath.Join(t.opts.ConfigDir, "certfix-"+bundle.Name+".yml")
+	config, err := installFile(t.env, configPath, traefikConfig(files[0], files[1]), false)
+	if err != nil {
+		return &Result{Files: files}, err
+	}
+
+	return &Result{Files: append(files, config)}, nil
+}
+
+// Dynamic configuration in YAML; paths are quoted as JSON strings, which
+// are valid YAML scalars
+func traefikConfig(certFile, keyFile string) []byte {
+	return []byte(fmt.Sprintf("# Managed by certfix-agent; changes will be overwritten\ntls:\n  certificates:\n    - certFile: %s\n      keyFile: %s\n",
+		strconv.Quote(certFile), strconv.Quote(keyFile)))
+}
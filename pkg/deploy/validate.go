@@ -0,0 +1,158 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// Validator output kept in failure reports
+	MAX_VALIDATION_OUTPUT = 4096
+
+	// How often waitServed dials a listener that isn't serving yet
+	SERVED_POLL_INTERVAL = 2 * time.Second
+	SERVED_DIAL_TIMEOUT  = 5 * time.Second
+)
+
+// DefaultValidators check a server's configuration without applying it.
+// One runs before every reload or restart of its service, so a certificate
+// the server can't load never takes it down.
+var DefaultValidators = map[string][]string{
+	"nginx":   {"nginx", "-t"},
+	"apache2": {"apache2ctl", "configtest"},
+	"httpd":   {"apachectl", "configtest"},
+	"haproxy": {"haproxy", "-c", "-f", "/etc/haproxy/haproxy.cfg"},
+	"postfix": {"postfix", "check"},
+	"dovecot": {"doveconf", "-n"},
+	"exim4":   {"exim4", "-bV"},
+	"exim":    {"exim", "-bV"},
+}
+
+// ValidationError is a reload refused because the configuration check
+// failed; Output is what the check printed
+type ValidationError struct {
+	Service string
+	Command []string
+	Output  string
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("refusing to reload %s: %s failed: %v: %s", e.Service, strings.Join(e.Command, " "), e.Err, e.Output)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate runs the configuration check of service, if it has one.
+// Configured validators replace the defaults, and an empty one turns the
+// check off; a default whose tool isn't installed is skipped.
+func (e *Env) Validate(ctx context.Context, service string) error {
+	command, configured := e.Validators[service]
+	if !configured {
+		command = DefaultValidators[service]
+	}
+	if len(command) == 0 {
+		return nil
+	}
+	if !configured && !commandExists(command[0]) {
+		log.Printf("[WARNING] Not checking the configuration of %s before reloading: %s not found", service, command[0])
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(string(out))
+	if len(output) > MAX_VALIDATION_OUTPUT {
+		output = output[:MAX_VALIDATION_OUTPUT] + "..."
+	}
+	return &ValidationError{Service: service, Command: command, Output: output, Err: err}
+}
+
+// attachValidation copies a failed check's output into the result, so it
+// reaches the server with the task result and not just the error line
+func attachValidation(result *Result, err error) *Result {
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		return result
+	}
+	if result == nil {
+		result = &Result{}
+	}
+	if result.Details == nil {
+		result.Details = map[string]string{}
+	}
+	result.Details["validation_command"] = strings.Join(validation.Command, " ")
+	result.Details["validation_output"] = validation.Output
+	return result
+}
+
+// waitServed dials a TLS listener until it presents the certificate with
+// fingerprint, for servers whose reload can't report whether it took;
+// serverName is sent as SNI when set. The
+// certificate is read before any client authentication, so listeners that
+// require client certificates can be checked as well.
+func waitServed(ctx context.Context, address, serverName, fingerprint string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var served string
+	var err error
+	for {
+		served, err = servedFingerprint(ctx, address, serverName)
+		if err == nil && served == fingerprint {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("%s is not serving the new certificate: %w", address, err)
+			}
+			return fmt.Errorf("%s still serves certificate %s after %s", address, served, timeout)
+		case <-time.After(SERVED_POLL_INTERVAL):
+		}
+	}
+}
+
+func servedFingerprint(ctx context.Context, address, serverName string) (string, error) {
+	var leaf []byte
+	config := &tls.Config{
+		ServerName: serverName,
+		// Only the fingerprint matters here, not whether the chain is trusted
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) > 0 {
+				leaf = raw[0]
+			}
+			return nil
+		},
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: SERVED_DIAL_TIMEOUT}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if conn != nil {
+		conn.Close()
+	}
+	if leaf == nil {
+		if err == nil {
+			err = fmt.Errorf("no certificate presented")
+		}
+		return "", err
+	}
+	sum := sha256.Sum256(leaf)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,569 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TARGET_OPENVPN    = "openvpn"
+	TARGET_STRONGSWAN = "strongswan"
+
+	// Time OpenVPN gets to re-read its files before it is checked on; a
+	// key it can't load makes it exit
+	OPENVPN_SETTLE = 5 * time.Second
+	// The service OpenVPN installs on Windows
+	OPENVPN_WINDOWS_SERVICE = "OpenVPNService"
+
+	// swanctl loads credentials from vici; ipsec is the legacy stroke
+	// interface configured in ipsec.conf
+	STRONGSWAN_SWANCTL = "swanctl"
+	STRONGSWAN_STROKE  = "ipsec"
+	SWANCTL_DIR        = "/etc/swanctl"
+	IPSEC_DIR          = "/etc/ipsec.d"
+	IPSEC_SECRETS      = "/etc/ipsec.secrets"
+)
+
+func init() {
+	builtinTargets[TARGET_OPENVPN] = newOpenVPNTarget
+	builtinTargets[TARGET_STRONGSWAN] = newStrongSwanTarget
+}
+
+// OpenVPNOptions configure the OpenVPN target
+type OpenVPNOptions struct {
+	// Config is the server or client configuration whose cert and key (or
+	// pkcs12) are rotated, e.g. /etc/openvpn/server/server.conf
+	Config string `json:"config"`
+	// Service is signalled or restarted; derived from the config location
+	// (openvpn-server@name, openvpn-client@name or openvpn@name) by default
+	Service string `json:"service,omitempty"`
+}
+
+// openvpnTarget rotates what an OpenVPN configuration references: cert and
+// key files, <cert> and <key> blocks inline, or a pkcs12 file. OpenVPN
+// only loads them when it (re)starts, so the reload drops the tunnels
+// and peers reconnect with the new certificate: SIGUSR1 when the daemon
+// re-reads keys on a soft restart, SIGHUP when persist-key keeps them
+// across one, and a service restart when it dropped the privileges it
+// needs to read them.
+type openvpnTarget struct {
+	env  *Env
+	opts OpenVPNOptions
+}
+
+// openvpnConfig is what the target needs from a configuration
+type openvpnConfig struct {
+	dir        string
+	directives map[string]string
+	inline     map[string]bool
+	server     bool
+}
+
+func newOpenVPNTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts OpenVPNOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Config == "" {
+		return nil, tasks.Rejectf("openvpn target requires config")
+	}
+	if !filepath.IsAbs(opts.Config) {
+		return nil, tasks.Rejectf("config must be an absolute path")
+	}
+	if opts.Service == "" {
+		opts.Service = openvpnServiceName(opts.Config)
+	}
+	return &openvpnTarget{env: env, opts: opts}, nil
+}
+
+// openvpnServiceName follows the systemd units distros ship
+func openvpnServiceName(config string) string {
+	if runtime.GOOS == "windows" {
+		return OPENVPN_WINDOWS_SERVICE
+	}
+	name := strings.TrimSuffix(filepath.Base(config), filepath.Ext(config))
+	switch filepath.Base(filepath.Dir(config)) {
+	case "server":
+		return "openvpn-server@" + name
+	case "client":
+		return "openvpn-client@" + name
+	}
+	return "openvpn@" + name
+}
+
+func (t *openvpnTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	config, err := t.env.Confine(t.opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := readOpenVPNConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	// Peers with remote-cert-tls refuse a certificate without the usage
+	// for the role, so don't install one
+	usage, role := x509.ExtKeyUsageClientAuth, "client"
+	if conf.server {
+		usage, role = x509.ExtKeyUsageServerAuth, "server"
+	}
+	if !hasExtKeyUsage(bundle.Leaf(), usage) {
+		return nil, tasks.Rejectf("certificate is not valid for TLS %s authentication, which this %s configuration needs", role, role)
+	}
+
+	snap := newSnapshot()
+	result := &Result{Details: map[string]string{"role": role, "config": t.opts.Config}}
+	switch {
+	case conf.inline["cert"] || conf.inline["key"]:
+		if !conf.inline["cert"] || !conf.inline["key"] {
+			return nil, tasks.Rejectf("%s has only one of <cert> and <key> inline", t.opts.Config)
+		}
+		data, err := os.ReadFile(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", config, err)
+		}
+		data = replaceInlineBlock(data, "key", bundle.PrivateKey)
+		data = replaceInlineBlock(data, "cert", bundle.FullChain())
+		snap.save(config)
+		file, err := installFile(t.env, config, data, true)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		result.Files = []string{file}
+		result.Details["format"] = "inline"
+	case conf.directives["pkcs12"] != "":
+		if conf.inline["pkcs12"] {
+			return nil, tasks.Rejectf("%s has <pkcs12> inline; use a pkcs12 file or cert and key", t.opts.Config)
+		}
+		pair, err := tls.X509KeyPair(bundle.FullChain(), bundle.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := bundleIntermediates(bundle)
+		if err != nil {
+			return nil, err
+		}
+		// OpenVPN would ask for a password on the console
+		data, err := pkcs12.Passwordless.Encode(pair.PrivateKey, bundle.Leaf(), chain, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS12: %w", err)
+		}
+		path, err := t.env.Confine(conf.resolve(conf.directives["pkcs12"]))
+		if err != nil {
+			return nil, err
+		}
+		snap.save(path)
+		file, err := installFile(t.env, path, data, true)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		result.Files = []string{file}
+		result.Details["format"] = "pkcs12"
+	case conf.directives["cert"] != "" && conf.directives["key"] != "":
+		certPath, err := t.env.Confine(conf.resolve(conf.directives["cert"]))
+		if err != nil {
+			return nil, err
+		}
+		keyPath, err := t.env.Confine(conf.resolve(conf.directives["key"]))
+		if err != nil {
+			return nil, err
+		}
+		snap.save(certPath)
+		snap.save(keyPath)
+		files, err := installPair(t.env, certPath, keyPath, bundle)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		result.Files = files
+		result.Details["format"] = "pem"
+	default:
+		return nil, tasks.Rejectf("%s references no cert and key or pkcs12", t.opts.Config)
+	}
+
+	pidFile := ""
+	if conf.directives["writepid"] != "" {
+		pidFile = conf.resolve(conf.directives["writepid"])
+	}
+	switch {
+	case runtime.GOOS == "windows" || conf.directives["user"] != "" || conf.directives["group"] != "":
+		// An unprivileged daemon can't read the new key; only a fresh start
+		// as root can
+		if err := t.env.Restart(ctx, t.opts.Service); err != nil {
+			return result, fmt.Errorf("failed to restart %s: %w", t.opts.Service, err)
+		}
+		result.Details["reload"] = "restart"
+	case conf.has("persist-key"):
+		if err := t.signal(ctx, pidFile, "HUP"); err != nil {
+			return result, err
+		}
+		result.Details["reload"] = "SIGHUP"
+	default:
+		if err := t.signal(ctx, pidFile, "USR1"); err != nil {
+			return result, err
+		}
+		result.Details["reload"] = "SIGUSR1"
+	}
+	result.Reloaded = []string{t.opts.Service}
+
+	select {
+	case <-ctx.Done():
+		return result, ctx.Err()
+	case <-time.After(OPENVPN_SETTLE):
+	}
+	if err := t.alive(ctx, pidFile); err != nil {
+		return result, fmt.Errorf("openvpn did not survive the reload, check its log: %w", err)
+	}
+	return result, nil
+}
+
+// signal sends the daemon a signal through its pid file, or through
+// systemd. Signals are reloads, so the service must be allowlisted.
+func (t *openvpnTarget) signal(ctx context.Context, pidFile, signal string) error {
+	if !allowed(t.env.Allowlist, t.opts.Service) {
+		return tasks.Rejectf("service %q is not in the allowlist", t.opts.Service)
+	}
+	if pidFile != "" {
+		pid, err := readPid(pidFile)
+		if err != nil {
+			return err
+		}
+		return run(ctx, "kill", "-"+signal, strconv.Itoa(pid))
+	}
+	if !commandExists("systemctl") {
+		return tasks.Rejectf("no writepid in %s and no systemd to signal %s through", t.opts.Config, t.opts.Service)
+	}
+	return run(ctx, "systemctl", "kill", "--kill-whom=main", "--signal=SIG"+signal, t.opts.Service)
+}
+
+// alive checks the daemon is still running after its reload
+func (t *openvpnTarget) alive(ctx context.Context, pidFile string) error {
+	if pidFile != "" && runtime.GOOS != "windows" {
+		pid, err := readPid(pidFile)
+		if err != nil {
+			return err
+		}
+		return run(ctx, "kill", "-0", strconv.Itoa(pid))
+	}
+	if t.env.Manager == nil {
+		return nil
+	}
+	state, err := t.env.Manager.Status(ctx, t.opts.Service)
+	if err != nil {
+		return err
+	}
+	if state != "active" && state != "running" {
+		return fmt.Errorf("%s is %s", t.opts.Service, state)
+	}
+	return nil
+}
+
+func readPid(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 1 {
+		return 0, fmt.Errorf("invalid pid in %s", path)
+	}
+	return pid, nil
+}
+
+// readOpenVPNConfig reads the directives of a configuration, noting which
+// files are inline blocks
+func readOpenVPNConfig(path string) (*openvpnConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	conf := &openvpnConfig{dir: filepath.Dir(path), directives: map[string]string{}, inline: map[string]bool{}}
+	scanner := bufio.NewScanner(file)
+	block := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if block != "" {
+			if line == "</"+block+">" {
+				block = ""
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">") && !strings.HasPrefix(line, "</") {
+			block = strings.Trim(line, "<>")
+			conf.inline[block] = true
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimPrefix(line, "--"), " ")
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		conf.directives[name] = value
+		if value == "" {
+			// Flags such as persist-key
+			conf.directives[name] = name
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	mode := conf.directives["mode"]
+	conf.server = conf.has("server") || conf.has("server-bridge") || conf.has("tls-server") || mode == "server"
+	// Relative paths are relative to cd, or to where systemd runs OpenVPN:
+	// the configuration's directory
+	if cd := conf.directives["cd"]; cd != "" {
+		conf.dir = cd
+	}
+	return conf, nil
+}
+
+func (c *openvpnConfig) has(directive string) bool {
+	_, ok := c.directives[directive]
+	return ok
+}
+
+func (c *openvpnConfig) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.dir, path)
+}
+
+// replaceInlineBlock swaps the contents of an inline <tag> block
+func replaceInlineBlock(config []byte, tag string, content []byte) []byte {
+	pattern := regexp.MustCompile(`(?s)(<` + tag + `>\r?\n).*?(\r?\n?</` + tag + `>)`)
+	content = bytes.TrimSpace(content)
+	return pattern.ReplaceAllFunc(config, func(match []byte) []byte {
+		groups := pattern.FindSubmatch(match)
+		out := append([]byte{}, groups[1]...)
+		out = append(out, content...)
+		if !bytes.HasPrefix(groups[2], []byte("\n")) && !bytes.HasPrefix(groups[2], []byte("\r\n")) {
+			out = append(out, '\n')
+		}
+		return append(out, groups[2]...)
+	})
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	// No extension means no restriction
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func bundleIntermediates(bundle *Bundle) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for _, der := range bundle.ChainCertificates() {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse chain: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// StrongSwanOptions configure the strongSwan target
+type StrongSwanOptions struct {
+	// CertFile and KeyFile default to <name>.pem in swanctl's x509 and
+	// private directories, or ipsec.d's certs and private; swanctl.conf
+	// (certs) or ipsec.conf (leftcert) and ipsec.secrets must reference them
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// Interface is swanctl or ipsec; swanctl when it is installed
+	Interface string `json:"interface,omitempty"`
+}
+
+// strongswanTarget installs the machine certificate and key and has charon
+// load them: swanctl --load-creds, then --load-conns since connections
+// carry their certificate, or for ipsec.conf setups, ipsec rereadsecrets
+// and reload. Established SAs keep going; the next rekey or connection
+// authenticates with the new certificate.
+type strongswanTarget struct {
+	env  *Env
+	opts StrongSwanOptions
+}
+
+func newStrongSwanTarget(env *Env, options json.RawMessage) (Target, error) {
+	var opts StrongSwanOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, tasks.Rejectf("cert_file and key_file go together")
+	}
+	switch opts.Interface {
+	case "":
+		opts.Interface = STRONGSWAN_STROKE
+		if commandExists("swanctl") && dirExists(SWANCTL_DIR) {
+			opts.Interface = STRONGSWAN_SWANCTL
+		}
+	case STRONGSWAN_SWANCTL, STRONGSWAN_STROKE:
+	default:
+		return nil, tasks.Rejectf("invalid interface %q: want %s or %s", opts.Interface, STRONGSWAN_SWANCTL, STRONGSWAN_STROKE)
+	}
+	if !commandExists(opts.Interface) {
+		return nil, tasks.Rejectf("%s not found", opts.Interface)
+	}
+	return &strongswanTarget{env: env, opts: opts}, nil
+}
+
+func (t *strongswanTarget) Deploy(ctx context.Context, bundle *Bundle) (*Result, error) {
+	certPath, keyPath := t.opts.CertFile, t.opts.KeyFile
+	if certPath == "" {
+		if t.opts.Interface == STRONGSWAN_SWANCTL {
+			certPath = filepath.Join(SWANCTL_DIR, "x509", bundle.Name+".pem")
+			keyPath = filepath.Join(SWANCTL_DIR, "private", bundle.Name+".pem")
+		} else {
+			certPath = filepath.Join(IPSEC_DIR, "certs", bundle.Name+".pem")
+			keyPath = filepath.Join(IPSEC_DIR, "private", bundle.Name+".pem")
+		}
+	}
+	var err error
+	if certPath, err = t.env.Confine(certPath); err != nil {
+		return nil, err
+	}
+	if keyPath, err = t.env.Confine(keyPath); err != nil {
+		return nil, err
+	}
+	if t.opts.Interface == STRONGSWAN_STROKE {
+		if err := checkIPsecSecret(keyPath, bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	snap := newSnapshot()
+	snap.save(certPath)
+	snap.save(keyPath)
+	key, err := installFile(t.env, keyPath, bundle.PrivateKey, true)
+	if err != nil {
+		snap.restore()
+		return nil, err
+	}
+	files := []string{key}
+	// charon reads one certificate per file. swanctl loads intermediates
+	// next to the leaf untrusted, so they only complete the chain sent to
+	// peers; x509ca or cacerts would make them trust anchors. stroke loads
+	// only the leftcert, so its peers need the intermediates already.
+	var chain [][]byte
+	if t.opts.Interface == STRONGSWAN_SWANCTL {
+		chain = bundle.ChainCertificates()
+	}
+	for i, der := range chain {
+		path := strings.TrimSuffix(certPath, filepath.Ext(certPath)) + "-chain-" + strconv.Itoa(i+1) + ".pem"
+		snap.save(path)
+		file, err := installFile(t.env, path, pemCertificate(der), false)
+		if err != nil {
+			snap.restore()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	cert, err := installFile(t.env, certPath, pemCertificate(bundle.Leaf().Raw), false)
+	if err != nil {
+		snap.restore()
+		return nil, err
+	}
+	files = append([]string{cert}, files...)
+	result := &Result{Files: files, Details: map[string]string{"interface": t.opts.Interface}}
+
+	var commands [][]string
+	if t.opts.Interface == STRONGSWAN_SWANCTL {
+		commands = [][]string{{"swanctl", "--load-creds", "--noprompt"}, {"swanctl", "--load-conns"}}
+	} else {
+		commands = [][]string{{"ipsec", "rereadsecrets"}, {"ipsec", "reload"}}
+	}
+	for _, command := range commands {
+		if err := run(ctx, command[0], command[1:]...); err != nil {
+			return result, err
+		}
+	}
+	result.Reloaded = []string{"strongswan"}
+
+	// Confirm charon holds the new certificate
+	list := []string{"swanctl", "--list-certs"}
+	if t.opts.Interface == STRONGSWAN_STROKE {
+		list = []string{"ipsec", "listcerts"}
+	}
+	out, err := output(ctx, list[0], list[1:]...)
+	if err != nil {
+		return result, fmt.Errorf("failed to list loaded certificates: %w", err)
+	}
+	serial := colonHex(bundle.Leaf().SerialNumber.Bytes())
+	if !strings.Contains(strings.ToLower(out), serial) {
+		return result, fmt.Errorf("charon did not load certificate %s; check that the configuration references %s", serial, cert)
+	}
+	result.Details["serial"] = serial
+	return result, nil
+}
+
+// checkIPsecSecret makes sure ipsec.secrets declares the key with the
+// type of the new one, since stroke can't tell an RSA key from an ECDSA
+// one by itself
+func checkIPsecSecret(keyPath string, bundle *Bundle) error {
+	want := "PKCS8"
+	switch bundle.Leaf().PublicKeyAlgorithm {
+	case x509.RSA:
+		want = "RSA"
+	case x509.ECDSA:
+		want = "ECDSA"
+	}
+
+	data, err := os.ReadFile(IPSEC_SECRETS)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", IPSEC_SECRETS, err)
+	}
+	name := filepath.Base(keyPath)
+	for _, line := range strings.Split(string(data), "\n") {
+		_, secret, ok := strings.Cut(line, ":")
+		fields := strings.Fields(secret)
+		if !ok || len(fields) < 2 || strings.Trim(fields[1], `"`) != keyPath && strings.Trim(fields[1], `"`) != name {
+			continue
+		}
+		if kind := strings.ToUpper(fields[0]); kind != want && kind != "PKCS8" && want != "PKCS8" {
+			return tasks.Rejectf("%s declares %s as %s but the new key is %s", IPSEC_SECRETS, name, kind, want)
+		}
+		return nil
+	}
+	return tasks.Rejectf("%s doesn't reference %s; add \": %s %s\"", IPSEC_SECRETS, keyPath, want, name)
+}
+
+func pemCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// colonHex formats a serial the way strongSwan lists it
+func colonHex(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
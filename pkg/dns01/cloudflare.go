@@ -0,0 +1,255 @@
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	PROVIDER_CLOUDFLARE = "cloudflare"
+
+	CLOUDFLARE_API     = "https://api.cloudflare.com/client/v4"
+	CLOUDFLARE_TIMEOUT = 30 * time.Second
+)
+
+func init() {
+	Register(PROVIDER_CLOUDFLARE, newCloudflare)
+}
+
+// CloudflareOptions configure the Cloudflare provider. The token needs only
+// Zone:DNS:Edit; with ZoneID set it doesn't need Zone:Read either, so it
+// can be scoped to a single zone.
+type CloudflareOptions struct {
+	// APIToken falls back to CLOUDFLARE_API_TOKEN
+	APIToken string `json:"api_token,omitempty"`
+	ZoneID   string `json:"zone_id,omitempty"`
+}
+
+type cloudflare struct {
+	token  string
+	zoneID string
+	client *http.Client
+	api    string
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content,omitempty"`
+	TTL     int    `json:"ttl"`
+	// Data replaces Content for structured types such as TLSA
+	Data *cloudflareTLSA `json:"data,omitempty"`
+}
+
+type cloudflareTLSA struct {
+	Usage        int    `json:"usage"`
+	Selector     int    `json:"selector"`
+	MatchingType int    `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+func newCloudflare(options json.RawMessage) (Provider, error) {
+	var opts CloudflareOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.APIToken == "" {
+		opts.APIToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	}
+	if opts.APIToken == "" {
+		return nil, fmt.Errorf("cloudflare provider requires api_token")
+	}
+	redact.AddSecret(opts.APIToken)
+	return &cloudflare{
+		token:  opts.APIToken,
+		zoneID: opts.ZoneID,
+		client: httpclient.New(CLOUDFLARE_TIMEOUT),
+		api:    CLOUDFLARE_API,
+	}, nil
+}
+
+func (c *cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.records(ctx, zoneID, "TXT", fqdn, value)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	record := cloudflareRecord{Type: "TXT", Name: fqdn, Content: value, TTL: RECORD_TTL}
+	return c.request(ctx, "POST", "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+func (c *cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.records(ctx, zoneID, "TXT", fqdn, value)
+	if err != nil {
+		return err
+	}
+	for _, record := range existing {
+		if err := c.request(ctx, "DELETE", "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cloudflare) SetRecords(ctx context.Context, fqdn, rrtype string, values []string, ttl int) error {
+	zoneID, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	existing, err := c.records(ctx, zoneID, rrtype, fqdn, "")
+	if err != nil {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, record := range existing {
+		content := normalizeRecord(record.Content)
+		if slices.ContainsFunc(values, func(v string) bool { return normalizeRecord(v) == content }) {
+			present[content] = true
+			continue
+		}
+		if err := c.request(ctx, "DELETE", "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, value := range values {
+		if present[normalizeRecord(value)] {
+			continue
+		}
+		record := cloudflareRecord{Type: rrtype, Name: fqdn, Content: value, TTL: ttl}
+		if rrtype == "TLSA" {
+			var data cloudflareTLSA
+			if _, err := fmt.Sscanf(value, "%d %d %d %s", &data.Usage, &data.Selector, &data.MatchingType, &data.Certificate); err != nil {
+				return fmt.Errorf("invalid TLSA record %q: %w", value, err)
+			}
+			record.Content, record.Data = "", &data
+		}
+		if err := c.request(ctx, "POST", "/zones/"+zoneID+"/dns_records", record, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeRecord makes record contents comparable across whitespace and
+// hex case
+func normalizeRecord(content string) string {
+	return strings.ToLower(strings.Join(strings.Fields(content), " "))
+}
+
+// zone finds the zone ID by trying each parent name of fqdn
+func (c *cloudflare) zone(ctx context.Context, fqdn string) (string, error) {
+	if c.zoneID != "" {
+		return c.zoneID, nil
+	}
+
+	name := fqdn
+	for strings.Contains(name, ".") {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.request(ctx, "GET", "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+		name = name[strings.Index(name, ".")+1:]
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s (or the token lacks Zone:Read; set zone_id)", fqdn)
+}
+
+// records lists rrtype records at fqdn, only those holding value if set
+func (c *cloudflare) records(ctx context.Context, zoneID, rrtype, fqdn, value string) ([]cloudflareRecord, error) {
+	query := url.Values{}
+	query.Set("type", rrtype)
+	query.Set("name", fqdn)
+	if value != "" {
+		query.Set("content", value)
+	}
+
+	var records []cloudflareRecord
+	if err := c.request(ctx, "GET", "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *cloudflare) request(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.api+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudflare API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("cloudflare %s %s failed with status %d", method, path, resp.StatusCode)
+	}
+	if !result.Success {
+		var messages []string
+		for _, e := range result.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare %s %s failed: %s", method, path, strings.Join(messages, "; "))
+	}
+	if out != nil {
+		if err := json.Unmarshal(result.Result, out); err != nil {
+			return fmt.Errorf("failed to parse cloudflare response: %w", err)
+		}
+	}
+	return nil
+}
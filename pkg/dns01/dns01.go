@@ -0,0 +1,112 @@
+// Package dns01 publishes ACME DNS-01 challenge records. A Provider talks
+// to one DNS host; built-in providers cover Route53 and Cloudflare, and the
+// exec provider hands the work to a user script for everything else.
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+)
+
+const (
+	CHALLENGE_PREFIX = "_acme-challenge."
+
+	// TTL requested for challenge records; providers round up to their minimum
+	RECORD_TTL = 120
+)
+
+// Provider publishes and removes DNS-01 challenge TXT records. fqdn is the
+// full record name without trailing dot; value is the record content. A
+// name may carry several values at once (a wildcard and its apex share
+// _acme-challenge), so Present adds and CleanUp removes only that value.
+type Provider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// RecordSetter is implemented by providers that also manage records other
+// than challenges, such as TLSA records for DANE. SetRecords replaces every
+// rrtype value at fqdn with values; no values deletes the set.
+type RecordSetter interface {
+	SetRecords(ctx context.Context, fqdn, rrtype string, values []string, ttl int) error
+}
+
+// Factory builds a provider from its JSON options in the agent config
+type Factory func(options json.RawMessage) (Provider, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a provider available by name. Built-in providers register
+// themselves from init.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = factory
+}
+
+// Providers lists the registered provider names
+func Providers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the named provider. "type:label" names select the type before
+// the colon, so one type can be configured more than once (exec:gandi).
+func New(name string, options json.RawMessage) (Provider, error) {
+	kind, _, _ := strings.Cut(name, ":")
+	mu.RLock()
+	factory, ok := factories[kind]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider %q (available: %s)", kind, strings.Join(Providers(), ", "))
+	}
+	return factory(options)
+}
+
+// ChallengeRecord returns the record name and value for a domain and the
+// ACME key authorization (RFC 8555 section 8.4)
+func ChallengeRecord(domain, keyAuthorization string) (string, string) {
+	sum := sha256.Sum256([]byte(keyAuthorization))
+	return ChallengeName(domain), base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ChallengeName is _acme-challenge.<domain>; wildcards validate at their
+// base and international names at their A-label form
+func ChallengeName(domain string) string {
+	domain = strings.TrimSuffix(strings.TrimPrefix(domain, "*."), ".")
+	if ascii, err := idn.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return CHALLENGE_PREFIX + strings.ToLower(domain)
+}
+
+// decodeOptions rejects unknown fields so credential typos fail loudly
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid provider options: %w", err)
+	}
+	return nil
+}
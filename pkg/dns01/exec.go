@@ -0,0 +1,125 @@
+package dns01
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROVIDER_EXEC = "exec"
+
+	EXEC_DEFAULT_TIMEOUT = 2 * time.Minute
+
+	ACTION_PRESENT = "present"
+	ACTION_CLEANUP = "cleanup"
+	ACTION_SET     = "set"
+)
+
+func init() {
+	Register(PROVIDER_EXEC, newExecProvider)
+}
+
+// ExecOptions configure the exec provider. The command is run as
+//
+//	<command> [args...] present|cleanup|set
+//
+// with this environment on top of the agent's own:
+//
+//	CERTFIX_DNS_ACTION  present or cleanup
+//	CERTFIX_DNS_FQDN    record name, e.g. _acme-challenge.example.com
+//	CERTFIX_DNS_DOMAIN  the name being validated, e.g. example.com
+//	CERTFIX_DNS_ZONE    enclosing zone when it could be determined
+//	CERTFIX_DNS_VALUE   TXT record content
+//	CERTFIX_DNS_TTL     suggested TTL in seconds
+//
+// Exit status 0 means done; anything else fails the challenge with the
+// command's output as the reason. present must only add the value and
+// cleanup must only remove it, since one name can hold several values.
+// Propagation is checked by the agent afterwards.
+//
+// set replaces a whole record set of another type (TLSA for DANE), with
+// CERTFIX_DNS_TYPE naming the type and CERTFIX_DNS_VALUES holding one
+// value per line; no values means delete the set. Scripts that only do
+// challenges can fail it.
+type ExecOptions struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Env adds variables, e.g. API credentials the script needs
+	Env map[string]string `json:"env,omitempty"`
+	// Timeout in seconds per invocation
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type execProvider struct {
+	opts    ExecOptions
+	timeout time.Duration
+}
+
+func newExecProvider(options json.RawMessage) (Provider, error) {
+	var opts ExecOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Command == "" {
+		return nil, fmt.Errorf("exec provider requires command")
+	}
+	path, err := exec.LookPath(opts.Command)
+	if err != nil {
+		return nil, fmt.Errorf("exec provider command %s: %w", opts.Command, err)
+	}
+	opts.Command = path
+
+	timeout := EXEC_DEFAULT_TIMEOUT
+	if opts.Timeout > 0 {
+		timeout = time.Duration(opts.Timeout) * time.Second
+	}
+	return &execProvider{opts: opts, timeout: timeout}, nil
+}
+
+func (p *execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, ACTION_PRESENT, fqdn, "CERTFIX_DNS_VALUE="+value, "CERTFIX_DNS_TTL="+strconv.Itoa(RECORD_TTL))
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, ACTION_CLEANUP, fqdn, "CERTFIX_DNS_VALUE="+value, "CERTFIX_DNS_TTL="+strconv.Itoa(RECORD_TTL))
+}
+
+func (p *execProvider) SetRecords(ctx context.Context, fqdn, rrtype string, values []string, ttl int) error {
+	return p.run(ctx, ACTION_SET, fqdn,
+		"CERTFIX_DNS_TYPE="+rrtype,
+		"CERTFIX_DNS_VALUES="+strings.Join(values, "\n"),
+		"CERTFIX_DNS_TTL="+strconv.Itoa(ttl),
+	)
+}
+
+func (p *execProvider) run(ctx context.Context, action, fqdn string, vars ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	env := append(os.Environ(),
+		"CERTFIX_DNS_ACTION="+action,
+		"CERTFIX_DNS_FQDN="+fqdn,
+		"CERTFIX_DNS_DOMAIN="+strings.TrimPrefix(fqdn, CHALLENGE_PREFIX),
+	)
+	env = append(env, vars...)
+	if zone, _, err := FindZone(ctx, fqdn); err == nil {
+		env = append(env, "CERTFIX_DNS_ZONE="+zone)
+	}
+	for key, val := range p.opts.Env {
+		env = append(env, key+"="+val)
+	}
+
+	cmd := exec.CommandContext(ctx, p.opts.Command, append(append([]string(nil), p.opts.Args...), action)...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", p.opts.Command, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package dns01
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+)
+
+const (
+	PROPAGATION_TIMEOUT  = 5 * time.Minute
+	PROPAGATION_INTERVAL = 5 * time.Second
+	QUERY_TIMEOUT        = 5 * time.Second
+)
+
+// FindZone returns the closest enclosing zone of fqdn and its name servers,
+// found by walking up the labels until one has NS records
+func FindZone(ctx context.Context, fqdn string) (string, []string, error) {
+	name := strings.TrimSuffix(fqdn, ".")
+	for {
+		lookupCtx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+		records, err := securedns.Resolver().LookupNS(lookupCtx, name)
+		cancel()
+		if err == nil && len(records) > 0 {
+			var servers []string
+			for _, ns := range records {
+				servers = append(servers, strings.TrimSuffix(ns.Host, "."))
+			}
+			return name, servers, nil
+		}
+
+		i := strings.Index(name, ".")
+		if i < 0 || !strings.Contains(name[i+1:], ".") {
+			return "", nil, fmt.Errorf("no zone found for %s", fqdn)
+		}
+		name = name[i+1:]
+	}
+}
+
+// WaitForPropagation polls every authoritative name server of the zone
+// until all of them serve value at fqdn. Asking the authoritative servers
+// directly avoids caching resolvers holding on to a negative answer.
+func WaitForPropagation(ctx context.Context, fqdn, value string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = PROPAGATION_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, servers, err := FindZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pending := pendingServers(ctx, servers, fqdn, value)
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %s not visible on %s after %v", fqdn, strings.Join(pending, ", "), timeout)
+		case <-time.After(PROPAGATION_INTERVAL):
+		}
+	}
+}
+
+func pendingServers(ctx context.Context, servers []string, fqdn, value string) []string {
+	var pending []string
+	for _, server := range servers {
+		values, err := lookupTXTAt(ctx, server, fqdn)
+		if err != nil || !contains(values, value) {
+			pending = append(pending, server)
+		}
+	}
+	return pending
+}
+
+// lookupTXTAt sends the query straight to one name server
+func lookupTXTAt(ctx context.Context, server, fqdn string) ([]string, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := netdial.Dialer{Timeout: QUERY_TIMEOUT, Resolver: securedns.Resolver()}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	return resolver.LookupTXT(ctx, fqdn)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/awsauth"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	PROVIDER_ROUTE53 = "route53"
+
+	ROUTE53_API     = "https://route53.amazonaws.com/2013-04-01"
+	ROUTE53_REGION  = "us-east-1"
+	ROUTE53_TIMEOUT = 30 * time.Second
+	ROUTE53_XMLNS   = "https://route53.amazonaws.com/doc/2013-04-01/"
+)
+
+func init() {
+	Register(PROVIDER_ROUTE53, newRoute53)
+}
+
+// Route53Options configure the Route53 provider. Without static keys the
+// provider uses AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY and then the EC2
+// instance profile. The policy needs route53:ListHostedZonesByName,
+// route53:ListResourceRecordSets, route53:ChangeResourceRecordSets and
+// route53:GetChange; with HostedZoneID set the first can be dropped.
+type Route53Options struct {
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+	HostedZoneID    string `json:"hosted_zone_id,omitempty"`
+}
+
+type route53 struct {
+	opts   Route53Options
+	client *http.Client
+	creds  *awsauth.Source
+	// Serializes read-modify-write of a name's record sets
+	mu sync.Mutex
+}
+
+type route53RecordSet struct {
+	Name            string   `xml:"Name"`
+	Type            string   `xml:"Type"`
+	TTL             int      `xml:"TTL"`
+	ResourceRecords []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+func newRoute53(options json.RawMessage) (Provider, error) {
+	var opts Route53Options
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	client := httpclient.New(ROUTE53_TIMEOUT)
+
+	creds := awsauth.FromEnvironment()
+	if opts.AccessKeyID != "" {
+		creds = &awsauth.Credentials{AccessKeyID: opts.AccessKeyID, SecretAccessKey: opts.SecretAccessKey, Token: opts.SessionToken}
+	}
+	if creds != nil && creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("route53 provider requires secret_access_key with access_key_id")
+	}
+	if creds != nil {
+		redact.AddSecret(creds.SecretAccessKey)
+	}
+
+	return &route53{opts: opts, client: client, creds: awsauth.NewSource(creds)}, nil
+}
+
+func (r *route53) Present(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, "TXT", RECORD_TTL, func(values []string) []string {
+		if contains(values, quoteTXT(value)) {
+			return values
+		}
+		return append(values, quoteTXT(value))
+	})
+}
+
+func (r *route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, "TXT", RECORD_TTL, func(values []string) []string {
+		var kept []string
+		for _, v := range values {
+			if v != quoteTXT(value) {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	})
+}
+
+func (r *route53) SetRecords(ctx context.Context, fqdn, rrtype string, values []string, ttl int) error {
+	return r.update(ctx, fqdn, rrtype, ttl, func([]string) []string {
+		return values
+	})
+}
+
+// update rewrites a record set, since Route53 replaces whole record sets
+// and other challenges for the same name must survive, then waits for the
+// change to reach every Route53 name server
+func (r *route53) update(ctx context.Context, fqdn, rrtype string, ttl int, change func([]string) []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	zoneID, err := r.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	current, err := r.recordSet(ctx, zoneID, fqdn, rrtype)
+	if err != nil {
+		return err
+	}
+	var values []string
+	if current != nil {
+		values = current.ResourceRecords
+	}
+	updated := change(append([]string(nil), values...))
+	if strings.Join(updated, "\n") == strings.Join(values, "\n") {
+		return nil
+	}
+
+	request := route53ChangeRequest{Xmlns: ROUTE53_XMLNS}
+	if len(updated) == 0 {
+		// DELETE must match the existing set exactly
+		request.Changes = []route53Change{{Action: "DELETE", RecordSet: *current}}
+	} else {
+		request.Changes = []route53Change{{Action: "UPSERT", RecordSet: route53RecordSet{
+			Name: fqdn + ".", Type: rrtype, TTL: ttl, ResourceRecords: updated,
+		}}}
+	}
+
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal change batch: %w", err)
+	}
+	var info route53ChangeInfo
+	if err := r.request(ctx, "POST", "/hostedzone/"+zoneID+"/rrset", body, &info); err != nil {
+		return err
+	}
+	return r.waitForChange(ctx, info.ID)
+}
+
+func (r *route53) waitForChange(ctx context.Context, changeID string) error {
+	changeID = strings.TrimPrefix(changeID, "/change/")
+	for {
+		var info route53ChangeInfo
+		if err := r.request(ctx, "GET", "/change/"+changeID, nil, &info); err != nil {
+			return err
+		}
+		if info.Status == "INSYNC" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("route53 change %s still %s: %w", changeID, info.Status, ctx.Err())
+		case <-time.After(PROPAGATION_INTERVAL):
+		}
+	}
+}
+
+// zone picks the most specific public hosted zone containing fqdn
+func (r *route53) zone(ctx context.Context, fqdn string) (string, error) {
+	if r.opts.HostedZoneID != "" {
+		return r.opts.HostedZoneID, nil
+	}
+
+	name := fqdn
+	for strings.Contains(name, ".") {
+		var result struct {
+			Zones []struct {
+				ID      string `xml:"Id"`
+				Name    string `xml:"Name"`
+				Private bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		path := "/hostedzonesbyname?dnsname=" + url.QueryEscape(name) + "&maxitems=1"
+		if err := r.request(ctx, "GET", path, nil, &result); err != nil {
+			return "", err
+		}
+		for _, zone := range result.Zones {
+			if strings.TrimSuffix(zone.Name, ".") == name && !zone.Private {
+				return strings.TrimPrefix(zone.ID, "/hostedzone/"), nil
+			}
+		}
+		name = name[strings.Index(name, ".")+1:]
+	}
+	return "", fmt.Errorf("no Route53 hosted zone found for %s", fqdn)
+}
+
+func (r *route53) recordSet(ctx context.Context, zoneID, fqdn, rrtype string) (*route53RecordSet, error) {
+	query := url.Values{}
+	query.Set("name", fqdn+".")
+	query.Set("type", rrtype)
+	query.Set("maxitems", "1")
+
+	var result struct {
+		Sets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	if err := r.request(ctx, "GET", "/hostedzone/"+zoneID+"/rrset?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	// The listing starts at name, so the first set may be a later one
+	for _, set := range result.Sets {
+		if strings.EqualFold(strings.TrimSuffix(set.Name, "."), fqdn) && set.Type == rrtype {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *route53) request(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	creds, err := r.creds.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ROUTE53_API+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	awsauth.SignV4(req, body, creds, ROUTE53_REGION, "route53", time.Now())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("route53 API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("route53 %s %s failed: %s: %s", method, path, apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("route53 %s %s failed with status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		if err := xml.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to parse route53 response: %w", err)
+		}
+	}
+	return nil
+}
+
+func quoteTXT(value string) string {
+	return strconv.Quote(value)
+}
@@ -0,0 +1,223 @@
+package dns01
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_DNS_PRESENT = "dns01.present"
+	TASK_DNS_CLEANUP = "dns01.cleanup"
+
+	// Records nobody cleaned up explicitly are removed after this long
+	CLEANUP_AFTER   = time.Hour
+	CLEANUP_TIMEOUT = 5 * time.Minute
+)
+
+// ChallengeRequest is the payload of dns01.present and dns01.cleanup.
+// Either the record value or the ACME key authorization is given.
+type ChallengeRequest struct {
+	Provider         string `json:"provider"`
+	Domain           string `json:"domain"`
+	Value            string `json:"value,omitempty"`
+	KeyAuthorization string `json:"key_authorization,omitempty"`
+	// SkipPropagation returns as soon as the provider accepted the record
+	SkipPropagation bool `json:"skip_propagation,omitempty"`
+}
+
+// ChallengeResult reports the record that was published or removed
+type ChallengeResult struct {
+	Provider  string     `json:"provider"`
+	FQDN      string     `json:"fqdn"`
+	Value     string     `json:"value"`
+	CleanupAt *time.Time `json:"cleanup_at,omitempty"`
+}
+
+// Service answers DNS-01 tasks with the providers configured on this agent.
+// Credentials never travel in tasks; the task only names a provider.
+type Service struct {
+	options   map[string]json.RawMessage
+	audit     *audit.Logger
+	mu        sync.Mutex
+	providers map[string]Provider
+	pending   map[string]*time.Timer
+}
+
+// NewService creates a service for the configured providers, keyed by
+// provider name with each provider's options as the value
+func NewService(options map[string]json.RawMessage, auditLog *audit.Logger) *Service {
+	return &Service{
+		options:   options,
+		audit:     auditLog,
+		providers: make(map[string]Provider),
+		pending:   make(map[string]*time.Timer),
+	}
+}
+
+// Register installs the dns01 task handlers
+func (s *Service) Register(registry *tasks.Registry) {
+	registry.Register(TASK_DNS_PRESENT, s.handlePresent)
+	registry.Register(TASK_DNS_CLEANUP, s.handleCleanUp)
+}
+
+func (s *Service) handlePresent(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req ChallengeRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	result, err := s.Present(ctx, req)
+	s.record(task, TASK_DNS_PRESENT, req, err)
+	return result, err
+}
+
+func (s *Service) handleCleanUp(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req ChallengeRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	result, err := s.CleanUp(ctx, req)
+	s.record(task, TASK_DNS_CLEANUP, req, err)
+	return result, err
+}
+
+// Present publishes the record, waits until every authoritative server
+// serves it and schedules its removal
+func (s *Service) Present(ctx context.Context, req ChallengeRequest) (*ChallengeResult, error) {
+	provider, fqdn, value, err := s.resolve(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := provider.Present(ctx, fqdn, value); err != nil {
+		return nil, err
+	}
+	if !req.SkipPropagation {
+		if err := WaitForPropagation(ctx, fqdn, value, PROPAGATION_TIMEOUT); err != nil {
+			s.cleanUp(provider, req.Provider, fqdn, value)
+			return nil, err
+		}
+	}
+
+	cleanupAt := time.Now().Add(CLEANUP_AFTER).UTC()
+	s.scheduleCleanUp(provider, req.Provider, fqdn, value)
+	return &ChallengeResult{Provider: req.Provider, FQDN: fqdn, Value: value, CleanupAt: &cleanupAt}, nil
+}
+
+// CleanUp removes the record now and cancels the scheduled removal
+func (s *Service) CleanUp(ctx context.Context, req ChallengeRequest) (*ChallengeResult, error) {
+	provider, fqdn, value, err := s.resolve(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if timer, ok := s.pending[pendingKey(req.Provider, fqdn, value)]; ok {
+		timer.Stop()
+		delete(s.pending, pendingKey(req.Provider, fqdn, value))
+	}
+	s.mu.Unlock()
+
+	if err := provider.CleanUp(ctx, fqdn, value); err != nil {
+		return nil, err
+	}
+	return &ChallengeResult{Provider: req.Provider, FQDN: fqdn, Value: value}, nil
+}
+
+func (s *Service) resolve(req ChallengeRequest) (Provider, string, string, error) {
+	if req.Domain == "" {
+		return nil, "", "", tasks.Rejectf("domain is required")
+	}
+	fqdn, value := ChallengeName(req.Domain), req.Value
+	if value == "" {
+		if req.KeyAuthorization == "" {
+			return nil, "", "", tasks.Rejectf("value or key_authorization is required")
+		}
+		_, value = ChallengeRecord(req.Domain, req.KeyAuthorization)
+	}
+
+	provider, err := s.provider(req.Provider)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return provider, fqdn, value, nil
+}
+
+// provider builds configured providers once and reuses them
+func (s *Service) provider(name string) (Provider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if provider, ok := s.providers[name]; ok {
+		return provider, nil
+	}
+	options, ok := s.options[name]
+	if !ok {
+		var configured []string
+		for configuredName := range s.options {
+			configured = append(configured, configuredName)
+		}
+		sort.Strings(configured)
+		return nil, tasks.Rejectf("DNS provider %q is not configured on this agent (configured: %s)", name, strings.Join(configured, ", "))
+	}
+
+	provider, err := New(name, options)
+	if err != nil {
+		return nil, err
+	}
+	s.providers[name] = provider
+	return provider, nil
+}
+
+func (s *Service) scheduleCleanUp(provider Provider, name, fqdn, value string) {
+	key := pendingKey(name, fqdn, value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.pending[key]; ok {
+		timer.Stop()
+	}
+	s.pending[key] = time.AfterFunc(CLEANUP_AFTER, func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+		s.cleanUp(provider, name, fqdn, value)
+	})
+}
+
+func (s *Service) cleanUp(provider Provider, name, fqdn, value string) {
+	ctx, cancel := context.WithTimeout(context.Background(), CLEANUP_TIMEOUT)
+	defer cancel()
+	if err := provider.CleanUp(ctx, fqdn, value); err != nil {
+		log.Printf("[WARNING] Failed to remove DNS challenge record %s via %s: %v", fqdn, name, err)
+		return
+	}
+	log.Printf("[INFO] Removed DNS challenge record %s via %s", fqdn, name)
+}
+
+func pendingKey(provider, fqdn, value string) string {
+	return provider + ":" + fqdn + ":" + value
+}
+
+func (s *Service) record(task *tasks.Task, action string, req ChallengeRequest, err error) {
+	entry := audit.Entry{
+		TaskID:  task.ID,
+		Action:  action,
+		Target:  req.Provider + ":" + ChallengeName(req.Domain),
+		Outcome: tasks.STATUS_SUCCEEDED,
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", task.ID, err)
+	}
+}
@@ -0,0 +1,143 @@
+package dnscheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+)
+
+const (
+	LOOKUP_TIMEOUT = 5 * time.Second
+)
+
+// Result is the outcome of checking one name
+type Result struct {
+	Name     string   `json:"name"`
+	Resolved []string `json:"resolved,omitempty"`
+	Matches  bool     `json:"matches"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Checker verifies that DNS names resolve to this host or a known address
+type Checker struct {
+	Resolver *net.Resolver
+	local    []net.IP
+	known    []*net.IPNet
+}
+
+// NewChecker builds a checker that accepts this host's interface addresses
+// plus the given known addresses (single IPs or CIDRs, e.g. load balancers)
+func NewChecker(known []string) (*Checker, error) {
+	c := &Checker{Resolver: net.DefaultResolver}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			c.local = append(c.local, ipnet.IP)
+		}
+	}
+
+	for _, entry := range known {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid known address %q: %w", entry, err)
+		}
+		c.known = append(c.known, network)
+	}
+
+	return c, nil
+}
+
+// Check resolves every name and reports whether at least one address points
+// at this host. Wildcard names are skipped since they cannot be resolved.
+func (c *Checker) Check(ctx context.Context, names []string) []Result {
+	var results []Result
+
+	for _, name := range uniqueNames(names) {
+		results = append(results, c.checkName(ctx, name))
+	}
+
+	return results
+}
+
+func (c *Checker) checkName(ctx context.Context, name string) Result {
+	result := Result{Name: name}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+	defer cancel()
+
+	addrs, err := c.Resolver.LookupIPAddr(lookupCtx, name)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for _, addr := range addrs {
+		result.Resolved = append(result.Resolved, addr.IP.String())
+		if c.isOurs(addr.IP) {
+			result.Matches = true
+		}
+	}
+	sort.Strings(result.Resolved)
+
+	return result
+}
+
+func (c *Checker) isOurs(ip net.IP) bool {
+	for _, local := range c.local {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	for _, network := range c.known {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mismatches filters results down to names that don't point at this host
+func Mismatches(results []Result) []Result {
+	var mismatches []Result
+	for _, result := range results {
+		if !result.Matches {
+			mismatches = append(mismatches, result)
+		}
+	}
+	return mismatches
+}
+
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if ascii, err := idn.ToASCII(name); err == nil {
+			name = ascii
+		}
+		if name == "" || strings.HasPrefix(name, "*.") || net.ParseIP(name) != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,332 @@
+// Package drift compares what should be deployed on this host with what is
+// actually there: certificates replaced by hand, keys deleted or swapped,
+// chains edited, managed files rewritten, or an endpoint still serving
+// something else.
+package drift
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/verify"
+)
+
+const (
+	KIND_MISSING        = "missing"
+	KIND_REPLACED       = "replaced"
+	KIND_CHAIN_MODIFIED = "chain_modified"
+	KIND_KEY_MISMATCH   = "key_mismatch"
+	KIND_MODIFIED       = "modified"
+	KIND_NOT_SERVED     = "not_served"
+
+	// Keystores are the largest files targets write
+	MAX_FILE_SIZE = 4 << 20
+)
+
+// File is one file a deployment wrote. What the file held at deployment
+// time is recorded when known, so later changes can be told apart.
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Fingerprints of the certificates in the file, in order
+	Certificates []string `json:"certificates,omitempty"`
+	// Fingerprint of the public key of a private key file
+	Key string `json:"key,omitempty"`
+}
+
+// Expected is the desired state of one deployment
+type Expected struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	Fingerprint string `json:"fingerprint_sha256"`
+	// SHA-256 of the certificate's SubjectPublicKeyInfo
+	KeyFingerprint string          `json:"key_fingerprint,omitempty"`
+	Files          []File          `json:"files,omitempty"`
+	Endpoints      []verify.Target `json:"endpoints,omitempty"`
+	DeployedAt     time.Time       `json:"deployed_at,omitempty"`
+}
+
+// Key identifies a deployment; a later deployment of the same certificate
+// to the same target supersedes the earlier one
+func (e *Expected) Key() string {
+	return e.Target + ":" + e.Name
+}
+
+// Finding is one difference between desired and actual state
+type Finding struct {
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	Kind     string `json:"kind"`
+	Path     string `json:"path,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Found    string `json:"found,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ID is stable across checks, so repeated findings can be recognized
+func (f *Finding) ID() string {
+	return strings.Join([]string{f.Target, f.Name, f.Kind, f.Path, f.Endpoint, f.Found}, "|")
+}
+
+// Report is the outcome of one drift check
+type Report struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Checked   int       `json:"checked"`
+	Findings  []Finding `json:"drift"`
+	Errors    []string  `json:"errors,omitempty"`
+	// Remediate asks the server to redeploy drifted certificates
+	Remediate bool `json:"remediate,omitempty"`
+}
+
+// Record captures the desired state right after a successful deployment
+func Record(req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result) *Expected {
+	expected := &Expected{
+		Name:           req.Name,
+		Target:         req.Target,
+		Fingerprint:    bundle.Fingerprint(),
+		KeyFingerprint: keyFingerprint(bundle.Leaf().RawSubjectPublicKeyInfo),
+		DeployedAt:     time.Now().UTC(),
+	}
+	for _, path := range result.Files {
+		file := File{Path: path}
+		if data, err := readFile(path); err == nil {
+			sum := sha256.Sum256(data)
+			file.SHA256 = hex.EncodeToString(sum[:])
+			file.Certificates, file.Key = inspect(data)
+		}
+		expected.Files = append(expected.Files, file)
+	}
+	return expected
+}
+
+// Check compares each expectation with the files on disk and the endpoints
+func Check(ctx context.Context, expected []*Expected) *Report {
+	report := &Report{CheckedAt: time.Now().UTC(), Findings: []Finding{}}
+	for _, exp := range expected {
+		report.Checked++
+		for _, file := range exp.Files {
+			if finding, err := checkFile(exp, file); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", file.Path, err))
+			} else if finding != nil {
+				report.Findings = append(report.Findings, *finding)
+			}
+		}
+		for _, target := range exp.Endpoints {
+			if ctx.Err() != nil {
+				report.Errors = append(report.Errors, ctx.Err().Error())
+				return report
+			}
+			result := verify.Verify(ctx, target, exp.Fingerprint)
+			if result.ServedFingerprint == "" {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", target.Address(), result.Error))
+				continue
+			}
+			if result.ServedFingerprint != strings.ToLower(exp.Fingerprint) {
+				report.Findings = append(report.Findings, Finding{
+					Name:     exp.Name,
+					Target:   exp.Target,
+					Kind:     KIND_NOT_SERVED,
+					Endpoint: target.Address(),
+					Expected: exp.Fingerprint,
+					Found:    result.ServedFingerprint,
+				})
+			}
+		}
+	}
+	return report
+}
+
+func checkFile(exp *Expected, file File) (*Finding, error) {
+	finding := &Finding{Name: exp.Name, Target: exp.Target, Path: file.Path}
+
+	data, err := readFile(file.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		finding.Kind = KIND_MISSING
+		return finding, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if file.SHA256 != "" && hex.EncodeToString(sum[:]) == file.SHA256 {
+		return nil, nil
+	}
+
+	certs, key := inspect(data)
+	hasCerts := len(file.Certificates) > 0 || (file.SHA256 == "" && len(certs) > 0)
+	hasKey := file.Key != "" || (file.SHA256 == "" && key != "")
+	if hasCerts {
+		// Combined files (e.g. for HAProxy) hold the key too
+		if f := checkCertificates(exp, file, data, certs, finding); f != nil || !hasKey {
+			return f, nil
+		}
+	}
+	if hasKey {
+		return checkKey(exp, file, key, finding), nil
+	}
+	if file.SHA256 != "" {
+		finding.Kind = KIND_MODIFIED
+		finding.Expected, finding.Found = file.SHA256, hex.EncodeToString(sum[:])
+		return finding, nil
+	}
+	return nil, nil
+}
+
+func checkKey(exp *Expected, file File, key string, finding *Finding) *Finding {
+	want := file.Key
+	if want == "" {
+		want = exp.KeyFingerprint
+	}
+	if want == "" || key == want {
+		// Same key, possibly re-encoded
+		return nil
+	}
+	finding.Kind = KIND_KEY_MISMATCH
+	finding.Expected, finding.Found = want, key
+	if key == "" {
+		finding.Detail = "no private key found in file"
+	}
+	return finding
+}
+
+func checkCertificates(exp *Expected, file File, data []byte, certs []string, finding *Finding) *Finding {
+	want := strings.ToLower(exp.Fingerprint)
+	found := ""
+	if len(certs) > 0 {
+		found = certs[0]
+	}
+
+	// Without a record of the file's layout only a leaf can be judged
+	if len(file.Certificates) == 0 {
+		if found == "" || found == want || !startsWithLeaf(data) {
+			return nil
+		}
+		finding.Kind = KIND_REPLACED
+		finding.Expected, finding.Found = want, found
+		return finding
+	}
+
+	if equal(certs, file.Certificates) {
+		return nil
+	}
+	if file.Certificates[0] == want && found != want {
+		finding.Kind = KIND_REPLACED
+		finding.Expected, finding.Found = want, found
+		if found == "" {
+			finding.Detail = "no certificate found in file"
+		}
+		return finding
+	}
+	finding.Kind = KIND_CHAIN_MODIFIED
+	finding.Detail = fmt.Sprintf("%d certificates, %d expected", len(certs), len(file.Certificates))
+	return finding
+}
+
+// startsWithLeaf reports whether the first certificate in data is an
+// end-entity certificate rather than part of a chain file
+func startsWithLeaf(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			return err == nil && !cert.IsCA
+		}
+	}
+}
+
+// inspect returns the fingerprints of the PEM certificates in data and the
+// public key fingerprint of the first private key
+func inspect(data []byte) ([]string, string) {
+	var certs []string
+	key := ""
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, key
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			sum := sha256.Sum256(block.Bytes)
+			certs = append(certs, hex.EncodeToString(sum[:]))
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == "":
+			if public := publicKey(block); public != nil {
+				if der, err := x509.MarshalPKIXPublicKey(public); err == nil {
+					key = keyFingerprint(der)
+				}
+			}
+		}
+	}
+}
+
+func publicKey(block *pem.Block) crypto.PublicKey {
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return nil
+}
+
+func keyFingerprint(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return hex.EncodeToString(sum[:])
+}
+
+func readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, MAX_FILE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_FILE_SIZE {
+		return nil, fmt.Errorf("file larger than %d bytes", MAX_FILE_SIZE)
+	}
+	return data, nil
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+// Package events delivers local agent events (failed renewals, expiring
+// certificates, rolled back deployments) straight to operator channels,
+// independently of the CertFix API and its notification pipeline.
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_RENEWAL_FAILED      = "renewal.failed"
+	EVENT_CERT_EXPIRING       = "cert.expiring"
+	EVENT_DEPLOY_FAILED       = "deploy.failed"
+	EVENT_DEPLOY_ROLLED_BACK  = "deploy.rolled_back"
+	EVENT_DRIFT_DETECTED      = "cert.drift"
+	EVENT_RENEWAL_FALLBACK    = "renewal.fallback"
+	EVENT_ROTATION_INCOMPLETE = "rotation.incomplete"
+	EVENT_REREGISTERED        = "instance.reregistered"
+	EVENT_MAINTENANCE_STARTED = "maintenance.started"
+	EVENT_MAINTENANCE_ENDED   = "maintenance.ended"
+	EVENT_API_ACTION_REQUIRED = "api.action_required"
+	EVENT_API_DEPRECATED      = "api.deprecated"
+	EVENT_CERT_REVOKED        = "cert.revoked"
+
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+
+	DEFAULT_QUEUE_SIZE = 100
+	MAX_QUEUE_SIZE     = 10000
+	DELIVERY_TIMEOUT   = 10 * time.Second
+	DELIVERY_RETRIES   = 3
+	RETRY_DELAY        = 2 * time.Second
+
+	// What happens to an event arriving at a notifier's full queue: the
+	// oldest queued event makes room for it, or only a sample of arrivals
+	// gets in that way while the queue stays full
+	OVERFLOW_DROP_OLDEST = "drop_oldest"
+	OVERFLOW_SAMPLE      = "sample"
+	// Under OVERFLOW_SAMPLE, one in this many arrivals gets in; critical
+	// events always do
+	SAMPLE_EVERY = 10
+)
+
+// Event is one notable thing that happened on this host
+type Event struct {
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	Host     string            `json:"host"`
+	Severity string            `json:"severity"`
+	Summary  string            `json:"summary"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Notifier delivers events to one channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event Event) error
+}
+
+type sink struct {
+	notifier Notifier
+	// Event types to deliver; empty means all
+	types map[string]bool
+	queue *queue
+}
+
+// SinkStats counts what became of the events published to one notifier
+type SinkStats struct {
+	Notifier  string `json:"notifier"`
+	Queued    int    `json:"queued"`
+	Delivered int64  `json:"delivered"`
+	Failed    int64  `json:"failed"`
+	Dropped   int64  `json:"dropped"`
+}
+
+// Dispatcher fans events out to notifiers. Each notifier has its own
+// bounded queue and goroutine, so publishers never block and a channel
+// that is slow or down only holds up, and eventually loses, its own events.
+type Dispatcher struct {
+	mu        sync.RWMutex
+	sinks     []*sink
+	queueSize int
+	overflow  string
+}
+
+// NewDispatcher creates a dispatcher with no notifiers
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{queueSize: DEFAULT_QUEUE_SIZE, overflow: OVERFLOW_DROP_OLDEST}
+}
+
+// Default is the process-wide dispatcher used by Publish
+var Default = NewDispatcher()
+
+// Publish sends an event through the default dispatcher
+func Publish(event Event) {
+	Default.Publish(event)
+}
+
+// SetQueue sets the size and overflow policy of the queues of notifiers
+// added from now on; zero and "" keep the defaults
+func (d *Dispatcher) SetQueue(size int, overflow string) error {
+	if size < 0 || size > MAX_QUEUE_SIZE {
+		return fmt.Errorf("invalid event queue size %d (max %d)", size, MAX_QUEUE_SIZE)
+	}
+	switch overflow {
+	case "":
+		overflow = OVERFLOW_DROP_OLDEST
+	case OVERFLOW_DROP_OLDEST, OVERFLOW_SAMPLE:
+	default:
+		return fmt.Errorf("unknown event queue overflow policy %q: use %s or %s", overflow, OVERFLOW_DROP_OLDEST, OVERFLOW_SAMPLE)
+	}
+	if size == 0 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queueSize, d.overflow = size, overflow
+	return nil
+}
+
+// AddNotifier subscribes a notifier to the given event types, or to all
+// events when types is empty
+func (d *Dispatcher) AddNotifier(notifier Notifier, types []string) {
+	filter := make(map[string]bool)
+	for _, t := range types {
+		filter[t] = true
+	}
+
+	d.mu.Lock()
+	s := &sink{notifier: notifier, types: filter, queue: newQueue(notifier.Name(), d.queueSize, d.overflow)}
+	d.sinks = append(d.sinks, s)
+	d.mu.Unlock()
+
+	go s.run()
+}
+
+// Publish queues an event for every notifier subscribed to its type
+func (d *Dispatcher) Publish(event Event) {
+	d.mu.RLock()
+	sinks := d.sinks
+	d.mu.RUnlock()
+	if len(sinks) == 0 {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Host == "" {
+		event.Host, _ = os.Hostname()
+	}
+	if event.Severity == "" {
+		event.Severity = SEVERITY_WARNING
+	}
+
+	for _, s := range sinks {
+		if len(s.types) > 0 && !s.types[event.Type] {
+			continue
+		}
+		s.queue.push(event)
+	}
+}
+
+// Stats reports on each notifier's queue, in the order they were added
+func (d *Dispatcher) Stats() []SinkStats {
+	d.mu.RLock()
+	sinks := d.sinks
+	d.mu.RUnlock()
+	stats := make([]SinkStats, len(sinks))
+	for i, s := range sinks {
+		stats[i] = s.queue.snapshot()
+	}
+	return stats
+}
+
+func (s *sink) run() {
+	for {
+		event := s.queue.next()
+		err := deliver(s.notifier, event)
+		s.queue.delivered(err == nil)
+	}
+}
+
+func deliver(notifier Notifier, event Event) error {
+	var err error
+	for attempt := 0; attempt < DELIVERY_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(RETRY_DELAY << (attempt - 1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DELIVERY_TIMEOUT)
+		err = notifier.Notify(ctx, event)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	log.Printf("[WARNING] Failed to deliver %s event via %s: %v", event.Type, notifier.Name(), err)
+	return err
+}
+
+// queue is one notifier's backlog, bounded so an outage of the channel
+// can't grow the agent's memory
+type queue struct {
+	mu       sync.Mutex
+	events   []Event
+	size     int
+	overflow string
+	// Signalled when an event is added
+	ready chan struct{}
+	stats SinkStats
+	// Arrivals and drops since the queue last filled up
+	arrivals int
+	dropped  int64
+}
+
+func newQueue(name string, size int, overflow string) *queue {
+	return &queue{size: size, overflow: overflow, ready: make(chan struct{}, 1), stats: SinkStats{Notifier: name}}
+}
+
+func (q *queue) push(event Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) < q.size {
+		q.events = append(q.events, event)
+	} else {
+		q.arrivals++
+		if q.arrivals == 1 {
+			log.Printf("[WARNING] Event queue for %s is full; dropping events (%s) until it catches up", q.stats.Notifier, q.overflow)
+		}
+		q.stats.Dropped++
+		q.dropped++
+		sampled := q.overflow == OVERFLOW_SAMPLE && event.Severity != SEVERITY_CRITICAL && (q.arrivals-1)%SAMPLE_EVERY != 0
+		if sampled {
+			return
+		}
+		copy(q.events, q.events[1:])
+		q.events[len(q.events)-1] = event
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the oldest queued event and takes it off the queue
+func (q *queue) next() Event {
+	for {
+		q.mu.Lock()
+		if len(q.events) > 0 {
+			event := q.events[0]
+			q.events = append(q.events[:0], q.events[1:]...)
+			if len(q.events) == 0 && q.dropped > 0 {
+				log.Printf("[INFO] Event queue for %s caught up; %d events were dropped", q.stats.Notifier, q.dropped)
+				q.arrivals, q.dropped = 0, 0
+			}
+			q.mu.Unlock()
+			return event
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+func (q *queue) delivered(ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ok {
+		q.stats.Delivered++
+	} else {
+		q.stats.Failed++
+	}
+}
+
+func (q *queue) snapshot() SinkStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Queued = len(q.events)
+	return stats
+}
@@ -0,0 +1,162 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+// SMTPConfig describes a mail relay and the alert recipients
+type SMTPConfig struct {
+	// Server is host:port; port 465 implies implicit TLS, anything else
+	// upgrades with STARTTLS when the relay offers it
+	Server   string   `json:"server"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// RequireTLS refuses to send over a relay without STARTTLS
+	RequireTLS bool     `json:"require_tls,omitempty"`
+	Events     []string `json:"events,omitempty"`
+}
+
+// SMTP mails events through a relay
+type SMTP struct {
+	config SMTPConfig
+	host   string
+}
+
+// NewSMTP validates the config and creates the notifier
+func NewSMTP(config SMTPConfig) (*SMTP, error) {
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server %q: %w", config.Server, err)
+	}
+	if config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("SMTP alerts require from and to")
+	}
+	redact.AddSecret(config.Password)
+	return &SMTP{config: config, host: host}, nil
+}
+
+// Name identifies the relay in logs
+func (s *SMTP) Name() string {
+	return "smtp " + s.config.Server
+}
+
+// Notify sends one event as a plain text message
+func (s *SMTP) Notify(ctx context.Context, event Event) error {
+	dialer := &netdial.Dialer{Timeout: DELIVERY_TIMEOUT}
+	tlsConfig := &tls.Config{ServerName: s.host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	var err error
+	implicitTLS := strings.HasSuffix(s.config.Server, ":465")
+	if implicitTLS {
+		conn, err = dialer.DialTLS(ctx, "tcp", s.config.Server, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.config.Server)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", s.config.Server, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer client.Close()
+	if event.Host != "" {
+		if err := client.Hello(event.Host); err != nil {
+			return fmt.Errorf("EHLO rejected: %w", err)
+		}
+	}
+
+	if !implicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %w", err)
+			}
+		} else if s.config.RequireTLS {
+			return fmt.Errorf("%s does not offer STARTTLS", s.config.Server)
+		}
+	}
+
+	if s.config.Username != "" {
+		// PlainAuth itself refuses to send credentials without TLS
+		// except to localhost
+		if err := client.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, s.host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.config.From); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %w", err)
+	}
+	for _, to := range s.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("RCPT TO %s rejected: %w", to, err)
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %w", err)
+	}
+	if _, err := writer.Write(s.message(event)); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+	return client.Quit()
+}
+
+func (s *SMTP) message(event Event) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.config.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("[CertFix] %s on %s", event.Type, event.Host)))
+	fmt.Fprintf(&b, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), event.Host)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+
+	fmt.Fprintf(&b, "%s\r\n\r\n", event.Summary)
+	fmt.Fprintf(&b, "Event:    %s\r\nSeverity: %s\r\nHost:     %s\r\nTime:     %s\r\n",
+		event.Type, event.Severity, event.Host, event.Time.Format(time.RFC3339))
+
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		b.WriteString("\r\n")
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, event.Details[key])
+	}
+	return b.Bytes()
+}
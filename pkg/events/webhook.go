@@ -0,0 +1,133 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_SLACK = "slack"
+)
+
+// WebhookConfig describes one outbound webhook
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Format is "json" (the Event itself) or "slack" (incoming webhook
+	// payload, also understood by Mattermost and Rocket.Chat)
+	Format string `json:"format,omitempty"`
+	// Events limits delivery to these types; empty means all
+	Events  []string          `json:"events,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret signs JSON payloads in X-Certfix-Signature (sha256=<hex hmac>)
+	Secret string `json:"secret,omitempty"`
+}
+
+// Webhook posts events to a URL
+type Webhook struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+// NewWebhook validates the config and creates the notifier
+func NewWebhook(config WebhookConfig) (*Webhook, error) {
+	parsed, err := url.Parse(config.URL)
+	if err != nil || parsed.Scheme != "https" && parsed.Scheme != "http" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", config.URL)
+	}
+	if config.Format == "" {
+		config.Format = FORMAT_JSON
+	}
+	if config.Format != FORMAT_JSON && config.Format != FORMAT_SLACK {
+		return nil, fmt.Errorf("unknown webhook format %q", config.Format)
+	}
+
+	// Incoming webhook URLs embed their credential in the path
+	if config.Format == FORMAT_SLACK {
+		redact.AddSecret(parsed.Path)
+	}
+	redact.AddSecret(config.Secret)
+
+	return &Webhook{config: config, client: httpclient.New(DELIVERY_TIMEOUT)}, nil
+}
+
+// Name identifies the webhook in logs without revealing its path
+func (w *Webhook) Name() string {
+	parsed, _ := url.Parse(w.config.URL)
+	return "webhook " + parsed.Host
+}
+
+// Notify posts one event
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	var payload interface{} = event
+	if w.config.Format == FORMAT_SLACK {
+		payload = map[string]string{"text": slackText(event)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Certfix-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// slackText renders an event as mrkdwn
+func slackText(event Event) string {
+	icon := ":information_source:"
+	switch event.Severity {
+	case SEVERITY_WARNING:
+		icon = ":warning:"
+	case SEVERITY_CRITICAL:
+		icon = ":rotating_light:"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s *%s* on `%s`\n%s", icon, event.Type, event.Host, event.Summary)
+
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n• %s: %s", key, event.Details[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,311 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_PUSH_FILE  = "file.push"
+	TASK_FETCH_FILE = "file.fetch"
+
+	// Certificate bundles and keys are small; anything larger is suspicious
+	MAX_FILE_SIZE = 1 << 20
+
+	// Modes for installed certificates and private keys
+	PUBLIC_FILE_MODE  os.FileMode = 0644
+	PRIVATE_FILE_MODE os.FileMode = 0600
+)
+
+// Modes the server may request for pushed files
+var allowedModes = map[os.FileMode]bool{
+	0600: true,
+	0640: true,
+	0644: true,
+}
+
+// PushRequest is the payload of a file.push task
+type PushRequest struct {
+	Path          string `json:"path"`
+	ContentBase64 string `json:"content_base64"`
+	SHA256        string `json:"sha256"`
+	Mode          string `json:"mode,omitempty"`
+	Overwrite     bool   `json:"overwrite"`
+}
+
+// FetchRequest is the payload of a file.fetch task
+type FetchRequest struct {
+	Path string `json:"path"`
+}
+
+// FileInfo is returned for both pushed and fetched files
+type FileInfo struct {
+	Path          string    `json:"path"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Mode          string    `json:"mode"`
+	ModTime       time.Time `json:"mod_time"`
+	ContentBase64 string    `json:"content_base64,omitempty"`
+	BackupPath    string    `json:"backup_path,omitempty"`
+}
+
+// Service executes file transfer tasks confined to a set of directories
+type Service struct {
+	roots []string
+	audit *audit.Logger
+}
+
+// NewService creates a service allowing transfers beneath roots only
+func NewService(roots []string, auditLog *audit.Logger) *Service {
+	return &Service{roots: ResolveRoots(roots), audit: auditLog}
+}
+
+// Register installs the file transfer task handlers
+func (s *Service) Register(registry *tasks.Registry) {
+	registry.Register(TASK_PUSH_FILE, s.handlePush)
+	registry.Register(TASK_FETCH_FILE, s.handleFetch)
+}
+
+func (s *Service) handlePush(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req PushRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	info, err := s.push(req)
+	s.record(task, "file.push", req.Path, info, err)
+	return info, err
+}
+
+func (s *Service) handleFetch(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req FetchRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	info, err := s.fetch(req)
+	s.record(task, "file.fetch", req.Path, info, err)
+	return info, err
+}
+
+func (s *Service) push(req PushRequest) (*FileInfo, error) {
+	content, err := base64.StdEncoding.DecodeString(req.ContentBase64)
+	if err != nil {
+		return nil, tasks.Rejectf("content is not valid base64")
+	}
+	if len(content) > MAX_FILE_SIZE {
+		return nil, tasks.Rejectf("content is %d bytes, limit is %d", len(content), MAX_FILE_SIZE)
+	}
+
+	sum := sha256.Sum256(content)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), req.SHA256) {
+		return nil, tasks.Rejectf("checksum mismatch")
+	}
+
+	mode := os.FileMode(0644)
+	if req.Mode != "" {
+		parsed, err := strconv.ParseUint(req.Mode, 8, 32)
+		if err != nil || !allowedModes[os.FileMode(parsed)] {
+			return nil, tasks.Rejectf("mode %q is not allowed", req.Mode)
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	path, err := s.resolve(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var backup string
+	if _, err := os.Lstat(path); err == nil {
+		if !req.Overwrite {
+			return nil, tasks.Rejectf("%s exists and overwrite was not requested", path)
+		}
+		backup = fmt.Sprintf("%s.certfix-%s.bak", path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := copyFile(path, backup); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+	}
+
+	if err := WriteFileAtomic(path, content, mode); err != nil {
+		return nil, err
+	}
+
+	info, err := describe(path, false)
+	if err != nil {
+		return nil, err
+	}
+	info.BackupPath = backup
+	return info, nil
+}
+
+func (s *Service) fetch(req FetchRequest) (*FileInfo, error) {
+	path, err := s.resolve(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	return describe(path, true)
+}
+
+// resolve confines path to the service's roots
+func (s *Service) resolve(path string) (string, error) {
+	return Confine(s.roots, path)
+}
+
+// Confine cleans path and ensures it (after resolving symlinks in its
+// parent directory) stays inside one of roots, which must already have
+// their own symlinks resolved
+func Confine(roots []string, path string) (string, error) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", tasks.Rejectf("path must be absolute")
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return "", tasks.Rejectf("directory of %s does not exist", path)
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+
+	// The file itself must not be a symlink pointing elsewhere
+	if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", tasks.Rejectf("%s is a symlink", path)
+	}
+
+	for _, root := range roots {
+		if resolved == root || strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", tasks.Rejectf("%s is outside the configured certificate directories", path)
+}
+
+// ResolveRoots resolves symlinks in roots, dropping any that don't exist
+func ResolveRoots(roots []string) []string {
+	var cleaned []string
+	for _, root := range roots {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			cleaned = append(cleaned, resolved)
+		}
+	}
+	return cleaned
+}
+
+func (s *Service) record(task *tasks.Task, action, target string, info *FileInfo, err error) {
+	entry := audit.Entry{
+		TaskID:  task.ID,
+		Action:  action,
+		Target:  target,
+		Outcome: tasks.STATUS_SUCCEEDED,
+	}
+	if info != nil {
+		entry.Details = map[string]string{
+			"sha256": info.SHA256,
+			"size":   strconv.FormatInt(info.Size, 10),
+		}
+		if info.BackupPath != "" {
+			entry.Details["backup"] = info.BackupPath
+		}
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", task.ID, err)
+	}
+}
+
+func describe(path string, withContent bool) (*FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, tasks.Rejectf("%s is not a regular file", path)
+	}
+	if stat.Size() > MAX_FILE_SIZE {
+		return nil, tasks.Rejectf("%s is %d bytes, limit is %d", path, stat.Size(), MAX_FILE_SIZE)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(file, MAX_FILE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+
+	info := &FileInfo{
+		Path:    path,
+		Size:    int64(len(content)),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Mode:    fmt.Sprintf("%04o", stat.Mode().Perm()),
+		ModTime: stat.ModTime().UTC(),
+	}
+	if withContent {
+		info.ContentBase64 = base64.StdEncoding.EncodeToString(content)
+	}
+	return info, nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory and
+// renames it over path, so readers never observe a partially written file
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, info.Mode().Perm())
+}
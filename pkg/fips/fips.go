@@ -0,0 +1,62 @@
+// Package fips reports whether the agent's cryptography runs in a FIPS
+// 140 validated module. Which module is available depends on how the
+// binary was built:
+//
+//   - Go's native FIPS 140-3 module (Go 1.24+): build with GOFIPS140 set to
+//     a frozen module version such as v1.0.0, or run with GODEBUG=fips140=on.
+//     Only a frozen module is the one that went through validation.
+//   - BoringCrypto: build with GOEXPERIMENT=boringcrypto
+//
+// Builds with neither always report FIPS mode as unavailable.
+package fips
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotEnabled = errors.New("FIPS mode is not enabled")
+
+// Status describes the FIPS state of the running binary
+type Status struct {
+	Enabled bool   `json:"enabled"`
+	Module  string `json:"module"`
+	// Module version, for modules that have one
+	Version string `json:"version,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Current returns the FIPS status of the running binary
+func Current() Status {
+	return current()
+}
+
+// Enabled reports whether a FIPS module is active
+func Enabled() bool {
+	return current().Enabled
+}
+
+// Assert fails unless a FIPS module is active; called at startup when the
+// configuration demands FIPS mode
+func Assert() error {
+	status := current()
+	if !status.Enabled {
+		return fmt.Errorf("%w: %s", ErrNotEnabled, status.Detail)
+	}
+	return nil
+}
+
+// String renders the status for version output
+func (s Status) String() string {
+	module := s.Module
+	if s.Version != "" {
+		module += " " + s.Version
+	}
+	if s.Enabled {
+		if s.Detail != "" {
+			return "enabled (" + module + "; " + s.Detail + ")"
+		}
+		return "enabled (" + module + ")"
+	}
+	return "disabled (" + s.Detail + ")"
+}
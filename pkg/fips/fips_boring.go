@@ -0,0 +1,12 @@
+//go:build boringcrypto
+
+package fips
+
+import "crypto/boring"
+
+func current() Status {
+	if boring.Enabled() {
+		return Status{Enabled: true, Module: "boringcrypto"}
+	}
+	return Status{Module: "boringcrypto", Detail: "BoringCrypto is linked but not active on this platform"}
+}
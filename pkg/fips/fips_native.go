@@ -0,0 +1,20 @@
+//go:build go1.24 && !boringcrypto
+
+package fips
+
+import "crypto/fips140"
+
+// Reported by builds against the in-tree module instead of a frozen one
+const UNFROZEN_VERSION = "latest"
+
+func current() Status {
+	version := moduleVersion()
+	if fips140.Enabled() {
+		status := Status{Enabled: true, Module: "go-fips140", Version: version}
+		if version == UNFROZEN_VERSION {
+			status.Detail = "not a validated module, rebuild with GOFIPS140=v1.0.0"
+		}
+		return status
+	}
+	return Status{Module: "go-fips140", Version: version, Detail: "rebuild with GOFIPS140=v1.0.0 or run with GODEBUG=fips140=on"}
+}
@@ -0,0 +1,7 @@
+//go:build !go1.24 && !boringcrypto
+
+package fips
+
+func current() Status {
+	return Status{Module: "none", Detail: "this build has no FIPS module; build with Go 1.24+ or GOEXPERIMENT=boringcrypto"}
+}
@@ -0,0 +1,9 @@
+//go:build go1.26 && !boringcrypto
+
+package fips
+
+import "crypto/fips140"
+
+func moduleVersion() string {
+	return fips140.Version()
+}
@@ -0,0 +1,24 @@
+//go:build go1.24 && !go1.26 && !boringcrypto
+
+package fips
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// fips140.Version is Go 1.26+; older toolchains record the GOFIPS140
+// setting, e.g. "v1.0.0-c2097c7c", in the build info
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return UNFROZEN_VERSION
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "GOFIPS140" && setting.Value != "off" && setting.Value != "" {
+			version, _, _ := strings.Cut(setting.Value, "-")
+			return version
+		}
+	}
+	return UNFROZEN_VERSION
+}
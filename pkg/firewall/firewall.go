@@ -0,0 +1,368 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/netinfo"
+)
+
+const (
+	COMMAND_TIMEOUT = 5 * time.Second
+	// Jumps between iptables chains are followed this deep
+	MAX_CHAIN_DEPTH = 8
+
+	CHALLENGE_HTTP_01     = "http-01"
+	CHALLENGE_TLS_ALPN_01 = "tls-alpn-01"
+	CHALLENGE_DNS_01      = "dns-01"
+)
+
+// Well-known service names used by firewalld and nftables rules
+var serviceNames = map[int]string{80: "http", 443: "https"}
+
+// Status is the result of checking whether one TCP port accepts inbound traffic
+type Status struct {
+	Backend string `json:"backend"`
+	Zone    string `json:"zone,omitempty"`
+	Port    int    `json:"port"`
+	Allowed bool   `json:"allowed"`
+	Detail  string `json:"detail,omitempty"`
+	Remedy  string `json:"remedy,omitempty"`
+}
+
+// BlockedError explains why a challenge port is unreachable
+type BlockedError struct {
+	Status Status
+}
+
+func (e *BlockedError) Error() string {
+	where := e.Status.Backend
+	if e.Status.Zone != "" {
+		where += " zone " + e.Status.Zone
+	}
+	msg := fmt.Sprintf("port %d blocked by %s", e.Status.Port, where)
+	if e.Status.Remedy != "" {
+		msg += " (fix: " + e.Status.Remedy + ")"
+	}
+	return msg
+}
+
+// PortInUseError reports a challenge port already bound by another process
+type PortInUseError struct {
+	Port int
+	Err  error
+}
+
+func (e *PortInUseError) Error() string {
+	return fmt.Sprintf("port %d is already in use by another process: %v", e.Port, e.Err)
+}
+
+// ChallengePort returns the inbound port a challenge type needs, or 0 for
+// challenge types (dns-01) that don't need inbound connectivity
+func ChallengePort(challenge string) int {
+	switch challenge {
+	case CHALLENGE_HTTP_01:
+		return 80
+	case CHALLENGE_TLS_ALPN_01:
+		return 443
+	}
+	return 0
+}
+
+// Preflight verifies, when the agent answers the challenge itself
+// (standalone), that the port is free, and then that the port a challenge
+// needs is reachable through the local firewall. It returns nil when it
+// cannot tell. A *PortInUseError is certain; a *BlockedError comes from
+// reading the firewall rules and may miss rules the check doesn't model.
+func Preflight(challenge string, standalone bool) error {
+	port := ChallengePort(challenge)
+	if port == 0 {
+		return nil
+	}
+
+	if standalone {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return &PortInUseError{Port: port, Err: err}
+		}
+		listener.Close()
+	}
+
+	if status := CheckPort(port); !status.Allowed {
+		return &BlockedError{Status: status}
+	}
+
+	return nil
+}
+
+// CheckPort detects the active firewall and evaluates whether inbound TCP
+// traffic to port is accepted. Backends are tried from most to least
+// specific since firewalld and ufw generate nftables/iptables rules.
+func CheckPort(port int) Status {
+	if output, err := run("firewall-cmd", "--state"); err == nil && strings.TrimSpace(output) == "running" {
+		return checkFirewalld(port)
+	}
+	if output, err := run("ufw", "status", "verbose"); err == nil && strings.Contains(output, "Status: active") {
+		return checkUFW(port, output)
+	}
+	if output, err := run("nft", "list", "ruleset"); err == nil && strings.Contains(output, "hook input") {
+		return checkNftables(port, output)
+	}
+	if output, err := run("iptables", "-S"); err == nil {
+		return checkIptables(port, output)
+	}
+
+	return Status{Backend: "none", Port: port, Allowed: true, Detail: "no active firewall detected"}
+}
+
+func checkFirewalld(port int) Status {
+	status := Status{Backend: "firewalld", Port: port}
+
+	// Challenges arrive on the interface holding the default route, which
+	// may be bound to a zone other than the default one
+	if iface := netinfo.DefaultRouteInterface(); iface != "" {
+		zone, _ := run("firewall-cmd", "--get-zone-of-interface="+iface)
+		status.Zone = strings.TrimSpace(zone)
+	}
+	if status.Zone == "" || strings.Contains(status.Zone, "no zone") {
+		zone, _ := run("firewall-cmd", "--get-default-zone")
+		status.Zone = strings.TrimSpace(zone)
+	}
+
+	service := serviceNames[port]
+	portSpec := fmt.Sprintf("%d/tcp", port)
+
+	if output, _ := run("firewall-cmd", "--zone="+status.Zone, "--query-port="+portSpec); strings.TrimSpace(output) == "yes" {
+		status.Allowed = true
+		return status
+	}
+	if service != "" {
+		if output, _ := run("firewall-cmd", "--zone="+status.Zone, "--query-service="+service); strings.TrimSpace(output) == "yes" {
+			status.Allowed = true
+			return status
+		}
+	}
+
+	// Zones with target ACCEPT allow everything not explicitly rejected
+	if output, _ := run("firewall-cmd", "--zone="+status.Zone, "--get-target", "--permanent"); strings.TrimSpace(output) == "ACCEPT" {
+		status.Allowed = true
+		return status
+	}
+
+	status.Detail = fmt.Sprintf("neither %s nor service %s is enabled", portSpec, service)
+	target := "--add-port=" + portSpec
+	if service != "" {
+		target = "--add-service=" + service
+	}
+	status.Remedy = fmt.Sprintf("firewall-cmd --zone=%s %s --permanent && firewall-cmd --reload", status.Zone, target)
+	return status
+}
+
+func checkUFW(port int, output string) Status {
+	status := Status{Backend: "ufw", Port: port}
+	portStr := strconv.Itoa(port)
+
+	// Application profiles commonly used for web servers
+	profiles := map[int][]string{
+		80:  {"Nginx HTTP", "Nginx Full", "Apache", "Apache Full", "WWW", "WWW Full"},
+		443: {"Nginx HTTPS", "Nginx Full", "Apache Secure", "Apache Full", "WWW Secure", "WWW Full"},
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, "ALLOW IN") && !strings.Contains(line, "ALLOW ") {
+			continue
+		}
+		rule := strings.TrimSpace(strings.SplitN(line, "ALLOW", 2)[0])
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, spec := range strings.Split(fields[0], ",") {
+			spec = strings.TrimSuffix(spec, "/tcp")
+			if spec == portStr || portInRange(spec, port) {
+				status.Allowed = true
+				return status
+			}
+		}
+		for _, profile := range profiles[port] {
+			if strings.HasPrefix(rule, profile) && (len(rule) == len(profile) || rule[len(profile)] == ' ') {
+				status.Allowed = true
+				return status
+			}
+		}
+	}
+
+	if strings.Contains(output, "allow (incoming)") {
+		status.Allowed = true
+		return status
+	}
+
+	status.Detail = "default incoming policy denies and no ALLOW rule matches"
+	status.Remedy = fmt.Sprintf("ufw allow %d/tcp", port)
+	return status
+}
+
+var (
+	nftPolicyDropRe = regexp.MustCompile(`hook input[^;]*;\s*policy (drop|reject)`)
+	nftDportRe      = regexp.MustCompile(`tcp dport (\{[^}]*\}|\S+)[^\n]*accept`)
+)
+
+func checkNftables(port int, output string) Status {
+	status := Status{Backend: "nftables", Port: port}
+
+	if !nftPolicyDropRe.MatchString(output) {
+		status.Allowed = true
+		status.Detail = "input chain policy accepts by default"
+		return status
+	}
+
+	portStr := strconv.Itoa(port)
+	for _, match := range nftDportRe.FindAllStringSubmatch(output, -1) {
+		for _, spec := range strings.FieldsFunc(strings.Trim(match[1], "{}"), func(r rune) bool { return r == ',' || r == ' ' }) {
+			if spec == portStr || spec == serviceNames[port] || portInRange(spec, port) {
+				status.Allowed = true
+				return status
+			}
+		}
+	}
+
+	status.Detail = "input chain drops by default and no accept rule matches"
+	status.Remedy = fmt.Sprintf("nft add rule inet filter input tcp dport %d accept", port)
+	return status
+}
+
+// checkIptables evaluates INPUT as iptables would, following jumps into
+// user-defined chains. Only rules matching the port on its own decide;
+// rules that depend on addresses or connection state are passed over.
+func checkIptables(port int, output string) Status {
+	status := Status{Backend: "iptables", Port: port}
+
+	policy := ""
+	chains := map[string][]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "-P" && fields[1] == "INPUT":
+			policy = fields[2]
+		case len(fields) == 2 && fields[0] == "-N":
+			chains[fields[1]] = nil
+		case len(fields) > 2 && fields[0] == "-A":
+			chains[fields[1]] = append(chains[fields[1]], strings.TrimSpace(line))
+		}
+	}
+
+	verdict, rule := evaluateChain(chains, "INPUT", port, 0)
+	switch verdict {
+	case "ACCEPT":
+		status.Allowed = true
+		return status
+	case "DROP":
+		status.Detail = "explicit DROP/REJECT rule: " + rule
+		status.Remedy = fmt.Sprintf("iptables -I INPUT -p tcp --dport %d -j ACCEPT", port)
+		return status
+	}
+
+	if policy != "DROP" && policy != "REJECT" {
+		status.Allowed = true
+		return status
+	}
+
+	status.Detail = "INPUT policy is DROP and no ACCEPT rule matches"
+	status.Remedy = fmt.Sprintf("iptables -I INPUT -p tcp --dport %d -j ACCEPT", port)
+	return status
+}
+
+// evaluateChain returns "ACCEPT" or "DROP" with the deciding rule, or ""
+// when traffic to port falls through the chain
+func evaluateChain(chains map[string][]string, chain string, port int, depth int) (string, string) {
+	if depth > MAX_CHAIN_DEPTH {
+		return "", ""
+	}
+	for _, line := range chains[chain] {
+		restricted := strings.Contains(line, "--dport ") || strings.Contains(line, "--dports ")
+		if restricted && !matchesPort(line, port) {
+			continue
+		}
+		target := ""
+		if i := strings.Index(line, " -j "); i >= 0 {
+			if fields := strings.Fields(line[i+len(" -j "):]); len(fields) > 0 {
+				target = fields[0]
+			}
+		}
+		// A jump is followed even without a port match, since the chain it
+		// leads to may hold the port rules (-A INPUT -j web)
+		if _, ok := chains[target]; ok {
+			if verdict, rule := evaluateChain(chains, target, port, depth+1); verdict != "" {
+				return verdict, rule
+			}
+			continue
+		}
+		if !restricted {
+			// Only an unconditional RETURN ends the chain
+			if target == "RETURN" && line == "-A "+chain+" -j RETURN" {
+				return "", ""
+			}
+			continue
+		}
+		// First matching rule wins, as in iptables itself
+		switch target {
+		case "ACCEPT":
+			return "ACCEPT", line
+		case "DROP", "REJECT":
+			return "DROP", line
+		case "RETURN":
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// matchesPort reports whether a TCP rule's --dport or --dports covers port
+func matchesPort(line string, port int) bool {
+	if !strings.Contains(line, "-p tcp") {
+		return false
+	}
+	portStr := strconv.Itoa(port)
+	if strings.Contains(line, "--dport "+portStr+" ") || strings.HasSuffix(line, "--dport "+portStr) {
+		return true
+	}
+	if i := strings.Index(line, "--dport "); i >= 0 {
+		if fields := strings.Fields(line[i+len("--dport "):]); len(fields) > 0 && portInRange(fields[0], port) {
+			return true
+		}
+	}
+	if i := strings.Index(line, "--dports "); i >= 0 {
+		for _, spec := range strings.Split(strings.Fields(line[i+len("--dports "):])[0], ",") {
+			if spec == portStr || portInRange(spec, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portInRange matches "1000-2000" and "1000:2000" style ranges
+func portInRange(spec string, port int) bool {
+	spec = strings.Replace(spec, ":", "-", 1)
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	low, err1 := strconv.Atoi(parts[0])
+	high, err2 := strconv.Atoi(parts[1])
+	return err1 == nil && err2 == nil && port >= low && port <= high
+}
+
+func run(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMMAND_TIMEOUT)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	return string(output), err
+}
@@ -0,0 +1,208 @@
+// Package fswatch reports changes under certificate directories as they
+// happen. Changes are batched until the directories have been quiet for a
+// moment, so a deployment writing several files, or an editor saving
+// through a temporary file, arrives as one batch.
+package fswatch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	DEFAULT_DEBOUNCE = 5 * time.Second
+
+	// inotify watches come out of a per-user kernel limit shared with every
+	// other program on the host
+	MAX_WATCHES = 8192
+)
+
+// Options controls what a Watcher watches
+type Options struct {
+	// Directories watched with everything below them
+	Roots []string
+	// Directories watched on their own, such as those deployments wrote to
+	Dirs []string
+	// Skip leaves out matching directories and files
+	Skip func(path string) bool
+	// Quiet time that ends a batch
+	Debounce time.Duration
+}
+
+// Watcher delivers batches of changed paths
+type Watcher struct {
+	fs      *fsnotify.Watcher
+	opts    Options
+	changes chan []string
+	done    chan struct{}
+	watched map[string]bool
+	// Directories below these are watched as they are created
+	recursive map[string]bool
+}
+
+// New starts watching; directories that don't exist yet are skipped
+func New(opts Options) (*Watcher, error) {
+	if opts.Debounce <= 0 {
+		opts.Debounce = DEFAULT_DEBOUNCE
+	}
+	if opts.Skip == nil {
+		opts.Skip = func(string) bool { return false }
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start file watcher: %w", err)
+	}
+	w := &Watcher{
+		fs:        fw,
+		opts:      opts,
+		changes:   make(chan []string),
+		done:      make(chan struct{}),
+		watched:   map[string]bool{},
+		recursive: map[string]bool{},
+	}
+	for _, root := range opts.Roots {
+		root = filepath.Clean(root)
+		w.recursive[root] = true
+		w.addTree(root, nil)
+	}
+	for _, dir := range opts.Dirs {
+		w.add(filepath.Clean(dir))
+	}
+	go w.run()
+	return w, nil
+}
+
+// Changes delivers each batch of paths that were created, written,
+// removed or renamed, sorted
+func (w *Watcher) Changes() <-chan []string {
+	return w.changes
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.fs.Close()
+}
+
+func (w *Watcher) add(dir string) bool {
+	if w.watched[dir] || w.opts.Skip(dir) {
+		return false
+	}
+	if len(w.watched) >= MAX_WATCHES {
+		log.Printf("[WARNING] Not watching %s: already watching %d directories", dir, MAX_WATCHES)
+		return false
+	}
+	if err := w.fs.Add(dir); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[WARNING] Failed to watch %s: %v", dir, err)
+		}
+		return false
+	}
+	w.watched[dir] = true
+	return true
+}
+
+// addTree watches dir and the directories below it; files already there
+// are added to found, for a directory that was created with its contents
+func (w *Watcher) addTree(dir string, found map[string]bool) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if found != nil && !w.opts.Skip(path) {
+				found[path] = true
+			}
+			return nil
+		}
+		if !w.add(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// underRoot reports whether dir is below a recursively watched root
+func (w *Watcher) underRoot(dir string) bool {
+	for root := range w.recursive {
+		rel, err := filepath.Rel(root, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) run() {
+	pending := map[string]bool{}
+	quiet := time.NewTimer(w.opts.Debounce)
+	quiet.Stop()
+	ready := false
+
+	for {
+		// The batch goes out once things are quiet and the reader is ready
+		var out chan []string
+		var batch []string
+		if ready && len(pending) > 0 {
+			out = w.changes
+			batch = make([]string, 0, len(pending))
+			for path := range pending {
+				batch = append(batch, path)
+			}
+			sort.Strings(batch)
+		}
+
+		select {
+		case <-w.done:
+			quiet.Stop()
+			return
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || w.opts.Skip(event.Name) {
+				continue
+			}
+			pending[event.Name] = true
+			if event.Has(fsnotify.Create) && w.underRoot(filepath.Dir(event.Name)) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					w.addTree(event.Name, pending)
+				}
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				// The kernel drops the watch of a directory that went away
+				delete(w.watched, event.Name)
+			}
+			ready = false
+			quiet.Reset(w.opts.Debounce)
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost: everything watched may have changed
+				log.Printf("[WARNING] File watcher missed events; treating every watched directory as changed")
+				for dir := range w.watched {
+					pending[dir] = true
+				}
+				ready = false
+				quiet.Reset(w.opts.Debounce)
+				continue
+			}
+			log.Printf("[WARNING] File watcher: %v", err)
+		case <-quiet.C:
+			ready = true
+		case out <- batch:
+			pending = map[string]bool{}
+			ready = false
+		}
+	}
+}
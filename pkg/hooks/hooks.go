@@ -0,0 +1,380 @@
+// Package hooks runs Starlark scripts around certificate deployments, for
+// conditions too involved for shell hooks ("only deploy if the SANs
+// include this host's name"). Scripts run inside the agent with no file,
+// network or process access; all they can reach are the builtins below.
+//
+// A script may define either or both of
+//
+//	def should_deploy(cert, deploy):
+//	    # True to allow, False or a reason string to refuse
+//
+//	def after_deploy(cert, deploy, result):
+//	    # runs once the target succeeded; fail() marks the task failed
+//
+// cert has name, common_name, dns_names, ip_addresses, issuer, serial,
+// fingerprint, not_before, not_after (unix seconds) and days_left; deploy
+// has target and options; result has files, reloaded and details.
+//
+// Builtins: hostname(), log(msg), struct(**kwargs), and in after_deploy
+// reload(service) and restart(service), subject to the service allowlist.
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	FUNC_SHOULD_DEPLOY = "should_deploy"
+	FUNC_AFTER_DEPLOY  = "after_deploy"
+
+	// Bounds on a single hook call; policy checks should be trivial
+	MAX_EXECUTION_STEPS = 1000000
+	CALL_TIMEOUT        = 10 * time.Second
+
+	SCRIPT_EXTENSION = ".star"
+
+	localEnv = "certfix.env"
+	localCtx = "certfix.ctx"
+)
+
+// Script is one loaded hook file
+type Script struct {
+	name    string
+	globals starlark.StringDict
+}
+
+// Hooks runs every loaded script around deployments. It implements
+// deploy.Hook.
+type Hooks struct {
+	scripts []*Script
+}
+
+// Load compiles the *.star files in dir, in name order. A missing
+// directory yields no hooks.
+func Load(dir string) (*Hooks, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return &Hooks{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), SCRIPT_EXTENSION) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	h := &Hooks{}
+	for _, name := range names {
+		script, err := loadScript(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		h.scripts = append(h.scripts, script)
+	}
+	return h, nil
+}
+
+// Broken stands in for hooks that failed to load: a policy that cannot be
+// evaluated refuses every deployment until the scripts are fixed
+func Broken(err error) deploy.Hook {
+	return brokenHook{err: err}
+}
+
+type brokenHook struct {
+	err error
+}
+
+func (b brokenHook) BeforeDeploy(context.Context, *deploy.DeployRequest, *deploy.Bundle) error {
+	return tasks.Rejectf("deploy hooks failed to load: %v", b.err)
+}
+
+func (b brokenHook) AfterDeploy(context.Context, *deploy.DeployRequest, *deploy.Bundle, *deploy.Result, *deploy.Env) error {
+	return nil
+}
+
+// Scripts lists the loaded file names
+func (h *Hooks) Scripts() []string {
+	var names []string
+	for _, script := range h.scripts {
+		names = append(names, script.name)
+	}
+	return names
+}
+
+func loadScript(path string) (*Script, error) {
+	name := filepath.Base(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// Hooks steer deployments; only the owner may change them
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("hook %s is writable by group or others", name)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook %s: %w", name, err)
+	}
+
+	thread := newThread(name)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, name, src, builtins())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hook %s: %w", name, describe(err))
+	}
+	for _, fn := range []string{FUNC_SHOULD_DEPLOY, FUNC_AFTER_DEPLOY} {
+		if value, ok := globals[fn]; ok {
+			if _, callable := value.(starlark.Callable); !callable {
+				return nil, fmt.Errorf("hook %s: %s is not a function", name, fn)
+			}
+		}
+	}
+	return &Script{name: name, globals: globals}, nil
+}
+
+// BeforeDeploy asks every script's should_deploy; any refusal wins
+func (h *Hooks) BeforeDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle) error {
+	for _, script := range h.scripts {
+		fn, ok := script.globals[FUNC_SHOULD_DEPLOY]
+		if !ok {
+			continue
+		}
+		value, err := script.call(ctx, nil, fn, certValue(bundle), deployValue(req))
+		if err != nil {
+			return err
+		}
+		switch v := value.(type) {
+		case starlark.Bool:
+			if !v {
+				return tasks.Rejectf("deployment refused by hook %s", script.name)
+			}
+		case starlark.String:
+			return tasks.Rejectf("deployment refused by hook %s: %s", script.name, string(v))
+		default:
+			return fmt.Errorf("hook %s: %s must return True, False or a reason, not %s", script.name, FUNC_SHOULD_DEPLOY, value.Type())
+		}
+	}
+	return nil
+}
+
+// AfterDeploy runs every script's after_deploy
+func (h *Hooks) AfterDeploy(ctx context.Context, req *deploy.DeployRequest, bundle *deploy.Bundle, result *deploy.Result, env *deploy.Env) error {
+	for _, script := range h.scripts {
+		fn, ok := script.globals[FUNC_AFTER_DEPLOY]
+		if !ok {
+			continue
+		}
+		if _, err := script.call(ctx, env, fn, certValue(bundle), deployValue(req), resultValue(result)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call runs fn on a fresh thread bounded in steps and time
+func (s *Script) call(ctx context.Context, env *deploy.Env, fn starlark.Value, args ...starlark.Value) (starlark.Value, error) {
+	thread := newThread(s.name)
+	thread.SetLocal(localCtx, ctx)
+	if env != nil {
+		thread.SetLocal(localEnv, env)
+	}
+
+	timer := time.AfterFunc(CALL_TIMEOUT, func() { thread.Cancel("timed out") })
+	defer timer.Stop()
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("cancelled") })
+	defer stop()
+
+	value, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		return nil, fmt.Errorf("hook %s: %w", s.name, describe(err))
+	}
+	return value, nil
+}
+
+func newThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("[INFO] Hook %s: %s", name, msg)
+		},
+		// load() would reach the filesystem
+		Load: func(*starlark.Thread, string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("load is not available in hooks")
+		},
+	}
+	thread.SetMaxExecutionSteps(MAX_EXECUTION_STEPS)
+	return thread
+}
+
+// describe includes the Starlark backtrace, which points at the line
+func describe(err error) error {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+func builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"struct":   starlark.NewBuiltin("struct", starlarkstruct.Make),
+		"hostname": starlark.NewBuiltin("hostname", builtinHostname),
+		"log":      starlark.NewBuiltin("log", builtinLog),
+		"reload":   starlark.NewBuiltin("reload", builtinService),
+		"restart":  starlark.NewBuiltin("restart", builtinService),
+	}
+}
+
+func builtinHostname(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(name), nil
+}
+
+func builtinLog(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &msg); err != nil {
+		return nil, err
+	}
+	thread.Print(thread, msg)
+	return starlark.None, nil
+}
+
+// builtinService backs reload() and restart(); the env enforces the
+// service allowlist
+func builtinService(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var service string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &service); err != nil {
+		return nil, err
+	}
+	env, ok := thread.Local(localEnv).(*deploy.Env)
+	if !ok {
+		return nil, fmt.Errorf("%s is only available in %s", b.Name(), FUNC_AFTER_DEPLOY)
+	}
+	ctx, _ := thread.Local(localCtx).(context.Context)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var err error
+	if b.Name() == "restart" {
+		err = env.Restart(ctx, service)
+	} else {
+		err = env.Reload(ctx, service)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func certValue(bundle *deploy.Bundle) starlark.Value {
+	leaf := bundle.Leaf()
+	var ips []string
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return starlarkstruct.FromStringDict(starlark.String("cert"), starlark.StringDict{
+		"name":         starlark.String(bundle.Name),
+		"common_name":  starlark.String(leaf.Subject.CommonName),
+		"dns_names":    stringList(leaf.DNSNames),
+		"ip_addresses": stringList(ips),
+		"issuer":       starlark.String(leaf.Issuer.String()),
+		"serial":       starlark.String(leaf.SerialNumber.Text(16)),
+		"fingerprint":  starlark.String(bundle.Fingerprint()),
+		"not_before":   starlark.MakeInt64(leaf.NotBefore.Unix()),
+		"not_after":    starlark.MakeInt64(leaf.NotAfter.Unix()),
+		"days_left":    starlark.MakeInt(int(time.Until(leaf.NotAfter).Hours() / 24)),
+	})
+}
+
+func deployValue(req *deploy.DeployRequest) starlark.Value {
+	var options interface{}
+	if len(req.Options) > 0 {
+		json.Unmarshal(req.Options, &options)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("deploy"), starlark.StringDict{
+		"target":  starlark.String(req.Target),
+		"options": toValue(options),
+	})
+}
+
+func resultValue(result *deploy.Result) starlark.Value {
+	details := starlark.NewDict(len(result.Details))
+	for key, value := range result.Details {
+		details.SetKey(starlark.String(key), starlark.String(value))
+	}
+	details.Freeze()
+	return starlarkstruct.FromStringDict(starlark.String("result"), starlark.StringDict{
+		"files":    stringList(result.Files),
+		"reloaded": stringList(result.Reloaded),
+		"details":  details,
+	})
+}
+
+func stringList(values []string) *starlark.List {
+	items := make([]starlark.Value, len(values))
+	for i, value := range values {
+		items[i] = starlark.String(value)
+	}
+	list := starlark.NewList(items)
+	list.Freeze()
+	return list
+}
+
+// toValue converts decoded JSON into frozen Starlark values
+func toValue(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case string:
+		return starlark.String(v)
+	case []interface{}:
+		items := make([]starlark.Value, len(v))
+		for i, item := range v {
+			items[i] = toValue(item)
+		}
+		list := starlark.NewList(items)
+		list.Freeze()
+		return list
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(v))
+		for key, item := range v {
+			dict.SetKey(starlark.String(key), toValue(item))
+		}
+		dict.Freeze()
+		return dict
+	}
+	return starlark.None
+}
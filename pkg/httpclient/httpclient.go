@@ -0,0 +1,130 @@
+// Package httpclient provides the HTTP transport shared by every API call so
+// connections and TLS sessions are reused instead of re-established per request.
+package httpclient
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/netdial"
+)
+
+const (
+	DIAL_TIMEOUT            = 10 * time.Second
+	TLS_HANDSHAKE_TIMEOUT   = 10 * time.Second
+	RESPONSE_HEADER_TIMEOUT = 60 * time.Second
+	IDLE_CONN_TIMEOUT       = 90 * time.Second
+	MAX_IDLE_CONNS_PER_HOST = 4
+)
+
+var (
+	dialer = &netdial.Dialer{
+		Timeout:   DIAL_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}
+	resolver = &cachingResolver{entries: make(map[string]cachedAddrs)}
+
+	transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           resolver.dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          16,
+		MaxIdleConnsPerHost:   MAX_IDLE_CONNS_PER_HOST,
+		IdleConnTimeout:       IDLE_CONN_TIMEOUT,
+		TLSHandshakeTimeout:   TLS_HANDSHAKE_TIMEOUT,
+		ResponseHeaderTimeout: RESPONSE_HEADER_TIMEOUT,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+)
+
+// Transport returns the shared transport
+func Transport() *http.Transport {
+	return transport
+}
+
+// New returns a client over the shared transport with an overall request
+// timeout. Clients are cheap; the pooled connections live in the transport.
+func New(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: RoundTripper(),
+	}
+}
+
+// SetDNSCache enables caching of resolved addresses for ttl; zero disables it
+func SetDNSCache(ttl time.Duration) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	resolver.ttl = ttl
+	resolver.entries = make(map[string]cachedAddrs)
+}
+
+type cachedAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+type cachingResolver struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedAddrs
+}
+
+// dialContext dials through the DNS cache and meters the connection
+// against the bandwidth caps
+func (r *cachingResolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := r.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return throttle(conn), nil
+}
+
+func (r *cachingResolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	r.mu.Lock()
+	ttl := r.ttl
+	r.mu.Unlock()
+
+	host, port, err := net.SplitHostPort(address)
+	if ttl <= 0 || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := r.lookup(ctx, host, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialAddrs(ctx, network, addrs, port)
+	if err == nil {
+		return conn, nil
+	}
+
+	// A stale entry may point at a host that moved; forget it
+	r.mu.Lock()
+	delete(r.entries, host)
+	r.mu.Unlock()
+	return nil, err
+}
+
+func (r *cachingResolver) lookup(ctx context.Context, host string, ttl time.Duration) ([]string, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.entries[host] = cachedAddrs{addrs: addrs, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
@@ -0,0 +1,107 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// SPKI pins use the HPKP notation: sha256/<base64 of SHA-256(SubjectPublicKeyInfo)>
+	SPKI_PIN_PREFIX = "sha256/"
+)
+
+type pinSet struct {
+	spki  [][]byte
+	certs [][]byte
+}
+
+// parsePins accepts SPKI pins ("sha256/...") and certificate fingerprints
+// (SHA-256 of the DER certificate in hex, colons optional)
+func parsePins(pins []string) (*pinSet, error) {
+	set := &pinSet{}
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		if strings.HasPrefix(pin, SPKI_PIN_PREFIX) {
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, SPKI_PIN_PREFIX))
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q", pin)
+			}
+			set.spki = append(set.spki, sum)
+			continue
+		}
+
+		sum, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q (expected sha256/<base64> or a SHA-256 fingerprint)", pin)
+		}
+		set.certs = append(set.certs, sum)
+	}
+	return set, nil
+}
+
+// matches reports whether any certificate in the verified chain is pinned.
+// Pinning an intermediate or the root survives leaf renewals.
+func (s *pinSet) matches(chain []*x509.Certificate) bool {
+	for _, cert := range chain {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range s.spki {
+			if bytes.Equal(spki[:], pin) {
+				return true
+			}
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+		for _, pin := range s.certs {
+			if bytes.Equal(fingerprint[:], pin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyPins runs after normal chain verification, so pinning narrows trust
+// and never replaces it
+func (s *pinSet) verifyPins(host string) func(tls.ConnectionState) error {
+	// No SNI is sent to IP addresses, so ServerName is empty for those
+	serverName := host
+	if net.ParseIP(host) != nil {
+		serverName = ""
+	}
+
+	return func(state tls.ConnectionState) error {
+		if !strings.EqualFold(state.ServerName, serverName) {
+			return nil
+		}
+
+		chains := state.VerifiedChains
+		if len(chains) == 0 {
+			// InsecureSkipVerify leaves no verified chain. Anyone can append a
+			// copy of a pinned CA to what they present, so only the leaf,
+			// whose key the handshake proved, may match.
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("%s presented no certificate", host)
+			}
+			chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+		}
+		for _, chain := range chains {
+			if s.matches(chain) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate presented by %s does not match any configured pin", host)
+	}
+}
+
+// SPKIPin computes the SPKI pin of a certificate in the notation accepted by
+// TLSPolicy.Pins
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return SPKI_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,138 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCert issues a certificate for cn, signed by parent or self-signed
+func newCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyPins(t *testing.T) {
+	root, rootKey := newCert(t, "Root", true, nil, nil)
+	intermediate, intermediateKey := newCert(t, "Intermediate", true, root, rootKey)
+	leaf, _ := newCert(t, "api.example.com", false, intermediate, intermediateKey)
+	other, _ := newCert(t, "Other", true, nil, nil)
+
+	verified := tls.ConnectionState{
+		ServerName:       "api.example.com",
+		PeerCertificates: []*x509.Certificate{leaf, intermediate},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, intermediate, root}},
+	}
+	// InsecureSkipVerify: the peer may append any CA it likes
+	unverified := tls.ConnectionState{
+		ServerName:       "api.example.com",
+		PeerCertificates: []*x509.Certificate{leaf, intermediate, root},
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		pin     string
+		state   tls.ConnectionState
+		wantErr bool
+	}{
+		{"verified leaf SPKI", "api.example.com", SPKIPin(leaf), verified, false},
+		{"verified intermediate SPKI", "api.example.com", SPKIPin(intermediate), verified, false},
+		{"verified root fingerprint", "api.example.com", fingerprint(root), verified, false},
+		{"verified unrelated pin", "api.example.com", SPKIPin(other), verified, true},
+		{"unverified leaf SPKI", "api.example.com", SPKIPin(leaf), unverified, false},
+		{"unverified leaf fingerprint", "api.example.com", fingerprint(leaf), unverified, false},
+		{"unverified intermediate", "api.example.com", SPKIPin(intermediate), unverified, true},
+		{"unverified root", "api.example.com", fingerprint(root), unverified, true},
+		{"unverified no certificate", "api.example.com", SPKIPin(leaf), tls.ConnectionState{ServerName: "api.example.com"}, true},
+		{"other host not checked", "proxy.example.com", SPKIPin(other), verified, false},
+		{"IP address without SNI", "192.0.2.10", SPKIPin(other), tls.ConnectionState{VerifiedChains: verified.VerifiedChains}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePins([]string{tt.pin})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = pins.verifyPins(tt.host)(tt.state)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyPins() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	leaf, _ := newCert(t, "api.example.com", false, nil, nil)
+	sum := fingerprint(leaf)
+
+	var colons []string
+	for i := 0; i < len(sum); i += 2 {
+		colons = append(colons, strings.ToUpper(sum[i:i+2]))
+	}
+
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"SPKI", SPKIPin(leaf), false},
+		{"fingerprint", sum, false},
+		{"fingerprint with colons", strings.Join(colons, ":"), false},
+		{"surrounding spaces", " " + sum + " ", false},
+		{"SPKI not base64", SPKI_PIN_PREFIX + "not base64!", true},
+		{"SPKI too short", SPKI_PIN_PREFIX + "AAAA", true},
+		{"fingerprint too short", sum[:32], true},
+		{"not hex", strings.Repeat("z", 64), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePins([]string{tt.pin})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePins() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !pins.matches([]*x509.Certificate{leaf}) {
+				t.Errorf("pin %q does not match the certificate it was made from", tt.pin)
+			}
+		})
+	}
+}
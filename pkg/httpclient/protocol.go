@@ -0,0 +1,234 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// HTTP versions the shared transport can be limited to or upgraded to
+const (
+	PROTOCOL_HTTP1 = "1.1"
+	PROTOCOL_HTTP2 = "2"
+	PROTOCOL_HTTP3 = "3"
+)
+
+const (
+	// An HTTP/2 connection that has been silent this long is pinged, and
+	// dropped when the ping goes unanswered, instead of hanging requests
+	// until the response header timeout on a lossy link
+	H2_READ_IDLE_TIMEOUT = 30 * time.Second
+	H2_PING_TIMEOUT      = 15 * time.Second
+
+	// Blocked UDP shows up as a handshake that never completes; give up
+	// quickly and use TCP
+	QUIC_HANDSHAKE_TIMEOUT = 5 * time.Second
+	QUIC_IDLE_TIMEOUT      = IDLE_CONN_TIMEOUT
+	QUIC_KEEP_ALIVE        = 15 * time.Second
+	// After HTTP/3 fails for a host it is not tried again for this long
+	H3_BACKOFF = 10 * time.Minute
+)
+
+var (
+	roundTripper http.RoundTripper = transport
+
+	// Requests to the host the agent authenticates to with a client
+	// certificate go through a transport of their own
+	authHost         string
+	authTransport    *http.Transport
+	authRoundTripper http.RoundTripper
+)
+
+func init() {
+	configureHTTP2(transport)
+}
+
+// Registering HTTP/2 explicitly, rather than through ForceAttemptHTTP2,
+// exposes the health check settings
+func configureHTTP2(t *http.Transport) {
+	h2Transport, err := http2.ConfigureTransports(t)
+	if err != nil {
+		log.Printf("[WARNING] HTTP/2 unavailable: %v", err)
+		return
+	}
+	h2Transport.ReadIdleTimeout = H2_READ_IDLE_TIMEOUT
+	h2Transport.PingTimeout = H2_PING_TIMEOUT
+}
+
+// cloneTransport copies the shared transport's settings with another TLS
+// config. HTTP/2 is registered afresh: the copied registration would hand
+// the clone's connections to the shared transport's pool.
+func cloneTransport(config *tls.Config) *http.Transport {
+	t := transport.Clone()
+	t.TLSNextProto = nil
+	t.TLSClientConfig = config
+	configureHTTP2(t)
+	return t
+}
+
+// RoundTripper returns what API clients should send requests through: the
+// shared transport, or HTTP/3 in front of it when enabled. With client
+// authentication, requests for its host are routed to their own transport.
+func RoundTripper() http.RoundTripper {
+	if authRoundTripper == nil {
+		return roundTripper
+	}
+	return hostRouter{}
+}
+
+// SetProtocol selects the HTTP version for API traffic. HTTP/2 with a
+// fallback to HTTP/1.1 is the default; "1.1" is for middleboxes that break
+// HTTP/2, and "3" tries HTTP/3 over QUIC first, falling back to TCP where
+// UDP is blocked or a proxy is in the way. It must be called after
+// ApplyTLSPolicy and before the first request.
+func SetProtocol(version string) error {
+	rt, err := withProtocol(transport, version)
+	if err != nil {
+		return err
+	}
+	roundTripper = rt
+	if authTransport != nil {
+		authRoundTripper, _ = withProtocol(authTransport, version)
+	}
+	return nil
+}
+
+func withProtocol(t *http.Transport, version string) (http.RoundTripper, error) {
+	switch version {
+	case "", PROTOCOL_HTTP2:
+		return t, nil
+	case PROTOCOL_HTTP1:
+		// A non-nil empty map keeps the transport from upgrading
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		t.ForceAttemptHTTP2 = false
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+		return t, nil
+	case PROTOCOL_HTTP3:
+		return newFallbackTransport(t), nil
+	}
+	return nil, fmt.Errorf("unknown HTTP version %q (use 1.1, 2 or 3)", version)
+}
+
+// hostRouter sends HTTPS requests for the client-authenticated host through
+// its transport, and everything else through the shared one
+type hostRouter struct{}
+
+func (hostRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && strings.EqualFold(req.URL.Hostname(), authHost) {
+		return authRoundTripper.RoundTrip(req)
+	}
+	return roundTripper.RoundTrip(req)
+}
+
+func (hostRouter) CloseIdleConnections() {
+	for _, rt := range []http.RoundTripper{roundTripper, authRoundTripper} {
+		if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+}
+
+// fallbackTransport sends requests over HTTP/3 and retries them over the
+// TCP transport when QUIC does not get through
+type fallbackTransport struct {
+	h3  *http3.Transport
+	tcp *http.Transport
+
+	mu sync.Mutex
+	// Hosts where HTTP/3 failed, and when
+	broken map[string]time.Time
+}
+
+func newFallbackTransport(tcp *http.Transport) *fallbackTransport {
+	tlsConfig := &tls.Config{}
+	if tcp.TLSClientConfig != nil {
+		tlsConfig = tcp.TLSClientConfig.Clone()
+	}
+	// QUIC only runs TLS 1.3; http3 sets its own ALPN
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = nil
+
+	return &fallbackTransport{
+		h3: &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: QUIC_HANDSHAKE_TIMEOUT,
+				MaxIdleTimeout:       QUIC_IDLE_TIMEOUT,
+				KeepAlivePeriod:      QUIC_KEEP_ALIVE,
+			},
+		},
+		tcp:    tcp,
+		broken: map[string]time.Time{},
+	}
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.useH3(req) {
+		return t.tcp.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	if req.Context().Err() != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if _, ok := t.broken[req.URL.Host]; !ok {
+		log.Printf("[WARNING] HTTP/3 to %s failed, using TCP for %v: %v", req.URL.Host, H3_BACKOFF, err)
+	}
+	t.broken[req.URL.Host] = time.Now()
+	t.mu.Unlock()
+
+	// The body may have been partly sent; only retry what can be replayed
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, errors.Join(err, bodyErr)
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.tcp.RoundTrip(req)
+}
+
+// useH3 rules out plain HTTP, proxied hosts and hosts in back-off. The
+// bandwidth caps meter TCP connections only, so they keep traffic on TCP.
+func (t *fallbackTransport) useH3(req *http.Request) bool {
+	if req.URL.Scheme != "https" || uploadLimit.limited() || downloadLimit.limited() {
+		return false
+	}
+	if proxy, err := t.tcp.Proxy(req); err != nil || proxy != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at, ok := t.broken[req.URL.Host]; ok {
+		if time.Since(at) < H3_BACKOFF {
+			return false
+		}
+		delete(t.broken, req.URL.Host)
+	}
+	return true
+}
+
+func (t *fallbackTransport) CloseIdleConnections() {
+	t.h3.CloseIdleConnections()
+	t.tcp.CloseIdleConnections()
+}
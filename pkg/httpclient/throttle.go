@@ -0,0 +1,107 @@
+package httpclient
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Reads and writes are metered in chunks this size, so a large upload is
+// spread out instead of sent in a burst and then paid for
+const THROTTLE_CHUNK = 16 * 1024
+
+var (
+	uploadLimit   = &limiter{}
+	downloadLimit = &limiter{}
+)
+
+// SetBandwidth caps what the agent sends and receives over the shared
+// transport, in bytes per second; zero removes a cap. The caps are shared
+// by every connection, so parallel requests split them.
+func SetBandwidth(upload, download int64) {
+	uploadLimit.setRate(upload)
+	downloadLimit.setRate(download)
+}
+
+// limiter is a token bucket holding at most one second of traffic
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) setRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bytesPerSecond)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *limiter) limited() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate > 0
+}
+
+// wait charges n bytes and sleeps while the bucket is in debt
+func (l *limiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	rate := l.rate
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / rate * float64(time.Second)))
+	}
+}
+
+// throttledConn meters a connection against the shared limits
+type throttledConn struct {
+	net.Conn
+}
+
+func throttle(conn net.Conn) net.Conn {
+	if !uploadLimit.limited() && !downloadLimit.limited() {
+		return conn
+	}
+	return &throttledConn{Conn: conn}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > THROTTLE_CHUNK {
+		p = p[:THROTTLE_CHUNK]
+	}
+	n, err := c.Conn.Read(p)
+	downloadLimit.wait(n)
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > THROTTLE_CHUNK {
+			chunk = chunk[:THROTTLE_CHUNK]
+		}
+		uploadLimit.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
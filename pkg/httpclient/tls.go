@@ -0,0 +1,159 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Oldest protocol version the agent negotiates unless configured otherwise
+const DEFAULT_MIN_TLS_VERSION = tls.VersionTLS12
+
+// TLSPolicy restricts how outbound connections negotiate TLS
+type TLSPolicy struct {
+	// MinVersion is "1.0" through "1.3"; empty keeps the default of 1.2
+	MinVersion string
+	// CipherSuites by IANA name (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256);
+	// only affects TLS 1.2 and below, TLS 1.3 suites are not configurable
+	CipherSuites []string
+	// InsecureSkipVerify disables certificate verification. Testing only.
+	InsecureSkipVerify bool
+	// Pins restrict which certificates PinnedHost may present: SPKI pins
+	// ("sha256/<base64>") or certificate SHA-256 fingerprints in hex
+	Pins       []string
+	PinnedHost string
+	// ClientAuth sets up mutual TLS with a single host
+	ClientAuth *ClientAuth
+}
+
+// ClientAuth authenticates the agent to Host with a client certificate.
+// Connections to Host get a transport of their own, so the certificate,
+// and any trust that replaces the system roots, never reach other servers.
+type ClientAuth struct {
+	Host                 string
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	// VerifyPeerCertificate, when set, replaces chain and hostname
+	// verification for Host (e.g. checking a SPIFFE ID)
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ApplyTLSPolicy configures the shared transport; it must be called before
+// the first request
+func ApplyTLSPolicy(policy TLSPolicy) error {
+	config := &tls.Config{MinVersion: DEFAULT_MIN_TLS_VERSION}
+
+	if policy.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(policy.MinVersion), "tls")]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", policy.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(policy.CipherSuites) > 0 {
+		suites, err := cipherSuiteIDs(policy.CipherSuites)
+		if err != nil {
+			return err
+		}
+		config.CipherSuites = suites
+	}
+
+	if policy.InsecureSkipVerify {
+		log.Println("[WARNING] TLS certificate verification is disabled; never use this in production")
+		config.InsecureSkipVerify = true
+	}
+
+	if len(policy.Pins) > 0 {
+		if policy.PinnedHost == "" {
+			return fmt.Errorf("certificate pins configured without a host to pin")
+		}
+		pins, err := parsePins(policy.Pins)
+		if err != nil {
+			return err
+		}
+		config.VerifyConnection = pins.verifyPins(policy.PinnedHost)
+	}
+
+	// Keep the ALPN protocols HTTP/2 registered
+	if transport.TLSClientConfig != nil {
+		config.NextProtos = transport.TLSClientConfig.NextProtos
+	}
+	transport.TLSClientConfig = config
+
+	authHost, authTransport = "", nil
+	if auth := policy.ClientAuth; auth != nil {
+		if auth.Host == "" {
+			return fmt.Errorf("client authentication configured without a host")
+		}
+		authConfig := config.Clone()
+		authConfig.GetClientCertificate = auth.GetClientCertificate
+		if auth.VerifyPeerCertificate != nil {
+			// Only disables the built-in checks; the callback still runs
+			authConfig.InsecureSkipVerify = true
+			authConfig.VerifyPeerCertificate = auth.VerifyPeerCertificate
+		}
+		authHost = auth.Host
+		authTransport = cloneTransport(authConfig)
+	}
+	// Until SetProtocol picks otherwise
+	roundTripper, authRoundTripper = transport, nil
+	if authTransport != nil {
+		authRoundTripper = authTransport
+	}
+	return nil
+}
+
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		suite, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if suite.Insecure {
+			log.Printf("[WARNING] Cipher suite %s is considered insecure", suite.Name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// DescribeConnection summarizes negotiated TLS parameters for diagnostics
+func DescribeConnection(state *tls.ConnectionState) string {
+	if state == nil {
+		return "plaintext (no TLS)"
+	}
+
+	parts := []string{
+		tls.VersionName(state.Version),
+		tls.CipherSuiteName(state.CipherSuite),
+	}
+	if state.NegotiatedProtocol != "" {
+		parts = append(parts, "ALPN "+state.NegotiatedProtocol)
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		parts = append(parts, fmt.Sprintf("server cert %q issued by %q", leaf.Subject.CommonName, leaf.Issuer.CommonName))
+	}
+	if state.DidResume {
+		parts = append(parts, "resumed")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,85 @@
+// Package idn converts internationalized domain names between the Unicode
+// form people write (U-labels, bücher.example) and the ASCII form used in
+// certificates, ACME and DNS (A-labels, xn--bcher-kva.example). Wildcard
+// prefixes and IP addresses pass through unchanged.
+package idn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const ACE_PREFIX = "xn--"
+
+// ToASCII returns the lowercase A-label form of name, as certificates and
+// CAs expect it
+func ToASCII(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if net.ParseIP(name) != nil {
+		return name, nil
+	}
+	prefix := ""
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		prefix, name = "*.", rest
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name %q: %w", prefix+name, err)
+	}
+	return prefix + strings.ToLower(ascii), nil
+}
+
+// ToUnicode returns the U-label form of name for display; names that
+// don't convert are returned as they are
+func ToUnicode(name string) string {
+	if !IsInternational(name) {
+		return name
+	}
+	prefix := ""
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		prefix, name = "*.", rest
+	}
+	unicode, err := idna.Display.ToUnicode(name)
+	if err != nil {
+		return prefix + name
+	}
+	return prefix + unicode
+}
+
+// IsInternational reports whether name has an A-label or non-ASCII
+// characters, i.e. whether its two forms differ
+func IsInternational(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if strings.HasPrefix(strings.ToLower(label), ACE_PREFIX) {
+			return true
+		}
+	}
+	for _, r := range name {
+		if r > 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal compares two names in either form, ignoring case
+func Equal(a, b string) bool {
+	asciiA, errA := ToASCII(a)
+	asciiB, errB := ToASCII(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return asciiA == asciiB
+}
+
+// Display shows an international name in both forms: "A-label (U-label)"
+func Display(name string) string {
+	ascii, err := ToASCII(name)
+	if err != nil || !IsInternational(ascii) {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", ascii, ToUnicode(ascii))
+}
@@ -0,0 +1,388 @@
+// Package intermediates keeps the intermediate CA certificates the agent
+// has seen or fetched, keyed by Subject Key Identifier, so chains can be
+// completed without going back to the network each time.
+package intermediates
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	// Least recently used intermediates are evicted beyond this many
+	MAX_ENTRIES = 500
+	// Chains longer than this are not real PKI
+	MAX_CHAIN_DEPTH = 8
+	// A failed AIA fetch is not retried for this long
+	FETCH_BACKOFF  = 1 * time.Hour
+	MAX_FETCH_SIZE = 1 << 20
+	FETCH_TIMEOUT  = 15 * time.Second
+)
+
+var (
+	ErrNotFound = errors.New("issuer not found")
+	errBackoff  = errors.New("fetch failed recently")
+)
+
+type entry struct {
+	DER      []byte    `json:"der"`
+	Source   string    `json:"source"`
+	AddedAt  time.Time `json:"added_at"`
+	LastUsed time.Time `json:"last_used"`
+
+	cert *x509.Certificate
+}
+
+// Cache maps Subject Key Identifiers to intermediate certificates. Without
+// a store it only lives in memory; without a client it never fetches.
+type Cache struct {
+	mu     sync.Mutex
+	blob   store.Blob
+	client *http.Client
+	// Roots a certificate must chain to before it is cached; nil means the
+	// system roots
+	roots   *x509.CertPool
+	entries map[string]*entry
+	// AIA URLs that failed recently, so a broken one isn't hammered
+	failed map[string]time.Time
+	hits   int64
+	misses int64
+}
+
+// Stats counts lookups answered from the cache and those that were not
+type Stats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// Default is the process-wide cache shared by chain building, deployment
+// bundling and verification
+var Default = NewCache()
+
+// NewCache returns an empty in-memory cache
+func NewCache() *Cache {
+	return &Cache{entries: map[string]*entry{}, failed: map[string]time.Time{}}
+}
+
+// Load persists the cache in blob, adding what it already holds
+func (c *Cache) Load(blob store.Blob) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blob = blob
+
+	data, err := blob.Load()
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load intermediate cache: %w", err)
+	}
+	var stored map[string]*entry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("invalid intermediate cache: %w", err)
+	}
+	var batch []*x509.Certificate
+	for _, e := range stored {
+		if cert, err := x509.ParseCertificate(e.DER); err == nil {
+			e.cert = cert
+			batch = append(batch, cert)
+		}
+	}
+	// Entries that no longer chain to a trusted root (expired, or learned
+	// before only trusted certificates were) are dropped
+	for ski, e := range stored {
+		if e.cert == nil || !c.trusted(e.cert, batch) {
+			continue
+		}
+		if _, ok := c.entries[ski]; !ok {
+			c.entries[ski] = e
+		}
+	}
+	return nil
+}
+
+// SetRoots trusts pool instead of the system roots when deciding which
+// certificates to cache, for CAs with private roots
+func (c *Cache) SetRoots(pool *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roots = pool
+}
+
+// SetClient enables fetching missing issuers from the Authority
+// Information Access URL; nil keeps the cache offline
+func (c *Cache) SetClient(client *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+}
+
+// Stats returns the cache size and lookup counts
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses}
+}
+
+// Learn adds the intermediates among certs that chain to a trusted root,
+// through the cache or the other certs; leaves, roots, certificates without
+// a Subject Key Identifier and anything unverifiable are skipped, since
+// endpoints may present whatever they like. source says where they were
+// seen, e.g. "deploy" or "served".
+func (c *Cache) Learn(source string, certs ...*x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := false
+	for _, cert := range certs {
+		if !isIntermediate(cert) {
+			continue
+		}
+		key := hex.EncodeToString(cert.SubjectKeyId)
+		// A cross-signed CA shares its key with another certificate; the one
+		// cached stays until it no longer verifies
+		if existing, ok := c.entries[key]; ok && (bytes.Equal(existing.DER, cert.Raw) || c.trusted(existing.cert, nil)) {
+			continue
+		}
+		if !c.trusted(cert, certs) {
+			continue
+		}
+		now := time.Now().UTC()
+		c.entries[key] = &entry{DER: cert.Raw, Source: source, AddedAt: now, LastUsed: now, cert: cert}
+		added = true
+	}
+	if added {
+		c.evict()
+		c.save()
+	}
+}
+
+// LearnPEM is Learn for a PEM bundle, e.g. a deployment's chain
+func (c *Cache) LearnPEM(source string, data []byte) {
+	c.Learn(source, ParsePEM(data)...)
+}
+
+// Issuer returns the certificate that issued cert: from the cache by
+// Authority Key Identifier, else from the AIA URL when fetching is enabled
+func (c *Cache) Issuer(ctx context.Context, cert *x509.Certificate) (*x509.Certificate, error) {
+	if issuer := c.lookup(cert); issuer != nil {
+		return issuer, nil
+	}
+
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil || len(cert.IssuingCertificateURL) == 0 {
+		return nil, ErrNotFound
+	}
+	for _, url := range cert.IssuingCertificateURL {
+		issuers, err := c.fetch(ctx, client, url)
+		if errors.Is(err, errBackoff) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[WARNING] Failed to fetch issuer of %s from %s: %v", cert.Subject, url, err)
+			continue
+		}
+		for _, issuer := range issuers {
+			if cert.CheckSignatureFrom(issuer) == nil {
+				c.Learn("aia", issuer)
+				return issuer, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Complete returns the intermediates needed to chain leaf up to a root,
+// starting from those given and filling gaps from the cache or AIA. The
+// result stops short of the root. An error means the chain is incomplete;
+// what was found is still returned.
+func (c *Cache) Complete(ctx context.Context, leaf *x509.Certificate, given []*x509.Certificate) ([]*x509.Certificate, error) {
+	c.Learn("chain", given...)
+
+	var chain []*x509.Certificate
+	current := leaf
+	for depth := 0; depth < MAX_CHAIN_DEPTH; depth++ {
+		if isSelfSigned(current) {
+			return chain, nil
+		}
+		issuer := findIssuer(current, given)
+		if issuer == nil {
+			var err error
+			if issuer, err = c.Issuer(ctx, current); err != nil {
+				return chain, fmt.Errorf("issuer of %s: %w", current.Subject, err)
+			}
+		}
+		if isSelfSigned(issuer) {
+			return chain, nil
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+	return chain, fmt.Errorf("chain of %s is longer than %d certificates", leaf.Subject, MAX_CHAIN_DEPTH)
+}
+
+// Pool returns the cached intermediates, to offer as
+// x509.VerifyOptions.Intermediates
+func (c *Cache) Pool() *x509.CertPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool := x509.NewCertPool()
+	for _, e := range c.entries {
+		pool.AddCert(e.cert)
+	}
+	return pool
+}
+
+// trusted reports whether cert chains to a trusted root through the cached
+// intermediates or those in batch; the caller holds c.mu
+func (c *Cache) trusted(cert *x509.Certificate, batch []*x509.Certificate) bool {
+	pool := x509.NewCertPool()
+	for _, e := range c.entries {
+		pool.AddCert(e.cert)
+	}
+	for _, other := range batch {
+		if other != cert {
+			pool.AddCert(other)
+		}
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+func (c *Cache) lookup(cert *x509.Certificate) *x509.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(cert.AuthorityKeyId) > 0 {
+		if e, ok := c.entries[hex.EncodeToString(cert.AuthorityKeyId)]; ok && cert.CheckSignatureFrom(e.cert) == nil {
+			e.LastUsed = time.Now().UTC()
+			c.hits++
+			return e.cert
+		}
+	}
+	c.misses++
+	return nil
+}
+
+func (c *Cache) fetch(ctx context.Context, client *http.Client, url string) ([]*x509.Certificate, error) {
+	c.mu.Lock()
+	if at, ok := c.failed[url]; ok && time.Since(at) < FETCH_BACKOFF {
+		c.mu.Unlock()
+		return nil, errBackoff
+	}
+	c.mu.Unlock()
+
+	certs, err := download(ctx, client, url)
+	if err != nil {
+		c.mu.Lock()
+		c.failed[url] = time.Now()
+		c.mu.Unlock()
+	}
+	return certs, err
+}
+
+func download(ctx context.Context, client *http.Client, url string) ([]*x509.Certificate, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported URL scheme")
+	}
+	ctx, cancel := context.WithTimeout(ctx, FETCH_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_FETCH_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return parseAIA(body)
+}
+
+// parseAIA accepts what CAs publish: DER, PEM or a PKCS#7 certs-only bundle
+func parseAIA(body []byte) ([]*x509.Certificate, error) {
+	if certs := ParsePEM(body); len(certs) > 0 {
+		return certs, nil
+	}
+	if cert, err := x509.ParseCertificate(body); err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+	return parsePKCS7(body)
+}
+
+// evict drops the least recently used entries beyond MAX_ENTRIES; the
+// caller holds c.mu
+func (c *Cache) evict() {
+	if len(c.entries) <= MAX_ENTRIES {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].LastUsed.Before(c.entries[keys[j]].LastUsed) })
+	for _, key := range keys[:len(keys)-MAX_ENTRIES] {
+		delete(c.entries, key)
+	}
+}
+
+// save writes the cache out; the caller holds c.mu
+func (c *Cache) save() {
+	if c.blob == nil {
+		return
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return
+	}
+	if err := c.blob.Save(data); err != nil {
+		log.Printf("[WARNING] Failed to save intermediate cache: %v", err)
+	}
+}
+
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if bytes.Equal(cert.RawIssuer, candidate.RawSubject) && cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func isIntermediate(cert *x509.Certificate) bool {
+	return cert != nil && cert.IsCA && len(cert.SubjectKeyId) > 0 && !isSelfSigned(cert)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return false
+	}
+	return len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId)
+}
@@ -0,0 +1,61 @@
+package intermediates
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+)
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// Only the fields up to the certificates matter for a certs-only bundle
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// parsePKCS7 extracts the certificates of a degenerate PKCS#7 SignedData,
+// the .p7c format some CAs publish their intermediates in
+func parsePKCS7(der []byte) ([]*x509.Certificate, error) {
+	var info contentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("not a certificate or PKCS#7 bundle: %w", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected PKCS#7 content type %v", info.ContentType)
+	}
+	var data signedData
+	if _, err := asn1.UnmarshalWithParams(info.Content.Bytes, &data, ""); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#7 SignedData: %w", err)
+	}
+	if len(data.Certificates.Bytes) == 0 {
+		return nil, fmt.Errorf("PKCS#7 bundle has no certificates")
+	}
+	return x509.ParseCertificates(data.Certificates.Bytes)
+}
+
+// ParsePEM returns the certificates in a PEM bundle, skipping bad blocks
+func ParsePEM(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/dane"
+	"github.com/certfix/certfix-agent/pkg/dnscheck"
+	"github.com/certfix/certfix-agent/pkg/pqc"
+	"github.com/certfix/certfix-agent/pkg/tlsobserve"
+	"github.com/certfix/certfix-agent/pkg/truststore"
+)
+
+// Sections of a report a delta can leave out, by their JSON names
+const (
+	SECTION_DNS_CHECKS      = "dns_checks"
+	SECTION_PQ_READINESS    = "pq_readiness"
+	SECTION_TLSA            = "tlsa_records"
+	SECTION_TLS_OBSERVATION = "tls_observation"
+	SECTION_MANAGED         = "managed_certificates"
+	SECTION_TRUST_STORES    = "trust_stores"
+)
+
+// Delta is how a report differs from an earlier one the server already
+// has: the certificates new or changed since, the keys of those gone, and
+// the other sections except those listed as unchanged
+type Delta struct {
+	// GeneratedAt of the report the delta applies to
+	Base        time.Time     `json:"base"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Changed     []Certificate `json:"changed,omitempty"`
+	Removed     []string      `json:"removed,omitempty"`
+	Unchanged   []string      `json:"unchanged,omitempty"`
+
+	DNSChecks      []dnscheck.Result    `json:"dns_checks,omitempty"`
+	PQReadiness    *pqc.Report          `json:"pq_readiness,omitempty"`
+	TLSA           []dane.Record        `json:"tlsa_records,omitempty"`
+	TLSObservation *tlsobserve.Report   `json:"tls_observation,omitempty"`
+	Managed        []ManagedCertificate `json:"managed_certificates,omitempty"`
+	TrustStores    []truststore.Store   `json:"trust_stores,omitempty"`
+	Errors         []string             `json:"errors,omitempty"`
+}
+
+// Key identifies a certificate across reports: where it was found and
+// which certificate it is
+func (c *Certificate) Key() string {
+	location := c.Path
+	if c.Endpoint != "" {
+		location = c.Endpoint
+	}
+	return location + "#" + c.FingerprintSHA256
+}
+
+// Diff returns what changed from base to r
+func (r *Report) Diff(base *Report) *Delta {
+	delta := &Delta{Base: base.GeneratedAt, GeneratedAt: r.GeneratedAt, Errors: r.Errors}
+
+	before := make(map[string][]byte, len(base.Certificates))
+	for i := range base.Certificates {
+		before[base.Certificates[i].Key()], _ = json.Marshal(&base.Certificates[i])
+	}
+	seen := make(map[string]bool, len(r.Certificates))
+	for i := range r.Certificates {
+		cert := &r.Certificates[i]
+		key := cert.Key()
+		seen[key] = true
+		if data, _ := json.Marshal(cert); !bytes.Equal(data, before[key]) {
+			delta.Changed = append(delta.Changed, *cert)
+		}
+	}
+	for i := range base.Certificates {
+		if key := base.Certificates[i].Key(); !seen[key] {
+			delta.Removed = append(delta.Removed, key)
+			seen[key] = true
+		}
+	}
+
+	section := func(name string, current, previous interface{}) bool {
+		a, _ := json.Marshal(current)
+		b, _ := json.Marshal(previous)
+		if bytes.Equal(a, b) {
+			delta.Unchanged = append(delta.Unchanged, name)
+			return false
+		}
+		return true
+	}
+	if section(SECTION_DNS_CHECKS, r.DNSChecks, base.DNSChecks) {
+		delta.DNSChecks = r.DNSChecks
+	}
+	if section(SECTION_PQ_READINESS, r.PQReadiness, base.PQReadiness) {
+		delta.PQReadiness = r.PQReadiness
+	}
+	if section(SECTION_TLSA, r.TLSA, base.TLSA) {
+		delta.TLSA = r.TLSA
+	}
+	if section(SECTION_TLS_OBSERVATION, r.TLSObservation, base.TLSObservation) {
+		delta.TLSObservation = r.TLSObservation
+	}
+	if section(SECTION_MANAGED, r.Managed, base.Managed) {
+		delta.Managed = r.Managed
+	}
+	if section(SECTION_TRUST_STORES, r.TrustStores, base.TrustStores) {
+		delta.TrustStores = r.TrustStores
+	}
+	return delta
+}
@@ -0,0 +1,359 @@
+package inventory
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/dane"
+	"github.com/certfix/certfix-agent/pkg/dnscheck"
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/pqc"
+	"github.com/certfix/certfix-agent/pkg/tlsobserve"
+	"github.com/certfix/certfix-agent/pkg/truststore"
+	"github.com/certfix/certfix-agent/pkg/webserver"
+)
+
+// Certificate describes one certificate file found on the host
+type Certificate struct {
+	Path               string                `json:"path"`
+	Subject            string                `json:"subject"`
+	Issuer             string                `json:"issuer"`
+	CommonName         string                `json:"common_name,omitempty"`
+	DNSNames           []string              `json:"dns_names,omitempty"`
+	DNSNamesUnicode    []string              `json:"dns_names_unicode,omitempty"`
+	IPAddresses        []string              `json:"ip_addresses,omitempty"`
+	SerialNumber       string                `json:"serial_number"`
+	NotBefore          time.Time             `json:"not_before"`
+	NotAfter           time.Time             `json:"not_after"`
+	FingerprintSHA256  string                `json:"fingerprint_sha256"`
+	KeyAlgorithm       string                `json:"key_algorithm"`
+	KeySize            int                   `json:"key_size,omitempty"`
+	SignatureAlgorithm string                `json:"signature_algorithm"`
+	IsCA               bool                  `json:"is_ca"`
+	ChainLength        int                   `json:"chain_length"`
+	Usages             []webserver.CertUsage `json:"usages,omitempty"`
+	Endpoint           string                `json:"endpoint,omitempty"`
+	Container          *ContainerSource      `json:"container,omitempty"`
+	// Staging certificates come from a test CA and are not publicly trusted
+	Staging bool `json:"staging,omitempty"`
+	// Managed names the agent-managed certificate this is, if any
+	Managed string `json:"managed,omitempty"`
+	// Labels of the managed certificate, to group certificates by
+	// application in the console
+	Labels map[string]string `json:"labels,omitempty"`
+	// Handshakes that presented this certificate, while the TLS observer
+	// runs; a count of zero is a file no client got
+	Handshakes *Handshakes `json:"handshakes,omitempty"`
+}
+
+// Handshakes is how often the TLS observer saw a certificate presented
+type Handshakes struct {
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// ManagedCertificate is a certificate the agent renews, listed whether or
+// not its files were found, so the server knows the labels of each
+type ManagedCertificate struct {
+	Name        string            `json:"name"`
+	Domains     []string          `json:"domains"`
+	Fingerprint string            `json:"fingerprint_sha256,omitempty"`
+	NotAfter    time.Time         `json:"not_after,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Destinations the current certificate is deployed to
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// ContainerSource identifies the container a certificate was found in
+type ContainerSource struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Image     string            `json:"image"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Port      int               `json:"port,omitempty"`
+	MountPath string            `json:"mount_path,omitempty"`
+}
+
+// Report is the inventory document uploaded to the API
+type Report struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	Certificates []Certificate     `json:"certificates"`
+	DNSChecks    []dnscheck.Result `json:"dns_checks,omitempty"`
+	PQReadiness  *pqc.Report       `json:"pq_readiness,omitempty"`
+	TLSA         []dane.Record     `json:"tlsa_records,omitempty"`
+	// TLSObservation also lists served certificates no file was found for
+	TLSObservation *tlsobserve.Report   `json:"tls_observation,omitempty"`
+	Managed        []ManagedCertificate `json:"managed_certificates,omitempty"`
+	// TrustStores lists the CAs the host trusts, when enabled
+	TrustStores []truststore.Store `json:"trust_stores,omitempty"`
+	Errors      []string           `json:"errors,omitempty"`
+}
+
+// Readiness lists each certificate's algorithms for the post-quantum
+// readiness report
+func (r *Report) Readiness() []pqc.Certificate {
+	certs := make([]pqc.Certificate, 0, len(r.Certificates))
+	for _, cert := range r.Certificates {
+		location := cert.Path
+		if cert.Endpoint != "" {
+			location = cert.Endpoint
+		}
+		certs = append(certs, pqc.Certificate{
+			Location:           location,
+			Fingerprint:        cert.FingerprintSHA256,
+			KeyAlgorithm:       cert.KeyAlgorithm,
+			KeySize:            cert.KeySize,
+			SignatureAlgorithm: cert.SignatureAlgorithm,
+		})
+	}
+	return certs
+}
+
+// Endpoints lists the TLS endpoints certificates were probed at, once each
+func (r *Report) Endpoints() []string {
+	seen := map[string]bool{}
+	var endpoints []string
+	for _, cert := range r.Certificates {
+		if cert.Endpoint != "" && !seen[cert.Endpoint] {
+			seen[cert.Endpoint] = true
+			endpoints = append(endpoints, cert.Endpoint)
+		}
+	}
+	return endpoints
+}
+
+// Observe attaches what the TLS observer saw, counting the handshakes of
+// every certificate found
+func (r *Report) Observe(observation *tlsobserve.Report) {
+	r.TLSObservation = observation
+	for i := range r.Certificates {
+		cert := &r.Certificates[i]
+		cert.Handshakes = &Handshakes{}
+		if usage, ok := observation.Find(cert.FingerprintSHA256); ok {
+			cert.Handshakes.Count = usage.Handshakes
+			cert.Handshakes.LastSeen = usage.LastSeen
+		}
+	}
+}
+
+// Tag lists a managed certificate and marks every certificate found with
+// one of its fingerprints (the current one, and the previous one while a
+// rotation overlaps) as that certificate, with its labels
+func (r *Report) Tag(managed ManagedCertificate, fingerprints ...string) {
+	r.Managed = append(r.Managed, managed)
+	for i := range r.Certificates {
+		cert := &r.Certificates[i]
+		if cert.FingerprintSHA256 != "" && slices.Contains(fingerprints, cert.FingerprintSHA256) {
+			cert.Managed = managed.Name
+			cert.Labels = managed.Labels
+		}
+	}
+}
+
+// Build creates an inventory report from the certificate files referenced
+// by web server configurations, attaching every vhost that uses each file
+func Build(usages []webserver.CertUsage) *Report {
+	report := &Report{
+		GeneratedAt:  time.Now().UTC(),
+		Certificates: []Certificate{},
+	}
+
+	byPath := make(map[string][]webserver.CertUsage)
+	var paths []string
+	for _, usage := range usages {
+		if _, seen := byPath[usage.CertFile]; !seen {
+			paths = append(paths, usage.CertFile)
+		}
+		byPath[usage.CertFile] = append(byPath[usage.CertFile], usage)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		cert, err := ParseCertificateFile(path)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		cert.Usages = byPath[path]
+		report.Certificates = append(report.Certificates, *cert)
+	}
+
+	return report
+}
+
+// Add appends certificates and errors gathered by other discovery sources
+func (r *Report) Add(certs []Certificate, errs []string) {
+	r.Certificates = append(r.Certificates, certs...)
+	r.Errors = append(r.Errors, errs...)
+}
+
+// Merge appends certificates found by a scan, skipping files and endpoints
+// already in the report (web server usages carry richer context)
+func (r *Report) Merge(certs []Certificate, errs []string) {
+	seen := make(map[string]bool)
+	for _, cert := range r.Certificates {
+		seen[cert.Path+"|"+cert.Endpoint] = true
+	}
+
+	for _, cert := range certs {
+		key := cert.Path + "|" + cert.Endpoint
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		r.Certificates = append(r.Certificates, cert)
+	}
+	r.Errors = append(r.Errors, errs...)
+}
+
+// ServedNames returns the DNS names of certificates that a vhost or a
+// listening endpoint serves, i.e. the names this host should answer for
+func (r *Report) ServedNames() []string {
+	var names []string
+	for _, cert := range r.Certificates {
+		if len(cert.Usages) == 0 && cert.Endpoint == "" {
+			continue
+		}
+		names = append(names, cert.DNSNames...)
+		if len(cert.DNSNames) == 0 && cert.CommonName != "" {
+			names = append(names, cert.CommonName)
+		}
+	}
+	return names
+}
+
+// ParseCertificateFile reads a PEM file and describes its leaf certificate.
+// Any further certificates in the file are counted as the chain.
+func ParseCertificateFile(path string) (*Certificate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+	return ParseCertificate(file, path)
+}
+
+// ParseCertificate is ParseCertificateFile for PEM data from any source;
+// path is recorded as the certificate's location
+func ParseCertificate(r io.Reader, path string) (*Certificate, error) {
+	// Stream the data: only the leaf is parsed, the rest of a bundle is counted
+	reader := NewPEMReader(r)
+	var leaf *x509.Certificate
+	count := 0
+	for {
+		der, err := reader.NextCertificate()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		count++
+		if leaf == nil {
+			leaf, err = x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate in %s: %w", path, err)
+			}
+		}
+	}
+
+	if leaf == nil {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	cert := Describe(leaf)
+	cert.Path = path
+	cert.ChainLength = count
+	return &cert, nil
+}
+
+// Describe extracts the inventory fields from a parsed certificate
+func Describe(cert *x509.Certificate) Certificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	keyAlgorithm, keySize := publicKeyInfo(cert)
+	// Go doesn't name post-quantum algorithms yet
+	signatureAlgorithm := cert.SignatureAlgorithm.String()
+	if cert.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		signatureAlgorithm = pqc.SignatureAlgorithm(cert.Raw)
+	}
+
+	return Certificate{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		CommonName:         cert.Subject.CommonName,
+		DNSNames:           cert.DNSNames,
+		DNSNamesUnicode:    unicodeNames(cert.DNSNames),
+		IPAddresses:        ips,
+		SerialNumber:       cert.SerialNumber.Text(16),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		FingerprintSHA256:  hex.EncodeToString(fingerprint[:]),
+		KeyAlgorithm:       keyAlgorithm,
+		KeySize:            keySize,
+		SignatureAlgorithm: signatureAlgorithm,
+		IsCA:               cert.IsCA,
+		Staging:            IsStagingIssuer(cert.Issuer.CommonName),
+	}
+}
+
+// Issuer name markers of the well-known test CAs
+var stagingIssuers = []string{"(STAGING)", "Fake LE", "Pebble"}
+
+// IsStagingIssuer reports whether an issuer common name belongs to a test
+// CA such as Let's Encrypt staging or Pebble
+func IsStagingIssuer(commonName string) bool {
+	for _, marker := range stagingIssuers {
+		if strings.Contains(commonName, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// DNSNamesUnicode mirrors DNSNames in U-label form, only when a name is
+// internationalized
+func unicodeNames(names []string) []string {
+	international := false
+	unicode := make([]string, len(names))
+	for i, name := range names {
+		unicode[i] = idn.ToUnicode(name)
+		international = international || unicode[i] != name
+	}
+	if !international {
+		return nil
+	}
+	return unicode
+}
+
+func publicKeyInfo(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	default:
+		if cert.PublicKeyAlgorithm == x509.UnknownPublicKeyAlgorithm {
+			return pqc.PublicKeyAlgorithm(cert.RawSubjectPublicKeyInfo), 0
+		}
+		return cert.PublicKeyAlgorithm.String(), 0
+	}
+}
@@ -0,0 +1,150 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Upper bound on a single certificate block; real certificates are a few KB
+	MAX_PEM_BLOCK_SIZE = 256 * 1024
+	pemBufferSize      = 64 * 1024
+)
+
+var (
+	pemBegin       = []byte("-----BEGIN ")
+	pemEnd         = []byte("-----END ")
+	pemDashes      = []byte("-----")
+	certBlockBegin = []byte("-----BEGIN CERTIFICATE-----")
+)
+
+// PEMReader walks PEM certificate blocks in a stream one at a time, so large
+// CA bundles never have to be held in memory as a whole. Other block types
+// (keys, CRLs, parameters) and text between blocks are skipped without
+// being buffered.
+type PEMReader struct {
+	r      *bufio.Reader
+	line   int
+	Errors []string
+}
+
+// NewPEMReader wraps r for block-by-block reading
+func NewPEMReader(r io.Reader) *PEMReader {
+	return &PEMReader{r: bufio.NewReaderSize(r, pemBufferSize)}
+}
+
+// NextCertificate returns the DER bytes of the next certificate block, or
+// io.EOF when the stream is exhausted. Malformed blocks are recorded in
+// Errors and skipped.
+func (p *PEMReader) NextCertificate() ([]byte, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, pemBegin) {
+			continue
+		}
+
+		start := p.line
+		if !bytes.Equal(line, certBlockBegin) {
+			if err := p.skipBlock(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		der, err := p.readBlock()
+		if err == io.EOF {
+			p.Errors = append(p.Errors, fmt.Sprintf("line %d: unterminated certificate block", start))
+			return nil, io.EOF
+		}
+		if err != nil {
+			p.Errors = append(p.Errors, fmt.Sprintf("line %d: %v", start, err))
+			continue
+		}
+		return der, nil
+	}
+}
+
+// readBlock accumulates base64 up to the END line and decodes it
+func (p *PEMReader) readBlock() ([]byte, error) {
+	var encoded []byte
+	oversized := false
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, pemEnd) {
+			break
+		}
+		if bytes.HasPrefix(line, pemBegin) {
+			return nil, errors.New("certificate block not terminated before next block")
+		}
+		// RFC 1421 headers are not used in certificate blocks; ignore them
+		if bytes.IndexByte(line, ':') >= 0 {
+			continue
+		}
+		if len(encoded)+len(line) > MAX_PEM_BLOCK_SIZE {
+			oversized = true
+			continue
+		}
+		encoded = append(encoded, line...)
+	}
+
+	if oversized {
+		return nil, fmt.Errorf("certificate block exceeds %d bytes", MAX_PEM_BLOCK_SIZE)
+	}
+
+	der := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(der, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 in certificate block: %w", err)
+	}
+	return der[:n], nil
+}
+
+// skipBlock discards lines up to and including the END line
+func (p *PEMReader) skipBlock() error {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, pemEnd) && bytes.HasSuffix(line, pemDashes) {
+			return nil
+		}
+	}
+}
+
+// readLine returns one line, truncating (not buffering) overlong lines
+func (p *PEMReader) readLine() ([]byte, error) {
+	line, isPrefix, err := p.r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	p.line++
+
+	if isPrefix {
+		// Copy the head before draining: ReadLine reuses its buffer
+		head := append([]byte(nil), line...)
+		for isPrefix {
+			_, isPrefix, err = p.r.ReadLine()
+			if err != nil {
+				break
+			}
+		}
+		return head, nil
+	}
+	return line, nil
+}
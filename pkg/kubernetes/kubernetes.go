@@ -0,0 +1,237 @@
+// Package kubernetes supports running the agent as a DaemonSet: it
+// identifies the node the pod runs on and finds the node's certificate
+// locations through a hostPath mount.
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// Where the DaemonSet mounts the node's root filesystem
+	DEFAULT_HOST_ROOT = "/host"
+
+	// Static pod manifests; their flags point at the control plane certificates
+	STATIC_POD_DIR = "/etc/kubernetes/manifests"
+
+	// Set from spec.nodeName through the downward API
+	NODE_NAME_ENV = "NODE_NAME"
+
+	API_TIMEOUT = 10 * time.Second
+)
+
+// Certificate locations on nodes across common distributions
+var NODE_CERT_PATHS = []string{
+	"/etc/kubernetes/pki",
+	"/etc/kubernetes/ssl",
+	"/var/lib/kubelet/pki",
+	"/var/lib/rancher/k3s/server/tls",
+	"/var/lib/rancher/k3s/agent",
+	"/var/lib/rancher/rke2/server/tls",
+	"/var/lib/rancher/rke2/agent",
+	"/etc/etcd/pki",
+}
+
+// Node is the subset of the Node object reported with the instance
+type Node struct {
+	Name           string            `json:"name"`
+	UID            string            `json:"uid"`
+	MachineID      string            `json:"machine_id,omitempty"`
+	SystemUUID     string            `json:"system_uuid,omitempty"`
+	KubeletVersion string            `json:"kubelet_version,omitempty"`
+	OSImage        string            `json:"os_image,omitempty"`
+	ProviderID     string            `json:"provider_id,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// InCluster reports whether the agent runs in a pod with a service account
+func InCluster() bool {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(SERVICE_ACCOUNT_DIR, "token"))
+	return err == nil
+}
+
+// NodeName returns the name of the node this pod is scheduled on
+func NodeName() string {
+	return os.Getenv(NODE_NAME_ENV)
+}
+
+// GetNode reads the node object using the pod's service account
+func GetNode(ctx context.Context, name string) (*Node, error) {
+	if name == "" {
+		return nil, fmt.Errorf("node name unknown: set %s from spec.nodeName", NODE_NAME_ENV)
+	}
+
+	client, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(filepath.Join(SERVICE_ACCOUNT_DIR, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+"/api/v1/nodes/"+name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("get node %s failed with status %d: %s", name, resp.StatusCode, string(body))
+	}
+
+	var obj struct {
+		Metadata struct {
+			Name   string            `json:"name"`
+			UID    string            `json:"uid"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			ProviderID string `json:"providerID"`
+		} `json:"spec"`
+		Status struct {
+			NodeInfo struct {
+				MachineID      string `json:"machineID"`
+				SystemUUID     string `json:"systemUUID"`
+				KubeletVersion string `json:"kubeletVersion"`
+				OSImage        string `json:"osImage"`
+			} `json:"nodeInfo"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("failed to parse node %s: %w", name, err)
+	}
+
+	return &Node{
+		Name:           obj.Metadata.Name,
+		UID:            obj.Metadata.UID,
+		MachineID:      obj.Status.NodeInfo.MachineID,
+		SystemUUID:     obj.Status.NodeInfo.SystemUUID,
+		KubeletVersion: obj.Status.NodeInfo.KubeletVersion,
+		OSImage:        obj.Status.NodeInfo.OSImage,
+		ProviderID:     obj.Spec.ProviderID,
+		Labels:         obj.Metadata.Labels,
+	}, nil
+}
+
+// InstanceID derives a stable machine ID for the node: the host's
+// /etc/machine-id as reported by the kubelet, or the node UID without it
+func (n *Node) InstanceID() string {
+	if n.MachineID != "" {
+		return n.MachineID
+	}
+	return n.UID
+}
+
+func inClusterClient() (*http.Client, error) {
+	ca, err := os.ReadFile(filepath.Join(SERVICE_ACCOUNT_DIR, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in cluster CA")
+	}
+
+	return &http.Client{
+		Timeout: API_TIMEOUT,
+		Transport: &http.Transport{
+			// The API server is reached directly, never through a proxy
+			Proxy:           nil,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		},
+	}, nil
+}
+
+// ScanRoots returns the node certificate locations that exist under
+// hostRoot, plus directories referenced by static pod manifests
+func ScanRoots(hostRoot string) []string {
+	seen := make(map[string]bool)
+	var roots []string
+	add := func(path string) {
+		full := filepath.Join(hostRoot, path)
+		if seen[full] {
+			return
+		}
+		if info, err := os.Stat(full); err == nil && info.IsDir() {
+			seen[full] = true
+			roots = append(roots, full)
+		}
+	}
+
+	for _, path := range NODE_CERT_PATHS {
+		add(path)
+	}
+	for _, file := range StaticPodCertFiles(filepath.Join(hostRoot, STATIC_POD_DIR)) {
+		add(filepath.Dir(file))
+	}
+
+	sort.Strings(roots)
+	return roots
+}
+
+// Flags such as --tls-cert-file=, --client-ca-file= or --etcd-certfile=
+var certFlagRe = regexp.MustCompile(`--[a-z0-9-]*(?:cert|ca|crt)[a-z0-9-]*(?:-file|file)?[=\s"']+(/[^\s"',\]]+\.(?:crt|pem|cert))`)
+
+// StaticPodCertFiles extracts certificate paths from the flags of static
+// pod manifests. Manifests are YAML, but the flags are plain strings, so a
+// line scan is enough.
+func StaticPodCertFiles(manifestDir string) []string {
+	entries, err := os.ReadDir(manifestDir)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(manifestDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			for _, match := range certFlagRe.FindAllStringSubmatch(scanner.Text(), -1) {
+				if !seen[match[1]] {
+					seen[match[1]] = true
+					files = append(files, match[1])
+				}
+			}
+		}
+		file.Close()
+	}
+
+	sort.Strings(files)
+	return files
+}
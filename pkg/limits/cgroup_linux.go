@@ -0,0 +1,144 @@
+package limits
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CGROUP_ROOT      = "/sys/fs/cgroup"
+	PROC_SELF_CGROUP = "/proc/self/cgroup"
+)
+
+// Values at or above this mean no memory limit (cgroup v1 reports "none"
+// as a page-aligned maximum)
+const unlimitedMemory = 1 << 62
+
+// Cgroup returns the CPU and memory limits of the cgroup the process runs
+// in, zero for none. Limits on parent groups count too, as the kernel
+// enforces them. Both cgroup v2 and v1 hierarchies are read.
+func Cgroup() (cpus float64, memory int64) {
+	f, err := os.Open(PROC_SELF_CGROUP)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		controllers, path := fields[1], fields[2]
+		if fields[0] == "0" && controllers == "" {
+			root := CGROUP_ROOT
+			if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+				// Hybrid layout: v2 beside the v1 controllers
+				root = filepath.Join(CGROUP_ROOT, "unified")
+			}
+			cpus = tighter(cpus, walk(root, path, v2CPUs))
+			memory = tighter(memory, walk(root, path, v2Memory))
+			continue
+		}
+		for _, controller := range strings.Split(controllers, ",") {
+			switch controller {
+			case "cpu":
+				root := v1Root(controllers, controller)
+				cpus = tighter(cpus, walk(root, path, v1CPUs))
+			case "memory":
+				root := v1Root(controllers, controller)
+				memory = tighter(memory, walk(root, path, v1Memory))
+			}
+		}
+	}
+	return cpus, memory
+}
+
+// v1Root finds a v1 hierarchy, mounted under the joined controller names
+// (cpu,cpuacct) or under the controller alone
+func v1Root(controllers, controller string) string {
+	root := filepath.Join(CGROUP_ROOT, controllers)
+	if _, err := os.Stat(root); err == nil {
+		return root
+	}
+	return filepath.Join(CGROUP_ROOT, controller)
+}
+
+// walk reads a limit from the process's group and each of its parents up
+// to root, returning the tightest. In a container without its own cgroup
+// namespace the path names the host's hierarchy and doesn't exist under
+// the container's mount, which then holds the container's own limits.
+func walk[T int64 | float64](root, path string, read func(dir string) T) T {
+	var limit T
+	dir := filepath.Join(root, path)
+	for {
+		limit = tighter(limit, read(dir))
+		if dir == root || !strings.HasPrefix(dir, root) {
+			return limit
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// cpu.max holds "$MAX $PERIOD", with "max" for no limit
+func v2CPUs(dir string) float64 {
+	fields := strings.Fields(readFile(filepath.Join(dir, "cpu.max")))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	return quotaCPUs(fields[0], fields[1])
+}
+
+func v2Memory(dir string) int64 {
+	return parseMemory(readFile(filepath.Join(dir, "memory.max")))
+}
+
+// A quota of -1 is no limit
+func v1CPUs(dir string) float64 {
+	return quotaCPUs(readFile(filepath.Join(dir, "cpu.cfs_quota_us")), readFile(filepath.Join(dir, "cpu.cfs_period_us")))
+}
+
+func v1Memory(dir string) int64 {
+	return parseMemory(readFile(filepath.Join(dir, "memory.limit_in_bytes")))
+}
+
+func quotaCPUs(quota, period string) float64 {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return float64(q) / float64(p)
+}
+
+func parseMemory(value string) int64 {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 || n >= unlimitedMemory {
+		return 0
+	}
+	return n
+}
+
+func readFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// tighter returns the smaller of two limits, zero being none
+func tighter[T int64 | float64](a, b T) T {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package limits
+
+// Cgroup returns no limits: cgroups are Linux only
+func Cgroup() (cpus float64, memory int64) {
+	return 0, 0
+}
@@ -0,0 +1,140 @@
+// Package limits keeps the agent's own CPU and memory use in check, so a
+// scan or a deployment never competes with the workload the agent is
+// there to protect. Limits come from the configuration and from the
+// cgroup the agent runs in, as in a container or a systemd unit with
+// CPUQuota= or MemoryMax=; the tighter of the two applies.
+package limits
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	SOURCE_CONFIG = "config"
+	SOURCE_CGROUP = "cgroup"
+
+	// The Go heap is kept to this share of a cgroup's memory limit, leaving
+	// room for stacks, the runtime and what the kernel counts besides
+	CGROUP_MEMORY_PERCENT = 90
+	// CPU use is measured over windows this long
+	CPU_WINDOW = time.Second
+	// Wait never pauses longer than this at once
+	MAX_PAUSE = 2 * time.Second
+)
+
+// Options are the configured limits; zero means no limit
+type Options struct {
+	// CPUs the agent may keep busy, e.g. 0.5 for half a core
+	CPUs float64
+	// Memory the agent aims to stay under
+	MemoryBytes int64
+}
+
+// Limits are the limits in effect and where each came from
+type Limits struct {
+	CPUs         float64
+	CPUSource    string
+	MemoryBytes  int64
+	MemorySource string
+}
+
+var (
+	mu        sync.Mutex
+	current   Limits
+	windowAt  time.Time
+	windowCPU time.Duration
+)
+
+// Apply sets the process's limits from opts and its cgroup: GOMAXPROCS
+// follows the CPU limit, the garbage collector's soft limit the memory
+// one, and Wait holds workers to the CPU share
+func Apply(opts Options) (Limits, error) {
+	if opts.CPUs < 0 || math.IsNaN(opts.CPUs) || math.IsInf(opts.CPUs, 0) {
+		return Limits{}, fmt.Errorf("invalid CPU limit %v", opts.CPUs)
+	}
+	if opts.MemoryBytes < 0 {
+		return Limits{}, fmt.Errorf("invalid memory limit %d", opts.MemoryBytes)
+	}
+
+	var l Limits
+	if opts.CPUs > 0 {
+		l.CPUs, l.CPUSource = opts.CPUs, SOURCE_CONFIG
+	}
+	if opts.MemoryBytes > 0 {
+		l.MemoryBytes, l.MemorySource = opts.MemoryBytes, SOURCE_CONFIG
+	}
+	cgroupCPUs, cgroupMemory := Cgroup()
+	if cgroupCPUs > 0 && (l.CPUs == 0 || cgroupCPUs < l.CPUs) {
+		l.CPUs, l.CPUSource = cgroupCPUs, SOURCE_CGROUP
+	}
+	if cgroupMemory > 0 {
+		if heap := cgroupMemory / 100 * CGROUP_MEMORY_PERCENT; l.MemoryBytes == 0 || heap < l.MemoryBytes {
+			l.MemoryBytes, l.MemorySource = heap, SOURCE_CGROUP
+		}
+	}
+
+	if l.CPUs > 0 {
+		runtime.GOMAXPROCS(min(runtime.NumCPU(), max(1, int(math.Ceil(l.CPUs)))))
+	}
+	if l.MemoryBytes > 0 {
+		debug.SetMemoryLimit(l.MemoryBytes)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = l
+	windowAt, windowCPU = time.Now(), processCPU()
+	return l, nil
+}
+
+// Current returns the limits set by Apply
+func Current() Limits {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// Wait pauses a worker while the process has used more than its CPU share
+// in the current window. Heavy work calls it between units, so only the
+// workers slow down: heartbeats and tasks go on, where the kernel
+// enforcing a cgroup quota would stall the whole process.
+func Wait(ctx context.Context) {
+	pause := overBudget()
+	if pause <= 0 {
+		return
+	}
+	timer := time.NewTimer(min(pause, MAX_PAUSE))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// overBudget returns how long the process must idle to be back within its
+// CPU share
+func overBudget() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	if current.CPUs <= 0 {
+		return 0
+	}
+	now, used := time.Now(), processCPU()
+	if used == 0 {
+		// Not measurable on this platform
+		return 0
+	}
+	elapsed := now.Sub(windowAt)
+	pause := time.Duration(float64(used-windowCPU)/current.CPUs) - elapsed
+	// A new window starts once the last one is paid for
+	if pause <= 0 && elapsed >= CPU_WINDOW {
+		windowAt, windowCPU = now, used
+	}
+	return pause
+}
@@ -0,0 +1,97 @@
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/platform"
+)
+
+var LOCK_FILE = filepath.Join(platform.RunDir(), "certfix-agent.lock")
+
+// ErrLocked is returned when another process already holds the lock
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock represents an exclusive lock on a file held by this process
+type Lock struct {
+	file *os.File
+}
+
+// LockedError describes the process currently holding the lock
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("%s is held by another process (pid %d)", e.Path, e.PID)
+	}
+	return fmt.Sprintf("%s is held by another process", e.Path)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// Acquire takes an exclusive, non-blocking lock on path and records the
+// current PID in it. The lock is released automatically by the kernel if
+// the process dies, so a stale file never blocks the next start.
+func Acquire(path string) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		pid := readPID(file)
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, &LockedError{Path: path, PID: pid}
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record our PID so a second instance can report who holds the lock
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		file.Sync()
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release drops the lock. The file itself is left in place: unlinking it
+// would let a waiting process lock the orphaned inode while a third creates
+// and locks a fresh file at the same path, and Windows cannot remove a file
+// that is still open anyway. Clearing the PID keeps it from going stale.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// readPID returns the PID recorded in the lock file, or 0 if unknown
+func readPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -7,15 +7,16 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
-)
 
-const (
-	MACHINE_ID_FILE = "/etc/certfix-agent/machine-id"
+	"github.com/certfix/certfix-agent/pkg/platform"
 )
 
+var MACHINE_ID_FILE = filepath.Join(platform.ConfigDir(), "machine-id")
+
 // GenerateMachineID creates a unique, stable identifier for this machine
 // It uses multiple hardware characteristics to ensure stability across reinstalls
 func GenerateMachineID() (string, error) {
@@ -57,7 +58,7 @@ func loadStoredMachineID() (string, error) {
 // storeMachineID saves the machine ID to disk
 func storeMachineID(id string) error {
 	// Ensure directory exists
-	dir := "/etc/certfix-agent"
+	dir := filepath.Dir(MACHINE_ID_FILE)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
@@ -163,6 +164,19 @@ func getSystemUUID() string {
 				}
 			}
 		}
+
+	case "windows":
+		// SMBIOS UUID via CIM; wmic is gone from recent releases
+		cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command",
+			"(Get-CimInstance -ClassName Win32_ComputerSystemProduct).UUID")
+		output, err := cmd.Output()
+		if err == nil {
+			uuid = strings.TrimSpace(string(output))
+			if uuid != "" && uuid != "FFFFFFFF-FFFF-FFFF-FFFF-FFFFFFFFFFFF" {
+				return uuid
+			}
+			uuid = ""
+		}
 	}
 
 	return uuid
@@ -231,6 +245,20 @@ func getOSMachineID() string {
 	case "darwin":
 		// macOS uses IOPlatformUUID (already in getSystemUUID)
 		return ""
+	case "windows":
+		// Set at install time, like /etc/machine-id
+		cmd := exec.Command("reg.exe", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`, "/v", "MachineGuid")
+		output, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "MachineGuid" {
+				return fields[2]
+			}
+		}
+		return ""
 	}
 
 	for _, path := range paths {
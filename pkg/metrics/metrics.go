@@ -0,0 +1,150 @@
+// Package metrics records how long the agent's operations take: issuance
+// by CA, deployment by target, deploy hooks, service reloads, scans and API
+// calls. Durations are kept as histograms for Prometheus and forwarded to
+// StatsD when configured, so a slow renewal can be traced to the CA, the
+// host or a hook.
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations
+const (
+	// Ordering a certificate from a CA; the target is the CA's host
+	OP_ISSUANCE = "issuance"
+	// Installing a bundle; the target is the deploy target
+	OP_DEPLOY = "deploy"
+	// Hooks around a deployment: pre_deploy, post_deploy and the agent's
+	// own after-deploy hooks
+	OP_DEPLOY_HOOK = "deploy_hook"
+	// Validating and reloading a service; the target is the service
+	OP_RELOAD = "reload"
+	// Walking the filesystem for certificates
+	OP_SCAN = "scan"
+	// A call to the CertFix API; the target is the call
+	OP_API = "api"
+)
+
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_FAILURE = "failure"
+)
+
+// Histogram bucket bounds in seconds, from a fast API call to a DNS-01
+// order waiting on propagation
+var BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Sink receives every observation as it is made
+type Sink interface {
+	Timing(op, target, outcome string, d time.Duration)
+}
+
+// Series is the histogram of one operation, target and outcome
+type Series struct {
+	Operation string
+	Target    string
+	Outcome   string
+	Count     uint64
+	// Total of the observed durations, in seconds
+	Sum float64
+	// Counts per bucket of BUCKETS, not cumulative; the last counts what
+	// is above every bound
+	Buckets []uint64
+}
+
+type seriesKey struct {
+	op, target, outcome string
+}
+
+// Registry keeps the histograms
+type Registry struct {
+	mu     sync.Mutex
+	series map[seriesKey]*Series
+	sinks  []Sink
+}
+
+// Default is the agent's registry
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{series: map[seriesKey]*Series{}}
+}
+
+// Observe records an operation that took d and failed when err is not nil
+func Observe(op, target string, d time.Duration, err error) {
+	Default.Observe(op, target, d, err)
+}
+
+// Since records an operation that started at start
+func Since(op, target string, start time.Time, err error) {
+	Default.Observe(op, target, time.Since(start), err)
+}
+
+// AddSink forwards observations to sink
+func (r *Registry) AddSink(sink Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks = append(r.sinks, sink)
+}
+
+// Observe records an operation that took d
+func (r *Registry) Observe(op, target string, d time.Duration, err error) {
+	outcome := OUTCOME_SUCCESS
+	if err != nil {
+		outcome = OUTCOME_FAILURE
+	}
+	seconds := d.Seconds()
+
+	r.mu.Lock()
+	key := seriesKey{op, target, outcome}
+	series := r.series[key]
+	if series == nil {
+		series = &Series{Operation: op, Target: target, Outcome: outcome, Buckets: make([]uint64, len(BUCKETS)+1)}
+		r.series[key] = series
+	}
+	series.Count++
+	series.Sum += seconds
+	series.Buckets[sort.SearchFloat64s(BUCKETS, seconds)]++
+	sinks := r.sinks
+	r.mu.Unlock()
+
+	for _, sink := range sinks {
+		sink.Timing(op, target, outcome, d)
+	}
+}
+
+// Snapshot copies the histograms, ordered by operation, target and outcome
+func (r *Registry) Snapshot() []Series {
+	r.mu.Lock()
+	list := make([]Series, 0, len(r.series))
+	for _, series := range r.series {
+		copied := *series
+		copied.Buckets = append([]uint64(nil), series.Buckets...)
+		list = append(list, copied)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Outcome < b.Outcome
+	})
+	return list
+}
+
+// Format renders a duration for event details and logs
+func Format(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	METRIC_NAME  = "certfix_operation_duration_seconds"
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// WritePrometheus writes the histograms in the Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# HELP %s How long the agent's operations take.\n", METRIC_NAME)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", METRIC_NAME)
+	for _, series := range r.Snapshot() {
+		labels := fmt.Sprintf(`operation="%s",target="%s",outcome="%s"`,
+			escapeLabel(series.Operation), escapeLabel(series.Target), escapeLabel(series.Outcome))
+		var cumulative uint64
+		for i, bound := range BUCKETS {
+			cumulative += series.Buckets[i]
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", METRIC_NAME, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", METRIC_NAME, labels, series.Count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", METRIC_NAME, labels, strconv.FormatFloat(series.Sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", METRIC_NAME, labels, series.Count)
+	}
+	return b.Flush()
+}
+
+// Handler serves the registry at /metrics
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		if err := r.WritePrometheus(w); err != nil {
+			log.Printf("[WARNING] Metrics: %v", err)
+		}
+	})
+	return mux
+}
+
+// Serve exposes the registry for Prometheus until the listener is closed
+func (r *Registry) Serve(listener net.Listener) error {
+	server := &http.Server{
+		Handler:           r.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("[INFO] Metrics at http://%s/metrics", listener.Addr())
+	return server.Serve(listener)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_STATSD_PREFIX = "certfix"
+
+// StatsD sends each observation as a timer over UDP, named
+// <prefix>.<operation>.<target>.<outcome>; losing a packet loses one
+// sample and never blocks the agent
+type StatsD struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsD sends to address (host:port); prefix defaults to "certfix"
+func NewStatsD(address, prefix string) (*StatsD, error) {
+	if prefix == "" {
+		prefix = DEFAULT_STATSD_PREFIX
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid StatsD address %q: %w", address, err)
+	}
+	return &StatsD{conn: conn, prefix: strings.TrimSuffix(prefix, ".")}, nil
+}
+
+func (s *StatsD) Timing(op, target, outcome string, d time.Duration) {
+	name := strings.Join([]string{s.prefix, op, statsdName(target), outcome}, ".")
+	line := fmt.Sprintf("%s:%d|ms", name, d.Milliseconds())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Write([]byte(line))
+}
+
+// statsdName keeps a target from adding path segments or breaking the
+// line format
+func statsdName(target string) string {
+	if target == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, target)
+}
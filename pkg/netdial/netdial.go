@@ -0,0 +1,229 @@
+// Package netdial makes the agent's outbound TCP connections. When a host
+// has both IPv4 and IPv6 addresses the attempts race Happy Eyeballs style
+// (RFC 8305): the preferred family goes first and the other follows a
+// moment later, so a broken path in one family costs a fraction of a
+// second instead of a connect timeout. On single-stack hosts the addresses
+// of the missing family simply fail fast.
+package netdial
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PREFER_AUTO = "auto"
+	PREFER_IPV4 = "ipv4"
+	PREFER_IPV6 = "ipv6"
+
+	// RFC 8305's recommended connection attempt delay
+	DEFAULT_ATTEMPT_DELAY = 250 * time.Millisecond
+	MIN_ATTEMPT_DELAY     = 10 * time.Millisecond
+)
+
+var (
+	mu           sync.Mutex
+	prefer       = PREFER_AUTO
+	attemptDelay = DEFAULT_ATTEMPT_DELAY
+)
+
+// SetPreference sets the address family tried first and the wait before
+// each next attempt; "auto" keeps the resolver's order, which follows the
+// system's address selection policy (RFC 6724)
+func SetPreference(family string, delay time.Duration) error {
+	switch family {
+	case "", PREFER_AUTO:
+		family = PREFER_AUTO
+	case PREFER_IPV4, PREFER_IPV6:
+	default:
+		return fmt.Errorf("invalid address family preference %q: use %s, %s or %s", family, PREFER_AUTO, PREFER_IPV4, PREFER_IPV6)
+	}
+	if delay <= 0 {
+		delay = DEFAULT_ATTEMPT_DELAY
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	prefer, attemptDelay = family, max(delay, MIN_ATTEMPT_DELAY)
+	return nil
+}
+
+// Preference returns the address family tried first
+func Preference() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return prefer
+}
+
+// Dialer connects like net.Dialer, racing the addresses of a host
+type Dialer struct {
+	// Limit for the whole connection, all attempts included
+	Timeout   time.Duration
+	KeepAlive time.Duration
+	// Looks up host names; the system's when nil
+	Resolver *net.Resolver
+}
+
+func (d *Dialer) netDialer() *net.Dialer {
+	return &net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive, Resolver: d.Resolver}
+}
+
+// DialContext connects to address. Networks other than "tcp", and
+// addresses that are already IPs, are dialed as net.Dialer would.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if network != "tcp" || err != nil || net.ParseIP(host) != nil {
+		return d.netDialer().DialContext(ctx, network, address)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return d.DialAddrs(ctx, network, addrs, port)
+}
+
+// DialAddrs races connections to the given IP addresses of one host
+func (d *Dialer) DialAddrs(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("no addresses to dial")}
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mu.Lock()
+	family, delay := prefer, attemptDelay
+	mu.Unlock()
+	addrs = interleave(addrs, family)
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	dialer := &net.Dialer{KeepAlive: d.KeepAlive}
+	next, pending := 0, 0
+	start := func() {
+		address := net.JoinHostPort(addrs[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, address)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// The losers are cancelled; any that connected anyway are closed
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			// A failed attempt doesn't wait for the delay
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// DialTLS connects and completes a TLS handshake, like tls.Dialer
+func (d *Dialer) DialTLS(ctx context.Context, network, address string, config *tls.Config) (*tls.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// interleave orders addresses alternating between families, starting with
+// the preferred one; "auto" starts with the family of the first address
+func interleave(addrs []string, family string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	first, second := v4, v6
+	switch family {
+	case PREFER_IPV6:
+		first, second = v6, v4
+	case PREFER_AUTO:
+		if len(v4) == 0 || (len(v6) > 0 && addrs[0] == v6[0]) {
+			first, second = v6, v4
+		}
+	}
+	ordered := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,235 @@
+package netinfo
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Interface describes one network interface and its addresses
+type Interface struct {
+	Name       string   `json:"name"`
+	MACAddress string   `json:"mac_address,omitempty"`
+	MTU        int      `json:"mtu"`
+	Up         bool     `json:"up"`
+	IPv4       []string `json:"ipv4,omitempty"`
+	IPv6       []string `json:"ipv6,omitempty"`
+	Default    bool     `json:"default_route,omitempty"`
+}
+
+// Report is the full network picture of the host
+type Report struct {
+	Interfaces  []Interface `json:"interfaces"`
+	PrimaryIPv4 string      `json:"primary_ipv4,omitempty"`
+	PrimaryIPv6 string      `json:"primary_ipv6,omitempty"`
+	PrimaryMAC  string      `json:"primary_mac,omitempty"`
+}
+
+// Collect enumerates all non-loopback interfaces, skipping names matching
+// any of the exclude glob patterns (e.g. "docker*", "veth*"), and selects
+// the primary addresses from the default-route interface
+func Collect(exclude []string) (*Report, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultIface := DefaultRouteInterface()
+	report := &Report{Interfaces: []Interface{}}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || isExcluded(iface.Name, exclude) {
+			continue
+		}
+
+		info := Interface{
+			Name:       iface.Name,
+			MACAddress: iface.HardwareAddr.String(),
+			MTU:        iface.MTU,
+			Up:         iface.Flags&net.FlagUp != 0,
+			Default:    iface.Name == defaultIface,
+		}
+
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				info.IPv4 = append(info.IPv4, ipnet.IP.String())
+			} else {
+				info.IPv6 = append(info.IPv6, ipnet.IP.String())
+			}
+		}
+
+		report.Interfaces = append(report.Interfaces, info)
+	}
+
+	report.selectPrimary()
+	return report, nil
+}
+
+// selectPrimary prefers the default-route interface, then any interface
+// that is up, so multi-homed hosts report the address traffic leaves from
+func (r *Report) selectPrimary() {
+	candidates := make([]Interface, 0, len(r.Interfaces))
+	for _, iface := range r.Interfaces {
+		if iface.Default {
+			candidates = append([]Interface{iface}, candidates...)
+		} else if iface.Up {
+			candidates = append(candidates, iface)
+		}
+	}
+
+	for _, iface := range candidates {
+		if r.PrimaryIPv4 == "" && len(iface.IPv4) > 0 {
+			r.PrimaryIPv4 = iface.IPv4[0]
+		}
+		if r.PrimaryIPv6 == "" {
+			r.PrimaryIPv6 = firstGlobalIPv6(iface.IPv6)
+		}
+		if r.PrimaryMAC == "" && iface.MACAddress != "" {
+			r.PrimaryMAC = iface.MACAddress
+		}
+	}
+}
+
+// PrimaryIP returns the primary address of the preferred family, or of the
+// other one on single-stack hosts
+func (r *Report) PrimaryIP(preferIPv6 bool) string {
+	if preferIPv6 && r.PrimaryIPv6 != "" {
+		return r.PrimaryIPv6
+	}
+	if r.PrimaryIPv4 != "" {
+		return r.PrimaryIPv4
+	}
+	return r.PrimaryIPv6
+}
+
+// DefaultRouteInterface returns the name of the interface holding the
+// default route, or "" if it cannot be determined
+func DefaultRouteInterface() string {
+	if name := defaultRouteFromProc(); name != "" {
+		return name
+	}
+
+	// Portable fallback: a UDP "connection" selects a source address via the
+	// routing table without sending any packets
+	for _, target := range []string{"192.0.2.1:53", "[2001:db8::1]:53"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+		local := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		if name := interfaceForIP(local); name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// defaultRouteFromProc reads the Linux IPv4 and IPv6 routing tables. Only
+// a true default route counts (VPN clients add 0.0.0.0/1 and 128.0.0.0/1
+// to override it), and among several the lowest metric wins, as it does in
+// the kernel.
+func defaultRouteFromProc() string {
+	if file, err := os.Open("/proc/net/route"); err == nil {
+		defer file.Close()
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		name := lowestMetricRoute(file, func(fields []string) (string, string, bool) {
+			if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+				return "", "", false
+			}
+			return fields[0], fields[6], true
+		}, 10)
+		if name != "" {
+			return name
+		}
+	}
+
+	if file, err := os.Open("/proc/net/ipv6_route"); err == nil {
+		defer file.Close()
+		// dest dest_len src src_len nexthop metric refcnt use flags iface
+		return lowestMetricRoute(file, func(fields []string) (string, string, bool) {
+			if len(fields) < 10 || fields[0] != strings.Repeat("0", 32) || fields[1] != "00" || fields[9] == "lo" {
+				return "", "", false
+			}
+			return fields[9], fields[5], true
+		}, 16)
+	}
+
+	return ""
+}
+
+// lowestMetricRoute returns the interface of the usable route with the
+// lowest metric among the lines match accepts; metrics are printed in the
+// given base
+func lowestMetricRoute(r io.Reader, match func(fields []string) (iface, metric string, ok bool), base int) string {
+	best := ""
+	var bestMetric uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		iface, metricText, ok := match(fields)
+		if !ok {
+			continue
+		}
+		metric, err := strconv.ParseUint(metricText, base, 32)
+		if err != nil {
+			continue
+		}
+		if best == "" || metric < bestMetric {
+			best, bestMetric = iface, metric
+		}
+	}
+	return best
+}
+
+func interfaceForIP(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func firstGlobalIPv6(addrs []string) string {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return addr
+		}
+	}
+	// Fall back to ULA addresses before giving up; never report link-local
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip != nil && ip.IsGlobalUnicast() {
+			return addr
+		}
+	}
+	return ""
+}
+
+func isExcluded(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
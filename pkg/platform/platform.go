@@ -0,0 +1,15 @@
+// Package platform holds the operating system specifics every module needs:
+// where configuration and state live, how to describe the OS and how the
+// process runs as a system service. Each OS has its own build-tagged file.
+package platform
+
+import "path/filepath"
+
+const (
+	SERVICE_NAME = "certfix-agent"
+)
+
+// ConfigFile is the agent's configuration file
+func ConfigFile() string {
+	return filepath.Join(ConfigDir(), "config.json")
+}
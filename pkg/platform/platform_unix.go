@@ -0,0 +1,73 @@
+//go:build !windows
+
+package platform
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// ConfigDir holds config.json and the machine ID
+func ConfigDir() string {
+	return "/etc/certfix-agent"
+}
+
+// StateDir holds caches, audit logs and other agent-owned state
+func StateDir() string {
+	return "/var/lib/certfix-agent"
+}
+
+// RunDir holds runtime files such as the instance lock
+func RunDir() string {
+	return "/var/run"
+}
+
+// PluginDir holds external plugin executables
+func PluginDir() string {
+	return "/usr/lib/certfix-agent/plugins"
+}
+
+// DefaultBinaryPath is where the installer puts the agent
+func DefaultBinaryPath() string {
+	return "/usr/local/bin/certfix-agent"
+}
+
+// OSVersion describes the distribution or OS release
+func OSVersion() string {
+	switch runtime.GOOS {
+	case "linux":
+		// Try to read /etc/os-release
+		data, err := os.ReadFile("/etc/os-release")
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "PRETTY_NAME=") {
+					return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), "\"")
+				}
+			}
+		}
+
+		// Fallback to uname
+		if output, err := exec.Command("uname", "-r").Output(); err == nil {
+			return strings.TrimSpace(string(output))
+		}
+	case "darwin":
+		if output, err := exec.Command("sw_vers", "-productVersion").Output(); err == nil {
+			return "macOS " + strings.TrimSpace(string(output))
+		}
+	}
+	return "unknown"
+}
+
+// RunService is a no-op outside Windows; init systems run the agent as a
+// plain process. It reports false so the caller runs in the foreground.
+func RunService(name string, run func(stop <-chan struct{})) (bool, error) {
+	return false, nil
+}
+
+// RescanSignals ask a running agent to scan and report right away
+func RescanSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR1}
+}
@@ -0,0 +1,90 @@
+//go:build windows
+
+package platform
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	WINDOWS_VERSION_KEY = `HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+)
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// ConfigDir holds config.json and the machine ID
+func ConfigDir() string {
+	return filepath.Join(programData(), "CertFix", "Agent")
+}
+
+// StateDir holds caches, audit logs and other agent-owned state
+func StateDir() string {
+	return filepath.Join(programData(), "CertFix", "Agent", "state")
+}
+
+// RunDir holds runtime files such as the instance lock
+func RunDir() string {
+	return StateDir()
+}
+
+func programFiles() string {
+	if dir := os.Getenv("ProgramFiles"); dir != "" {
+		return dir
+	}
+	return `C:\Program Files`
+}
+
+// PluginDir holds external plugin executables; under Program Files so only
+// administrators can add to it
+func PluginDir() string {
+	return filepath.Join(programFiles(), "CertFix", "plugins")
+}
+
+// DefaultBinaryPath is where the installer puts the agent
+func DefaultBinaryPath() string {
+	return filepath.Join(programFiles(), "CertFix", "certfix-agent.exe")
+}
+
+// OSVersion reads the product name and build from the registry, e.g.
+// "Windows Server 2022 Datacenter 21H2 (build 20348)"
+func OSVersion() string {
+	values := map[string]string{}
+	output, err := exec.Command("reg.exe", "query", WINDOWS_VERSION_KEY).Output()
+	if err != nil {
+		return "Windows"
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.HasPrefix(fields[1], "REG_") {
+			values[fields[0]] = strings.Join(fields[2:], " ")
+		}
+	}
+
+	version := values["ProductName"]
+	if version == "" {
+		version = "Windows"
+	}
+	// Windows 11 still reports "Windows 10" as ProductName; the build tells
+	// them apart
+	if display := values["DisplayVersion"]; display != "" {
+		version += " " + display
+	}
+	if build := values["CurrentBuild"]; build != "" {
+		version += " (build " + build + ")"
+	}
+	return version
+}
+
+// RescanSignals is empty: Windows has no SIGUSR1, so an immediate scan is
+// asked for through the control socket only
+func RescanSignals() []os.Signal {
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build windows
+
+package platform
+
+import (
+	"golang.org/x/sys/windows/svc"
+)
+
+// How long the SCM is told to wait for the agent to wind down, in ms
+const STOP_WAIT_HINT = 30000
+
+// RunService hands the process to the Service Control Manager when it was
+// started as a Windows service, running run until it returns. A stop or
+// shutdown request closes run's stop channel, so the agent leaves its loop
+// and releases its state as it would anywhere else. It reports false,
+// without error, when started from a console.
+func RunService(name string, run func(stop <-chan struct{})) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return false, err
+	}
+	if !isService {
+		return false, nil
+	}
+	// Blocks until the service stops
+	if err := svc.Run(name, &service{run: run}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type service struct {
+	run func(stop <-chan struct{})
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			// The agent loop gave up, which the SCM should see as a stop
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: STOP_WAIT_HINT}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+)
+
+// DeployParams is sent with the deploy method
+type DeployParams struct {
+	Name        string          `json:"name"`
+	Certificate string          `json:"certificate"`
+	Chain       string          `json:"chain,omitempty"`
+	PrivateKey  string          `json:"private_key"`
+	Fingerprint string          `json:"fingerprint_sha256"`
+	Options     json.RawMessage `json:"options,omitempty"`
+}
+
+// DeployResult is what a plugin reports back from deploy. RolledBack marks
+// a failure after which the plugin restored the previous state.
+type DeployResult struct {
+	Files      []string          `json:"files,omitempty"`
+	Reloaded   []string          `json:"reloaded,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	RolledBack bool              `json:"rolled_back,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// DeployFactory exposes a deploy-capable plugin as a deploy target. Options
+// from the task are passed through untouched for the plugin to validate.
+func (p *Plugin) DeployFactory() deploy.Factory {
+	return func(env *deploy.Env, options json.RawMessage) (deploy.Target, error) {
+		return &pluginTarget{plugin: p, options: options}, nil
+	}
+}
+
+type pluginTarget struct {
+	plugin  *Plugin
+	options json.RawMessage
+}
+
+func (t *pluginTarget) Deploy(ctx context.Context, bundle *deploy.Bundle) (*deploy.Result, error) {
+	params := DeployParams{
+		Name:        bundle.Name,
+		Certificate: string(bundle.Certificate),
+		Chain:       string(bundle.Chain),
+		PrivateKey:  string(bundle.PrivateKey),
+		Fingerprint: bundle.Fingerprint(),
+		Options:     t.options,
+	}
+
+	var out DeployResult
+	if err := t.plugin.call(ctx, CALL_TIMEOUT, METHOD_DEPLOY, params, &out); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", t.plugin.Manifest.Name, err)
+	}
+
+	result := &deploy.Result{Files: out.Files, Reloaded: out.Reloaded, Details: out.Details}
+	if out.RolledBack {
+		return result, fmt.Errorf("plugin %s: %s: %w", t.plugin.Manifest.Name, out.Error, deploy.ErrRolledBack)
+	}
+	if out.Error != "" {
+		return result, fmt.Errorf("plugin %s: %s", t.plugin.Manifest.Name, out.Error)
+	}
+	return result, nil
+}
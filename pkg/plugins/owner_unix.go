@@ -0,0 +1,31 @@
+//go:build !windows
+
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkOwnership refuses executables a non-root user could have replaced;
+// plugins run with the agent's privileges
+func checkOwnership(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("not executable")
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("writable by group or others (mode %04o)", info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("owned by uid %d, not root", stat.Uid)
+	}
+	return nil
+}
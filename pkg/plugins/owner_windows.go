@@ -0,0 +1,26 @@
+//go:build windows
+
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkOwnership relies on the plugin directory's ACL (Program Files is
+// administrator-only); it only makes sure the file is something to run
+func checkOwnership(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".exe") {
+		return fmt.Errorf("not an .exe")
+	}
+	return nil
+}
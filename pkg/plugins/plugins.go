@@ -0,0 +1,239 @@
+// Package plugins runs external executables that add deploy targets and
+// certificate sources without changing the agent.
+//
+// Each call starts the plugin once, writes one JSON request to its stdin
+// and reads one JSON response from its stdout; stderr is logged. Requests
+// look like
+//
+//	{"protocol": 1, "method": "deploy", "params": {...}}
+//
+// and responses carry either a result or an error:
+//
+//	{"protocol": 1, "result": {...}}
+//	{"protocol": 1, "error": {"message": "..."}}
+//
+// Methods:
+//
+//	describe  handshake; result is a Manifest. Sent at startup with
+//	          params {"protocols": [1]} listing what the agent speaks.
+//	deploy    capability "deploy"; params are DeployParams, result is
+//	          DeployResult
+//	list      capability "source"; no params, result is SourceResult
+//
+// Plugins must be owned by root (or the agent's own user) and not writable
+// by group or others, or they are ignored.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PROTOCOL_VERSION = 1
+
+	CAPABILITY_DEPLOY = "deploy"
+	CAPABILITY_SOURCE = "source"
+
+	METHOD_DESCRIBE = "describe"
+	METHOD_DEPLOY   = "deploy"
+	METHOD_LIST     = "list"
+
+	DESCRIBE_TIMEOUT = 10 * time.Second
+	CALL_TIMEOUT     = 2 * time.Minute
+
+	// Responses carry certificates at most; anything bigger is a bug
+	MAX_RESPONSE_SIZE = 16 << 20
+	MAX_STDERR_SIZE   = 64 << 10
+)
+
+var pluginNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Manifest is a plugin's answer to describe
+type Manifest struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities"`
+	Description  string   `json:"description,omitempty"`
+}
+
+// Has reports whether the plugin declared a capability
+func (m *Manifest) Has(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+type request struct {
+	Protocol int         `json:"protocol"`
+	Method   string      `json:"method"`
+	Params   interface{} `json:"params,omitempty"`
+}
+
+type response struct {
+	Protocol int             `json:"protocol"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// Plugin is an executable that completed the handshake
+type Plugin struct {
+	Path     string
+	Manifest Manifest
+}
+
+// Discover loads every plugin in dir. Files that fail the ownership check
+// or the handshake are reported as errors and skipped; a missing directory
+// just means no plugins.
+func Discover(ctx context.Context, dir string) ([]*Plugin, []error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to read plugin directory: %w", err)}
+	}
+
+	var loaded []*Plugin
+	var errs []error
+	seen := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		plugin, err := Load(ctx, path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+			continue
+		}
+		if other, dup := seen[plugin.Manifest.Name]; dup {
+			errs = append(errs, fmt.Errorf("%s: plugin name %q already used by %s", entry.Name(), plugin.Manifest.Name, other))
+			continue
+		}
+		seen[plugin.Manifest.Name] = entry.Name()
+		loaded = append(loaded, plugin)
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Manifest.Name < loaded[j].Manifest.Name })
+	return loaded, errs
+}
+
+// Load checks one executable and performs the version handshake
+func Load(ctx context.Context, path string) (*Plugin, error) {
+	if err := checkOwnership(path); err != nil {
+		return nil, err
+	}
+
+	p := &Plugin{Path: path}
+	params := map[string][]int{"protocols": {PROTOCOL_VERSION}}
+	if err := p.call(ctx, DESCRIBE_TIMEOUT, METHOD_DESCRIBE, params, &p.Manifest); err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	if p.Manifest.Protocol != PROTOCOL_VERSION {
+		return nil, fmt.Errorf("plugin speaks protocol %d, agent speaks %d", p.Manifest.Protocol, PROTOCOL_VERSION)
+	}
+	if !pluginNameRe.MatchString(p.Manifest.Name) {
+		return nil, fmt.Errorf("invalid plugin name %q", p.Manifest.Name)
+	}
+	if !p.Manifest.Has(CAPABILITY_DEPLOY) && !p.Manifest.Has(CAPABILITY_SOURCE) {
+		return nil, fmt.Errorf("plugin declares no known capability (have %s)", strings.Join(p.Manifest.Capabilities, ", "))
+	}
+	return p, nil
+}
+
+// String identifies the plugin in logs
+func (p *Plugin) String() string {
+	return fmt.Sprintf("%s %s (%s)", p.Manifest.Name, p.Manifest.Version, filepath.Base(p.Path))
+}
+
+// call runs the plugin for one request
+func (p *Plugin) call(ctx context.Context, timeout time.Duration, method string, params, out interface{}) error {
+	input, err := json.Marshal(request{Protocol: PROTOCOL_VERSION, Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Dir = filepath.Dir(p.Path)
+	// Plugins get a clean environment; anything they need comes through
+	// the request
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		fmt.Sprintf("CERTFIX_PLUGIN_PROTOCOL=%d", PROTOCOL_VERSION),
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &limitedWriter{w: &stdout, n: MAX_RESPONSE_SIZE}
+	cmd.Stderr = &limitedWriter{w: &stderr, n: MAX_STDERR_SIZE}
+
+	runErr := cmd.Run()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		for _, line := range strings.Split(msg, "\n") {
+			log.Printf("[INFO] Plugin %s: %s", filepath.Base(p.Path), line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %v", method, timeout)
+	}
+
+	var resp response
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		if runErr != nil {
+			return fmt.Errorf("%s failed: %w", method, runErr)
+		}
+		return fmt.Errorf("invalid %s response: %w", method, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.Error.Message)
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s failed: %w", method, runErr)
+	}
+	if out != nil {
+		if err := json.Unmarshal(resp.Result, out); err != nil {
+			return fmt.Errorf("invalid %s result: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// limitedWriter stops collecting output after n bytes but keeps draining
+// the pipe so the plugin doesn't block
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n > 0 {
+		chunk := b
+		if len(chunk) > l.n {
+			chunk = chunk[:l.n]
+		}
+		l.w.Write(chunk)
+		l.n -= len(chunk)
+	}
+	return len(b), nil
+}
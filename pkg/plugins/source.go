@@ -0,0 +1,65 @@
+package plugins
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+)
+
+// SourceCertificate is one certificate a source plugin found. Location is
+// shown as the certificate's path, e.g. "vault:pki/issue/web" or a file
+// inside an appliance; PEM is the leaf followed by its chain.
+type SourceCertificate struct {
+	Location string `json:"location"`
+	PEM      string `json:"pem"`
+}
+
+// SourceResult is the result of the list method
+type SourceResult struct {
+	Certificates []SourceCertificate `json:"certificates"`
+}
+
+// Certificates asks a source plugin for the certificates it knows about.
+// The agent parses them itself, so the inventory never carries fields a
+// plugin made up.
+func (p *Plugin) Certificates(ctx context.Context) ([]inventory.Certificate, []string) {
+	var out SourceResult
+	if err := p.call(ctx, CALL_TIMEOUT, METHOD_LIST, nil, &out); err != nil {
+		return nil, []string{fmt.Sprintf("plugin %s: %v", p.Manifest.Name, err)}
+	}
+
+	var certs []inventory.Certificate
+	var errs []string
+	for _, found := range out.Certificates {
+		var ders [][]byte
+		rest := []byte(found.PEM)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			errs = append(errs, fmt.Sprintf("plugin %s: %s: no certificate", p.Manifest.Name, found.Location))
+			continue
+		}
+		leaf, err := x509.ParseCertificate(ders[0])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("plugin %s: %s: %v", p.Manifest.Name, found.Location, err))
+			continue
+		}
+
+		cert := inventory.Describe(leaf)
+		cert.Path = p.Manifest.Name + ":" + found.Location
+		cert.ChainLength = len(ders)
+		certs = append(certs, cert)
+	}
+	return certs, errs
+}
@@ -0,0 +1,287 @@
+// Package pqc reports how ready a host is for post-quantum cryptography:
+// which key and signature algorithms its certificates use, and whether
+// the TLS endpoints it serves negotiate a hybrid post-quantum key exchange
+// (X25519MLKEM768 and friends), which protects today's traffic against
+// later decryption. The API aggregates the reports fleet-wide.
+package pqc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+)
+
+const (
+	STATUS_QUANTUM_VULNERABLE = "quantum_vulnerable"
+	STATUS_POST_QUANTUM       = "post_quantum"
+	STATUS_UNKNOWN            = "unknown"
+
+	// IANA TLS supported groups for the hybrid key exchanges
+	CURVE_X25519_MLKEM768     tls.CurveID = 0x11ec
+	CURVE_SECP256R1_MLKEM768  tls.CurveID = 0x11eb
+	CURVE_SECP384R1_MLKEM1024 tls.CurveID = 0x11ed
+
+	PROBE_TIMEOUT    = 5 * time.Second
+	PROBE_CONCURRENT = 8
+)
+
+// Hybrid groups in the order they are tried
+var hybridGroups = []struct {
+	ID   tls.CurveID
+	Name string
+}{
+	{CURVE_X25519_MLKEM768, "X25519MLKEM768"},
+	{CURVE_SECP256R1_MLKEM768, "SecP256r1MLKEM768"},
+	{CURVE_SECP384R1_MLKEM1024, "SecP384r1MLKEM1024"},
+}
+
+// NIST post-quantum algorithm OIDs (FIPS 203, 204, 205) that Go's x509
+// doesn't name yet
+var pqAlgorithms = map[string]string{
+	"2.16.840.1.101.3.4.3.17": "ML-DSA-44",
+	"2.16.840.1.101.3.4.3.18": "ML-DSA-65",
+	"2.16.840.1.101.3.4.3.19": "ML-DSA-87",
+	"2.16.840.1.101.3.4.3.20": "SLH-DSA-SHA2-128s",
+	"2.16.840.1.101.3.4.3.21": "SLH-DSA-SHA2-128f",
+	"2.16.840.1.101.3.4.3.22": "SLH-DSA-SHA2-192s",
+	"2.16.840.1.101.3.4.3.23": "SLH-DSA-SHA2-192f",
+	"2.16.840.1.101.3.4.3.24": "SLH-DSA-SHA2-256s",
+	"2.16.840.1.101.3.4.3.25": "SLH-DSA-SHA2-256f",
+	"2.16.840.1.101.3.4.3.26": "SLH-DSA-SHAKE-128s",
+	"2.16.840.1.101.3.4.3.27": "SLH-DSA-SHAKE-128f",
+	"2.16.840.1.101.3.4.3.28": "SLH-DSA-SHAKE-192s",
+	"2.16.840.1.101.3.4.3.29": "SLH-DSA-SHAKE-192f",
+	"2.16.840.1.101.3.4.3.30": "SLH-DSA-SHAKE-256s",
+	"2.16.840.1.101.3.4.3.31": "SLH-DSA-SHAKE-256f",
+	"2.16.840.1.101.3.4.4.1":  "ML-KEM-512",
+	"2.16.840.1.101.3.4.4.2":  "ML-KEM-768",
+	"2.16.840.1.101.3.4.4.3":  "ML-KEM-1024",
+}
+
+// Classical algorithms Shor's algorithm breaks, matched by name
+var vulnerableMarkers = []string{"RSA", "ECDSA", "Ed25519", "Ed448", "DSA"}
+
+// AlgorithmName names an algorithm OID, or returns "" if it is not a
+// known post-quantum one
+func AlgorithmName(oid asn1.ObjectIdentifier) string {
+	return pqAlgorithms[oid.String()]
+}
+
+// PublicKeyAlgorithm names the algorithm of a DER SubjectPublicKeyInfo
+func PublicKeyAlgorithm(spki []byte) string {
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(spki, &info); err != nil {
+		return ""
+	}
+	if name := AlgorithmName(info.Algorithm.Algorithm); name != "" {
+		return name
+	}
+	return info.Algorithm.Algorithm.String()
+}
+
+// SignatureAlgorithm names the signature algorithm of a DER certificate
+func SignatureAlgorithm(certificate []byte) string {
+	var cert struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(certificate, &cert); err != nil {
+		return ""
+	}
+	if name := AlgorithmName(cert.Algorithm.Algorithm); name != "" {
+		return name
+	}
+	return cert.Algorithm.Algorithm.String()
+}
+
+// Classify tells whether an algorithm survives a quantum computer
+func Classify(algorithm string) string {
+	for _, name := range pqAlgorithms {
+		if strings.EqualFold(algorithm, name) {
+			return STATUS_POST_QUANTUM
+		}
+	}
+	if strings.HasPrefix(algorithm, "ML-") || strings.HasPrefix(algorithm, "SLH-") {
+		return STATUS_POST_QUANTUM
+	}
+	for _, marker := range vulnerableMarkers {
+		if strings.Contains(strings.ToUpper(algorithm), strings.ToUpper(marker)) {
+			return STATUS_QUANTUM_VULNERABLE
+		}
+	}
+	return STATUS_UNKNOWN
+}
+
+// Certificate is the readiness of one discovered certificate
+type Certificate struct {
+	Location           string `json:"location"`
+	Fingerprint        string `json:"fingerprint_sha256"`
+	KeyAlgorithm       string `json:"key_algorithm"`
+	KeySize            int    `json:"key_size,omitempty"`
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	KeyStatus          string `json:"key_status"`
+	SignatureStatus    string `json:"signature_status"`
+}
+
+// Endpoint is whether one TLS endpoint negotiates a hybrid key exchange
+type Endpoint struct {
+	Endpoint string `json:"endpoint"`
+	Hybrid   bool   `json:"hybrid_key_exchange"`
+	// Group is the first hybrid group the server accepted
+	Group string `json:"group,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Summary counts what the API aggregates across the fleet
+type Summary struct {
+	Certificates        int            `json:"certificates"`
+	QuantumVulnerable   int            `json:"quantum_vulnerable"`
+	PostQuantum         int            `json:"post_quantum"`
+	Unknown             int            `json:"unknown"`
+	KeyTypes            map[string]int `json:"key_types"`
+	SignatureAlgorithms map[string]int `json:"signature_algorithms"`
+	Endpoints           int            `json:"endpoints"`
+	HybridEndpoints     int            `json:"hybrid_endpoints"`
+	// Ready once every certificate and endpoint checked is post-quantum
+	CertificatesReady bool `json:"certificates_ready"`
+	KeyExchangeReady  bool `json:"key_exchange_ready"`
+}
+
+// Report is the readiness section of the inventory
+type Report struct {
+	Summary      Summary       `json:"summary"`
+	Certificates []Certificate `json:"certificates"`
+	Endpoints    []Endpoint    `json:"endpoints,omitempty"`
+}
+
+// NewReport classifies certificates and summarizes them with the endpoint
+// results. A certificate only counts as post-quantum when both its key and
+// its signature are.
+func NewReport(certificates []Certificate, endpoints []Endpoint) *Report {
+	report := &Report{
+		Summary: Summary{
+			KeyTypes:            map[string]int{},
+			SignatureAlgorithms: map[string]int{},
+		},
+		Certificates: certificates,
+		Endpoints:    endpoints,
+	}
+	s := &report.Summary
+	for i := range report.Certificates {
+		c := &report.Certificates[i]
+		c.KeyStatus = Classify(c.KeyAlgorithm)
+		c.SignatureStatus = Classify(c.SignatureAlgorithm)
+		switch {
+		case c.KeyStatus == STATUS_POST_QUANTUM && c.SignatureStatus == STATUS_POST_QUANTUM:
+			s.PostQuantum++
+		case c.KeyStatus == STATUS_QUANTUM_VULNERABLE || c.SignatureStatus == STATUS_QUANTUM_VULNERABLE:
+			s.QuantumVulnerable++
+		default:
+			s.Unknown++
+		}
+		keyType := c.KeyAlgorithm
+		if c.KeySize > 0 {
+			keyType = fmt.Sprintf("%s-%d", c.KeyAlgorithm, c.KeySize)
+		}
+		s.KeyTypes[keyType]++
+		s.SignatureAlgorithms[c.SignatureAlgorithm]++
+	}
+	s.Certificates = len(report.Certificates)
+	for _, e := range report.Endpoints {
+		if e.Error != "" {
+			continue
+		}
+		s.Endpoints++
+		if e.Hybrid {
+			s.HybridEndpoints++
+		}
+	}
+	s.CertificatesReady = s.Certificates > 0 && s.PostQuantum == s.Certificates
+	s.KeyExchangeReady = s.Endpoints > 0 && s.HybridEndpoints == s.Endpoints
+	return report
+}
+
+// ProbeEndpoints checks every endpoint for a hybrid key exchange, a few at
+// a time, returning results in the order given
+func ProbeEndpoints(ctx context.Context, endpoints []string) []Endpoint {
+	results := make([]Endpoint, len(endpoints))
+	limit := make(chan struct{}, PROBE_CONCURRENT)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			results[i] = ProbeEndpoint(ctx, endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+	return results
+}
+
+// ProbeEndpoint offers the server only hybrid groups, one at a time: a
+// completed handshake means it negotiates that group. TLS 1.3 is required
+// since the hybrids don't exist below it.
+func ProbeEndpoint(ctx context.Context, endpoint string) Endpoint {
+	result := Endpoint{Endpoint: endpoint}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid endpoint: %v", err)
+		return result
+	}
+	if ascii, err := idn.ToASCII(host); err == nil {
+		host = ascii
+	}
+
+	for _, group := range hybridGroups {
+		err := handshake(ctx, host, port, group.ID)
+		if err == nil {
+			result.Hybrid = true
+			result.Group = group.Name
+			return result
+		}
+		// Only a refused handshake says anything about the groups
+		var netErr net.Error
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" || errors.As(err, &netErr) && netErr.Timeout() {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	return result
+}
+
+func handshake(ctx context.Context, host, port string, group tls.CurveID) error {
+	dialer := &netdial.Dialer{Timeout: PROBE_TIMEOUT, Resolver: securedns.Resolver()}
+	config := &tls.Config{
+		ServerName: host,
+		// Only the key exchange is of interest here
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		CurvePreferences:   []tls.CurveID{group},
+	}
+	ctx, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+	defer cancel()
+
+	conn, err := dialer.DialTLS(ctx, "tcp", net.JoinHostPort(host, port), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,193 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/intermediates"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+	"github.com/certfix/certfix-agent/pkg/verify"
+)
+
+const (
+	TASK_PROBE = "net.probe"
+
+	DEFAULT_TIMEOUT = 5 * time.Second
+	MAX_TIMEOUT     = 30 * time.Second
+	MAX_TARGETS     = 20
+
+	STAGE_DNS = "dns"
+	STAGE_TCP = "tcp"
+	STAGE_TLS = "tls"
+)
+
+// Target is one host:port the server wants tested from inside the network
+type Target struct {
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	TLS            bool   `json:"tls"`
+	ServerName     string `json:"server_name,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// PeerCertificate summarizes a certificate presented during the handshake
+type PeerCertificate struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+}
+
+// TLSInfo describes the negotiated TLS session
+type TLSInfo struct {
+	Version         string            `json:"version"`
+	CipherSuite     string            `json:"cipher_suite"`
+	ALPN            string            `json:"alpn,omitempty"`
+	HandshakeMillis int64             `json:"handshake_ms"`
+	Certificates    []PeerCertificate `json:"certificates"`
+	VerifyError     string            `json:"verify_error,omitempty"`
+}
+
+// Result is the outcome of probing one target. FailedStage pinpoints where
+// connectivity broke: name resolution, TCP connect or TLS handshake.
+type Result struct {
+	Target        Target   `json:"target"`
+	Reachable     bool     `json:"reachable"`
+	Addresses     []string `json:"addresses,omitempty"`
+	ConnectedTo   string   `json:"connected_to,omitempty"`
+	ConnectMillis int64    `json:"connect_ms,omitempty"`
+	TLS           *TLSInfo `json:"tls,omitempty"`
+	FailedStage   string   `json:"failed_stage,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// Probe resolves, connects to and optionally handshakes with target
+func Probe(ctx context.Context, target Target) *Result {
+	result := &Result{Target: target}
+
+	timeout := DEFAULT_TIMEOUT
+	if target.TimeoutSeconds > 0 {
+		timeout = time.Duration(target.TimeoutSeconds) * time.Second
+		if timeout > MAX_TIMEOUT {
+			timeout = MAX_TIMEOUT
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := securedns.Resolver().LookupHost(ctx, target.Host)
+	if err != nil {
+		result.FailedStage = STAGE_DNS
+		result.Error = err.Error()
+		return result
+	}
+	result.Addresses = addrs
+
+	dialer := &netdial.Dialer{Resolver: securedns.Resolver()}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target.Host, strconv.Itoa(target.Port)))
+	if err != nil {
+		result.FailedStage = STAGE_TCP
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.ConnectMillis = time.Since(start).Milliseconds()
+	result.ConnectedTo = conn.RemoteAddr().String()
+
+	if !target.TLS {
+		result.Reachable = true
+		return result
+	}
+
+	serverName := target.ServerName
+	if serverName == "" {
+		serverName = target.Host
+	}
+
+	// Handshake without verification so the presented chain can be reported
+	// even when it is untrusted; verification is evaluated separately
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	start = time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		result.FailedStage = STAGE_TLS
+		result.Error = err.Error()
+		return result
+	}
+
+	state := tlsConn.ConnectionState()
+	info := &TLSInfo{
+		Version:         tls.VersionName(state.Version),
+		CipherSuite:     tls.CipherSuiteName(state.CipherSuite),
+		ALPN:            state.NegotiatedProtocol,
+		HandshakeMillis: time.Since(start).Milliseconds(),
+	}
+	for _, cert := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, PeerCertificate{
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			NotAfter:    cert.NotAfter.UTC(),
+			Fingerprint: verify.Fingerprint(cert),
+		})
+	}
+	if len(state.PeerCertificates) > 0 {
+		served := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			served.AddCert(cert)
+		}
+		intermediates.Default.Learn("served", state.PeerCertificates[1:]...)
+		opts := x509.VerifyOptions{DNSName: serverName, Intermediates: served}
+		if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+			info.VerifyError = err.Error()
+		}
+	}
+
+	result.TLS = info
+	result.Reachable = true
+	return result
+}
+
+// ProbeRequest is the payload of a net.probe task
+type ProbeRequest struct {
+	Targets []Target `json:"targets"`
+}
+
+// Register installs the net.probe task handler
+func Register(registry *tasks.Registry) {
+	registry.Register(TASK_PROBE, handle)
+}
+
+func handle(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req ProbeRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Targets) == 0 {
+		return nil, tasks.Rejectf("no targets to probe")
+	}
+	if len(req.Targets) > MAX_TARGETS {
+		return nil, tasks.Rejectf("%d targets requested, limit is %d", len(req.Targets), MAX_TARGETS)
+	}
+
+	for _, target := range req.Targets {
+		if target.Host == "" || target.Port <= 0 || target.Port > 65535 {
+			return nil, tasks.Rejectf("invalid target %s:%d", target.Host, target.Port)
+		}
+	}
+
+	var results []*Result
+	for _, target := range req.Targets {
+		results = append(results, Probe(ctx, target))
+	}
+	return results, nil
+}
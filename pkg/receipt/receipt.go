@@ -0,0 +1,313 @@
+// Package receipt keeps a signed record of every successful deployment:
+// what was installed, where, when, for which order, and the hashes of the
+// files written. Each receipt carries the hash of the one before it, so a
+// receipt removed from or altered in the chain shows, and the agent signs
+// them with its own Ed25519 key, which it registers with the API.
+package receipt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	VERSION = 1
+
+	// A receipt line is a few KB; leave room for many files
+	MAX_LINE = 1 << 20
+)
+
+var ErrBadSignature = errors.New("invalid receipt signature")
+
+// File is one file a deployment wrote, hashed once it was in place
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Receipt describes one successful deployment
+type Receipt struct {
+	Version  int    `json:"version"`
+	Sequence uint64 `json:"sequence"`
+	// SHA-256 of the previous receipt's payload; empty for the first
+	Previous string `json:"previous,omitempty"`
+
+	Host string `json:"host"`
+	// Task ID, or acme:<name>/<destination> for the agent's own renewals
+	DeploymentID string `json:"deployment_id"`
+	// ACME order URL, or the task ID when the server supplied the certificate
+	OrderID string `json:"order_id,omitempty"`
+
+	Certificate  string    `json:"certificate"`
+	Fingerprint  string    `json:"fingerprint_sha256"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	NotAfter     time.Time `json:"not_after,omitempty"`
+	Target       string    `json:"target"`
+	Files        []File    `json:"files,omitempty"`
+	Reloaded     []string  `json:"reloaded,omitempty"`
+	DeployedAt   time.Time `json:"deployed_at"`
+}
+
+// Signed is a receipt as stored and uploaded: Signature is the agent key's
+// signature over the exact Payload bytes, like the server's key manifest
+type Signed struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+	KeyID     string          `json:"key_id"`
+	PublicKey string          `json:"public_key"`
+}
+
+// Receipt decodes the payload
+func (s *Signed) Receipt() (*Receipt, error) {
+	var r Receipt
+	if err := json.Unmarshal(s.Payload, &r); err != nil {
+		return nil, fmt.Errorf("failed to decode receipt: %w", err)
+	}
+	return &r, nil
+}
+
+// Hash is what the next receipt's Previous refers to
+func (s *Signed) Hash() string {
+	sum := sha256.Sum256(s.Payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the signature against the key the receipt names
+func (s *Signed) Verify() error {
+	pub, err := base64.StdEncoding.DecodeString(s.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid receipt public key")
+	}
+	if KeyID(pub) != s.KeyID {
+		return fmt.Errorf("receipt key ID %s does not match its public key", s.KeyID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(pub, s.Payload, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// KeyID names a public key: the first 16 bytes of its SHA-256, in hex
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+// LoadKey loads the agent's receipt signing key, creating one on first use
+func LoadKey(state store.Blob) (ed25519.PrivateKey, error) {
+	if data, err := state.Load(); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("stored receipt key is not PEM")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored receipt key: %w", err)
+		}
+		signer, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("stored receipt key is not Ed25519")
+		}
+		return signer, nil
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate receipt key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode receipt key: %w", err)
+	}
+	if err := state.Save(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to store receipt key: %w", err)
+	}
+	return key, nil
+}
+
+// PublicKey encodes the public half of key as the API expects it
+func PublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// HashFiles hashes the files a deployment wrote; one that can't be read is
+// listed with the reason instead of a hash
+func HashFiles(paths []string) []File {
+	files := make([]File, 0, len(paths))
+	for _, path := range paths {
+		file := File{Path: path}
+		if data, err := os.ReadFile(path); err != nil {
+			file.Error = err.Error()
+		} else {
+			sum := sha256.Sum256(data)
+			file.SHA256 = hex.EncodeToString(sum[:])
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Log is the local chain of receipts: a JSON line per signed receipt,
+// appended and synced before the receipt is handed on
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	key      ed25519.PrivateKey
+	sequence uint64
+	previous string
+}
+
+// Open continues the chain in the file at path, which need not exist yet
+func Open(path string, key ed25519.PrivateKey) (*Log, error) {
+	l := &Log{path: path, key: key}
+	receipts, err := Read(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if n := len(receipts); n > 0 {
+		last, err := receipts[n-1].Receipt()
+		if err != nil {
+			return nil, err
+		}
+		l.sequence, l.previous = last.Sequence, receipts[n-1].Hash()
+	}
+	return l, nil
+}
+
+// Issue numbers, links and signs r, then appends it to the log
+func (l *Log) Issue(r *Receipt) (*Signed, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Version = VERSION
+	r.Sequence = l.sequence + 1
+	r.Previous = l.previous
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+	pub := l.key.Public().(ed25519.PublicKey)
+	signed := &Signed{
+		Payload:   payload,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(l.key, payload)),
+		KeyID:     KeyID(pub),
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+	line, err := json.Marshal(signed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create receipt directory: %w", err)
+	}
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open receipt log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write receipt log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to write receipt log: %w", err)
+	}
+	l.sequence, l.previous = r.Sequence, signed.Hash()
+	return signed, nil
+}
+
+// Read loads every receipt in the log at path, oldest first
+func Read(path string) ([]*Signed, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Decode(file)
+}
+
+// Decode reads receipts written one per line
+func Decode(r io.Reader) ([]*Signed, error) {
+	var receipts []*Signed
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_LINE)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var signed Signed
+		if err := json.Unmarshal(data, &signed); err != nil {
+			return receipts, fmt.Errorf("line %d: %w", line, err)
+		}
+		receipts = append(receipts, &signed)
+	}
+	if err := scanner.Err(); err != nil {
+		return receipts, fmt.Errorf("failed to read receipts: %w", err)
+	}
+	return receipts, nil
+}
+
+// Problem is a receipt that fails verification
+type Problem struct {
+	Sequence uint64
+	Reason   string
+}
+
+// VerifyChain checks every signature, that all receipts are signed by one
+// key (trusted, when given, else the first receipt's), and that each links
+// to the one before it without gaps. A log trimmed at the front still
+// verifies from its first receipt.
+func VerifyChain(receipts []*Signed, trusted ed25519.PublicKey) []Problem {
+	var problems []Problem
+	keyID := ""
+	if trusted != nil {
+		keyID = KeyID(trusted)
+	}
+	var previous *Receipt
+	previousHash := ""
+	for i, signed := range receipts {
+		r, err := signed.Receipt()
+		if err != nil {
+			problems = append(problems, Problem{Sequence: uint64(i + 1), Reason: err.Error()})
+			previous = nil
+			continue
+		}
+		if err := signed.Verify(); err != nil {
+			problems = append(problems, Problem{Sequence: r.Sequence, Reason: err.Error()})
+		}
+		if keyID == "" {
+			keyID = signed.KeyID
+		} else if signed.KeyID != keyID {
+			problems = append(problems, Problem{Sequence: r.Sequence, Reason: fmt.Sprintf("signed by key %s, expected %s", signed.KeyID, keyID)})
+		}
+		if previous != nil {
+			if r.Sequence != previous.Sequence+1 {
+				problems = append(problems, Problem{Sequence: r.Sequence, Reason: fmt.Sprintf("follows receipt %d; receipts are missing", previous.Sequence)})
+			} else if r.Previous != previousHash {
+				problems = append(problems, Problem{Sequence: r.Sequence, Reason: fmt.Sprintf("does not link to receipt %d; it was altered or replaced", previous.Sequence)})
+			}
+		}
+		previous, previousHash = r, signed.Hash()
+	}
+	return problems
+}
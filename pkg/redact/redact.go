@@ -0,0 +1,112 @@
+// Package redact scrubs credentials from anything the agent writes out:
+// the log output, task errors reported to the API and audit entries.
+package redact
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	PLACEHOLDER = "[REDACTED]"
+
+	// Shorter registered secrets would match ordinary words
+	MIN_SECRET_LENGTH = 6
+)
+
+var (
+	mu      sync.RWMutex
+	secrets []string
+)
+
+type rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var rules = []rule{
+	// PEM private keys of any flavor (RSA, EC, ENCRYPTED, OPENSSH, ...)
+	{
+		regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]*)PRIVATE KEY-----[\s\S]*?(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`),
+		"-----BEGIN ${1}PRIVATE KEY-----" + PLACEHOLDER + "-----END ${1}PRIVATE KEY-----",
+	},
+	// Credential headers quoted in errors and logs
+	{
+		regexp.MustCompile(`(?im)^((?:x-api-key|authorization|proxy-authorization|cookie|set-cookie)\s*:\s*)\S.*$`),
+		"${1}" + PLACEHOLDER,
+	},
+	// Bearer tokens outside of headers
+	{
+		regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9\-._~+/]+=*`),
+		"${1}" + PLACEHOLDER,
+	},
+	// JSON fields
+	{
+		regexp.MustCompile(`(?i)("(?:[a-z_]*token|password|passwd|secret|[a-z_]*api_key|private_key|client_secret|secret_access_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`),
+		`${1}"` + PLACEHOLDER + `"`,
+	},
+	// Query strings and key=value pairs
+	{
+		regexp.MustCompile(`(?i)\b([a-z_]*token|password|passwd|pwd|secret|api[_-]?key|access[_-]?key|client[_-]?secret|signature)=([^&\s"',;]+)`),
+		"${1}=" + PLACEHOLDER,
+	},
+	// Passwords embedded in URLs
+	{
+		regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`),
+		"${1}" + PLACEHOLDER + "@",
+	},
+}
+
+// AddSecret registers a literal value (e.g. the configured API token) that
+// must never appear in output, wherever it shows up
+func AddSecret(secret string) {
+	if len(secret) < MIN_SECRET_LENGTH {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, existing := range secrets {
+		if existing == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	// Longest first, so a secret containing another is replaced whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// String returns s with registered secrets and credential patterns replaced
+func String(s string) string {
+	mu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, PLACEHOLDER)
+	}
+	mu.RUnlock()
+
+	for _, r := range rules {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// NewWriter wraps w so every write is redacted; used as the log output.
+// The log package issues one Write per line, so patterns never straddle
+// two writes.
+func NewWriter(w io.Writer) io.Writer {
+	return &writer{w: w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := w.w.Write([]byte(String(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
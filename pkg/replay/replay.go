@@ -0,0 +1,123 @@
+// Package replay rejects stale or repeated signed messages. Each message
+// carries a timestamp and a single-use nonce; nonces are remembered for as
+// long as their timestamp would still be accepted, and persisted so a
+// restart does not reopen the window.
+package replay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	// Messages older than this, or further in the future, are refused
+	DEFAULT_WINDOW = 10 * time.Minute
+
+	MIN_NONCE_LENGTH = 16
+)
+
+var (
+	ErrStale    = errors.New("message timestamp outside the accepted window")
+	ErrReplayed = errors.New("message nonce already used")
+	ErrNoNonce  = errors.New("message has no nonce")
+)
+
+// Guard remembers nonces seen within the window
+type Guard struct {
+	mu     sync.Mutex
+	window time.Duration
+	state  store.Blob
+	seen   map[string]time.Time
+	// now returns the reference time, normally corrected for clock skew
+	now func() time.Time
+}
+
+// NewGuard loads previously seen nonces from state; nil keeps them in
+// memory only. now supplies the current time in the sender's clock; nil
+// uses the local clock.
+func NewGuard(state store.Blob, window time.Duration, now func() time.Time) *Guard {
+	if window <= 0 {
+		window = DEFAULT_WINDOW
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	g := &Guard{window: window, state: state, seen: make(map[string]time.Time), now: now}
+	if state != nil {
+		if data, err := state.Load(); err == nil {
+			_ = json.Unmarshal(data, &g.seen)
+		}
+	}
+	return g
+}
+
+// Check accepts a message once: its timestamp must be within the window
+// and its nonce unseen. Accepted nonces are recorded before returning.
+func (g *Guard) Check(nonce string, timestamp time.Time) error {
+	if len(nonce) < MIN_NONCE_LENGTH {
+		return ErrNoNonce
+	}
+
+	now := g.now()
+	age := now.Sub(timestamp)
+	if age > g.window || age < -g.window {
+		return fmt.Errorf("%w (%v old)", ErrStale, age.Round(time.Second))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(now)
+	if _, ok := g.seen[nonce]; ok {
+		return ErrReplayed
+	}
+	g.seen[nonce] = timestamp
+
+	if err := g.save(); err != nil {
+		// Refusing the message is safer than accepting it unrecorded
+		delete(g.seen, nonce)
+		return err
+	}
+	return nil
+}
+
+// Anything older than the window would be rejected as stale anyway
+func (g *Guard) prune(now time.Time) {
+	for nonce, ts := range g.seen {
+		if now.Sub(ts) > g.window {
+			delete(g.seen, nonce)
+		}
+	}
+}
+
+func (g *Guard) save() error {
+	if g.state == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(g.seen)
+	if err != nil {
+		return fmt.Errorf("failed to marshal nonces: %w", err)
+	}
+	if err := g.state.Save(data); err != nil {
+		return fmt.Errorf("failed to store nonces: %w", err)
+	}
+	return nil
+}
+
+// NewNonce returns a random nonce for outgoing messages
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package replay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// memBlob is an in-memory store.Blob
+type memBlob struct {
+	data    []byte
+	saveErr error
+}
+
+func (b *memBlob) Load() ([]byte, error) {
+	if b.data == nil {
+		return nil, errors.New("not found")
+	}
+	return b.data, nil
+}
+
+func (b *memBlob) Save(data []byte) error {
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	b.data = append([]byte(nil), data...)
+	return nil
+}
+
+// clock is a settable time source for the guard
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func TestCheck(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		nonce     string
+		timestamp time.Time
+		want      error
+	}{
+		{"fresh", NewNonce(), now, nil},
+		{"within window in the past", NewNonce(), now.Add(-DEFAULT_WINDOW + time.Second), nil},
+		{"within window in the future", NewNonce(), now.Add(DEFAULT_WINDOW - time.Second), nil},
+		{"too old", NewNonce(), now.Add(-DEFAULT_WINDOW - time.Second), ErrStale},
+		{"too far in the future", NewNonce(), now.Add(DEFAULT_WINDOW + time.Second), ErrStale},
+		{"no nonce", "", now, ErrNoNonce},
+		{"short nonce", "abc", now, ErrNoNonce},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clock{now: now}
+			g := NewGuard(nil, 0, c.Now)
+			if err := g.Check(tt.nonce, tt.timestamp); !errors.Is(err, tt.want) {
+				t.Errorf("Check() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	c := &clock{now: time.Now()}
+	g := NewGuard(nil, 0, c.Now)
+	nonce := NewNonce()
+
+	if err := g.Check(nonce, c.now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check(nonce, c.now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("second Check() error = %v, want %v", err, ErrReplayed)
+	}
+	if err := g.Check(NewNonce(), c.now); err != nil {
+		t.Errorf("Check() with a new nonce: %v", err)
+	}
+}
+
+func TestNoncesSurviveRestart(t *testing.T) {
+	c := &clock{now: time.Now()}
+	state := &memBlob{}
+	nonce := NewNonce()
+
+	if err := NewGuard(state, 0, c.Now).Check(nonce, c.now); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGuard(state, 0, c.Now).Check(nonce, c.now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Check() after restart error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestExpiredNoncesPruned(t *testing.T) {
+	c := &clock{now: time.Now()}
+	g := NewGuard(nil, time.Minute, c.Now)
+
+	if err := g.Check(NewNonce(), c.now); err != nil {
+		t.Fatal(err)
+	}
+	c.now = c.now.Add(2 * time.Minute)
+	if err := g.Check(NewNonce(), c.now); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.seen) != 1 {
+		t.Errorf("%d nonces remembered, want 1", len(g.seen))
+	}
+}
+
+func TestUnsavedNonceRefused(t *testing.T) {
+	c := &clock{now: time.Now()}
+	state := &memBlob{saveErr: errors.New("disk full")}
+	g := NewGuard(state, 0, c.Now)
+	nonce := NewNonce()
+
+	if err := g.Check(nonce, c.now); err == nil {
+		t.Fatal("Check() accepted a nonce it could not record")
+	}
+	// Not recorded, so the retry once storage recovers is not a replay
+	state.saveErr = nil
+	if err := g.Check(nonce, c.now); err != nil {
+		t.Errorf("Check() after storage recovered: %v", err)
+	}
+}
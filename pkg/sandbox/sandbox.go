@@ -0,0 +1,117 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupported is returned when the running kernel or platform cannot
+// enforce the sandbox. Callers should treat it as a warning, not a failure.
+var ErrUnsupported = errors.New("sandboxing is not supported on this system")
+
+// Policy lists the filesystem locations the agent may touch once sandboxed.
+// Everything not listed becomes inaccessible to the process and its children.
+type Policy struct {
+	// ReadWrite paths: config, state, lock file and managed certificate directories
+	ReadWrite []string
+	// ReadOnly paths: system files the agent inspects (os-release, trust stores, /proc)
+	ReadOnly []string
+	// Exec paths: directories holding binaries the agent may run (uname, systemctl)
+	Exec []string
+	// PacketCapture allows the packet socket and eBPF filter of the TLS observer
+	PacketCapture bool
+}
+
+// DefaultPolicy returns the baseline policy for the agent, extended with the
+// given certificate paths and agent-owned directories
+func DefaultPolicy(agentDirs []string, certPaths []string) Policy {
+	readWrite := append([]string{}, agentDirs...)
+	readWrite = append(readWrite, certPaths...)
+
+	return Policy{
+		ReadWrite: dedupe(readWrite),
+		ReadOnly: []string{
+			"/etc",
+			"/proc",
+			"/sys",
+			"/dev",
+			"/run",
+		},
+		Exec: []string{
+			"/usr",
+			"/bin",
+			"/sbin",
+			"/lib",
+			"/lib64",
+		},
+	}
+}
+
+// SystemdDirectives returns the [Service] hardening directives matching the
+// policy, so the unit enforces the same boundaries even where Landlock is
+// unavailable and adds a seccomp syscall filter on top
+func SystemdDirectives(policy Policy) []string {
+	directives := []string{
+		"NoNewPrivileges=yes",
+		"ProtectSystem=strict",
+		"ProtectHome=read-only",
+		"PrivateTmp=yes",
+		"PrivateDevices=yes",
+		"ProtectKernelTunables=yes",
+		"ProtectKernelModules=yes",
+		"ProtectKernelLogs=yes",
+		"ProtectControlGroups=yes",
+		"ProtectClock=yes",
+		"ProtectHostname=yes",
+		"RestrictSUIDSGID=yes",
+		"RestrictRealtime=yes",
+		"RestrictNamespaces=yes",
+		"LockPersonality=yes",
+		"MemoryDenyWriteExecute=yes",
+		"RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK",
+		"SystemCallArchitectures=native",
+		"SystemCallFilter=@system-service",
+		"SystemCallFilter=~@mount @reboot @swap @module @raw-io @debug @cpu-emulation @obsolete",
+		"SystemCallErrorNumber=EPERM",
+	}
+
+	if policy.PacketCapture {
+		directives = append(directives,
+			"RestrictAddressFamilies=AF_PACKET",
+			"SystemCallFilter=bpf",
+		)
+	}
+
+	if len(policy.ReadWrite) > 0 {
+		// Prefix with "-" so missing optional directories don't fail the unit
+		var paths []string
+		for _, path := range policy.ReadWrite {
+			paths = append(paths, "-"+path)
+		}
+		directives = append(directives, "ReadWritePaths="+strings.Join(paths, " "))
+	}
+
+	return directives
+}
+
+// Describe returns a short human-readable summary of the policy for logs
+func Describe(policy Policy) string {
+	return fmt.Sprintf("read-write: %s", strings.Join(policy.ReadWrite, ", "))
+}
+
+func dedupe(paths []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		result = append(result, path)
+	}
+	sort.Strings(result)
+	return result
+}
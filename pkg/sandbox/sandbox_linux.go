@@ -0,0 +1,153 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock syscall numbers are shared by every architecture
+const (
+	SYS_LANDLOCK_CREATE_RULESET = 444
+	SYS_LANDLOCK_ADD_RULE       = 445
+	SYS_LANDLOCK_RESTRICT_SELF  = 446
+
+	LANDLOCK_CREATE_RULESET_VERSION = 1 << 0
+	LANDLOCK_RULE_PATH_BENEATH      = 1
+
+	PR_SET_NO_NEW_PRIVS = 38
+
+	// O_PATH is not exported by package syscall on every architecture
+	O_PATH = 0x200000
+)
+
+// Filesystem access rights (see include/uapi/linux/landlock.h)
+const (
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+	accessRefer      = 1 << 13 // ABI v2
+	accessTruncate   = 1 << 14 // ABI v3
+
+	accessReadOnly  = accessReadFile | accessReadDir
+	accessReadWrite = accessReadOnly | accessWriteFile | accessRemoveDir | accessRemoveFile |
+		accessMakeDir | accessMakeReg | accessMakeSym | accessMakeSock | accessMakeFifo
+)
+
+type rulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// pathBeneathAttr mirrors the packed struct landlock_path_beneath_attr
+type pathBeneathAttr [12]byte
+
+func newPathBeneathAttr(access uint64, fd int32) pathBeneathAttr {
+	var attr pathBeneathAttr
+	*(*uint64)(unsafe.Pointer(&attr[0])) = access
+	*(*int32)(unsafe.Pointer(&attr[8])) = fd
+	return attr
+}
+
+// Apply restricts the current process (all threads) and its future children
+// to the paths in policy using Landlock. It returns ErrUnsupported when the
+// kernel has no Landlock support or the binary links cgo.
+func Apply(policy Policy) error {
+	abi, _, errno := syscall.Syscall(SYS_LANDLOCK_CREATE_RULESET, 0, 0, LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+			return ErrUnsupported
+		}
+		return fmt.Errorf("failed to query landlock ABI: %w", errno)
+	}
+
+	handled := uint64(accessReadWrite | accessExecute | accessMakeChar | accessMakeBlock)
+	readWrite := uint64(accessReadWrite)
+	if abi >= 2 {
+		handled |= accessRefer
+		readWrite |= accessRefer
+	}
+	if abi >= 3 {
+		handled |= accessTruncate
+		readWrite |= accessTruncate
+	}
+
+	attr := rulesetAttr{handledAccessFS: handled}
+	fd, _, errno := syscall.Syscall(SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %w", errno)
+	}
+	rulesetFD := int(fd)
+	defer syscall.Close(rulesetFD)
+
+	for _, path := range policy.ReadWrite {
+		if err := addPathRule(rulesetFD, path, readWrite); err != nil {
+			return err
+		}
+	}
+	for _, path := range policy.ReadOnly {
+		if err := addPathRule(rulesetFD, path, accessReadOnly); err != nil {
+			return err
+		}
+	}
+	for _, path := range policy.Exec {
+		if err := addPathRule(rulesetFD, path, accessReadOnly|accessExecute); err != nil {
+			return err
+		}
+	}
+
+	// Landlock requires no_new_privs, and both calls must reach every thread
+	// the Go runtime has already started. The runtime can only do that when
+	// it started every thread itself, which rules out builds linking cgo.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("%w: binary was built with cgo (build with CGO_ENABLED=0)", ErrUnsupported)
+		}
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(SYS_LANDLOCK_RESTRICT_SELF, uintptr(rulesetFD), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %w", errno)
+	}
+
+	return nil
+}
+
+// addPathRule grants access beneath path. Missing paths are skipped since
+// optional directories (e.g. /lib64) don't exist on every distribution.
+func addPathRule(rulesetFD int, path string, access uint64) error {
+	fd, err := syscall.Open(path, O_PATH|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s for landlock rule: %w", path, err)
+	}
+	defer syscall.Close(fd)
+
+	// Directory-only rights are rejected for regular files
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err == nil && stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= accessExecute | accessWriteFile | accessReadFile | accessTruncate
+	}
+
+	attr := newPathBeneathAttr(access, int32(fd))
+	if _, _, errno := syscall.Syscall6(SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFD), LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %w", path, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package sandbox
+
+// Apply is a no-op outside Linux
+func Apply(policy Policy) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,145 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+const (
+	CACHE_VERSION = 1
+)
+
+// CacheEntry remembers what a file contained the last time it was parsed.
+// Cert is nil for files that turned out not to hold a certificate.
+type CacheEntry struct {
+	Size    int64                  `json:"size"`
+	ModTime time.Time              `json:"mod_time"`
+	SHA256  string                 `json:"sha256,omitempty"`
+	Cert    *inventory.Certificate `json:"cert,omitempty"`
+}
+
+// Cache lets periodic scans skip files that haven't changed
+type Cache struct {
+	mu      sync.Mutex
+	state   store.Blob
+	entries map[string]*CacheEntry
+	seen    map[string]bool
+}
+
+type cacheFile struct {
+	Version int                    `json:"version"`
+	Entries map[string]*CacheEntry `json:"entries"`
+}
+
+// LoadCache reads the cache from state; a missing or outdated cache yields
+// an empty one so the next scan simply re-parses everything
+func LoadCache(state store.Blob) *Cache {
+	cache := &Cache{
+		state:   state,
+		entries: make(map[string]*CacheEntry),
+		seen:    make(map[string]bool),
+	}
+
+	data, err := state.Load()
+	if err != nil {
+		return cache
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != CACHE_VERSION {
+		return cache
+	}
+	if file.Entries != nil {
+		cache.entries = file.Entries
+	}
+	return cache
+}
+
+// lookup returns the cached entry when size and mtime are unchanged
+func (c *Cache) lookup(path string, info os.FileInfo) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seen[path] = true
+	entry, ok := c.entries[path]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// lookupByHash handles files that were touched but not modified (e.g. by a
+// config management run): hashing is far cheaper than parsing a bundle
+func (c *Cache) lookupByHash(path string, info os.FileInfo) (*CacheEntry, string, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return nil, "", false
+	}
+	if !ok || entry.SHA256 == "" || entry.SHA256 != sum {
+		return nil, sum, false
+	}
+
+	c.store(path, info, sum, entry.Cert)
+	return entry, sum, true
+}
+
+func (c *Cache) store(path string, info os.FileInfo, sum string, cert *inventory.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seen[path] = true
+	c.entries[path] = &CacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  sum,
+		Cert:    cert,
+	}
+}
+
+// Save prunes files not seen during the last scan and writes the cache
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	for path := range c.entries {
+		if !c.seen[path] {
+			delete(c.entries, path)
+		}
+	}
+	data, err := json.Marshal(cacheFile{Version: CACHE_VERSION, Entries: c.entries})
+	c.seen = make(map[string]bool)
+	c.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal scan cache: %w", err)
+	}
+	if err := c.state.Save(data); err != nil {
+		return fmt.Errorf("failed to write scan cache: %w", err)
+	}
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,349 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/limits"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/securedns"
+)
+
+const (
+	// Bundles are streamed, so large trust stores are safe to parse
+	DEFAULT_MAX_FILE_SIZE = 16 << 20
+	ENDPOINT_TIMEOUT      = 5 * time.Second
+
+	// Extension-less files are sniffed for a PEM header in this many bytes
+	SNIFF_SIZE = 512
+)
+
+// Extensions parsed without sniffing
+var certExtensions = map[string]bool{
+	".pem":       true,
+	".crt":       true,
+	".cer":       true,
+	".cert":      true,
+	".ca-bundle": true,
+}
+
+// Directories never worth descending into
+var skippedDirs = map[string]bool{
+	"/proc": true,
+	"/sys":  true,
+	"/dev":  true,
+	"/run":  true,
+}
+
+// Options controls a scan
+type Options struct {
+	Roots     []string
+	Endpoints []string
+	Exclude   []string
+	// Workers bounds concurrent parsers; defaults to the CPUs the agent may
+	// use, and a memory limit caps it further
+	Workers int
+	// FilesPerSecond throttles file opens so scans don't starve the host's
+	// I/O; zero means unthrottled
+	FilesPerSecond int
+	MaxFileSize    int64
+	// Cache, when set, lets unchanged files skip parsing entirely
+	Cache *Cache
+}
+
+// Stats summarizes a completed scan
+type Stats struct {
+	FilesSeen    int64         `json:"files_seen"`
+	FilesParsed  int64         `json:"files_parsed"`
+	CacheHits    int64         `json:"cache_hits"`
+	Certificates int64         `json:"certificates"`
+	Duration     time.Duration `json:"duration"`
+}
+
+// Result is the output of a scan
+type Result struct {
+	Certificates []inventory.Certificate
+	Errors       []string
+	Stats        Stats
+}
+
+type job struct {
+	path     string
+	endpoint string
+	// Extension-less file to check for a PEM header before parsing
+	sniff bool
+}
+
+// Scan walks the roots and probes the endpoints using a bounded worker
+// pool. A single walker feeds candidate files to the workers so directory
+// traversal never fans out unboundedly.
+func Scan(ctx context.Context, opts Options) *Result {
+	start := time.Now()
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DEFAULT_MAX_FILE_SIZE
+	}
+	// Each worker may hold a whole file; together they get a quarter of
+	// the memory limit
+	if limit := limits.Current().MemoryBytes; limit > 0 {
+		opts.Workers = min(opts.Workers, max(1, int(limit/4/opts.MaxFileSize)))
+	}
+
+	jobs := make(chan job, opts.Workers*4)
+	result := &Result{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	var throttle <-chan time.Time
+	if opts.FilesPerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.FilesPerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				limits.Wait(ctx)
+				var cert *inventory.Certificate
+				var err error
+				var cached bool
+				if j.endpoint != "" {
+					cert, err = scanEndpoint(ctx, j.endpoint)
+				} else {
+					if throttle != nil {
+						select {
+						case <-throttle:
+						case <-ctx.Done():
+							continue
+						}
+					}
+					if j.sniff && !sniffPEM(j.path) {
+						if opts.Cache != nil {
+							if info, err := os.Stat(j.path); err == nil {
+								opts.Cache.store(j.path, info, "", nil)
+							}
+						}
+						continue
+					}
+					cert, cached, err = scanFile(j.path, opts.MaxFileSize, opts.Cache)
+				}
+
+				mu.Lock()
+				if cached {
+					result.Stats.CacheHits++
+				} else if j.path != "" {
+					result.Stats.FilesParsed++
+				}
+				if err != nil {
+					result.Errors = append(result.Errors, err.Error())
+				} else if cert != nil {
+					result.Certificates = append(result.Certificates, *cert)
+					result.Stats.Certificates++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, endpoint := range opts.Endpoints {
+		select {
+		case jobs <- job{endpoint: endpoint}:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, root := range opts.Roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if skippedDirs[path] || Excluded(path, opts.Exclude) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || Excluded(path, opts.Exclude) {
+				return nil
+			}
+
+			mu.Lock()
+			result.Stats.FilesSeen++
+			mu.Unlock()
+
+			// Unchanged files are answered from the cache without opening them
+			if opts.Cache != nil {
+				if info, err := d.Info(); err == nil {
+					if entry, ok := opts.Cache.lookup(path, info); ok {
+						mu.Lock()
+						result.Stats.CacheHits++
+						if entry.Cert != nil {
+							result.Certificates = append(result.Certificates, *entry.Cert)
+							result.Stats.Certificates++
+						}
+						mu.Unlock()
+						return nil
+					}
+				}
+			}
+
+			// Sniffing opens the file, so it is left to the throttled workers
+			ok, sniff := isCandidate(path, d)
+			if !ok {
+				if opts.Cache != nil {
+					if info, err := d.Info(); err == nil {
+						opts.Cache.store(path, info, "", nil)
+					}
+				}
+				return nil
+			}
+			select {
+			case jobs <- job{path: path, sniff: sniff}:
+			case <-ctx.Done():
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	result.Stats.Duration = time.Since(start)
+	return result
+}
+
+// HasCertExtension reports whether a file name has an extension used for
+// certificates
+func HasCertExtension(name string) bool {
+	return certExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// isCandidate filters by extension without opening the file. Small
+// extension-less files are candidates too, with sniff set since only their
+// content can tell.
+func isCandidate(path string, d fs.DirEntry) (ok, sniff bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if certExtensions[ext] {
+		return true, false
+	}
+	if ext != "" {
+		return false, false
+	}
+
+	info, err := d.Info()
+	if err != nil || info.Size() == 0 || info.Size() > DEFAULT_MAX_FILE_SIZE {
+		return false, false
+	}
+	return true, true
+}
+
+// sniffPEM reports whether a PEM certificate header appears in the first
+// SNIFF_SIZE bytes of a file
+func sniffPEM(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	buf := make([]byte, SNIFF_SIZE)
+	n, _ := file.Read(buf)
+	return bytes.Contains(buf[:n], []byte("-----BEGIN CERTIFICATE-----"))
+}
+
+// scanFile parses one candidate file, consulting the content hash in the
+// cache first. The boolean reports whether the cache answered.
+func scanFile(path string, maxSize int64, cache *Cache) (*inventory.Certificate, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, nil
+	}
+	if info.Size() > maxSize {
+		return nil, false, nil
+	}
+
+	var sum string
+	if cache != nil {
+		var entry *CacheEntry
+		var hit bool
+		if entry, sum, hit = cache.lookupByHash(path, info); hit {
+			return entry.Cert, true, nil
+		}
+	}
+
+	cert, err := inventory.ParseCertificateFile(path)
+	if err != nil {
+		// Keys, CSRs and other PEM files share extensions with certificates
+		cert = nil
+	}
+	if cache != nil {
+		cache.store(path, info, sum, cert)
+	}
+	return cert, false, nil
+}
+
+func scanEndpoint(ctx context.Context, endpoint string) (*inventory.Certificate, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if ascii, err := idn.ToASCII(host); err == nil {
+		host = ascii
+	}
+
+	dialer := &netdial.Dialer{Timeout: ENDPOINT_TIMEOUT, Resolver: securedns.Resolver()}
+	ctx, cancel := context.WithTimeout(ctx, ENDPOINT_TIMEOUT)
+	defer cancel()
+
+	conn, err := dialer.DialTLS(ctx, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+	defer conn.Close()
+
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("endpoint %s presented no certificate", endpoint)
+	}
+
+	cert := inventory.Describe(chain[0])
+	cert.Endpoint = endpoint
+	cert.ChainLength = len(chain)
+	return &cert, nil
+}
+
+// Excluded reports whether path, or its base name, matches one of the
+// exclude patterns
+func Excluded(path string, patterns []string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, base); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package scripts
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// isolate runs the script in its own process group (so a timeout kills
+// every child) and, when the agent is root, as an unprivileged user
+func isolate(cmd *exec.Cmd, runAs, scratch string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	if os.Geteuid() != 0 || runAs == "" || runAs == "root" {
+		return nil
+	}
+
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return fmt.Errorf("failed to look up script user %s: %w", runAs, err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if err := os.Chown(scratch, uid, gid); err != nil {
+		return fmt.Errorf("failed to hand scratch directory to %s: %w", runAs, err)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
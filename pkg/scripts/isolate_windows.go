@@ -0,0 +1,12 @@
+//go:build windows
+
+package scripts
+
+import (
+	"os/exec"
+)
+
+// isolate has no privilege drop on Windows; scripts run as the agent
+func isolate(cmd *exec.Cmd, runAs, scratch string) error {
+	return nil
+}
@@ -0,0 +1,305 @@
+package scripts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_RUN_SCRIPT = "script.run"
+
+	DEFAULT_TIMEOUT = 60 * time.Second
+	MAX_TIMEOUT     = 10 * time.Minute
+	MAX_SCRIPT_SIZE = 256 * 1024
+	MAX_OUTPUT_SIZE = 64 * 1024
+
+	// Domain separation so a script signature can't be reused elsewhere
+	SIGNATURE_CONTEXT = "certfix-script-v2"
+	// A signed script can be replayed until it expires, so signatures may
+	// not be valid for longer than this
+	MAX_SIGNATURE_VALIDITY = 24 * time.Hour
+)
+
+// Interpreters a script may request
+var allowedInterpreters = map[string]bool{
+	"/bin/sh":   true,
+	"/bin/bash": true,
+}
+
+// RunRequest is the payload of a script.run task
+type RunRequest struct {
+	Name           string   `json:"name"`
+	Interpreter    string   `json:"interpreter"`
+	Args           []string `json:"args,omitempty"`
+	Script         string   `json:"script"`
+	Signature      string   `json:"signature"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+	// Signed along with the script; required
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RunResult captures the full outcome of a script
+type RunResult struct {
+	Name            string `json:"name"`
+	ExitCode        int    `json:"exit_code"`
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	Truncated       bool   `json:"truncated,omitempty"`
+	TimedOut        bool   `json:"timed_out,omitempty"`
+	DurationMillis  int64  `json:"duration_ms"`
+	SignatureKeyIdx int    `json:"signature_key_index"`
+}
+
+// Runner executes signed scripts in a restricted environment
+type Runner struct {
+	keys    []ed25519.PublicKey
+	runAs   string
+	workDir string
+	audit   *audit.Logger
+}
+
+// NewRunner loads the trusted Ed25519 public keys (PEM files). Scripts run
+// as runAs (when the agent is root) inside a scratch directory under workDir.
+func NewRunner(keyFiles []string, runAs, workDir string, auditLog *audit.Logger) (*Runner, error) {
+	runner := &Runner{runAs: runAs, workDir: workDir, audit: auditLog}
+
+	for _, path := range keyFiles {
+		key, err := LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		runner.keys = append(runner.keys, key)
+	}
+	if len(runner.keys) == 0 {
+		return nil, errors.New("no script signing keys configured")
+	}
+
+	return runner, nil
+}
+
+// LoadPublicKey reads a PKIX PEM-encoded Ed25519 public key
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not Ed25519", path)
+	}
+	return key, nil
+}
+
+// SignedMessage returns the bytes covered by a script signature. The
+// interpreter, arguments and expiry are included so they can't be swapped.
+// Every field is length-prefixed, so no field can absorb part of the next.
+func SignedMessage(req *RunRequest) []byte {
+	fields := []string{
+		req.Name,
+		req.Interpreter,
+		req.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(len(req.Args)),
+	}
+	fields = append(fields, req.Args...)
+	fields = append(fields, req.Script)
+
+	var b []byte
+	b = append(b, SIGNATURE_CONTEXT...)
+	for _, field := range fields {
+		b = append(b, fmt.Sprintf("\n%d:", len(field))...)
+		b = append(b, field...)
+	}
+	return b
+}
+
+// Register installs the script.run task handler
+func (r *Runner) Register(registry *tasks.Registry) {
+	registry.Register(TASK_RUN_SCRIPT, r.handle)
+}
+
+func (r *Runner) handle(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req RunRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	result, err := r.run(ctx, &req)
+
+	entry := audit.Entry{
+		TaskID:  task.ID,
+		Action:  TASK_RUN_SCRIPT,
+		Target:  req.Name,
+		Outcome: tasks.STATUS_SUCCEEDED,
+	}
+	if result != nil {
+		entry.Details = map[string]string{"exit_code": fmt.Sprint(result.ExitCode)}
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := r.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", task.ID, err)
+	}
+
+	return result, err
+}
+
+// verify checks the signature against every trusted key
+func (r *Runner) verify(req *RunRequest) (int, error) {
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return -1, tasks.Rejectf("malformed signature")
+	}
+
+	message := SignedMessage(req)
+	keyIdx := -1
+	for i, key := range r.keys {
+		if ed25519.Verify(key, message, signature) {
+			keyIdx = i
+			break
+		}
+	}
+	if keyIdx < 0 {
+		return -1, tasks.Rejectf("signature does not match any trusted key")
+	}
+
+	// Checked after the signature, since the expiry is only trusted once signed
+	now := time.Now()
+	switch {
+	case req.ExpiresAt.IsZero():
+		return -1, tasks.Rejectf("script signature has no expiry")
+	case now.After(req.ExpiresAt):
+		return -1, tasks.Rejectf("script signature expired at %s", req.ExpiresAt.Format(time.RFC3339))
+	case req.ExpiresAt.Sub(now) > MAX_SIGNATURE_VALIDITY:
+		return -1, tasks.Rejectf("script signature is valid for longer than %s", MAX_SIGNATURE_VALIDITY)
+	}
+	return keyIdx, nil
+}
+
+func (r *Runner) run(ctx context.Context, req *RunRequest) (*RunResult, error) {
+	if len(req.Script) > MAX_SCRIPT_SIZE {
+		return nil, tasks.Rejectf("script is %d bytes, limit is %d", len(req.Script), MAX_SCRIPT_SIZE)
+	}
+	if !allowedInterpreters[req.Interpreter] {
+		return nil, tasks.Rejectf("interpreter %q is not allowed", req.Interpreter)
+	}
+
+	keyIdx, err := r.verify(req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := DEFAULT_TIMEOUT
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout > MAX_TIMEOUT {
+			timeout = MAX_TIMEOUT
+		}
+	}
+
+	if err := os.MkdirAll(r.workDir, 0711); err != nil {
+		return nil, fmt.Errorf("failed to create script directory: %w", err)
+	}
+	scratch, err := os.MkdirTemp(r.workDir, "run-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	scriptPath := filepath.Join(scratch, "script")
+	if err := os.WriteFile(scriptPath, []byte(req.Script), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write script: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, req.Interpreter, append([]string{scriptPath}, req.Args...)...)
+	cmd.Dir = scratch
+	// Scripts get a minimal environment; the agent's own env may hold secrets
+	cmd.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=" + scratch,
+		"LANG=C",
+		"CERTFIX_SCRIPT_NAME=" + req.Name,
+	}
+	stdout := &limitedBuffer{limit: MAX_OUTPUT_SIZE}
+	stderr := &limitedBuffer{limit: MAX_OUTPUT_SIZE}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := isolate(cmd, r.runAs, scratch); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	runErr := cmd.Run()
+	if cmd.ProcessState == nil {
+		return nil, fmt.Errorf("failed to start script: %w", runErr)
+	}
+
+	result := &RunResult{
+		Name:            req.Name,
+		Stdout:          stdout.String(),
+		Stderr:          stderr.String(),
+		Truncated:       stdout.truncated || stderr.truncated,
+		TimedOut:        errors.Is(ctx.Err(), context.DeadlineExceeded),
+		DurationMillis:  time.Since(start).Milliseconds(),
+		SignatureKeyIdx: keyIdx,
+		ExitCode:        cmd.ProcessState.ExitCode(),
+	}
+
+	if result.TimedOut {
+		return result, fmt.Errorf("script timed out after %v", timeout)
+	}
+	if runErr != nil {
+		return result, fmt.Errorf("script exited with code %d", result.ExitCode)
+	}
+	return result, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := b.limit - b.Len()
+	if remaining <= 0 {
+		b.truncated = true
+		return len(p), nil
+	}
+	if len(p) > remaining {
+		b.truncated = true
+		b.Buffer.Write(p[:remaining])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,143 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// grpcService implements envoy.service.secret.v3.SecretDiscoveryService
+// over the state-of-the-world protocol: every response carries all the
+// requested secrets, and a new one is pushed whenever the store changes
+type grpcService struct {
+	secretservice.UnimplementedSecretDiscoveryServiceServer
+	store *Store
+}
+
+// NewGRPCServer returns a gRPC server exposing the store over SDS
+func NewGRPCServer(store *Store) *grpc.Server {
+	server := grpc.NewServer()
+	secretservice.RegisterSecretDiscoveryServiceServer(server, &grpcService{store: store})
+	return server
+}
+
+func (g *grpcService) FetchSecrets(ctx context.Context, req *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	if req.GetTypeUrl() != "" && req.GetTypeUrl() != SECRET_TYPE_URL {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported type_url %q", req.GetTypeUrl())
+	}
+	return g.response(req.GetResourceNames(), "")
+}
+
+func (g *grpcService) StreamSecrets(stream secretservice.SecretDiscoveryService_StreamSecretsServer) error {
+	ctx := stream.Context()
+	requests := make(chan *discovery.DiscoveryRequest)
+	received := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		names       []string
+		subscribed  bool
+		sentVersion string
+		sentNonce   string
+		nonce       int
+	)
+	send := func() error {
+		nonce++
+		resp, err := g.response(names, strconv.Itoa(nonce))
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		sentVersion, sentNonce = resp.VersionInfo, resp.Nonce
+		return nil
+	}
+
+	for {
+		// Taken before comparing versions, so no change slips in between
+		changed := g.store.Changed()
+		if subscribed && g.store.Version() != sentVersion {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-received:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-changed:
+		case req := <-requests:
+			if req.GetTypeUrl() != "" && req.GetTypeUrl() != SECRET_TYPE_URL {
+				return status.Errorf(codes.InvalidArgument, "unsupported type_url %q", req.GetTypeUrl())
+			}
+			// A reply to an older response; the newer one is still in flight
+			if req.GetResponseNonce() != sentNonce {
+				continue
+			}
+			if detail := req.GetErrorDetail(); detail != nil {
+				// Resending the same version would be rejected again; wait
+				// for the next change
+				log.Printf("[WARNING] SDS: Envoy rejected secrets version %s: %s", sentVersion, detail.GetMessage())
+			}
+			requested := req.GetResourceNames()
+			if !subscribed || !slices.Equal(names, requested) {
+				names = requested
+				subscribed = true
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// response builds the discovery response for names (all secrets if empty)
+func (g *grpcService) response(names []string, nonce string) (*discovery.DiscoveryResponse, error) {
+	version, secrets := g.store.snapshot(names)
+	resp := &discovery.DiscoveryResponse{VersionInfo: version, TypeUrl: SECRET_TYPE_URL, Nonce: nonce}
+	for _, secret := range secrets {
+		resource, err := anypb.New(&tlsv3.Secret{
+			Name: secret.Name,
+			Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: secret.CertChain}},
+				PrivateKey:       &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: secret.PrivateKey}},
+			}},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode secret %s: %v", secret.Name, err)
+		}
+		resp.Resources = append(resp.Resources, resource)
+	}
+	return resp, nil
+}
@@ -0,0 +1,38 @@
+package sds
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the uid and primary gid of the process at the
+// other end of a unix socket
+func peerCredentials(conn net.Conn) (int, int, error) {
+	if conn == nil {
+		return 0, 0, nil
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, fmt.Errorf("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *unix.Xucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	if cred.Ngroups == 0 {
+		return int(cred.Uid), -1, nil
+	}
+	return int(cred.Uid), int(cred.Groups[0]), nil
+}
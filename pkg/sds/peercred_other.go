@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package sds
+
+import "net"
+
+// peerCredentials can't identify peers here, so the server refuses to start
+func peerCredentials(net.Conn) (int, int, error) {
+	return 0, 0, errUnsupported
+}
@@ -0,0 +1,158 @@
+package sds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errUnsupported = errors.New("peer credentials are not available on this platform")
+
+// DiscoveryRequest is the subset of the xDS v3 request Envoy sends
+type DiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+}
+
+// Handler serves REST-JSON SDS from the store
+func Handler(store *Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req DiscoveryRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid discovery request", http.StatusBadRequest)
+			return
+		}
+		if req.TypeURL != "" && req.TypeURL != SECRET_TYPE_URL {
+			http.Error(w, "unsupported type_url", http.StatusBadRequest)
+			return
+		}
+
+		// Envoy polls; an unchanged version_info in the reply is a no-op for it
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Response(req.ResourceNames))
+	})
+	return mux
+}
+
+// Access lists the local users allowed to fetch secrets besides root and
+// the agent's own user. Peers are identified by the kernel (SO_PEERCRED),
+// so a GID matches the connecting process's primary group.
+type Access struct {
+	UIDs []int
+	GIDs []int
+}
+
+func (a Access) empty() bool {
+	return len(a.UIDs) == 0 && len(a.GIDs) == 0
+}
+
+func (a Access) allows(uid, gid int) bool {
+	return uid == 0 || uid == os.Getuid() || slices.Contains(a.UIDs, uid) || slices.Contains(a.GIDs, gid)
+}
+
+// Listen opens the SDS listener on "unix:/path". It serves private keys, so
+// there is no TCP mode: every connection's peer credentials are checked
+// against access. The socket is created inside a private directory and
+// moved into place once its mode is set, so it is never reachable with
+// looser permissions. Only root and the agent can connect unless access
+// names other users, in which case anyone may connect and the credentials
+// alone decide.
+func Listen(address string, access Access) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid SDS address %q: want unix:/path, since it serves private keys", address)
+	}
+	if _, _, err := peerCredentials(nil); errors.Is(err, errUnsupported) {
+		return nil, fmt.Errorf("SDS server: %w", err)
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sds-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SDS socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	// The socket moves away from tmp, so Close must not unlink by name
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	mode := os.FileMode(0600)
+	if !access.empty() {
+		mode = 0666
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	os.Remove(path)
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return &peerListener{Listener: listener, access: access, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// peerListener drops connections from processes access doesn't allow
+type peerListener struct {
+	net.Listener
+	access Access
+	addr   net.Addr
+}
+
+// Addr is where the socket was moved to
+func (l *peerListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, gid, err := peerCredentials(conn)
+		if err == nil && l.access.allows(uid, gid) {
+			return conn, nil
+		}
+		if err != nil {
+			log.Printf("[WARNING] SDS: connection refused: %v", err)
+		} else {
+			log.Printf("[WARNING] SDS: connection from uid %d gid %d refused", uid, gid)
+		}
+		conn.Close()
+	}
+}
+
+// Serve runs the SDS server until the listener is closed: gRPC, or with
+// rest, REST-JSON
+func Serve(listener net.Listener, store *Store, rest bool) error {
+	log.Printf("[INFO] SDS server listening on %s", listener.Addr())
+	if !rest {
+		return NewGRPCServer(store).Serve(listener)
+	}
+	server := &http.Server{
+		Handler:           Handler(store),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.Serve(listener)
+}
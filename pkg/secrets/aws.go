@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/awsauth"
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	SCHEME_AWS_SECRETS_MANAGER = "aws-sm"
+
+	SECRETS_MANAGER_TIMEOUT = 30 * time.Second
+)
+
+func init() {
+	Register(SCHEME_AWS_SECRETS_MANAGER, newSecretsManager)
+}
+
+// SecretsManagerOptions configure the AWS Secrets Manager provider.
+// Without static keys it uses AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY and
+// then the EC2 instance profile, which needs secretsmanager:GetSecretValue.
+type SecretsManagerOptions struct {
+	// Region defaults to AWS_REGION; ARNs carry their own
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// secretsManagerProvider reads aws-sm:name-or-arn, or one field of a JSON
+// secret with aws-sm:name#field
+type secretsManagerProvider struct {
+	opts   SecretsManagerOptions
+	client *http.Client
+	creds  *awsauth.Source
+}
+
+func newSecretsManager(options json.RawMessage) (Provider, error) {
+	var opts SecretsManagerOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Region == "" {
+		opts.Region = os.Getenv("AWS_REGION")
+	}
+	if opts.Region == "" {
+		opts.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	creds := awsauth.FromEnvironment()
+	if opts.AccessKeyID != "" {
+		creds = &awsauth.Credentials{AccessKeyID: opts.AccessKeyID, SecretAccessKey: opts.SecretAccessKey, Token: opts.SessionToken}
+	}
+	if creds != nil && creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("aws-sm provider requires secret_access_key with access_key_id")
+	}
+	if creds != nil {
+		redact.AddSecret(creds.SecretAccessKey)
+	}
+	return &secretsManagerProvider{opts: opts, client: httpclient.New(SECRETS_MANAGER_TIMEOUT), creds: awsauth.NewSource(creds)}, nil
+}
+
+func (s *secretsManagerProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	id, field := splitField(ref)
+	region := s.opts.Region
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return "", fmt.Errorf("no region: set region or AWS_REGION, or use the secret's ARN")
+	}
+
+	creds, err := s.creds.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsauth.SignV4(req, body, creds, region, "secretsmanager", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("secrets manager unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Type != "" {
+			return "", fmt.Errorf("GetSecretValue failed: %s: %s", apiErr.Type, apiErr.Message)
+		}
+		return "", fmt.Errorf("GetSecretValue failed with status %d", resp.StatusCode)
+	}
+	var result struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("failed to parse GetSecretValue response: %w", err)
+	}
+	if result.SecretString == nil {
+		return "", fmt.Errorf("binary secrets are not supported")
+	}
+	if field == "" {
+		return *result.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(*result.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	return pickField(fields, field)
+}
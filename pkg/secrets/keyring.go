@@ -0,0 +1,27 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const SCHEME_KEYRING = "keyring"
+
+func init() {
+	Register(SCHEME_KEYRING, func(json.RawMessage) (Provider, error) { return keyringProvider{}, nil })
+}
+
+// keyringProvider reads keyring:service/account from the OS keyring: the
+// Secret Service (secret-tool) on Linux, the keychain on macOS and the
+// Credential Manager on Windows
+type keyringProvider struct{}
+
+func (keyringProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	service, account, _ := strings.Cut(ref, "/")
+	if service == "" {
+		return "", fmt.Errorf("want keyring:service/account")
+	}
+	return keyringLookup(ctx, service, account)
+}
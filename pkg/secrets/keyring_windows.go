@@ -0,0 +1,72 @@
+//go:build windows
+
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const CRED_TYPE_GENERIC = 1
+
+var (
+	advapi32      = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// The service is the generic credential's target name; an account must
+// match its user name
+func keyringLookup(ctx context.Context, service, account string) (string, error) {
+	target, err := windows.UTF16PtrFromString(service)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), CRED_TYPE_GENERIC, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return "", fmt.Errorf("CredRead: %w", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	if account != "" && windows.UTF16PtrToString(cred.UserName) != account {
+		return "", fmt.Errorf("credential belongs to another account")
+	}
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return decodeBlob(blob), nil
+}
+
+// Credential Manager stores passwords as UTF-16, other tools often UTF-8;
+// UTF-16 text has NUL bytes, UTF-8 text never does
+func decodeBlob(blob []byte) string {
+	if len(blob)%2 != 0 || (utf8.Valid(blob) && !bytes.Contains(blob, []byte{0})) {
+		return string(blob)
+	}
+	units := make([]uint16, len(blob)/2)
+	for i := range units {
+		units[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
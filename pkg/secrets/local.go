@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	SCHEME_ENV  = "env"
+	SCHEME_FILE = "file"
+
+	// Secret files larger than this are refused
+	MAX_SECRET_FILE = 64 << 10
+)
+
+func init() {
+	Register(SCHEME_ENV, func(json.RawMessage) (Provider, error) { return envProvider{}, nil })
+	Register(SCHEME_FILE, func(json.RawMessage) (Provider, error) { return fileProvider{}, nil })
+}
+
+// envProvider reads env:NAME from the agent's environment, e.g. set with
+// a systemd drop-in's Environment= or EnvironmentFile=
+type envProvider struct{}
+
+func (envProvider) Resolve(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable is not set")
+	}
+	return value, nil
+}
+
+// fileProvider reads file:/path, such as a systemd credential or a
+// mounted Kubernetes secret, without its trailing newline
+type fileProvider struct{}
+
+func (fileProvider) Resolve(ctx context.Context, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > MAX_SECRET_FILE {
+		return "", fmt.Errorf("file is larger than %d bytes", MAX_SECRET_FILE)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
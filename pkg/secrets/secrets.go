@@ -0,0 +1,178 @@
+// Package secrets resolves references to secrets kept outside the agent
+// config, such as keystore passwords. A reference is "scheme:name" with a
+// registered scheme (env:KEYSTORE_PASS, vault:secret/data/tomcat#password);
+// any other value is used as it is, so plaintext settings keep working.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+// Provider looks up the secret a reference names; ref is what follows the
+// scheme
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// Factory builds a provider from its options in the agent config, which
+// are empty when it has none there
+type Factory func(options json.RawMessage) (Provider, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a provider available under a scheme. Built-in providers
+// register themselves from init.
+func Register(scheme string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[scheme] = factory
+}
+
+// Schemes lists the registered schemes
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var schemes []string
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsReference reports whether value names a secret rather than being one
+func IsReference(value string) bool {
+	scheme, _, found := strings.Cut(value, ":")
+	if !found {
+		return false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := factories[scheme]
+	return ok
+}
+
+// Resolver resolves references with the configured provider options.
+// Providers are built on first use, so one that is never referenced can't
+// fail the agent.
+type Resolver struct {
+	options map[string]json.RawMessage
+
+	mu        sync.Mutex
+	providers map[string]Provider
+}
+
+// NewResolver takes provider options by scheme. Options for a scheme that
+// doesn't exist are an error, to catch typos.
+func NewResolver(options map[string]json.RawMessage) (*Resolver, error) {
+	for scheme := range options {
+		mu.RLock()
+		_, ok := factories[scheme]
+		mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown secrets provider %q (available: %s)", scheme, strings.Join(Schemes(), ", "))
+		}
+	}
+	return &Resolver{options: options, providers: map[string]Provider{}}, nil
+}
+
+// Resolve returns the secret value names, or value itself when it isn't a
+// reference. Either way the value is redacted from logs and reports. A
+// nil resolver resolves with the providers' defaults.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsReference(value) {
+		redact.AddSecret(value)
+		return value, nil
+	}
+	scheme, ref, _ := strings.Cut(value, ":")
+	provider, err := r.provider(scheme)
+	if err != nil {
+		return "", err
+	}
+	secret, err := provider.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s secret %q: %w", scheme, ref, err)
+	}
+	redact.AddSecret(secret)
+	return secret, nil
+}
+
+func (r *Resolver) provider(scheme string) (Provider, error) {
+	if r == nil {
+		r = &Resolver{providers: map[string]Provider{}}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if provider, ok := r.providers[scheme]; ok {
+		return provider, nil
+	}
+	mu.RLock()
+	factory := factories[scheme]
+	mu.RUnlock()
+	provider, err := factory(r.options[scheme])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s secrets provider: %w", scheme, err)
+	}
+	r.providers[scheme] = provider
+	return provider, nil
+}
+
+// splitField splits "path#field" into the path and the field to pick from
+// a structured secret
+func splitField(ref string) (string, string) {
+	path, field, _ := strings.Cut(ref, "#")
+	return path, field
+}
+
+// pickField returns one string field of a JSON object secret; without a
+// field the object must have exactly one
+func pickField(data map[string]interface{}, field string) (string, error) {
+	if field == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("secret has %d fields; name one with #field", len(data))
+		}
+		for _, value := range data {
+			return stringValue(value)
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	return stringValue(value)
+}
+
+func stringValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number, float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("secret field is not a string")
+	}
+}
+
+// decodeOptions rejects unknown fields so credential typos fail loudly
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid provider options: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/httpclient"
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	SCHEME_VAULT = "vault"
+
+	VAULT_TIMEOUT = 30 * time.Second
+)
+
+func init() {
+	Register(SCHEME_VAULT, newVault)
+}
+
+// VaultOptions configure the Vault provider; unset fields fall back to
+// VAULT_ADDR, VAULT_TOKEN, VAULT_NAMESPACE and VAULT_CACERT
+type VaultOptions struct {
+	Address string `json:"address,omitempty"`
+	// TokenFile is read on every lookup, so a Vault Agent sink can renew it
+	TokenFile  string `json:"token_file,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	RootCAFile string `json:"root_ca_file,omitempty"`
+}
+
+// vaultProvider reads vault:mount/path#field through the HTTP API. KV v2
+// paths include data/ (secret/data/tomcat); both KV versions work.
+type vaultProvider struct {
+	opts   VaultOptions
+	client *http.Client
+}
+
+func newVault(options json.RawMessage) (Provider, error) {
+	var opts VaultOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Address == "" {
+		opts.Address = os.Getenv("VAULT_ADDR")
+	}
+	if opts.Address == "" {
+		return nil, fmt.Errorf("vault provider requires address or VAULT_ADDR")
+	}
+	if opts.Token == "" && opts.TokenFile == "" {
+		opts.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if opts.Token == "" && opts.TokenFile == "" {
+		return nil, fmt.Errorf("vault provider requires token, token_file or VAULT_TOKEN")
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if opts.RootCAFile == "" {
+		opts.RootCAFile = os.Getenv("VAULT_CACERT")
+	}
+	redact.AddSecret(opts.Token)
+
+	client := httpclient.New(VAULT_TIMEOUT)
+	if opts.RootCAFile != "" {
+		data, err := os.ReadFile(opts.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.RootCAFile)
+		}
+		transport := httpclient.Transport().Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client = &http.Client{Transport: transport, Timeout: VAULT_TIMEOUT}
+	}
+	return &vaultProvider{opts: opts, client: client}, nil
+}
+
+func (v *vaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, field := splitField(ref)
+	token, err := v.token()
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimRight(v.opts.Address, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.opts.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var result struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	json.Unmarshal(body, &result)
+	if resp.StatusCode != http.StatusOK {
+		if len(result.Errors) > 0 {
+			return "", fmt.Errorf("vault returned status %d: %s", resp.StatusCode, strings.Join(result.Errors, "; "))
+		}
+		return "", fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+
+	// KV v2 wraps the secret with its metadata
+	data := result.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = inner
+		}
+	}
+	return pickField(data, field)
+}
+
+func (v *vaultProvider) token() (string, error) {
+	if v.opts.TokenFile == "" {
+		return v.opts.Token, nil
+	}
+	data, err := os.ReadFile(v.opts.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token_file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	redact.AddSecret(token)
+	return token, nil
+}
@@ -0,0 +1,118 @@
+package securedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	CONTENT_TYPE = "application/dns-message"
+	MAX_MESSAGE  = 65535
+)
+
+// httpsConn carries the resolver's length-prefixed messages over DNS over
+// HTTPS: each complete query written is sent as one POST, and its answer
+// is read back with the same framing
+type httpsConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	out      bytes.Buffer
+	in       bytes.Buffer
+}
+
+func (c *httpsConn) Write(b []byte) (int, error) {
+	c.out.Write(b)
+	for c.out.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.out.Bytes()))
+		if c.out.Len() < 2+size {
+			break
+		}
+		query := make([]byte, size)
+		c.out.Next(2)
+		c.out.Read(query)
+		answer, err := c.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		c.in.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+		c.in.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *httpsConn) Read(b []byte) (int, error) {
+	if c.in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.in.Read(b)
+}
+
+func (c *httpsConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	req.Header.Set("Accept", CONTENT_TYPE)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", c.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver %s answered %s", c.url, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, MAX_MESSAGE+1))
+	if err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", c.url, err)
+	}
+	if len(answer) > MAX_MESSAGE {
+		return nil, fmt.Errorf("resolver %s sent an oversized answer", c.url)
+	}
+	return answer, nil
+}
+
+func (c *httpsConn) Close() error {
+	return nil
+}
+
+func (c *httpsConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *httpsConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *httpsConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *httpsConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *httpsConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return SCHEME_HTTPS }
+func (a dohAddr) String() string  { return string(a) }
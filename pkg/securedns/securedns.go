@@ -0,0 +1,153 @@
+// Package securedns sends the agent's own DNS lookups to a DNS over HTTPS
+// (RFC 8484) or DNS over TLS (RFC 7858) resolver, for hosts whose local DNS
+// is split-horizon or unreliable. The lookups go through a regular
+// *net.Resolver, so callers use it like the system's.
+package securedns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/netdial"
+)
+
+const (
+	SCHEME_HTTPS = "https"
+	SCHEME_TLS   = "tls"
+
+	DEFAULT_DOT_PORT  = "853"
+	DIAL_TIMEOUT      = 5 * time.Second
+	QUERY_TIMEOUT     = 5 * time.Second
+	IDLE_CONN_TIMEOUT = 90 * time.Second
+)
+
+// Options describes the resolver to use
+type Options struct {
+	// https://dns.example/dns-query for DNS over HTTPS, tls://dns.example
+	// or tls://dns.example:853 for DNS over TLS
+	Server string
+	// Addresses of the server's host, so reaching it doesn't need a lookup
+	// through the local DNS
+	Bootstrap []string
+}
+
+var current atomic.Pointer[net.Resolver]
+
+// Use makes r the resolver the agent's lookups go through; nil goes back to
+// the system's
+func Use(r *net.Resolver) {
+	current.Store(r)
+}
+
+// Resolver returns the resolver set by Use, or the system's
+func Resolver() *net.Resolver {
+	if r := current.Load(); r != nil {
+		return r
+	}
+	return net.DefaultResolver
+}
+
+// New returns a resolver sending every query to the server in opts
+func New(opts Options) (*net.Resolver, error) {
+	server, err := url.Parse(opts.Server)
+	if err != nil || server.Host == "" {
+		return nil, fmt.Errorf("invalid resolver %q", opts.Server)
+	}
+	bootstrap := opts.Bootstrap
+	for _, addr := range bootstrap {
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q", addr)
+		}
+	}
+
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch server.Scheme {
+	case SCHEME_HTTPS:
+		dial = httpsDialer(server, bootstrap)
+	case SCHEME_TLS:
+		if server.Port() == "" {
+			server.Host = net.JoinHostPort(server.Hostname(), DEFAULT_DOT_PORT)
+		}
+		dial = tlsDialer(server.Host, bootstrap)
+	default:
+		return nil, fmt.Errorf("unsupported resolver %q: use https:// for DNS over HTTPS or tls:// for DNS over TLS", opts.Server)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		// The address is the system's name server and is ignored. A
+		// connection that isn't a net.PacketConn makes the resolver frame
+		// messages as over TCP, which is also what DNS over TLS expects.
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}, nil
+}
+
+// dialHost connects to address, racing the bootstrap addresses instead of
+// looking up its host when there are any
+func dialHost(ctx context.Context, address string, bootstrap []string) (net.Conn, error) {
+	dialer := &netdial.Dialer{Timeout: DIAL_TIMEOUT}
+	if len(bootstrap) == 0 {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialAddrs(ctx, "tcp", bootstrap, port)
+}
+
+// tlsDialer opens a DNS over TLS connection for each exchange
+func tlsDialer(address string, bootstrap []string) func(ctx context.Context) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialHost(ctx, address, bootstrap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach resolver %s: %w", address, err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with resolver %s failed: %w", address, err)
+		}
+		return tlsConn, nil
+	}
+}
+
+// httpsDialer returns connections that POST each query to the DNS over
+// HTTPS endpoint; the HTTP connections underneath are pooled
+func httpsDialer(endpoint *url.URL, bootstrap []string) func(ctx context.Context) (net.Conn, error) {
+	address := endpoint.Host
+	if endpoint.Port() == "" {
+		address = net.JoinHostPort(endpoint.Hostname(), "443")
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr != address {
+					// A proxy from the environment
+					dialer := &netdial.Dialer{Timeout: DIAL_TIMEOUT}
+					return dialer.DialContext(ctx, network, addr)
+				}
+				return dialHost(ctx, address, bootstrap)
+			},
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     IDLE_CONN_TIMEOUT,
+		},
+		Timeout: QUERY_TIMEOUT,
+	}
+	url := endpoint.String()
+	return func(ctx context.Context) (net.Conn, error) {
+		return &httpsConn{ctx: ctx, client: client, url: url}, nil
+	}
+}
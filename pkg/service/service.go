@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	ACTION_RELOAD  = "reload"
+	ACTION_RESTART = "restart"
+
+	COMMAND_TIMEOUT = 60 * time.Second
+)
+
+// ErrUnsupported is returned when the init system cannot perform an action
+var ErrUnsupported = errors.New("action not supported by this service manager")
+
+var serviceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._-]*$`)
+
+// Manager controls system services through the platform's init system
+type Manager interface {
+	// Name identifies the init system (systemd, launchd, scm, sysv)
+	Name() string
+	Reload(ctx context.Context, service string) error
+	Restart(ctx context.Context, service string) error
+	// Status returns a short state string such as "active" or "running"
+	Status(ctx context.Context, service string) (string, error)
+}
+
+// Detect returns the service manager for the running system
+func Detect() Manager {
+	switch runtime.GOOS {
+	case "windows":
+		return scmManager{}
+	case "darwin":
+		return launchdManager{}
+	}
+
+	// systemd creates this directory when it is PID 1
+	if info, err := os.Stat("/run/systemd/system"); err == nil && info.IsDir() {
+		return systemdManager{}
+	}
+	return sysvManager{}
+}
+
+// ValidateName rejects names that could be interpreted as options or paths
+func ValidateName(service string) error {
+	if !serviceNameRe.MatchString(service) {
+		return fmt.Errorf("invalid service name %q", service)
+	}
+	return nil
+}
+
+// Apply runs action (reload or restart) for service
+func Apply(ctx context.Context, m Manager, action, service string) error {
+	if err := ValidateName(service); err != nil {
+		return err
+	}
+
+	switch action {
+	case ACTION_RELOAD:
+		return m.Reload(ctx, service)
+	case ACTION_RESTART:
+		return m.Restart(ctx, service)
+	default:
+		return fmt.Errorf("unknown service action %q", action)
+	}
+}
+
+type systemdManager struct{}
+
+func (systemdManager) Name() string { return "systemd" }
+
+func (systemdManager) Reload(ctx context.Context, service string) error {
+	return run(ctx, "systemctl", "reload", service)
+}
+
+func (systemdManager) Restart(ctx context.Context, service string) error {
+	return run(ctx, "systemctl", "restart", service)
+}
+
+func (systemdManager) Status(ctx context.Context, service string) (string, error) {
+	// is-active exits non-zero for inactive units but still prints the state
+	output, _ := output(ctx, "systemctl", "is-active", service)
+	if output == "" {
+		return "", fmt.Errorf("failed to query %s", service)
+	}
+	return output, nil
+}
+
+// launchdManager addresses daemons in the system domain by label
+type launchdManager struct{}
+
+func (launchdManager) Name() string { return "launchd" }
+
+func (launchdManager) Reload(ctx context.Context, service string) error {
+	// launchd has no reload verb; servers conventionally reload on SIGHUP
+	return run(ctx, "launchctl", "kill", "HUP", "system/"+service)
+}
+
+func (launchdManager) Restart(ctx context.Context, service string) error {
+	return run(ctx, "launchctl", "kickstart", "-k", "system/"+service)
+}
+
+func (launchdManager) Status(ctx context.Context, service string) (string, error) {
+	out, err := output(ctx, "launchctl", "print", "system/"+service)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "state = ") {
+			return strings.TrimPrefix(line, "state = "), nil
+		}
+	}
+	return "unknown", nil
+}
+
+// scmManager drives the Windows Service Control Manager via sc.exe
+type scmManager struct{}
+
+func (scmManager) Name() string { return "scm" }
+
+func (m scmManager) Reload(ctx context.Context, service string) error {
+	// SCM has no reload verb; services that re-read their configuration
+	// accept PARAMCHANGE, everything else has to be restarted
+	if err := run(ctx, "sc.exe", "control", service, "paramchange"); err == nil {
+		return nil
+	}
+	return m.Restart(ctx, service)
+}
+
+func (m scmManager) Restart(ctx context.Context, service string) error {
+	// sc.exe stop returns immediately; wait for the stop before starting
+	run(ctx, "sc.exe", "stop", service)
+	for i := 0; i < 30; i++ {
+		if state, _ := m.Status(ctx, service); state == "stopped" {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	return run(ctx, "sc.exe", "start", service)
+}
+
+func (scmManager) Status(ctx context.Context, service string) (string, error) {
+	out, err := output(ctx, "sc.exe", "query", service)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "STATE") {
+			fields := strings.Fields(line)
+			return strings.ToLower(fields[len(fields)-1]), nil
+		}
+	}
+	return "unknown", nil
+}
+
+// sysvManager falls back to the service(8) wrapper on non-systemd Linux
+type sysvManager struct{}
+
+func (sysvManager) Name() string { return "sysv" }
+
+func (sysvManager) Reload(ctx context.Context, service string) error {
+	return run(ctx, "service", service, "reload")
+}
+
+func (sysvManager) Restart(ctx context.Context, service string) error {
+	return run(ctx, "service", service, "restart")
+}
+
+func (sysvManager) Status(ctx context.Context, service string) (string, error) {
+	if err := run(ctx, "service", service, "status"); err != nil {
+		return "stopped", nil
+	}
+	return "running", nil
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
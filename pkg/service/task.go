@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_SERVICE_CONTROL = "service.control"
+)
+
+// DefaultAllowlist is used when the config does not list services
+var DefaultAllowlist = []string{"nginx", "apache2", "httpd", "haproxy", "postfix", "dovecot", "exim4", "tomcat", "tomcat9", "tomcat10"}
+
+// ControlRequest is the payload of a service.control task
+type ControlRequest struct {
+	Service string `json:"service"`
+	Action  string `json:"action"`
+}
+
+// ControlResult reports the service state after the action
+type ControlResult struct {
+	Service string `json:"service"`
+	Action  string `json:"action"`
+	Manager string `json:"manager"`
+	State   string `json:"state,omitempty"`
+}
+
+// TaskHandler executes server-requested reloads/restarts for allowlisted services
+type TaskHandler struct {
+	manager   Manager
+	allowlist map[string]bool
+	audit     *audit.Logger
+}
+
+// NewTaskHandler creates a handler restricted to the given services
+func NewTaskHandler(manager Manager, allowlist []string, auditLog *audit.Logger) *TaskHandler {
+	if len(allowlist) == 0 {
+		allowlist = DefaultAllowlist
+	}
+	allowed := make(map[string]bool)
+	for _, name := range allowlist {
+		allowed[name] = true
+	}
+	return &TaskHandler{manager: manager, allowlist: allowed, audit: auditLog}
+}
+
+// Register installs the service.control task handler
+func (h *TaskHandler) Register(registry *tasks.Registry) {
+	registry.Register(TASK_SERVICE_CONTROL, h.handle)
+}
+
+func (h *TaskHandler) handle(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req ControlRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	result, err := h.control(ctx, req)
+
+	entry := audit.Entry{
+		TaskID:  task.ID,
+		Action:  "service." + req.Action,
+		Target:  req.Service,
+		Outcome: tasks.STATUS_SUCCEEDED,
+		Details: map[string]string{"manager": h.manager.Name()},
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := h.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", task.ID, err)
+	}
+
+	return result, err
+}
+
+func (h *TaskHandler) control(ctx context.Context, req ControlRequest) (*ControlResult, error) {
+	if !h.allowlist[req.Service] {
+		return nil, tasks.Rejectf("service %q is not in the allowlist", req.Service)
+	}
+	if req.Action != ACTION_RELOAD && req.Action != ACTION_RESTART {
+		return nil, tasks.Rejectf("action %q is not allowed", req.Action)
+	}
+
+	if err := Apply(ctx, h.manager, req.Action, req.Service); err != nil {
+		return nil, err
+	}
+
+	result := &ControlResult{
+		Service: req.Service,
+		Action:  req.Action,
+		Manager: h.manager.Name(),
+	}
+	result.State, _ = h.manager.Status(ctx, req.Service)
+	return result, nil
+}
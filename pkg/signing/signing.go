@@ -0,0 +1,178 @@
+// Package signing verifies detached signatures on commands pushed by the
+// server. A root key compiled into the agent signs a manifest of command
+// signing keys, so those can be rotated without shipping a new binary,
+// and a stolen API token alone is never enough to issue commands.
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+)
+
+// rootKey is the base64 Ed25519 root public key, set at build time with
+//
+//	-ldflags "-X github.com/certfix/certfix-agent/pkg/signing.rootKey=<base64>"
+var rootKey = ""
+
+var (
+	ErrNoRootKey    = errors.New("no signing root key compiled into this build")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrBadSignature = errors.New("invalid signature")
+)
+
+// RootKey returns the compiled-in root key, or ErrNoRootKey for builds
+// made without one (development builds)
+func RootKey() (ed25519.PublicKey, error) {
+	if rootKey == "" {
+		return nil, ErrNoRootKey
+	}
+	return decodeKey(rootKey)
+}
+
+// SignedManifest is the envelope served by the API: Payload is a Manifest,
+// and Signature is the root key's signature over the exact Payload bytes
+type SignedManifest struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// Manifest lists the keys currently allowed to sign commands
+type Manifest struct {
+	Version int   `json:"version"`
+	Keys    []Key `json:"keys"`
+}
+
+// Key is one command signing key
+type Key struct {
+	ID        string    `json:"id"`
+	PublicKey string    `json:"public_key"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+}
+
+// Verifier checks command signatures against the current manifest
+type Verifier struct {
+	mu      sync.RWMutex
+	root    ed25519.PublicKey
+	state   store.Blob
+	version int
+	keys    map[string]Key
+}
+
+// NewVerifier creates a verifier trusting root, persisting the accepted
+// manifest in state (nil keeps it in memory only). A previously stored
+// manifest is loaded if still valid.
+func NewVerifier(root ed25519.PublicKey, state store.Blob) *Verifier {
+	v := &Verifier{root: root, state: state, keys: make(map[string]Key)}
+	if state == nil {
+		return v
+	}
+	if data, err := state.Load(); err == nil {
+		// A stored manifest that no longer verifies is simply ignored
+		_ = v.apply(data, false)
+	}
+	return v
+}
+
+// ApplyManifest verifies a signed manifest and adopts it. Older versions
+// are refused so a captured manifest cannot resurrect a retired key.
+func (v *Verifier) ApplyManifest(data []byte) error {
+	return v.apply(data, true)
+}
+
+func (v *Verifier) apply(data []byte, persist bool) error {
+	var signed SignedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("failed to parse key manifest: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(v.root, signed.Payload, sig) {
+		return fmt.Errorf("key manifest: %w", ErrBadSignature)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(signed.Payload, &manifest); err != nil {
+		return fmt.Errorf("failed to parse key manifest payload: %w", err)
+	}
+
+	keys := make(map[string]Key)
+	for _, key := range manifest.Keys {
+		if _, err := decodeKey(key.PublicKey); err != nil {
+			return fmt.Errorf("key manifest: key %s: %w", key.ID, err)
+		}
+		keys[key.ID] = key
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if manifest.Version < v.version {
+		return fmt.Errorf("key manifest version %d is older than current version %d", manifest.Version, v.version)
+	}
+	if manifest.Version == v.version && len(v.keys) > 0 {
+		return nil
+	}
+
+	if persist && v.state != nil {
+		if err := v.state.Save(data); err != nil {
+			return fmt.Errorf("failed to store key manifest: %w", err)
+		}
+	}
+
+	v.version = manifest.Version
+	v.keys = keys
+	return nil
+}
+
+// Version returns the version of the adopted manifest, 0 if none
+func (v *Verifier) Version() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.version
+}
+
+// HasKey reports whether keyID is in the current manifest
+func (v *Verifier) HasKey(keyID string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	_, ok := v.keys[keyID]
+	return ok
+}
+
+// Verify checks a base64 signature over message made by keyID
+func (v *Verifier) Verify(keyID string, message []byte, signature string) error {
+	v.mu.RLock()
+	key, ok := v.keys[keyID]
+	v.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if !key.NotAfter.IsZero() && time.Now().After(key.NotAfter) {
+		return fmt.Errorf("signing key %q expired at %s", keyID, key.NotAfter.Format(time.RFC3339))
+	}
+
+	public, err := decodeKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(public, message, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func decodeKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
@@ -0,0 +1,168 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// memBlob is an in-memory store.Blob
+type memBlob struct{ data []byte }
+
+func (b *memBlob) Load() ([]byte, error) {
+	if b.data == nil {
+		return nil, errors.New("not found")
+	}
+	return b.data, nil
+}
+
+func (b *memBlob) Save(data []byte) error {
+	b.data = append([]byte(nil), data...)
+	return nil
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func signManifest(t *testing.T, root ed25519.PrivateKey, manifest Manifest) []byte {
+	t.Helper()
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(SignedManifest{
+		Payload:   payload,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(root, payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func manifestKey(id string, public ed25519.PublicKey, notAfter time.Time) Key {
+	return Key{ID: id, PublicKey: base64.StdEncoding.EncodeToString(public), NotAfter: notAfter}
+}
+
+func sign(private ed25519.PrivateKey, message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(private, message))
+}
+
+func TestVerify(t *testing.T) {
+	rootPublic, rootPrivate := newKey(t)
+	public, private := newKey(t)
+	v := NewVerifier(rootPublic, nil)
+	manifest := Manifest{Version: 1, Keys: []Key{manifestKey("k1", public, time.Time{})}}
+	if err := v.ApplyManifest(signManifest(t, rootPrivate, manifest)); err != nil {
+		t.Fatalf("ApplyManifest: %v", err)
+	}
+
+	message := []byte("task")
+	if err := v.Verify("k1", message, sign(private, message)); err != nil {
+		t.Errorf("Verify of a valid signature: %v", err)
+	}
+	if err := v.Verify("k1", []byte("other task"), sign(private, message)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verify of another message = %v, want ErrBadSignature", err)
+	}
+	_, stranger := newKey(t)
+	if err := v.Verify("k1", message, sign(stranger, message)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Verify with a key outside the manifest = %v, want ErrBadSignature", err)
+	}
+	if err := v.Verify("k2", message, sign(private, message)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Verify with an unknown key ID = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestManifestSignature(t *testing.T) {
+	rootPublic, rootPrivate := newKey(t)
+	_, forger := newKey(t)
+	public, _ := newKey(t)
+	manifest := Manifest{Version: 1, Keys: []Key{manifestKey("k1", public, time.Time{})}}
+
+	v := NewVerifier(rootPublic, nil)
+	if err := v.ApplyManifest(signManifest(t, forger, manifest)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("manifest signed by another key = %v, want ErrBadSignature", err)
+	}
+
+	// A payload altered after signing must not verify
+	var signed SignedManifest
+	if err := json.Unmarshal(signManifest(t, rootPrivate, manifest), &signed); err != nil {
+		t.Fatal(err)
+	}
+	attacker, _ := newKey(t)
+	tampered, _ := json.Marshal(Manifest{Version: 1, Keys: []Key{manifestKey("k1", attacker, time.Time{})}})
+	signed.Payload = tampered
+	data, _ := json.Marshal(signed)
+	if err := v.ApplyManifest(data); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered manifest = %v, want ErrBadSignature", err)
+	}
+
+	if v.HasKey("k1") || v.Version() != 0 {
+		t.Errorf("rejected manifests were adopted: version %d", v.Version())
+	}
+}
+
+func TestManifestRollback(t *testing.T) {
+	rootPublic, rootPrivate := newKey(t)
+	retired, retiredPrivate := newKey(t)
+	current, _ := newKey(t)
+	old := signManifest(t, rootPrivate, Manifest{Version: 1, Keys: []Key{manifestKey("retired", retired, time.Time{})}})
+	newer := signManifest(t, rootPrivate, Manifest{Version: 2, Keys: []Key{manifestKey("current", current, time.Time{})}})
+
+	state := &memBlob{}
+	v := NewVerifier(rootPublic, state)
+	if err := v.ApplyManifest(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.ApplyManifest(newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.ApplyManifest(old); err == nil {
+		t.Fatal("older manifest was accepted")
+	}
+	message := []byte("task")
+	if err := v.Verify("retired", message, sign(retiredPrivate, message)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("retired key after rollback attempt = %v, want ErrUnknownKey", err)
+	}
+
+	// The adopted version survives a restart, so the rollback stays refused
+	restarted := NewVerifier(rootPublic, state)
+	if restarted.Version() != 2 {
+		t.Fatalf("restored version = %d, want 2", restarted.Version())
+	}
+	if err := restarted.ApplyManifest(old); err == nil {
+		t.Error("older manifest was accepted after a restart")
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	rootPublic, rootPrivate := newKey(t)
+	expired, expiredPrivate := newKey(t)
+	valid, validPrivate := newKey(t)
+	manifest := Manifest{Version: 1, Keys: []Key{
+		manifestKey("expired", expired, time.Now().Add(-time.Minute)),
+		manifestKey("valid", valid, time.Now().Add(time.Hour)),
+	}}
+	v := NewVerifier(rootPublic, nil)
+	if err := v.ApplyManifest(signManifest(t, rootPrivate, manifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("task")
+	if err := v.Verify("expired", message, sign(expiredPrivate, message)); err == nil {
+		t.Error("signature by an expired key was accepted")
+	}
+	if err := v.Verify("valid", message, sign(validPrivate, message)); err != nil {
+		t.Errorf("signature by an unexpired key: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package simulator
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ACME_TIMEOUT = 2 * time.Minute
+)
+
+// issuer produces a certificate, its chain and private key as PEM
+type issuer interface {
+	Issue(names []string) (cert, chain, key []byte, err error)
+	Describe() string
+}
+
+// localIssuer is a throwaway CA created for one simulation
+type localIssuer struct {
+	key  crypto.Signer
+	cert *x509.Certificate
+}
+
+func newLocalIssuer() (*localIssuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "CertFix Simulator CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &localIssuer{key: key, cert: cert}, nil
+}
+
+func (l *localIssuer) Describe() string {
+	return "a local test CA"
+}
+
+func (l *localIssuer) Issue(names []string) ([]byte, []byte, []byte, error) {
+	key, keyPEM, err := newLeafKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, l.cert, key.Public(), l.key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	return encodeCert(der), encodeCert(l.cert.Raw), keyPEM, nil
+}
+
+// acmeIssuer orders certificates from an ACME test server. Pebble must run
+// with PEBBLE_VA_ALWAYS_VALID=1: challenges are accepted but not served.
+type acmeIssuer struct {
+	directory string
+	client    *acme.Client
+}
+
+func newACMEIssuer(directory string) (*acmeIssuer, error) {
+	u, err := url.Parse(directory)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid ACME directory URL %q", directory)
+	}
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Pebble serves its API with a certificate from its own throwaway CA;
+	// only a server on this machine is trusted blindly
+	if isLoopback(u.Hostname()) {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: directory,
+		HTTPClient:   &http.Client{Transport: transport, Timeout: ACME_TIMEOUT},
+		UserAgent:    "certfix-agent-simulator",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ACME_TIMEOUT)
+	defer cancel()
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		return nil, fmt.Errorf("failed to register ACME account at %s: %w", directory, err)
+	}
+	return &acmeIssuer{directory: directory, client: client}, nil
+}
+
+func (a *acmeIssuer) Describe() string {
+	return "ACME server " + a.directory
+}
+
+func (a *acmeIssuer) Issue(names []string) ([]byte, []byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ACME_TIMEOUT)
+	defer cancel()
+
+	var ids []acme.AuthzID
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			ids = append(ids, acme.AuthzID{Type: "ip", Value: name})
+		} else {
+			ids = append(ids, acme.AuthzID{Type: "dns", Value: name})
+		}
+	}
+	order, err := a.client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := a.client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to fetch authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "http-01" {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, nil, nil, fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+		}
+		if _, err := a.client.Accept(ctx, challenge); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to accept challenge: %w", err)
+		}
+		if _, err := a.client.WaitAuthorization(ctx, authzURL); err != nil {
+			return nil, nil, nil, fmt.Errorf("authorization for %s failed: %w", authz.Identifier.Value, err)
+		}
+	}
+
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, nil, fmt.Errorf("order failed: %w", err)
+	}
+
+	key, keyPEM, err := newLeafKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	request := &x509.CertificateRequest{Subject: pkix.Name{CommonName: names[0]}}
+	for _, id := range ids {
+		if id.Type == "ip" {
+			request.IPAddresses = append(request.IPAddresses, net.ParseIP(id.Value))
+		} else {
+			request.DNSNames = append(request.DNSNames, id.Value)
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, request, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	ders, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	var chain []byte
+	for _, der := range ders[1:] {
+		chain = append(chain, encodeCert(der)...)
+	}
+	return encodeCert(ders[0]), chain, keyPEM, nil
+}
+
+func newLeafKey() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
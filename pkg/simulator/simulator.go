@@ -0,0 +1,465 @@
+// Package simulator is an in-process stand-in for the CertFix API, used by
+// 'certfix-agent start --simulate' to exercise registration, inventory,
+// renewal and deployment on a workstation.
+//
+// It implements the endpoints the agent calls, signs its tasks with a
+// throwaway root key, and plays a fixed scenario: once the agent registers
+// it issues a certificate for the host and sends a deploy task, then renews
+// and redeploys it RENEWAL_DELAY after the first deployment succeeded.
+// Certificates come from a local CA, or from an ACME server such as Pebble
+// when a directory URL is given.
+package simulator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/drift"
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/replay"
+	"github.com/certfix/certfix-agent/pkg/signing"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	// Time between the first successful deployment and the renewal
+	RENEWAL_DELAY = 2 * time.Minute
+
+	// Simulated certificates are short-lived so renewal is the norm
+	CERT_VALIDITY = 24 * time.Hour
+
+	INSTANCE_ID = "sim-instance"
+	SIGNING_KEY = "sim-signing-key"
+	CERT_NAME   = "simulated"
+
+	// Inventory chunks are small; this only guards against runaway bodies
+	MAX_BODY_SIZE = 64 << 20
+)
+
+// Options configure a simulated API
+type Options struct {
+	// Token the agent must present in X-API-Key
+	Token string
+	// CertDir receives deployed certificates (traefik target layout)
+	CertDir string
+	// Names on the issued certificates
+	Names []string
+	// ACMEDirectory switches issuance to an ACME server, e.g. Pebble
+	ACMEDirectory string
+}
+
+// Server is a running simulated API
+type Server struct {
+	URL string
+
+	opts     Options
+	root     ed25519.PrivateKey
+	signer   ed25519.PrivateKey
+	manifest []byte
+	issuer   issuer
+	listener net.Listener
+	http     *http.Server
+
+	mu          sync.Mutex
+	uploads     map[string][]inventory.Certificate
+	registered  bool
+	pending     []tasks.Task
+	issued      map[string]string
+	deployed    string
+	renewed     bool
+	taskCounter int
+}
+
+// Start listens on a loopback port and serves the simulated API
+func Start(opts Options) (*Server, error) {
+	if len(opts.Names) == 0 {
+		return nil, fmt.Errorf("simulator needs at least one certificate name")
+	}
+
+	_, root, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate root key: %w", err)
+	}
+	signerPub, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	manifest, err := signedManifest(root, signerPub)
+	if err != nil {
+		return nil, err
+	}
+
+	var iss issuer
+	if opts.ACMEDirectory != "" {
+		iss, err = newACMEIssuer(opts.ACMEDirectory)
+	} else {
+		iss, err = newLocalIssuer()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		URL:      "http://" + listener.Addr().String(),
+		opts:     opts,
+		root:     root,
+		signer:   signer,
+		manifest: manifest,
+		issuer:   iss,
+		listener: listener,
+		uploads:  make(map[string][]inventory.Certificate),
+		issued:   make(map[string]string),
+	}
+	s.http = &http.Server{Handler: s.routes(), ReadHeaderTimeout: 10 * time.Second}
+	go s.http.Serve(listener)
+
+	log.Printf("[INFO] Simulator: API listening on %s, issuing from %s", s.URL, iss.Describe())
+	return s, nil
+}
+
+// RootKey is the public key the agent must trust for the simulator's
+// signing key manifest
+func (s *Server) RootKey() ed25519.PublicKey {
+	return s.root.Public().(ed25519.PublicKey)
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+func signedManifest(root ed25519.PrivateKey, signer ed25519.PublicKey) ([]byte, error) {
+	payload, err := json.Marshal(signing.Manifest{
+		Version: 1,
+		Keys: []signing.Key{{
+			ID:        SIGNING_KEY,
+			PublicKey: base64.StdEncoding.EncodeToString(signer),
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key manifest: %w", err)
+	}
+	return json.Marshal(signing.SignedManifest{
+		Payload:   payload,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(root, payload)),
+	})
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /instances/register", s.handleRegister)
+	mux.HandleFunc("PUT /instances/{id}/heartbeat", s.handleHeartbeat)
+	mux.HandleFunc("POST /instances/{id}/inventory", s.handleInventory)
+	mux.HandleFunc("POST /instances/{id}/inventory/uploads", s.handleUploadStart)
+	mux.HandleFunc("PUT /instances/{id}/inventory/uploads/{upload}/chunks/{seq}", s.handleUploadChunk)
+	mux.HandleFunc("POST /instances/{id}/inventory/uploads/{upload}/complete", s.handleUploadComplete)
+	mux.HandleFunc("GET /instances/{id}/tasks", s.handleTasks)
+	mux.HandleFunc("POST /instances/{id}/tasks/{task}/result", s.handleResult)
+	mux.HandleFunc("GET /instances/{id}/deployments", s.handleDeployments)
+	mux.HandleFunc("POST /instances/{id}/drift", s.handleDrift)
+	mux.HandleFunc("GET /signing/keys", s.handleKeys)
+	mux.HandleFunc("POST /checks/tls", s.handleTLSCheck)
+	return s.authenticate(mux)
+}
+
+// authenticate checks the token the same way the API does: in the header,
+// never the URL
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != s.opts.Token {
+			log.Printf("[WARNING] Simulator: rejected %s %s: bad API key", r.Method, r.URL.Path)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/instances/") && r.URL.Path != "/instances/register" &&
+			!strings.HasPrefix(r.URL.Path, "/instances/"+INSTANCE_ID+"/") {
+			http.Error(w, "unknown instance", http.StatusNotFound)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Hostname string                 `json:"hostname"`
+		OSType   string                 `json:"os_type"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid registration", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[INFO] Simulator: registered %s (%s), task types %v", data.Hostname, data.OSType, data.Metadata["task_types"])
+
+	s.mu.Lock()
+	first := !s.registered
+	s.registered = true
+	s.mu.Unlock()
+	if first {
+		go s.issueAndDeploy("initial issuance")
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"instance_id":  INSTANCE_ID,
+		"key_id":       SIGNING_KEY,
+		"service_hash": "simulated",
+		"service_name": "CertFix Simulator",
+		"status":       "active",
+		"message":      "simulated registration",
+	})
+}
+
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	log.Printf("[INFO] Simulator: heartbeat received")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleInventory(w http.ResponseWriter, r *http.Request) {
+	var report inventory.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "invalid inventory", http.StatusBadRequest)
+		return
+	}
+	s.checkInventory(report.Certificates, len(report.Errors))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handleUploadStart(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	id := replay.NewNonce()
+	s.mu.Lock()
+	s.uploads[id] = nil
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"upload_id": id})
+}
+
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("upload")
+	dec := json.NewDecoder(r.Body)
+	var chunk []inventory.Certificate
+	for dec.More() {
+		var cert inventory.Certificate
+		if err := dec.Decode(&cert); err != nil {
+			http.Error(w, "invalid chunk", http.StatusBadRequest)
+			return
+		}
+		chunk = append(chunk, cert)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[id]; !ok {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+	s.uploads[id] = append(s.uploads[id], chunk...)
+	writeJSON(w, http.StatusOK, map[string]int{"received": len(chunk)})
+}
+
+func (s *Server) handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	id := r.PathValue("upload")
+	s.mu.Lock()
+	certs, ok := s.uploads[id]
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+	s.checkInventory(certs, 0)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// checkInventory reports whether the scan found what was deployed
+func (s *Server) checkInventory(certs []inventory.Certificate, errs int) {
+	log.Printf("[INFO] Simulator: inventory received, %d certificates, %d errors", len(certs), errs)
+
+	s.mu.Lock()
+	deployed := s.deployed
+	s.mu.Unlock()
+	if deployed == "" {
+		return
+	}
+	for _, cert := range certs {
+		if cert.FingerprintSHA256 == deployed {
+			log.Printf("[SUCCESS] Simulator: deployed certificate found by the scan at %s", cert.Path)
+			return
+		}
+	}
+	log.Printf("[WARNING] Simulator: deployed certificate %s not in the inventory yet", deployed[:16])
+}
+
+func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Printf("[INFO] Simulator: sending %d task(s)", len(pending))
+	writeJSON(w, http.StatusOK, pending)
+}
+
+func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
+	var result tasks.Result
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, "invalid result", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	if result.Status != tasks.STATUS_SUCCEEDED {
+		log.Printf("[ERROR] Simulator: task %s (%s) %s: %s", result.TaskID, result.Type, result.Status, result.Error)
+		return
+	}
+	log.Printf("[SUCCESS] Simulator: task %s (%s) succeeded", result.TaskID, result.Type)
+
+	if result.Type != deploy.TASK_DEPLOY {
+		return
+	}
+	s.mu.Lock()
+	if fingerprint, ok := s.issued[result.TaskID]; ok {
+		s.deployed = fingerprint
+		delete(s.issued, result.TaskID)
+	}
+	renew := !s.renewed
+	s.renewed = true
+	s.mu.Unlock()
+	if renew {
+		log.Printf("[INFO] Simulator: renewal scheduled in %v", RENEWAL_DELAY)
+		time.AfterFunc(RENEWAL_DELAY, func() { s.issueAndDeploy("renewal") })
+	}
+}
+
+// The desired state is the last certificate deployed successfully
+func (s *Server) handleDeployments(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	deployed := s.deployed
+	s.mu.Unlock()
+
+	deployments := []drift.Expected{}
+	if deployed != "" {
+		deployments = append(deployments, drift.Expected{Name: CERT_NAME, Target: deploy.TARGET_TRAEFIK, Fingerprint: deployed})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deployments": deployments})
+}
+
+// Drift is remediated by issuing and deploying a fresh certificate
+func (s *Server) handleDrift(w http.ResponseWriter, r *http.Request) {
+	var report drift.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "invalid drift report", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[INFO] Simulator: drift report, %d deployments checked, %d findings", report.Checked, len(report.Findings))
+	for _, finding := range report.Findings {
+		log.Printf("[WARNING] Simulator: drift in %s: %s %s", finding.Name, finding.Kind, finding.Path+finding.Endpoint)
+	}
+
+	queued := 0
+	s.mu.Lock()
+	remediate := report.Remediate && len(report.Findings) > 0 && len(s.issued) == 0
+	s.mu.Unlock()
+	if remediate {
+		s.issueAndDeploy("drift remediation")
+		queued = 1
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"queued": queued})
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.manifest)
+}
+
+// There is no outside vantage point on a workstation
+func (s *Server) handleTLSCheck(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "external checks are not available in simulation", http.StatusNotImplemented)
+}
+
+// issueAndDeploy gets a certificate and queues the task deploying it
+func (s *Server) issueAndDeploy(reason string) {
+	log.Printf("[INFO] Simulator: %s for %s", reason, strings.Join(s.opts.Names, ", "))
+	cert, chain, key, err := s.issuer.Issue(s.opts.Names)
+	if err != nil {
+		log.Printf("[ERROR] Simulator: %s failed: %v", reason, err)
+		return
+	}
+
+	options, _ := json.Marshal(deploy.TraefikOptions{CertDir: s.opts.CertDir})
+	req := deploy.DeployRequest{
+		Name:        CERT_NAME,
+		Target:      deploy.TARGET_TRAEFIK,
+		Options:     options,
+		Certificate: string(cert),
+		Chain:       string(chain),
+		PrivateKey:  string(key),
+	}
+	bundle := &deploy.Bundle{Name: req.Name, Certificate: cert, Chain: chain, PrivateKey: key}
+	if err := bundle.Validate(); err != nil {
+		log.Printf("[ERROR] Simulator: issued an invalid bundle: %v", err)
+		return
+	}
+
+	id, err := s.enqueue(deploy.TASK_DEPLOY, req)
+	if err != nil {
+		log.Printf("[ERROR] Simulator: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.issued[id] = bundle.Fingerprint()
+	s.mu.Unlock()
+}
+
+// enqueue signs a task the way the API does and queues it for the next poll
+func (s *Server) enqueue(taskType string, payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal task payload: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taskCounter++
+	task := tasks.Task{
+		ID:        fmt.Sprintf("sim-task-%d", s.taskCounter),
+		Type:      taskType,
+		Payload:   data,
+		CreatedAt: time.Now().UTC(),
+		Nonce:     replay.NewNonce(),
+		KeyID:     SIGNING_KEY,
+	}
+	task.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.signer, tasks.SignedMessage(&task)))
+	s.pending = append(s.pending, task)
+	log.Printf("[INFO] Simulator: queued task %s (%s)", task.ID, taskType)
+	return task.ID, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,216 @@
+// Package spiffe lets the agent authenticate with an X.509 SVID instead of a
+// static token. SVIDs are read from files kept fresh by a SPIRE agent
+// running spiffe-helper (or any equivalent), and reloaded whenever they
+// are rotated on disk.
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPIFFE_SCHEME = "spiffe"
+
+	// Default file names written by spiffe-helper
+	DEFAULT_CERT_FILE   = "svid.pem"
+	DEFAULT_KEY_FILE    = "svid_key.pem"
+	DEFAULT_BUNDLE_FILE = "svid_bundle.pem"
+)
+
+// Source serves the current SVID from disk
+type Source struct {
+	CertFile   string
+	KeyFile    string
+	BundleFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	id      string
+	modTime time.Time
+
+	bundle        *x509.CertPool
+	bundleModTime time.Time
+}
+
+// NewSource returns a source and checks that an SVID is already present
+func NewSource(certFile, keyFile, bundleFile string) (*Source, error) {
+	s := &Source{CertFile: certFile, KeyFile: keyFile, BundleFile: bundleFile}
+	if _, err := s.current(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ID returns the SPIFFE ID of the current SVID
+func (s *Source) ID() (string, error) {
+	if _, err := s.current(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id, nil
+}
+
+// GetClientCertificate is installed in the TLS config so every handshake
+// presents the latest SVID
+func (s *Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.current()
+}
+
+// Bundle loads the trust bundle used to verify the API server, if
+// configured. It is reloaded whenever SPIRE rotates it on disk.
+func (s *Source) Bundle() (*x509.CertPool, error) {
+	if s.BundleFile == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(s.BundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SPIFFE bundle: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bundle != nil && info.ModTime().Equal(s.bundleModTime) {
+		return s.bundle, nil
+	}
+
+	data, err := os.ReadFile(s.BundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SPIFFE bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		// Caught mid-write; keep trusting the previous bundle
+		if s.bundle != nil {
+			return s.bundle, nil
+		}
+		return nil, fmt.Errorf("no certificates in SPIFFE bundle %s", s.BundleFile)
+	}
+	s.bundle = pool
+	s.bundleModTime = info.ModTime()
+	return pool, nil
+}
+
+// VerifyServer returns a VerifyPeerCertificate check for the API server:
+// its SVID must chain to the current bundle and carry serverID, or when
+// serverID is empty, any ID in the agent's own trust domain. SVIDs need
+// not have DNS names, so hostname verification doesn't apply.
+func (s *Source) VerifyServer(serverID string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("failed to parse server certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+
+		bundle, err := s.Bundle()
+		if err != nil {
+			return err
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         bundle,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("server SVID not trusted by the SPIFFE bundle: %w", err)
+		}
+
+		id, err := spiffeID(certs[0])
+		if err != nil {
+			return err
+		}
+		if serverID != "" {
+			if id != serverID {
+				return fmt.Errorf("server SPIFFE ID %s is not %s", id, serverID)
+			}
+			return nil
+		}
+		own, err := s.ID()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(trustDomain(id), trustDomain(own)) {
+			return fmt.Errorf("server SPIFFE ID %s is outside trust domain %s", id, trustDomain(own))
+		}
+		return nil
+	}
+}
+
+func (s *Source) current() (*tls.Certificate, error) {
+	info, err := os.Stat(s.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SVID: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cert != nil && info.ModTime().Equal(s.modTime) {
+		return s.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		// Mid-rotation the pair can briefly disagree; keep serving the old one
+		if s.cert != nil {
+			return s.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load SVID: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SVID: %w", err)
+	}
+	id, err := spiffeID(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("SVID %s expired at %s", id, leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	cert.Leaf = leaf
+	s.cert = &cert
+	s.id = id
+	s.modTime = info.ModTime()
+	return s.cert, nil
+}
+
+// An X.509 SVID carries exactly one URI SAN with the spiffe scheme
+func spiffeID(cert *x509.Certificate) (string, error) {
+	var ids []string
+	for _, uri := range cert.URIs {
+		if strings.EqualFold(uri.Scheme, SPIFFE_SCHEME) {
+			ids = append(ids, uri.String())
+		}
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("certificate is not an X.509 SVID: expected one spiffe:// URI SAN, found %d", len(ids))
+	}
+	return ids[0], nil
+}
+
+// trustDomain is the authority of a SPIFFE ID
+func trustDomain(id string) string {
+	domain := strings.TrimPrefix(strings.ToLower(id), SPIFFE_SCHEME+"://")
+	domain, _, _ = strings.Cut(domain, "/")
+	return domain
+}
@@ -0,0 +1,246 @@
+package sshproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/deploy"
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+// The only target on a proxied host: files plus a reload
+const TARGET_FILES = "files"
+
+// FilesOptions place the certificate on the remote host. CertPath receives
+// the full chain unless ChainPath is set, in which case it gets the leaf.
+type FilesOptions struct {
+	CertPath  string   `json:"cert_path"`
+	KeyPath   string   `json:"key_path"`
+	ChainPath string   `json:"chain_path,omitempty"`
+	Reload    []string `json:"reload,omitempty"`
+}
+
+// Service runs cert.deploy tasks for one proxied host
+type Service struct {
+	host  *Host
+	audit *audit.Logger
+}
+
+// NewService creates the deploy handler for host
+func NewService(host *Host, auditLog *audit.Logger) *Service {
+	return &Service{host: host, audit: auditLog}
+}
+
+// Register installs the cert.deploy task handler
+func (s *Service) Register(registry *tasks.Registry) {
+	registry.Register(deploy.TASK_DEPLOY, s.handleDeploy)
+}
+
+func (s *Service) handleDeploy(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req deploy.DeployRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	result, err := s.Deploy(ctx, &req)
+	s.record(task, &req, result, err)
+	return result, err
+}
+
+// Deploy writes the bundle to the host and reloads the listed services,
+// restoring the previous files if a reload fails
+func (s *Service) Deploy(ctx context.Context, req *deploy.DeployRequest) (*deploy.Result, error) {
+	if req.Target != TARGET_FILES {
+		return nil, tasks.Rejectf("unknown deploy target %q on proxied host (available: %s)", req.Target, TARGET_FILES)
+	}
+	var opts FilesOptions
+	if len(req.Options) > 0 {
+		if err := json.Unmarshal(req.Options, &opts); err != nil {
+			return nil, tasks.Rejectf("invalid target options: %v", err)
+		}
+	}
+	if opts.CertPath == "" || opts.KeyPath == "" {
+		return nil, tasks.Rejectf("files target requires cert_path and key_path")
+	}
+	for _, service := range opts.Reload {
+		if err := s.checkService(service); err != nil {
+			return nil, err
+		}
+	}
+
+	bundle := &deploy.Bundle{
+		Name:        req.Name,
+		Certificate: []byte(req.Certificate),
+		Chain:       []byte(req.Chain),
+		PrivateKey:  []byte(req.PrivateKey),
+	}
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+
+	_, fs, err := s.host.session()
+	if err != nil {
+		return nil, err
+	}
+
+	// Key first, so a reload in between never pairs a new certificate with
+	// an old key
+	writes := []remoteWrite{{path: opts.KeyPath, data: bundle.PrivateKey, mode: filetransfer.PRIVATE_FILE_MODE}}
+	if opts.ChainPath != "" {
+		writes = append(writes,
+			remoteWrite{path: opts.CertPath, data: bundle.Certificate, mode: filetransfer.PUBLIC_FILE_MODE},
+			remoteWrite{path: opts.ChainPath, data: bundle.Chain, mode: filetransfer.PUBLIC_FILE_MODE})
+	} else {
+		writes = append(writes, remoteWrite{path: opts.CertPath, data: bundle.FullChain(), mode: filetransfer.PUBLIC_FILE_MODE})
+	}
+
+	for i := range writes {
+		resolved, err := s.confine(fs, writes[i].path)
+		if err != nil {
+			return nil, err
+		}
+		writes[i].path = resolved
+		previous, err := fs.ReadFile(resolved, MAX_FILE_SIZE)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to back up %s: %w", resolved, err)
+		}
+		writes[i].previous, writes[i].existed = previous, err == nil
+	}
+
+	result := &deploy.Result{Target: TARGET_FILES, Fingerprint: bundle.Fingerprint()}
+	for i, w := range writes {
+		if err := replaceFile(fs, w.path, w.data, w.mode); err != nil {
+			s.restore(fs, writes[:i])
+			s.host.reset()
+			return result, fmt.Errorf("failed to write %s: %w", w.path, err)
+		}
+		result.Files = append(result.Files, w.path)
+	}
+
+	for _, service := range opts.Reload {
+		if err := s.reload(ctx, service); err != nil {
+			s.restore(fs, writes)
+			for _, done := range result.Reloaded {
+				s.reload(ctx, done)
+			}
+			s.reload(ctx, service)
+			return result, fmt.Errorf("reload of %s failed: %v: %w", service, err, deploy.ErrRolledBack)
+		}
+		result.Reloaded = append(result.Reloaded, service)
+	}
+	return result, nil
+}
+
+type remoteWrite struct {
+	path     string
+	data     []byte
+	mode     os.FileMode
+	previous []byte
+	existed  bool
+}
+
+// confine resolves the directory of p on the host and requires it to lie
+// within one of the certificate paths
+func (s *Service) confine(fs *sftpClient, p string) (string, error) {
+	if !path.IsAbs(p) {
+		return "", tasks.Rejectf("path %q is not absolute", p)
+	}
+	dir, err := fs.RealPath(path.Dir(path.Clean(p)))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path.Dir(p), err)
+	}
+	resolved := path.Join(dir, path.Base(p))
+	for _, root := range s.host.opts.CertPaths {
+		realRoot, err := fs.RealPath(path.Clean(root))
+		if err != nil {
+			continue
+		}
+		if resolved == realRoot || strings.HasPrefix(resolved, strings.TrimSuffix(realRoot, "/")+"/") {
+			return resolved, nil
+		}
+	}
+	return "", tasks.Rejectf("path %s is outside the certificate paths of %s", resolved, s.host.Name())
+}
+
+// restore puts back the previous contents of already written files
+func (s *Service) restore(fs *sftpClient, writes []remoteWrite) {
+	for _, w := range writes {
+		var err error
+		if !w.existed {
+			err = fs.Remove(w.path)
+		} else {
+			err = replaceFile(fs, w.path, w.previous, w.mode)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Proxy %s: failed to restore %s: %v", s.host.Name(), w.path, err)
+		}
+	}
+}
+
+// replaceFile writes a temporary file next to p and renames it over p
+func replaceFile(fs *sftpClient, p string, data []byte, mode os.FileMode) error {
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+".certfix-tmp")
+	if err := fs.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := fs.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := fs.Chmod(tmp, mode); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	if err := fs.Rename(tmp, p); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *Service) checkService(service string) error {
+	if !serviceNameRe.MatchString(service) {
+		return tasks.Rejectf("invalid service name %q", service)
+	}
+	for _, allowed := range s.host.opts.ServiceAllowlist {
+		if allowed == service {
+			return nil
+		}
+	}
+	return tasks.Rejectf("service %q is not in the allowlist of %s", service, s.host.Name())
+}
+
+func (s *Service) reload(ctx context.Context, service string) error {
+	command := strings.ReplaceAll(s.host.opts.ReloadCommand, "{service}", service)
+	_, err := s.host.Run(ctx, command)
+	return err
+}
+
+func (s *Service) record(task *tasks.Task, req *deploy.DeployRequest, result *deploy.Result, err error) {
+	entry := audit.Entry{
+		TaskID:  task.ID,
+		Action:  deploy.TASK_DEPLOY,
+		Target:  "ssh:" + s.host.Name() + ":" + req.Name,
+		Outcome: tasks.STATUS_SUCCEEDED,
+	}
+	if result != nil {
+		entry.Details = map[string]string{"fingerprint": result.Fingerprint}
+		if len(result.Files) > 0 {
+			entry.Details["files"] = strings.Join(result.Files, ",")
+		}
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", task.ID, err)
+	}
+}
@@ -0,0 +1,523 @@
+package sshproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Minimal SFTP version 3 client (draft-ietf-secsh-filexfer-02): just the
+// requests needed to walk directories, read certificates and replace files.
+// Requests are sent one at a time; the files involved are small.
+
+const (
+	sftpVersion = 3
+
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpSetstat       = 9
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpExtended      = 200
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtendedReply = 201
+
+	fxfRead  = 0x01
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+	fxfExcl  = 0x20
+
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+
+	fxOK     = 0
+	fxEOF    = 1
+	fxNoFile = 2
+
+	// Largest read request; servers commonly cap at 32 KiB
+	sftpChunkSize = 32 << 10
+	// Packets larger than this are a protocol error, not data
+	sftpMaxPacket = 256 << 10
+
+	extPosixRename = "posix-rename@openssh.com"
+)
+
+// StatusError is an SFTP status response other than OK
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (code %d)", e.Message, e.Code)
+}
+
+// Is maps "no such file" onto os.ErrNotExist
+func (e *StatusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.Code == fxNoFile
+}
+
+// FileInfo is the subset of SFTP attributes the proxy uses
+type FileInfo struct {
+	Name string
+	Size int64
+	Mode os.FileMode
+}
+
+func (f FileInfo) IsDir() bool     { return f.Mode.IsDir() }
+func (f FileInfo) IsRegular() bool { return f.Mode.IsRegular() }
+
+type sftpClient struct {
+	mu         sync.Mutex
+	session    *ssh.Session
+	w          io.WriteCloser
+	r          io.Reader
+	nextID     uint32
+	extensions map[string]string
+}
+
+func newSFTP(conn *ssh.Client) (*sftpClient, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %w", err)
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("sftp subsystem unavailable: %w", err)
+	}
+
+	c := &sftpClient{session: session, w: w, r: r, extensions: make(map[string]string)}
+	if err := c.init(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sftpClient) init() error {
+	var b packetBuilder
+	b.byte(fxpInit)
+	b.uint32(sftpVersion)
+	if err := c.send(b.bytes()); err != nil {
+		return err
+	}
+	typ, data, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != fxpVersion {
+		return fmt.Errorf("sftp: unexpected packet %d during init", typ)
+	}
+	p := packetParser{data: data}
+	if version := p.uint32(); version != sftpVersion {
+		return fmt.Errorf("sftp: server speaks version %d", version)
+	}
+	for p.remaining() > 0 {
+		name, value := p.string(), p.string()
+		c.extensions[name] = value
+	}
+	return p.err
+}
+
+func (c *sftpClient) Close() error {
+	return c.session.Close()
+}
+
+func (c *sftpClient) send(packet []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(packet)))
+	if _, err := c.w.Write(append(length[:], packet...)); err != nil {
+		return fmt.Errorf("sftp: write failed: %w", err)
+	}
+	return nil
+}
+
+func (c *sftpClient) recv() (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(c.r, length[:]); err != nil {
+		return 0, nil, fmt.Errorf("sftp: read failed: %w", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		return 0, nil, fmt.Errorf("sftp: read failed: %w", err)
+	}
+	return packet[0], packet[1:], nil
+}
+
+// request sends one request and returns the response type and body after
+// the request id
+func (c *sftpClient) request(typ byte, build func(*packetBuilder)) (byte, *packetParser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := c.nextID
+	var b packetBuilder
+	b.byte(typ)
+	b.uint32(id)
+	build(&b)
+	if err := c.send(b.bytes()); err != nil {
+		return 0, nil, err
+	}
+
+	respType, data, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	p := &packetParser{data: data}
+	if got := p.uint32(); got != id {
+		return 0, nil, fmt.Errorf("sftp: response id %d for request %d", got, id)
+	}
+	if respType == fxpStatus {
+		code, msg := p.uint32(), p.string()
+		if code == fxOK {
+			return respType, p, nil
+		}
+		return respType, nil, &StatusError{Code: code, Message: msg}
+	}
+	return respType, p, nil
+}
+
+// status expects a plain OK status
+func (c *sftpClient) status(typ byte, build func(*packetBuilder)) error {
+	respType, _, err := c.request(typ, build)
+	if err != nil {
+		return err
+	}
+	if respType != fxpStatus {
+		return fmt.Errorf("sftp: unexpected packet %d", respType)
+	}
+	return nil
+}
+
+func (c *sftpClient) handle(typ byte, build func(*packetBuilder)) (string, error) {
+	respType, p, err := c.request(typ, build)
+	if err != nil {
+		return "", err
+	}
+	if respType != fxpHandle {
+		return "", fmt.Errorf("sftp: unexpected packet %d", respType)
+	}
+	h := p.string()
+	return h, p.err
+}
+
+func (c *sftpClient) closeHandle(h string) error {
+	return c.status(fxpClose, func(b *packetBuilder) { b.string(h) })
+}
+
+// Stat follows symlinks
+func (c *sftpClient) Stat(p string) (FileInfo, error) {
+	return c.stat(fxpStat, p)
+}
+
+// Lstat does not follow symlinks
+func (c *sftpClient) Lstat(p string) (FileInfo, error) {
+	return c.stat(fxpLstat, p)
+}
+
+func (c *sftpClient) stat(typ byte, p string) (FileInfo, error) {
+	respType, parser, err := c.request(typ, func(b *packetBuilder) { b.string(p) })
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if respType != fxpAttrs {
+		return FileInfo{}, fmt.Errorf("sftp: unexpected packet %d", respType)
+	}
+	info := parser.attrs()
+	info.Name = path.Base(p)
+	return info, parser.err
+}
+
+// RealPath canonicalizes a path on the server, resolving symlinks
+func (c *sftpClient) RealPath(p string) (string, error) {
+	respType, parser, err := c.request(fxpRealpath, func(b *packetBuilder) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	if respType != fxpName || parser.uint32() != 1 {
+		return "", fmt.Errorf("sftp: unexpected realpath response")
+	}
+	resolved := parser.string()
+	return resolved, parser.err
+}
+
+// ReadDir lists a directory, without "." and ".."
+func (c *sftpClient) ReadDir(dir string) ([]FileInfo, error) {
+	h, err := c.handle(fxpOpendir, func(b *packetBuilder) { b.string(dir) })
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(h)
+
+	var entries []FileInfo
+	for {
+		respType, p, err := c.request(fxpReaddir, func(b *packetBuilder) { b.string(h) })
+		var status *StatusError
+		if errors.As(err, &status) && status.Code == fxEOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		if respType != fxpName {
+			return entries, fmt.Errorf("sftp: unexpected packet %d", respType)
+		}
+		for n := p.uint32(); n > 0 && p.err == nil; n-- {
+			name := p.string()
+			p.string() // longname
+			info := p.attrs()
+			info.Name = name
+			if name != "." && name != ".." {
+				entries = append(entries, info)
+			}
+		}
+		if p.err != nil {
+			return entries, p.err
+		}
+	}
+}
+
+// ReadFile reads a whole file, refusing ones larger than limit
+func (c *sftpClient) ReadFile(p string, limit int64) ([]byte, error) {
+	h, err := c.handle(fxpOpen, func(b *packetBuilder) {
+		b.string(p)
+		b.uint32(fxfRead)
+		b.uint32(0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(h)
+
+	var buf bytes.Buffer
+	for {
+		respType, parser, err := c.request(fxpRead, func(b *packetBuilder) {
+			b.string(h)
+			b.uint64(uint64(buf.Len()))
+			b.uint32(sftpChunkSize)
+		})
+		var status *StatusError
+		if errors.As(err, &status) && status.Code == fxEOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if respType != fxpData {
+			return nil, fmt.Errorf("sftp: unexpected packet %d", respType)
+		}
+		data := parser.string()
+		if parser.err != nil {
+			return nil, parser.err
+		}
+		buf.WriteString(data)
+		if int64(buf.Len()) > limit {
+			return nil, fmt.Errorf("%s is larger than %d bytes", p, limit)
+		}
+	}
+}
+
+// WriteFile creates p exclusively with mode and writes data
+func (c *sftpClient) WriteFile(p string, data []byte, mode os.FileMode) error {
+	h, err := c.handle(fxpOpen, func(b *packetBuilder) {
+		b.string(p)
+		b.uint32(fxfWrite | fxfCreat | fxfExcl | fxfTrunc)
+		b.uint32(attrPermissions)
+		b.uint32(uint32(mode.Perm()))
+	})
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); offset += sftpChunkSize {
+		end := offset + sftpChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		err := c.status(fxpWrite, func(b *packetBuilder) {
+			b.string(h)
+			b.uint64(uint64(offset))
+			b.string(string(data[offset:end]))
+		})
+		if err != nil {
+			c.closeHandle(h)
+			return err
+		}
+	}
+	return c.closeHandle(h)
+}
+
+// Chmod sets permissions; servers apply the umask on create
+func (c *sftpClient) Chmod(p string, mode os.FileMode) error {
+	return c.status(fxpSetstat, func(b *packetBuilder) {
+		b.string(p)
+		b.uint32(attrPermissions)
+		b.uint32(uint32(mode.Perm()))
+	})
+}
+
+func (c *sftpClient) Remove(p string) error {
+	return c.status(fxpRemove, func(b *packetBuilder) { b.string(p) })
+}
+
+// Rename replaces newpath atomically when the server supports OpenSSH's
+// posix-rename; plain SFTP rename refuses to overwrite, so the fallback
+// removes the target first
+func (c *sftpClient) Rename(oldpath, newpath string) error {
+	if _, ok := c.extensions[extPosixRename]; ok {
+		return c.status(fxpExtended, func(b *packetBuilder) {
+			b.string(extPosixRename)
+			b.string(oldpath)
+			b.string(newpath)
+		})
+	}
+	if err := c.Remove(newpath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.status(fxpRename, func(b *packetBuilder) {
+		b.string(oldpath)
+		b.string(newpath)
+	})
+}
+
+type packetBuilder struct {
+	buf []byte
+}
+
+func (b *packetBuilder) byte(v byte) { b.buf = append(b.buf, v) }
+func (b *packetBuilder) uint32(v uint32) {
+	b.buf = binary.BigEndian.AppendUint32(b.buf, v)
+}
+func (b *packetBuilder) uint64(v uint64) {
+	b.buf = binary.BigEndian.AppendUint64(b.buf, v)
+}
+func (b *packetBuilder) string(s string) {
+	b.uint32(uint32(len(s)))
+	b.buf = append(b.buf, s...)
+}
+func (b *packetBuilder) bytes() []byte { return b.buf }
+
+// packetParser records the first decoding error and returns zero values
+// after it, so callers check err once
+type packetParser struct {
+	data []byte
+	err  error
+}
+
+func (p *packetParser) remaining() int { return len(p.data) }
+
+func (p *packetParser) take(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.data) < n {
+		p.err = fmt.Errorf("sftp: truncated packet")
+		return nil
+	}
+	v := p.data[:n]
+	p.data = p.data[n:]
+	return v
+}
+
+func (p *packetParser) uint32() uint32 {
+	if v := p.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (p *packetParser) uint64() uint64 {
+	if v := p.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (p *packetParser) string() string {
+	n := p.uint32()
+	if n > uint32(len(p.data)) {
+		p.err = fmt.Errorf("sftp: truncated packet")
+		return ""
+	}
+	return string(p.take(int(n)))
+}
+
+func (p *packetParser) attrs() FileInfo {
+	var info FileInfo
+	flags := p.uint32()
+	if flags&attrSize != 0 {
+		info.Size = int64(p.uint64())
+	}
+	if flags&attrUIDGID != 0 {
+		p.uint32()
+		p.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		info.Mode = posixMode(p.uint32())
+	}
+	if flags&attrACModTime != 0 {
+		p.uint32()
+		p.uint32()
+	}
+	if flags&attrExtended != 0 {
+		for n := p.uint32(); n > 0 && p.err == nil; n-- {
+			p.string()
+			p.string()
+		}
+	}
+	return info
+}
+
+// posixMode converts st_mode bits into an os.FileMode
+func posixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0100000:
+	default:
+		mode |= os.ModeIrregular
+	}
+	return mode
+}
@@ -0,0 +1,305 @@
+// Package sshproxy lets one agent manage certificates on hosts that cannot
+// run it (appliances, legacy boxes): it scans their certificate paths over
+// SFTP, replaces files and triggers reloads over SSH. Each host registers
+// as its own instance, marked as proxied by the parent agent.
+//
+// Host keys are always verified against a known_hosts file, and writes are
+// confined to the host's configured certificate paths.
+package sshproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/certfix/certfix-agent/pkg/inventory"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+	"github.com/certfix/certfix-agent/pkg/scanner"
+)
+
+const (
+	DEFAULT_PORT           = "22"
+	DEFAULT_RELOAD_COMMAND = "systemctl reload {service}"
+
+	DIAL_TIMEOUT    = 15 * time.Second
+	COMMAND_TIMEOUT = 2 * time.Minute
+
+	// Remote walks are slow; keep them shallow and bounded
+	MAX_SCAN_DEPTH = 6
+	MAX_SCAN_FILES = 5000
+	MAX_FILE_SIZE  = 1 << 20
+)
+
+// Service names are substituted into a shell command
+var serviceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._-]{0,127}$`)
+
+// Options describe one proxied host
+type Options struct {
+	// Name identifies the host in the inventory and logs
+	Name    string
+	Address string
+	User    string
+	// KeyFile is an unencrypted private key for public key authentication
+	KeyFile        string
+	KnownHostsFile string
+	// ScanPaths are walked for certificates; CertPaths bound deployments
+	// and default to ScanPaths
+	ScanPaths        []string
+	CertPaths        []string
+	ServiceAllowlist []string
+	// ReloadCommand runs after a deployment, with {service} substituted
+	ReloadCommand string
+}
+
+// Host is a proxied host; the SSH connection is opened on first use and
+// reopened after errors
+type Host struct {
+	opts   Options
+	config *ssh.ClientConfig
+
+	mu   sync.Mutex
+	conn *ssh.Client
+	fs   *sftpClient
+}
+
+// New validates the options and loads the key and known hosts
+func New(opts Options) (*Host, error) {
+	if opts.Name == "" || opts.Address == "" || opts.User == "" {
+		return nil, fmt.Errorf("proxy host requires name, address and user")
+	}
+	if opts.KeyFile == "" || opts.KnownHostsFile == "" {
+		return nil, fmt.Errorf("proxy host %s requires key_file and known_hosts_file", opts.Name)
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		opts.Address = net.JoinHostPort(opts.Address, DEFAULT_PORT)
+	}
+	if len(opts.CertPaths) == 0 {
+		opts.CertPaths = opts.ScanPaths
+	}
+	for _, p := range append(append([]string{}, opts.ScanPaths...), opts.CertPaths...) {
+		if !path.IsAbs(p) {
+			return nil, fmt.Errorf("proxy host %s: path %q is not absolute", opts.Name, p)
+		}
+	}
+	if opts.ReloadCommand == "" {
+		opts.ReloadCommand = DEFAULT_RELOAD_COMMAND
+	}
+
+	keyData, err := os.ReadFile(opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy host %s: failed to read key: %w", opts.Name, err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("proxy host %s: failed to parse key: %w", opts.Name, err)
+	}
+	hostKeys, err := knownhosts.New(opts.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy host %s: failed to load known hosts: %w", opts.Name, err)
+	}
+
+	return &Host{
+		opts: opts,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeys,
+			Timeout:         DIAL_TIMEOUT,
+		},
+	}, nil
+}
+
+// Name returns the configured host name
+func (h *Host) Name() string {
+	return h.opts.Name
+}
+
+// Address returns host:port
+func (h *Host) Address() string {
+	return h.opts.Address
+}
+
+// session returns the open connection, dialing if needed
+func (h *Host) session() (*ssh.Client, *sftpClient, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn != nil {
+		return h.conn, h.fs, nil
+	}
+	dialer := &netdial.Dialer{Timeout: DIAL_TIMEOUT}
+	tcpConn, err := dialer.DialContext(context.Background(), "tcp", h.opts.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s: %w", h.opts.Address, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, h.opts.Address, h.config)
+	if err != nil {
+		tcpConn.Close()
+		return nil, nil, fmt.Errorf("failed to connect to %s: %w", h.opts.Address, err)
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	fs, err := newSFTP(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	h.conn, h.fs = conn, fs
+	return conn, fs, nil
+}
+
+// reset drops the connection after an error so the next call redials
+func (h *Host) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fs != nil {
+		h.fs.Close()
+	}
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	h.conn, h.fs = nil, nil
+}
+
+// Close closes the connection
+func (h *Host) Close() {
+	h.reset()
+}
+
+// Ping checks that the host is reachable and SFTP works
+func (h *Host) Ping() error {
+	_, fs, err := h.session()
+	if err != nil {
+		return err
+	}
+	if _, err := fs.Stat("/"); err != nil {
+		h.reset()
+		return err
+	}
+	return nil
+}
+
+// Run executes a command on the host, returning its combined output
+func (h *Host) Run(ctx context.Context, command string) (string, error) {
+	conn, _, err := h.session()
+	if err != nil {
+		return "", err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		h.reset()
+		return "", fmt.Errorf("failed to open session: %w", err)
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	session.Stdout = &out
+	session.Stderr = &out
+
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return out.String(), fmt.Errorf("%q timed out", command)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return out.String(), fmt.Errorf("%q failed: %w: %s", command, err, msg)
+		}
+		return out.String(), fmt.Errorf("%q failed: %w", command, err)
+	}
+	return out.String(), nil
+}
+
+// System reports the remote kernel name, release and machine from uname
+func (h *Host) System(ctx context.Context) (osType, release, arch string) {
+	out, err := h.Run(ctx, "uname -s -r -m")
+	fields := strings.Fields(out)
+	if err != nil || len(fields) != 3 {
+		return "unknown", "", ""
+	}
+	return strings.ToLower(fields[0]), fields[1], fields[2]
+}
+
+// Scan walks the scan paths for certificate files
+func (h *Host) Scan(ctx context.Context) ([]inventory.Certificate, []string) {
+	_, fs, err := h.session()
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	w := &walker{ctx: ctx, fs: fs}
+	for _, root := range h.opts.ScanPaths {
+		w.walk(path.Clean(root), 0)
+	}
+	if w.connErr != nil {
+		h.reset()
+	}
+	return w.certs, w.errs
+}
+
+type walker struct {
+	ctx     context.Context
+	fs      *sftpClient
+	files   int
+	certs   []inventory.Certificate
+	errs    []string
+	connErr error
+}
+
+func (w *walker) walk(dir string, depth int) {
+	if w.ctx.Err() != nil || w.connErr != nil || w.files >= MAX_SCAN_FILES {
+		return
+	}
+	entries, err := w.fs.ReadDir(dir)
+	if err != nil {
+		w.record(dir, err)
+		return
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name)
+		switch {
+		case entry.IsDir():
+			if depth < MAX_SCAN_DEPTH {
+				w.walk(p, depth+1)
+			}
+		case entry.IsRegular() && scanner.HasCertExtension(entry.Name):
+			if entry.Size > MAX_FILE_SIZE || w.files >= MAX_SCAN_FILES {
+				continue
+			}
+			w.files++
+			data, err := w.fs.ReadFile(p, MAX_FILE_SIZE)
+			if err != nil {
+				w.record(p, err)
+				continue
+			}
+			// Keys and CSRs share extensions with certificates
+			if cert, err := inventory.ParseCertificate(bytes.NewReader(data), p); err == nil {
+				w.certs = append(w.certs, *cert)
+			}
+		}
+	}
+}
+
+// record keeps per-path errors; anything that isn't an SFTP status means
+// the connection itself failed and the walk stops
+func (w *walker) record(p string, err error) {
+	if _, ok := err.(*StatusError); !ok {
+		w.connErr = err
+	}
+	w.errs = append(w.errs, fmt.Sprintf("%s: %v", p, err))
+}
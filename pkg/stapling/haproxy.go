@@ -0,0 +1,43 @@
+package stapling
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	SOCKET_TIMEOUT = 5 * time.Second
+)
+
+// UpdateHAProxy hands a new response to a running HAProxy over its runtime
+// API, which otherwise only reads .ocsp files at startup. The socket must
+// be at the admin level.
+func UpdateHAProxy(socket string, response []byte) error {
+	conn, err := net.DialTimeout("unix", socket, SOCKET_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("failed to connect to HAProxy: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SOCKET_TIMEOUT))
+
+	command := "set ssl ocsp-response " + base64.StdEncoding.EncodeToString(response) + "\n"
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return fmt.Errorf("failed to send to HAProxy: %w", err)
+	}
+	// One-shot commands are answered and the connection closed
+	var reply strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply.WriteString(scanner.Text())
+		reply.WriteByte(' ')
+	}
+	answer := strings.TrimSpace(reply.String())
+	if !strings.Contains(answer, "OCSP Response updated") {
+		return fmt.Errorf("HAProxy refused the response: %s", answer)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Package stapling keeps OCSP responses for deployed certificates next to
+// their files, so web servers can staple them without reaching the
+// responder themselves.
+package stapling
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/certfix/certfix-agent/pkg/filetransfer"
+	"github.com/certfix/certfix-agent/pkg/intermediates"
+)
+
+const (
+	// Suffix HAProxy loads automatically; nginx is pointed at the same file
+	// with ssl_stapling_file
+	RESPONSE_SUFFIX = ".ocsp"
+
+	MAX_RESPONSE_SIZE = 64 << 10
+	FETCH_TIMEOUT     = 30 * time.Second
+	// Requests up to this size go as GET, which responders' CDNs cache
+	MAX_GET_REQUEST = 255
+
+	// Responses without a nextUpdate are refreshed this often
+	DEFAULT_LIFETIME = 24 * time.Hour
+)
+
+// Outcomes of a refresh
+const (
+	STATUS_FRESH   = "fresh"
+	STATUS_UPDATED = "updated"
+	STATUS_REVOKED = "revoked"
+	STATUS_FAILED  = "failed"
+)
+
+// ErrNoResponder marks certificates that name no OCSP responder; more and
+// more CAs drop OCSP, so this is not a failure
+var ErrNoResponder = errors.New("certificate has no OCSP responder")
+
+// Result is the state of one certificate file's stapling response
+type Result struct {
+	CertFile     string    `json:"cert_file"`
+	ResponseFile string    `json:"response_file"`
+	Status       string    `json:"status"`
+	ThisUpdate   time.Time `json:"this_update,omitempty"`
+	NextUpdate   time.Time `json:"next_update,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	// The DER response, when it was updated
+	Response []byte `json:"-"`
+}
+
+// ResponseFile is where the response for a certificate file is kept
+func ResponseFile(certFile string) string {
+	return certFile + RESPONSE_SUFFIX
+}
+
+// Refresh makes sure the response next to certFile is current: it is kept
+// until half its validity has passed and then fetched again. The issuer is
+// taken from the file's chain or the intermediate cache.
+func Refresh(ctx context.Context, client *http.Client, certFile string) *Result {
+	result := &Result{CertFile: certFile, ResponseFile: ResponseFile(certFile)}
+	fail := func(err error) *Result {
+		result.Status, result.Error = STATUS_FAILED, err.Error()
+		return result
+	}
+
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return fail(err)
+	}
+	certs := intermediates.ParsePEM(data)
+	if len(certs) == 0 {
+		return fail(fmt.Errorf("no certificate found"))
+	}
+	leaf := certs[0]
+	if len(leaf.OCSPServer) == 0 {
+		return fail(ErrNoResponder)
+	}
+	issuer := issuerOf(leaf, certs[1:])
+	if issuer == nil {
+		if issuer, err = intermediates.Default.Issuer(ctx, leaf); err != nil {
+			return fail(fmt.Errorf("issuer of %s: %w", leaf.Subject, err))
+		}
+	}
+
+	now := time.Now()
+	if existing, err := os.ReadFile(result.ResponseFile); err == nil {
+		if resp, err := ocsp.ParseResponseForCert(existing, leaf, issuer); err == nil && resp.Status == ocsp.Good && !due(resp, now) {
+			result.Status, result.ThisUpdate, result.NextUpdate = STATUS_FRESH, resp.ThisUpdate, resp.NextUpdate
+			return result
+		}
+	}
+
+	raw, resp, err := Fetch(ctx, client, leaf, issuer)
+	if err != nil {
+		return fail(err)
+	}
+	result.ThisUpdate, result.NextUpdate = resp.ThisUpdate, resp.NextUpdate
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		// Stapling it would only make clients fail faster; leave the old
+		// file and let the operator act
+		result.Status = STATUS_REVOKED
+		result.Error = fmt.Sprintf("revoked at %s", resp.RevokedAt.Format(time.RFC3339))
+		return result
+	default:
+		return fail(fmt.Errorf("responder does not know the certificate"))
+	}
+
+	if err := filetransfer.WriteFileAtomic(result.ResponseFile, raw, filetransfer.PUBLIC_FILE_MODE); err != nil {
+		return fail(err)
+	}
+	result.Status, result.Response = STATUS_UPDATED, raw
+	return result
+}
+
+// Fetch asks the certificate's responder for its status and checks the
+// response is signed for this certificate
+func Fetch(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+	var lastErr error
+	for _, responder := range leaf.OCSPServer {
+		raw, err := post(ctx, client, responder, request)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", responder, err)
+			continue
+		}
+		resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: invalid response: %w", responder, err)
+			continue
+		}
+		return raw, resp, nil
+	}
+	return nil, nil, lastErr
+}
+
+func post(ctx context.Context, client *http.Client, responder string, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, FETCH_TIMEOUT)
+	defer cancel()
+
+	var req *http.Request
+	var err error
+	encoded := base64.StdEncoding.EncodeToString(request)
+	if len(encoded) <= MAX_GET_REQUEST {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(responder, "/")+"/"+url.QueryEscape(encoded), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(request))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/ocsp-request")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_SIZE))
+}
+
+// due reports whether half of the response's validity has passed
+func due(resp *ocsp.Response, now time.Time) bool {
+	next := resp.NextUpdate
+	if next.IsZero() {
+		next = resp.ThisUpdate.Add(DEFAULT_LIFETIME)
+	}
+	return now.After(resp.ThisUpdate.Add(next.Sub(resp.ThisUpdate) / 2))
+}
+
+func issuerOf(leaf *x509.Certificate, chain []*x509.Certificate) *x509.Certificate {
+	for _, cert := range chain {
+		if bytes.Equal(leaf.RawIssuer, cert.RawSubject) && leaf.CheckSignatureFrom(cert) == nil {
+			return cert
+		}
+	}
+	return nil
+}
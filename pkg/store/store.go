@@ -0,0 +1,322 @@
+// Package store keeps the agent's local state in a single embedded bbolt
+// database: instance identity, the last inventory, the renewal schedule,
+// task history and the spool of results awaiting delivery. Every write is
+// a transaction, so a crash never leaves half-written state behind.
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BUCKET_IDENTITY  = "identity"
+	BUCKET_INVENTORY = "inventory"
+	BUCKET_RENEWALS  = "renewals"
+	BUCKET_TASKS     = "tasks"
+	BUCKET_SPOOL     = "spool"
+	// What was deployed where, the local desired state
+	BUCKET_DEPLOYMENTS = "deployments"
+	// Certificates the agent issued itself over ACME, with their keys
+	BUCKET_CERTIFICATES = "certificates"
+	// Opaque blobs owned by other packages (scan cache, key manifest, nonces)
+	BUCKET_STATE = "state"
+
+	// Only one process may hold the database; the instance lock normally
+	// guarantees that, so waiting longer would only hide a bug
+	OPEN_TIMEOUT = 5 * time.Second
+)
+
+var buckets = []string{BUCKET_IDENTITY, BUCKET_INVENTORY, BUCKET_RENEWALS, BUCKET_TASKS, BUCKET_SPOOL, BUCKET_DEPLOYMENTS, BUCKET_CERTIFICATES, BUCKET_STATE}
+
+var ErrNotFound = errors.New("not found in state database")
+
+// Store is the open state database
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state database: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Path returns the database file
+func (s *Store) Path() string {
+	return s.db.Path()
+}
+
+// Close flushes and closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// WriteTo writes a consistent copy of the whole database, taken in one
+// read transaction while the agent keeps writing
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Get decodes the JSON value stored under key; ErrNotFound if absent
+func (s *Store) Get(bucket, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(bucket)).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// Put stores v as JSON under key
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s/%s: %w", bucket, key, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+}
+
+// Delete removes key; deleting a missing key is not an error
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn with every key and raw JSON value in bucket, in key order
+func (s *Store) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				// Nested bucket (a queue)
+				return nil
+			}
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Blob is a single opaque value that a package loads at startup and
+// rewrites as a whole
+type Blob interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+type blob struct {
+	s   *Store
+	key string
+}
+
+// Blob returns the value stored under key in the state bucket
+func (s *Store) Blob(key string) Blob {
+	return &blob{s: s, key: key}
+}
+
+func (b *blob) Load() ([]byte, error) {
+	var data []byte
+	err := b.s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(BUCKET_STATE)).Get([]byte(b.key))
+		if v == nil {
+			return ErrNotFound
+		}
+		// Values are only valid for the life of the transaction
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (b *blob) Save(data []byte) error {
+	return b.s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_STATE)).Put([]byte(b.key), data)
+	})
+}
+
+// ImportFile moves a legacy state file into the blob under key. Nothing
+// happens when the blob already exists or the file is missing; the file is
+// removed once its contents are committed.
+func (s *Store) ImportFile(key, path string) (bool, error) {
+	if _, err := s.Blob(key).Load(); err == nil {
+		return false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := s.Blob(key).Save(data); err != nil {
+		return false, fmt.Errorf("failed to import %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return true, fmt.Errorf("imported %s but failed to remove it: %w", path, err)
+	}
+	return true, nil
+}
+
+// Queue is a bounded, ordered list of JSON records kept in a nested bucket
+type Queue struct {
+	s      *Store
+	bucket string
+	name   string
+	max    int
+}
+
+// Queue returns the queue name within bucket, holding at most max records
+// (0 for no limit)
+func (s *Store) Queue(bucket, name string, max int) *Queue {
+	return &Queue{s: s, bucket: bucket, name: name, max: max}
+}
+
+// Push appends v, dropping the oldest records beyond the limit in the same
+// transaction; returns how many were dropped
+func (q *Queue) Push(v interface{}) (int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal %s record: %w", q.name, err)
+	}
+
+	dropped := 0
+	err = q.s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(q.bucket)).CreateBucketIfNotExists([]byte(q.name))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(sequenceKey(seq), data); err != nil {
+			return err
+		}
+		if q.max <= 0 {
+			return nil
+		}
+
+		excess := count(b) - q.max
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && excess > 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			excess--
+			dropped++
+		}
+		return nil
+	})
+	return dropped, err
+}
+
+// Peek decodes the oldest record into v; false when the queue is empty
+func (q *Queue) Peek(v interface{}) (bool, error) {
+	found := false
+	err := q.s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(q.bucket)).Bucket([]byte(q.name))
+		if b == nil {
+			return nil
+		}
+		k, data := b.Cursor().First()
+		if k == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
+
+// Pop removes the oldest record
+func (q *Queue) Pop() error {
+	return q.s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(q.bucket)).Bucket([]byte(q.name))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		if k, _ := c.First(); k != nil {
+			return c.Delete()
+		}
+		return nil
+	})
+}
+
+// Len returns the number of records
+func (q *Queue) Len() int {
+	n := 0
+	q.s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(q.bucket)).Bucket([]byte(q.name)); b != nil {
+			n = count(b)
+		}
+		return nil
+	})
+	return n
+}
+
+// List calls fn with every record, oldest first
+func (q *Queue) List(fn func(data []byte) error) error {
+	return q.s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(q.bucket)).Bucket([]byte(q.name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+// Stats only covers committed pages, so count keys directly
+func count(b *bolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// Big-endian keys sort in insertion order
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,177 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/redact"
+)
+
+const (
+	STATUS_SUCCEEDED = "succeeded"
+	STATUS_FAILED    = "failed"
+	STATUS_REJECTED  = "rejected"
+
+	// Upper bound for a single task unless the handler sets its own
+	DEFAULT_TASK_TIMEOUT = 5 * time.Minute
+)
+
+// ErrRejected marks a task refused by policy (as opposed to one that failed
+// while running), e.g. a path outside the allowed directories
+var ErrRejected = errors.New("task rejected")
+
+// Task is a unit of work pushed by the server
+type Task struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+	// Single-use value covered by the signature, for replay protection
+	Nonce string `json:"nonce,omitempty"`
+	// Detached signature over SignedMessage, made by a manifest key
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Verifier authenticates a task before it runs
+type Verifier func(task *Task) error
+
+// Result is reported back to the server after a task runs
+type Result struct {
+	TaskID     string      `json:"task_id"`
+	Type       string      `json:"type"`
+	Status     string      `json:"status"`
+	Data       interface{} `json:"data,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+}
+
+// Handler executes one task type and returns data to report to the server
+type Handler func(ctx context.Context, task *Task) (interface{}, error)
+
+// Registry maps task types to handlers
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	verify   Verifier
+}
+
+// NewRegistry creates an empty task registry
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+// Register installs the handler for a task type
+func (r *Registry) Register(taskType string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[taskType] = handler
+}
+
+// SetVerifier makes every task pass verify before it is dispatched
+func (r *Registry) SetVerifier(verify Verifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.verify = verify
+}
+
+// SignedMessage is the byte string a task signature covers. Each field is
+// length-prefixed so no two tasks can produce the same message.
+func SignedMessage(task *Task) []byte {
+	var b []byte
+	b = append(b, "certfix-task-v1"...)
+	for _, field := range [][]byte{
+		[]byte(task.ID),
+		[]byte(task.Type),
+		[]byte(task.CreatedAt.UTC().Format(time.RFC3339Nano)),
+		[]byte(task.Nonce),
+		task.Payload,
+	} {
+		b = append(b, fmt.Sprintf("\n%d:", len(field))...)
+		b = append(b, field...)
+	}
+	return b
+}
+
+// Types returns the registered task types, advertised to the server
+func (r *Registry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]string, 0, len(r.handlers))
+	for taskType := range r.handlers {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Execute runs a task with a timeout and converts the outcome into a Result.
+// Unknown task types are rejected rather than failed.
+func (r *Registry) Execute(ctx context.Context, task *Task) *Result {
+	result := &Result{
+		TaskID:    task.ID,
+		Type:      task.Type,
+		StartedAt: time.Now().UTC(),
+	}
+
+	r.mu.RLock()
+	handler, ok := r.handlers[task.Type]
+	verify := r.verify
+	r.mu.RUnlock()
+
+	if verify != nil {
+		if err := verify(task); err != nil {
+			result.Status = STATUS_REJECTED
+			result.Error = fmt.Sprintf("signature verification failed: %v", err)
+			result.FinishedAt = time.Now().UTC()
+			return result
+		}
+	}
+
+	if !ok {
+		result.Status = STATUS_REJECTED
+		result.Error = fmt.Sprintf("unsupported task type %q", task.Type)
+		result.FinishedAt = time.Now().UTC()
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DEFAULT_TASK_TIMEOUT)
+	defer cancel()
+
+	data, err := handler(ctx, task)
+	result.FinishedAt = time.Now().UTC()
+	result.Data = data
+
+	switch {
+	case err == nil:
+		result.Status = STATUS_SUCCEEDED
+	case errors.Is(err, ErrRejected):
+		result.Status = STATUS_REJECTED
+		result.Error = redact.String(err.Error())
+	default:
+		result.Status = STATUS_FAILED
+		result.Error = redact.String(err.Error())
+	}
+
+	return result
+}
+
+// Decode unmarshals a task payload into v, wrapping errors as rejections
+func Decode(task *Task, v interface{}) error {
+	if err := json.Unmarshal(task.Payload, v); err != nil {
+		return fmt.Errorf("%w: invalid payload: %v", ErrRejected, err)
+	}
+	return nil
+}
+
+// Rejectf builds a policy rejection error
+func Rejectf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrRejected, fmt.Sprintf(format, args...))
+}
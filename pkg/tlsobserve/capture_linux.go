@@ -0,0 +1,131 @@
+//go:build linux
+
+package tlsobserve
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// Packets wait this long in a read before shutdown is checked
+const READ_TIMEOUT_SECONDS = 1
+
+// A packet socket with an eBPF filter that only lets ClientHellos to the
+// watched ports reach user space, so busy servers cost nothing per packet
+type packetCapture struct {
+	fd      int
+	program *ebpf.Program
+}
+
+func openCapture(ports []int) (capture, error) {
+	program, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "certfix_hello",
+		Type:         ebpf.SocketFilter,
+		License:      "GPL",
+		Instructions: helloFilter(ports),
+	})
+	if err != nil {
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			return nil, ErrUnsupported
+		}
+		return nil, fmt.Errorf("failed to load capture filter: %w", err)
+	}
+
+	// SOCK_DGRAM strips the link layer: packets start at the IP header
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		program.Close()
+		return nil, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	c := &packetCapture{fd: fd, program: program}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ATTACH_BPF, program.FD()); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to attach capture filter: %w", err)
+	}
+	timeout := unix.Timeval{Sec: READ_TIMEOUT_SECONDS}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	return c, nil
+}
+
+func (c *packetCapture) next(buf []byte) (segment, bool, error) {
+	n, from, err := unix.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return segment{}, false, nil
+		}
+		return segment{}, false, err
+	}
+	// Only hellos the host receives; loopback traffic shows up twice
+	if link, ok := from.(*unix.SockaddrLinklayer); !ok || link.Pkttype != unix.PACKET_HOST {
+		return segment{}, false, nil
+	}
+	seg, ok := parseSegment(buf[:n])
+	return seg, ok, nil
+}
+
+func (c *packetCapture) Close() error {
+	err := unix.Close(c.fd)
+	c.program.Close()
+	return err
+}
+
+// helloFilter returns the socket filter: TCP over IPv4 (unfragmented) or
+// IPv6 without extension headers, to one of ports, whose payload starts
+// a handshake record holding a ClientHello. It keeps the packet or drops it.
+func helloFilter(ports []int) asm.Instructions {
+	insns := asm.Instructions{
+		// Packet loads read the sk_buff in R6
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadAbs(0, asm.Byte),
+		asm.RSh.Imm(asm.R0, 4),
+		asm.JEq.Imm(asm.R0, 6, "ipv6"),
+		asm.JNE.Imm(asm.R0, 4, "drop"),
+
+		asm.LoadAbs(9, asm.Byte),
+		asm.JNE.Imm(asm.R0, PROTO_TCP, "drop"),
+		asm.LoadAbs(6, asm.Half),
+		asm.And.Imm(asm.R0, IPV4_FRAGMENT_MASK),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+		asm.LoadAbs(0, asm.Byte),
+		asm.And.Imm(asm.R0, 0x0f),
+		asm.LSh.Imm(asm.R0, 2),
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.Ja.Label("tcp"),
+
+		asm.LoadAbs(6, asm.Byte).WithSymbol("ipv6"),
+		asm.JNE.Imm(asm.R0, PROTO_TCP, "drop"),
+		asm.Mov.Imm(asm.R7, IPV6_HEADER_LENGTH),
+
+		// R7 is the TCP header offset; R8 keeps the destination port
+		asm.LoadInd(asm.R0, asm.R7, 2, asm.Half).WithSymbol("tcp"),
+		asm.Mov.Reg(asm.R8, asm.R0),
+		asm.LoadInd(asm.R0, asm.R7, 12, asm.Byte),
+		asm.RSh.Imm(asm.R0, 4),
+		asm.LSh.Imm(asm.R0, 2),
+		asm.Add.Reg(asm.R7, asm.R0),
+		asm.LoadInd(asm.R0, asm.R7, 0, asm.Byte),
+		asm.JNE.Imm(asm.R0, RECORD_HANDSHAKE, "drop"),
+		asm.LoadInd(asm.R0, asm.R7, TLS_RECORD_HEADER, asm.Byte),
+		asm.JNE.Imm(asm.R0, HANDSHAKE_HELLO, "drop"),
+	}
+	for _, port := range ports {
+		insns = append(insns, asm.JEq.Imm(asm.R8, int32(port), "keep"))
+	}
+	return append(insns,
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("drop"),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, SNAPLEN).WithSymbol("keep"),
+		asm.Return(),
+	)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
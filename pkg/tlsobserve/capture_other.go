@@ -0,0 +1,8 @@
+//go:build !linux
+
+package tlsobserve
+
+// Handshakes can only be captured with eBPF on Linux
+func openCapture(ports []int) (capture, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,134 @@
+package tlsobserve
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	RECORD_HANDSHAKE    = 0x16
+	HANDSHAKE_HELLO     = 1
+	EXTENSION_SNI       = 0
+	PROTO_TCP           = 6
+	IPV6_HEADER_LENGTH  = 40
+	IPV4_FRAGMENT_MASK  = 0x1fff
+	SNI_TYPE_HOST_NAME  = 0
+	TLS_RECORD_HEADER   = 5
+	HELLO_RANDOM_LENGTH = 32
+)
+
+// parseSegment splits an IP packet into the TCP endpoints and payload. The
+// capture filter already kept only ClientHellos to the watched ports.
+func parseSegment(packet []byte) (segment, bool) {
+	if len(packet) == 0 {
+		return segment{}, false
+	}
+	var src, dst netip.Addr
+	var offset int
+	switch packet[0] >> 4 {
+	case 4:
+		offset = int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || offset < 20 || packet[9] != PROTO_TCP {
+			return segment{}, false
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+	case 6:
+		offset = IPV6_HEADER_LENGTH
+		if len(packet) < offset || packet[6] != PROTO_TCP {
+			return segment{}, false
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+	default:
+		return segment{}, false
+	}
+
+	tcp := packet[min(offset, len(packet)):]
+	if len(tcp) < 20 {
+		return segment{}, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return segment{}, false
+	}
+	return segment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:2])),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:4])),
+		payload: tcp[dataOffset:],
+	}, true
+}
+
+// serverName returns the SNI of a ClientHello, or "" without one. Large
+// hellos span several segments; extensions are read as far as this one
+// goes, which usually reaches the server name.
+func serverName(payload []byte) string {
+	if len(payload) < TLS_RECORD_HEADER+4 || payload[0] != RECORD_HANDSHAKE || payload[TLS_RECORD_HEADER] != HANDSHAKE_HELLO {
+		return ""
+	}
+	// Handshake header, client version and random
+	hello := payload[TLS_RECORD_HEADER+4:]
+	hello, ok := skip(hello, 2+HELLO_RANDOM_LENGTH)
+	if !ok {
+		return ""
+	}
+	// Session ID, cipher suites, compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		if hello, ok = skipPrefixed(hello, lengthSize); !ok {
+			return ""
+		}
+	}
+	if hello, ok = skip(hello, 2); !ok {
+		return ""
+	}
+
+	for len(hello) >= 4 {
+		kind := binary.BigEndian.Uint16(hello[0:2])
+		length := int(binary.BigEndian.Uint16(hello[2:4]))
+		hello = hello[4:]
+		if length > len(hello) {
+			return ""
+		}
+		if kind == EXTENSION_SNI {
+			return hostName(hello[:length])
+		}
+		hello = hello[length:]
+	}
+	return ""
+}
+
+// hostName reads the first host_name entry of a server_name extension
+func hostName(ext []byte) string {
+	list, ok := skip(ext, 2)
+	for ok && len(list) >= 3 {
+		kind := list[0]
+		length := int(binary.BigEndian.Uint16(list[1:3]))
+		if len(list) < 3+length {
+			return ""
+		}
+		if kind == SNI_TYPE_HOST_NAME {
+			return string(list[3 : 3+length])
+		}
+		list = list[3+length:]
+	}
+	return ""
+}
+
+func skip(data []byte, n int) ([]byte, bool) {
+	if len(data) < n {
+		return nil, false
+	}
+	return data[n:], true
+}
+
+// skipPrefixed skips a vector whose length takes lengthSize bytes
+func skipPrefixed(data []byte, lengthSize int) ([]byte, bool) {
+	if len(data) < lengthSize {
+		return nil, false
+	}
+	length := int(data[0])
+	if lengthSize == 2 {
+		length = int(binary.BigEndian.Uint16(data[0:2]))
+	}
+	return skip(data[lengthSize:], length)
+}
@@ -0,0 +1,308 @@
+// Package tlsobserve watches the TLS handshakes the host's servers answer
+// and counts which certificate each one presented, so the inventory can
+// tell certificates clients actually get from files nothing serves.
+//
+// Capture only sees ClientHellos: the certificate itself is encrypted in
+// TLS 1.3. Every new (address, port, server name) is resolved once by
+// handshaking with the server the same way, and the answer is cached.
+package tlsobserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a resolved certificate is trusted before asking again
+	RESOLVE_TTL     = 10 * time.Minute
+	RESOLVE_TIMEOUT = 5 * time.Second
+	// Targets waiting to be resolved; hellos beyond it count as unresolved
+	RESOLVE_QUEUE = 256
+	// Packets larger than this are cut; a ClientHello fits easily
+	SNAPLEN = 16384
+)
+
+// ErrUnsupported is returned where the kernel can't capture handshakes.
+// Callers should treat it as a warning, not a failure.
+var ErrUnsupported = errors.New("TLS observation is not supported on this system")
+
+// DEFAULT_PORTS speak TLS from the first byte; STARTTLS ports can't be
+// resolved by a plain handshake
+var DEFAULT_PORTS = []int{443, 8443, 465, 636, 993, 995}
+
+// Usage is how often one certificate was presented since the observer
+// started
+type Usage struct {
+	Fingerprint string    `json:"fingerprint_sha256"`
+	Subject     string    `json:"subject,omitempty"`
+	Handshakes  int64     `json:"handshakes"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Ports       []int     `json:"ports"`
+	ServerNames []string  `json:"server_names,omitempty"`
+}
+
+// Report is what the observer has seen so far
+type Report struct {
+	Since      time.Time `json:"since"`
+	Ports      []int     `json:"ports"`
+	Handshakes int64     `json:"handshakes"`
+	// Unresolved handshakes whose certificate couldn't be fetched
+	Unresolved   int64   `json:"unresolved,omitempty"`
+	Certificates []Usage `json:"certificates"`
+}
+
+// Find returns the usage of a certificate by its SHA-256 fingerprint
+func (r *Report) Find(fingerprint string) (Usage, bool) {
+	for _, usage := range r.Certificates {
+		if usage.Fingerprint == fingerprint {
+			return usage, true
+		}
+	}
+	return Usage{}, false
+}
+
+// A handshake to resolve: the server address and the name the client asked for
+type target struct {
+	addr netip.Addr
+	port int
+	sni  string
+}
+
+type resolved struct {
+	fingerprint string
+	subject     string
+	expires     time.Time
+}
+
+// Hellos seen for a target while it is being resolved
+type pending struct {
+	count int64
+	first time.Time
+	last  time.Time
+}
+
+// A ClientHello segment captured on its way to a local server
+type segment struct {
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	payload []byte
+}
+
+// capture delivers ClientHello segments; next returns false when the read
+// timed out or the packet wasn't one, so the caller can check for shutdown
+type capture interface {
+	next(buf []byte) (segment, bool, error)
+	Close() error
+}
+
+// Observer counts the certificates presented in handshakes on the host
+type Observer struct {
+	ports []int
+	since time.Time
+	queue chan target
+
+	mu         sync.Mutex
+	usage      map[string]*Usage
+	cache      map[target]resolved
+	pending    map[target]*pending
+	own        map[uint16]time.Time
+	handshakes int64
+	unresolved int64
+}
+
+// New returns an observer of handshakes to the given local ports,
+// DEFAULT_PORTS if none
+func New(ports []int) *Observer {
+	if len(ports) == 0 {
+		ports = DEFAULT_PORTS
+	}
+	return &Observer{
+		ports:   slices.Sorted(slices.Values(ports)),
+		queue:   make(chan target, RESOLVE_QUEUE),
+		usage:   map[string]*Usage{},
+		cache:   map[target]resolved{},
+		pending: map[target]*pending{},
+		own:     map[uint16]time.Time{},
+	}
+}
+
+// Start attaches the capture filter and watches until ctx is done. Failing
+// to attach it, e.g. without CAP_BPF and CAP_NET_RAW, is returned.
+func (o *Observer) Start(ctx context.Context) error {
+	for _, port := range o.ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	source, err := openCapture(o.ports)
+	if err != nil {
+		return err
+	}
+	o.since = time.Now().UTC()
+
+	go o.resolveLoop(ctx)
+	go func() {
+		defer source.Close()
+		buf := make([]byte, SNAPLEN)
+		for ctx.Err() == nil {
+			seg, ok, err := source.next(buf)
+			if err != nil {
+				log.Printf("[ERROR] TLS observer stopped: %v", err)
+				return
+			}
+			if ok {
+				o.observe(seg)
+			}
+		}
+	}()
+	return nil
+}
+
+// observe counts one ClientHello against its cached certificate, or holds
+// it until the target is resolved
+func (o *Observer) observe(seg segment) {
+	now := time.Now().UTC()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Skip the hellos of our own resolving handshakes
+	if expires, ok := o.own[seg.src.Port()]; ok && now.Before(expires) {
+		return
+	}
+	o.handshakes++
+	t := target{addr: seg.dst.Addr().Unmap(), port: int(seg.dst.Port()), sni: serverName(seg.payload)}
+
+	if r, ok := o.cache[t]; ok && now.Before(r.expires) {
+		o.count(t, r, 1, now, now)
+		return
+	}
+	if p, ok := o.pending[t]; ok {
+		p.count++
+		p.last = now
+		return
+	}
+	select {
+	case o.queue <- t:
+		o.pending[t] = &pending{count: 1, first: now, last: now}
+	default:
+		o.unresolved++
+	}
+}
+
+// count attributes handshakes to the certificate; callers hold o.mu
+func (o *Observer) count(t target, r resolved, n int64, first, last time.Time) {
+	usage, ok := o.usage[r.fingerprint]
+	if !ok {
+		usage = &Usage{Fingerprint: r.fingerprint, Subject: r.subject, FirstSeen: first}
+		o.usage[r.fingerprint] = usage
+	}
+	usage.Handshakes += n
+	usage.LastSeen = last
+	if !slices.Contains(usage.Ports, t.port) {
+		usage.Ports = append(usage.Ports, t.port)
+		slices.Sort(usage.Ports)
+	}
+	if t.sni != "" && !slices.Contains(usage.ServerNames, t.sni) {
+		usage.ServerNames = append(usage.ServerNames, t.sni)
+		slices.Sort(usage.ServerNames)
+	}
+}
+
+func (o *Observer) resolveLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-o.queue:
+			r, err := o.resolve(ctx, t)
+			o.mu.Lock()
+			p := o.pending[t]
+			delete(o.pending, t)
+			if err != nil {
+				o.unresolved += p.count
+				log.Printf("[WARNING] TLS observer: failed to resolve the certificate of %s (%q): %v", net.JoinHostPort(t.addr.String(), strconv.Itoa(t.port)), t.sni, err)
+			} else {
+				o.cache[t] = r
+				o.count(t, r, p.count, p.first, p.last)
+			}
+			o.mu.Unlock()
+		}
+	}
+}
+
+// resolve handshakes with the server as the client did and returns the
+// leaf certificate it presents. Its local port is registered first so the
+// capture doesn't count this handshake.
+func (o *Observer) resolve(ctx context.Context, t target) (resolved, error) {
+	ctx, cancel := context.WithTimeout(ctx, RESOLVE_TIMEOUT)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.addr.String(), strconv.Itoa(t.port)))
+	if err != nil {
+		return resolved{}, err
+	}
+	defer conn.Close()
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		o.mu.Lock()
+		now := time.Now()
+		for port, expires := range o.own {
+			if now.After(expires) {
+				delete(o.own, port)
+			}
+		}
+		o.own[uint16(local.Port)] = now.Add(RESOLVE_TIMEOUT + time.Second)
+		o.mu.Unlock()
+	}
+
+	// Only the presented certificate matters here, not whether it verifies
+	client := tls.Client(conn, &tls.Config{ServerName: t.sni, InsecureSkipVerify: true})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return resolved{}, err
+	}
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return resolved{}, fmt.Errorf("no certificate presented")
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return resolved{
+		fingerprint: hex.EncodeToString(sum[:]),
+		subject:     certs[0].Subject.String(),
+		expires:     time.Now().Add(RESOLVE_TTL),
+	}, nil
+}
+
+// Report returns a snapshot of the usage counted so far, most used first
+func (o *Observer) Report() *Report {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	report := &Report{Since: o.since, Ports: o.ports, Handshakes: o.handshakes, Unresolved: o.unresolved}
+	for _, usage := range o.usage {
+		u := *usage
+		u.Ports = slices.Clone(usage.Ports)
+		u.ServerNames = slices.Clone(usage.ServerNames)
+		report.Certificates = append(report.Certificates, u)
+	}
+	sort.Slice(report.Certificates, func(i, j int) bool {
+		a, b := report.Certificates[i], report.Certificates[j]
+		if a.Handshakes != b.Handshakes {
+			return a.Handshakes > b.Handshakes
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+	return report
+}
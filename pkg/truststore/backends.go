@@ -0,0 +1,172 @@
+package truststore
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	BACKEND_DEBIAN  = "update-ca-certificates"
+	BACKEND_REDHAT  = "update-ca-trust"
+	BACKEND_P11KIT  = "p11-kit"
+	BACKEND_MACOS   = "macos-keychain"
+	BACKEND_WINDOWS = "windows-certstore"
+
+	SYSTEM_KEYCHAIN = "/Library/Keychains/System.keychain"
+	// Prefix of the anchor files the agent writes, so they stand out
+	FILE_PREFIX = "certfix-"
+)
+
+// Detect picks the trust store of this host; nil when none is supported
+func Detect() Backend {
+	switch runtime.GOOS {
+	case "darwin":
+		if commandExists("security") {
+			return &keychainBackend{keychain: SYSTEM_KEYCHAIN}
+		}
+	case "windows":
+		if commandExists("certutil") {
+			return &certutilBackend{}
+		}
+	default:
+		// Debian, Ubuntu and Alpine; then RHEL, Fedora, SUSE-likes and Arch
+		if commandExists("update-ca-certificates") && isDir("/usr/local/share/ca-certificates") {
+			return &anchorBackend{name: BACKEND_DEBIAN, dir: "/usr/local/share/ca-certificates", refresh: []string{"update-ca-certificates"}, outputs: []string{"/etc/ssl/certs"}}
+		}
+		if commandExists("update-ca-trust") && isDir("/etc/pki/ca-trust/source/anchors") {
+			return &anchorBackend{name: BACKEND_REDHAT, dir: "/etc/pki/ca-trust/source/anchors", refresh: []string{"update-ca-trust", "extract"}, outputs: []string{"/etc/pki/ca-trust/extracted"}}
+		}
+		if commandExists("trust") && isDir("/etc/ca-certificates/trust-source/anchors") {
+			return &anchorBackend{name: BACKEND_P11KIT, dir: "/etc/ca-certificates/trust-source/anchors", refresh: []string{"trust", "extract-compat"}, outputs: []string{"/etc/ca-certificates/extracted", "/etc/ssl/certs"}}
+		}
+	}
+	return nil
+}
+
+// anchorBackend drops PEM files in the distribution's anchor directory and
+// regenerates the system bundle
+type anchorBackend struct {
+	name    string
+	dir     string
+	refresh []string
+	// Where refresh writes the regenerated bundles
+	outputs []string
+}
+
+func (b *anchorBackend) Name() string {
+	return b.name
+}
+
+// Paths lists the directories a backend writes to, for the sandbox: the
+// anchor directory and the bundles its refresh regenerates. Keychain and
+// certificate store backends write through their own tools and have none.
+func Paths(backend Backend) []string {
+	anchors, ok := backend.(*anchorBackend)
+	if !ok {
+		return nil
+	}
+	return append([]string{anchors.dir}, anchors.outputs...)
+}
+
+// The file is named by fingerprint so entries never collide
+func (b *anchorBackend) path(entry *Installed) string {
+	return filepath.Join(b.dir, FILE_PREFIX+entry.SHA256[:16]+".crt")
+}
+
+func (b *anchorBackend) Add(ctx context.Context, cert *x509.Certificate, entry *Installed) error {
+	if err := os.WriteFile(b.path(entry), encodePEM(cert), 0644); err != nil {
+		return fmt.Errorf("failed to write trust anchor: %w", err)
+	}
+	return nil
+}
+
+func (b *anchorBackend) Remove(ctx context.Context, entry *Installed) error {
+	if err := os.Remove(b.path(entry)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove trust anchor: %w", err)
+	}
+	return nil
+}
+
+func (b *anchorBackend) Refresh(ctx context.Context) error {
+	return run(ctx, b.refresh[0], b.refresh[1:]...)
+}
+
+// keychainBackend trusts roots in the System keychain for every user;
+// intermediates are only added, so path building can find them
+type keychainBackend struct {
+	keychain string
+}
+
+func (b *keychainBackend) Name() string {
+	return BACKEND_MACOS
+}
+
+func (b *keychainBackend) Add(ctx context.Context, cert *x509.Certificate, entry *Installed) error {
+	return withTempPEM(cert, func(file string) error {
+		if entry.Root {
+			return run(ctx, "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", b.keychain, file)
+		}
+		return run(ctx, "security", "add-certificates", "-k", b.keychain, file)
+	})
+}
+
+func (b *keychainBackend) Remove(ctx context.Context, entry *Installed) error {
+	// delete-certificate -t drops the trust settings along with the item
+	return run(ctx, "security", "delete-certificate", "-Z", entry.SHA1, "-t", b.keychain)
+}
+
+func (b *keychainBackend) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// certutilBackend uses the local machine Root and CA stores
+type certutilBackend struct{}
+
+func (b *certutilBackend) Name() string {
+	return BACKEND_WINDOWS
+}
+
+func storeFor(entry *Installed) string {
+	if entry.Root {
+		return "Root"
+	}
+	return "CA"
+}
+
+func (b *certutilBackend) Add(ctx context.Context, cert *x509.Certificate, entry *Installed) error {
+	return withTempPEM(cert, func(file string) error {
+		return run(ctx, "certutil", "-addstore", "-f", storeFor(entry), file)
+	})
+}
+
+func (b *certutilBackend) Remove(ctx context.Context, entry *Installed) error {
+	return run(ctx, "certutil", "-delstore", storeFor(entry), entry.SHA1)
+}
+
+func (b *certutilBackend) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// withTempPEM hands the certificate to tools that only read files
+func withTempPEM(cert *x509.Certificate, fn func(file string) error) error {
+	dir, err := os.MkdirTemp("", "certfix-truststore-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(file, encodePEM(cert), 0600); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return fn(file)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,293 @@
+package truststore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of trust store reported in the inventory
+const (
+	KIND_SYSTEM = "system"
+	KIND_JAVA   = "java"
+	KIND_NSS    = "nss"
+
+	// Password every JDK ships cacerts with; only used by keytool, which
+	// insists on one even to list trusted certificates
+	JAVA_STOREPASS = "changeit"
+)
+
+// System bundles, in the order Go's crypto/x509 looks for them
+var systemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+var javaStores = []string{
+	"/etc/ssl/certs/java/cacerts",
+	"/etc/pki/java/cacerts",
+	"/usr/lib/jvm/*/lib/security/cacerts",
+	"/usr/lib/jvm/*/jre/lib/security/cacerts",
+	"/opt/java/*/lib/security/cacerts",
+	"/Library/Java/JavaVirtualMachines/*/Contents/Home/lib/security/cacerts",
+}
+
+var nssDirs = []string{
+	"/etc/pki/nssdb",
+	"/root/.pki/nssdb",
+	"/home/*/.pki/nssdb",
+	"/root/.mozilla/firefox/*",
+	"/home/*/.mozilla/firefox/*",
+}
+
+// InventoryOptions pick the stores enumerated besides the OS one
+type InventoryOptions struct {
+	Java bool
+	NSS  bool
+	// Fingerprints of the CAs the agent installed itself
+	Managed map[string]bool
+}
+
+// Store is one trust store found on the host and the CAs it trusts
+type Store struct {
+	Kind     string `json:"kind"`
+	Location string `json:"location"`
+	CAs      []CA   `json:"cas"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CA describes one trusted certificate
+type CA struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	FingerprintSHA256  string    `json:"fingerprint_sha256"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	KeyAlgorithm       string    `json:"key_algorithm"`
+	KeySize            int       `json:"key_size,omitempty"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	SelfSigned         bool      `json:"self_signed"`
+	// Installed by the agent from server policy
+	Managed bool `json:"managed,omitempty"`
+}
+
+// Enumerate lists the CAs trusted by the OS and, when asked, by the Java
+// keystores and NSS databases found on the host
+func Enumerate(ctx context.Context, opts InventoryOptions) []Store {
+	stores := []Store{systemStore(ctx)}
+	if opts.Java {
+		for _, path := range glob(javaStores) {
+			stores = append(stores, javaStore(ctx, path))
+		}
+	}
+	if opts.NSS && runtime.GOOS != "windows" && commandExists("certutil") {
+		for _, dir := range glob(nssDirs) {
+			if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err == nil {
+				stores = append(stores, nssStore(ctx, dir))
+			}
+		}
+	}
+	for i := range stores {
+		for j := range stores[i].CAs {
+			stores[i].CAs[j].Managed = opts.Managed[stores[i].CAs[j].FingerprintSHA256]
+		}
+	}
+	return stores
+}
+
+func systemStore(ctx context.Context) Store {
+	switch runtime.GOOS {
+	case "darwin":
+		store := Store{Kind: KIND_SYSTEM, Location: "keychain"}
+		var ders [][]byte
+		for _, keychain := range []string{"/System/Library/Keychains/SystemRootCertificates.keychain", SYSTEM_KEYCHAIN} {
+			out, err := output(ctx, "security", "find-certificate", "-a", "-p", keychain)
+			if err != nil {
+				store.Error = err.Error()
+				continue
+			}
+			ders = append(ders, pemBlocks([]byte(out))...)
+		}
+		store.CAs = describeAll(ders)
+		return store
+	case "windows":
+		store := Store{Kind: KIND_SYSTEM, Location: `Cert:\LocalMachine\Root`}
+		out, err := output(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			`Get-ChildItem Cert:\LocalMachine\Root | ForEach-Object { [Convert]::ToBase64String($_.RawData) }`)
+		if err != nil {
+			store.Error = err.Error()
+			return store
+		}
+		var ders [][]byte
+		for _, line := range strings.Fields(out) {
+			if der, err := base64.StdEncoding.DecodeString(line); err == nil {
+				ders = append(ders, der)
+			}
+		}
+		store.CAs = describeAll(ders)
+		return store
+	default:
+		for _, path := range systemBundles {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			return Store{Kind: KIND_SYSTEM, Location: path, CAs: describeAll(pemBlocks(data))}
+		}
+		return Store{Kind: KIND_SYSTEM, Error: "no CA bundle found"}
+	}
+}
+
+// javaStore reads JKS keystores directly; anything else (PKCS#12 in newer
+// JDKs) goes through keytool when it is installed
+func javaStore(ctx context.Context, path string) Store {
+	store := Store{Kind: KIND_JAVA, Location: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		store.Error = err.Error()
+		return store
+	}
+	ders, err := parseJKS(data)
+	if err == errNotJKS && commandExists("keytool") {
+		var out string
+		out, err = output(ctx, "keytool", "-list", "-rfc", "-keystore", path, "-storepass", JAVA_STOREPASS)
+		ders = pemBlocks([]byte(out))
+	}
+	if err != nil {
+		store.Error = err.Error()
+	}
+	store.CAs = describeAll(ders)
+	return store
+}
+
+// nssStore lists the certificates an NSS database trusts to issue server
+// certificates ("C" in the SSL trust flags)
+func nssStore(ctx context.Context, dir string) Store {
+	store := Store{Kind: KIND_NSS, Location: dir}
+	db := "sql:" + dir
+	out, err := output(ctx, "certutil", "-L", "-d", db)
+	if err != nil {
+		store.Error = err.Error()
+		return store
+	}
+
+	var ders [][]byte
+	for _, line := range strings.Split(out, "\n") {
+		// "<nickname>   <ssl>,<email>,<object signing>"; nicknames have spaces
+		line = strings.TrimSpace(line)
+		split := strings.LastIndexAny(line, " \t")
+		if split < 0 {
+			continue
+		}
+		nickname, flags := strings.TrimSpace(line[:split]), line[split+1:]
+		ssl, _, found := strings.Cut(flags, ",")
+		if !found || !strings.ContainsAny(ssl, "cC") {
+			continue
+		}
+		cert, err := output(ctx, "certutil", "-L", "-d", db, "-n", nickname, "-a")
+		if err != nil {
+			continue
+		}
+		ders = append(ders, pemBlocks([]byte(cert))...)
+	}
+	store.CAs = describeAll(ders)
+	return store
+}
+
+func describeAll(ders [][]byte) []CA {
+	seen := map[string]bool{}
+	cas := []CA{}
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		ca := Describe(cert)
+		if seen[ca.FingerprintSHA256] {
+			continue
+		}
+		seen[ca.FingerprintSHA256] = true
+		cas = append(cas, ca)
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].Subject < cas[j].Subject })
+	return cas
+}
+
+// Describe summarizes a trusted certificate for the inventory
+func Describe(cert *x509.Certificate) CA {
+	ca := CA{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		FingerprintSHA256:  Fingerprint(cert),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		SelfSigned:         IsSelfSigned(cert),
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		ca.KeySize = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		ca.KeySize = key.Curve.Params().BitSize
+	}
+	return ca
+}
+
+func pemBlocks(data []byte) [][]byte {
+	var ders [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return ders
+		}
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+}
+
+func glob(patterns []string) []string {
+	var paths []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			// Distributions link every JDK's cacerts to the shared one
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil || seen[resolved] {
+				continue
+			}
+			seen[resolved] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return string(out), err
+}
@@ -0,0 +1,100 @@
+package truststore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	JKS_MAGIC = 0xFEEDFEED
+
+	jksPrivateKey  = 1
+	jksTrustedCert = 2
+)
+
+var errNotJKS = errors.New("not a JKS keystore")
+
+// parseJKS returns the trusted certificates of a Java KeyStore. Reading
+// certificate entries needs no password; the trailing integrity digest is
+// not checked, as nothing read here is trusted by the agent itself.
+func parseJKS(data []byte) ([][]byte, error) {
+	r := &jksReader{data: data}
+	if r.uint32() != JKS_MAGIC {
+		return nil, errNotJKS
+	}
+	version := r.uint32()
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unsupported JKS version %d", version)
+	}
+
+	count := r.uint32()
+	var certs [][]byte
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		tag := r.uint32()
+		r.utf() // alias
+		r.bytes(8)
+		switch tag {
+		case jksPrivateKey:
+			r.bytes(int(r.uint32()))
+			chain := r.uint32()
+			for j := uint32(0); j < chain && r.err == nil; j++ {
+				r.certificate(version)
+			}
+		case jksTrustedCert:
+			if der := r.certificate(version); der != nil {
+				certs = append(certs, der)
+			}
+		default:
+			return certs, fmt.Errorf("unknown JKS entry type %d", tag)
+		}
+	}
+	if r.err != nil {
+		return certs, fmt.Errorf("truncated JKS keystore")
+	}
+	return certs, nil
+}
+
+type jksReader struct {
+	data []byte
+	err  error
+}
+
+func (r *jksReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *jksReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *jksReader) utf() string {
+	b := r.bytes(2)
+	if b == nil {
+		return ""
+	}
+	return string(r.bytes(int(binary.BigEndian.Uint16(b))))
+}
+
+// Version 2 keystores name the certificate type before each certificate
+func (r *jksReader) certificate(version uint32) []byte {
+	certType := "X.509"
+	if version == 2 {
+		certType = r.utf()
+	}
+	der := r.bytes(int(r.uint32()))
+	if certType != "X.509" {
+		return nil
+	}
+	return der
+}
@@ -0,0 +1,167 @@
+package truststore
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/certfix/certfix-agent/pkg/audit"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_TRUSTSTORE_APPLY = "truststore.apply"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// CARequest is one organization CA to be trusted
+type CARequest struct {
+	Name string `json:"name"`
+	PEM  string `json:"pem"`
+}
+
+// ApplyRequest is the payload of a truststore.apply task. A CA whose name
+// is already installed with another certificate is replaced by it.
+type ApplyRequest struct {
+	Install []CARequest `json:"install,omitempty"`
+	Remove  []string    `json:"remove,omitempty"`
+	// Exclusive removes every CA the agent installed that Install does not
+	// list, making the payload the complete policy
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// ApplyResult reports the changes and the CAs managed afterwards
+type ApplyResult struct {
+	Backend   string      `json:"backend"`
+	Installed []string    `json:"installed,omitempty"`
+	Unchanged []string    `json:"unchanged,omitempty"`
+	Removed   []string    `json:"removed,omitempty"`
+	Managed   []Installed `json:"managed"`
+}
+
+// TaskHandler applies server trust store policy
+type TaskHandler struct {
+	manager *Manager
+	audit   *audit.Logger
+}
+
+// NewTaskHandler creates a handler changing the trust store through manager
+func NewTaskHandler(manager *Manager, auditLog *audit.Logger) *TaskHandler {
+	return &TaskHandler{manager: manager, audit: auditLog}
+}
+
+// Register installs the truststore.apply task handler
+func (h *TaskHandler) Register(registry *tasks.Registry) {
+	registry.Register(TASK_TRUSTSTORE_APPLY, h.handle)
+}
+
+func (h *TaskHandler) handle(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req ApplyRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+
+	// Validate everything first so a bad entry changes nothing
+	certs := make([]*x509.Certificate, len(req.Install))
+	wanted := map[string]bool{}
+	for i, ca := range req.Install {
+		if !validName.MatchString(ca.Name) {
+			return nil, tasks.Rejectf("invalid CA name %q", ca.Name)
+		}
+		if wanted[ca.Name] {
+			return nil, tasks.Rejectf("CA %q is listed twice", ca.Name)
+		}
+		wanted[ca.Name] = true
+		cert, err := ParseCA(ca.PEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ca.Name, err)
+		}
+		certs[i] = cert
+	}
+	remove := req.Remove
+	if req.Exclusive {
+		for _, entry := range h.manager.Installed() {
+			if !wanted[entry.Name] {
+				remove = append(remove, entry.Name)
+			}
+		}
+	}
+
+	result := &ApplyResult{}
+	if h.manager.backend != nil {
+		result.Backend = h.manager.backend.Name()
+	}
+	changed := false
+	var failed error
+	for i, ca := range req.Install {
+		entry, installed, err := h.manager.Install(ctx, ca.Name, certs[i], task.ID)
+		if err == nil && !installed {
+			result.Unchanged = append(result.Unchanged, ca.Name)
+			continue
+		}
+		h.record(task.ID, "truststore.install", ca.Name, certs[i].Subject.String(), Fingerprint(certs[i]), err)
+		if installed {
+			changed = true
+			result.Installed = append(result.Installed, ca.Name)
+			log.Printf("[INFO] Trusted %s as %s (%s)", entry.Subject, ca.Name, result.Backend)
+		}
+		if err != nil {
+			failed = err
+			break
+		}
+	}
+	for _, name := range remove {
+		if failed != nil {
+			break
+		}
+		entry, err := h.manager.Remove(ctx, name)
+		if err == nil && entry == nil {
+			continue
+		}
+		if err != nil {
+			h.record(task.ID, "truststore.remove", name, "", "", err)
+			failed = err
+			break
+		}
+		h.record(task.ID, "truststore.remove", name, entry.Subject, entry.SHA256, nil)
+		changed = true
+		result.Removed = append(result.Removed, name)
+		log.Printf("[INFO] Removed %s (%s) from the trust store", name, entry.Subject)
+	}
+
+	// Whatever went in must be visible, even if a later step failed
+	if changed {
+		if err := h.manager.Refresh(ctx); err != nil && failed == nil {
+			failed = fmt.Errorf("failed to refresh the trust store: %w", err)
+		}
+	}
+	result.Managed = h.manager.Installed()
+	return result, failed
+}
+
+func (h *TaskHandler) record(taskID, action, name, subject, fingerprint string, err error) {
+	entry := audit.Entry{
+		TaskID:  taskID,
+		Action:  action,
+		Target:  name,
+		Outcome: tasks.STATUS_SUCCEEDED,
+		Details: map[string]string{},
+	}
+	if h.manager.backend != nil {
+		entry.Details["backend"] = h.manager.backend.Name()
+	}
+	if subject != "" {
+		entry.Details["subject"] = subject
+		entry.Details["sha256"] = fingerprint
+	}
+	if err != nil {
+		entry.Outcome = tasks.STATUS_FAILED
+		entry.Error = err.Error()
+	}
+	if err := h.audit.Record(entry); err != nil {
+		log.Printf("[WARNING] Failed to write audit entry for task %s: %v", taskID, err)
+	}
+}
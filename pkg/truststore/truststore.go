@@ -0,0 +1,225 @@
+package truststore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/store"
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	COMMAND_TIMEOUT = 1 * time.Minute
+)
+
+// Installed is a CA the agent put in the OS trust store. Only these may be
+// updated or removed; roots shipped with the OS are never touched.
+type Installed struct {
+	Name        string    `json:"name"`
+	Subject     string    `json:"subject"`
+	SHA256      string    `json:"sha256"`
+	SHA1        string    `json:"sha1"`
+	Root        bool      `json:"root"`
+	NotAfter    time.Time `json:"not_after"`
+	Backend     string    `json:"backend"`
+	InstalledAt time.Time `json:"installed_at"`
+	TaskID      string    `json:"task_id,omitempty"`
+}
+
+// Backend adds and removes certificates in one platform's trust store
+type Backend interface {
+	Name() string
+	Add(ctx context.Context, cert *x509.Certificate, entry *Installed) error
+	Remove(ctx context.Context, entry *Installed) error
+	// Refresh rebuilds derived bundles after a batch of changes
+	Refresh(ctx context.Context) error
+}
+
+// Manager tracks the CAs the agent installed and applies changes to them
+type Manager struct {
+	mu        sync.Mutex
+	backend   Backend
+	blob      store.Blob
+	installed map[string]*Installed
+}
+
+// NewManager loads the record of installed CAs. backend is nil when the
+// platform's trust store tooling was not found.
+func NewManager(backend Backend, blob store.Blob) (*Manager, error) {
+	m := &Manager{backend: backend, blob: blob, installed: map[string]*Installed{}}
+	data, err := blob.Load()
+	if errors.Is(err, store.ErrNotFound) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust store record: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.installed); err != nil {
+		return nil, fmt.Errorf("invalid trust store record: %w", err)
+	}
+	return m, nil
+}
+
+// Installed lists the CAs the agent manages, by name
+func (m *Manager) Installed() []Installed {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Installed, 0, len(m.installed))
+	for _, entry := range m.installed {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Install adds a CA under name, replacing a different CA the agent had
+// installed under the same name. Installing the same CA again is a no-op.
+func (m *Manager) Install(ctx context.Context, name string, cert *x509.Certificate, taskID string) (*Installed, bool, error) {
+	if m.backend == nil {
+		return nil, false, tasks.Rejectf("no supported trust store found on this host")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &Installed{
+		Name:        name,
+		Subject:     cert.Subject.String(),
+		SHA256:      Fingerprint(cert),
+		SHA1:        sha1Hex(cert.Raw),
+		Root:        IsSelfSigned(cert),
+		NotAfter:    cert.NotAfter.UTC(),
+		Backend:     m.backend.Name(),
+		InstalledAt: time.Now().UTC(),
+		TaskID:      taskID,
+	}
+	previous := m.installed[name]
+	if previous != nil && previous.SHA256 == entry.SHA256 {
+		return previous, false, nil
+	}
+
+	if err := m.backend.Add(ctx, cert, entry); err != nil {
+		return nil, false, err
+	}
+	if previous != nil {
+		if err := m.backend.Remove(ctx, previous); err != nil {
+			return entry, true, fmt.Errorf("installed %s but failed to remove the CA it replaces: %w", name, err)
+		}
+	}
+	m.installed[name] = entry
+	return entry, true, m.save()
+}
+
+// Remove takes out a CA the agent installed; unknown names are a no-op
+func (m *Manager) Remove(ctx context.Context, name string) (*Installed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.installed[name]
+	if entry == nil {
+		return nil, nil
+	}
+	if m.backend == nil || m.backend.Name() != entry.Backend {
+		return nil, tasks.Rejectf("%s was installed in the %s trust store, which is not available", name, entry.Backend)
+	}
+	if err := m.backend.Remove(ctx, entry); err != nil {
+		return nil, err
+	}
+	delete(m.installed, name)
+	return entry, m.save()
+}
+
+// Refresh rebuilds the platform's bundles after changes
+func (m *Manager) Refresh(ctx context.Context) error {
+	if m.backend == nil {
+		return nil
+	}
+	return m.backend.Refresh(ctx)
+}
+
+func (m *Manager) save() error {
+	data, err := json.Marshal(m.installed)
+	if err != nil {
+		return err
+	}
+	if err := m.blob.Save(data); err != nil {
+		return fmt.Errorf("failed to save trust store record: %w", err)
+	}
+	return nil
+}
+
+// ParseCA decodes a single PEM CA certificate. Leaf certificates are
+// refused so the trust store never ends up trusting an end entity.
+func ParseCA(data string) (*x509.Certificate, error) {
+	block, rest := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, tasks.Rejectf("no PEM certificate found")
+	}
+	if next, _ := pem.Decode(rest); next != nil {
+		return nil, tasks.Rejectf("expected a single certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, tasks.Rejectf("invalid certificate: %v", err)
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return nil, tasks.Rejectf("%s is not a CA certificate", cert.Subject)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, tasks.Rejectf("%s expired on %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// Fingerprint is the lowercase hex SHA-256 of the certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsSelfSigned reports whether cert is a root rather than an intermediate.
+// Names and key identifiers are compared rather than the signature, which
+// Go refuses to check on the SHA-1 roots many stores still carry.
+func IsSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return false
+	}
+	return len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId)
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func encodePEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
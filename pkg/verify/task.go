@@ -0,0 +1,129 @@
+package verify
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/tasks"
+)
+
+const (
+	TASK_VERIFY_DEPLOYMENT = "deploy.verify"
+
+	// Servers may take a moment to pick up a reloaded certificate
+	VERIFY_ATTEMPTS = 3
+	VERIFY_BACKOFF  = 5 * time.Second
+)
+
+// ExternalChecker asks the API to connect to the target from the internet,
+// catching load balancers or CDNs that still serve an old certificate
+type ExternalChecker func(ctx context.Context, target Target) (*Result, error)
+
+// VerifyRequest is the payload of a deploy.verify task
+type VerifyRequest struct {
+	DeploymentID   string   `json:"deployment_id"`
+	Targets        []Target `json:"targets"`
+	ExpectedSHA256 string   `json:"expected_sha256,omitempty"`
+	CertificatePEM string   `json:"certificate_pem,omitempty"`
+	External       bool     `json:"external"`
+}
+
+// VerifyReport aggregates per-target results for a deployment
+type VerifyReport struct {
+	DeploymentID string    `json:"deployment_id"`
+	Status       string    `json:"status"`
+	Results      []*Result `json:"results"`
+}
+
+// TaskHandler runs post-deploy verification on server request
+type TaskHandler struct {
+	external ExternalChecker
+}
+
+// NewTaskHandler creates a handler; external may be nil
+func NewTaskHandler(external ExternalChecker) *TaskHandler {
+	return &TaskHandler{external: external}
+}
+
+// Register installs the deploy.verify task handler
+func (h *TaskHandler) Register(registry *tasks.Registry) {
+	registry.Register(TASK_VERIFY_DEPLOYMENT, h.handle)
+}
+
+func (h *TaskHandler) handle(ctx context.Context, task *tasks.Task) (interface{}, error) {
+	var req VerifyRequest
+	if err := tasks.Decode(task, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Targets) == 0 {
+		return nil, tasks.Rejectf("no targets to verify")
+	}
+
+	// Hex case differs between tools; Verify and the external checker's
+	// result are compared against the lowercase form
+	expected := strings.ToLower(req.ExpectedSHA256)
+	if expected == "" {
+		fingerprint, err := FingerprintPEM([]byte(req.CertificatePEM))
+		if err != nil {
+			return nil, tasks.Rejectf("expected certificate: %v", err)
+		}
+		expected = fingerprint
+	}
+
+	report := h.VerifyAll(ctx, req.DeploymentID, req.Targets, expected, req.External)
+	return report, nil
+}
+
+// VerifyAll checks every target (retrying to allow for reload latency) and
+// optionally repeats the check through the external checker
+func (h *TaskHandler) VerifyAll(ctx context.Context, deploymentID string, targets []Target, expected string, external bool) *VerifyReport {
+	report := &VerifyReport{DeploymentID: deploymentID, Status: STATUS_VERIFIED}
+
+	for _, target := range targets {
+		var result *Result
+		for attempt := 0; attempt < VERIFY_ATTEMPTS; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(VERIFY_BACKOFF):
+				}
+			}
+			result = Verify(ctx, target, expected)
+			if result.Status == STATUS_VERIFIED || ctx.Err() != nil {
+				break
+			}
+		}
+		report.add(result)
+
+		if external && h.external != nil {
+			extResult, err := h.external(ctx, target)
+			if err != nil {
+				extResult = &Result{
+					Target:    target,
+					Status:    STATUS_FAILED,
+					Checker:   "external",
+					Error:     err.Error(),
+					CheckedAt: time.Now().UTC(),
+				}
+			} else {
+				extResult.Checker = "external"
+				extResult.ExpectedFingerprint = expected
+				if extResult.ServedFingerprint != expected {
+					extResult.Status = STATUS_FAILED
+					extResult.Error = joinErrors(extResult.Error, "externally served certificate does not match")
+				}
+			}
+			report.add(extResult)
+		}
+	}
+
+	return report
+}
+
+func (r *VerifyReport) add(result *Result) {
+	r.Results = append(r.Results, result)
+	if result.Status != STATUS_VERIFIED {
+		r.Status = STATUS_FAILED
+	}
+}
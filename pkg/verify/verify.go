@@ -0,0 +1,193 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certfix/certfix-agent/pkg/idn"
+	"github.com/certfix/certfix-agent/pkg/intermediates"
+	"github.com/certfix/certfix-agent/pkg/netdial"
+)
+
+const (
+	STATUS_VERIFIED = "verified"
+	STATUS_FAILED   = "failed"
+
+	DIAL_TIMEOUT = 10 * time.Second
+)
+
+// Roots served chains are validated against; nil means the system roots.
+// Set once at startup, before any check runs.
+var roots *x509.CertPool
+
+// LoadRootCAs returns the system roots plus the CAs in the given PEM files,
+// so certificates from an internal CA can be verified
+func LoadRootCAs(files []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// SetRoots makes served chains validate against pool instead of the system
+// roots
+func SetRoots(pool *x509.CertPool) {
+	roots = pool
+}
+
+// Target is the public endpoint that should serve a deployed certificate
+type Target struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// Address returns host:port, defaulting to 443
+func (t Target) Address() string {
+	port := t.Port
+	if port == 0 {
+		port = 443
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+// Result reports what an endpoint served compared with what was expected
+type Result struct {
+	Target              Target    `json:"target"`
+	Status              string    `json:"status"`
+	Checker             string    `json:"checker"`
+	ExpectedFingerprint string    `json:"expected_fingerprint"`
+	ServedFingerprint   string    `json:"served_fingerprint,omitempty"`
+	ServedNotAfter      time.Time `json:"served_not_after,omitempty"`
+	ChainLength         int       `json:"chain_length,omitempty"`
+	ChainValid          bool      `json:"chain_valid"`
+	Error               string    `json:"error,omitempty"`
+	CheckedAt           time.Time `json:"checked_at"`
+}
+
+// Fingerprint returns the hex SHA-256 of a certificate's DER encoding
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FingerprintPEM returns the fingerprint of the first certificate in PEM data
+func FingerprintPEM(data []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", fmt.Errorf("no certificate found in PEM data")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return Fingerprint(cert), nil
+	}
+}
+
+// Verify connects to target, reads the served chain and checks that the leaf
+// matches expectedFingerprint and that the chain validates for the server
+// name against the system roots, or those set with SetRoots
+func Verify(ctx context.Context, target Target, expectedFingerprint string) *Result {
+	result := &Result{
+		Target:              target,
+		Status:              STATUS_FAILED,
+		Checker:             "agent",
+		ExpectedFingerprint: strings.ToLower(expectedFingerprint),
+		CheckedAt:           time.Now().UTC(),
+	}
+
+	serverName := target.ServerName
+	if serverName == "" {
+		serverName = target.Host
+	}
+	// SNI and SAN matching work on A-labels
+	if ascii, err := idn.ToASCII(serverName); err == nil {
+		serverName = ascii
+	}
+
+	dialer := &netdial.Dialer{Timeout: DIAL_TIMEOUT}
+	// Trust is evaluated below so a mismatch is reported, not just refused
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+
+	address := target.Address()
+	if ascii, err := idn.ToASCII(target.Host); err == nil {
+		address = Target{Host: ascii, Port: target.Port}.Address()
+	}
+	conn, err := dialer.DialTLS(ctx, "tcp", address, config)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to connect: %v", err)
+		return result
+	}
+	defer conn.Close()
+
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		result.Error = "server presented no certificate"
+		return result
+	}
+
+	leaf := chain[0]
+	result.ServedFingerprint = Fingerprint(leaf)
+	result.ServedNotAfter = leaf.NotAfter.UTC()
+	result.ChainLength = len(chain)
+
+	served := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		served.AddCert(cert)
+	}
+	intermediates.Default.Learn("served", chain[1:]...)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: served}); err != nil {
+		result.Error = fmt.Sprintf("served chain does not validate: %v", err)
+		// Tell an incomplete chain apart from an untrusted one
+		if _, err := intermediates.Default.Complete(ctx, leaf, chain[1:]); err == nil {
+			if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: intermediates.Default.Pool()}); err == nil {
+				result.Error += " (the server omits an intermediate certificate)"
+			}
+		}
+	} else {
+		result.ChainValid = true
+	}
+
+	if result.ServedFingerprint != result.ExpectedFingerprint {
+		result.Error = joinErrors(result.Error, "served certificate does not match the deployed certificate")
+		return result
+	}
+
+	if result.ChainValid {
+		result.Status = STATUS_VERIFIED
+	}
+	return result
+}
+
+func joinErrors(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "; " + b
+}
@@ -0,0 +1,221 @@
+package webserver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// apacheVHost accumulates TLS directives for one <VirtualHost> section
+type apacheVHost struct {
+	configFile string
+	line       int
+	listen     []string
+	names      []string
+	certFile   string
+	keyFile    string
+	chainFile  string
+}
+
+type apacheParser struct {
+	root string
+	// Files on the current include stack
+	visited map[string]bool
+	global  apacheVHost
+	usages  []CertUsage
+}
+
+// ParseApacheConfig parses an Apache httpd configuration (following
+// Include/IncludeOptional) and returns the certificate files used by each
+// virtual host
+func ParseApacheConfig(path string) ([]CertUsage, error) {
+	p := &apacheParser{
+		root:    filepath.Dir(path),
+		visited: make(map[string]bool),
+	}
+
+	// RHEL layouts keep the main config in conf/ under ServerRoot
+	if filepath.Base(p.root) == "conf" {
+		p.root = filepath.Dir(p.root)
+	}
+
+	var current *apacheVHost
+	if err := p.parseFile(path, 0, &current); err != nil {
+		return nil, err
+	}
+
+	// Server-wide certificate outside any vhost (mod_ssl default server)
+	if p.global.certFile != "" {
+		p.global.configFile = path
+		p.emit(&p.global)
+	}
+
+	return p.usages, nil
+}
+
+func (p *apacheParser) parseFile(path string, depth int, current **apacheVHost) error {
+	if depth > MAX_INCLUDE_DEPTH {
+		return fmt.Errorf("include depth exceeded at %s", path)
+	}
+	// Only a file already open further up the include chain is a cycle; a
+	// snippet shared by several virtual hosts is parsed for each of them
+	if p.visited[path] {
+		return nil
+	}
+	p.visited[path] = true
+	defer delete(p.visited, path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	var pending string
+	pendingLine := 0
+
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+
+		// Join backslash line continuations
+		if strings.HasSuffix(text, "\\") {
+			if pending == "" {
+				pendingLine = lineNo
+			}
+			pending += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		if pending != "" {
+			text = pending + text
+			pending = ""
+		} else {
+			pendingLine = lineNo
+		}
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		p.handleLine(path, pendingLine, text, depth, current)
+	}
+
+	return scanner.Err()
+}
+
+func (p *apacheParser) handleLine(path string, line int, text string, depth int, current **apacheVHost) {
+	if strings.HasPrefix(text, "<") {
+		section := strings.Trim(text, "<>")
+		fields := strings.Fields(section)
+		if len(fields) == 0 {
+			return
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "virtualhost":
+			*current = &apacheVHost{
+				configFile: path,
+				line:       line,
+				listen:     fields[1:],
+			}
+		case "/virtualhost":
+			if *current != nil {
+				p.emit(*current)
+				*current = nil
+			}
+		}
+		return
+	}
+
+	fields := splitApacheArgs(text)
+	if len(fields) < 2 {
+		return
+	}
+
+	target := &p.global
+	if *current != nil {
+		target = *current
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "serverroot":
+		p.root = fields[1]
+	case "include", "includeoptional":
+		for _, include := range resolveIncludes(p.root, fields[1]) {
+			if info, err := os.Stat(include); err == nil && info.IsDir() {
+				// Including a directory includes every file in it
+				entries, _ := filepath.Glob(filepath.Join(include, "*"))
+				for _, entry := range entries {
+					p.parseFile(entry, depth+1, current)
+				}
+				continue
+			}
+			p.parseFile(include, depth+1, current)
+		}
+	case "servername":
+		if *current != nil {
+			(*current).names = append([]string{fields[1]}, (*current).names...)
+		}
+	case "serveralias":
+		if *current != nil {
+			(*current).names = append((*current).names, fields[1:]...)
+		}
+	case "sslcertificatefile":
+		target.certFile = resolvePath(p.root, fields[1])
+	case "sslcertificatekeyfile":
+		target.keyFile = resolvePath(p.root, fields[1])
+	case "sslcertificatechainfile":
+		target.chainFile = resolvePath(p.root, fields[1])
+	}
+}
+
+func (p *apacheParser) emit(vhost *apacheVHost) {
+	if vhost.certFile == "" {
+		return
+	}
+
+	usage := CertUsage{
+		Server:      "apache",
+		ConfigFile:  vhost.configFile,
+		Line:        vhost.line,
+		ServerNames: vhost.names,
+		Listen:      vhost.listen,
+		CertFile:    vhost.certFile,
+		KeyFile:     vhost.keyFile,
+		ChainFile:   vhost.chainFile,
+	}
+	if len(vhost.names) > 0 {
+		usage.VHost = vhost.names[0]
+	}
+	p.usages = append(p.usages, usage)
+}
+
+// splitApacheArgs splits a directive into words, honouring double quotes
+func splitApacheArgs(text string) []string {
+	var fields []string
+	var b strings.Builder
+	inQuote := false
+
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case (r == ' ' || r == '\t') && !inQuote:
+			if b.Len() > 0 {
+				fields = append(fields, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		fields = append(fields, b.String())
+	}
+
+	return fields
+}
@@ -0,0 +1,202 @@
+package webserver
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Version probes shell out to the server binaries; never let one hang startup
+	VERSION_TIMEOUT = 5 * time.Second
+)
+
+// Server describes a detected TLS-terminating server installation
+type Server struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version,omitempty"`
+	Binary      string   `json:"binary,omitempty"`
+	ConfigPaths []string `json:"config_paths,omitempty"`
+}
+
+// detector describes how to find and identify one kind of server
+type detector struct {
+	name        string
+	binaries    []string
+	versionArgs []string
+	versionRe   *regexp.Regexp
+	configs     []string
+}
+
+var tomcatVersionRe = regexp.MustCompile(`Apache Tomcat Version ([0-9][^\s]*)`)
+
+var detectors = []detector{
+	{
+		name:        "nginx",
+		binaries:    []string{"nginx", "/usr/sbin/nginx", "/usr/local/sbin/nginx", "/usr/local/nginx/sbin/nginx"},
+		versionArgs: []string{"-v"},
+		versionRe:   regexp.MustCompile(`nginx/([0-9][^\s]*)`),
+		configs:     []string{"/etc/nginx/nginx.conf", "/usr/local/etc/nginx/nginx.conf", "/usr/local/nginx/conf/nginx.conf"},
+	},
+	{
+		name:        "apache",
+		binaries:    []string{"apache2", "httpd", "/usr/sbin/apache2", "/usr/sbin/httpd"},
+		versionArgs: []string{"-v"},
+		versionRe:   regexp.MustCompile(`Apache/([0-9][^\s]*)`),
+		configs:     []string{"/etc/apache2/apache2.conf", "/etc/httpd/conf/httpd.conf", "/usr/local/etc/httpd/httpd.conf"},
+	},
+	{
+		name:        "haproxy",
+		binaries:    []string{"haproxy", "/usr/sbin/haproxy", "/usr/local/sbin/haproxy"},
+		versionArgs: []string{"-v"},
+		versionRe:   regexp.MustCompile(`(?i)HA-?Proxy version ([0-9][^\s]*)`),
+		configs:     []string{"/etc/haproxy/haproxy.cfg", "/usr/local/etc/haproxy/haproxy.cfg"},
+	},
+	{
+		name:        "caddy",
+		binaries:    []string{"caddy", "/usr/bin/caddy", "/usr/local/bin/caddy"},
+		versionArgs: []string{"version"},
+		versionRe:   regexp.MustCompile(`v([0-9][^\s]*)`),
+		configs:     []string{"/etc/caddy/Caddyfile", "/etc/caddy/caddy.json"},
+	},
+	{
+		name:        "postfix",
+		binaries:    []string{"postconf", "/usr/sbin/postconf"},
+		versionArgs: []string{"-d", "mail_version"},
+		versionRe:   regexp.MustCompile(`mail_version\s*=\s*([0-9][^\s]*)`),
+		configs:     []string{"/etc/postfix/main.cf", "/etc/postfix/master.cf"},
+	},
+}
+
+// Detect returns every TLS-terminating server found on this host
+func Detect() []Server {
+	var servers []Server
+
+	for _, d := range detectors {
+		if server, ok := d.detect(); ok {
+			servers = append(servers, server)
+		}
+	}
+
+	if server, ok := detectTomcat(); ok {
+		servers = append(servers, server)
+	}
+
+	if runtime.GOOS == "windows" {
+		if server, ok := detectIIS(); ok {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+func (d detector) detect() (Server, bool) {
+	binary := findBinary(d.binaries)
+	configs := existingPaths(d.configs)
+	if binary == "" && len(configs) == 0 {
+		return Server{}, false
+	}
+
+	server := Server{
+		Name:        d.name,
+		Binary:      binary,
+		ConfigPaths: configs,
+	}
+
+	if binary != "" {
+		// Several servers print their version on stderr
+		output := runVersion(binary, d.versionArgs...)
+		if match := d.versionRe.FindStringSubmatch(output); len(match) > 1 {
+			server.Version = match[1]
+		}
+	}
+
+	return server, true
+}
+
+// detectTomcat looks for a Tomcat installation via CATALINA_HOME or the
+// usual package locations, reading the version from RELEASE-NOTES
+func detectTomcat() (Server, bool) {
+	candidates := []string{os.Getenv("CATALINA_HOME"), os.Getenv("CATALINA_BASE"), "/opt/tomcat"}
+	for _, pattern := range []string{"/usr/share/tomcat*", "/var/lib/tomcat*", "/opt/tomcat*"} {
+		matches, _ := filepath.Glob(pattern)
+		candidates = append(candidates, matches...)
+	}
+
+	for _, home := range candidates {
+		if home == "" {
+			continue
+		}
+		serverXML := filepath.Join(home, "conf", "server.xml")
+		if _, err := os.Stat(serverXML); err != nil {
+			continue
+		}
+
+		server := Server{
+			Name:        "tomcat",
+			ConfigPaths: []string{serverXML},
+		}
+		if data, err := os.ReadFile(filepath.Join(home, "RELEASE-NOTES")); err == nil {
+			if match := tomcatVersionRe.FindSubmatch(data); len(match) > 1 {
+				server.Version = string(match[1])
+			}
+		}
+		return server, true
+	}
+
+	return Server{}, false
+}
+
+// detectIIS reads the IIS version from the InetStp registry key
+func detectIIS() (Server, bool) {
+	output := runVersion("reg", "query", `HKLM\SOFTWARE\Microsoft\InetStp`, "/v", "VersionString")
+	re := regexp.MustCompile(`VersionString\s+REG_SZ\s+Version\s+([0-9.]+)`)
+	match := re.FindStringSubmatch(output)
+	if len(match) < 2 {
+		return Server{}, false
+	}
+
+	server := Server{
+		Name:    "iis",
+		Version: match[1],
+	}
+	config := filepath.Join(os.Getenv("windir"), "System32", "inetsrv", "config", "applicationHost.config")
+	if _, err := os.Stat(config); err == nil {
+		server.ConfigPaths = []string{config}
+	}
+	return server, true
+}
+
+// findBinary returns the first candidate that resolves to an executable
+func findBinary(candidates []string) string {
+	for _, candidate := range candidates {
+		if path, err := exec.LookPath(candidate); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func existingPaths(paths []string) []string {
+	var found []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+func runVersion(binary string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), VERSION_TIMEOUT)
+	defer cancel()
+
+	output, _ := exec.CommandContext(ctx, binary, args...).CombinedOutput()
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,250 @@
+package webserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// nginxToken is a word or punctuation token from an nginx config file
+type nginxToken struct {
+	text   string
+	line   int
+	quoted bool
+}
+
+// nginxBlock accumulates TLS directives for one server {} block
+type nginxBlock struct {
+	configFile  string
+	line        int
+	serverNames []string
+	listen      []string
+	certFile    string
+	keyFile     string
+	ownCert     bool
+}
+
+type nginxParser struct {
+	root string
+	// Files on the current include stack
+	visited map[string]bool
+	usages  []CertUsage
+}
+
+// ParseNginxConfig parses an nginx configuration (following include
+// directives) and returns the certificate files used by each server block
+func ParseNginxConfig(path string) ([]CertUsage, error) {
+	p := &nginxParser{
+		root:    filepath.Dir(path),
+		visited: make(map[string]bool),
+	}
+
+	// http-level ssl_certificate directives are inherited by server blocks
+	inherited := &nginxBlock{}
+	if err := p.parseFile(path, 0, inherited, nil); err != nil {
+		return nil, err
+	}
+	return p.usages, nil
+}
+
+func (p *nginxParser) parseFile(path string, depth int, inherited *nginxBlock, server *nginxBlock) error {
+	if depth > MAX_INCLUDE_DEPTH {
+		return fmt.Errorf("include depth exceeded at %s", path)
+	}
+	// Only a file already open further up the include chain is a cycle; a
+	// snippet shared by several server blocks is parsed for each of them
+	if p.visited[path] {
+		return nil
+	}
+	p.visited[path] = true
+	defer delete(p.visited, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tokens := tokenizeNginx(string(data))
+	_, err = p.parseBlock(path, tokens, 0, depth, inherited, server)
+	return err
+}
+
+// parseBlock consumes statements until the closing brace of the current block
+func (p *nginxParser) parseBlock(path string, tokens []nginxToken, pos, depth int, inherited *nginxBlock, server *nginxBlock) (int, error) {
+	for pos < len(tokens) {
+		tok := tokens[pos]
+		if !tok.quoted && tok.text == "}" {
+			return pos + 1, nil
+		}
+
+		// Collect the statement's words up to ";" or "{"
+		var words []string
+		start := tok.line
+		for pos < len(tokens) {
+			t := tokens[pos]
+			if !t.quoted && (t.text == ";" || t.text == "{" || t.text == "}") {
+				break
+			}
+			words = append(words, t.text)
+			pos++
+		}
+		if pos >= len(tokens) {
+			break
+		}
+
+		terminator := tokens[pos].text
+		if terminator == "}" {
+			// Missing semicolon before a closing brace; let the outer loop handle it
+			continue
+		}
+		pos++
+		if len(words) == 0 {
+			continue
+		}
+
+		if terminator == "{" {
+			var err error
+			if words[0] == "server" && server == nil {
+				block := &nginxBlock{
+					configFile: path,
+					line:       start,
+					certFile:   inherited.certFile,
+					keyFile:    inherited.keyFile,
+				}
+				pos, err = p.parseBlock(path, tokens, pos, depth, inherited, block)
+				p.emit(block)
+			} else if words[0] == "http" && server == nil {
+				// Server blocks inherit from this http {} context only
+				scope := *inherited
+				pos, err = p.parseBlock(path, tokens, pos, depth, &scope, server)
+			} else {
+				pos, err = p.parseBlock(path, tokens, pos, depth, inherited, server)
+			}
+			if err != nil {
+				return pos, err
+			}
+			continue
+		}
+
+		target := inherited
+		if server != nil {
+			target = server
+		}
+
+		switch words[0] {
+		case "include":
+			if len(words) > 1 {
+				for _, include := range resolveIncludes(p.root, words[1]) {
+					// Included files share the including context
+					if err := p.parseFile(include, depth+1, inherited, server); err != nil {
+						continue
+					}
+				}
+			}
+		case "server_name":
+			if server != nil {
+				server.serverNames = append(server.serverNames, words[1:]...)
+			}
+		case "listen":
+			if server != nil && len(words) > 1 {
+				server.listen = append(server.listen, strings.Join(words[1:], " "))
+			}
+		case "ssl_certificate":
+			if len(words) > 1 {
+				target.certFile = resolvePath(p.root, words[1])
+				target.ownCert = true
+			}
+		case "ssl_certificate_key":
+			if len(words) > 1 {
+				target.keyFile = resolvePath(p.root, words[1])
+			}
+		}
+	}
+
+	return pos, nil
+}
+
+func (p *nginxParser) emit(block *nginxBlock) {
+	if block.certFile == "" {
+		return
+	}
+
+	// An inherited http-level certificate only matters for TLS listeners
+	if !block.ownCert {
+		tls := false
+		for _, listen := range block.listen {
+			if strings.Contains(listen, "ssl") || strings.Contains(listen, "quic") {
+				tls = true
+			}
+		}
+		if !tls {
+			return
+		}
+	}
+
+	usage := CertUsage{
+		Server:      "nginx",
+		ConfigFile:  block.configFile,
+		Line:        block.line,
+		ServerNames: block.serverNames,
+		Listen:      block.listen,
+		CertFile:    block.certFile,
+		KeyFile:     block.keyFile,
+	}
+	if len(block.serverNames) > 0 {
+		usage.VHost = block.serverNames[0]
+	}
+	p.usages = append(p.usages, usage)
+}
+
+// tokenizeNginx splits config text into words, quoted strings and the
+// structural characters ; { }, dropping comments
+func tokenizeNginx(text string) []nginxToken {
+	var tokens []nginxToken
+	line := 1
+	i := 0
+
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, nginxToken{text: string(c), line: line})
+			i++
+		case c == '"' || c == '\'':
+			quote := c
+			startLine := line
+			i++
+			var b strings.Builder
+			for i < len(text) && text[i] != quote {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				if text[i] == '\n' {
+					line++
+				}
+				b.WriteByte(text[i])
+				i++
+			}
+			i++
+			tokens = append(tokens, nginxToken{text: b.String(), line: startLine, quoted: true})
+		default:
+			start := i
+			for i < len(text) && !strings.ContainsRune(" \t\r\n;{}#", rune(text[i])) {
+				i++
+			}
+			tokens = append(tokens, nginxToken{text: text[start:i], line: line})
+		}
+	}
+
+	return tokens
+}
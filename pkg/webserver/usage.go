@@ -0,0 +1,80 @@
+package webserver
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// Guard against include cycles and runaway glob expansion
+	MAX_INCLUDE_DEPTH = 16
+)
+
+// CertUsage links a certificate file to the virtual host that serves it
+type CertUsage struct {
+	Server      string   `json:"server"`
+	ConfigFile  string   `json:"config_file"`
+	Line        int      `json:"line"`
+	VHost       string   `json:"vhost,omitempty"`
+	ServerNames []string `json:"server_names,omitempty"`
+	Listen      []string `json:"listen,omitempty"`
+	CertFile    string   `json:"cert_file"`
+	KeyFile     string   `json:"key_file,omitempty"`
+	ChainFile   string   `json:"chain_file,omitempty"`
+}
+
+// FindCertUsages parses the configuration of every supported server in
+// servers and returns the certificate files referenced by their vhosts
+func FindCertUsages(servers []Server) []CertUsage {
+	var usages []CertUsage
+
+	for _, server := range servers {
+		for _, config := range server.ConfigPaths {
+			var found []CertUsage
+			var err error
+
+			switch server.Name {
+			case "nginx":
+				found, err = ParseNginxConfig(config)
+			case "apache":
+				found, err = ParseApacheConfig(config)
+			default:
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			usages = append(usages, found...)
+		}
+	}
+
+	sort.SliceStable(usages, func(i, j int) bool {
+		if usages[i].CertFile != usages[j].CertFile {
+			return usages[i].CertFile < usages[j].CertFile
+		}
+		return usages[i].VHost < usages[j].VHost
+	})
+	return usages
+}
+
+// resolveIncludes expands an include pattern relative to root
+func resolveIncludes(root, pattern string) []string {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(root, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// resolvePath makes a relative certificate path absolute against root
+func resolvePath(root, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
@@ -78,27 +78,11 @@ fi
 chmod +x "$BIN_PATH"
 echo "[INFO] Binary installed to $BIN_PATH"
 
-# Create systemd service
+# Create systemd service (unit includes the sandbox hardening directives)
 echo "[INFO] Creating systemd service..."
-cat > "/etc/systemd/system/$SERVICE_NAME.service" <<EOF
-[Unit]
-Description=CertFix Agent Service
-After=network.target
+"$BIN_PATH" service install
 
-[Service]
-ExecStart=$BIN_PATH start
-Restart=always
-RestartSec=5
-User=root
-WorkingDirectory=/etc/certfix-agent
-
-[Install]
-WantedBy=multi-user.target
-EOF
-
-# Enable and start service
-systemctl daemon-reload
-systemctl enable "$SERVICE_NAME"
+# Start service (enabled by "service install")
 systemctl start "$SERVICE_NAME"
 
 # Check service status
@@ -7,6 +7,7 @@ BIN_PATH="/usr/local/bin/certfix-agent"
 CONFIG_DIR="/etc/certfix-agent"
 CONFIG_FILE="$CONFIG_DIR/config.json"
 SERVICE_FILE="/etc/systemd/system/$SERVICE_NAME.service"
+SOCKET_FILE="/etc/systemd/system/$SERVICE_NAME.socket"
 
 echo "[INFO] Uninstalling Certfix Agent..."
 
@@ -22,15 +23,24 @@ if systemctl is-active --quiet "$SERVICE_NAME" 2>/dev/null; then
     systemctl stop "$SERVICE_NAME"
 fi
 
+# The control socket would start the agent again on the next connection
+if systemctl is-active --quiet "$SERVICE_NAME.socket" 2>/dev/null; then
+    systemctl stop "$SERVICE_NAME.socket"
+fi
+
 if systemctl is-enabled --quiet "$SERVICE_NAME" 2>/dev/null; then
     echo "[INFO] Disabling service..."
     systemctl disable "$SERVICE_NAME"
 fi
 
-# Remove service file
-if [ -f "$SERVICE_FILE" ]; then
+if systemctl is-enabled --quiet "$SERVICE_NAME.socket" 2>/dev/null; then
+    systemctl disable "$SERVICE_NAME.socket"
+fi
+
+# Remove service and socket files
+if [ -f "$SERVICE_FILE" ] || [ -f "$SOCKET_FILE" ]; then
     echo "[INFO] Removing service file..."
-    rm -f "$SERVICE_FILE"
+    rm -f "$SERVICE_FILE" "$SOCKET_FILE"
     systemctl daemon-reload
 fi
 
@@ -59,7 +69,7 @@ echo ""
 echo "Removed items:"
 echo "  - Service: $SERVICE_NAME"
 echo "  - Binary: $BIN_PATH"
-echo "  - Service file: $SERVICE_FILE"
+echo "  - Service files: $SERVICE_FILE, $SOCKET_FILE"
 if [[ "$remove_config" =~ ^[Yy]$ ]]; then
     echo "  - Configuration: $CONFIG_DIR"
 fi
@@ -0,0 +1,206 @@
+# Certfix Agent update script for Windows
+# Usage: powershell -ExecutionPolicy Bypass -File update.ps1 [-Yes]
+param(
+    [switch]$Yes
+)
+
+$ErrorActionPreference = "Stop"
+
+# GitHub repository and release info
+$RepoOwner = "certfix"
+$RepoName = "certfix-agent"
+$ServiceName = "certfix-agent"
+
+# Installation paths
+$BinPath = Join-Path $env:ProgramFiles "CertFix\certfix-agent.exe"
+$ConfigDir = Join-Path $env:ProgramData "CertFix\Agent"
+$ConfigFile = Join-Path $ConfigDir "config.json"
+$BackupDir = Join-Path $env:TEMP "certfix-agent-backup"
+
+function Write-Info($msg) { Write-Host "[INFO] $msg" -ForegroundColor Cyan }
+function Write-Success($msg) { Write-Host "[SUCCESS] $msg" -ForegroundColor Green }
+function Write-Warn($msg) { Write-Host "[WARNING] $msg" -ForegroundColor Yellow }
+function Write-Err($msg) { Write-Host "[ERROR] $msg" -ForegroundColor Red }
+
+function Get-CurrentVersion {
+    if (Test-Path $ConfigFile) {
+        $config = Get-Content $ConfigFile -Raw | ConvertFrom-Json
+        if ($config.current_version -and $config.current_version -ne "0.0.1") {
+            return $config.current_version
+        }
+    }
+    return "unknown"
+}
+
+# curl's rate limit in bytes per second from bandwidth.download_kbps, or 0
+function Get-DownloadLimit {
+    if (Test-Path $ConfigFile) {
+        $config = Get-Content $ConfigFile -Raw | ConvertFrom-Json
+        if ($config.bandwidth -and $config.bandwidth.download_kbps -gt 0) {
+            return [int64]$config.bandwidth.download_kbps * 125
+        }
+    }
+    return 0
+}
+
+function Get-LatestVersion {
+    $release = Invoke-RestMethod -UseBasicParsing "https://api.github.com/repos/$RepoOwner/$RepoName/releases/latest"
+    if (-not $release.tag_name) {
+        Write-Err "Failed to fetch latest version from GitHub"
+        exit 1
+    }
+    return $release.tag_name
+}
+
+function Test-VersionGreater($version1, $version2) {
+    try {
+        return [version]($version1.TrimStart("v")) -gt [version]($version2.TrimStart("v"))
+    } catch {
+        return $true
+    }
+}
+
+function Backup-Binary {
+    if (Test-Path $BinPath) {
+        Write-Info "Creating backup of current binary..."
+        New-Item -ItemType Directory -Force -Path $BackupDir | Out-Null
+        $script:BackupFile = Join-Path $BackupDir ("certfix-agent-backup-" + (Get-Date -Format "yyyyMMdd-HHmmss") + ".exe")
+        Copy-Item $BinPath $script:BackupFile
+        Write-Success "Backup created in $BackupDir"
+    }
+}
+
+function Update-ConfigVersion($newVersion) {
+    if (Test-Path $ConfigFile) {
+        $config = Get-Content $ConfigFile -Raw | ConvertFrom-Json
+        $config | Add-Member -NotePropertyName current_version -NotePropertyValue $newVersion -Force
+        # Windows PowerShell's UTF8 encoding writes a BOM the agent cannot parse
+        $json = $config | ConvertTo-Json -Depth 32
+        [IO.File]::WriteAllText($ConfigFile, $json, (New-Object Text.UTF8Encoding $false))
+    }
+}
+
+function Invoke-Rollback {
+    Write-Warn "Update failed. Attempting rollback..."
+    if ($script:BackupFile -and (Test-Path $script:BackupFile)) {
+        Stop-Service $ServiceName -ErrorAction SilentlyContinue
+        Copy-Item $script:BackupFile $BinPath -Force
+        Start-Service $ServiceName -ErrorAction SilentlyContinue
+        Write-Success "Rollback completed"
+    } else {
+        Write-Err "No backup found for rollback"
+    }
+}
+
+Write-Info "Certfix Agent Update Script"
+Write-Host "================================"
+
+$principal = New-Object Security.Principal.WindowsPrincipal([Security.Principal.WindowsIdentity]::GetCurrent())
+if (-not $principal.IsInRole([Security.Principal.WindowsBuiltInRole]::Administrator)) {
+    Write-Err "This script must be run from an elevated (Administrator) prompt"
+    exit 1
+}
+
+if (-not (Test-Path $BinPath)) {
+    Write-Err "Certfix Agent is not installed. Please install it first."
+    exit 1
+}
+
+$CurrentVersion = Get-CurrentVersion
+Write-Info "Current version: $CurrentVersion"
+
+Write-Info "Fetching latest version from GitHub..."
+$LatestVersion = Get-LatestVersion
+Write-Info "Latest version: $LatestVersion"
+
+if ($CurrentVersion -eq $LatestVersion) {
+    Write-Success "Already running the latest version ($CurrentVersion)"
+    exit 0
+}
+if ($CurrentVersion -ne "unknown" -and -not (Test-VersionGreater $LatestVersion $CurrentVersion)) {
+    Write-Success "Current version ($CurrentVersion) is newer than or equal to latest release ($LatestVersion)"
+    exit 0
+}
+
+Write-Info "Update available: $CurrentVersion -> $LatestVersion"
+
+if (-not $Yes) {
+    $confirm = Read-Host "Do you want to proceed with the update? (y/N)"
+    if ($confirm -notmatch "^[Yy]$") {
+        Write-Info "Update cancelled by user"
+        exit 0
+    }
+}
+
+$BinaryName = "certfix-agent-windows-amd64.exe"
+$DownloadUrl = "https://github.com/$RepoOwner/$RepoName/releases/download/$LatestVersion/$BinaryName"
+$TempBinary = Join-Path $env:TEMP "certfix-agent-new.exe"
+
+Write-Info "Download URL: $DownloadUrl"
+$DownloadLimit = Get-DownloadLimit
+$Curl = Get-Command curl.exe -ErrorAction SilentlyContinue
+try {
+    # Invoke-WebRequest can't limit its rate; curl.exe ships with Windows 10 and later
+    if ($DownloadLimit -gt 0 -and $Curl) {
+        Write-Info "Download limited to $($DownloadLimit / 125) kbit/s"
+        & $Curl.Source -fsSL --limit-rate $DownloadLimit $DownloadUrl -o $TempBinary
+        if ($LASTEXITCODE -ne 0) { throw "curl.exe exited with $LASTEXITCODE" }
+    } else {
+        if ($DownloadLimit -gt 0) {
+            Write-Warn "curl.exe not found, downloading without the bandwidth limit"
+        }
+        Invoke-WebRequest -UseBasicParsing $DownloadUrl -OutFile $TempBinary
+    }
+} catch {
+    Write-Err "Failed to download new version from $DownloadUrl"
+    exit 1
+}
+if (-not (Test-Path $TempBinary) -or (Get-Item $TempBinary).Length -eq 0) {
+    Write-Err "Downloaded file is empty or corrupted"
+    Remove-Item $TempBinary -ErrorAction SilentlyContinue
+    exit 1
+}
+
+Backup-Binary
+
+# A running service holds the executable open
+Write-Info "Stopping service..."
+$service = Get-Service $ServiceName -ErrorAction SilentlyContinue
+$ServiceWasRunning = $service -and $service.Status -eq "Running"
+if ($ServiceWasRunning) {
+    Stop-Service $ServiceName
+    $service.WaitForStatus("Stopped", (New-TimeSpan -Seconds 30))
+}
+
+Write-Info "Installing new binary..."
+try {
+    Move-Item $TempBinary $BinPath -Force
+} catch {
+    Write-Err "Failed to replace binary"
+    Invoke-Rollback
+    exit 1
+}
+
+Update-ConfigVersion $LatestVersion
+
+if ($ServiceWasRunning) {
+    Write-Info "Starting service..."
+    try {
+        Start-Service $ServiceName
+        Start-Sleep -Seconds 2
+        if ((Get-Service $ServiceName).Status -ne "Running") {
+            throw "service is not running"
+        }
+    } catch {
+        Write-Err "Service failed to start properly after update"
+        Invoke-Rollback
+        exit 1
+    }
+}
+
+Write-Success "Update completed successfully!"
+Write-Info "Updated from $CurrentVersion to $LatestVersion"
+
+# Clean old backups (keep last 5)
+Get-ChildItem $BackupDir -Filter "certfix-agent-backup-*" -ErrorAction SilentlyContinue |
+    Sort-Object LastWriteTime -Descending | Select-Object -Skip 5 | Remove-Item -Force
@@ -50,6 +50,24 @@ get_current_version() {
     echo "unknown"
 }
 
+# Function to get curl's rate limit from the agent's bandwidth.download_kbps
+get_download_limit() {
+    if [ -f "$CONFIG_FILE" ]; then
+        local kbps=""
+        if command -v jq &> /dev/null; then
+            kbps=$(jq -r '.bandwidth.download_kbps // empty' "$CONFIG_FILE" 2>/dev/null)
+        else
+            kbps=$(grep -o '"download_kbps"[[:space:]]*:[[:space:]]*[0-9]*' "$CONFIG_FILE" 2>/dev/null | grep -o '[0-9]*$')
+        fi
+        if [[ "$kbps" =~ ^[0-9]+$ ]] && [ "$kbps" -gt 0 ]; then
+            # kilobits to bytes per second
+            echo "$((kbps * 125))"
+            return
+        fi
+    fi
+    echo ""
+}
+
 # Function to get latest version from GitHub
 get_latest_version() {
     local latest=$(curl -fsSL "https://api.github.com/repos/${REPO_OWNER}/${REPO_NAME}/releases/latest" 2>/dev/null | grep '"tag_name"' | cut -d'"' -f4)
@@ -238,8 +256,14 @@ main() {
     print_info "Downloading new version for architecture: $ARCH"
     print_info "Download URL: $DOWNLOAD_URL"
     
-    # Download new binary
-    if ! curl -fsSL "$DOWNLOAD_URL" -o "$TEMP_BINARY"; then
+    # Download new binary, within the agent's bandwidth limit on thin links
+    CURL_LIMIT=()
+    DOWNLOAD_LIMIT=$(get_download_limit)
+    if [ -n "$DOWNLOAD_LIMIT" ]; then
+        print_info "Download limited to $((DOWNLOAD_LIMIT / 125)) kbit/s"
+        CURL_LIMIT=(--limit-rate "$DOWNLOAD_LIMIT")
+    fi
+    if ! curl -fsSL "${CURL_LIMIT[@]}" "$DOWNLOAD_URL" -o "$TEMP_BINARY"; then
         print_error "Failed to download new version from $DOWNLOAD_URL"
         exit 1
     fi